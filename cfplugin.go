@@ -91,7 +91,7 @@ func (c *CfPriam) Publish(cliConn plugin.CliConnection, args []string) {
 	log := &util.Logr{TraceOn: *trace, ErrW: os.Stdout, OutW: os.Stdout}
 	if cfg := &(util.Config{}); cfg.Init(log, c.defaultConfigFile) {
 		if ctx := cli.InitCtx(cfg, true); ctx != nil {
-			core.PublishApps(ctx, *manifile)
+			core.PublishApps(ctx, *manifile, false, true)
 		}
 	}
 }
@@ -17,6 +17,7 @@ package cli
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/howeyc/gopass"
 	"github.com/urfave/cli"
@@ -24,8 +25,12 @@ import (
 	. "github.com/vmware/priam/util"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -35,6 +40,15 @@ const (
 	accessTokenTypeOption = "accesstokentype"
 	refreshTokenOption    = "refreshtoken"
 	idTokenOption         = "idtoken"
+	tokenExpiryOption     = "accesstokenexpiry"
+	clientIDOption        = "clientid"
+	clientSecretEnvOption = "clientsecretenv"
+	scopeOption           = "scope"      // scopes requested at login, requested again to renew tokens
+	tokenScopeOption      = "tokenscope" // scopes granted to the access token
+	emailDomainOption     = "default-email-domain"
+	caseSensitiveOption   = "case-sensitive"
+	lowercaseNamesOption  = "lowercase-names"
+	displayNameOption     = "display-name-template"
 	cliClientSecret       = "not-a-secret"
 	defaultAwsCredFile    = ".aws/credentials"
 	defaultAwsProfile     = "priam"
@@ -44,6 +58,12 @@ const (
 // Initially a const, but now allowed to be a user-changeable value
 var cliClientID = "github.com-vmware-priam"
 
+// defaultCredentialStore is where tokens are saved if --credential-store is not given
+var defaultCredentialStore = CredentialsAuto
+
+// secretOptions are the options of targets saved in the credential store
+var secretOptions = []string{accessTokenOption, refreshTokenOption, idTokenOption}
+
 var cliClientRegistration = map[string]interface{}{"clientId": cliClientID, "secret": cliClientSecret,
 	"accessTokenTTL": 60 * 60, "authGrantTypes": "authorization_code refresh_token", "displayUserGrant": false,
 	"redirectUri": TokenCatcherURI, "refreshTokenTTL": 60 * 60 * 24 * 30, "scope": "openid user profile email admin"}
@@ -60,6 +80,14 @@ var registerDescription = `Registers this application as an OAuth2 client in the
       refresh token lifetime in seconds: ` + fmt.Sprintf("%v", cliClientRegistration["refreshTokenTTL"]) + `
 `
 
+var exitCodesDescription = fmt.Sprintf(`Exit codes:
+     %d  success
+     %d  error
+     %d  a resource was not found
+     %d  some operations of a bulk command failed, such as some users of 'user load'
+     %d  the command was interrupted, after printing what it did`,
+	ExitOK, ExitError, ExitNotFound, ExitPartial, ExitInterrupted)
+
 // service instances for CLI
 var usersService DirectoryService = &SCIMUsersService{}
 var groupsService DirectoryService = &SCIMGroupsService{}
@@ -72,6 +100,40 @@ var tokenServiceFactory TokenServiceFactory = &TokenServiceFactoryImpl{}
 var getRawPassword = gopass.GetPasswd // called via variable so that tests can provide stub
 var consoleInput io.Reader = os.Stdin // will be set to other readers for tests
 
+// settings of the requests made by a command, from the global options
+var requestOptions = struct {
+	maxAttempts int
+	timeout     time.Duration
+	context     context.Context // cancels the requests in flight
+	stopContext context.Context // stops commands from starting requests
+	transport   TransportOptions
+
+	traceBodyLimit int
+	rate           float64
+	auditFile      string
+	cache          *ResponseCache // nil with --no-cache
+	chosenID       string
+	caseSensitive  string // value of --case-sensitive if set, which overrides the option of the target
+	stats          *RequestStats
+	printStats     bool // --stats, the breakdown of requests is printed after any command
+	pageSize       int  // SCIM resources requested per page, the default of core if 0
+	har            *HarLog
+	harFile        string // --har, where the requests and responses are written once the command ends
+}{DefaultMaxAttempts, DefaultTimeout, context.Background(), context.Background(), TransportOptions{},
+	DefaultTraceBodyLimit, 0, "", nil, "", "", nil, false, 0, nil, ""}
+
+// path of the command that was run, such as "user load"
+var commandPath string
+
+// commandChanges is whether the command that was run may change the tenant,
+// in which case it prints where its requests go when it starts, unless
+// showDestination is false with both --quiet and --force.
+var commandChanges, showDestination bool
+
+// interruptGrace is how long the requests in flight may go on after an
+// interrupt before they are canceled
+var interruptGrace = 5 * time.Second
+
 func getArgOrPassword(log *Logr, prompt, arg string, repeat bool) string {
 	getPwd := func(prompt string) string {
 		log.Info("%s", prompt)
@@ -107,8 +169,11 @@ func getOptionalArg(log *Logr, prompt, arg string) string {
 }
 
 func InitCtx(cfg *Config, authn bool) *HttpContext {
-	if cfg.CurrentTarget == NoTarget {
-		cfg.Log.Err("Error: no target set\n")
+	if len(cfg.Targets) == 0 {
+		cfg.Log.Err("Error: no target set, add one with \"priam target <url> [name]\"\n")
+		return nil
+	} else if cfg.CurrentTarget == NoTarget {
+		cfg.Log.Err("Error: no target set, select one with \"priam target <name>\" or --target\n")
 		return nil
 	}
 	basePath := vidmBasePath
@@ -116,17 +181,152 @@ func InitCtx(cfg *Config, authn bool) *HttpContext {
 		basePath = "/SAAS" + vidmBasePath
 	}
 	ctx := NewHttpContext(cfg.Log, cfg.Option(HostOption), basePath, vidmBaseMediaType)
+	ctx.TargetName = cfg.CurrentTarget
+	ctx.MaxAttempts, ctx.Timeout = requestOptions.maxAttempts, requestOptions.timeout
+	ctx.TraceBodyLimit = requestOptions.traceBodyLimit
+	ctx.SetRate(requestOptions.rate).SetAudit(requestOptions.auditFile).SetCache(requestOptions.cache)
+	ctx.SetStats(requestOptions.stats).SetHar(requestOptions.har)
+	SetTokenScopes(ctx, cfg.Option(scopeOption), cfg.Option(tokenScopeOption))
+	ctx.WithContext(requestOptions.context).WithStop(requestOptions.stopContext)
+	if domain := cfg.Option(emailDomainOption); domain != "" {
+		SetDefaultEmailDomain(ctx, domain)
+	}
+	if requestOptions.chosenID != "" {
+		ChooseID(ctx, requestOptions.chosenID)
+	}
+	if requestOptions.pageSize > 0 {
+		SetPageSize(ctx, requestOptions.pageSize)
+	}
+	caseSensitive := StringOrDefault(requestOptions.caseSensitive, cfg.Option(caseSensitiveOption))
+	if exact, err := strconv.ParseBool(caseSensitive); err == nil {
+		ctx.SetCaseSensitiveNames(exact)
+	} else if caseSensitive != "" {
+		cfg.Log.Err("Error: invalid %s option of target %s: %s\n", caseSensitiveOption, cfg.CurrentTarget, caseSensitive)
+		return nil
+	}
+	if lowercase := cfg.Option(lowercaseNamesOption); lowercase != "" {
+		if on, err := strconv.ParseBool(lowercase); err == nil {
+			SetLowercaseNames(ctx, on)
+		} else {
+			cfg.Log.Err("Error: invalid %s option of target %s: %s\n", lowercaseNamesOption, cfg.CurrentTarget, lowercase)
+			return nil
+		}
+	}
+	if tmpl := cfg.Option(displayNameOption); tmpl != "" {
+		if err := SetDisplayNameTemplate(ctx, tmpl); err != nil {
+			cfg.Log.Err("Error: invalid %s option of target %s: %v\n", displayNameOption, cfg.CurrentTarget, err)
+			return nil
+		}
+	}
+	if err := ctx.SetTransport(requestOptions.transport); err != nil {
+		cfg.Log.Err("Error: %v\n", err)
+		return nil
+	}
 	if authn {
 		if token := cfg.Option(accessTokenOption); token == "" {
 			cfg.Log.Err("No access token saved for current target. Please log in.\n")
 			return nil
 		} else {
-			ctx.Authorization(cfg.Option(accessTokenTypeOption) + " " + token)
+			authorization := cfg.Option(accessTokenTypeOption) + " " + token
+			ctx.Authorization(authorization)
+			ctx.Principal, ctx.Client = TokenPrincipal(authorization), TokenClient(authorization)
+		}
+		if renew := tokenRenewer(cfg); renew != nil {
+			expiry, _ := time.Parse(time.RFC3339, cfg.Option(tokenExpiryOption))
+			ctx.SetReauthorizer(expiry, renew)
+		}
+		if commandChanges {
+			ctx.AnnounceTarget(showDestination)
 		}
 	}
 	return ctx
 }
 
+// setEmailDomain saves the default email domain of the current target, or
+// removes it if the domain is empty.
+func setEmailDomain(cfg *Config, domain string) {
+	if cfg.CurrentTarget == NoTarget {
+		cfg.Log.Err("Error: no target set, select one with \"priam target <name>\"\n")
+	} else if domain == "" {
+		if cfg.WithoutOptions(emailDomainOption).Save() {
+			cfg.Log.Info("Default email domain of target %s removed\n", cfg.CurrentTarget)
+		}
+	} else if cfg.WithOptions(map[string]string{emailDomainOption: domain}).Save() {
+		cfg.Log.Info("Default email domain of target %s set to %s\n", cfg.CurrentTarget, domain)
+	}
+}
+
+// tokenRenewer returns how to get a new access token with the grant used to
+// log in: the client credentials grant with the client ID and the environment
+// variable of the secret saved at login, or the refresh token grant. It
+// returns nil if the access token cannot be renewed. Grants that need the
+// user, such as the authorization code grant in a browser, are never used to
+// renew tokens, so that commands run by scripts do not wait for a login.
+func tokenRenewer(cfg *Config) Reauthorizer {
+	clientID, secretEnv, refreshToken := cfg.Option(clientIDOption), cfg.Option(clientSecretEnvOption),
+		cfg.Option(refreshTokenOption)
+	var grant func(ctx *HttpContext, tokenService TokenGrants) (TokenInfo, error)
+	if clientID != "" && secretEnv != "" {
+		grant = func(ctx *HttpContext, tokenService TokenGrants) (TokenInfo, error) {
+			secret := os.Getenv(secretEnv)
+			if secret == "" {
+				return TokenInfo{}, fmt.Errorf("environment variable %s of the client secret is not set", secretEnv)
+			}
+			return tokenService.ClientCredentialsGrant(ctx, clientID, secret)
+		}
+	} else if refreshToken != "" {
+		grant = func(ctx *HttpContext, tokenService TokenGrants) (TokenInfo, error) {
+			return tokenService.RefreshTokenGrant(ctx, refreshToken)
+		}
+	} else {
+		return nil
+	}
+	return func() (string, time.Time, error) {
+		ctx := InitCtx(cfg, false)
+		if ctx == nil {
+			return "", time.Time{}, fmt.Errorf("could not reach target %s", cfg.CurrentTarget)
+		}
+		ctx.TargetName = ""
+		tokenInfo, err := grant(ctx, tokenServiceFactory.GetTokenService(cfg, cliClientID, cliClientSecret))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		tokenInfo.RefreshToken = StringOrDefault(tokenInfo.RefreshToken, refreshToken)
+		tokenInfo.IDToken = StringOrDefault(tokenInfo.IDToken, cfg.Option(idTokenOption))
+		tokenInfo.Scope = StringOrDefault(tokenInfo.Scope, cfg.Option(tokenScopeOption))
+		saveTokens(cfg, tokenInfo, clientID, secretEnv)
+		return tokenInfo.AccessTokenType + " " + tokenInfo.AccessToken, tokenExpiry(tokenInfo), nil
+	}
+}
+
+// tokenExpiry returns when the access token expires, zero if unknown
+func tokenExpiry(tokenInfo TokenInfo) time.Time {
+	if tokenInfo.ExpiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(tokenInfo.ExpiresIn) * time.Second).UTC()
+}
+
+// saveTokens saves the tokens of a login with their expiry and scopes, and the
+// client ID and environment variable of the client secret if they can renew
+// the tokens.
+func saveTokens(cfg *Config, tokenInfo TokenInfo, clientID, secretEnv string) bool {
+	opts := map[string]string{accessTokenTypeOption: tokenInfo.AccessTokenType,
+		accessTokenOption: tokenInfo.AccessToken, refreshTokenOption: tokenInfo.RefreshToken,
+		idTokenOption: tokenInfo.IDToken}
+	cfg.WithoutOptions(tokenExpiryOption, clientIDOption, clientSecretEnvOption, tokenScopeOption)
+	if scopes := ParseScopes(tokenInfo.Scope); scopes != "" {
+		opts[tokenScopeOption] = scopes
+	}
+	if expiry := tokenExpiry(tokenInfo); !expiry.IsZero() {
+		opts[tokenExpiryOption] = expiry.Format(time.RFC3339)
+	}
+	if clientID != "" && secretEnv != "" {
+		opts[clientIDOption], opts[clientSecretEnvOption] = clientID, secretEnv
+	}
+	return cfg.WithOptions(opts).Save()
+}
+
 func initArgs(cfg *Config, c *cli.Context, minArgs, maxArgs int, validateArgs func([]string) bool) []string {
 	args := c.Args()
 	if args == nil {
@@ -155,6 +355,189 @@ func initCmd(cfg *Config, c *cli.Context, minArgs, maxArgs int, authn bool, vali
 	return
 }
 
+// targetCtx returns the context of a named target, from a copy of the config
+// so that each target renews its own access token.
+func targetCtx(cfg *Config, name string) *HttpContext {
+	target := *cfg
+	if err := target.UseTarget(name); err != nil {
+		cfg.Log.Err("Error: %v\n", err)
+		return nil
+	}
+	return InitCtx(&target, true)
+}
+
+// settings of a command run on several targets, from the global options
+var targetOptions = struct {
+	names    []string // nil to run the command on the current target only
+	failFast bool
+	force    bool
+}{}
+
+// commands that change the config file or read local files rather than
+// tenants, which are not run on several targets
+var configCommands = []string{"audit", "credentials", "login", "logout", "scaffold", "target", "targets", "token"}
+
+// commands that make many requests, after which a summary of the requests
+// is printed
+var bulkCommands = []string{"apply", "backup", "entitlement load", "entitlement orphans", "group export",
+	"user deactivate", "user delete", "user delete-all", "user load", "user reset-passwords", "user unentitled"}
+
+// commands that do not change tenants, which are run on several targets
+// without confirmation
+var readOnlyCommands = []string{"app get", "app list", "backup", "check", "client get", "client list", "compare", "diff",
+	"entitlement get", "group exists", "group export", "group get", "group list", "group search", "health", "policies",
+	"role get", "role list", "schema", "schemas", "scim get", "scim list", "scim types", "template get",
+	"template list", "user describe", "user exists", "user get", "user groups", "user list", "user unentitled"}
+
+// selectTargets returns the targets of --all-targets or of the comma
+// separated list of --targets, which must all be configured.
+func selectTargets(cfg *Config, target, list string, all bool) ([]string, error) {
+	if target != "" || (all && list != "") {
+		return nil, fmt.Errorf("only one of --target, --targets and --all-targets can be given")
+	}
+	if all {
+		if names := cfg.TargetNames(); len(names) > 0 {
+			return names, nil
+		}
+		return nil, fmt.Errorf("no targets are configured yet")
+	}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" && !HasString(name, names) {
+			if err := cfg.UseTarget(name); err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no target names given with --targets")
+	}
+	return names, nil
+}
+
+// changesTenants returns true if the command may change the tenants it is
+// run on. The tenant and localuserstore commands only do with settings.
+func changesTenants(path string, args []string) bool {
+	switch path {
+	case "tenant":
+		return len(args) > 1
+	case "localuserstore":
+		return len(args) > 0
+	}
+	return !HasString(path, readOnlyCommands)
+}
+
+// onTargets wraps the actions of the commands and their subcommands so that
+// they run on each target of --all-targets or --targets in turn.
+func onTargets(cfg *Config, cmds cli.Commands, parent string) cli.Commands {
+	for i := range cmds {
+		path := strings.TrimSpace(parent + " " + cmds[i].Name)
+		cmds[i].Subcommands = onTargets(cfg, cmds[i].Subcommands, path)
+		if action, ok := cmds[i].Action.(func(*cli.Context) error); ok {
+			cmds[i].Action = func(c *cli.Context) error {
+				commandPath = path
+				commandChanges = changesTenants(path, c.Args()) && !HasString(strings.Fields(path)[0], configCommands)
+				showDestination = !c.GlobalBool("quiet") || !c.GlobalBool("force") && !c.Bool("force")
+				if targetOptions.names == nil {
+					return action(c)
+				}
+				runOnTargets(cfg, c, path, action)
+				return nil
+			}
+		}
+	}
+	return cmds
+}
+
+// runOnTargets runs the action of a command on each target, prefixing its
+// output with the name of the target, and then prints which targets failed.
+// A failure stops the remaining targets only with --fail-fast.
+func runOnTargets(cfg *Config, c *cli.Context, path string, action func(*cli.Context) error) {
+	log, names := cfg.Log, targetOptions.names
+	if HasString(strings.Fields(path)[0], configCommands) {
+		log.Err("Command \"%s\" is about the config rather than tenants and cannot be run on several targets\n", path)
+		return
+	}
+	if changesTenants(path, c.Args()) && !targetOptions.force &&
+		!log.Confirm("Run \"%s\" on targets %s?", path, strings.Join(names, ", ")) {
+		log.Info("Command not run\n")
+		return
+	}
+	outW, errW := log.OutW, log.ErrW
+	codes, worst := make(map[string]int), log.TakeExitCode()
+	for _, name := range names {
+		if err := cfg.UseTarget(name); err != nil {
+			log.Err("%v\n", err)
+			return
+		}
+		out, errs := &prefixWriter{w: outW, prefix: "[" + name + "] "}, &prefixWriter{w: errW, prefix: "[" + name + "] "}
+		log.OutW, log.ErrW = out, errs
+		if err := action(c); err != nil {
+			log.Err("%v\n", err)
+		}
+		out.endLine()
+		errs.endLine()
+		log.OutW, log.ErrW = outW, errW
+		if codes[name] = log.TakeExitCode(); codes[name] > worst {
+			worst = codes[name]
+		}
+		if codes[name] != 0 && targetOptions.failFast {
+			break
+		}
+	}
+	var succeeded, failed, notRun []string
+	for _, name := range names {
+		if code, ran := codes[name]; !ran {
+			notRun = append(notRun, name)
+		} else if code == 0 {
+			succeeded = append(succeeded, name)
+		} else {
+			failed = append(failed, fmt.Sprintf("%s (exit code %d)", name, code))
+		}
+	}
+	log.Info("\nCommand \"%s\" succeeded on %d of %d targets\n", path, len(succeeded), len(names))
+	for _, result := range []struct {
+		title string
+		names []string
+	}{{"Succeeded", succeeded}, {"Failed", failed}, {"Not run", notRun}} {
+		if len(result.names) > 0 {
+			log.Info("%s: %s\n", result.title, strings.Join(result.names, ", "))
+		}
+	}
+	log.Fail(worst)
+}
+
+// prefixWriter starts each line written to w with a prefix, such as the name
+// of the target that a command is run on.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  string
+	midLine bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	var out []byte
+	for _, c := range b {
+		if !p.midLine {
+			out = append(out, p.prefix...)
+		}
+		out = append(out, c)
+		p.midLine = c != '\n'
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// endLine ends a line left incomplete, such as a prompt.
+func (p *prefixWriter) endLine() {
+	if p.midLine {
+		p.Write([]byte("\n"))
+	}
+}
+
 func initUserCmd(cfg *Config, c *cli.Context, getPwd bool) (*BasicUser, *HttpContext) {
 	maxArgs := 1
 	if getPwd {
@@ -164,14 +547,43 @@ func initUserCmd(cfg *Config, c *cli.Context, getPwd bool) (*BasicUser, *HttpCon
 	if args == nil {
 		return nil, nil
 	}
-	user := &BasicUser{Name: args[0], Given: c.String("given"),
-		Family: c.String("family"), Email: c.String("email")}
+	user := &BasicUser{Name: args[0], Given: c.String("given"), Family: c.String("family"),
+		Middle: c.String("middle"), Honorific: c.String("honorific"), Display: c.String("display"),
+		Email: c.String("email"), InternalUserType: c.String("internal-user-type")}
 	if getPwd {
 		user.Pwd = getArgOrPassword(cfg.Log, "Password", args[1], true)
+		return user, passwordOptions(c, InitCtx(cfg, true))
 	}
 	return user, InitCtx(cfg, true)
 }
 
+// clearedAttributes returns the paths of the attributes to remove: those of
+// --clear and those of the name flags explicitly set to an empty value.
+func clearedAttributes(c *cli.Context) []string {
+	var paths []string
+	paths = append(paths, c.StringSlice("clear")...)
+	for _, flag := range [][2]string{{"given", "name.givenName"}, {"family", "name.familyName"},
+		{"middle", "name.middleName"}, {"honorific", "name.honorificPrefix"}, {"display", "displayName"}} {
+		if c.IsSet(flag[0]) && c.String(flag[0]) == "" {
+			paths = append(paths, flag[1])
+		}
+	}
+	return paths
+}
+
+// passwordOptions makes the context check passwords against the password
+// policy of the tenant unless --skip-policy-check is set, and require users
+// to change them at next login if --must-change is set.
+func passwordOptions(c *cli.Context, ctx *HttpContext) *HttpContext {
+	if ctx != nil && !c.Bool("skip-policy-check") {
+		EnforcePasswordPolicy(ctx)
+	}
+	if ctx != nil && c.Bool("must-change") {
+		RequirePasswordChange(ctx)
+	}
+	return ctx
+}
+
 func checkTarget(cfg *Config) bool {
 	ctx, output := InitCtx(cfg, false), ""
 	if ctx == nil {
@@ -215,6 +627,162 @@ func cmdWithAuth1Arg(cfg *Config, cmd func(*HttpContext, string)) func(c *cli.Co
 	}
 }
 
+// cmdGetByName returns the action of a get command of users, groups or
+// roles, which lists those whose name matches with --match.
+func cmdGetByName(cfg *Config, display func(*HttpContext, string)) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+			if err := SetNameMatch(ctx, c.String("match")); err != nil {
+				cfg.Log.Err("Error: %v\n", err)
+			} else {
+				display(ctx, args[0])
+			}
+		}
+		return nil
+	}
+}
+
+// setRowCheck sets the checks of the rows of the file of a bulk command from
+// its --expect-at-least and --allow-partial options.
+func setRowCheck(ctx *HttpContext, c *cli.Context) {
+	SetRowCheck(ctx, RowCheck{ExpectAtLeast: c.Int("expect-at-least"), AllowPartial: c.Bool("allow-partial")})
+}
+
+// openCheckpoint returns the checkpoint of a bulk command that reads the
+// given file if the command records its progress, and false on errors.
+func openCheckpoint(ctx *HttpContext, c *cli.Context, fileName string) (*Checkpoint, bool) {
+	cpFile := c.String("checkpoint")
+	if cpFile == "" && !c.Bool("resume") {
+		return nil, true
+	}
+	cp, err := OpenCheckpoint(ctx.Log, StringOrDefault(cpFile, fileName+".checkpoint"), fileName, c.Bool("resume"))
+	if err != nil {
+		ctx.Log.Err("Could not open checkpoint: %v\n", err)
+		return nil, false
+	}
+	return cp, true
+}
+
+// startSummary starts the summary of a bulk command that reads the given
+// file if --summary-json is given, which is written once the command ends,
+// and returns false on errors.
+func startSummary(ctx *HttpContext, c *cli.Context, fileName string) bool {
+	summaryFile := c.String("summary-json")
+	if summaryFile == "" {
+		return true
+	} else if targetOptions.names != nil {
+		ctx.Log.Err("Error: --summary-json cannot be used with several targets\n")
+		return false
+	}
+	summary, err := StartRunSummary(summaryFile, commandPath, fileName, ctx.Destination())
+	if err != nil {
+		ctx.Log.Err("Error: %v\n", err)
+		return false
+	}
+	ctx.Log.Summary = summary
+	return true
+}
+
+// finishSummary writes the summary of a bulk command once it ended, with
+// the exit code of the command.
+func finishSummary(log *Logr, exitCode int) {
+	if log == nil || log.Summary == nil {
+		return
+	}
+	summary := log.Summary
+	log.Summary = nil
+	if err := summary.Finish(exitCode); err != nil {
+		log.Err("Error: %v\n", err)
+	}
+}
+
+// attrFilter matches a --filter option such as userName=joe or
+// emails.value~=@acme.com
+var attrFilter = regexp.MustCompile(`^([A-Za-z][\w.:-]*)(~?=)(.*)$`)
+
+// listFilter returns the SCIM filter of the --filter-expr and --filter
+// options, combined with AND. Values true and false are compared as booleans.
+// A --filter that is neither attr=value nor attr~=substring is used as an
+// expression, as it was before --filter-expr, with a warning.
+func listFilter(log *Logr, c *cli.Context) ScimFilter {
+	filters := []ScimFilter{RawFilter(c.String("filter-expr"))}
+	for _, f := range c.StringSlice("filter") {
+		m := attrFilter.FindStringSubmatch(f)
+		switch {
+		case m == nil:
+			log.Warn("--filter '%s' is not attr=value or attr~=substring, use --filter-expr for a filter expression\n", f)
+			filters = append(filters, RawFilter(f))
+		case m[2] == "~=":
+			filters = append(filters, Co(m[1], m[3]))
+		case m[3] == "true" || m[3] == "false":
+			filters = append(filters, Eq(m[1], m[3] == "true"))
+		default:
+			filters = append(filters, Eq(m[1], m[3]))
+		}
+	}
+	return And(filters...)
+}
+
+// userTypeOption returns the internal user type of the --user-type option in
+// upper case, empty if it is not given, and false if it is not valid.
+func userTypeOption(ctx *HttpContext, c *cli.Context) (string, bool) {
+	if c.String("user-type") == "" {
+		return "", true
+	}
+	userType, err := CheckUserType(c.String("user-type"))
+	if err != nil {
+		ctx.Log.Err("Error: %v\n", err)
+		return "", false
+	}
+	return userType, true
+}
+
+// cmdList returns the action of a command that lists SCIM resources
+func cmdList(cfg *Config, list func(*HttpContext, ListOptions)) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
+			if opts, ok := listOptions(ctx, c); ok {
+				list(ctx, opts)
+			}
+		}
+		return nil
+	}
+}
+
+// listOptions returns the options of a list command from its flags, and
+// false if one is not valid.
+func listOptions(ctx *HttpContext, c *cli.Context) (ListOptions, bool) {
+	opts := ListOptions{Count: c.Int("count"), SortBy: c.String("sort"), Descending: c.Bool("desc"),
+		CountOnly: c.Bool("count-only")}
+	var ok bool
+	if opts.DateWindow, ok = dateWindow(ctx, c); !ok {
+		return opts, false
+	}
+	filter := listFilter(ctx.Log, c)
+	if days := c.Int("inactive-days"); c.Bool("inactive") || days > 0 {
+		filter = And(filter, Eq("active", false))
+		// the earlier of --inactive-days and --modified-before
+		before := time.Now().AddDate(0, 0, -days)
+		if days > 0 && (opts.LastModifiedBefore.IsZero() || before.Before(opts.LastModifiedBefore)) {
+			opts.LastModifiedBefore = before
+		}
+	}
+	opts.Filter = filter.String()
+	opts.Dates, opts.UserStatus, opts.ShowUserType = c.Bool("dates"), c.Bool("user-status"), c.Bool("show-user-type")
+	if opts.UserType, ok = userTypeOption(ctx, c); !ok {
+		return opts, false
+	}
+	if pattern := c.String("grep"); pattern != "" {
+		var err error
+		if opts.Grep, err = regexp.Compile("(?i)" + pattern); err != nil {
+			ctx.Log.Err("Invalid --grep pattern: %v\n", err)
+			return opts, false
+		}
+	}
+	ctx.Log.VerboseOn = ctx.Log.VerboseOn || c.Bool("full")
+	return opts, true
+}
+
 func cmdWithAuth0Arg(cfg *Config, cmd func(*HttpContext)) func(c *cli.Context) error {
 	return func(c *cli.Context) error {
 		if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
@@ -232,7 +800,96 @@ func updateClientID(clientID string) {
 	cliClientID = clientID
 }
 
-func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
+// dateWindow returns the times of the --created-after, --created-before,
+// --modified-after and --modified-before flags, and false if one is not valid.
+func dateWindow(ctx *HttpContext, c *cli.Context) (DateWindow, bool) {
+	var w DateWindow
+	for _, flag := range []struct {
+		name string
+		time *time.Time
+	}{{"created-after", &w.CreatedAfter}, {"created-before", &w.CreatedBefore},
+		{"modified-after", &w.LastModifiedAfter}, {"modified-before", &w.LastModifiedBefore}} {
+		var err error
+		if *flag.time, err = parseTime(c.String(flag.name), false); err != nil {
+			ctx.Log.Err("Invalid --%s: %v\n", flag.name, err)
+			return w, false
+		}
+	}
+	return w, true
+}
+
+// parseTime parses a time such as 2020-01-31T12:00:00Z, or a date in UTC
+// such as 2020-01-31 which is the start of the day, or its end if end is true.
+func parseTime(s string, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("\"%s\" is not a date such as 2020-01-31 or a time such as 2020-01-31T12:00:00Z", s)
+	}
+	return t, nil
+}
+
+// openLogFile sets the log to also write records to the named file, which
+// is appended to, and returns the function that closes it.
+func openLogFile(log *Logr, fileName, format string, only bool) (func() error, error) {
+	noClose := func() error { return nil }
+	switch format {
+	case "json":
+		log.LogJSON = true
+	case "text":
+	default:
+		return noClose, fmt.Errorf("unknown log format \"%s\", supported formats are: json, text\n", format)
+	}
+	if fileName == "" {
+		if only {
+			return noClose, fmt.Errorf("--log-file-only requires --log-file\n")
+		}
+		return noClose, nil
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return noClose, fmt.Errorf("could not open log file: %v\n", err)
+	}
+	log.LogW, log.ConsoleOff = f, only
+	return f.Close, nil
+}
+
+// printStats prints a summary of the requests sent after bulk commands,
+// unless only results and errors are printed, or the summary and the
+// breakdown of the requests by path to ErrW after any command with --stats.
+func printStats(log *Logr, stats *RequestStats) {
+	if stats.Requests() == 0 {
+		return
+	}
+	if requestOptions.printStats {
+		fmt.Fprint(log.ErrW, stats.Summary()+stats.Breakdown())
+	} else if HasString(commandPath, bulkCommands) && !log.MachineFormat() {
+		log.Info("%s", stats.Summary())
+	}
+}
+
+// writeOutput replaces the file of --output with the results if the command
+// succeeded, even partially, or leaves it as it was otherwise.
+func writeOutput(log *Logr, output *OutputFile) {
+	if code := log.ExitCode(); code != ExitOK && code != ExitPartial {
+		log.Warn("Results were not written to the output file since the command failed\n")
+		return
+	}
+	if err := output.Commit(); err != nil {
+		log.Err("%v\n", err)
+	}
+}
+
+// Priam runs the command given by args and returns the exit code of the process
+func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) int {
 	var err error
 	cfg := &Config{}
 
@@ -240,41 +897,260 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 	// app level ErrWriter is ignored for some deprecation warnings.
 	cli.ErrWriter = errorW
 
+	// an interrupt stops commands from starting requests, and cancels the
+	// requests in flight after interruptGrace, so that commands can stop
+	// cleanly with their summary. A second interrupt kills the process as
+	// usual.
+	cmdContext, cancel := context.WithCancel(context.Background())
+	stopContext, stop := context.WithCancel(context.Background())
+	defer cancel()
+	defer stop()
+	requestOptions.context, requestOptions.stopContext = cmdContext, stopContext
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			signal.Stop(interrupts)
+			fmt.Fprintf(errorW, "Interrupted, stopping after the requests in flight, interrupt again to kill...\n")
+			stop()
+			select {
+			case <-time.After(interruptGrace):
+				cancel()
+			case <-cmdContext.Done():
+			}
+		case <-cmdContext.Done():
+		}
+	}()
+
+	closeTrace, closeLog := func() error { return nil }, func() error { return nil }
+	defer func() { closeTrace(); closeLog() }()
+	var output *OutputFile // of --output, discarded unless the command succeeds
+	defer func() {
+		if output != nil {
+			output.Discard()
+		}
+	}()
+
 	app := cli.NewApp()
 	app.Name, app.Usage = filepath.Base(args[0]), "a utility to interact with VMware Identity Manager"
 	app.Email, app.Author, app.Writer, app.ErrWriter = "", "", infoW, errorW
 	app.Action, app.Version = cli.ShowAppHelp, "1.0.0"
+	app.Description = exitCodesDescription
 	app.Flags = []cli.Flag{
+		cli.BoolFlag{Name: "all-targets", Usage: "run the command on each configured target in turn"},
+		cli.StringFlag{Name: "audit-file", EnvVar: "PRIAM_AUDIT_FILE",
+			Usage: "append a record of each request that may change the tenant to this file"},
+		cli.StringFlag{Name: "cacert", Usage: "PEM file of additional certificate authorities to trust"},
+		cli.BoolFlag{Name: "case-sensitive", Usage: "compare the names of users, groups and roles with case, " +
+			"default from the case-sensitive option of the target"},
+		cli.StringFlag{Name: "cert", Usage: "PEM file of the client certificate for mutual TLS"},
+		cli.StringFlag{Name: "color", Value: "auto", Usage: "color errors, warnings, planned changes and diffs: " +
+			"always, never or auto, on terminals unless NO_COLOR is set"},
+		cli.StringFlag{Name: "columns", Usage: "comma separated path labels of the only values printed of each " +
+			"result, such as userName,emails.0.value,active"},
 		cli.StringFlag{Name: "config", Usage: "specify config file. Def: " + defaultCfgFile},
+		cli.StringFlag{Name: "credential-store", Value: defaultCredentialStore,
+			Usage: "where tokens are saved: keyring, file, or auto to use the OS keyring if available"},
 		cli.BoolFlag{Name: "debug, d", Usage: "print debug output"},
+		cli.BoolFlag{Name: "fail-fast", Usage: "stop at the first target that fails with --all-targets or --targets"},
+		cli.BoolFlag{Name: "force", Usage: "do not ask for confirmation before changing several targets"},
+		cli.StringFlag{Name: "format, o", Value: "table", Usage: "output format of results: json, yaml, table or csv"},
+		cli.StringFlag{Name: "har", Usage: "write all requests and responses to this HAR file, without secrets, " +
+			"even if the command fails"},
+		cli.StringFlag{Name: "choose-id", Usage: "SCIM id of the resource to use when a name matches several resources"},
+		cli.BoolFlag{Name: "insecure, k", Usage: "do not verify server certificates, NOT secure"},
 		cli.BoolFlag{Name: "json, j", Usage: "prefer output in json rather than yaml"},
-		cli.BoolFlag{Name: "trace, t", Usage: "print all requests and responses"},
-		cli.BoolFlag{Name: "verbose, V", Usage: "print verbose output"},
+		cli.StringFlag{Name: "key", Usage: "PEM file of the key of the client certificate"},
+		cli.StringFlag{Name: "log-file", Usage: "also append a record of each message and result to this file"},
+		cli.BoolFlag{Name: "log-file-only", Usage: "print messages only to the log file, results are still printed"},
+		cli.StringFlag{Name: "log-format", Value: "text", Usage: "format of the records of the log file: text or json"},
+		cli.BoolFlag{Name: "no-cache", Usage: "do not reuse the responses to repeated requests, even if not modified"},
+		cli.StringFlag{Name: "output", Usage: "write results to this file rather than stdout, replaced only " +
+			"once the command completes"},
+		cli.BoolFlag{Name: "overwrite", Usage: "replace the file of --output if it exists"},
+		cli.IntFlag{Name: "page-size", Value: 500, Usage: "number of users, groups or roles requested per page, " +
+			"more pages are requested if the tenant returns fewer"},
+		cli.StringFlag{Name: "proxy", Usage: "URL of the proxy for all requests. Def: from HTTPS_PROXY and NO_PROXY"},
+		cli.StringFlag{Name: "query", Usage: "print only the values selected by a dotted path such as " +
+			"emails.0.value or a Go template such as '{{.id}} {{.userName}}'"},
+		cli.BoolFlag{Name: "quiet, q", Usage: "print only results and errors"},
+		cli.Float64Flag{Name: "rate", Usage: "maximum requests sent per second, including retries, no limit if 0"},
+		cli.IntFlag{Name: "retries", Value: DefaultMaxAttempts - 1,
+			Usage: "times to retry requests that fail because of throttling or a transient error"},
+		cli.BoolFlag{Name: "reverse", Usage: "print lists of results in reverse order"},
+		cli.StringFlag{Name: "sort-by", Usage: "path label of the value that lists of results are sorted by as " +
+			"numbers, dates or strings that ignore case, such as meta.created"},
+		cli.BoolFlag{Name: "strict", Usage: "fail if the query selects nothing"},
+		cli.DurationFlag{Name: "timeout", Value: DefaultTimeout,
+			Usage: "maximum time for each request, such as 90s or 5m, no limit if 0"},
+		cli.BoolFlag{Name: "stats", Usage: "print the requests sent by path, with retries, errors and latencies"},
+		cli.StringFlag{Name: "target", Usage: "name of the target to use for this command rather than the current one"},
+		cli.StringFlag{Name: "targets", Usage: "comma separated names of the targets to run the command on in turn"},
+		cli.BoolFlag{Name: "trace, t", Usage: "print all requests and responses to stderr, without secrets"},
+		cli.StringFlag{Name: "trace-file", Usage: "print all requests and responses to this file rather than stderr"},
+		cli.IntFlag{Name: "trace-max-body", Value: DefaultTraceBodyLimit,
+			Usage: "maximum bytes of each request or response body to trace, no limit if 0"},
+		cli.BoolFlag{Name: "verbose, V", Usage: "print all fields of results and debug output such as requests sent"},
 	}
 	app.Before = func(c *cli.Context) (err error) {
-		log := &Logr{DebugOn: c.Bool("debug"), TraceOn: c.Bool("trace"),
-			Style: LYaml, VerboseOn: c.Bool("verbose"), ErrW: errorW, OutW: infoW}
+		log := &Logr{TraceOn: c.Bool("trace"),
+			Style: LYaml, VerboseOn: c.Bool("verbose"), ErrW: errorW, OutW: infoW, InR: consoleInput}
 		if c.Bool("json") {
 			log.Style = LJson
 		}
+		if c.Bool("debug") || c.Bool("verbose") {
+			log.Level = LDebug
+		} else if c.Bool("quiet") {
+			log.Level = LError
+		}
+		if log.Format, err = ParseOutputFormat(c.String("format")); err != nil {
+			return fmt.Errorf("%v\n", err)
+		}
+		colorMode, err := ParseColorMode(c.String("color"))
+		if err != nil {
+			return fmt.Errorf("%v\n", err)
+		}
+		if query := c.String("query"); query != "" {
+			if log.Query, err = ParseQuery(query); err != nil {
+				return fmt.Errorf("%v\n", err)
+			}
+			log.Query.Strict = c.Bool("strict")
+		}
+		if columns := c.String("columns"); columns != "" {
+			log.Columns = strings.Split(columns, ",")
+		}
+		log.SortBy, log.Reverse = c.String("sort-by"), c.Bool("reverse")
+		requestOptions.maxAttempts, requestOptions.timeout = c.Int("retries")+1, c.Duration("timeout")
+		requestOptions.transport = TransportOptions{CAFile: c.String("cacert"), CertFile: c.String("cert"),
+			KeyFile: c.String("key"), Insecure: c.Bool("insecure"), ProxyURL: c.String("proxy")}
+		requestOptions.traceBodyLimit = c.Int("trace-max-body")
+		requestOptions.rate = c.Float64("rate")
+		requestOptions.auditFile = c.String("audit-file")
+		requestOptions.chosenID = c.String("choose-id")
+		if requestOptions.pageSize = c.Int("page-size"); requestOptions.pageSize <= 0 {
+			return fmt.Errorf("--page-size must be positive\n")
+		}
+		if requestOptions.caseSensitive = ""; c.IsSet("case-sensitive") {
+			requestOptions.caseSensitive = strconv.FormatBool(c.Bool("case-sensitive"))
+		}
+		requestOptions.stats, requestOptions.printStats = NewRequestStats(), c.Bool("stats")
+		if requestOptions.har, requestOptions.harFile = nil, c.String("har"); requestOptions.harFile != "" {
+			requestOptions.har = NewHarLog(c.App.Name, c.App.Version, requestOptions.traceBodyLimit)
+		}
+		if requestOptions.cache = nil; !c.Bool("no-cache") {
+			requestOptions.cache = NewResponseCache()
+		}
+		if traceFile := c.String("trace-file"); traceFile != "" {
+			f, err := os.Create(traceFile)
+			if err != nil {
+				return fmt.Errorf("could not create trace file: %v\n", err)
+			}
+			closeTrace, log.TraceOn, log.TraceW = f.Close, true, f
+		}
+		if closeLog, err = openLogFile(log, c.String("log-file"), c.String("log-format"),
+			c.Bool("log-file-only")); err != nil {
+			return err
+		}
+		if output = nil; c.String("output") != "" {
+			if output, err = CreateOutputFile(c.String("output"), c.Bool("overwrite")); err != nil {
+				return fmt.Errorf("%v\n", err)
+			}
+			log.OutW, log.ResultsOnly = output, true
+		}
+		log.SetColor(colorMode)
 		if !cfg.Init(log, StringOrDefault(c.String("config"), defaultCfgFile)) {
 			return fmt.Errorf("app initialization failed\n")
 		}
+		store, err := NewCredentialStore(c.String("credential-store"))
+		if err != nil {
+			return fmt.Errorf("%v\n", err)
+		}
+		cfg.KeepSecrets(store, secretOptions...)
+		targetOptions.names, targetOptions.failFast, targetOptions.force = nil, c.Bool("fail-fast"), c.Bool("force")
+		if all, list := c.Bool("all-targets"), c.String("targets"); all || list != "" {
+			if targetOptions.names, err = selectTargets(cfg, c.String("target"), list, all); err != nil {
+				return fmt.Errorf("%v\n", err)
+			}
+		} else if target := c.String("target"); target != "" {
+			if err = cfg.UseTarget(target); err != nil {
+				return fmt.Errorf("%v\n", err)
+			}
+		}
 		return nil
 	}
 
 	pageFlags := []cli.Flag{
 		cli.IntFlag{Name: "count", Usage: "maximum entries to get"},
-		cli.StringFlag{Name: "filter", Usage: "filter such as 'username eq \"joe\"' for SCIM resources"},
+		cli.BoolFlag{Name: "count-only", Usage: "only print the number of entries"},
+		cli.StringSliceFlag{Name: "filter", Usage: "only list entries with an attribute equal to a value, such as " +
+			"userName=joe, or containing a substring, such as emails.value~=@acme.com, may be repeated"},
+		cli.StringFlag{Name: "filter-expr", Usage: "SCIM filter expression such as 'userName sw \"jo\"', " +
+			"combined with --filter"},
+		cli.StringFlag{Name: "sort", Usage: "attribute to sort by, such as userName or name.familyName"},
+		cli.BoolFlag{Name: "desc", Usage: "sort in descending order"},
+		cli.BoolFlag{Name: "full", Usage: "get and print all attributes rather than a summary"},
+		cli.StringFlag{Name: "grep", Usage: "only print entries with a summary field that matches this regular " +
+			"expression, ignoring case unless it starts with (?-i)"},
+	}
+
+	dateWindowFlags := []cli.Flag{
+		cli.StringFlag{Name: "created-after", Usage: "only list entries created on or after this date, such as " +
+			"2020-01-31, or time, entries without a valid creation time are listed"},
+		cli.StringFlag{Name: "created-before", Usage: "only list entries created before this date, such as " +
+			"2020-01-31, or time, entries without a valid creation time are listed"},
+		cli.StringFlag{Name: "modified-after", Usage: "only list entries last modified on or after this date, " +
+			"such as 2020-01-31, or time, entries without a valid modification time are listed"},
+		cli.StringFlag{Name: "modified-before", Usage: "only list entries last modified before this date, " +
+			"such as 2020-01-31, or time, entries without a valid modification time are listed"},
+	}
+
+	dateFlags := append([]cli.Flag{
+		cli.BoolFlag{Name: "dates", Usage: "also print when each entry was created and last modified"},
+	}, dateWindowFlags...)
+
+	checkpointFlags := []cli.Flag{
+		cli.StringFlag{Name: "checkpoint", Usage: "file to record progress in, <fileName>.checkpoint with --resume"},
+		cli.BoolFlag{Name: "resume", Usage: "continue after the entries recorded in the checkpoint file"},
 	}
 
+	summaryFlag := cli.StringFlag{Name: "summary-json", Usage: "write what the command did with each row, " +
+		"with counts and the hash of the file, to this JSON file, also when the command fails"}
+
+	rowCheckFlags := []cli.Flag{
+		cli.IntFlag{Name: "expect-at-least", Usage: "fail before making any change if the file has fewer rows"},
+		cli.BoolFlag{Name: "allow-partial", Usage: "load the rows before the first that cannot be read, " +
+			"rather than fail"},
+	}
+
+	passwordFlags := []cli.Flag{
+		cli.BoolFlag{Name: "must-change", Usage: "require users to change the password at next login, " +
+			"fails if the tenant does not support it"},
+		cli.BoolFlag{Name: "skip-policy-check", Usage: "do not check passwords against the password policy " +
+			"of the tenant before sending them, for credentials that cannot get the policy"},
+	}
+
+	userTypeFlag := cli.StringFlag{Name: "user-type", Usage: "only users of this internal user type, one of " +
+		strings.Join(InternalUserTypes, ", ")}
+
+	allowDuplicateEmailFlag := cli.BoolFlag{Name: "allow-duplicate-email",
+		Usage: "only warn of users whose email is already used by another user"}
+
+	matchFlag := cli.StringFlag{Name: "match", Usage: "list the id and name of all those whose name starts with " +
+		"the name given with prefix, or contains it with contains"}
 	memberFlags := []cli.Flag{
 		cli.BoolFlag{Name: "delete, d", Usage: "delete member"},
 	}
 
-	userAttrFlags := []cli.Flag{cli.StringFlag{Name: "email", Usage: "email of the user account"},
+	userAttrFlags := []cli.Flag{
+		cli.StringFlag{Name: "display", Usage: "display name of the user account, composed with the " +
+			displayNameOption + " of the target if not set"},
+		cli.StringFlag{Name: "email", Usage: "email of the user account"},
 		cli.StringFlag{Name: "family", Usage: "family name of the user account"},
 		cli.StringFlag{Name: "given", Usage: "given name of the user account"},
+		cli.StringFlag{Name: "honorific", Usage: "honorific prefix of the user account, such as Dr."},
+		cli.StringFlag{Name: "middle", Usage: "middle name of the user account"},
 	}
 
 	templateFlags := []cli.Flag{
@@ -311,11 +1187,32 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Subcommands: []cli.Command{
 				{
 					Name: "add", Usage: "add applications to the catalog", ArgsUsage: "<manifestYAMLFile>",
-					Action: cmdWithAuth1Arg(cfg, appsService.Publish),
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "update, u", Usage: "update applications with the same name that already exist"},
+						cli.BoolFlag{Name: "force, f", Usage: "add applications even if one with the same name exists"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							appsService.Publish(ctx, args[0], c.Bool("force"), c.Bool("update"))
+						}
+						return nil
+					},
 				},
 				{
 					Name: "delete", Usage: "delete an app from the catalog", ArgsUsage: "<appName>",
-					Action: cmdWithAuth1Arg(cfg, appsService.Delete),
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "force, f", Usage: "do not ask for confirmation"},
+						cli.BoolFlag{Name: "remove-entitlements", Usage: "delete the app's entitlements first"},
+						cli.IntFlag{Name: "chunk-size", Value: DefaultEntitlementChunkSize,
+							Usage: "most entitlements removed in one bulk request"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							SetEntitlementChunkSize(ctx, c.Int("chunk-size"))
+							appsService.Delete(ctx, args[0], c.Bool("remove-entitlements"), c.Bool("force"))
+						}
+						return nil
+					},
 				},
 				{
 					Name: "get", Usage: "get information about an app", ArgsUsage: "<appName>",
@@ -323,16 +1220,121 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				},
 				{
 					Name: "list", Usage: "list all applications in the catalog", ArgsUsage: " ",
-					Flags: pageFlags,
+					Flags: []cli.Flag{
+						cli.IntFlag{Name: "count", Usage: "maximum entries to get"},
+						cli.StringFlag{Name: "filter", Usage: "only list apps with names containing this string"},
+						cli.BoolFlag{Name: "full", Usage: "print all app information in JSON rather than a summary"},
+					},
 					Action: func(c *cli.Context) error {
 						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
-							appsService.List(ctx, c.Int("count"), c.String("filter"))
+							appsService.List(ctx, c.Int("count"), c.String("filter"), c.Bool("full"))
 						}
 						return nil
 					},
 				},
 			},
 		},
+		{
+			Name: "apply", Aliases: []string{"restore"}, ArgsUsage: "<directory>",
+			Usage: "create the users, groups, group members and entitlements of a backup that are missing",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run", Usage: "only print the changes that would be made"},
+				cli.BoolFlag{Name: "prune", Usage: "then remove the users of the tenant that are not in the backup"},
+				cli.StringFlag{Name: "prune-action", Usage: "how users are pruned, " + PruneDeactivate + " or " + PruneDelete},
+				cli.StringFlag{Name: "prune-filter", Usage: "SCIM filter of the users that may be pruned"},
+				userTypeFlag,
+				cli.BoolFlag{Name: "force", Usage: "prune users without asking for confirmation"},
+				cli.BoolFlag{Name: "i-know-what-im-doing", Usage: "prune users of any type, including those synced " +
+					"from a directory, without --user-type"},
+				cli.IntFlag{Name: "expect-at-least", Usage: "fail before making any change if the backup has " +
+					"fewer users"},
+				cli.BoolFlag{Name: "allow-partial", Usage: "apply the rows of each file before the first that cannot " +
+					"be read, rather than fail"},
+				cli.IntFlag{Name: "member-batch-size", Value: DefaultMemberBatchSize, Usage: "most members added " +
+					"or removed with one patch of a group, halved down to one for patches that fail with 413 or time out"},
+			},
+			Action: func(c *cli.Context) error {
+				if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+					setRowCheck(ctx, c)
+					SetMemberBatchSize(ctx, c.Int("member-batch-size"))
+					opts := RestoreOptions{DryRun: c.Bool("dry-run")}
+					if c.Bool("prune") {
+						if opts.PruneAction = c.String("prune-action"); opts.PruneAction == "" {
+							ctx.Log.Err("--prune requires --prune-action=%s or --prune-action=%s\n", PruneDeactivate, PruneDelete)
+							return nil
+						}
+						opts.PruneFilter, opts.PruneAnyUserType = c.String("prune-filter"), c.Bool("i-know-what-im-doing")
+						opts.Force = c.Bool("force")
+						var ok bool
+						if opts.PruneUserType, ok = userTypeOption(ctx, c); !ok {
+							return nil
+						}
+					} else if c.String("prune-action") != "" || c.String("prune-filter") != "" || c.String("user-type") != "" ||
+						c.Bool("i-know-what-im-doing") || c.Bool("force") {
+						ctx.Log.Err("--prune-action, --prune-filter, --user-type, --i-know-what-im-doing and --force are " +
+							"only used with --prune\n")
+						return nil
+					}
+					Restore(ctx, args[0], opts)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "audit", ArgsUsage: "[auditFile]",
+			Usage: "print the records of the audit file, by default the one given with --audit-file",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "since", Usage: "only records from this date or time, such as 2020-01-31"},
+				cli.StringFlag{Name: "until", Usage: "only records before the end of this date, or before this time"},
+				cli.StringFlag{Name: "resource", Usage: "only records about the resource of this name or ID"},
+			},
+			Action: func(c *cli.Context) error {
+				args := initArgs(cfg, c, 0, 1, nil)
+				if args == nil {
+					return nil
+				}
+				fileName := StringOrDefault(args[0], requestOptions.auditFile)
+				if fileName == "" {
+					cfg.Log.Err("No audit file given, use --audit-file or give its name\n")
+					return nil
+				}
+				since, err := parseTime(c.String("since"), false)
+				if err != nil {
+					cfg.Log.Err("Invalid --since: %v\n", err)
+					return nil
+				}
+				until, err := parseTime(c.String("until"), true)
+				if err != nil {
+					cfg.Log.Err("Invalid --until: %v\n", err)
+					return nil
+				}
+				PrintAudit(cfg.Log, fileName, since, until, c.String("resource"))
+				return nil
+			},
+		},
+		{
+			Name: "backup", ArgsUsage: "<directory>",
+			Usage: "save the users, groups and entitlements of the tenant in files of a directory",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "parallel", Value: 2, Usage: "maximum number of exports that run at the same time"},
+			},
+			Action: func(c *cli.Context) error {
+				if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+					Backup(ctx, args[0], c.Int("parallel"))
+				}
+				return nil
+			},
+		},
+		{
+			Name: "check", Aliases: []string{"whoami"}, ArgsUsage: " ",
+			Usage: "check the target URL, TLS setup and access token, and show who is logged in",
+			Action: func(c *cli.Context) error {
+				if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
+					CmdCheck(ctx)
+				}
+				return nil
+			},
+		},
 		{
 			Name: "client", Usage: "oauth2 client application commands",
 			Subcommands: []cli.Command{
@@ -368,21 +1370,147 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				},
 			},
 		},
+		{
+			Name: "credentials", Usage: "commands for the saved tokens of targets",
+			Subcommands: []cli.Command{
+				{
+					Name: "clear", Usage: "delete the saved tokens of a target from the keyring and config file",
+					ArgsUsage: "[targetName]",
+					Action: func(c *cli.Context) error {
+						if args := initArgs(cfg, c, 0, 1, nil); args != nil {
+							cfg.ClearCredentials(args[0])
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name: "compare", ArgsUsage: "<targetA> <targetB>",
+			Usage: "print the users and groups only in one of two targets and those that differ",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "users-only", Usage: "only compare the users"},
+				cli.BoolFlag{Name: "groups-only", Usage: "only compare the groups"},
+			},
+			Action: func(c *cli.Context) error {
+				args := initArgs(cfg, c, 2, 2, func(args []string) bool {
+					if c.Bool("users-only") && c.Bool("groups-only") {
+						cfg.Log.Err("Only one of --users-only and --groups-only can be given\n")
+						return false
+					}
+					return true
+				})
+				if args == nil {
+					return nil
+				}
+				if a, b := targetCtx(cfg, args[0]), targetCtx(cfg, args[1]); a != nil && b != nil {
+					CompareTargets(a, b, CompareOptions{UsersOnly: c.Bool("users-only"), GroupsOnly: c.Bool("groups-only")})
+				}
+				return nil
+			},
+		},
+		{
+			Name: "diff", ArgsUsage: "<directory>",
+			Usage: "print how the users, groups and entitlements of a backup differ from those of the tenant",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "case-sensitive", Usage: "show names and emails that only differ in case as changes"},
+			},
+			Action: func(c *cli.Context) error {
+				if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+					Diff(ctx, args[0], c.Bool("case-sensitive"))
+				}
+				return nil
+			},
+		},
 		{
 			Name: "entitlement", Usage: "commands for entitlements",
 			Subcommands: []cli.Command{
 				{
-					Name: "get", ArgsUsage: "(group|user|app) <name>",
-					Usage: "gets entitlements for a specific user, app, or group",
+					Name: "add", ArgsUsage: "(group|role|user) <name> <appName>",
+					Usage: "entitles a specific user, group or role to an app",
+					Flags: []cli.Flag{cli.BoolFlag{Name: "id", Usage: "appName is a catalog item ID"},
+						cli.BoolFlag{Name: "dry-run", Usage: "only print the entitlement that would be created"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 3, 3, true, func(args []string) bool {
+							res := HasString(args[0], SubjectTypeNames())
+							if !res {
+								cfg.Log.Err("First parameter of 'add' must be one of: %s\n", strings.Join(SubjectTypeNames(), ", "))
+							}
+							return res
+						}); ctx != nil {
+							Entitle(ctx, args[0], args[1], args[2], EntitleOptions{AppByID: c.Bool("id"),
+								DryRun: c.Bool("dry-run")})
+						}
+						return nil
+					},
+				},
+				{
+					Name: "get", ArgsUsage: "(group|role|user|app) <name>",
+					Usage: "gets entitlements for a specific user, app, group or role",
+					Flags: []cli.Flag{cli.BoolFlag{Name: "id", Usage: "name is a SCIM ID or catalog item ID"},
+						cli.BoolFlag{Name: "effective", Usage: "also get the entitlements of the groups of the user, " +
+							"with how the user is entitled to each app"},
+						cli.IntFlag{Name: "parallel", Value: 4, Usage: "maximum number of groups whose entitlements " +
+							"are got at the same time with --effective"},
+					},
 					Action: func(c *cli.Context) error {
 						if args, ctx := initCmd(cfg, c, 2, 2, true, func(args []string) bool {
-							res := HasString(args[0], []string{"group", "user", "app"})
+							types := append(SubjectTypeNames(), "app")
+							res := HasString(args[0], types)
 							if !res {
-								cfg.Log.Err("First parameter of 'get' must be user, group or app\n")
+								cfg.Log.Err("First parameter of 'get' must be one of: %s\n", strings.Join(types, ", "))
+							} else if c.Bool("effective") && args[0] != "user" {
+								cfg.Log.Err("Only the entitlements of a user can be got with --effective\n")
+								res = false
 							}
 							return res
 						}); ctx != nil {
-							GetEntitlement(ctx, args[0], args[1])
+							if c.Bool("effective") {
+								GetEffectiveEntitlements(ctx, args[1], c.Bool("id"), c.Int("parallel"))
+							} else {
+								GetEntitlement(ctx, args[0], args[1], c.Bool("id"))
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name: "load", ArgsUsage: "<fileName>",
+					Usage: "entitles the subjects of a YAML file of app, subjectType, subject and policy rows",
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "ensure", Usage: "skip the subjects already entitled to the app"},
+						cli.BoolFlag{Name: "policy-update", Usage: "also update the activation policy of the " +
+							"entitlements that differ from their row, implies --ensure"},
+						cli.IntFlag{Name: "chunk-size", Value: DefaultEntitlementChunkSize,
+							Usage: "most entitlements sent in one bulk request"},
+						cli.BoolFlag{Name: "dry-run", Usage: "only print the entitlements that would be created or updated"},
+						summaryFlag,
+					}, rowCheckFlags...),
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil && startSummary(ctx, c, args[0]) {
+							setRowCheck(ctx, c)
+							SetEntitlementChunkSize(ctx, c.Int("chunk-size"))
+							LoadEntitlements(ctx, args[0], EntitlementLoadOptions{Ensure: c.Bool("ensure"),
+								PolicyUpdate: c.Bool("policy-update"), DryRun: c.Bool("dry-run")})
+						}
+						return nil
+					},
+				},
+				{
+					Name: "orphans", Usage: "lists the entitlements whose user, group or role no longer exists",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "clean", Usage: "delete the orphaned entitlements"},
+						cli.BoolFlag{Name: "dry-run", Usage: "with --clean, only print the entitlements that would be deleted"},
+						cli.BoolFlag{Name: "force, f", Usage: "do not ask for confirmation"},
+						cli.IntFlag{Name: "chunk-size", Value: DefaultEntitlementChunkSize,
+							Usage: "most entitlements deleted in one bulk request"},
+					},
+					Action: func(c *cli.Context) error {
+						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
+							SetEntitlementChunkSize(ctx, c.Int("chunk-size"))
+							OrphanedEntitlements(ctx, OrphanOptions{Clean: c.Bool("clean"), DryRun: c.Bool("dry-run"),
+								Force: c.Bool("force")})
 						}
 						return nil
 					},
@@ -393,18 +1521,40 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Name: "group", Usage: "commands for groups",
 			Subcommands: []cli.Command{
 				{
-					Name: "get", Usage: "get a specific group", ArgsUsage: "get <groupName>",
-					Action: cmdWithAuth1Arg(cfg, groupsService.DisplayEntity),
+					Name: "export", Usage: "writes the members of all groups to a CSV file", ArgsUsage: "<fileName>",
+					Flags: []cli.Flag{
+						cli.IntFlag{Name: "parallel", Value: 4, Usage: "maximum number of groups whose members " +
+							"are got at the same time"},
+						cli.BoolFlag{Name: "count", Usage: "add a memberCount column, 0 for the groups without members"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							ExportGroupMembers(ctx, args[0], GroupExportOptions{Parallel: c.Int("parallel"),
+								Count: c.Bool("count")})
+						}
+						return nil
+					},
 				},
 				{
-					Name: "list", Usage: "list all groups", ArgsUsage: " ", Flags: pageFlags,
+					Name: "exists", ArgsUsage: "<groupName>",
+					Usage: "exit with 0 if a group exists, 2 if it does not, or 1 on errors, printing nothing",
+					Flags: []cli.Flag{cli.BoolFlag{Name: "print-id", Usage: "print the id of the group if it exists"}},
 					Action: func(c *cli.Context) error {
-						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
-							groupsService.ListEntities(ctx, c.Int("count"), c.String("filter"))
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							Exists(ctx, "Groups", "displayName", args[0], c.Bool("print-id"))
 						}
 						return nil
 					},
 				},
+				{
+					Name: "get", Usage: "get a specific group", ArgsUsage: "get <groupName>",
+					Flags:  []cli.Flag{matchFlag},
+					Action: cmdGetByName(cfg, groupsService.DisplayEntity),
+				},
+				{
+					Name: "list", Usage: "list all groups", ArgsUsage: " ", Flags: append(dateFlags, pageFlags...),
+					Action: cmdList(cfg, groupsService.ListEntities),
+				},
 				{
 					Name: "member", Usage: "add or remove users from a group",
 					ArgsUsage: "<groupname> <username>", Flags: memberFlags,
@@ -415,6 +1565,46 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 						return nil
 					},
 				},
+				{
+					Name: "search", Usage: "search groups by part of their name", ArgsUsage: "<text>",
+					Flags: []cli.Flag{cli.BoolFlag{Name: "prefix", Usage: "only groups whose name starts with text"}},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							match := MatchContains
+							if c.Bool("prefix") {
+								match = MatchPrefix
+							}
+							SearchGroups(ctx, args[0], match)
+						}
+						return nil
+					},
+				},
+				{
+					Name: "update", Usage: "rename a group or set its description", ArgsUsage: "<groupName>",
+					Description: "--description \"\" removes the description of the group.\n",
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "name", Usage: "new name of the group, refused if another group has it"},
+						cli.StringFlag{Name: "description", Usage: "description of the group"},
+						cli.BoolFlag{Name: "id", Usage: "groupName is the SCIM ID of the group"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, func(args []string) bool {
+							if !c.IsSet("name") && !c.IsSet("description") {
+								cfg.Log.Err("Nothing to update, give --name or --description\n")
+								return false
+							} else if c.IsSet("name") && c.String("name") == "" {
+								cfg.Log.Err("The name of a group cannot be empty\n")
+								return false
+							}
+							return true
+						}); ctx != nil {
+							groupsService.UpdateEntity(ctx, args[0], &GroupUpdate{DisplayName: c.String("name"),
+								Description: c.String("description"), SetDescription: c.IsSet("description"),
+								ByID: c.Bool("id")})
+						}
+						return nil
+					},
+				},
 			},
 		},
 		{
@@ -443,15 +1633,26 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Flags: []cli.Flag{
 				cli.BoolFlag{Name: "authcode, a", Usage: "use browser to authenticate via oauth2 authorization code grant"},
 				cli.BoolFlag{Name: "client, c", Usage: "authenticate with oauth2 client ID and secret"},
+				cli.StringFlag{Name: "client-id", Usage: "authenticate as this oauth2 client, implies --client"},
+				cli.StringFlag{Name: "client-secret-env", Usage: "name of the environment variable with the " +
+					"client secret, implies --client. Expired access tokens are then renewed automatically"},
 				cli.StringFlag{Name: "id, i", Usage: "Override client id, default is " + cliClientID},
+				cli.StringFlag{Name: "scope", Usage: "OAuth2 scopes to request, separated by spaces or commas, " +
+					"such as \"admin\". Def: the scopes of the client"},
 			},
 			Action: func(c *cli.Context) (err error) {
 				if a, ctx := initCmd(cfg, c, 0, 2, false, nil); ctx != nil {
 					if c.String("id") != "" {
 						updateClientID(c.String("id"))
 					}
-					tokenInfo := TokenInfo{}
+					tokenInfo, clientID, secretEnv := TokenInfo{}, c.String("client-id"), c.String("client-secret-env")
 					tokenService := tokenServiceFactory.GetTokenService(cfg, cliClientID, cliClientSecret)
+					scopes, client := ParseScopes(c.String("scope")), c.Bool("client") || clientID != "" || secretEnv != ""
+					if scopes != "" && !client && !c.Bool("authcode") {
+						cfg.Log.Err("Error: scopes can only be requested with --client or --authcode\n")
+						return nil
+					}
+					SetTokenScopes(ctx, scopes, "")
 					if c.Bool("authcode") {
 						if tokenInfo, err = tokenService.AuthCodeGrant(ctx, a[0]); err != nil {
 							cfg.Log.Err("Error getting tokens via browser: %v\n", err)
@@ -459,20 +1660,34 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 						}
 					} else {
 						promptN, promptP, loginFunc := "Username", "Password", tokenService.LoginSystemUser
-						if c.Bool("client") {
+						if client {
 							promptN, promptP, loginFunc = "Client ID", "Secret", tokenService.ClientCredentialsGrant
 						}
+						if clientID != "" {
+							a = append([]string{clientID}, a[:1]...)
+						}
+						if secretEnv != "" {
+							if a[1] = os.Getenv(secretEnv); a[1] == "" {
+								cfg.Log.Err("Error: environment variable %s of the client secret is not set\n", secretEnv)
+								return nil
+							}
+						}
 						name := getOptionalArg(cfg.Log, promptN, a[0])
 						pwd := getArgOrPassword(cfg.Log, promptP, a[1], false)
 						if tokenInfo, err = loginFunc(ctx, name, pwd); err != nil {
 							cfg.Log.Err("Error getting access token: %v\n", err)
 							return nil
 						}
+						clientID = name
 					}
-					opts := map[string]string{accessTokenTypeOption: tokenInfo.AccessTokenType,
-						accessTokenOption: tokenInfo.AccessToken, refreshTokenOption: tokenInfo.RefreshToken,
-						idTokenOption: tokenInfo.IDToken}
-					if cfg.WithOptions(opts).Save() {
+					if missing := MissingScopes(scopes, tokenInfo.Scope); tokenInfo.Scope != "" && len(missing) > 0 {
+						cfg.Log.Warn("the access token was not granted the requested scopes: %s\n",
+							strings.Join(missing, " "))
+					}
+					if cfg.WithoutOptions(scopeOption); scopes != "" {
+						cfg.WithOptions(map[string]string{scopeOption: scopes})
+					}
+					if saveTokens(cfg, tokenInfo, clientID, secretEnv) {
 						cfg.Log.Info("Access token saved\n")
 					}
 				}
@@ -483,7 +1698,8 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Name: "logout", Usage: "deletes access token from configuration store for current target",
 			Action: func(c *cli.Context) error {
 				if args := initArgs(cfg, c, 0, 0, nil); args != nil &&
-					cfg.WithoutOptions(accessTokenTypeOption, accessTokenOption, refreshTokenOption, idTokenOption).Save() {
+					cfg.WithoutOptions(accessTokenTypeOption, accessTokenOption, refreshTokenOption, idTokenOption,
+						tokenExpiryOption, clientIDOption, clientSecretEnvOption, scopeOption, tokenScopeOption).Save() {
 					cfg.Log.Info("Access token removed\n")
 				}
 				return nil
@@ -503,16 +1719,12 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Subcommands: []cli.Command{
 				{
 					Name: "get", Usage: "get specific SCIM role", ArgsUsage: "<roleName>",
-					Action: cmdWithAuth1Arg(cfg, rolesService.DisplayEntity),
+					Flags:  []cli.Flag{matchFlag},
+					Action: cmdGetByName(cfg, rolesService.DisplayEntity),
 				},
 				{
 					Name: "list", ArgsUsage: " ", Usage: "list all roles", Flags: pageFlags,
-					Action: func(c *cli.Context) error {
-						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
-							rolesService.ListEntities(ctx, c.Int("count"), c.String("filter"))
-						}
-						return nil
-					},
+					Action: cmdList(cfg, rolesService.ListEntities),
 				},
 				{
 					Name: "member", Usage: "add or remove users from a role",
@@ -526,11 +1738,78 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				},
 			},
 		},
+		{
+			Name: "scaffold", ArgsUsage: "<format> [fileName]",
+			Usage: "write an example YAML file of a format that priam loads, or check a file with --validate",
+			Description: "Formats are " + strings.Join(ScaffoldFormats(), ", ") + ". The example is written to a new " +
+				"file, or printed\n   if no file name is given. --validate reads a file of the format as the command " +
+				"that loads it\n   would, and reports the problems of its entries without sending any request.\n",
+			Flags: []cli.Flag{cli.StringFlag{Name: "validate", Usage: "file to check rather than write an example"}},
+			Action: func(c *cli.Context) error {
+				validate := c.String("validate")
+				if args := initArgs(cfg, c, 1, 2, func(args []string) bool {
+					return validate == "" || args[1] == ""
+				}); args == nil {
+					return nil
+				} else if validate != "" {
+					ValidateFile(cfg.Log, args[0], validate)
+				} else {
+					Scaffold(cfg.Log, args[0], args[1])
+				}
+				return nil
+			},
+		},
 		{
 			Name: "schema", Usage: "get SCIM schema of specific type", ArgsUsage: "<type>",
 			Description: "Supported types are User, Group, Role, PasswordState, ServiceProviderConfig\n",
 			Action:      cmdWithAuth1Arg(cfg, CmdSchema),
 		},
+		{
+			Name: "schemas", Usage: "list the SCIM resource types and schemas of the target with their attributes",
+			ArgsUsage: " ",
+			Action: func(c *cli.Context) error {
+				if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
+					CmdSchemas(ctx)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "scim", Usage: "commands for resources of any SCIM resource type",
+			Subcommands: []cli.Command{
+				{
+					Name: "get", Usage: "get a resource of a SCIM resource type by name",
+					ArgsUsage: "<resourceType> <nameAttr> <name>", Flags: []cli.Flag{matchFlag},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 3, 3, true, nil); ctx != nil {
+							if err := SetNameMatch(ctx, c.String("match")); err != nil {
+								cfg.Log.Err("Error: %v\n", err)
+							} else {
+								ScimGet(ctx, args[0], args[1], args[2])
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name: "list", Usage: "list the resources of a SCIM resource type", ArgsUsage: "<resourceType>",
+					Flags: append([]cli.Flag{cli.StringFlag{Name: "name-attr", Value: "displayName",
+						Usage: "attribute that names the resources, printed with their id"}}, pageFlags...),
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							if opts, ok := listOptions(ctx, c); ok {
+								ScimList(ctx, args[0], c.String("name-attr"), opts)
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name: "types", Usage: "list the SCIM resource types of the target", ArgsUsage: " ",
+					Action: cmdWithAuth0Arg(cfg, ScimResourceTypes),
+				},
+			},
+		},
 		{
 			Name: "target", Usage: "set or display the target workspace instance",
 			ArgsUsage: "[newTargetURL] [targetName]",
@@ -538,6 +1817,8 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				cli.BoolFlag{Name: "force, f", Usage: "force target -- don't validate URL with health check"},
 				cli.BoolFlag{Name: "delete, d", Usage: "delete specified or current target"},
 				cli.BoolFlag{Name: "delete-all", Usage: "delete all targets"},
+				cli.StringFlag{Name: "default-email-domain", Usage: "set the email domain of users added without " +
+					"an email to the current target, or remove it if empty"},
 			},
 			Action: func(c *cli.Context) error {
 				if args := initArgs(cfg, c, 0, 2, nil); args != nil {
@@ -545,6 +1826,8 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 						cfg.Clear()
 					} else if c.Bool("delete") {
 						cfg.DeleteTarget(args[0], args[1])
+					} else if args[0] == "" && c.IsSet("default-email-domain") {
+						setEmailDomain(cfg, c.String("default-email-domain"))
 					} else if args[0] == "" {
 						cfg.PrintTarget("current")
 					} else if c.Bool("force") {
@@ -643,9 +1926,16 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 			Subcommands: []cli.Command{
 				{
 					Name: "add", Usage: "create a user account", ArgsUsage: "<userName> [password]",
-					Flags: userAttrFlags,
+					Flags: append(append(passwordFlags, userAttrFlags...), cli.StringFlag{Name: "internal-user-type",
+						Usage: "internal user type of the account, such as SERVICE for service accounts, one of " +
+							strings.Join(InternalUserTypes, ", ")}, allowDuplicateEmailFlag,
+						cli.BoolFlag{Name: "no-duplicate-check", Usage: "do not check for a user with the same " +
+							"userName or email before adding the user"}),
 					Action: func(c *cli.Context) error {
 						if user, ctx := initUserCmd(cfg, c, true); ctx != nil {
+							if !c.Bool("no-duplicate-check") {
+								CheckDuplicates(ctx, c.Bool("allow-duplicate-email"))
+							}
 							usersService.AddEntity(ctx, user)
 						}
 						return nil
@@ -653,29 +1943,153 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				},
 				{
 					Name: "get", Usage: "display user account", ArgsUsage: "<userName>",
-					Action: cmdWithAuth1Arg(cfg, usersService.DisplayEntity),
+					Flags:  []cli.Flag{matchFlag},
+					Action: cmdGetByName(cfg, usersService.DisplayEntity),
+				},
+				{
+					Name: "describe", ArgsUsage: "<userName>",
+					Usage:  "print a user account with the names of its groups and roles, and its entitlements",
+					Action: cmdWithAuth1Arg(cfg, DescribeUser),
+				},
+				{
+					Name: "exists", ArgsUsage: "<userName>",
+					Usage: "exit with 0 if a user exists, 2 if it does not, or 1 on errors, printing nothing",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "print-id", Usage: "print the id of the user if it exists"},
+						cli.BoolFlag{Name: "by-email", Usage: "find the user by email rather than userName"},
+					},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil && c.Bool("by-email") {
+							UserWithEmailExists(ctx, args[0], c.Bool("print-id"))
+						} else if ctx != nil {
+							Exists(ctx, "Users", "userName", args[0], c.Bool("print-id"))
+						}
+						return nil
+					},
 				},
 				{
 					Name: "delete", Usage: "delete user account", ArgsUsage: "<userName>",
 					Action: cmdWithAuth1Arg(cfg, usersService.DeleteEntity),
 				},
 				{
-					Name: "list", Usage: "list user accounts", ArgsUsage: " ",
-					Flags: pageFlags,
+					Name: "groups", ArgsUsage: "<userName>",
+					Usage: "list the groups of a user with their ids, and how they were found",
+					Flags: []cli.Flag{cli.BoolFlag{Name: "id", Usage: "userName is a SCIM ID"}},
 					Action: func(c *cli.Context) error {
-						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
-							usersService.ListEntities(ctx, c.Int("count"), c.String("filter"))
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							ListUserGroups(ctx, args[0], c.Bool("id"))
+						}
+						return nil
+					},
+				},
+				{
+					Name: "deactivate", Usage: "deactivate a user account rather than delete it", ArgsUsage: "<userName>",
+					Flags: []cli.Flag{cli.StringFlag{Name: "status", Usage: "workspace status of the user to set"}},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							SetUserActive(ctx, args[0], false, c.String("status"))
 						}
 						return nil
 					},
 				},
 				{
-					Name: "load", ArgsUsage: "<fileName>", Usage: "loads yaml file of an array of users.",
+					Name: "delete-all", Usage: "delete the user accounts named in a file", ArgsUsage: "<fileName>",
+					Description: "The file is a YAML list of user names or users as for 'user load', a CSV file\n" +
+						"of user names in the first column, or a text file with a user name on each line.\n",
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "deactivate-instead", Usage: "deactivate the users rather than delete them"},
+						cli.BoolFlag{Name: "force, f", Usage: "do not ask for confirmation"},
+						cli.StringFlag{Name: "status", Usage: "workspace status to set on deactivated users"},
+						userTypeFlag, summaryFlag,
+					}, checkpointFlags...),
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							userType, ok := userTypeOption(ctx, c)
+							if cp, cpOK := openCheckpoint(ctx, c, args[0]); ok && cpOK && startSummary(ctx, c, args[0]) {
+								DeleteUsers(ctx, args[0], c.Bool("deactivate-instead"), c.String("status"), userType,
+									c.Bool("force"), cp)
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name: "list", Usage: "list user accounts", ArgsUsage: " ",
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "inactive", Usage: "only list users that are not active"},
+						cli.IntFlag{Name: "inactive-days", Usage: "only list users that are not active and were last " +
+							"modified more than this number of days ago, or have no valid modification time"},
+						cli.BoolFlag{Name: "user-status", Usage: "also print the workspace status of each user, " +
+							"such as " + LockedStatus},
+						userTypeFlag,
+						cli.BoolFlag{Name: "show-user-type", Usage: "also print the internal user type of each user"},
+					}, append(dateFlags, pageFlags...)...),
+					Action: cmdList(cfg, usersService.ListEntities),
+				},
+				{
+					Name: "load", ArgsUsage: "<fileName>", Usage: "loads a YAML or CSV file of users.",
 					Description: "Example yaml file content:\n---\n- {name: joe, given: joseph, pwd: changeme}\n" +
-						"- {name: sue, given: susan, family: jones, email: sue@what.com}\n",
+						"- {name: sue, given: susan, family: jones, email: sue@what.com}\n" +
+						"- {name: backup-svc, pwd: changeme, internalUserType: SERVICE}\n" +
+						"- {name: ann, attrs: {name.middleName: lee, urn:scim:schemas:extension:workspace:1.0.department: hr}}\n" +
+						"\nUsers can also be under users, with defaults of their fields under defaults:\n" +
+						"---\ndefaults: {family: Sales, email: \"{{.Name}}@corp.example.org\"}\nusers:\n- {name: joe}\n" +
+						"\nCSV files have a header with the fields of the users, name first:\n" +
+						"userName,given,family,email\njoe,joseph,,joe@what.com\n",
+					Flags: append(append([]cli.Flag{cli.BoolFlag{Name: "keep-unknown-fields",
+						Usage: "add the unknown fields of users as SCIM attributes, like those of attrs"},
+						cli.BoolFlag{Name: "check-duplicates", Usage: "check for users with the same userName or " +
+							"email before adding users, with all users of the tenant got once"},
+						cli.IntFlag{Name: "bulk", Usage: "add users with SCIM bulk requests of this many users, " +
+							"or one request each if the tenant has no bulk endpoint"},
+						allowDuplicateEmailFlag, summaryFlag}, passwordFlags...), append(checkpointFlags, rowCheckFlags...)...),
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); passwordOptions(c, ctx) != nil {
+							setRowCheck(ctx, c)
+							if c.Bool("keep-unknown-fields") {
+								KeepUnknownFields(ctx)
+							}
+							if c.Bool("check-duplicates") {
+								CheckDuplicates(ctx, c.Bool("allow-duplicate-email"))
+							}
+							if c.Int("bulk") > 0 {
+								BulkUserLoad(ctx, c.Int("bulk"))
+							}
+							if cp, ok := openCheckpoint(ctx, c, args[0]); ok && startSummary(ctx, c, args[0]) {
+								usersService.LoadEntities(ctx, args[0], cp)
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name: "lock", Usage: "lock a user account without deactivating it", ArgsUsage: "<userName>",
+					Flags: []cli.Flag{cli.StringFlag{Name: "status", Value: LockedStatus,
+						Usage: "workspace status of the user to set"}},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							SetUserLocked(ctx, args[0], true, c.String("status"))
+						}
+						return nil
+					},
+				},
+				{
+					Name: "unlock", Usage: "unlock a locked user account", ArgsUsage: "<userName>",
+					Flags: []cli.Flag{cli.StringFlag{Name: "status", Value: UnlockedStatus,
+						Usage: "workspace status of the user to set"}},
 					Action: func(c *cli.Context) error {
 						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
-							usersService.LoadEntities(ctx, args[0])
+							SetUserLocked(ctx, args[0], false, c.String("status"))
+						}
+						return nil
+					},
+				},
+				{
+					Name: "reactivate", Usage: "activate a deactivated user account", ArgsUsage: "<userName>",
+					Flags: []cli.Flag{cli.StringFlag{Name: "status", Usage: "workspace status of the user to set"}},
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); ctx != nil {
+							SetUserActive(ctx, args[0], true, c.String("status"))
 						}
 						return nil
 					},
@@ -683,19 +2097,86 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 				{
 					Name: "password", Usage: "set a user's password", ArgsUsage: "<username> [password]",
 					Description: "If password is not given as an argument, user will be prompted to enter it",
+					Flags:       passwordFlags,
 					Action: func(c *cli.Context) error {
-						if args, ctx := initCmd(cfg, c, 1, 2, true, nil); ctx != nil {
+						if args, ctx := initCmd(cfg, c, 1, 2, true, nil); passwordOptions(c, ctx) != nil {
 							usersService.UpdateEntity(ctx, args[0], &BasicUser{Pwd: getArgOrPassword(cfg.Log, "Password", args[1], true)})
 						}
 						return nil
 					},
 				},
+				{
+					Name: "reset-passwords", Usage: "reset the passwords of the users of a file", ArgsUsage: "<fileName>",
+					Description: "The file is a CSV file of user names and passwords, or with --generate a file of user\n" +
+						"names as for 'user delete-all', in which case random passwords are generated and written\n" +
+						"to the output file. All users are looked up and their passwords checked before any is reset.\n" +
+						"Users whose password was not reset are saved in <fileName>.failed.<ext>.\n",
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "best-effort", Usage: "reset the passwords of the users that pass the " +
+							"pre-flight checks even if others do not"},
+						cli.BoolFlag{Name: "force, f", Usage: "do not ask for confirmation"},
+						cli.BoolFlag{Name: "generate", Usage: "generate random passwords for a file of user names"},
+						cli.StringFlag{Name: "passwords-file", Usage: "new file to write generated passwords to, " +
+							"<fileName>.passwords.csv by default"},
+						cli.IntFlag{Name: "parallel", Value: 4, Usage: "maximum number of users reset at the same time"},
+					}, passwordFlags...),
+					Action: func(c *cli.Context) error {
+						if args, ctx := initCmd(cfg, c, 1, 1, true, nil); passwordOptions(c, ctx) != nil {
+							ResetPasswords(ctx, args[0], ResetOptions{Generate: c.Bool("generate"),
+								Output: c.String("passwords-file"), Parallel: c.Int("parallel"),
+								BestEffort: c.Bool("best-effort"), Force: c.Bool("force")})
+						}
+						return nil
+					},
+				},
+				{
+					Name: "unentitled", Usage: "list the active users that are not entitled to any app", ArgsUsage: " ",
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "effective", Usage: "also count the entitlements of the groups of each user"},
+						cli.IntFlag{Name: "min-age", Usage: "only list users created at least this number of days ago"},
+						cli.StringFlag{Name: "csv-file", Usage: "CSV file to write the users to rather than print them"},
+						cli.IntFlag{Name: "parallel", Value: 4, Usage: "maximum number of users checked at the same time"},
+					}, dateWindowFlags...),
+					Action: func(c *cli.Context) error {
+						if _, ctx := initCmd(cfg, c, 0, 0, true, nil); ctx != nil {
+							if window, ok := dateWindow(ctx, c); ok {
+								UnentitledUsers(ctx, UnentitledOptions{Effective: c.Bool("effective"),
+									Parallel: c.Int("parallel"), MinAge: c.Int("min-age"), Output: c.String("csv-file"),
+									DateWindow: window})
+							}
+						}
+						return nil
+					},
+				},
 				{
 					Name: "update", Usage: "update user account", ArgsUsage: "<userName>",
-					Flags: userAttrFlags,
+					Description: "--email replaces the primary email of the user, other emails are kept.\n" +
+						"   --given \"\", --family \"\" and the other name flags set to \"\" clear the names of\n" +
+						"   the user, --clear removes any attribute, such as --clear name.givenName. A display\n" +
+						"   name is composed with the " + displayNameOption + " of the target when both --given\n" +
+						"   and --family are set without --display.\n",
+					Flags: append([]cli.Flag{
+						cli.StringSliceFlag{Name: "clear", Usage: "remove an attribute of the user, may be repeated"},
+						cli.BoolFlag{Name: "scim2", Usage: "send the update as a SCIM 2.0 PATCH request"},
+						cli.StringSliceFlag{Name: "add-email", Usage: "add an email to the user, may be repeated"},
+						cli.StringSliceFlag{Name: "remove-email", Usage: "remove an email of the user, may be repeated"},
+						cli.StringFlag{Name: "set-primary-email", Usage: "make an email the primary email of the user, " +
+							"adding it if the user does not have it"},
+					}, userAttrFlags...),
 					Action: func(c *cli.Context) error {
 						if user, ctx := initUserCmd(cfg, c, false); ctx != nil {
-							usersService.UpdateEntity(ctx, user.Name, user)
+							update := &UserUpdate{BasicUser: *user, AddEmails: c.StringSlice("add-email"),
+								RemoveEmails: c.StringSlice("remove-email"), PrimaryEmail: c.String("set-primary-email"),
+								Clear: clearedAttributes(c)}
+							if c.Bool("scim2") {
+								UseScim2Patch(ctx)
+							}
+							if len(update.AddEmails) > 0 || len(update.RemoveEmails) > 0 || update.PrimaryEmail != "" ||
+								len(update.Clear) > 0 {
+								usersService.UpdateEntity(ctx, user.Name, update)
+							} else {
+								usersService.UpdateEntity(ctx, user.Name, user)
+							}
 						}
 						return nil
 					},
@@ -704,7 +2185,31 @@ func Priam(args []string, defaultCfgFile string, infoW, errorW io.Writer) {
 		},
 	}
 
+	app.Commands = onTargets(cfg, app.Commands, "")
+
 	if err = app.Run(args); err != nil {
+		finishSummary(cfg.Log, 1)
 		fmt.Fprintln(errorW, "failed to run app: ", err)
+		return 1
+	}
+	if cfg.Log == nil {
+		return 0
+	}
+	if hits, conditional := requestOptions.cache.Stats(); conditional > 0 {
+		cfg.Log.Debug("Cache: %d of %d repeated GET requests were answered from the cache\n", hits, conditional)
+	}
+	printStats(cfg.Log, requestOptions.stats)
+	if requestOptions.har != nil {
+		if err := requestOptions.har.WriteFile(requestOptions.harFile); err != nil {
+			cfg.Log.Err("Error: %v\n", err)
+		}
+	}
+	if stopContext.Err() != nil {
+		cfg.Log.Fail(ExitInterrupted)
+	}
+	if output != nil {
+		writeOutput(cfg.Log, output)
 	}
+	finishSummary(cfg.Log, cfg.Log.ExitCode())
+	return cfg.Log.ExitCode()
 }
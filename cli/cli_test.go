@@ -17,8 +17,10 @@ package cli
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -32,6 +34,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -44,10 +47,16 @@ const (
 	healthApi               = "GET" + vidmBasePathTenantInUrl + "health"
 )
 
+// keep tokens of tests out of the keyring of the user running the tests
+func init() {
+	defaultCredentialStore = CredentialsFile
+}
+
 type tstCtx struct {
 	t                              *testing.T
 	appName, cfg, input, info, err string
 	printResults                   bool
+	exitCode                       int
 }
 
 func (ctx *tstCtx) printOut() *tstCtx {
@@ -104,7 +113,7 @@ func runner(ctx *tstCtx, args ...string) *tstCtx {
 	defer CleanupTempFile(cfgFile)
 	args = append([]string{ctx.appName}, args...)
 	infoW, errW := bytes.Buffer{}, bytes.Buffer{}
-	Priam(args, cfgFile.Name(), &infoW, &errW)
+	ctx.exitCode = Priam(args, cfgFile.Name(), &infoW, &errW)
 	_, err := cfgFile.Seek(0, 0)
 	require.Nil(ctx.t, err)
 	contents, err := ioutil.ReadAll(cfgFile)
@@ -224,6 +233,89 @@ current target is: 1, https://radio1.example.com
 
 }
 
+func TestTargetOption(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--target", "staging", "target")
+	ctx.assertOnlyInfoContains("current target is: staging, https://radio2.example.com")
+	assert.Contains(t, ctx.cfg, "currenttarget: 1\n")
+}
+
+func TestUnknownTargetOption(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--target", "prod", "target")
+	assert.Contains(t, ctx.err, `unknown target "prod", targets are: 1, radio, staging`)
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+// runOnTwoTargets runs a command with a config of targets 1 and 2, each with its own server.
+func runOnTwoTargets(t *testing.T, paths1, paths2 map[string]TstHandler, args ...string) *tstCtx {
+	srv1, srv2 := StartTstServer(t, paths1), StartTstServer(t, paths2)
+	defer srv1.Close()
+	defer srv2.Close()
+	second := tstSrvTgtWithAuth(srv2.URL)
+	cfg := tstSrvTgtWithAuth(srv1.URL) + "  2:\n" + second[strings.Index(second, "  1:\n")+len("  1:\n"):]
+	return runner(newTstCtx(t, cfg), args...)
+}
+
+func TestAllTargetsRunsCommandOnEachTarget(t *testing.T) {
+	good := map[string]TstHandler{healthApi: healthHandler(true)}
+	bad := map[string]TstHandler{healthApi: ErrorHandler(500, "favourite 500 error")}
+	ctx := runOnTwoTargets(t, good, bad, "--all-targets", "health")
+	assert.Contains(t, ctx.info, "[1] allOk: true\n")
+	assert.Contains(t, ctx.err, "[2] ")
+	assert.Contains(t, ctx.err, "favourite 500 error")
+	assert.Contains(t, ctx.info, "Command \"health\" succeeded on 1 of 2 targets\nSucceeded: 1\nFailed: 2 (exit code 1)\n")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestFailFastStopsAtFirstFailedTarget(t *testing.T) {
+	good := map[string]TstHandler{healthApi: healthHandler(true)}
+	bad := map[string]TstHandler{healthApi: ErrorHandler(500, "favourite 500 error")}
+	ctx := runOnTwoTargets(t, good, bad, "--targets", "2,1", "--fail-fast", "health")
+	assert.NotContains(t, ctx.info, "allOk")
+	assert.Contains(t, ctx.info, "Failed: 2 (exit code 1)\nNot run: 1\n")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestChangingSeveralTargetsAsksForConfirmation(t *testing.T) {
+	consoleInput = strings.NewReader("n\n")
+	ctx := runOnTwoTargets(t, nil, nil, "--all-targets", "localuserstore", "showLocalUserStore=false")
+	ctx.assertOnlyInfoContains("Run \"localuserstore\" on targets 1, 2? [y/N]: Command not run\n")
+	assert.Equal(t, 0, ctx.exitCode)
+}
+
+func TestForceChangesSeveralTargets(t *testing.T) {
+	paths := map[string]TstHandler{"PUT/SAAS/jersey/manager/api/localuserstore": GoodPathHandler(`{}`)}
+	ctx := runOnTwoTargets(t, paths, paths, "--all-targets", "--force", "localuserstore", "showLocalUserStore=false")
+	assert.Contains(t, ctx.info, "[1] Using target 1, http://127.0.0.1")
+	assert.Contains(t, ctx.info, "[2] Using target 2, http://127.0.0.1")
+	assert.Contains(t, ctx.info, "Command \"localuserstore\" succeeded on 2 of 2 targets\nSucceeded: 1, 2\n")
+	assert.Empty(t, ctx.err)
+	assert.Equal(t, 0, ctx.exitCode)
+}
+
+func TestConfigCommandsAreNotRunOnSeveralTargets(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--all-targets", "logout")
+	ctx.assertOnlyErrContains("Command \"logout\" is about the config rather than tenants")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestTargetsCannotBeUsedWithTarget(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--target", "radio", "--targets", "1,staging", "health")
+	assert.Contains(t, ctx.err, "only one of --target, --targets and --all-targets can be given")
+	ctx = runner(newTstCtx(t, ""), "--targets", "1,prod", "health")
+	assert.Contains(t, ctx.err, `unknown target "prod"`)
+}
+
+func TestMutatingCommandPrintsTarget(t *testing.T) {
+	paths := map[string]TstHandler{"PUT/SAAS/jersey/manager/api/localuserstore": GoodPathHandler(`{}`)}
+	ctx := runWithServer(t, paths, "localuserstore", "showLocalUserStore=false")
+	assert.True(t, strings.HasPrefix(ctx.info, "Using target 1, http://127.0.0.1"))
+}
+
+func TestCommandWithNoTargets(t *testing.T) {
+	ctx := runner(newTstCtx(t, " "), "user", "get", "joe")
+	ctx.assertOnlyErrContains(`no target set, add one with "priam target <url> [name]"`)
+}
+
 func TestReuseExistingTargetHostWithoutName(t *testing.T) {
 	ctx := runner(newTstCtx(t, ""), "target", "radio2.example.com")
 	ctx.assertOnlyInfoContains("new target is: staging, https://radio2.example.com")
@@ -282,6 +374,309 @@ func TestExitIfHealthFails(t *testing.T) {
 	runWithServer(t, paths, "health").assertOnlyErrContains("test health")
 }
 
+func TestApplyEmptyBackupDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-restore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&startIndex=1":               GoodPathHandler(`{"totalResults": 0}`),
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName%2Cmembers&count=500&startIndex=1": GoodPathHandler(`{"totalResults": 0}`)}
+	ctx := runWithServer(t, paths, "restore", "--dry-run", dir)
+	ctx.assertOnlyInfoContains("Entitlements created: 0, skipped: 0, failed: 0")
+	assert.Contains(t, ctx.info, "Dry run, no changes are made to")
+}
+
+func TestApplyPruneRequiresAction(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{}, "apply", "--prune", "backup")
+	ctx.assertInfoErrContains("Using target 1", "--prune requires --prune-action=deactivate or --prune-action=delete")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestApplyPruneRequiresUserType(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{}, "apply", "--prune", "--prune-action", "delete", "backup")
+	ctx.assertInfoErrContains("Using target 1", "Refusing to prune users of any type")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestUserListWithInvalidUserType(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{}, "user", "list", "--user-type", "synced")
+	ctx.assertOnlyErrContains(`invalid user type "synced", it must be one of: LOCAL, PROVISIONED, SERVICE`)
+}
+
+func TestDiffOfEmptyBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-diff")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cname%2Cemails&count=500&startIndex=1": GoodPathHandler(`{"totalResults": 0}`),
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName%2Cmembers&count=500&startIndex=1":   GoodPathHandler(`{"totalResults": 0}`)}
+	ctx := runWithServer(t, paths, "diff", "--case-sensitive", dir)
+	ctx.assertOnlyInfoContains("No changes")
+}
+
+func TestCompareTwoTargets(t *testing.T) {
+	usersPath := "GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&startIndex=1"
+	groupsPath := "GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=displayName%2Cmembers&count=500&startIndex=1"
+	paths1 := map[string]TstHandler{usersPath: GoodPathHandler(`{"totalResults": 0}`),
+		groupsPath: GoodPathHandler(`{"Resources": [{"displayName": "friends"}]}`)}
+	paths2 := map[string]TstHandler{usersPath: GoodPathHandler(`{"totalResults": 0}`), groupsPath: GoodPathHandler(`{"totalResults": 0}`)}
+	ctx := runOnTwoTargets(t, paths1, paths2, "compare", "--groups-only", "1", "2")
+	ctx.assertOnlyInfoContains("< group friends only in 1\n")
+}
+
+func TestCompareWithUnknownTarget(t *testing.T) {
+	ctx := runner(newTstCtx(t, tstSrvTgtWithAuth("https://radio.example.com")), "compare", "1", "nope")
+	ctx.assertOnlyErrContains("unknown target \"nope\"")
+}
+
+func TestCompareUsersOnlyAndGroupsOnly(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "compare", "--users-only", "--groups-only", "1", "radio")
+	ctx.assertInfoErrContains("USAGE", "Only one of --users-only and --groups-only can be given")
+}
+
+func TestScaffoldWithoutTarget(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "scaffold", "entitlements")
+	ctx.assertOnlyInfoContains("subjectType: group")
+}
+
+func TestScaffoldValidatesFileWithoutTarget(t *testing.T) {
+	groupsFile := WriteTempFile(t, "- {name: sales}\n- {name: sales}\n")
+	defer CleanupTempFile(groupsFile)
+	ctx := runner(newTstCtx(t, ""), "scaffold", "--validate", groupsFile.Name(), "groups")
+	ctx.assertOnlyErrContains("group 2: duplicate name sales of group 1")
+}
+
+func TestBackupFailsIfDirectoryCannotBeCreated(t *testing.T) {
+	notDir := WriteTempFile(t, "not a directory")
+	defer CleanupTempFile(notDir)
+	ctx := runWithServer(t, map[string]TstHandler{}, "backup", "--parallel", "1", filepath.Join(notDir.Name(), "backup"))
+	ctx.assertOnlyErrContains("Could not create backup directory")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestCheck(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Users?count=1": GoodPathHandler(`{}`)}
+	ctx := runWithServer(t, paths, "check")
+	ctx.assertOnlyInfoContains("unknown, the access token is not a JWT")
+	assert.Contains(t, ctx.info, `target: "1"`)
+}
+
+func TestExitIfCheckIsRefused(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Users?count=1": ErrorHandler(401, "expired")}
+	ctx := runWithServer(t, paths, "whoami")
+	ctx.assertOnlyErrContains("the access token was refused, please log in")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestSchemas(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/ResourceTypes": GoodPathHandler(`[{"name": "User", "endpoint": "/Users"}]`),
+		"GET" + vidmBasePathTenantInUrl + "scim/Schemas": GoodPathHandler(
+			`[{"id": "urn:test:User", "attributes": [{"name": "userName", "type": "string"}]}]`)}
+	ctx := runWithServer(t, paths, "schemas")
+	ctx.assertOnlyInfoContains("---- Schema urn:test:User ----")
+	assert.Contains(t, ctx.info, "userName")
+}
+
+func TestNoRetriesIfRetriesIsZero(t *testing.T) {
+	calls := 0
+	paths := map[string]TstHandler{healthApi: func(t *testing.T, req *TstReq) *TstReply {
+		calls++
+		return &TstReply{Status: 503, StatusMsg: "try later"}
+	}}
+	runWithServer(t, paths, "--retries", "0", "health").assertOnlyErrContains("503 Service Unavailable")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRateSpacesRequests(t *testing.T) {
+	times := []time.Time{}
+	timed := func(output string) TstHandler {
+		return func(t *testing.T, req *TstReq) *TstReply {
+			times = append(times, time.Now())
+			return &TstReply{Output: output}
+		}
+	}
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22friends%22": timed(
+			`{"Resources": [{"displayName": "friends", "id": "10"}]}`),
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22olaf%22": timed(
+			`{"Resources": [{"userName": "olaf", "id": "2"}]}`),
+		"POST" + vidmBasePathTenantInUrl + "scim/Groups/10": timed("")}
+	runWithServer(t, paths, "--rate", "20", "group", "member", "friends", "olaf").
+		assertOnlyInfoContains("Updated SCIM resource friends of type Groups")
+	require.Len(t, times, 3)
+	for i := 1; i < len(times); i++ {
+		assert.True(t, times[i].Sub(times[i-1]) >= 40*time.Millisecond)
+	}
+}
+
+func TestNoCacheDisablesResponseCache(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	runWithServer(t, paths, "health")
+	assert.NotNil(t, requestOptions.cache)
+	runWithServer(t, paths, "--no-cache", "health")
+	assert.Nil(t, requestOptions.cache)
+}
+
+func TestInvalidTransportOptionFailsCommand(t *testing.T) {
+	runWithServer(t, map[string]TstHandler{}, "--cacert", "does-not-exist.pem", "health").
+		assertOnlyErrContains("Error: could not read CA file")
+}
+
+func TestTraceToFile(t *testing.T) {
+	traceFile := WriteTempFile(t, "")
+	defer CleanupTempFile(traceFile)
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--trace-file", traceFile.Name(), "health")
+	ctx.assertOnlyInfoContains("allOk")
+	assert.NotContains(t, ctx.info, "request to")
+	trace := GetTempFile(t, traceFile.Name())
+	assert.Contains(t, trace, "GET request to : ")
+	assert.Contains(t, trace, "response status: 200 OK")
+}
+
+func TestLogFileOnly(t *testing.T) {
+	logFile := WriteTempFile(t, "")
+	defer CleanupTempFile(logFile)
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--log-file", logFile.Name(), "--log-format", "json", "--log-file-only", "health")
+	ctx.assertOnlyInfoContains("allOk")
+	assert.Contains(t, GetTempFile(t, logFile.Name()), `"level":"result","message":"Health info","result":{"allOk":true}}`)
+}
+
+func TestLogFileOnlyRequiresLogFile(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--log-file-only", "target")
+	assert.Contains(t, ctx.err, "--log-file-only requires --log-file")
+}
+
+func TestUnknownLogFormat(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--log-format", "xml", "target")
+	assert.Contains(t, ctx.err, `unknown log format "xml"`)
+}
+
+func TestUnknownOutputFormat(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--format", "xml", "target")
+	assert.Contains(t, ctx.err, `unknown output format "xml"`)
+}
+
+func TestUnknownColorMode(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--color", "pink", "target")
+	assert.Contains(t, ctx.err, `unknown color mode "pink"`)
+}
+
+func TestColorOnlyWhenAsked(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: ErrorHandler(500, "down")}
+	ctx := runWithServer(t, paths, "health")
+	assert.NotEmpty(t, ctx.err)
+	assert.NotContains(t, ctx.err+ctx.info, "\x1b[", "output that is not to a terminal should not be colored")
+	ctx = runWithServer(t, paths, "--color", "always", "health")
+	assert.True(t, strings.HasPrefix(ctx.err, "\x1b[31m"), "error should be red: %q", ctx.err)
+}
+
+func TestJsonOutputFormat(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--format", "json", "health")
+	var health map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(ctx.info), &health), "output should be valid JSON: %s", ctx.info)
+	assert.Equal(t, true, health["allOk"])
+}
+
+func TestOutputFile(t *testing.T) {
+	outFile := WriteTempFile(t, "old results")
+	defer CleanupTempFile(outFile)
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--format", "json", "--output", outFile.Name(), "health")
+	assert.Contains(t, ctx.err, "exists, add --overwrite to replace it")
+	assert.Equal(t, "old results", GetTempFile(t, outFile.Name()))
+
+	ctx = runWithServer(t, paths, "--format", "json", "--output", outFile.Name(), "--overwrite", "health")
+	assert.Empty(t, ctx.info)
+	assert.Equal(t, 0, ctx.exitCode)
+	var health map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(GetTempFile(t, outFile.Name())), &health))
+	assert.Equal(t, true, health["allOk"])
+}
+
+func TestOutputFileNotWrittenWhenCommandFails(t *testing.T) {
+	outFile := WriteTempFile(t, "old results")
+	defer CleanupTempFile(outFile)
+	paths := map[string]TstHandler{healthApi: ErrorHandler(500, "down")}
+	ctx := runWithServer(t, paths, "--output", outFile.Name(), "--overwrite", "health")
+	assert.Contains(t, ctx.err, "WARNING: Results were not written to the output file since the command failed")
+	assert.Equal(t, "old results", GetTempFile(t, outFile.Name()))
+}
+
+func TestHarFileWrittenWhenCommandFails(t *testing.T) {
+	harFile := WriteTempFile(t, "")
+	defer CleanupTempFile(harFile)
+	paths := map[string]TstHandler{healthApi: ErrorHandler(500, "down")}
+	ctx := runWithServer(t, paths, "--har", harFile.Name(), "health")
+	assert.NotEqual(t, 0, ctx.exitCode)
+	var har struct {
+		Log struct {
+			Version string
+			Entries []struct {
+				Request  struct{ Method, URL string }
+				Response struct{ Status int }
+			}
+		}
+	}
+	require.Nil(t, json.Unmarshal([]byte(GetTempFile(t, harFile.Name())), &har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 1)
+	assert.Equal(t, "GET", har.Log.Entries[0].Request.Method)
+	assert.Contains(t, har.Log.Entries[0].Request.URL, "/health")
+	assert.Equal(t, 500, har.Log.Entries[0].Response.Status)
+}
+
+func TestQueryOutput(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--query", "allOk", "health")
+	assert.Equal(t, "true\n", ctx.info)
+	assert.Equal(t, 0, ctx.exitCode)
+}
+
+func TestQueryMissingPathIsOnlyAnErrorIfStrict(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--query", "notThere", "health")
+	assert.Equal(t, "\n", ctx.info)
+	assert.Empty(t, ctx.err)
+	assert.Equal(t, 0, ctx.exitCode)
+
+	ctx = runWithServer(t, paths, "--query", "notThere", "--strict", "health")
+	assert.Equal(t, "\n", ctx.info)
+	assert.Contains(t, ctx.err, `Query "notThere" selected nothing in 1 of 1 results`)
+	assert.Equal(t, 1, ctx.exitCode)
+}
+
+func TestColumnsOutput(t *testing.T) {
+	paths := map[string]TstHandler{healthApi: healthHandler(true)}
+	ctx := runWithServer(t, paths, "--columns", "allOk,notThere", "--format", "csv", "--sort-by", "allOk",
+		"--reverse", "health")
+	assert.Equal(t, "allOk,notThere\ntrue,\n", ctx.info)
+	assert.Equal(t, 0, ctx.exitCode)
+}
+
+func TestInvalidQueryTemplate(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--query", "{{.id", "target")
+	assert.Contains(t, ctx.err, "invalid query template")
+	assert.Equal(t, 1, ctx.exitCode)
+}
+
+// -- test credentials ---------------------------------------------------------------------
+
+func TestClearCredentialsOfTarget(t *testing.T) {
+	ctx := runner(newTstCtx(t, tstSrvTgtWithAuth("https://radio.example.com")), "credentials", "clear", "1")
+	ctx.assertOnlyInfoContains("credentials of target 1 deleted.")
+	assert.NotContains(t, ctx.cfg, goodAccessToken)
+	assert.Contains(t, ctx.cfg, "accesstokentype: Bearer")
+}
+
+func TestInvalidCredentialStore(t *testing.T) {
+	ctx := runner(newTstCtx(t, ""), "--credential-store", "vault", "target")
+	assert.Contains(t, ctx.err, `unknown credential store "vault"`)
+}
+
 // -- test login -----------------------------------------------------------------------------
 
 func TestCanNotLoginWithNoTarget(t *testing.T) {
@@ -327,6 +722,24 @@ func TestCanLoginAsOAuthClient(t *testing.T) {
 	assertLoginSucceeded(t, "Bearer", ctx)
 }
 
+func TestLoginWithScopesSavesRequestedAndGrantedScopes(t *testing.T) {
+	tsMock := setupTokenServiceMock()
+	tsMock.On("ClientCredentialsGrant", mock.Anything, "john", "travolta").
+		Return(TokenInfo{AccessTokenType: "Bearer", AccessToken: goodAccessToken, Scope: "scim"}, nil)
+	ctx := testMockCommand(t, &tsMock.Mock, "login", "--scope", "admin,scim", "-c", "john", "travolta")
+	assert.Contains(t, ctx.cfg, scopeOption+": admin scim\n")
+	assert.Contains(t, ctx.cfg, tokenScopeOption+": scim\n")
+	assert.Contains(t, ctx.info, "Access token saved")
+	assert.Equal(t, "WARNING: the access token was not granted the requested scopes: admin\n", ctx.err)
+}
+
+func TestLoginAsSystemUserCannotRequestScopes(t *testing.T) {
+	tsMock := setupTokenServiceMock()
+	ctx := testMockCommand(t, &tsMock.Mock, "login", "--scope", "admin", "john", "travolta")
+	ctx.assertOnlyErrContains("scopes can only be requested with --client or --authcode")
+	tsMock.AssertNotCalled(t, "LoginSystemUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
 func TestPromptForOauthClient(t *testing.T) {
 	consoleInput = strings.NewReader("john")
 	getRawPassword = func() ([]byte, error) { return []byte("travolta"), nil }
@@ -339,6 +752,87 @@ func TestPromptForOauthClient(t *testing.T) {
 	ctx.assertOnlyInfoContains("Secret: ")
 }
 
+func TestCanLoginAsOAuthClientWithSecretFromEnv(t *testing.T) {
+	os.Setenv("PRIAM_TEST_SECRET", "travolta")
+	defer os.Unsetenv("PRIAM_TEST_SECRET")
+	tsMock := setupTokenServiceMock()
+	tsMock.On("ClientCredentialsGrant", mock.Anything, "john", "travolta").
+		Return(TokenInfo{AccessTokenType: "Bearer", AccessToken: goodAccessToken, ExpiresIn: 3600}, nil)
+	ctx := testMockCommand(t, &tsMock.Mock, "login", "--client-id", "john", "--client-secret-env", "PRIAM_TEST_SECRET")
+	assertLoginSucceeded(t, "Bearer", ctx)
+	assert.Contains(t, ctx.cfg, clientIDOption+": john")
+	assert.Contains(t, ctx.cfg, clientSecretEnvOption+": PRIAM_TEST_SECRET")
+	assert.Contains(t, ctx.cfg, tokenExpiryOption+": ")
+	assert.NotContains(t, ctx.cfg, "travolta\n")
+}
+
+func TestLoginFailsIfClientSecretEnvIsNotSet(t *testing.T) {
+	tsMock := setupTokenServiceMock()
+	ctx := testMockCommand(t, &tsMock.Mock, "login", "--client-id", "john", "--client-secret-env", "PRIAM_NO_SUCH_VAR")
+	ctx.assertOnlyErrContains("environment variable PRIAM_NO_SUCH_VAR of the client secret is not set")
+}
+
+func TestExpiredClientTokenIsRenewed(t *testing.T) {
+	os.Setenv("PRIAM_TEST_SECRET", "travolta")
+	defer os.Unsetenv("PRIAM_TEST_SECRET")
+	tsMock := setupTokenServiceMock()
+	tsMock.On("ClientCredentialsGrant", mock.Anything, "john", "travolta").
+		Return(TokenInfo{AccessTokenType: "Bearer", AccessToken: "fresh", ExpiresIn: 3600}, nil)
+	policies := func(t *testing.T, req *TstReq) *TstReply {
+		if req.Authorization != "Bearer fresh" {
+			return &TstReply{Status: 401, StatusMsg: "token expired"}
+		}
+		return &TstReply{Output: `{"items": []}`}
+	}
+	srv := StartTstServer(t, map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "accessPolicies": policies})
+	defer srv.Close()
+	cfg := tstSrvTgtWithAuth(srv.URL) + fmt.Sprintf("    %s: john\n    %s: PRIAM_TEST_SECRET\n    %s: 2016-01-01T00:00:00Z\n",
+		clientIDOption, clientSecretEnvOption, tokenExpiryOption)
+	ctx := runner(newTstCtx(t, cfg), "policies")
+	ctx.assertOnlyInfoContains("Access Policies")
+	assert.Contains(t, ctx.cfg, accessTokenOption+": fresh")
+	assert.NotContains(t, ctx.cfg, "2016-01-01")
+	tsMock.AssertExpectations(t)
+}
+
+func TestTokenRefusedWith401IsRenewedWithRefreshToken(t *testing.T) {
+	tsMock := setupTokenServiceMock()
+	tsMock.On("RefreshTokenGrant", mock.Anything, "so-it-goes").
+		Return(TokenInfo{AccessTokenType: "Bearer", AccessToken: "fresh"}, nil)
+	policies := func(t *testing.T, req *TstReq) *TstReply {
+		if req.Authorization != "Bearer fresh" {
+			return &TstReply{Status: 401, StatusMsg: "token revoked"}
+		}
+		return &TstReply{Output: `{"items": []}`}
+	}
+	srv := StartTstServer(t, map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "accessPolicies": policies})
+	defer srv.Close()
+	cfg := tstSrvTgtWithAuth(srv.URL) + fmt.Sprintf("    %s: so-it-goes\n", refreshTokenOption)
+	ctx := runner(newTstCtx(t, cfg), "policies")
+	ctx.assertOnlyInfoContains("Access Policies")
+	assert.Contains(t, ctx.cfg, accessTokenOption+": fresh")
+	assert.Contains(t, ctx.cfg, refreshTokenOption+": so-it-goes")
+	assert.Contains(t, ctx.cfg, idTokenOption+": "+goodIdToken)
+	tsMock.AssertExpectations(t)
+}
+
+func TestExpiredTokenThatCannotBeRenewedSuggestsLogin(t *testing.T) {
+	tsMock := setupTokenServiceMock()
+	tsMock.On("RefreshTokenGrant", mock.Anything, "so-it-goes").
+		Return(TokenInfo{}, errors.New("invalid_grant: refresh token expired"))
+	srv := StartTstServer(t, map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "accessPolicies": func(
+		t *testing.T, req *TstReq) *TstReply {
+		return &TstReply{Status: 401, StatusMsg: "token expired"}
+	}})
+	defer srv.Close()
+	cfg := tstSrvTgtWithAuth(srv.URL) + fmt.Sprintf("    %s: so-it-goes\n    %s: 2016-01-01T00:00:00Z\n",
+		refreshTokenOption, tokenExpiryOption)
+	ctx := runner(newTstCtx(t, cfg), "policies")
+	ctx.assertOnlyErrContains("could not renew the access token: invalid_grant: refresh token expired\n" +
+		`hint: the access token of target 1 expired or was revoked, log in again with "priam --target 1 login"`)
+	tsMock.AssertNumberOfCalls(t, "RefreshTokenGrant", 1)
+}
+
 func TestCanLoginAsSystemUser(t *testing.T) {
 	tsMock := setupTokenServiceMock()
 	tsMock.On("LoginSystemUser", mock.Anything, "john", "travolta").
@@ -463,12 +957,184 @@ func setupUsersServiceMock() *mocks.DirectoryService {
 	return usersServiceMock
 }
 
+// -- test exit codes of commands run against a test server
+
+func runUsersCmdWithServer(t *testing.T, paths map[string]TstHandler, args ...string) *tstCtx {
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	return runWithServer(t, paths, args...)
+}
+
+func TestExitCodeSuccess(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{healthApi: healthHandler(true)}, "health")
+	assert.Equal(t, ExitOK, ctx.exitCode)
+}
+
+func TestExitCodeError(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{healthApi: ErrorHandler(500, "broken")}, "health")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestExitCodeInputError(t *testing.T) {
+	ctx := runner(newTstCtx(t, tstSrvTgtWithAuth("http://frozen.site")), "user", "get")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestExitCodeNotFound(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Users?count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(`{"Resources": []}`)}
+	ctx := runUsersCmdWithServer(t, paths, "user", "get", "elsa")
+	assert.Contains(t, ctx.err, `no Users found named "elsa"`)
+	assert.Equal(t, ExitNotFound, ctx.exitCode)
+}
+
+func TestExitCodePartialLoad(t *testing.T) {
+	calls := 0
+	addUser := func(t *testing.T, req *TstReq) *TstReply {
+		if calls++; calls == 1 {
+			return &TstReply{Status: 409, StatusMsg: "user exists"}
+		}
+		return &TstReply{Output: "{}"}
+	}
+	usersFile := WriteTempFile(t, GetTempFile(t, yamlUsersFile))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	srv := StartTstServer(t, map[string]TstHandler{"POST" + vidmBasePathTenantInUrl + "scim/Users": addUser})
+	defer srv.Close()
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	ctx := runner(newTstCtx(t, tstSrvTgtWithAuth(srv.URL)+"    default-email-domain: example.com\n"),
+		"user", "load", usersFile.Name())
+	assert.Contains(t, ctx.info, "Users created: 1, failed: 1, not attempted: 0")
+	assert.Equal(t, ExitPartial, ctx.exitCode)
+}
+
+func TestLoadUsersWithDefaultEmailDomainOfTarget(t *testing.T) {
+	emails := []string{}
+	addUser := func(t *testing.T, req *TstReq) *TstReply {
+		user := struct{ Emails []struct{ Value string } }{}
+		require.Nil(t, json.Unmarshal([]byte(req.Input), &user))
+		emails = append(emails, user.Emails[0].Value)
+		return &TstReply{Output: "{}"}
+	}
+	srv := StartTstServer(t, map[string]TstHandler{"POST" + vidmBasePathTenantInUrl + "scim/Users": addUser})
+	defer srv.Close()
+	ctx := runner(newTstCtx(t, tstSrvTgtWithAuth(srv.URL)), "target", "--default-email-domain", "corp.example.org")
+	ctx.assertOnlyInfoContains("Default email domain of target 1 set to corp.example.org")
+	assert.Contains(t, ctx.cfg, "default-email-domain: corp.example.org")
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	ctx = runner(ctx, "user", "load", yamlUsersFile)
+	assert.Equal(t, []string{"joe@corp.example.org", "joe@what.com"}, emails)
+	assert.Contains(t, ctx.info, "Users created with an email of the default domain corp.example.org: 1")
+}
+
+func TestSetPasswordChecksPasswordPolicy(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "tenants/tenant/passwordpolicy": GoodPathHandler(`{"minLen": 12}`)}
+	ctx := runUsersCmdWithServer(t, paths, "user", "password", "elsa", "frozen")
+	assert.Contains(t, ctx.err, "password does not follow the password policy of the tenant: it must have at least 12 characters")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestSkipPolicyCheckDoesNotGetPasswordPolicy(t *testing.T) {
+	base := vidmBasePathTenantInUrl + "scim/Users"
+	paths := map[string]TstHandler{
+		"GET" + base + "?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(`{"Resources": [{"userName": "elsa", "id": "1"}]}`),
+		"POST" + base + "/1": GoodPathHandler("")}
+	ctx := runUsersCmdWithServer(t, paths, "user", "password", "--skip-policy-check", "elsa", "frozen")
+	assert.Contains(t, ctx.info, `User "elsa" updated`)
+	assert.Equal(t, ExitOK, ctx.exitCode)
+}
+
+func TestMustChangeFailsIfTenantDoesNotSupportIt(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Schemas": GoodPathHandler(
+		`{"Resources": [{"id": "urn:scim:schemas:core:1.0", "attributes": [{"name": "userName"}]}]}`)}
+	ctx := runUsersCmdWithServer(t, paths, "user", "password", "--skip-policy-check", "--must-change", "elsa", "frozen")
+	assert.Contains(t, ctx.err, "the tenant does not support requiring a password change at next login")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestResetPasswords(t *testing.T) {
+	base := vidmBasePathTenantInUrl + "scim/Users"
+	paths := map[string]TstHandler{
+		"GET" + base + "?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(ScimUsersPage(1, 1, "elsa")),
+		"POST" + base + "/" + ScimID("elsa"):                                               GoodPathHandler("")}
+	usersFile := WriteTempFile(t, "elsa,Frozen123!\n")
+	defer CleanupTempFile(usersFile)
+	ctx := runWithServer(t, paths, "user", "reset-passwords", "--skip-policy-check", "-f", usersFile.Name())
+	assert.Contains(t, ctx.info, "Passwords reset: 1, failed: 0, not attempted: 0")
+	assert.NotContains(t, ctx.info+ctx.err, "Frozen123!")
+	assert.Equal(t, ExitOK, ctx.exitCode)
+}
+
+func TestLockUser(t *testing.T) {
+	base := vidmBasePathTenantInUrl + "scim/Users"
+	paths := map[string]TstHandler{
+		"GET" + base + "?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(ScimUsersPage(1, 1, "elsa")),
+		"POST" + base + "/" + ScimID("elsa"):                                               GoodPathHandler(""),
+		"GET" + base + "/" + ScimID("elsa"):                                                GoodPathHandler(`{"urn:scim:schemas:extension:workspace:1.0": {"userStatus": "frozen"}}`)}
+	ctx := runWithServer(t, paths, "user", "lock", "--status", "frozen", "elsa")
+	assert.Contains(t, ctx.info, `User "elsa" locked, status is frozen`)
+	assert.Equal(t, ExitOK, ctx.exitCode)
+}
+
+func TestHelpDocumentsExitCodes(t *testing.T) {
+	runner(newTstCtx(t, ""), "help").assertOnlyInfoContains("2  a resource was not found")
+}
+
+func TestQuietOptionPrintsOnlyResults(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{healthApi: healthHandler(true)}, "--quiet", "health")
+	assert.Equal(t, "---- Health info ----\nallOk: true\n", ctx.info)
+	assert.Empty(t, ctx.err)
+	ctx = runner(newTstCtx(t, ""), "-q", "target", "-f", "https://bad.example.com")
+	assert.Empty(t, ctx.info)
+	assert.Empty(t, ctx.err)
+}
+
+func TestVerboseOptionPrintsRequestPaths(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{healthApi: healthHandler(true)}, "--verbose", "health")
+	assert.Contains(t, ctx.info, "GET http://127.0.0.1")
+	assert.Contains(t, ctx.info, healthApi[len("GET"):])
+}
+
 func TestCanAddUser(t *testing.T) {
 	usersServiceMock := setupUsersServiceMock()
 	usersServiceMock.On("AddEntity", mock.Anything, &BasicUser{Name: "elsa", Given: "", Family: "", Email: "", Pwd: "frozen"}).Return()
 	testMockCommand(t, &usersServiceMock.Mock, "user", "add", "elsa", "frozen")
 }
 
+func TestCanAddServiceAccount(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("AddEntity", mock.Anything, &BasicUser{Name: "olaf", Pwd: "snow", InternalUserType: "SERVICE"}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "add", "--internal-user-type", "SERVICE", "olaf", "snow")
+}
+
+func TestCanAddUserWithAllNames(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("AddEntity", mock.Anything, &BasicUser{Name: "anna", Pwd: "frozen", Given: "Anna",
+		Family: "Arendelle", Middle: "Elsa", Honorific: "Princess", Display: "Princess Anna"}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "add", "--given", "Anna", "--family", "Arendelle",
+		"--middle", "Elsa", "--honorific", "Princess", "--display", "Princess Anna", "anna", "frozen")
+}
+
+func TestCommandsThatChangeTheTenantPrintTheirDestination(t *testing.T) {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"prn": "admin@example",
+		"cid": "ops-client"}).SignedString([]byte("test key"))
+	cfg := tstSrvTgt("https://prod.example.com") + "    accesstokentype: Bearer\n    accesstoken: " + token + "\n"
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("DeleteEntity", mock.Anything, "elsa").Return()
+	usersServiceMock.On("DisplayEntity", mock.Anything, "elsa").Return()
+	destination := "Using target 1, https://prod.example.com, principal admin@example, client ops-client\n"
+	for _, args := range [][]string{{"user", "delete", "elsa"}, {"--quiet", "user", "delete", "elsa"},
+		{"--force", "user", "delete", "elsa"}} {
+		ctx := runner(newTstCtx(t, cfg), args...)
+		assert.Equal(t, destination, ctx.info, args)
+	}
+	ctx := runner(newTstCtx(t, cfg), "--quiet", "--force", "user", "delete", "elsa")
+	assert.Empty(t, ctx.info, "--quiet and --force together should not print the destination")
+	ctx = runner(newTstCtx(t, cfg), "user", "get", "elsa")
+	assert.Empty(t, ctx.info, "commands that do not change the tenant should not print the destination")
+}
+
 func TestCanGetUser(t *testing.T) {
 	usersServiceMock := setupUsersServiceMock()
 	usersServiceMock.On("DisplayEntity", mock.Anything, "elsa").Return()
@@ -483,16 +1149,270 @@ func TestCanDeleteUser(t *testing.T) {
 
 func TestCanListUsersWithCount(t *testing.T) {
 	usersServiceMock := setupUsersServiceMock()
-	usersServiceMock.On("ListEntities", mock.Anything, 10, "").Return()
+	usersServiceMock.On("ListEntities", mock.Anything, ListOptions{Count: 10}).Return()
 	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--count", "10")
 }
 
 func TestCanListUsersWithFilter(t *testing.T) {
 	usersServiceMock := setupUsersServiceMock()
-	usersServiceMock.On("ListEntities", mock.Anything, 0, "filter").Return()
+	usersServiceMock.On("ListEntities", mock.Anything, ListOptions{Filter: "filter"}).Return()
 	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--filter", "filter")
 }
 
+func TestCanListUsersSortedDescending(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, ListOptions{Count: 5, Filter: "filter", SortBy: "userName", Descending: true}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--count", "5", "--filter", "filter",
+		"--sort", "userName", "--desc")
+}
+
+func TestListAllAttributesOfUsers(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Users?count=2": GoodPathHandler(
+		`{"Resources": [{"userName": "elsa", "active": true}]}`)}
+	runUsersCmdWithServer(t, paths, "user", "list", "--count", "2", "--full").assertOnlyInfoContains("active: true")
+}
+
+func TestCanCountGroups(t *testing.T) {
+	groupsServiceMock := setupGroupsServiceMock()
+	groupsServiceMock.On("ListEntities", mock.Anything, ListOptions{Filter: "f", CountOnly: true}).Return()
+	testMockCommand(t, &groupsServiceMock.Mock, "group", "list", "--count-only", "--filter", "f")
+}
+
+func TestCanListUsersWithGrep(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Filter == "filter" && opts.Grep.MatchString("ELSA") && !opts.Grep.MatchString("anna")
+	})).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--filter", "filter", "--grep", "el+sa")
+}
+
+func TestListInactiveUsers(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Filter == "(userName sw \"a\") and active eq false" && !opts.DateWindow.IsSet()
+	})).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--filter", `userName sw "a"`, "--inactive")
+}
+
+func TestListUsersInactiveForDays(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		days := time.Since(opts.LastModifiedBefore).Hours() / 24
+		return opts.Filter == "active eq false" && days > 89 && days < 91
+	})).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--inactive-days", "90")
+}
+
+func TestListUsersInactiveForDaysKeepsEarlierModifiedBefore(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Filter == "active eq false" &&
+			opts.LastModifiedBefore.Format(time.RFC3339) == "2019-01-31T00:00:00Z"
+	})).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--inactive-days", "90",
+		"--modified-before", "2019-01-31")
+}
+
+func TestListUsersWithFiltersOfAttributes(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Filter == `(title pr or nickName pr) and userName eq "jo\"e" and emails.value co "@acme.com" and `+
+			`active eq true`
+	})).Return()
+	ctx := testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--filter", `userName=jo"e`,
+		"--filter", "emails.value~=@acme.com", "--filter", "active=true", "--filter-expr", "title pr or nickName pr")
+	assert.Empty(t, ctx.err)
+}
+
+func TestFilterThatIsNotOfAttributeIsUsedAsExpression(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Filter == `userName eq "joe"`
+	})).Return()
+	ctx := testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--filter", `userName eq "joe"`)
+	assert.Contains(t, ctx.err, "WARNING: --filter 'userName eq \"joe\"' is not attr=value or attr~=substring")
+}
+
+func TestListGroupsWithDates(t *testing.T) {
+	groupsServiceMock := setupGroupsServiceMock()
+	groupsServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.Dates && opts.CreatedBefore.Format(time.RFC3339) == "2020-01-31T00:00:00Z" &&
+			opts.LastModifiedBefore.Format(time.RFC3339) == "2020-02-01T12:00:00Z"
+	})).Return()
+	testMockCommand(t, &groupsServiceMock.Mock, "group", "list", "--dates", "--created-before", "2020-01-31",
+		"--modified-before", "2020-02-01T12:00:00Z")
+}
+
+func TestListUsersWithinDates(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("ListEntities", mock.Anything, mock.MatchedBy(func(opts ListOptions) bool {
+		return opts.CreatedAfter.Format(time.RFC3339) == "2020-01-24T00:00:00Z" && opts.CreatedBefore.IsZero() &&
+			opts.LastModifiedAfter.IsZero() && opts.LastModifiedBefore.Format(time.RFC3339) == "2019-01-31T00:00:00Z"
+	})).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "list", "--created-after", "2020-01-24",
+		"--modified-before", "2019-01-31")
+}
+
+func TestInvalidDateFailsListBeforeRequests(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{}, "user", "list", "--created-before", "last year")
+	ctx.assertOnlyErrContains(`Invalid --created-before: "last year" is not a date`)
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestInvalidGrepPatternFailsBeforeRequests(t *testing.T) {
+	ctx := runWithServer(t, map[string]TstHandler{}, "group", "list", "--grep", "(unclosed")
+	ctx.assertOnlyErrContains("Invalid --grep pattern: error parsing regexp: missing closing )")
+	assert.Equal(t, ExitError, ctx.exitCode)
+}
+
+func TestDeleteUsersOfFile(t *testing.T) {
+	usersFile := WriteTempFile(t, "elsa\n")
+	defer CleanupTempFile(usersFile)
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(
+			`{"Resources": [{"userName": "elsa", "id": "123"}]}`),
+		"DELETE" + vidmBasePathTenantInUrl + "scim/Users/123": GoodPathHandler("")}
+	ctx := runWithServer(t, paths, "user", "delete-all", "--force", usersFile.Name())
+	ctx.assertOnlyInfoContains("Users deleted: 1, not found: 0, failed: 0, not attempted: 0")
+	assert.Contains(t, ctx.info, "Using target 1")
+}
+
+func TestDeleteUsersOfFileWritesSummary(t *testing.T) {
+	usersFile := WriteTempFile(t, "elsa\nolaf\n")
+	defer CleanupTempFile(usersFile)
+	summaryFile := usersFile.Name() + ".summary.json"
+	defer os.Remove(summaryFile)
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(
+			`{"Resources": [{"userName": "elsa", "id": "123"}]}`),
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22olaf%22": GoodPathHandler(
+			`{"Resources": []}`),
+		"DELETE" + vidmBasePathTenantInUrl + "scim/Users/123": GoodPathHandler("")}
+	ctx := runWithServer(t, paths, "user", "delete-all", "--force", "--summary-json", summaryFile, usersFile.Name())
+	ctx.assertOnlyInfoContains("Users deleted: 1, not found: 1, failed: 0, not attempted: 0")
+	var summary map[string]interface{}
+	content, err := ioutil.ReadFile(summaryFile)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(content, &summary), string(content))
+	assert.Equal(t, "user delete-all", summary["command"])
+	assert.Equal(t, "1", summary["target"])
+	assert.Equal(t, float64(ExitNotFound), summary["exitCode"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"row": float64(2), "name": "olaf", "outcome": "skipped", "error": "no Users found named \"olaf\""},
+		map[string]interface{}{"row": float64(1), "name": "elsa", "outcome": "deleted"}}, summary["rows"])
+	assert.Equal(t, map[string]interface{}{"deleted": float64(1), "skipped": float64(1), "total": float64(2)},
+		summary["counts"])
+}
+
+func TestSummaryCannotBeWrittenForSeveralTargets(t *testing.T) {
+	usersFile := WriteTempFile(t, "elsa\n")
+	defer CleanupTempFile(usersFile)
+	auth := fmt.Sprintf("    %s: Bearer\n    %s: %s\n", accessTokenTypeOption, accessTokenOption, goodAccessToken)
+	cfg := "---\ncurrenttarget: a\ntargets:\n  a:\n    host: https://a.example.com\n" + auth +
+		"  b:\n    host: https://b.example.com\n" + auth
+	ctx := runner(newTstCtx(t, cfg), "--targets", "a,b", "--force", "entitlement", "load", "--summary-json",
+		usersFile.Name()+".summary.json", usersFile.Name())
+	assert.Contains(t, ctx.err, "--summary-json cannot be used with several targets")
+}
+
+func TestListUnentitledUsers(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta&count=500&filter=active+eq+true&startIndex=1": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"userName": "olaf", "id": "2"}]}`),
+		"GET" + vidmBasePathTenantInUrl + "entitlements/definitions/users/2": GoodPathHandler(`{"items": []}`)}
+	ctx := runWithServer(t, paths, "user", "unentitled", "--parallel", "1")
+	ctx.assertOnlyInfoContains("Users without entitlements")
+	assert.Contains(t, ctx.info, "olaf")
+	assert.Contains(t, ctx.info, "Active users: 1, without entitlements: 1, too new: 0, not checked: 0")
+
+	ctx = runWithServer(t, paths, "user", "unentitled", "--modified-after", "yesterday")
+	ctx.assertOnlyErrContains(`Invalid --modified-after: "yesterday" is not a date`)
+}
+
+func TestListUnentitledUsersToCsvFile(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta&count=500&filter=active+eq+true&startIndex=1": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"userName": "olaf", "id": "2"}]}`),
+		"GET" + vidmBasePathTenantInUrl + "entitlements/definitions/users/2": GoodPathHandler(`{"items": []}`)}
+	dir, err := ioutil.TempDir("", "priam-unentitled")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	runWithServer(t, paths, "user", "unentitled", "--csv-file", filepath.Join(dir, "unentitled.csv"))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "unentitled.csv"))
+	require.Nil(t, err)
+	assert.Contains(t, string(content), "olaf")
+}
+
+func TestRequestStats(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta&count=500&filter=active+eq+true&startIndex=1": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"userName": "olaf", "id": "2"}]}`),
+		"GET" + vidmBasePathTenantInUrl + "entitlements/definitions/users/2": GoodPathHandler(`{"items": []}`)}
+	ctx := runWithServer(t, paths, "user", "unentitled")
+	assert.Contains(t, ctx.info, "Requests: 2, retries: 0, 4xx: 0, 5xx: 0, p50: ")
+	assert.Empty(t, ctx.err)
+
+	ctx = runWithServer(t, paths, "--quiet", "user", "unentitled")
+	assert.NotContains(t, ctx.info+ctx.err, "Requests: ")
+	ctx = runWithServer(t, paths, "--format", "json", "user", "unentitled")
+	assert.NotContains(t, ctx.info+ctx.err, "Requests: ")
+
+	ctx = runWithServer(t, paths, "--quiet", "--stats", "user", "unentitled")
+	assert.Contains(t, ctx.err, "Requests: 2, retries: 0")
+	assert.Contains(t, ctx.err, "     1  GET entitlements/definitions\n")
+	assert.Contains(t, ctx.err, "     1  GET scim/Users\n")
+}
+
+func TestUserExistsPrintsOnlyID(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22bob%22": GoodPathHandler(
+			`{"Resources": [{"userName": "bob", "id": "12"}]}`)}
+	ctx := runWithServer(t, paths, "user", "exists", "--print-id", "bob")
+	assert.Equal(t, "12\n", ctx.info)
+	assert.Empty(t, ctx.err)
+}
+
+func TestGroupExistsFailsQuietlyIfNotFound(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22eng%22": GoodPathHandler(
+			`{"Resources": []}`)}
+	ctx := runWithServer(t, paths, "group", "exists", "eng")
+	assert.Empty(t, ctx.info)
+	assert.Empty(t, ctx.err)
+	assert.Equal(t, ExitNotFound, ctx.exitCode)
+}
+
+func TestDeactivateUser(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(
+			`{"Resources": [{"userName": "elsa", "id": "123"}]}`),
+		"POST" + vidmBasePathTenantInUrl + "scim/Users/123": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Contains(t, req.Input, `"UserStatus":"offboarded"`)
+			return &TstReply{Status: 204}
+		}}
+	ctx := runWithServer(t, paths, "user", "deactivate", "--status", "offboarded", "elsa")
+	ctx.assertOnlyInfoContains(`User "elsa" deactivated`)
+}
+
+func TestAuditOfChanges(t *testing.T) {
+	auditFile := WriteTempFile(t, "")
+	defer CleanupTempFile(auditFile)
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22elsa%22": GoodPathHandler(
+			`{"Resources": [{"userName": "elsa", "id": "123"}]}`),
+		"POST" + vidmBasePathTenantInUrl + "scim/Users/123": ErrorHandler(204, "")}
+	runWithServer(t, paths, "--audit-file", auditFile.Name(), "user", "deactivate", "elsa")
+	ctx := runner(newTstCtx(t, ""), "audit", "--since", "2020-01-01", "--resource", "elsa", auditFile.Name())
+	ctx.assertOnlyInfoContains("---- 1 audit records ----")
+	assert.Contains(t, ctx.info, "method: POST\n  path: scim/Users/123\n  resource: elsa\n  status: 204")
+}
+
+func TestAuditRequiresFileAndValidTimes(t *testing.T) {
+	runner(newTstCtx(t, ""), "audit").assertOnlyErrContains("No audit file given")
+	runner(newTstCtx(t, ""), "audit", "--until", "yesterday", "audit.log").
+		assertOnlyErrContains(`Invalid --until: "yesterday" is not a date`)
+}
+
 func TestCanUpdateUserPassword(t *testing.T) {
 	newpassword := "friendsforever"
 	usersServiceMock := setupUsersServiceMock()
@@ -521,9 +1441,18 @@ func TestCanUpdateUserInfo(t *testing.T) {
 	testMockCommand(t, &usersServiceMock.Mock, "user", "update", "elsa", "--given", newgiven, "--family", newfamily, "--email", newemail)
 }
 
+func TestCanUpdateUserEmails(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("UpdateEntity", mock.Anything, "elsa", &UserUpdate{BasicUser: BasicUser{Name: "elsa"},
+		AddEmails: []string{"elsa@ice.com", "queen@arendelle.com"}, RemoveEmails: []string{"elsa@old.com"},
+		PrimaryEmail: "queen@arendelle.com"}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "update", "--add-email", "elsa@ice.com", "--add-email",
+		"queen@arendelle.com", "--remove-email", "elsa@old.com", "--set-primary-email", "queen@arendelle.com", "elsa")
+}
+
 func TestLoadUsersFromYamlFile(t *testing.T) {
 	usersServiceMock := setupUsersServiceMock()
-	usersServiceMock.On("LoadEntities", mock.Anything, yamlUsersFile).Return()
+	usersServiceMock.On("LoadEntities", mock.Anything, yamlUsersFile, (*Checkpoint)(nil)).Return()
 	testMockCommand(t, &usersServiceMock.Mock, "user", "load", yamlUsersFile)
 }
 
@@ -542,21 +1471,41 @@ func TestCanGetGroup(t *testing.T) {
 	testMockCommand(t, &groupsServiceMock.Mock, "group", "get", "friendsforever")
 }
 
+func TestGetGroupsByNamePrefix(t *testing.T) {
+	groupsService = &SCIMGroupsService{}
+	defer setupGroupsServiceMock()
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+sw+%22eng+platform-%22&startIndex=1": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"id": "g1", "displayName": "eng platform-api"}]}`)}
+	ctx := runWithServer(t, paths, "group", "get", "--match", "prefix", "eng platform-")
+	ctx.assertOnlyInfoContains("displayName: eng platform-api")
+	ctx = runWithServer(t, paths, "group", "get", "--match", "suffix", "eng platform-")
+	ctx.assertOnlyErrContains(`unknown name match "suffix"`)
+}
+
+func TestSearchGroupsByPrefix(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Groups?attributes=id%2CdisplayName%2Cmembers&count=500&filter=displayName+sw+%22org-eng%22&startIndex=1": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"id": "g1", "displayName": "org-eng-api", "members": [{"value": "u1"}]}]}`)}
+	ctx := runWithServer(t, paths, "group", "search", "--prefix", "org-eng")
+	ctx.assertOnlyInfoContains("displayName: org-eng-api\n  memberCount: 1")
+}
+
 func TestCanListGroups(t *testing.T) {
 	groupsServiceMock := setupGroupsServiceMock()
-	groupsServiceMock.On("ListEntities", mock.Anything, 0, "").Return(nil)
+	groupsServiceMock.On("ListEntities", mock.Anything, ListOptions{}).Return(nil)
 	testMockCommand(t, &groupsServiceMock.Mock, "group", "list")
 }
 
 func TestCanListGroupsWithCount(t *testing.T) {
 	groupsServiceMock := setupGroupsServiceMock()
-	groupsServiceMock.On("ListEntities", mock.Anything, 13, "").Return(nil)
+	groupsServiceMock.On("ListEntities", mock.Anything, ListOptions{Count: 13}).Return(nil)
 	testMockCommand(t, &groupsServiceMock.Mock, "group", "list", "--count", "13")
 }
 
 func TestCanListGroupsWithFilter(t *testing.T) {
 	groupsServiceMock := setupGroupsServiceMock()
-	groupsServiceMock.On("ListEntities", mock.Anything, 0, "myfilter").Return(nil)
+	groupsServiceMock.On("ListEntities", mock.Anything, ListOptions{Filter: "myfilter"}).Return(nil)
 	testMockCommand(t, &groupsServiceMock.Mock, "group", "list", "--filter", "myfilter")
 }
 
@@ -572,6 +1521,23 @@ func TestCanRemoveMemberFromGroup(t *testing.T) {
 	testMockCommand(t, &groupServiceMock.Mock, "group", "member", "--delete", "friendsforever", "sven")
 }
 
+func TestCanRenameGroup(t *testing.T) {
+	groupServiceMock := setupGroupsServiceMock()
+	groupServiceMock.On("UpdateEntity", mock.Anything, "eng", &GroupUpdate{DisplayName: "engineering"}).Return()
+	testMockCommand(t, &groupServiceMock.Mock, "group", "update", "--name", "engineering", "eng")
+}
+
+func TestCanClearDescriptionOfGroupByID(t *testing.T) {
+	groupServiceMock := setupGroupsServiceMock()
+	groupServiceMock.On("UpdateEntity", mock.Anything, "10", &GroupUpdate{SetDescription: true, ByID: true}).Return()
+	testMockCommand(t, &groupServiceMock.Mock, "group", "update", "--description", "", "--id", "10")
+}
+
+func TestUpdateGroupWithNothingToUpdateShowsError(t *testing.T) {
+	ctx := runner(newTstCtx(t, " "), "group", "update", "eng")
+	ctx.assertInfoErrContains("USAGE", "Nothing to update, give --name or --description")
+}
+
 // - Policies
 
 func TestCanListAccessPolicies(t *testing.T) {
@@ -590,6 +1556,22 @@ func TestCantListAccessPoliciesWithoutAuth(t *testing.T) {
 }
 
 // - Schema
+func TestScimListOfAnyResourceType(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Devices?attributes=id%2CdeviceName&count=2": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"id": "d1", "deviceName": "pixel"}]}`)}
+	ctx := runWithServer(t, paths, "scim", "list", "--name-attr", "deviceName", "--count", "2", "Devices")
+	ctx.assertOnlyInfoContains("deviceName: pixel")
+}
+
+func TestScimTypes(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/ResourceTypes": GoodPathHandler(
+			`{"Resources": [{"name": "Device", "endpoint": "/Devices"}]}`)}
+	ctx := runWithServer(t, paths, "scim", "types")
+	ctx.assertOnlyInfoContains("endpoint: /Devices")
+}
+
 func TestCannotGetSchemaIfNoTypeSpecified(t *testing.T) {
 	ctx := testCliCommand(t, "schema")
 	ctx.assertInfoErrContains("USAGE", "Input Error: at least 1 arguments must be given")
@@ -659,7 +1641,7 @@ func TestErrorWhenCannotSetLocalUserStoreConfiguration(t *testing.T) {
 	paths := map[string]TstHandler{
 		"PUT/SAAS/jersey/manager/api/localuserstore": ErrorHandler(500, "error test")}
 	ctx := runWithServer(t, paths, "localuserstore", "showLocalUserStore=false")
-	ctx.assertOnlyErrContains("error test")
+	ctx.assertInfoErrContains("Using target 1", "error test")
 }
 
 // - Roles
@@ -679,13 +1661,13 @@ func TestCanGetRole(t *testing.T) {
 
 func TestCanDisplayAllRoles(t *testing.T) {
 	rolesServiceMock := setupRolesServiceMock()
-	rolesServiceMock.On("ListEntities", mock.Anything, 0, "").Return()
+	rolesServiceMock.On("ListEntities", mock.Anything, ListOptions{}).Return()
 	testMockCommand(t, &rolesServiceMock.Mock, "role", "list")
 }
 
 func TestCanDisplayAllRolesWithCountAndFilter(t *testing.T) {
 	rolesServiceMock := setupRolesServiceMock()
-	rolesServiceMock.On("ListEntities", mock.Anything, 2, "filter").Return()
+	rolesServiceMock.On("ListEntities", mock.Anything, ListOptions{Count: 2, Filter: "filter"}).Return()
 	testMockCommand(t, &rolesServiceMock.Mock, "role", "list", "--count", "2", "--filter", "filter")
 }
 
@@ -739,28 +1721,52 @@ func TestCanGetApp(t *testing.T) {
 
 func TestCanDeleteApp(t *testing.T) {
 	appsServiceMock := setupAppsServiceMock()
-	appsServiceMock.On("Delete", mock.Anything, "makesnow").Return()
+	appsServiceMock.On("Delete", mock.Anything, "makesnow", false, false).Return()
 	testMockCommand(t, &appsServiceMock.Mock, "app", "delete", "makesnow")
 }
 
+func TestCanForceDeleteAppWithEntitlements(t *testing.T) {
+	appsServiceMock := setupAppsServiceMock()
+	appsServiceMock.On("Delete", mock.Anything, "makesnow", true, true).Return()
+	testMockCommand(t, &appsServiceMock.Mock, "app", "delete", "-f", "--remove-entitlements", "makesnow")
+}
+
 func TestCanListApps(t *testing.T) {
 	appsServiceMock := setupAppsServiceMock()
-	appsServiceMock.On("List", mock.Anything, 0, "").Return()
+	appsServiceMock.On("List", mock.Anything, 0, "", false).Return()
 	testMockCommand(t, &appsServiceMock.Mock, "app", "list")
 }
 
 func TestCanListAppsWithCountAndFilter(t *testing.T) {
 	appsServiceMock := setupAppsServiceMock()
-	appsServiceMock.On("List", mock.Anything, 2, "filter").Return()
+	appsServiceMock.On("List", mock.Anything, 2, "filter", false).Return()
 	testMockCommand(t, &appsServiceMock.Mock, "app", "list", "--count", "2", "--filter", "filter")
 }
 
+func TestCanListAppsWithFullInfo(t *testing.T) {
+	appsServiceMock := setupAppsServiceMock()
+	appsServiceMock.On("List", mock.Anything, 0, "olaf", true).Return()
+	testMockCommand(t, &appsServiceMock.Mock, "app", "list", "--full", "--filter", "olaf")
+}
+
 func TestCanPublishAnAppWithASpecificManifest(t *testing.T) {
 	appsServiceMock := setupAppsServiceMock()
-	appsServiceMock.On("Publish", mock.Anything, "my-manifest.yaml").Return()
+	appsServiceMock.On("Publish", mock.Anything, "my-manifest.yaml", false, false).Return()
 	testMockCommand(t, &appsServiceMock.Mock, "app", "add", "my-manifest.yaml")
 }
 
+func TestCanForcePublishAnApp(t *testing.T) {
+	appsServiceMock := setupAppsServiceMock()
+	appsServiceMock.On("Publish", mock.Anything, "my-manifest.yaml", true, false).Return()
+	testMockCommand(t, &appsServiceMock.Mock, "app", "add", "--force", "my-manifest.yaml")
+}
+
+func TestCanPublishAnAppThatUpdatesExistingOnes(t *testing.T) {
+	appsServiceMock := setupAppsServiceMock()
+	appsServiceMock.On("Publish", mock.Anything, "my-manifest.yaml", false, true).Return()
+	testMockCommand(t, &appsServiceMock.Mock, "app", "add", "--update", "my-manifest.yaml")
+}
+
 // - Entitlements
 
 func TestGetEntitlementWithNoArgsShowsHelp(t *testing.T) {
@@ -783,7 +1789,21 @@ func TestGetEntitlementWithNoNameShowsError(t *testing.T) {
 
 func TestGetEntitlementWithWrongTypeShowsError(t *testing.T) {
 	ctx := runner(newTstCtx(t, " "), "entitlement", "get", "actor", "swayze")
-	ctx.assertInfoErrContains("USAGE", "First parameter of 'get' must be user, group or app")
+	ctx.assertInfoErrContains("USAGE", "First parameter of 'get' must be one of: group, role, user, app")
+}
+
+func TestEntitleWithWrongTypeShowsError(t *testing.T) {
+	ctx := runner(newTstCtx(t, " "), "entitlement", "add", "app", "swayze", "dirty-dancing")
+	ctx.assertInfoErrContains("USAGE", "First parameter of 'add' must be one of: group, role, user")
+}
+
+func TestCanEntitleUserToAppByID(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET/SAAS/jersey/manager/api/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22swayze%22": GoodPathHandler(
+			`{"Resources": [{ "userName" : "swayze", "id": "12345"}]}`),
+		"POST/SAAS/jersey/manager/api/entitlements/definitions": GoodPathHandler(`{}`)}
+	ctx := runWithServer(t, paths, "entitlement", "add", "--id", "user", "swayze", "dirty-dancing")
+	ctx.assertOnlyInfoContains(`Entitled user "swayze" to app "dirty-dancing"`)
 }
 
 // - Oauth2 Application Templates
@@ -952,3 +1972,100 @@ func TestCanUpdateAWSCredentialsInExplicitCredFileAndProfile(t *testing.T) {
 	tokenServiceMock.On("UpdateAWSCredentials", mock.Anything, goodIdToken, "space-hound", expectedAwsStsEndpoint, cfgFile, "kazak").Return(nil)
 	testMockCommand(t, &tokenServiceMock.Mock, "token", "aws", "-c", cfgFile, "-p", "kazak", "space-hound")
 }
+
+func TestUpdateUserClearsAttributes(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("UpdateEntity", mock.Anything, "elsa", &UserUpdate{BasicUser: BasicUser{Name: "elsa", Family: "arendelle"},
+		AddEmails: []string{}, RemoveEmails: []string{}, Clear: []string{"title", "name.givenName"}}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "update", "--clear", "title", "--given", "", "--family", "arendelle", "elsa")
+}
+
+func TestUpdateUserClearsNames(t *testing.T) {
+	usersServiceMock := setupUsersServiceMock()
+	usersServiceMock.On("UpdateEntity", mock.Anything, "elsa", &UserUpdate{BasicUser: BasicUser{Name: "elsa"},
+		AddEmails: []string{}, RemoveEmails: []string{},
+		Clear: []string{"name.middleName", "name.honorificPrefix", "displayName"}}).Return()
+	testMockCommand(t, &usersServiceMock.Mock, "user", "update", "--middle", "", "--honorific", "", "--display", "",
+		"elsa")
+}
+
+func TestAddUserChecksForDuplicatesUnlessDisabled(t *testing.T) {
+	search := "GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails&count=500&filter="
+	paths := map[string]TstHandler{
+		search + "userName+eq+%22elsa%22&startIndex=1":  GoodPathHandler(ScimUsersPage(1, 1, "elsa")),
+		"POST" + vidmBasePathTenantInUrl + "scim/Users": GoodPathHandler(`{"id": "1"}`)}
+	ctx := runUsersCmdWithServer(t, paths, "user", "add", "--skip-policy-check", "--email", "elsa@ice.com", "elsa", "fr0zen")
+	ctx.assertInfoErrContains("Using target 1", `Error creating user 'elsa': a user named "elsa" already exists with id elsa-id`)
+	ctx = runUsersCmdWithServer(t, paths, "user", "add", "--skip-policy-check", "--no-duplicate-check",
+		"--email", "elsa@ice.com", "elsa", "fr0zen")
+	ctx.assertOnlyInfoContains("User 'elsa' successfully added")
+}
+
+func TestIDChoosesAmongResourcesWithTheSameName(t *testing.T) {
+	users := `{"Resources": [{"id": "u1", "userName": "olaf"}, {"id": "u2", "userName": "Olaf"}]}`
+	paths := map[string]TstHandler{
+		"GET" + vidmBasePathTenantInUrl + "scim/Users?count=500&filter=userName+eq+%22olaf%22": GoodPathHandler(users)}
+	ctx := runUsersCmdWithServer(t, paths, "user", "get", "olaf")
+	ctx.assertInfoErrContains("id: u2", `multiple Users found named "olaf", choose one with --choose-id`)
+	ctx = runUsersCmdWithServer(t, paths, "--choose-id", "u2", "user", "get", "olaf")
+	ctx.assertOnlyInfoContains("id: u2")
+	assert.NotContains(t, ctx.info, "u1")
+}
+
+func TestCaseSensitiveNamesFromTargetOrOption(t *testing.T) {
+	paths := map[string]TstHandler{"GET" + vidmBasePathTenantInUrl + "scim/Users?count=500&filter=userName+eq+%22bob%22": GoodPathHandler(ScimUsersPage(1, 1, "BOB"))}
+	srv := StartTstServer(t, paths)
+	defer srv.Close()
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	cfg := tstSrvTgtWithAuth(srv.URL) + "    case-sensitive: \"true\"\n"
+	ctx := runner(newTstCtx(t, cfg), "user", "get", "bob")
+	ctx.assertOnlyErrContains(`no Users found named "bob" with this case`)
+	ctx = runner(newTstCtx(t, cfg), "--case-sensitive=false", "user", "get", "bob")
+	ctx.assertOnlyInfoContains("userName: BOB")
+	ctx = runner(newTstCtx(t, tstSrvTgtWithAuth(srv.URL)), "--case-sensitive", "user", "get", "bob")
+	ctx.assertOnlyErrContains(`no Users found named "bob" with this case`)
+}
+
+func TestLowercaseNamesFromTarget(t *testing.T) {
+	search := "GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails&count=500&filter="
+	paths := map[string]TstHandler{
+		search + "userName+eq+%22bob%22&startIndex=1":          GoodPathHandler(`{"Resources": []}`),
+		search + "emails+eq+%22bob%40acme.com%22&startIndex=1": GoodPathHandler(`{"Resources": []}`),
+		"POST" + vidmBasePathTenantInUrl + "scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Contains(t, req.Input, `"UserName":"bob"`)
+			return &TstReply{Output: `{"id": "1"}`}
+		}}
+	srv := StartTstServer(t, paths)
+	defer srv.Close()
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	cfg := tstSrvTgtWithAuth(srv.URL) + "    lowercase-names: \"true\"\n"
+	ctx := runner(newTstCtx(t, cfg), "user", "add", "--skip-policy-check", "--email", "Bob@acme.com", "Bob", "Pa55word")
+	assert.Contains(t, ctx.info, "User 'bob' successfully added")
+	cfg = tstSrvTgtWithAuth(srv.URL) + "    lowercase-names: \"sometimes\"\n"
+	ctx = runner(newTstCtx(t, cfg), "user", "add", "--skip-policy-check", "--email", "Bob@acme.com", "Bob", "Pa55word")
+	ctx.assertOnlyErrContains("invalid lowercase-names option of target")
+}
+
+func TestDisplayNameTemplateFromTarget(t *testing.T) {
+	search := "GET" + vidmBasePathTenantInUrl + "scim/Users?attributes=id%2CuserName%2Cemails&count=500&filter="
+	paths := map[string]TstHandler{
+		search + "userName+eq+%22bob%22&startIndex=1":          GoodPathHandler(`{"Resources": []}`),
+		search + "emails+eq+%22bob%40acme.com%22&startIndex=1": GoodPathHandler(`{"Resources": []}`),
+		"POST" + vidmBasePathTenantInUrl + "scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Contains(t, req.Input, `"DisplayName":"Builder, Bob"`)
+			return &TstReply{Output: `{"id": "1"}`}
+		}}
+	srv := StartTstServer(t, paths)
+	defer srv.Close()
+	usersService = &SCIMUsersService{}
+	defer setupUsersServiceMock()
+	cfg := tstSrvTgtWithAuth(srv.URL) + "    display-name-template: \"{{.Family}}, {{.Given}}\"\n"
+	ctx := runner(newTstCtx(t, cfg), "user", "add", "--skip-policy-check", "--email", "bob@acme.com",
+		"--given", "Bob", "--family", "Builder", "bob", "Pa55word")
+	assert.Contains(t, ctx.info, "User 'bob' successfully added")
+	cfg = tstSrvTgtWithAuth(srv.URL) + "    display-name-template: \"{{.Family\"\n"
+	ctx = runner(newTstCtx(t, cfg), "user", "add", "--skip-policy-check", "--email", "bob@acme.com", "bob", "Pa55word")
+	ctx.assertOnlyErrContains("invalid display-name-template option of target")
+}
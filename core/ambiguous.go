@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+)
+
+const chosenIDKey = "chosenID"
+
+// ambiguousNameError is returned when several resources have the name of the
+// resource to find, with the resources found.
+type ambiguousNameError struct {
+	resType, nameAttr, name string
+	candidates              []scimResource
+}
+
+func (e *ambiguousNameError) Error() string {
+	return fmt.Sprintf("multiple %v found named \"%s\", choose one with --choose-id", e.resType, e.name)
+}
+
+// ChooseID sets the id of the resource to use when a name matches several
+// resources. It is ignored for names that match one resource.
+func ChooseID(ctx *HttpContext, id string) {
+	ctx.SetValue(chosenIDKey, id)
+}
+
+// chooseResource returns the resource with the chosen id among several with
+// the same name, or an ambiguousNameError. The candidates are got again with
+// their creation date if they were got with restricted attributes.
+func chooseResource(ctx *HttpContext, resType, nameAttr, name string, matches []scimResource,
+	attributes []string) (scimResource, error) {
+	if id, _ := ctx.Value(chosenIDKey, nil); id != nil && id != "" {
+		for _, match := range matches {
+			if match.id() == id {
+				return match, nil
+			}
+		}
+	}
+	if len(attributes) > 0 && !HasString("meta", attributes) {
+		return scimGetByName(ctx, resType, nameAttr, name, "id", nameAttr, "meta")
+	}
+	return nil, &ambiguousNameError{resType, nameAttr, name, matches}
+}
+
+// reportAmbiguous prints the id, name and creation date of the resources
+// found if err is an ambiguousNameError, so that one can be chosen.
+func reportAmbiguous(ctx *HttpContext, err error) {
+	var ambiguous *ambiguousNameError
+	if !errors.As(err, &ambiguous) {
+		return
+	}
+	list := []interface{}{}
+	for _, candidate := range ambiguous.candidates {
+		list = append(list, candidate.attributes())
+	}
+	ctx.Log.PP(fmt.Sprintf("%s named %s", ambiguous.resType, ambiguous.name), list, "id", ambiguous.nameAttr,
+		"meta.created")
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"testing"
+)
+
+const duplicateGroups = `{"Resources": [
+	{"id": "g1", "displayName": "` + DEFAULT_GROUP_NAME + `", "meta": {"created": "2020-01-02T03:04:05Z"}},
+	{"id": "g2", "displayName": "` + DEFAULT_GROUP_NAME + `", "meta": {"created": "2021-06-07T08:09:10Z"}}]}`
+
+const groupsWithCreationURL = "GET/scim/Groups?attributes=id%2CdisplayName%2Cmeta&count=500&filter=displayName+eq+%22" +
+	DEFAULT_GROUP_NAME + "%22"
+
+func TestAmbiguousNamePrintsCandidatesWithCreationDates(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_GROUP_URL: GoodPathHandler(`{"Resources": [{"id": "g1", "displayName": "` + DEFAULT_GROUP_NAME +
+			`"}, {"id": "g2", "displayName": "` + DEFAULT_GROUP_NAME + `"}]}`),
+		groupsWithCreationURL: GoodPathHandler(duplicateGroups)})
+	assert.Empty(t, scimNameToID(ctx, "Groups", "displayName", DEFAULT_GROUP_NAME))
+	assert.Equal(t, `Error getting SCIM Groups ID of saturday-night-fever: multiple Groups found named `+
+		`"saturday-night-fever", choose one with --choose-id`+"\n", ctx.Log.ErrString())
+	assert.Equal(t, "---- Groups named saturday-night-fever ----\n"+
+		"- displayName: saturday-night-fever\n  id: g1\n  meta.created: \"2020-01-02T03:04:05Z\"\n"+
+		"- displayName: saturday-night-fever\n  id: g2\n  meta.created: \"2021-06-07T08:09:10Z\"\n",
+		ctx.Log.InfoString())
+}
+
+func TestChosenIDResolvesAmbiguousName(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{DEFAULT_SHOW_GROUP_URL: GoodPathHandler(duplicateGroups)})
+	ChooseID(ctx, "g2")
+	new(SCIMGroupsService).DisplayEntity(ctx, DEFAULT_GROUP_NAME)
+	AssertOnlyInfoContains(t, ctx, "id: g2")
+	assert.NotContains(t, ctx.Log.InfoString(), "g1")
+}
+
+func TestChosenIDThatMatchesNoCandidateIsAmbiguous(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{DEFAULT_SHOW_GROUP_URL: GoodPathHandler(duplicateGroups)})
+	ChooseID(ctx, "g3")
+	new(SCIMGroupsService).DisplayEntity(ctx, DEFAULT_GROUP_NAME)
+	AssertErrorContains(t, ctx, `multiple Groups found named "saturday-night-fever", choose one with --choose-id`)
+	assert.Contains(t, ctx.Log.InfoString(), "id: g1")
+}
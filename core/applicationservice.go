@@ -25,13 +25,18 @@ type ApplicationService interface {
 	Display(ctx *util.HttpContext, name string)
 
 	// Delete deletes the given application defined by its name
-	Delete(ctx *util.HttpContext, name string)
+	// @param removeEntitlements delete the entitlements of the application first
+	// @param force do not ask for confirmation
+	Delete(ctx *util.HttpContext, name string, removeEntitlements, force bool)
 
 	// List lists all applications in the catalog
 	// @param count the number of applications to display
-	// @param filter the filter
-	List(ctx *util.HttpContext, count int, filter string)
+	// @param filter only list applications with names containing this string
+	// @param full display all the application information in JSON rather than a summary
+	List(ctx *util.HttpContext, count int, filter string, full bool)
 
 	// Publish publishes the application defined by the manifestFile into VMware IDM catalog
-	Publish(ctx *util.HttpContext, manifestFile string)
+	// @param force add applications even if one with the same name is in the catalog
+	// @param update update the applications with the same name that are in the catalog
+	Publish(ctx *util.HttpContext, manifestFile string, force, update bool)
 }
@@ -16,6 +16,7 @@ limitations under the License.
 package core
 
 import (
+	"errors"
 	"fmt"
 	"github.com/pborman/uuid"
 	. "github.com/vmware/priam/util"
@@ -54,6 +55,9 @@ type manifestApp struct {
 	Workspace                     priamApp
 }
 
+// number of catalog items requested per page when listing apps
+var appPageSize = 100
+
 type itemResponse struct {
 	Links map[string]interface{}   `json:"_links,omitempty" yaml:"_links,omitempty"`
 	Items []map[string]interface{} `json:",omitempty" yaml:",omitempty"`
@@ -65,18 +69,18 @@ func (service IDMApplicationService) Display(ctx *HttpContext, appName string) {
 }
 
 // Delete given application from the catalog
-func (service IDMApplicationService) Delete(ctx *HttpContext, appName string) {
-	appDelete(ctx, appName)
+func (service IDMApplicationService) Delete(ctx *HttpContext, appName string, removeEntitlements, force bool) {
+	appDelete(ctx, appName, removeEntitlements, force)
 }
 
 // List all applications in the catalog
-func (service IDMApplicationService) List(ctx *HttpContext, count int, filter string) {
-	appList(ctx, count, filter)
+func (service IDMApplicationService) List(ctx *HttpContext, count int, filter string, full bool) {
+	appList(ctx, count, filter, full)
 }
 
 // Publish an application
-func (service IDMApplicationService) Publish(ctx *HttpContext, manifestFile string) {
-	PublishApps(ctx, manifestFile)
+func (service IDMApplicationService) Publish(ctx *HttpContext, manifestFile string, force, update bool) {
+	PublishApps(ctx, manifestFile, force, update)
 }
 
 func accessPolicyId(ctx *HttpContext, name string) string {
@@ -97,21 +101,27 @@ func accessPolicyId(ctx *HttpContext, name string) string {
 	return ""
 }
 
+// errAppFound stops the pages of a search once the app is found
+var errAppFound = errors.New("app found")
+
 // input name, uuid
-// output uuid of existing app with the input uuid or uuid of first app with name
-func checkAppExists(ctx *HttpContext, name, uuid string) (outid string, err error) {
-	outp := &itemResponse{}
-	ctx.Accept("catalog.summary.list").ContentType("catalog.search")
-	if err = ctx.Request("POST", "catalogitems/search?pageSize=10000", "{}", &outp); err == nil {
-		for _, item := range outp.Items {
-			if CaseEqual(uuid, item["uuid"]) {
-				outid = uuid
-				return
+// output uuid of existing app with the input uuid or uuid of first app with name,
+// and true if it has the input uuid. All pages of the catalog are searched.
+func checkAppExists(ctx *HttpContext, name, uuid string) (outid string, byUUID bool, err error) {
+	err = appPages(ctx, "", 0, func(items []map[string]interface{}) error {
+		for _, item := range items {
+			if uuid != "" && CaseEqual(uuid, item["uuid"]) {
+				outid, byUUID = uuid, true
+				return errAppFound
 			}
 			if CaselessEqual(name, item["name"]) && outid == "" {
 				outid = InterfaceToString(item["uuid"])
 			}
 		}
+		return nil
+	})
+	if err == errAppFound {
+		err = nil
 	}
 	return
 }
@@ -134,28 +144,68 @@ func getAppUuid(ctx *HttpContext, name string) (uuid, mtype string, err error) {
 		}
 	}
 	if uuid == "" {
-		err = fmt.Errorf("No app found with name \"%s\"", name)
+		err = NotFound("No app found with name \"%s\"", name)
 	}
 	return
 }
 
+// appID returns the catalog item id of the named app. A name that already
+// looks like a UUID is taken to be the id.
+func appID(ctx *HttpContext, name string) (string, error) {
+	if uuid.Parse(name) != nil {
+		return name, nil
+	}
+	id, _, err := getAppUuid(ctx, name)
+	return id, err
+}
+
+func appNameToID(ctx *HttpContext, name string) string {
+	if id, err := appID(ctx, name); err == nil {
+		return id
+	} else {
+		ctx.Log.Err("Error getting catalog item ID of %s: %v\n", name, err)
+	}
+	return ""
+}
+
 func getAppByUuid(ctx *HttpContext, uuid, mtype string) (app map[string]interface{}, err error) {
 	app = make(map[string]interface{})
 	err = ctx.Accept(mtype).Request("GET", fmt.Sprintf("catalogitems/%s", uuid), nil, &app)
 	return
 }
 
-func PublishApps(ctx *HttpContext, manifile string) {
+// getManifestApps reads the applications from a manifest file
+func getManifestApps(manifile string) ([]manifestApp, error) {
+	var manifest struct{ Applications []manifestApp }
+	if err := GetYamlFile(manifile, &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest.Applications) == 0 {
+		return nil, fmt.Errorf("no applications found in %s", manifile)
+	}
+	for i := range manifest.Applications {
+		w := &manifest.Applications[i].Workspace
+		if w.AuthInfo != nil {
+			w.AuthInfo = ChangeKeysToString(w.AuthInfo).(map[string]interface{})
+		}
+	}
+	return manifest.Applications, nil
+}
+
+// PublishApps adds the applications in the manifest to the catalog. An app
+// with the uuid of the manifest is updated. An app with the same name is
+// updated if update is set, or another app with the name is added if force
+// is set, and otherwise the app is refused as a duplicate.
+func PublishApps(ctx *HttpContext, manifile string, force, update bool) {
 	if manifile == "" {
 		manifile = "manifest.yaml"
 	}
-	var manifest struct{ Applications []manifestApp }
-	if err := GetYamlFile(manifile, &manifest); err != nil {
+	apps, err := getManifestApps(manifile)
+	if err != nil {
 		ctx.Log.Err("Error getting manifest: %v\n", err)
 		return
 	}
-	manifest.Applications[0].Workspace.AuthInfo = ChangeKeysToString(manifest.Applications[0].Workspace.AuthInfo).(map[string]interface{})
-	for _, v := range manifest.Applications {
+	for _, v := range apps {
 		var w = &v.Workspace
 		if w.Name == "" {
 			w.Name = v.Name
@@ -172,14 +222,18 @@ func PublishApps(ctx *HttpContext, manifile string) {
 			continue
 		}
 		method, path, errVerb, successVerb := "POST", "catalogitems", "adding", "added"
-		id, err := checkAppExists(ctx, w.Name, w.Uuid)
+		id, byUUID, err := checkAppExists(ctx, w.Name, w.Uuid)
 		if err != nil {
 			ctx.Log.Err("Error checking if app %s exists: %v\n", w.Name, err)
 			continue
 		}
-		if id != "" {
+		if id != "" && (byUUID || update) {
 			method, errVerb, successVerb, w.Uuid = "PUT", "updating", "updated", id
 			path += "/" + id
+		} else if id != "" && !force {
+			ctx.Log.Err("App \"%s\" already exists in the catalog with uuid %s, use --update to update it or "+
+				"--force to add another app with the same name\n", w.Name, id)
+			continue
 		}
 		if w.Uuid == "" {
 			w.Uuid = uuid.New()
@@ -201,17 +255,42 @@ func PublishApps(ctx *HttpContext, manifile string) {
 			ctx.Log.Err("Error %s %s to the catalog: %v\n", errVerb, w.Name, err)
 			continue
 		}
-		ctx.Log.Info("App \"%s\" %s to the catalog\n", w.Name, successVerb)
-		maybeEntitle(ctx, w.Uuid, entitleGrp, "group", "displayName", w.Name)
-		maybeEntitle(ctx, w.Uuid, entitleUser, "user", "userName", w.Name)
+		ctx.Log.Info("App \"%s\" %s to the catalog, uuid %s\n", w.Name, successVerb, w.Uuid)
+		maybeEntitle(ctx, w.Uuid, entitleGrp, "group", w.Name, false)
+		maybeEntitle(ctx, w.Uuid, entitleUser, "user", w.Name, false)
 	}
 }
 
-func appDelete(ctx *HttpContext, name string) {
-	if uuid, _, err := getAppUuid(ctx, name); err != nil {
+func appDelete(ctx *HttpContext, name string, removeEntitlements, force bool) {
+	uuid, _, err := getAppUuid(ctx, name)
+	if err != nil {
 		ctx.Log.Err("Error getting app info by name: %v\n", err)
-	} else if err := ctx.Request("DELETE", fmt.Sprintf("catalogitems/%s", uuid), nil, nil); err != nil {
+		return
+	}
+	if !force && !ctx.Log.Confirm("Delete app \"%s\" with uuid %s from the catalog?", name, uuid) {
+		ctx.Log.Info("app %s not deleted\n", name)
+		return
+	}
+	if removeEntitlements {
+		removed, failed, err := removeAppEntitlements(ctx, name, uuid)
+		if err != nil {
+			ctx.Log.Err("Error removing entitlements of app %s: %v\n", name, err)
+			return
+		}
+		if removed > 0 {
+			ctx.Log.Info("%d entitlements of app %s removed\n", removed, name)
+		}
+		if failed > 0 {
+			ctx.Log.Err("App %s not deleted, %d of its entitlements could not be removed\n", name, failed)
+			ctx.Log.Fail(ExitPartial)
+			return
+		}
+	}
+	if err := ctx.Request("DELETE", fmt.Sprintf("catalogitems/%s", uuid), nil, nil); err != nil {
 		ctx.Log.Err("Error deleting app %s from catalog: %v\n", name, err)
+		if defs, err := getAppEntitlements(ctx, uuid); !removeEntitlements && err == nil && len(defs) > 0 {
+			ctx.Log.Err("App %s still has %d entitlements, use --remove-entitlements to delete them first\n", name, len(defs))
+		}
 	} else {
 		ctx.Log.Info("app %s deleted\n", name)
 	}
@@ -227,19 +306,97 @@ func appGet(ctx *HttpContext, name string) {
 	}
 }
 
-func appList(ctx *HttpContext, count int, filter string) {
-	if count == 0 {
-		count = 10000
+// maxAppPages is the most pages of catalog items requested by one search, so
+// that a catalog that does not page with startIndex is not asked forever
+var maxAppPages = 1000
+
+// appKey returns what tells apart the catalog items of a search
+func appKey(item map[string]interface{}) string {
+	if uuid, ok := item["uuid"].(string); ok {
+		return uuid
 	}
-	path, input := fmt.Sprintf("catalogitems/search?pageSize=%v", count), "{}"
+	return fmt.Sprint(item)
+}
+
+// appPages calls fn with each page of the catalog items whose name matches
+// the filter, if any, until limit items are got if limit is positive. A
+// short page is not the last, since the catalog may return fewer items per
+// page than requested, only an empty one is, or one that starts with an item
+// of the pages before it or has no other item, in case the catalog ignores
+// startIndex. Items already got are not passed to fn again.
+func appPages(ctx *HttpContext, filter string, limit int, fn func(items []map[string]interface{}) error) error {
+	input := "{}"
 	if filter != "" {
 		input = fmt.Sprintf(`{"nameFilter":"%s"}`, EscapeQuotes(filter))
 	}
-	body := make(map[string]interface{})
-	ctx.Accept("catalog.summary.list").ContentType("catalog.search")
-	if err := ctx.Request("POST", path, input, &body); err != nil {
+	seen, got, start, short, requested, clamped := make(map[string]bool), 0, 0, 0, 0, false
+	for page := 0; limit <= 0 || got < limit; page++ {
+		if page == maxAppPages {
+			ctx.Log.Warn("Stopped after %d pages of catalog items, the catalog may not page with startIndex\n", page)
+			return nil
+		}
+		pageSize, body := appPageSize, new(itemResponse)
+		if limit > 0 && limit-got < pageSize {
+			pageSize = limit - got
+		}
+		path := fmt.Sprintf("catalogitems/search?startIndex=%d&pageSize=%d", start, pageSize)
+		ctx.Accept("catalog.summary.list").ContentType("catalog.search")
+		if err := ctx.Request("POST", path, input, body); err != nil {
+			return err
+		}
+		if len(body.Items) == 0 {
+			return nil
+		}
+		repeated, items := seen[appKey(body.Items[0])], []map[string]interface{}{}
+		for _, item := range body.Items {
+			if key := appKey(item); !seen[key] {
+				seen[key], items = true, append(items, item)
+			}
+		}
+		if got, start = got+len(items), start+len(body.Items); len(items) > 0 {
+			if err := fn(items); err != nil {
+				return err
+			}
+		}
+		if repeated || len(items) == 0 {
+			ctx.Log.Debug("The catalog returned apps of the pages before startIndex %d, it may not page with "+
+				"startIndex\n", start-len(body.Items))
+			return nil
+		} else if short > 0 && !clamped {
+			clamped = true
+			ctx.Log.Debug("The catalog returns at most %d apps per page rather than the %d requested, "+
+				"more requests are needed\n", short, requested)
+		}
+		if short = 0; len(body.Items) < pageSize {
+			short, requested = len(body.Items), pageSize
+		}
+	}
+	return nil
+}
+
+func appList(ctx *HttpContext, count int, filter string, full bool) {
+	items := make([]interface{}, 0)
+	err := appPages(ctx, filter, count, func(page []map[string]interface{}) error {
+		for _, item := range page {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
 		ctx.Log.Err("Error: %v\n", err)
+		return
+	}
+	if len(items) == 0 && !ctx.Log.MachineFormat() {
+		if filter == "" {
+			ctx.Log.Info("No apps in the catalog\n")
+		} else {
+			ctx.Log.Info("No apps in the catalog with name matching \"%s\"\n", filter)
+		}
+	} else if full && !ctx.Log.MachineFormat() {
+		ctx.Log.Info("%s\n", ToStringWithStyle(LJson, items))
+	} else if full {
+		ctx.Log.PP("Apps", items)
 	} else {
-		ctx.Log.PP("Apps", body["items"], "name", "description", "catalogItemType", "uuid")
+		ctx.Log.PP("Apps", items, "name", "uuid", "catalogItemType", "description")
 	}
 }
@@ -16,6 +16,7 @@ limitations under the License.
 package core
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
@@ -98,52 +99,268 @@ func TestAppGetErrorDuplicateName(t *testing.T) {
 	AssertErrorContains(t, ctx, `Error getting app info by name: Multiple apps with name "olaf"`)
 }
 
+const appListPath = "POST/catalogitems/search?startIndex=0&pageSize=100"
+
+// appListEndPath is the path of the page after a list of one app, which is
+// requested since only an empty page ends the list
+const appListEndPath = "POST/catalogitems/search?startIndex=1&pageSize=100"
+
 func TestAppList(t *testing.T) {
 	paths := map[string]TstHandler{
-		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+		appListPath:    appSearchH(appSearchFilter, appSearchResult, 0),
+		appListEndPath: appSearchH(appSearchFilter, `{"items": []}`, 0)}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	new(IDMApplicationService).List(ctx, 0, "olaf")
-	AssertOnlyInfoContains(t, ctx, `name: olaf`)
+	new(IDMApplicationService).List(ctx, 0, "olaf", false)
+	AssertOnlyInfoContains(t, ctx, "---- Apps ----\n- catalogItemType: Saml20\n  name: olaf\n  uuid: 6c48beb6-afb1-44bc-ad7f-980214ee346c")
+}
+
+func TestAppListFull(t *testing.T) {
+	paths := map[string]TstHandler{
+		appListPath:    appSearchH(appSearchFilter, `{"items": [{ "name" : "olaf", "visible": true}]}`, 0),
+		appListEndPath: appSearchH(appSearchFilter, `{"items": []}`, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "olaf", true)
+	assert.Equal(t, "[\n  {\n    \"name\": \"olaf\",\n    \"visible\": true\n  }\n]\n", ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestAppListEmpty(t *testing.T) {
+	paths := map[string]TstHandler{appListPath: appSearchH("{}", `{"items": []}`, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "", false)
+	AssertOnlyInfoContains(t, ctx, "No apps in the catalog\n")
+}
+
+func TestAppListEmptyInJson(t *testing.T) {
+	paths := map[string]TstHandler{appListPath: appSearchH("{}", `{"items": []}`, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.Format = FJson
+	appList(ctx, 0, "", false)
+	assert.Equal(t, "[]\n", ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestAppListEmptyWithFilter(t *testing.T) {
+	paths := map[string]TstHandler{appListPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "sven", false)
+	AssertOnlyInfoContains(t, ctx, `No apps in the catalog with name matching "sven"`)
+}
+
+func appPage(start, end int) string {
+	items := make([]string, 0)
+	for i := start; i < end; i++ {
+		items = append(items, fmt.Sprintf(`{"name": "app%d"}`, i))
+	}
+	return `{"items": [` + strings.Join(items, ",") + `]}`
+}
+
+func TestAppListPages(t *testing.T) {
+	defer func(size int) { appPageSize = size }(appPageSize)
+	appPageSize = 200
+	paths := map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=200":   appSearchH("{}", appPage(0, 200), 0),
+		"POST/catalogitems/search?startIndex=200&pageSize=200": appSearchH("{}", appPage(200, 400), 0),
+		"POST/catalogitems/search?startIndex=400&pageSize=200": appSearchH("{}", appPage(400, 450), 0),
+		"POST/catalogitems/search?startIndex=450&pageSize=200": appSearchH("{}", appPage(450, 450), 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "", false)
+	AssertOnlyInfoContains(t, ctx, "- name: app0\n")
+	AssertOnlyInfoContains(t, ctx, "- name: app449\n")
+	assert.Equal(t, 450, strings.Count(ctx.Log.InfoString(), "- name: app"))
+}
+
+func TestAppListPagesPastCatalogThatReturnsFewerItemsThanRequested(t *testing.T) {
+	paths := map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=100":   appSearchH("{}", appPage(0, 50), 0),
+		"POST/catalogitems/search?startIndex=50&pageSize=100":  appSearchH("{}", appPage(50, 100), 0),
+		"POST/catalogitems/search?startIndex=100&pageSize=100": appSearchH("{}", appPage(100, 120), 0),
+		"POST/catalogitems/search?startIndex=120&pageSize=100": appSearchH("{}", appPage(120, 120), 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.Level = LDebug
+	appList(ctx, 0, "", false)
+	assert.Equal(t, 120, strings.Count(ctx.Log.InfoString(), "- name: app"))
+	assert.Contains(t, ctx.Log.InfoString(), "- name: app119\n")
+	assert.Equal(t, 1, strings.Count(ctx.Log.InfoString(),
+		"The catalog returns at most 50 apps per page rather than the 100 requested"))
+}
+
+func TestAppListStopsWhenCatalogReturnsSamePageAgain(t *testing.T) {
+	page := `{"items": [{"name": "olaf", "uuid": "1"}, {"name": "sven", "uuid": "2"}]}`
+	paths := map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=100": appSearchH("{}", page, 0),
+		"POST/catalogitems/search?startIndex=2&pageSize=100": appSearchH("{}", page, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "", false)
+	assert.Equal(t, 2, strings.Count(ctx.Log.InfoString(), "- name: "))
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestAppListStopsAfterMostPages(t *testing.T) {
+	defer func(size, pages int) { appPageSize, maxAppPages = size, pages }(appPageSize, maxAppPages)
+	appPageSize, maxAppPages = 2, 2
+	paths := map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=2": appSearchH("{}", appPage(0, 2), 0),
+		"POST/catalogitems/search?startIndex=2&pageSize=2": appSearchH("{}", appPage(2, 4), 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 0, "", false)
+	assert.Equal(t, 4, strings.Count(ctx.Log.InfoString(), "- name: app"))
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: Stopped after 2 pages of catalog items")
+}
+
+func TestAppListPagesStopAtCount(t *testing.T) {
+	defer func(size int) { appPageSize = size }(appPageSize)
+	appPageSize = 2
+	paths := map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=2": appSearchH("{}", appPage(0, 2), 0),
+		"POST/catalogitems/search?startIndex=2&pageSize=1": appSearchH("{}", appPage(2, 3), 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appList(ctx, 3, "", false)
+	assert.Equal(t, 3, strings.Count(ctx.Log.InfoString(), "- name: app"))
 }
 
 func TestAppListError(t *testing.T) {
 	paths := map[string]TstHandler{
-		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 403)}
+		appListPath: appSearchH(appSearchFilter, appSearchResult, 403)}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	appList(ctx, 0, "olaf")
+	appList(ctx, 0, "olaf", false)
 	AssertErrorContains(t, ctx, `Error: 403 Forbidden`)
 }
 
+const appEntitlementsPath = "GET/entitlements/definitions/catalogitems/6c48beb6-afb1-44bc-ad7f-980214ee346c"
+const appEntitlementsResult = `{"items": [{"catalogItemId": "6c48beb6-afb1-44bc-ad7f-980214ee346c",
+		"subjectType": "USERS", "subjectId": "123"}, {"catalogItemId": "6c48beb6-afb1-44bc-ad7f-980214ee346c",
+		"subjectType": "GROUPS", "subjectId": "456"}]}`
+
 func TestAppDelete(t *testing.T) {
 	paths := map[string]TstHandler{
 		appDeletePath: GoodPathHandler(""),
 		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	new(IDMApplicationService).Delete(ctx, "olaf")
+	new(IDMApplicationService).Delete(ctx, "olaf", false, true)
+	AssertOnlyInfoContains(t, ctx, `app olaf deleted`)
+}
+
+func TestAppDeleteConfirmed(t *testing.T) {
+	paths := map[string]TstHandler{
+		appDeletePath: GoodPathHandler(""),
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.InR = strings.NewReader("y\n")
+	appDelete(ctx, "olaf", false, false)
+	AssertOnlyInfoContains(t, ctx, `Delete app "olaf" with uuid 6c48beb6-afb1-44bc-ad7f-980214ee346c from the catalog? [y/N]: `)
 	AssertOnlyInfoContains(t, ctx, `app olaf deleted`)
 }
 
+func TestAppDeleteNotConfirmed(t *testing.T) {
+	paths := map[string]TstHandler{appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.InR = strings.NewReader("n\n")
+	appDelete(ctx, "olaf", false, false)
+	AssertOnlyInfoContains(t, ctx, `app olaf not deleted`)
+}
+
 func TestAppDeleteNotFound(t *testing.T) {
 	paths := map[string]TstHandler{
 		appDeletePath: GoodPathHandler(""),
 		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	appDelete(ctx, "sven")
+	appDelete(ctx, "sven", false, true)
 	AssertErrorContains(t, ctx, `No app found with name "sven"`)
 }
 
+func TestAppDeleteMultipleMatches(t *testing.T) {
+	paths := map[string]TstHandler{
+		appSearchPath: appSearchH(appSearchFilter,
+			`{"items": [{ "name" : "olaf", "uuid": "1"}, {"name" : "OLAF", "uuid": "2"}]}`, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appDelete(ctx, "olaf", false, true)
+	AssertOnlyErrorContains(t, ctx, `Error getting app info by name: Multiple apps with name "olaf"`)
+}
+
 func TestAppDeleteError(t *testing.T) {
 	paths := map[string]TstHandler{
-		appDeletePath: ErrorHandler(403, "App not found"),
-		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+		appDeletePath:       ErrorHandler(403, "App not found"),
+		appEntitlementsPath: GoodPathHandler(`{"items": []}`),
+		appSearchPath:       appSearchH(appSearchFilter, appSearchResult, 0)}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	appDelete(ctx, "olaf")
+	appDelete(ctx, "olaf", false, true)
 	AssertErrorContains(t, ctx, `Error deleting app olaf from catalog: 403 Forbidden`)
+	assert.NotContains(t, ctx.Log.ErrString(), "--remove-entitlements")
+}
+
+func TestAppDeleteWithEntitlementsFails(t *testing.T) {
+	paths := map[string]TstHandler{
+		appDeletePath:       ErrorHandler(400, "catalog item is entitled"),
+		appEntitlementsPath: GoodPathHandler(appEntitlementsResult),
+		appSearchPath:       appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appDelete(ctx, "olaf", false, true)
+	AssertOnlyErrorContains(t, ctx, "Error deleting app olaf from catalog: 400 Bad Request\ncatalog item is entitled")
+	AssertOnlyErrorContains(t, ctx, "App olaf still has 2 entitlements, use --remove-entitlements to delete them first")
+}
+
+func TestAppDeleteRemovesEntitlements(t *testing.T) {
+	bulkH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"returnPayloadOnError":true,"operations":[`+
+			`{"method":"DELETE","data":{"catalogItemId":"6c48beb6-afb1-44bc-ad7f-980214ee346c","subjectType":"USERS","subjectId":"123"}},`+
+			`{"method":"DELETE","data":{"catalogItemId":"6c48beb6-afb1-44bc-ad7f-980214ee346c","subjectType":"GROUPS","subjectId":"456"}}]}`,
+			req.Input)
+		return &TstReply{Output: "{}"}
+	}
+	paths := map[string]TstHandler{
+		appDeletePath:                   GoodPathHandler(""),
+		appEntitlementsPath:             GoodPathHandler(appEntitlementsResult),
+		"POST/entitlements/definitions": bulkH,
+		appSearchPath:                   appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appDelete(ctx, "olaf", true, true)
+	AssertOnlyInfoContains(t, ctx, "2 entitlements of app olaf removed\napp olaf deleted")
+}
+
+func TestAppDeleteReportsEntitlementsNotRemoved(t *testing.T) {
+	paths := map[string]TstHandler{
+		appEntitlementsPath: GoodPathHandler(appEntitlementsResult),
+		"POST/entitlements/definitions": GoodPathHandler(`{"operations": [{"method": "DELETE", "status": "200"},
+			{"method": "DELETE", "status": "409", "errors": [{"message": "entitlement is locked"}]}]}`),
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appDelete(ctx, "olaf", true, true)
+	assert.Contains(t, ctx.Log.InfoString(), "Removed entitlement of user 123 to app olaf\n"+
+		"1 entitlements of app olaf removed\n")
+	assert.Equal(t, "Could not remove entitlement of group 456 to app olaf: 409 Conflict: entitlement is locked\n"+
+		"App olaf not deleted, 1 of its entitlements could not be removed\n", ctx.Log.ErrString())
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestAppDeleteRemoveEntitlementsError(t *testing.T) {
+	paths := map[string]TstHandler{
+		appEntitlementsPath: ErrorHandler(500, "no entitlements for you"),
+		appSearchPath:       appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	appDelete(ctx, "olaf", true, true)
+	AssertOnlyErrorContains(t, ctx, "Error removing entitlements of app olaf: 500 Internal Server Error")
 }
 
 const testManifestPrefix = `---
@@ -252,7 +469,8 @@ func (jsonMarshalTester) MarshalJSON() ([]byte, error) {
 
 type appPubEnv struct {
 	accessPolicy, jsonError, iconFile string
-	appCheckH, appPutH                func(t *testing.T, req *TstReq) *TstReply
+	force, update                     bool
+	appCheckH, appPutH, appPostH      func(t *testing.T, req *TstReq) *TstReply
 }
 
 const noIconFile = "<none>"
@@ -262,7 +480,7 @@ func PublishAppTester(t *testing.T, env appPubEnv) *HttpContext {
 }
 
 func PublishAppTesterForManifest(t *testing.T, env appPubEnv, manifestContent string) *HttpContext {
-	const groupPath = "GET/scim/Groups?count=10000&filter=displayName+eq+%22ALL+USERS%22"
+	const groupPath = "GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22ALL+USERS%22"
 	if env.iconFile == "" {
 		env.iconFile = "../resources/vin.jpg"
 	} else if env.iconFile == noIconFile {
@@ -277,11 +495,16 @@ func PublishAppTesterForManifest(t *testing.T, env appPubEnv, manifestContent st
 	if env.appPutH == nil {
 		env.appPutH = GoodPathHandler("")
 	}
+	if env.appPostH == nil {
+		env.appPostH = multipartH
+	}
 	tmpFile := WriteTempFile(t, fmt.Sprintf(manifestContent, env.iconFile, env.jsonError, env.accessPolicy))
 	defer CleanupTempFile(tmpFile)
 	paths := map[string]TstHandler{
-		"POST/catalogitems": multipartH,
+		"POST/catalogitems": env.appPostH,
 		appSearchPath:       env.appCheckH,
+		appListPath:         env.appCheckH,
+		appListEndPath:      env.appCheckH,
 		"GET/accessPolicies": func(t *testing.T, req *TstReq) *TstReply {
 			return &TstReply{Output: accessPolicyResult}
 		},
@@ -291,7 +514,7 @@ func PublishAppTesterForManifest(t *testing.T, env appPubEnv, manifestContent st
 	}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	new(IDMApplicationService).Publish(ctx, tmpFile.Name())
+	new(IDMApplicationService).Publish(ctx, tmpFile.Name(), env.force, env.update)
 	return ctx
 }
 
@@ -318,11 +541,77 @@ func TestPublishAppCheckAppError(t *testing.T) {
 }
 
 func TestPublishAppAlreadyExists(t *testing.T) {
-	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0)})
+	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), update: true})
 	AssertOnlyInfoContains(t, ctx, `App "olaf" updated to the catalog`)
 	AssertOnlyInfoContains(t, ctx, `Entitled group "ALL USERS" to app "olaf"`)
 }
 
+func TestPublishAppAlreadyExistsWithoutForce(t *testing.T) {
+	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0)})
+	AssertOnlyErrorContains(t, ctx, `App "olaf" already exists in the catalog with uuid 6c48beb6-afb1-44bc-ad7f-980214ee346c, `+
+		`use --update to update it or --force to add another app with the same name`)
+}
+
+func TestPublishAppAlreadyExistsWithForceAddsAnother(t *testing.T) {
+	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), appPutH: ErrorHandler(500, "not expected"),
+		force: true})
+	assert.Regexp(t, `App "olaf" added to the catalog, uuid [0-9a-f-]{36}\n`, ctx.Log.InfoString())
+	assert.NotContains(t, ctx.Log.InfoString(), "6c48beb6-afb1-44bc-ad7f-980214ee346c")
+}
+
+func TestPublishNewAppPrintsUuid(t *testing.T) {
+	ctx := PublishAppTester(t, appPubEnv{iconFile: noIconFile, appCheckH: appSearchH("{}", `{"items": []}`, 0)})
+	assert.Regexp(t, `App "olaf" added to the catalog, uuid [0-9a-f-]{36}\n`, ctx.Log.InfoString())
+}
+
+func TestPublishNewAppRequestBody(t *testing.T) {
+	var body map[string]interface{}
+	postH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "catalog.saml20+json", req.ContentType)
+		require.Nil(t, json.Unmarshal([]byte(req.Input), &body))
+		return &TstReply{}
+	}
+	PublishAppTester(t, appPubEnv{iconFile: noIconFile, appCheckH: appSearchH("{}", `{"items": []}`, 0), appPostH: postH})
+	assert.Equal(t, "olaf", body["name"])
+	assert.Equal(t, "Saml20", body["catalogItemType"])
+	assert.Equal(t, "1977-08-11", body["accessPolicySetUuid"])
+	assert.NotContains(t, body, "accessPolicy")
+	assert.NotContains(t, body, "entitleGroup")
+	assert.NotContains(t, body, "iconFile")
+	assert.Equal(t, "https://test.fanny.audience", body["authInfo"].(map[string]interface{})["audience"])
+}
+
+func TestManifestWithMultipleApps(t *testing.T) {
+	tmpFile := WriteTempFile(t, `---
+applications:
+- name: olaf
+  workspace:
+    catalogItemType: WebAppLink
+    authInfo: {type: WebAppLink, 1: one}
+- name: sven
+  workspace:
+    name: reindeer
+    catalogItemType: Saml20
+`)
+	defer CleanupTempFile(tmpFile)
+	apps, err := getManifestApps(tmpFile.Name())
+	require.Nil(t, err)
+	require.Len(t, apps, 2)
+	assert.Equal(t, "olaf", apps[0].Name)
+	assert.Equal(t, map[string]interface{}{"type": "WebAppLink", "1": "one"}, apps[0].Workspace.AuthInfo)
+	assert.Equal(t, "reindeer", apps[1].Workspace.Name)
+	assert.Nil(t, apps[1].Workspace.AuthInfo)
+}
+
+func TestManifestWithNoApps(t *testing.T) {
+	tmpFile := WriteTempFile(t, "---\napplications: []\n")
+	defer CleanupTempFile(tmpFile)
+	_, err := getManifestApps(tmpFile.Name())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no applications found in ")
+	}
+}
+
 func TestPublishAppJsonError(t *testing.T) {
 	ctx := PublishAppTester(t, appPubEnv{jsonError: "json error"})
 	AssertErrorContains(t, ctx, `Error converting app olaf to JSON`)
@@ -335,13 +624,13 @@ func TestPublishNewAppNoIconFile(t *testing.T) {
 }
 
 func TestPublishAppThatExistsNoIconFile(t *testing.T) {
-	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), iconFile: noIconFile})
+	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), iconFile: noIconFile, update: true})
 	AssertOnlyInfoContains(t, ctx, `App "olaf" updated to the catalog`)
 	AssertOnlyInfoContains(t, ctx, `Entitled group "ALL USERS" to app "olaf"`)
 }
 
 func TestPublishAppNoIconFileError(t *testing.T) {
-	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), iconFile: noIconFile, appPutH: ErrorHandler(500, "traditional error")})
+	ctx := PublishAppTester(t, appPubEnv{appCheckH: appGetH(appSearchResult, 0), iconFile: noIconFile, appPutH: ErrorHandler(500, "traditional error"), update: true})
 	AssertErrorContains(t, ctx, `Error updating olaf to the catalog: 500 Internal Server Error`)
 }
 
@@ -361,20 +650,37 @@ func TestGetAccessPolicyNotFound(t *testing.T) {
 
 func TestCheckAppExistsByName(t *testing.T) {
 	srv, ctx := NewTestContext(t, map[string]TstHandler{
-		appSearchPath: appSearchH("{}", appSearchResult, 0)})
+		appListPath:    appSearchH("{}", appSearchResult, 0),
+		appListEndPath: appSearchH("{}", `{"items": []}`, 0)})
 	defer srv.Close()
-	id, err := checkAppExists(ctx, "olaf", "")
+	id, byUUID, err := checkAppExists(ctx, "olaf", "")
 	assert.Nil(t, err)
 	assert.Equal(t, "6c48beb6-afb1-44bc-ad7f-980214ee346c", id)
+	assert.False(t, byUUID)
 }
 
 func TestCheckAppExistsByUUID(t *testing.T) {
 	srv, ctx := NewTestContext(t, map[string]TstHandler{
-		appSearchPath: appSearchH("{}", appSearchResult, 0)})
+		appListPath: appSearchH("{}", appSearchResult, 0)})
 	defer srv.Close()
-	id, err := checkAppExists(ctx, "sven", "6c48beb6-afb1-44bc-ad7f-980214ee346c")
+	id, byUUID, err := checkAppExists(ctx, "sven", "6c48beb6-afb1-44bc-ad7f-980214ee346c")
 	assert.Nil(t, err)
 	assert.Equal(t, "6c48beb6-afb1-44bc-ad7f-980214ee346c", id)
+	assert.True(t, byUUID)
+}
+
+func TestCheckAppExistsOnLaterPage(t *testing.T) {
+	defer func(size int) { appPageSize = size }(appPageSize)
+	appPageSize = 2
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=2": appSearchH("{}", appPage(0, 2), 0),
+		"POST/catalogitems/search?startIndex=2&pageSize=2": appSearchH("{}",
+			`{"items": [{"name": "app2"}, {"name": "olaf", "uuid": "7"}]}`, 0),
+		"POST/catalogitems/search?startIndex=4&pageSize=2": appSearchH("{}", `{"items": []}`, 0)})
+	defer srv.Close()
+	id, _, err := checkAppExists(ctx, "Olaf", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "7", id)
 }
 
 func TestPublishAppBadManifest(t *testing.T) {
@@ -382,7 +688,7 @@ func TestPublishAppBadManifest(t *testing.T) {
 	require.True(t, os.IsNotExist(err), "manifest file must not exist")
 	srv, ctx := NewTestContext(t, appSearchGetHandlers)
 	defer srv.Close()
-	PublishApps(ctx, "")
+	PublishApps(ctx, "", false, false)
 	AssertErrorContains(t, ctx, `Error getting manifest: open manifest.yaml: no such file or directory`)
 }
 
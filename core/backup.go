@@ -0,0 +1,295 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file names of a tenant backup
+const (
+	backupManifestFile     = "manifest.yaml"
+	backupUsersFile        = "users.yaml"
+	backupGroupsFile       = "groups.yaml"
+	backupEntitlementsFile = "entitlements.yaml"
+)
+
+// number of SCIM resources requested per page unless set with SetPageSize
+var scimPageSize = 500
+
+// backupManifest describes a tenant backup, it is written once all exports
+// of the backup are complete.
+type backupManifest struct {
+	Tenant  string   `yaml:"tenant"`
+	Created string   `yaml:"created"`
+	Files   []string `yaml:"files"`
+}
+
+// group with the user names of its members, as saved in a backup
+type backupGroup struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members,omitempty,flow"`
+}
+
+// entitlement of a user or group to an app, as saved in a backup
+type backupEntitlement struct {
+	App         string `json:"app" yaml:"app"`
+	SubjectType string `json:"subjectType" yaml:"subjectType"`
+	Subject     string `json:"subject" yaml:"subject"`
+	Policy      string `json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// backupState is the content of the files of a backup
+type backupState struct {
+	Users        []BasicUser
+	Groups       []backupGroup
+	Entitlements []backupEntitlement
+	partial      []string // files of which only the rows before an error were read
+}
+
+// backupExport is a file of a backup and the function that returns its
+// content, which is only saved if the export is complete, without error.
+type backupExport struct {
+	fileName string
+	export   func(ctx *HttpContext) (interface{}, error)
+}
+
+var backupExports = []backupExport{
+	{backupUsersFile, backupUsers},
+	{backupGroupsFile, backupGroups},
+	{backupEntitlementsFile, backupEntitlements},
+}
+
+// Backup saves the users, groups and entitlements of the tenant in files of
+// the given directory, in the formats read by Restore and, for the users,
+// by the user load command. At most parallel exports run at the same time,
+// each with its own copy of the context. The manifest is only written if all
+// exports are complete, otherwise the backup fails.
+func Backup(ctx *HttpContext, dir string, parallel int) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		ctx.Log.Err("Could not create backup directory: %v\n", err)
+		return
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	errs := make([]error, len(backupExports))
+	counts := make([]int, len(backupExports))
+	slots, wg := make(chan struct{}, parallel), sync.WaitGroup{}
+	for i := range backupExports {
+		wg.Add(1)
+		go func(i int, exportCtx *HttpContext) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			export := backupExports[i]
+			content, err := export.export(exportCtx)
+			if err == nil {
+				err = PutYamlFile(filepath.Join(dir, export.fileName), content)
+			}
+			errs[i], counts[i] = err, backupLen(content)
+		}(i, ctx.Clone())
+	}
+	wg.Wait()
+	files := []string{}
+	for i, export := range backupExports {
+		if errs[i] != nil {
+			ctx.Log.Err("Could not export %s: %v\n", export.fileName, errs[i])
+		} else {
+			ctx.Log.Info("Exported %d entries to %s\n", counts[i], filepath.Join(dir, export.fileName))
+			files = append(files, export.fileName)
+		}
+	}
+	if len(files) < len(backupExports) {
+		ctx.Log.Err("Backup of %s in %s is incomplete\n", ctx.HostURL, dir)
+		return
+	}
+	manifest := backupManifest{Tenant: ctx.HostURL, Created: time.Now().UTC().Format(time.RFC3339), Files: files}
+	if err := PutYamlFile(filepath.Join(dir, backupManifestFile), &manifest); err != nil {
+		ctx.Log.Err("Could not save backup manifest: %v\n", err)
+	} else {
+		ctx.Log.Info("Backup of %s saved in %s\n", ctx.HostURL, dir)
+	}
+}
+
+// readBackup reads the files of a backup directory, files that are not in
+// the directory are skipped. A file that does not decode fails unless the
+// row check of the context allows partial files.
+func readBackup(ctx *HttpContext, dir string) (*backupState, error) {
+	state := &backupState{}
+	contents := []interface{}{&state.Users, &state.Groups, &state.Entitlements}
+	for i, fileName := range []string{backupUsersFile, backupGroupsFile, backupEntitlementsFile} {
+		_, partial, err := readPartialRows(ctx, filepath.Join(dir, fileName), func(content []byte) (int, error) {
+			list := reflect.ValueOf(contents[i]).Elem()
+			list.Set(reflect.Zero(list.Type()))
+			err := yaml.Unmarshal(content, contents[i])
+			return backupLen(list.Interface()), err
+		})
+		if os.IsNotExist(err) {
+			ctx.Log.Debug("No %s in %s\n", fileName, dir)
+		} else if err != nil {
+			return nil, fmt.Errorf("%s of backup: %v", fileName, err)
+		} else if partial {
+			state.partial = append(state.partial, filepath.Join(dir, fileName))
+		}
+	}
+	return state, nil
+}
+
+func backupLen(content interface{}) int {
+	switch list := content.(type) {
+	case []BasicUser:
+		return len(list)
+	case []backupGroup:
+		return len(list)
+	case []backupEntitlement:
+		return len(list)
+	}
+	return 0
+}
+
+// scimForEach calls fn for each resource of a type that matches the filter,
+// if it is not empty, requested page by page with only the given attributes
+// so that only one page is held in memory. It stops at the first error
+// returned by fn, and returns it.
+func scimForEach(ctx *HttpContext, resType, filter string, attrs []string,
+	fn func(resource scimResource) error) error {
+	vals := url.Values{"count": {strconv.Itoa(pageSize(ctx))}, "startIndex": {"1"}}
+	if len(attrs) > 0 {
+		vals.Set("attributes", strings.Join(attrs, ","))
+	}
+	if filter != "" {
+		vals.Set("filter", filter)
+	}
+	return scimPages(ctx, resType, vals, 0, func(resources []scimResource) error {
+		for _, resource := range resources {
+			if err := fn(resource); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scimNames returns the names of all resources of a type by their ids
+func scimNames(ctx *HttpContext, resType, nameAttr string) (map[string]string, error) {
+	names := make(map[string]string)
+	err := scimForEach(ctx, resType, "", []string{"id", nameAttr}, func(resource scimResource) error {
+		names[resource.id()] = resource.name(nameAttr)
+		return nil
+	})
+	return names, err
+}
+
+func backupUsers(ctx *HttpContext) (interface{}, error) {
+	users := []BasicUser{}
+	attrs := []string{"userName", "name", "emails"}
+	err := scimForEach(ctx, "Users", "", attrs, func(resource scimResource) error {
+		users = append(users, resource.(*typedUser).basicUser())
+		return nil
+	})
+	return users, err
+}
+
+// backupGroups returns the groups with the names of their members. Members
+// that are not users, such as nested groups, are named by their display name.
+func backupGroups(ctx *HttpContext) (interface{}, error) {
+	userNames, err := scimNames(ctx, "Users", "userName")
+	if err != nil {
+		return nil, err
+	}
+	groups := []backupGroup{}
+	attrs := []string{"displayName", "members"}
+	err = scimForEach(ctx, "Groups", "", attrs, func(resource scimResource) error {
+		g := resource.(*typedGroup)
+		group := backupGroup{Name: g.DisplayName}
+		for _, member := range g.Members {
+			if name, ok := userNames[member.Value]; ok {
+				group.Members = append(group.Members, name)
+			} else {
+				group.Members = append(group.Members, member.Display)
+			}
+		}
+		sort.Strings(group.Members)
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, err
+}
+
+// backupEntitlements returns the entitlements of all apps of the catalog.
+// An entitlement of a subject that is not found makes the export incomplete.
+func backupEntitlements(ctx *HttpContext) (interface{}, error) {
+	names := make(map[string]map[string]string)
+	typeNames := make(map[string]string)
+	for typeName, st := range subjectTypes {
+		ids, err := scimNames(ctx, st.ScimType, st.NameAttr)
+		if err != nil {
+			return nil, err
+		}
+		names[st.EntitlementType], typeNames[st.EntitlementType] = ids, typeName
+	}
+	apps, err := catalogItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entitlements := []backupEntitlement{}
+	for _, app := range apps {
+		appName := InterfaceToString(app["name"])
+		defs, err := getAppEntitlements(ctx, InterfaceToString(app["uuid"]))
+		if err != nil {
+			return nil, fmt.Errorf("could not get entitlements of app \"%s\": %v", appName, err)
+		}
+		for _, def := range defs {
+			subject, ok := names[def.SubjectType][def.SubjectID]
+			if !ok {
+				return nil, fmt.Errorf("no %s found with id %s entitled to app \"%s\"",
+					def.SubjectType, def.SubjectID, appName)
+			}
+			entitlements = append(entitlements, backupEntitlement{App: appName,
+				SubjectType: typeNames[def.SubjectType], Subject: subject, Policy: def.ActivationPolicy})
+		}
+	}
+	return entitlements, nil
+}
+
+// catalogItems returns all items of the catalog, requested page by page
+func catalogItems(ctx *HttpContext) ([]map[string]interface{}, error) {
+	items := []map[string]interface{}{}
+	for {
+		body := new(itemResponse)
+		path := fmt.Sprintf("catalogitems/search?startIndex=%d&pageSize=%d", len(items), appPageSize)
+		ctx.Accept("catalog.summary.list").ContentType("catalog.search")
+		if err := ctx.Request("POST", path, "{}", body); err != nil {
+			return nil, err
+		}
+		items = append(items, body.Items...)
+		if len(body.Items) < appPageSize {
+			return items, nil
+		}
+	}
+}
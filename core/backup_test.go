@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const backupAppID = "6c48beb6-afb1-44bc-ad7f-980214ee346c"
+
+// backupPaths are the paths of a tenant with users anna, olaf and sven,
+// requested two by two, group friends, role trolls and an app entitled to
+// the group and the role.
+func backupPaths() map[string]TstHandler {
+	return map[string]TstHandler{
+		"GET/scim/Users?attributes=userName%2Cname%2Cemails&count=2&startIndex=1": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"userName": "anna", "name": {"givenName": "Anna", "familyName": "Arendelle"},
+			"emails": [{"value": "anna@example.com"}]}, {"userName": "olaf"}]}`),
+		"GET/scim/Users?attributes=userName%2Cname%2Cemails&count=2&startIndex=3": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"userName": "sven"}]}`),
+		"GET/scim/Users?attributes=id%2CuserName&count=2&startIndex=1": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"id": "1", "userName": "anna"}, {"id": "2", "userName": "olaf"}]}`),
+		"GET/scim/Users?attributes=id%2CuserName&count=2&startIndex=3": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"id": "3", "userName": "sven"}]}`),
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=2&startIndex=1": GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"id": "10", "displayName": "friends"}]}`),
+		"GET/scim/Roles?attributes=id%2CdisplayName&count=2&startIndex=1": GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"id": "20", "displayName": "trolls"}]}`),
+		"GET/scim/Groups?attributes=displayName%2Cmembers&count=2&startIndex=1": GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"displayName": "friends", "members": [{"value": "3"}, {"value": "1"}, {"value": "99", "display": "trolls"}]}]}`),
+		"POST/catalogitems/search?startIndex=0&pageSize=100": GoodPathHandler(`{"items": [{"name": "sledge", "uuid": "` + backupAppID + `"}]}`),
+		"GET/entitlements/definitions/catalogitems/" + backupAppID: GoodPathHandler(`{"items": [{"subjectType": "GROUPS",
+			"subjectId": "10", "activationPolicy": "AUTOMATIC"}, {"subjectType": "ROLES", "subjectId": "20",
+			"activationPolicy": "USER_ACTIVATED"}]}`),
+	}
+}
+
+func backupTo(t *testing.T, paths map[string]TstHandler) (*HttpContext, string) {
+	defer func(pageSize int) { scimPageSize = pageSize }(scimPageSize)
+	scimPageSize = 2
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "priam-backup")
+	require.Nil(t, err)
+	Backup(ctx, dir, 2)
+	return ctx, dir
+}
+
+func assertBackupFile(t *testing.T, dir, fileName, expected string) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, fileName))
+	require.Nil(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestBackup(t *testing.T) {
+	ctx, dir := backupTo(t, backupPaths())
+	defer os.RemoveAll(dir)
+	AssertOnlyInfoContains(t, ctx, "Exported 3 entries to "+filepath.Join(dir, "users.yaml"))
+	assert.Contains(t, ctx.Log.InfoString(), "Backup of "+ctx.HostURL+" saved in "+dir)
+	assertBackupFile(t, dir, "users.yaml", "- name: anna\n  given: Anna\n  family: Arendelle\n"+
+		"  email: anna@example.com\n- {name: olaf}\n- {name: sven}\n")
+	assertBackupFile(t, dir, "groups.yaml", "- name: friends\n  members: [anna, sven, trolls]\n")
+	assertBackupFile(t, dir, "entitlements.yaml",
+		"- app: sledge\n  subjectType: group\n  subject: friends\n  policy: AUTOMATIC\n"+
+			"- app: sledge\n  subjectType: role\n  subject: trolls\n  policy: USER_ACTIVATED\n")
+	var manifest backupManifest
+	require.Nil(t, GetYamlFile(filepath.Join(dir, "manifest.yaml"), &manifest))
+	assert.Equal(t, ctx.HostURL, manifest.Tenant)
+	assert.NotEmpty(t, manifest.Created)
+	assert.Equal(t, []string{"users.yaml", "groups.yaml", "entitlements.yaml"}, manifest.Files)
+}
+
+func TestBackupIsIncompleteIfAnExportFails(t *testing.T) {
+	paths := backupPaths()
+	paths["GET/entitlements/definitions/catalogitems/"+backupAppID] = ErrorHandler(500, "broken")
+	ctx, dir := backupTo(t, paths)
+	defer os.RemoveAll(dir)
+	assert.Contains(t, ctx.Log.ErrString(), `Could not export entitlements.yaml: could not get entitlements of app "sledge"`)
+	assert.Contains(t, ctx.Log.ErrString(), "Backup of "+ctx.HostURL+" in "+dir+" is incomplete")
+	assert.Contains(t, ctx.Log.InfoString(), "Exported 3 entries to "+filepath.Join(dir, "users.yaml"))
+	assert.Equal(t, ExitError, ctx.Log.ExitCode())
+	_, err := os.Stat(filepath.Join(dir, "manifest.yaml"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "entitlements.yaml"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBackupIsIncompleteIfEntitledSubjectIsNotFound(t *testing.T) {
+	paths := backupPaths()
+	paths["GET/entitlements/definitions/catalogitems/"+backupAppID] = GoodPathHandler(`{"items": [{"subjectType": "USERS",
+		"subjectId": "42"}]}`)
+	ctx, dir := backupTo(t, paths)
+	defer os.RemoveAll(dir)
+	assert.Contains(t, ctx.Log.ErrString(), `no USERS found with id 42 entitled to app "sledge"`)
+	assert.Equal(t, ExitError, ctx.Log.ExitCode())
+}
+
+// forEachNames returns the userNames of the users walked by scimForEach with
+// pages of two users, requested from the given paths.
+func forEachNames(t *testing.T, paths map[string]TstHandler) ([]string, error) {
+	defer func(pageSize int) { scimPageSize = pageSize }(scimPageSize)
+	scimPageSize = 2
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	names := []string{}
+	err := scimForEach(ctx, "Users", "", []string{"userName"}, func(resource scimResource) error {
+		names = append(names, resource.name("userName"))
+		return nil
+	})
+	return names, err
+}
+
+func usersPageURL(startIndex string) string {
+	return "GET/scim/Users?attributes=userName&count=2&startIndex=" + startIndex
+}
+
+func TestForEachStopsAfterShortLastPage(t *testing.T) {
+	names, err := forEachNames(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 3, "anna", "olaf")),
+		usersPageURL("3"): GoodPathHandler(ScimUsersPage(3, 3, "sven"))})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"anna", "olaf", "sven"}, names)
+}
+
+func TestForEachStopsAtEmptyPageIfTotalIsAMultipleOfPageSize(t *testing.T) {
+	names, err := forEachNames(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 4, "anna", "olaf")),
+		usersPageURL("3"): GoodPathHandler(ScimUsersPage(3, 4, "sven", "kristoff")),
+		usersPageURL("5"): GoodPathHandler(ScimUsersPage(5, 4))})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"anna", "olaf", "sven", "kristoff"}, names)
+}
+
+func TestForEachGetsAllPagesIfTotalIsTooLow(t *testing.T) {
+	names, err := forEachNames(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 1, "anna", "olaf")),
+		usersPageURL("3"): GoodPathHandler(ScimUsersPage(3, 1, "sven"))})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"anna", "olaf", "sven"}, names)
+}
+
+func TestForEachStopsAtEmptyPageIfTotalIsTooHigh(t *testing.T) {
+	names, err := forEachNames(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 100, "anna")),
+		usersPageURL("2"): GoodPathHandler(ScimUsersPage(2, 100))})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"anna"}, names)
+}
+
+func TestForEachStopsAtFirstErrorOfCallback(t *testing.T) {
+	defer func(pageSize int) { scimPageSize = pageSize }(scimPageSize)
+	scimPageSize = 2
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 3, "anna", "olaf"))})
+	defer srv.Close()
+	calls := 0
+	err := scimForEach(ctx, "Users", "", []string{"userName"}, func(resource scimResource) error {
+		calls++
+		return fmt.Errorf("stop at %s", resource.name("userName"))
+	})
+	assert.EqualError(t, err, "stop at anna")
+	assert.Equal(t, 1, calls)
+}
+
+func TestForEachReturnsErrorOfPage(t *testing.T) {
+	names, err := forEachNames(t, map[string]TstHandler{
+		usersPageURL("1"): GoodPathHandler(ScimUsersPage(1, 3, "anna", "olaf")),
+		usersPageURL("3"): ErrorHandler(500, "down")})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"anna", "olaf"}, names)
+}
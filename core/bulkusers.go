@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+const bulkUsersKey = "bulkUsers"
+
+// bulkOperation is an operation of a SCIM bulk request, or its outcome in
+// the response, whose status is a string, a number, or an object with a
+// code and a description depending on the version of SCIM.
+type bulkOperation struct {
+	Method   string          `json:"method"`
+	BulkID   string          `json:"bulkId,omitempty"`
+	Path     string          `json:"path,omitempty"`
+	Data     interface{}     `json:"data,omitempty"`
+	Location string          `json:"location,omitempty"`
+	Status   json.RawMessage `json:"status,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+type bulkMessage struct {
+	Schemas    []string        `json:"schemas"`
+	Operations []bulkOperation `json:"Operations"`
+}
+
+// BulkUserLoad makes loads of users add them with SCIM bulk requests of at
+// most size users each, or one request each if the tenant has no bulk
+// endpoint.
+func BulkUserLoad(ctx *HttpContext, size int) {
+	ctx.SetValue(bulkUsersKey, size)
+}
+
+// bulkUsersSize returns the number of users added with each bulk request, 0
+// if users are added one request each
+func bulkUsersSize(ctx *HttpContext) int {
+	size, _ := ctx.Value(bulkUsersKey, nil)
+	if n, ok := size.(int); ok && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// addUsers adds users, with one bulk request if the context loads users in
+// bulk, and says which were added. Users that are nil are not added.
+func addUsers(ctx *HttpContext, users []*BasicUser) []bool {
+	added := make([]bool, len(users))
+	if bulkUsersSize(ctx) > 0 {
+		bulkAddUsers(ctx, users, added)
+		return added
+	}
+	for i, u := range users {
+		added[i] = u != nil && scimAddUser(ctx, u)
+	}
+	return added
+}
+
+// bulkAddUsers adds users with a bulk request, with the index of each user
+// as bulkId so that the outcomes are mapped back to the users. If the tenant
+// has no bulk endpoint, users are added one request each from then on. If
+// the bulk request fails but was applied, at least in part, the users that
+// do not exist are added one request each.
+func bulkAddUsers(ctx *HttpContext, users []*BasicUser, added []bool) {
+	reqs, bulk := make([]*userRequest, len(users)), bulkMessage{Schemas: []string{coreSchemaURN}}
+	for i, u := range users {
+		if u == nil {
+			continue
+		}
+		req, err := newUserRequest(ctx, u)
+		if err != nil {
+			ctx.Log.Err("Error creating user '%s': %v\n", Named("Users", u.Name), err)
+			continue
+		}
+		ctx.Log.PP("add user: ", req.acct)
+		ctx.ForgetID("Users", "userName", u.Name)
+		reqs[i] = req
+		bulk.Operations = append(bulk.Operations, bulkOperation{Method: "POST", BulkID: strconv.Itoa(i),
+			Path: "/Users", Data: req.body})
+	}
+	if len(bulk.Operations) == 0 {
+		return
+	}
+	var reply bulkMessage
+	existing := make([]string, len(reqs))
+	err := ctx.Accept("json").RetryChecked(func() (applied bool, err error) {
+		for i, req := range reqs {
+			if req == nil {
+				continue
+			} else if existing[i], err = req.existingID(ctx); err != nil {
+				return false, err
+			}
+			applied = applied || existing[i] != ""
+		}
+		return applied, nil
+	}).Request("POST", "scim/Bulk", &bulk, &reply)
+	if err == ErrApplied {
+		// the bulk request may have been applied in part, add the users not found
+		for i, req := range reqs {
+			if req != nil && existing[i] != "" {
+				req.added(ctx, existing[i])
+				added[i] = true
+			} else if req != nil {
+				added[i] = req.post(ctx)
+			}
+		}
+		return
+	}
+	var status *StatusError
+	if errors.As(err, &status) && (status.Code == http.StatusNotFound || status.Code == http.StatusNotImplemented) {
+		ctx.Log.Warn("the tenant has no SCIM bulk endpoint, users are added one request each\n")
+		BulkUserLoad(ctx, 0)
+		for i, req := range reqs {
+			added[i] = req != nil && req.post(ctx)
+		}
+		return
+	}
+	outcomes := make(map[string]bulkOperation, len(reply.Operations))
+	for _, op := range reply.Operations {
+		outcomes[op.BulkID] = op
+	}
+	for i, req := range reqs {
+		if req == nil {
+			continue
+		}
+		op, ok := outcomes[strconv.Itoa(i)]
+		opErr := err
+		if opErr == nil && !ok {
+			opErr = errors.New("no outcome in the bulk response")
+		} else if opErr == nil {
+			opErr = op.err()
+		}
+		if opErr != nil {
+			ctx.Log.Err("Error creating user '%s': %v\n", Named("Users", req.name), opErr)
+		} else {
+			req.added(ctx, op.id())
+			added[i] = true
+		}
+	}
+}
+
+// err returns the error of an operation whose status is not a success
+func (op *bulkOperation) err() error {
+	var code json.Number
+	var status struct {
+		Code        json.Number
+		Description string
+	}
+	var reply struct{ Detail string }
+	if json.Unmarshal(op.Status, &code) != nil && json.Unmarshal(op.Status, &status) == nil {
+		code = status.Code
+	}
+	json.Unmarshal(op.Response, &reply)
+	n, err := strconv.Atoi(string(code))
+	if err != nil {
+		return fmt.Errorf("invalid status %s in the bulk response", op.Status)
+	} else if n >= 200 && n < 300 {
+		return nil
+	} else if detail := StringOrDefault(status.Description, reply.Detail); detail != "" {
+		return fmt.Errorf("%d %s: %s", n, http.StatusText(n), detail)
+	}
+	return fmt.Errorf("%d %s", n, http.StatusText(n))
+}
+
+// id returns the id of the resource created by an operation, from the
+// resource in the response or else from its location
+func (op *bulkOperation) id() string {
+	var resource struct{ ID string }
+	if json.Unmarshal(op.Response, &resource) == nil && resource.ID != "" {
+		return resource.ID
+	}
+	return path.Base(op.Location)
+}
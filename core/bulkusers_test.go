@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"os"
+	"strings"
+	"testing"
+)
+
+const bulkUsersFile = "---\n- {name: anna, email: anna@example.com}\n- {name: olaf, email: olaf@example.com}\n" +
+	"- {name: sven, email: sven@example.com}\n"
+
+// loadUsersInBulk loads the users of bulkUsersFile in bulk requests of two
+// users and returns the context and the name of the file of failed users
+func loadUsersInBulk(t *testing.T, paths map[string]TstHandler) (*HttpContext, string) {
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	BulkUserLoad(ctx, 2)
+	usersFile := WriteTempFile(t, bulkUsersFile)
+	defer CleanupTempFile(usersFile)
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	return ctx, usersFile.Name() + ".failed"
+}
+
+func TestLoadUsersInBulkMapsOutcomesToUsers(t *testing.T) {
+	requests := []bulkMessage{}
+	ctx, failFile := loadUsersInBulk(t, map[string]TstHandler{"POST/scim/Bulk": func(t *testing.T, req *TstReq) *TstReply {
+		bulk := bulkMessage{}
+		require.Nil(t, json.Unmarshal([]byte(req.Input), &bulk))
+		requests = append(requests, bulk)
+		if len(requests) == 1 {
+			return &TstReply{Output: `{"Operations": [
+				{"method": "POST", "bulkId": "1", "status": {"code": "409", "description": "user exists"}},
+				{"method": "POST", "bulkId": "0", "status": {"code": "201"}, "location": "https://t/scim/Users/a1"}]}`}
+		}
+		return &TstReply{Output: `{"Operations": [{"method": "POST", "bulkId": "0", "status": "201",
+			"response": {"id": "s1", "userName": "sven"}}]}`}
+	}})
+	defer os.Remove(failFile)
+	require.Len(t, requests, 2)
+	assert.Equal(t, []string{coreSchemaURN}, requests[0].Schemas)
+	require.Len(t, requests[0].Operations, 2)
+	assert.Equal(t, "POST", requests[0].Operations[1].Method)
+	assert.Equal(t, "1", requests[0].Operations[1].BulkID)
+	assert.Equal(t, "/Users", requests[0].Operations[1].Path)
+	assert.Equal(t, "olaf", requests[0].Operations[1].Data.(map[string]interface{})["UserName"])
+	assert.Len(t, requests[1].Operations, 1)
+	assert.Equal(t, "Error creating user 'olaf': 409 Conflict: user exists\n", ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "User 'anna' successfully added\n")
+	assert.Contains(t, ctx.Log.InfoString(), "User 'sven' successfully added\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 2, failed: 1, not attempted: 0\n")
+	assertFailedUsers(t, failFile, "olaf")
+}
+
+func TestLoadUsersInBulkFallsBackWithoutBulkEndpoint(t *testing.T) {
+	bulkCalls, added := 0, []string{}
+	ctx, failFile := loadUsersInBulk(t, map[string]TstHandler{
+		"POST/scim/Bulk": func(t *testing.T, req *TstReq) *TstReply {
+			bulkCalls++
+			return &TstReply{Status: 501, Output: "not implemented"}
+		},
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			acct := userAccount{}
+			require.Nil(t, json.Unmarshal([]byte(req.Input), &acct))
+			added = append(added, acct.UserName)
+			return &TstReply{Output: `{"id": "1"}`}
+		}})
+	defer os.Remove(failFile)
+	assert.Equal(t, 1, bulkCalls)
+	assert.Equal(t, []string{"anna", "olaf", "sven"}, added)
+	assert.Equal(t, "WARNING: the tenant has no SCIM bulk endpoint, users are added one request each\n",
+		ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 3, failed: 0, not attempted: 0\n")
+}
+
+func TestLoadUsersInBulkFailsUsersOfFailedRequest(t *testing.T) {
+	ctx, failFile := loadUsersInBulk(t, map[string]TstHandler{"POST/scim/Bulk": func(t *testing.T, req *TstReq) *TstReply {
+		if strings.Contains(req.Input, "sven") {
+			return &TstReply{Output: `{"Operations": []}`}
+		}
+		return &TstReply{Status: 500, Output: "down"}
+	}})
+	defer os.Remove(failFile)
+	assert.Contains(t, ctx.Log.ErrString(), "Error creating user 'anna': 500")
+	assert.Contains(t, ctx.Log.ErrString(), "Error creating user 'olaf': 500")
+	assert.Contains(t, ctx.Log.ErrString(), "Error creating user 'sven': no outcome in the bulk response\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 0, failed: 3, not attempted: 0\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+	assertFailedUsers(t, failFile, "anna", "olaf", "sven")
+}
+
+func TestLoadUsersInBulkAddsUsersMissingAfterFailedRequest(t *testing.T) {
+	bulkCalls, added := 0, []string{}
+	lookup := func(name, output string) (string, TstHandler) {
+		return "GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22" + name + "%22",
+			GoodPathHandler(output)
+	}
+	paths := map[string]TstHandler{
+		"POST/scim/Bulk": func(t *testing.T, req *TstReq) *TstReply {
+			if bulkCalls++; bulkCalls == 1 {
+				return &TstReply{Status: 502, Output: "bad gateway"}
+			}
+			return &TstReply{Output: `{"Operations": [{"method": "POST", "bulkId": "0", "status": "201",
+				"response": {"id": "s1", "userName": "sven"}}]}`}
+		},
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			acct := userAccount{}
+			require.Nil(t, json.Unmarshal([]byte(req.Input), &acct))
+			added = append(added, acct.UserName)
+			return &TstReply{Output: `{"id": "o1"}`}
+		}}
+	path, h := lookup("anna", `{"totalResults": 1, "Resources": [{"id": "a1", "userName": "anna"}]}`)
+	paths[path] = h
+	path, h = lookup("olaf", `{"totalResults": 0, "Resources": []}`)
+	paths[path] = h
+	ctx := NewReplayContext(t, paths)
+	BulkUserLoad(ctx, 2)
+	usersFile := WriteTempFile(t, bulkUsersFile)
+	defer CleanupTempFile(usersFile)
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Equal(t, 2, bulkCalls, "the failed bulk request is not sent again")
+	assert.Equal(t, []string{"olaf"}, added)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "User 'anna' successfully added\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 3, failed: 0, not attempted: 0\n")
+}
+
+func TestBulkOperationStatuses(t *testing.T) {
+	for status, msg := range map[string]string{
+		`"201"`:         "",
+		`200`:           "",
+		`{"code": 400}`: "400 Bad Request",
+		`{"code": "409", "description": "taken"}`: "409 Conflict: taken",
+		`"412"`: "412 Precondition Failed: stale",
+		`"ok"`:  `invalid status "ok" in the bulk response`,
+	} {
+		op := bulkOperation{Status: json.RawMessage(status), Response: json.RawMessage(`{"detail": "stale"}`)}
+		if status != `"412"` {
+			op.Response = nil
+		}
+		if msg == "" {
+			assert.Nil(t, op.err(), status)
+		} else if assert.NotNil(t, op.err(), status) {
+			assert.Equal(t, msg, op.err().Error())
+		}
+	}
+}
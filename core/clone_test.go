@@ -0,0 +1,66 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestClonesSendRequestsConcurrently checks, with go test -race, that the
+// clones of a context can look up and patch users from many goroutines
+// without data races, and that the headers of each clone are its own.
+func TestClonesSendRequestsConcurrently(t *testing.T) {
+	const workers, rounds = 16, 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		worker := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer worker")
+		override := r.Header.Get("X-HTTP-Method-Override")
+		switch {
+		case r.Method == "GET" && override == "" &&
+			r.URL.Query().Get("filter") == fmt.Sprintf(`userName eq "user%s"`, worker):
+			fmt.Fprintf(w, `{"totalResults": 1, "Resources": [{"id": "id%s", "userName": "user%s"}]}`, worker, worker)
+		case r.Method == "POST" && override == "PATCH" && r.URL.Path == "/scim/Users/id"+worker:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, fmt.Sprintf("unexpected %s %s from worker %s", r.Method, r.URL, worker), 400)
+		}
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int, ctx *HttpContext) {
+			defer wg.Done()
+			ctx.Authorization(fmt.Sprintf("Bearer worker%d", i))
+			for round := 0; round < rounds; round++ {
+				item, err := scimGetByName(ctx, "Users", "userName", fmt.Sprintf("user%d", i), "id", "userName")
+				if assert.Nil(t, err) {
+					assert.Equal(t, fmt.Sprintf("id%d", i), item.id())
+					assert.Nil(t, scimPatch(ctx, "Users", item.id(), map[string]string{"title": "engineer"}))
+				}
+			}
+		}(i, ctx.Clone())
+	}
+	wg.Wait()
+	assert.Empty(t, ctx.Log.ErrString())
+}
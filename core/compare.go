@@ -0,0 +1,253 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompareOptions are the options of CompareTargets
+type CompareOptions struct {
+	UsersOnly  bool // only compare the users
+	GroupsOnly bool // only compare the groups
+}
+
+// fieldDiff is a field of a user or group that differs between two targets
+type fieldDiff struct {
+	Field string `json:"field" yaml:"field"`
+	A     string `json:"a" yaml:"a"`
+	B     string `json:"b" yaml:"b"`
+}
+
+// resourceDiff is a user or group of both targets whose fields or members
+// differ
+type resourceDiff struct {
+	Name           string      `json:"name" yaml:"name"`
+	Fields         []fieldDiff `json:"fields,omitempty" yaml:"fields,omitempty"`
+	MembersOnlyInA []string    `json:"membersOnlyInA,omitempty" yaml:"membersOnlyInA,omitempty"`
+	MembersOnlyInB []string    `json:"membersOnlyInB,omitempty" yaml:"membersOnlyInB,omitempty"`
+}
+
+// resourcesDiff is how the users or groups of two targets differ
+type resourcesDiff struct {
+	OnlyInA []string       `json:"onlyInA" yaml:"onlyInA"`
+	OnlyInB []string       `json:"onlyInB" yaml:"onlyInB"`
+	Differ  []resourceDiff `json:"differ" yaml:"differ"`
+}
+
+// targetsDiff is how the users and groups of target A differ from those of B
+type targetsDiff struct {
+	A      string         `json:"a" yaml:"a"`
+	B      string         `json:"b" yaml:"b"`
+	Users  *resourcesDiff `json:"users,omitempty" yaml:"users,omitempty"`
+	Groups *resourcesDiff `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// compareState is the users and groups of a target by the key of their names
+type compareState struct {
+	users, groups map[string]compareEntry
+}
+
+// compareEntry is a user with its fields in the order they are compared, or
+// a group with the names of its members by their keys.
+type compareEntry struct {
+	name    string
+	fields  []fieldDiff // only Field and A are set
+	members map[string]string
+}
+
+// fields whose values that only differ in case are the same
+var caselessFields = []string{"userName", "email"}
+
+var compareUserAttrs = []string{"id", "userName", "name", "emails", "active"}
+
+// CompareTargets prints the users and groups that are only in target a,
+// only in target b, and those whose fields differ, as read by two contexts.
+// Names are matched without case unless the context of target a compares
+// them with case. Both targets are read at the same time, page by page.
+func CompareTargets(a, b *HttpContext, opts CompareOptions) {
+	exact := a.CaseSensitiveNames()
+	states, errs := make([]*compareState, 2), make([]error, 2)
+	wg := sync.WaitGroup{}
+	for i, ctx := range []*HttpContext{a, b} {
+		wg.Add(1)
+		go func(i int, ctx *HttpContext) {
+			defer wg.Done()
+			states[i], errs[i] = compareStateOf(ctx, opts, exact)
+		}(i, ctx)
+	}
+	wg.Wait()
+	for i, ctx := range []*HttpContext{a, b} {
+		if errs[i] != nil {
+			a.Log.Err("Could not get the users and groups of %s: %v\n", targetLabel(ctx), errs[i])
+		}
+	}
+	if errs[0] != nil || errs[1] != nil {
+		return
+	}
+	diff := &targetsDiff{A: targetLabel(a), B: targetLabel(b)}
+	if !opts.GroupsOnly {
+		diff.Users = compareEntries(states[0].users, states[1].users)
+	}
+	if !opts.UsersOnly {
+		diff.Groups = compareEntries(states[0].groups, states[1].groups)
+	}
+	if a.Log.MachineFormat() {
+		a.Log.PP("Comparison", diff)
+	} else {
+		printTargetsDiff(a.Log, diff)
+	}
+}
+
+// targetLabel returns the name of the target of a context, or its URL
+func targetLabel(ctx *HttpContext) string {
+	return StringOrDefault(ctx.TargetName, ctx.HostURL)
+}
+
+// nameKey returns how a name is matched between targets
+func nameKey(name string, exact bool) string {
+	if exact {
+		return name
+	}
+	return strings.ToLower(name)
+}
+
+// compareStateOf gets the users and groups of a target to compare. The
+// names of the users are also got for the groups-only comparison, so that
+// members are compared by user name.
+func compareStateOf(ctx *HttpContext, opts CompareOptions, exact bool) (*compareState, error) {
+	state := &compareState{users: make(map[string]compareEntry), groups: make(map[string]compareEntry)}
+	userNames := make(map[string]string)
+	attrs := compareUserAttrs
+	if opts.GroupsOnly {
+		attrs = []string{"id", "userName"}
+	}
+	err := scimForEach(ctx, "Users", "", attrs, func(resource scimResource) error {
+		u := resource.(*typedUser)
+		user, active := u.basicUser(), ""
+		if u.Active != nil {
+			active = strconv.FormatBool(*u.Active)
+		}
+		userNames[u.Id] = user.Name
+		if !opts.GroupsOnly {
+			state.users[nameKey(user.Name, exact)] = compareEntry{name: user.Name, fields: []fieldDiff{
+				{Field: "userName", A: user.Name}, {Field: "givenName", A: user.Given},
+				{Field: "familyName", A: user.Family}, {Field: "email", A: user.Email}, {Field: "active", A: active}}}
+		}
+		return nil
+	})
+	if err != nil || opts.UsersOnly {
+		return state, err
+	}
+	err = scimForEach(ctx, "Groups", "", []string{"displayName", "members"}, func(resource scimResource) error {
+		g := resource.(*typedGroup)
+		members := make(map[string]string)
+		for _, m := range g.Members {
+			name := StringOrDefault(userNames[m.Value], m.Display)
+			members[nameKey(name, exact)] = name
+		}
+		state.groups[nameKey(g.DisplayName, exact)] = compareEntry{name: g.DisplayName, members: members}
+		return nil
+	})
+	return state, err
+}
+
+// compareEntries returns the names of the entries only in a or only in b, and
+// the fields and members that differ for the entries of both.
+func compareEntries(a, b map[string]compareEntry) *resourcesDiff {
+	diff := &resourcesDiff{OnlyInA: []string{}, OnlyInB: []string{}, Differ: []resourceDiff{}}
+	for key, ea := range a {
+		eb, ok := b[key]
+		if !ok {
+			diff.OnlyInA = append(diff.OnlyInA, ea.name)
+			continue
+		}
+		rd := resourceDiff{Name: ea.name}
+		for i, f := range ea.fields {
+			if vb := eb.fields[i].A; f.A != vb && !(HasString(f.Field, caselessFields) && strings.EqualFold(f.A, vb)) {
+				rd.Fields = append(rd.Fields, fieldDiff{Field: f.Field, A: f.A, B: vb})
+			}
+		}
+		rd.MembersOnlyInA, rd.MembersOnlyInB = onlyIn(ea.members, eb.members), onlyIn(eb.members, ea.members)
+		if len(rd.Fields) > 0 || len(rd.MembersOnlyInA) > 0 || len(rd.MembersOnlyInB) > 0 {
+			diff.Differ = append(diff.Differ, rd)
+		}
+	}
+	for key, eb := range b {
+		if _, ok := a[key]; !ok {
+			diff.OnlyInB = append(diff.OnlyInB, eb.name)
+		}
+	}
+	sort.Strings(diff.OnlyInA)
+	sort.Strings(diff.OnlyInB)
+	sort.Slice(diff.Differ, func(i, j int) bool { return diff.Differ[i].Name < diff.Differ[j].Name })
+	return diff
+}
+
+// onlyIn returns the sorted names of the members of a that are not in b
+func onlyIn(a, b map[string]string) []string {
+	var names []string
+	for key, name := range a {
+		if _, ok := b[key]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printTargetsDiff(log *Logr, diff *targetsDiff) {
+	differences := 0
+	printf := func(format string, args ...interface{}) {
+		log.DiffLine(format, args...)
+		differences++
+	}
+	for _, r := range []struct {
+		kind string
+		diff *resourcesDiff
+	}{{"user", diff.Users}, {"group", diff.Groups}} {
+		if r.diff == nil {
+			continue
+		}
+		for _, name := range r.diff.OnlyInA {
+			printf("< %s %s only in %s\n", r.kind, name, diff.A)
+		}
+		for _, name := range r.diff.OnlyInB {
+			printf("> %s %s only in %s\n", r.kind, name, diff.B)
+		}
+		for _, rd := range r.diff.Differ {
+			var fields []string
+			for _, f := range rd.Fields {
+				fields = append(fields, fmt.Sprintf("%s: %s → %s", f.Field, f.A, f.B))
+			}
+			if len(rd.MembersOnlyInA) > 0 {
+				fields = append(fields, fmt.Sprintf("members only in %s: %s", diff.A, strings.Join(rd.MembersOnlyInA, ", ")))
+			}
+			if len(rd.MembersOnlyInB) > 0 {
+				fields = append(fields, fmt.Sprintf("members only in %s: %s", diff.B, strings.Join(rd.MembersOnlyInB, ", ")))
+			}
+			printf("~ %s %s, %s\n", r.kind, rd.Name, strings.Join(fields, ", "))
+		}
+	}
+	if differences == 0 {
+		log.Info("No differences between %s and %s\n", diff.A, diff.B)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const (
+	compareUsersPath     = "GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive&count=500&startIndex=1"
+	compareUserNamesPath = "GET/scim/Users?attributes=id%2CuserName&count=500&startIndex=1"
+	compareGroupsPath    = "GET/scim/Groups?attributes=displayName%2Cmembers&count=500&startIndex=1"
+)
+
+// compareContexts returns the contexts of targets staging and prod. Users
+// anna and Olaf are in both, anna with another email and inactive in prod,
+// kristoff only in staging and sven only in prod. Group friends is in both
+// with other members, trolls only in staging and Reindeer, REINDEER in prod,
+// the same in both.
+func compareContexts(t *testing.T) (staging, prod *HttpContext) {
+	stagingUsers := GoodPathHandler(`{"totalResults": 3, "Resources": [
+		{"id": "1", "userName": "anna", "name": {"givenName": "Anna"}, "emails": [{"value": "anna@example.com"}],
+		"active": true},
+		{"id": "2", "userName": "olaf", "active": true}, {"id": "3", "userName": "kristoff", "active": true}]}`)
+	prodUsers := GoodPathHandler(`{"totalResults": 3, "Resources": [
+		{"id": "11", "userName": "anna", "name": {"givenName": "Anna"}, "emails": [{"value": "anna@example.org"}],
+		"active": false},
+		{"id": "12", "userName": "Olaf", "active": true}, {"id": "14", "userName": "sven", "active": true}]}`)
+	staging = NewReplayContext(t, map[string]TstHandler{
+		compareUsersPath: stagingUsers, compareUserNamesPath: stagingUsers,
+		compareGroupsPath: GoodPathHandler(`{"totalResults": 3, "Resources": [
+			{"displayName": "friends", "members": [{"value": "1"}, {"value": "2"}, {"value": "3"}]},
+			{"displayName": "trolls"}, {"displayName": "reindeer", "members": [{"value": "3"}]}]}`),
+	})
+	prod = NewReplayContext(t, map[string]TstHandler{
+		compareUsersPath: prodUsers, compareUserNamesPath: prodUsers,
+		compareGroupsPath: GoodPathHandler(`{"totalResults": 2, "Resources": [
+			{"displayName": "friends", "members": [{"value": "11"}, {"value": "12"}, {"value": "14"}]},
+			{"displayName": "REINDEER", "members": [{"value": "99", "display": "kristoff"}]}]}`),
+	})
+	staging.TargetName, prod.TargetName = "staging", "prod"
+	return staging, prod
+}
+
+func TestCompareTargets(t *testing.T) {
+	staging, prod := compareContexts(t)
+	CompareTargets(staging, prod, CompareOptions{})
+	AssertOnlyInfoContains(t, staging, "< user kristoff only in staging\n> user sven only in prod\n"+
+		"~ user anna, email: anna@example.com → anna@example.org, active: true → false\n"+
+		"< group trolls only in staging\n"+
+		"~ group friends, members only in staging: kristoff, members only in prod: sven\n")
+}
+
+func TestCompareTargetsWithCase(t *testing.T) {
+	staging, prod := compareContexts(t)
+	staging.SetCaseSensitiveNames(true)
+	CompareTargets(staging, prod, CompareOptions{GroupsOnly: true})
+	AssertOnlyInfoContains(t, staging, "< group reindeer only in staging\n< group trolls only in staging\n"+
+		"> group REINDEER only in prod\n"+
+		"~ group friends, members only in staging: kristoff, olaf, members only in prod: Olaf, sven\n")
+	assert.NotContains(t, staging.Log.InfoString(), "user")
+}
+
+func TestCompareTargetsUsersOnlyAsJSON(t *testing.T) {
+	staging, prod := compareContexts(t)
+	staging.Log.Format = FJson
+	CompareTargets(staging, prod, CompareOptions{UsersOnly: true})
+	assert.JSONEq(t, `{"a": "staging", "b": "prod", "users": {"onlyInA": ["kristoff"], "onlyInB": ["sven"],
+		"differ": [{"name": "anna", "fields": [{"field": "email", "a": "anna@example.com", "b": "anna@example.org"},
+		{"field": "active", "a": "true", "b": "false"}]}]}}`, staging.Log.InfoString())
+}
+
+func TestCompareIdenticalTargets(t *testing.T) {
+	staging, _ := compareContexts(t)
+	other, _ := compareContexts(t)
+	CompareTargets(staging, other, CompareOptions{})
+	AssertOnlyInfoContains(t, staging, "No differences between staging and staging\n")
+}
+
+func TestCompareTargetsFailsIfATargetCannotBeRead(t *testing.T) {
+	staging, _ := compareContexts(t)
+	prod := NewReplayContext(t, map[string]TstHandler{compareUsersPath: ErrorHandler(500, "down")})
+	prod.MaxAttempts, prod.TargetName = 1, "prod"
+	CompareTargets(staging, prod, CompareOptions{})
+	assert.Contains(t, staging.Log.ErrString(), "Could not get the users and groups of prod: 500")
+	assert.Empty(t, staging.Log.InfoString())
+}
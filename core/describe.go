@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"sort"
+)
+
+// describedEntitlement is an entitlement of a user to an app, directly or
+// through one of the groups of the user
+type describedEntitlement struct {
+	App    string `json:"app" yaml:"app"`
+	Via    string `json:"via,omitempty" yaml:"via,omitempty"` // name of the group, empty if direct
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+}
+
+// userDescription is everything about a user, see DescribeUser. Errors are
+// the sections that could not be described entirely, with why.
+type userDescription struct {
+	User         map[string]interface{} `json:"user" yaml:"user"`
+	Groups       []string               `json:"groups" yaml:"groups"`
+	Roles        []string               `json:"roles" yaml:"roles"`
+	Entitlements []describedEntitlement `json:"entitlements" yaml:"entitlements"`
+	Errors       map[string]string      `json:"errors,omitempty" yaml:"errors,omitempty"`
+}
+
+func (d *userDescription) failed(section string, err error) {
+	if d.Errors == nil {
+		d.Errors = make(map[string]string)
+	}
+	if d.Errors[section] == "" {
+		d.Errors[section] = err.Error()
+	}
+}
+
+// DescribeUser prints the SCIM record of a user, the names of their groups
+// and roles, and their entitlements to apps, directly or through their
+// groups. Sections that could not be described are still printed with what
+// was found, flagged as incomplete, and the command then fails with
+// ExitPartial.
+func DescribeUser(ctx *HttpContext, name string) {
+	item, err := scimGetByName(ctx, "Users", "userName", name)
+	if err != nil {
+		ctx.Log.Err("Error getting user %s: %v\n", Named("Users", name), err)
+		reportAmbiguous(ctx, err)
+		return
+	}
+	user := item.(*typedUser)
+	desc := &userDescription{User: user.attributes(), Groups: []string{}, Roles: []string{},
+		Entitlements: []describedEntitlement{}}
+	groupIDs := make(map[string]string)
+	for _, g := range user.Groups {
+		groupName, err := displayName(ctx, "Groups", g)
+		if err != nil {
+			desc.failed("groups", err)
+			groupName = g.Value
+		}
+		desc.Groups, groupIDs[g.Value] = append(desc.Groups, groupName), groupName
+	}
+	for _, r := range user.Roles {
+		roleName, err := displayName(ctx, "Roles", r)
+		if err != nil {
+			desc.failed("roles", err)
+			roleName = r.Value
+		}
+		desc.Roles = append(desc.Roles, roleName)
+	}
+	sort.Strings(desc.Groups)
+	sort.Strings(desc.Roles)
+	desc.Entitlements = describeEntitlements(ctx, desc, user.Id, groupIDs)
+	printDescription(ctx.Log, desc)
+	if len(desc.Errors) > 0 {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
+
+// displayName returns the name of a group or role of a user, as given with
+// the user or else by getting the resource.
+func displayName(ctx *HttpContext, resType string, member dispValue) (string, error) {
+	if member.Display != "" {
+		return member.Display, nil
+	}
+	item := newScimResource(resType)
+	path := fmt.Sprintf("scim/%s/%s?%s", resType, member.Value, url.Values{"attributes": {"displayName"}}.Encode())
+	if err := ctx.Accept("json").Request("GET", path, nil, item); err != nil {
+		return "", fmt.Errorf("could not get name of %s %s: %v", resType, member.Value, err)
+	}
+	return item.name("displayName"), nil
+}
+
+// describeEntitlements returns the entitlements of a user and of its groups,
+// by the names of the apps.
+func describeEntitlements(ctx *HttpContext, desc *userDescription, userID string,
+	groupNames map[string]string) []describedEntitlement {
+	appNames := make(map[string]string)
+	if items, err := catalogItems(ctx); err != nil {
+		desc.failed("entitlements", fmt.Errorf("could not get names of apps: %v", err))
+	} else {
+		for _, item := range items {
+			appNames[InterfaceToString(item["uuid"])] = InterfaceToString(item["name"])
+		}
+	}
+	entitlements := []describedEntitlement{}
+	add := func(resType, id, via string) {
+		defs, err := subjectEntitlements(ctx, resType, id)
+		if err != nil && via == "" {
+			desc.failed("entitlements", fmt.Errorf("could not get entitlements of user: %v", err))
+		} else if err != nil {
+			desc.failed("entitlements", fmt.Errorf("could not get entitlements of group %s: %v", via, err))
+		}
+		for _, def := range defs {
+			entitlements = append(entitlements, describedEntitlement{App: StringOrDefault(appNames[def.CatalogItemID],
+				def.CatalogItemID), Via: via, Policy: def.ActivationPolicy})
+		}
+	}
+	add("users", userID, "")
+	for id, groupName := range groupNames {
+		add("groups", id, groupName)
+	}
+	sort.Slice(entitlements, func(i, j int) bool {
+		if entitlements[i].App != entitlements[j].App {
+			return entitlements[i].App < entitlements[j].App
+		}
+		return entitlements[i].Via < entitlements[j].Via
+	})
+	return entitlements
+}
+
+func printDescription(log *Logr, desc *userDescription) {
+	if log.MachineFormat() {
+		log.PP("User", desc)
+		return
+	}
+	title := func(section, label string) string {
+		if msg := desc.Errors[section]; msg != "" {
+			log.Warn("%s may be incomplete, %s\n", label, msg)
+			return label + " (incomplete)"
+		}
+		return label
+	}
+	log.PP("User", desc.User)
+	log.PP(title("groups", "Groups"), desc.Groups)
+	log.PP(title("roles", "Roles"), desc.Roles)
+	log.PP(title("entitlements", "Entitlements"), desc.Entitlements, "app", "via", "policy")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+// describePaths are the paths of a tenant where john is in groups friends,
+// and in a group that is only known by its id, and has a role. John is
+// entitled to app sledge, and to app castle through friends.
+func describePaths() map[string]TstHandler {
+	return map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(`{"Resources": [{"id": "1", "userName": "john",
+			"groups": [{"value": "10", "display": "friends"}, {"value": "11"}],
+			"roles": [{"value": "20", "display": "Administrator"}]}]}`),
+		"GET/scim/Groups/11?attributes=displayName": GoodPathHandler(`{"id": "11", "displayName": "trolls"}`),
+		"POST/catalogitems/search?startIndex=0&pageSize=100": GoodPathHandler(`{"items": [
+			{"name": "sledge", "uuid": "app-1"}, {"name": "castle", "uuid": "app-2"}]}`),
+		"GET/entitlements/definitions/users/1": GoodPathHandler(`{"items": [{"catalogItemId": "app-1",
+			"subjectType": "USERS", "subjectId": "1", "activationPolicy": "AUTOMATIC"}]}`),
+		"GET/entitlements/definitions/groups/10": GoodPathHandler(`{"items": [{"catalogItemId": "app-2",
+			"subjectType": "GROUPS", "subjectId": "10", "activationPolicy": "USER_ACTIVATED"}]}`),
+		"GET/entitlements/definitions/groups/11": GoodPathHandler(`{"items": []}`),
+	}
+}
+
+func describeJSON(t *testing.T, ctx *HttpContext) *userDescription {
+	ctx.Log.Format = FJson
+	DescribeUser(ctx, "john")
+	desc := &userDescription{}
+	require.Nil(t, json.Unmarshal([]byte(ctx.Log.InfoString()), desc))
+	return desc
+}
+
+func TestDescribeUser(t *testing.T) {
+	ctx := NewReplayContext(t, describePaths())
+	desc := describeJSON(t, ctx)
+	assert.Equal(t, "john", desc.User["userName"])
+	assert.Equal(t, []string{"friends", "trolls"}, desc.Groups)
+	assert.Equal(t, []string{"Administrator"}, desc.Roles)
+	assert.Equal(t, []describedEntitlement{{App: "castle", Via: "friends", Policy: "USER_ACTIVATED"},
+		{App: "sledge", Policy: "AUTOMATIC"}}, desc.Entitlements)
+	assert.Empty(t, desc.Errors)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestDescribeUserPrintsSections(t *testing.T) {
+	ctx := NewReplayContext(t, describePaths())
+	DescribeUser(ctx, "john")
+	for _, expected := range []string{"---- User ----", "---- Groups ----", "- trolls", "---- Roles ----",
+		"---- Entitlements ----", "castle", "friends"} {
+		assert.Contains(t, ctx.Log.InfoString(), expected)
+	}
+}
+
+func TestDescribeUserPrintsSectionsThatSucceeded(t *testing.T) {
+	paths := describePaths()
+	paths["GET/entitlements/definitions/groups/10"] = ErrorHandler(503, "down")
+	paths["GET/scim/Groups/11?attributes=displayName"] = ErrorHandler(404, "gone")
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	desc := describeJSON(t, ctx)
+	assert.Equal(t, []string{"11", "friends"}, desc.Groups)
+	assert.Equal(t, []describedEntitlement{{App: "sledge", Policy: "AUTOMATIC"}}, desc.Entitlements)
+	assert.Contains(t, desc.Errors["groups"], "could not get name of Groups 11")
+	assert.Contains(t, desc.Errors["entitlements"], "could not get entitlements of group friends")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestDescribeUserFlagsIncompleteSections(t *testing.T) {
+	paths := describePaths()
+	paths["POST/catalogitems/search?startIndex=0&pageSize=100"] = ErrorHandler(500, "broken")
+	ctx := NewReplayContext(t, paths)
+	DescribeUser(ctx, "john")
+	assert.Contains(t, ctx.Log.InfoString(), "---- Entitlements (incomplete) ----")
+	assert.Contains(t, ctx.Log.InfoString(), "app-1")
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: Entitlements may be incomplete, could not get names of apps")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestDescribeUserThatIsNotFound(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{DEFAULT_SHOW_USER_URL: GoodPathHandler(ScimUsersPage(1, 0))})
+	DescribeUser(ctx, "john")
+	assert.Contains(t, ctx.Log.ErrString(), `no Users found named "john"`)
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
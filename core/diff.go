@@ -0,0 +1,253 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"sort"
+	"strings"
+)
+
+// userChange is an attribute of a user that differs from the desired state
+type userChange struct {
+	Attribute string `json:"attribute" yaml:"attribute"`
+	Old       string `json:"old" yaml:"old"`
+	New       string `json:"new" yaml:"new"`
+}
+
+type userDiff struct {
+	Name    string       `json:"name" yaml:"name"`
+	Changes []userChange `json:"changes" yaml:"changes"`
+}
+
+type memberDiff struct {
+	Group  string   `json:"group" yaml:"group"`
+	Add    []string `json:"add,omitempty" yaml:"add,omitempty"`
+	Remove []string `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// tenantDiff is what would change in the tenant to reach a desired state
+type tenantDiff struct {
+	CreateUsers        []string            `json:"createUsers" yaml:"createUsers"`
+	UpdateUsers        []userDiff          `json:"updateUsers" yaml:"updateUsers"`
+	CreateGroups       []string            `json:"createGroups" yaml:"createGroups"`
+	Members            []memberDiff        `json:"members" yaml:"members"`
+	CreateEntitlements []backupEntitlement `json:"createEntitlements" yaml:"createEntitlements"`
+}
+
+// liveUser is the state of a user of the tenant
+type liveUser struct {
+	ID, UserName, Given, Family, Email string
+}
+
+// liveGroup is the state of a group of the tenant, with the ids of its members
+type liveGroup struct {
+	ID      string
+	Members map[string]bool
+}
+
+// Diff prints what would change in the tenant to reach the state of the files
+// of a backup directory: the users and groups to create, the users whose
+// names or emails differ, the group members to add or remove and the
+// entitlements to create. Names are compared without case unless
+// caseSensitive is set, as the tenant does when it looks them up.
+func Diff(ctx *HttpContext, dir string, caseSensitive bool) {
+	state, err := readBackup(ctx, dir)
+	if err != nil {
+		ctx.Log.Err("Could not read %v\n", err)
+		return
+	}
+	diff, err := tenantDiffOf(ctx, state, caseSensitive)
+	if err != nil {
+		ctx.Log.Err("Could not get the state of %s: %v\n", ctx.HostURL, err)
+	} else if ctx.Log.MachineFormat() {
+		ctx.Log.PP("Diff", diff)
+	} else {
+		printDiff(ctx.Log, diff)
+	}
+}
+
+func tenantDiffOf(ctx *HttpContext, state *backupState, caseSensitive bool) (*tenantDiff, error) {
+	users, userNames := make(map[string]liveUser), make(map[string]string)
+	attrs := []string{"id", "userName", "name", "emails"}
+	err := scimForEach(ctx, "Users", "", attrs, func(resource scimResource) error {
+		user := resource.(*typedUser).basicUser()
+		u := liveUser{ID: resource.id(), UserName: user.Name, Given: user.Given, Family: user.Family, Email: user.Email}
+		users[strings.ToLower(u.UserName)], userNames[u.ID] = u, u.UserName
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]liveGroup)
+	attrs = []string{"id", "displayName", "members"}
+	err = scimForEach(ctx, "Groups", "", attrs, func(resource scimResource) error {
+		group := resource.(*typedGroup)
+		g := liveGroup{ID: group.Id, Members: make(map[string]bool)}
+		for _, member := range group.Members {
+			g.Members[member.Value] = true
+		}
+		groups[strings.ToLower(group.DisplayName)] = g
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	diff := &tenantDiff{CreateUsers: []string{}, UpdateUsers: []userDiff{}, CreateGroups: []string{},
+		Members: []memberDiff{}, CreateEntitlements: []backupEntitlement{}}
+	created := map[string]map[string]bool{"Users": {}, "Groups": {}}
+	for _, u := range state.Users {
+		live, ok := users[strings.ToLower(u.Name)]
+		if !ok {
+			diff.CreateUsers = append(diff.CreateUsers, u.Name)
+			created["Users"][strings.ToLower(u.Name)] = true
+		} else if changes := userChanges(live, u, caseSensitive); len(changes) > 0 {
+			diff.UpdateUsers = append(diff.UpdateUsers, userDiff{Name: u.Name, Changes: changes})
+		}
+	}
+	for _, g := range state.Groups {
+		live, ok := groups[strings.ToLower(g.Name)]
+		if !ok {
+			diff.CreateGroups = append(diff.CreateGroups, g.Name)
+			created["Groups"][strings.ToLower(g.Name)] = true
+		}
+		md, wanted := memberDiff{Group: g.Name}, make(map[string]bool)
+		for _, name := range g.Members {
+			if u, ok := users[strings.ToLower(name)]; ok {
+				wanted[u.ID] = true
+				if !live.Members[u.ID] {
+					md.Add = append(md.Add, name)
+				}
+			} else if created["Users"][strings.ToLower(name)] {
+				md.Add = append(md.Add, name)
+			} else {
+				ctx.Log.Warn("Member \"%s\" of group \"%s\" is not a user\n", name, g.Name)
+			}
+		}
+		for id := range live.Members {
+			if name, ok := userNames[id]; ok && !wanted[id] {
+				md.Remove = append(md.Remove, name)
+			}
+		}
+		sort.Strings(md.Remove)
+		if len(md.Add) > 0 || len(md.Remove) > 0 {
+			diff.Members = append(diff.Members, md)
+		}
+	}
+	if len(state.Entitlements) == 0 {
+		return diff, nil
+	}
+	apps, err := catalogItems(ctx)
+	if err != nil {
+		return nil, err
+	}
+	appIDs := make(map[string]string)
+	for _, item := range apps {
+		appIDs[InterfaceToString(item["name"])] = InterfaceToString(item["uuid"])
+	}
+	ids := map[string]map[string]string{"Users": {}, "Groups": {}}
+	for name, u := range users {
+		ids["Users"][name] = u.ID
+	}
+	for name, g := range groups {
+		ids["Groups"][name] = g.ID
+	}
+	existing := make(map[string][]entitlementDef)
+	for _, e := range state.Entitlements {
+		st, err := getSubjectType(e.SubjectType)
+		if err != nil {
+			ctx.Log.Warn("Entitlement to app \"%s\" is skipped: %v\n", e.App, err)
+			continue
+		}
+		itemID, ok := appIDs[e.App]
+		if !ok {
+			ctx.Log.Warn("App \"%s\" entitled to %s \"%s\" is not in the catalog\n", e.App, e.SubjectType, e.Subject)
+			continue
+		}
+		subjID, ok := ids[st.ScimType][strings.ToLower(e.Subject)]
+		if !ok && !created[st.ScimType][strings.ToLower(e.Subject)] {
+			ctx.Log.Warn("No %s found named \"%s\" to entitle to app \"%s\"\n", e.SubjectType, e.Subject, e.App)
+			continue
+		}
+		if _, ok := existing[itemID]; !ok && subjID != "" {
+			if existing[itemID], err = getAppEntitlements(ctx, itemID); err != nil {
+				return nil, err
+			}
+		}
+		if !hasEntitlement(existing[itemID], st.EntitlementType, subjID) {
+			diff.CreateEntitlements = append(diff.CreateEntitlements, e)
+		}
+	}
+	return diff, nil
+}
+
+// userChanges returns the attributes of the file that differ from those of
+// the user, attributes that are not in the file are not compared.
+func userChanges(live liveUser, u BasicUser, caseSensitive bool) []userChange {
+	changes := []userChange{}
+	for _, a := range []userChange{{"userName", live.UserName, u.Name}, {"givenName", live.Given, u.Given},
+		{"familyName", live.Family, u.Family}, {"email", live.Email, u.Email}} {
+		if a.New != "" && a.New != a.Old && (caseSensitive || !strings.EqualFold(a.New, a.Old)) {
+			changes = append(changes, a)
+		}
+	}
+	return changes
+}
+
+func hasEntitlement(defs []entitlementDef, subjectType, subjectID string) bool {
+	for _, def := range defs {
+		if subjectID != "" && def.SubjectType == subjectType && def.SubjectID == subjectID {
+			return true
+		}
+	}
+	return false
+}
+
+func printDiff(log *Logr, diff *tenantDiff) {
+	changes := 0
+	printf := func(format string, args ...interface{}) {
+		log.DiffLine(format, args...)
+		changes++
+	}
+	for _, name := range diff.CreateUsers {
+		printf("+ user %s\n", name)
+	}
+	for _, u := range diff.UpdateUsers {
+		attrs := make([]string, len(u.Changes))
+		for i, c := range u.Changes {
+			attrs[i] = fmt.Sprintf("%s: %s → %s", c.Attribute, c.Old, c.New)
+		}
+		printf("~ user %s, %s\n", u.Name, strings.Join(attrs, ", "))
+	}
+	for _, name := range diff.CreateGroups {
+		printf("+ group %s\n", name)
+	}
+	for _, md := range diff.Members {
+		for _, name := range md.Add {
+			printf("+ member %s of group %s\n", name, md.Group)
+		}
+		for _, name := range md.Remove {
+			printf("- member %s of group %s\n", name, md.Group)
+		}
+	}
+	for _, e := range diff.CreateEntitlements {
+		printf("+ entitlement of %s %s to app %s\n", e.SubjectType, e.Subject, e.App)
+	}
+	if changes == 0 {
+		log.Info("No changes\n")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// diffPaths are the paths of the tenant of restorePaths, where anna has
+// another email and olaf is named Olaf.
+func diffPaths() map[string]TstHandler {
+	paths := restorePaths()
+	delete(paths, restoreUsersPath)
+	paths["GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails&count=500&startIndex=1"] = GoodPathHandler(
+		`{"totalResults": 3, "Resources": [{"id": "1", "userName": "anna", "emails": [{"value": "anna@old.com"}]},
+		{"id": "2", "userName": "Olaf"}, {"id": "4", "userName": "kristoff"}]}`)
+	return paths
+}
+
+func diffOf(t *testing.T, log *Logr, caseSensitive bool) *HttpContext {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.yaml"),
+		[]byte("- {name: anna, email: anna@example.com}\n- {name: olaf}\n- {name: sven}\n"), 0644))
+	srv := StartTstServer(t, diffPaths())
+	defer srv.Close()
+	ctx := NewHttpContext(log, srv.URL, "/", "")
+	Diff(ctx, dir, caseSensitive)
+	return ctx
+}
+
+func TestDiff(t *testing.T) {
+	ctx := diffOf(t, NewBufferedLogr(), false)
+	AssertOnlyInfoContains(t, ctx, "+ user sven\n"+
+		"~ user anna, email: anna@old.com → anna@example.com\n"+
+		"+ group trolls\n"+
+		"+ member olaf of group friends\n"+
+		"+ member sven of group friends\n"+
+		"- member kristoff of group friends\n"+
+		"+ member olaf of group trolls\n"+
+		"+ entitlement of user sven to app sledge\n")
+}
+
+func TestDiffCaseSensitive(t *testing.T) {
+	ctx := diffOf(t, NewBufferedLogr(), true)
+	assert.Contains(t, ctx.Log.InfoString(), "~ user olaf, userName: Olaf → olaf\n")
+}
+
+func TestDiffInJson(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FJson
+	ctx := diffOf(t, log, false)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.JSONEq(t, `{"createUsers": ["sven"],
+		"updateUsers": [{"name": "anna", "changes": [{"attribute": "email", "old": "anna@old.com", "new": "anna@example.com"}]}],
+		"createGroups": ["trolls"],
+		"members": [{"group": "friends", "add": ["olaf", "sven"], "remove": ["kristoff"]}, {"group": "trolls", "add": ["olaf"]}],
+		"createEntitlements": [{"app": "sledge", "subjectType": "user", "subject": "sven"}]}`, ctx.Log.InfoString())
+}
+
+func TestDiffWithoutChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-diff")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte("- {name: ANNA, email: Anna@Old.com}\n"), 0644))
+	srv, ctx := NewTestContext(t, diffPaths())
+	defer srv.Close()
+	Diff(ctx, dir, false)
+	AssertOnlyInfoContains(t, ctx, "No changes\n")
+}
@@ -17,6 +17,7 @@ package core
 
 import (
 	"github.com/vmware/priam/util"
+	"regexp"
 )
 
 // The directory service interface.
@@ -36,13 +37,31 @@ type DirectoryService interface {
 	DeleteEntity(ctx *util.HttpContext, name string)
 
 	// List existing entities
-	// @param count the number of entities to display
-	// @param filter the filter such as 'username eq \"joe\"' for SCIM resources
-	ListEntities(ctx *util.HttpContext, count int, filter string)
+	ListEntities(ctx *util.HttpContext, opts ListOptions)
 
-	// Create entities from a file
-	LoadEntities(ctx *util.HttpContext, fileName string)
+	// Create entities from a file, after those that the checkpoint records as
+	// processed if it is resumed. The checkpoint may be nil.
+	LoadEntities(ctx *util.HttpContext, fileName string, cp *util.Checkpoint)
 
 	// Adds or removes a user for entities that have members, like Group or Role
 	UpdateMember(ctx *util.HttpContext, name, member string, remove bool)
 }
+
+// Options of a list of entities
+type ListOptions struct {
+	Count      int            // the number of entities to display, all if 0
+	Filter     string         // the filter such as 'username eq "joe"' for SCIM resources
+	SortBy     string         // the attribute to sort by
+	Descending bool           // sort in descending order
+	Grep       *regexp.Regexp // only display entities with a summary field that matches
+	CountOnly  bool           // only print the number of entities
+	// only display entities created or last modified within these times,
+	// and those without a valid time to check, which are counted in a warning
+	DateWindow
+	Dates        bool // also display when entities were created and last modified
+	UserStatus   bool // also display the workspace status of users
+	ShowUserType bool // also display the internal user type of users
+	// only display users of this internal user type, filtered by the server
+	// if it can and always checked here, if it is set
+	UserType string
+}
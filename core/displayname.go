@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+	"text/template"
+)
+
+const displayNameTemplateKey = "displayNameTemplate"
+
+// SetDisplayNameTemplate sets the Go template that composes the display name
+// of users added or updated with a given or family name but no display name,
+// such as "{{.Honorific}} {{.Given}} {{.Family}}". The variables of the
+// template are Name, Given, Middle, Family, Honorific and Email, empty if the
+// user does not have them.
+func SetDisplayNameTemplate(ctx *HttpContext, text string) error {
+	tmpl, err := template.New("display name").Parse(text)
+	if err != nil {
+		return err
+	}
+	ctx.SetValue(displayNameTemplateKey, tmpl)
+	return nil
+}
+
+// composedDisplayName returns the display name of a user composed with the
+// template of the context, "" if the context has none or the user has a
+// display name or neither a given nor a family name. Spaces left by the
+// names that the user does not have are removed.
+func composedDisplayName(ctx *HttpContext, u *BasicUser) (string, error) {
+	tmpl, _ := ctx.Value(displayNameTemplateKey, nil)
+	if tmpl == nil || u.Display != "" || u.Given == "" && u.Family == "" {
+		return "", nil
+	}
+	var out bytes.Buffer
+	if err := tmpl.(*template.Template).Execute(&out, map[string]string{"Name": u.Name, "Given": u.Given,
+		"Middle": u.Middle, "Family": u.Family, "Honorific": u.Honorific, "Email": u.Email}); err != nil {
+		return "", fmt.Errorf("could not compose the display name: %v", err)
+	}
+	return strings.Join(strings.Fields(out.String()), " "), nil
+}
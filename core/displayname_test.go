@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+// addUserBody adds a user and returns the body of the request sent
+func addUserBody(t *testing.T, template string, u *BasicUser) (*HttpContext, string) {
+	body := ""
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		body = req.Input
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	if template != "" {
+		require.Nil(t, SetDisplayNameTemplate(ctx, template))
+	}
+	new(SCIMUsersService).AddEntity(ctx, u)
+	return ctx, body
+}
+
+func TestAddUserWithAllNames(t *testing.T) {
+	_, body := addUserBody(t, "{{.Given}} {{.Family}}", &BasicUser{Name: "ann", Given: "Ann", Family: "Lee",
+		Middle: "Mae", Honorific: "Dr.", Display: "Ann Lee, PhD", Email: "ann@hr.com"})
+	assert.JSONEq(t, `{"Schemas": ["urn:scim:schemas:core:1.0"], "UserName": "ann", "DisplayName": "Ann Lee, PhD",
+		"Name": {"GivenName": "Ann", "FamilyName": "Lee", "MiddleName": "Mae", "HonorificPrefix": "Dr."},
+		"Emails": [{"Value": "ann@hr.com"}]}`, body)
+}
+
+func TestAddUserWithComposedDisplayName(t *testing.T) {
+	_, body := addUserBody(t, "{{.Honorific}} {{.Given}} {{.Middle}} {{.Family}}",
+		&BasicUser{Name: "ann", Given: "Ann", Family: "Lee", Email: "ann@hr.com"})
+	assert.Contains(t, body, `"DisplayName":"Ann Lee"`)
+	_, body = addUserBody(t, "{{.Given}} {{.Family}}", &BasicUser{Name: "ann", Email: "ann@hr.com"})
+	assert.NotContains(t, body, "DisplayName", "a user without names should not get a composed display name")
+	_, body = addUserBody(t, "", &BasicUser{Name: "ann", Given: "Ann", Family: "Lee", Email: "ann@hr.com"})
+	assert.NotContains(t, body, "DisplayName")
+}
+
+func TestAddUserFailsIfDisplayNameCannotBeComposed(t *testing.T) {
+	ctx, body := addUserBody(t, "{{.Given.Initial}}", &BasicUser{Name: "ann", Given: "Ann", Email: "ann@hr.com"})
+	assert.Empty(t, body)
+	AssertErrorContains(t, ctx, "Error creating user 'ann': could not compose the display name")
+}
+
+func TestInvalidDisplayNameTemplate(t *testing.T) {
+	assert.NotNil(t, SetDisplayNameTemplate(NewHttpContext(NewBufferedLogr(), "", "", ""), "{{.Given"))
+}
+
+func TestUpdateUserComposesDisplayNameOnlyWithGivenAndFamily(t *testing.T) {
+	for _, test := range []struct {
+		update   BasicUser
+		expected string
+	}{
+		{BasicUser{Name: "john", Given: "Johnny", Family: "Wayne"}, `"DisplayName":"Wayne, Johnny"`},
+		{BasicUser{Name: "john", Given: "Johnny", Family: "Wayne", Display: "J. W."}, `"DisplayName":"J. W."`},
+		{BasicUser{Name: "john", Given: "Johnny"}, `"Name":{"GivenName":"Johnny"}`},
+		{BasicUser{Name: "john", Middle: "Lee", Honorific: "Mr."}, `"Name":{"MiddleName":"Lee","HonorificPrefix":"Mr."}`},
+	} {
+		body := ""
+		ctx := NewReplayContext(t, map[string]TstHandler{DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+			DEFAULT_POST_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+				body = req.Input
+				return &TstReply{Status: 204}
+			}})
+		require.Nil(t, SetDisplayNameTemplate(ctx, "{{.Family}}, {{.Given}}"))
+		new(SCIMUsersService).UpdateEntity(ctx, "john", &test.update)
+		assert.Contains(t, body, test.expected)
+		if test.update.Display == "" && test.update.Family == "" {
+			assert.NotContains(t, body, "DisplayName", "a partial name should not compose a display name")
+		}
+	}
+}
+
+func TestNamesRoundTrip(t *testing.T) {
+	u := BasicUser{Name: "ann", Given: "Ann", Family: "Lee", Middle: "Mae", Honorific: "Dr.",
+		Display: "Dr. Ann Lee", Email: "ann@hr.com"}
+	_, body := addUserBody(t, "", &u)
+	var created typedUser
+	require.Nil(t, json.Unmarshal([]byte(body), &created))
+	assert.Equal(t, u, created.basicUser())
+
+	u = BasicUser{Name: "bob", Given: "Bob", Family: "Ray", Email: "bob@hr.com"}
+	_, body = addUserBody(t, "", &u)
+	created = typedUser{}
+	require.Nil(t, json.Unmarshal([]byte(body), &created))
+	assert.Equal(t, u, created.basicUser(), "users with only a given and family name should not change")
+}
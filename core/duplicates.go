@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+const duplicateCheckKey = "duplicateCheck"
+
+// duplicateCheck says how users are checked before they are added. Users of
+// a load are checked against an index of all the users of the tenant, which
+// costs a few requests rather than two per user.
+type duplicateCheck struct {
+	allowEmails bool
+	names       map[string]string       // ids of users by lower case userName
+	emails      map[string]existingUser // users by lower case email
+}
+
+type existingUser struct {
+	name, id string
+}
+
+// CheckDuplicates makes users added with the context checked first for an
+// existing user with the same userName, and with the same email, which only
+// gets a warning if allowEmails is true.
+func CheckDuplicates(ctx *HttpContext, allowEmails bool) {
+	ctx.SetValue(duplicateCheckKey, &duplicateCheck{allowEmails: allowEmails})
+}
+
+func duplicateCheckOf(ctx *HttpContext) *duplicateCheck {
+	check, _ := ctx.Value(duplicateCheckKey, nil)
+	dc, _ := check.(*duplicateCheck)
+	return dc
+}
+
+// indexUsers gets the userNames and emails of all users if users are
+// checked for duplicates, so that the users of a load are checked without
+// more requests.
+func indexUsers(ctx *HttpContext) error {
+	dc := duplicateCheckOf(ctx)
+	if dc == nil {
+		return nil
+	}
+	dc.names, dc.emails = map[string]string{}, map[string]existingUser{}
+	err := scimForEach(ctx, "Users", "", []string{"id", "userName", "emails"}, func(resource scimResource) error {
+		u := resource.(*typedUser)
+		dc.add(u.Id, u.UserName, u.Emails...)
+		return nil
+	})
+	if err != nil {
+		dc.names, dc.emails = nil, nil
+	}
+	return err
+}
+
+// add adds a user to the index
+func (dc *duplicateCheck) add(id, name string, emails ...dispValue) {
+	dc.names[strings.ToLower(name)] = id
+	for _, email := range emails {
+		if key := strings.ToLower(email.Value); dc.emails[key].id == "" {
+			dc.emails[key] = existingUser{name, id}
+		}
+	}
+}
+
+// checkDuplicate returns an error if the context checks duplicates and a
+// user exists with the name, or with the email unless it only warns of them.
+func checkDuplicate(ctx *HttpContext, name, email string) error {
+	dc := duplicateCheckOf(ctx)
+	if dc == nil {
+		return nil
+	}
+	var nameID string
+	var emailUser existingUser
+	if dc.names != nil {
+		nameID, emailUser = dc.names[strings.ToLower(name)], dc.emails[strings.ToLower(email)]
+	} else if users, err := findUsers(ctx, Eq("userName", name)); err != nil {
+		return fmt.Errorf("could not check for a user with the same userName: %v", err)
+	} else if len(users) > 0 {
+		nameID = users[0].Id
+	} else if users, err = findUsers(ctx, Eq("emails", email)); err != nil {
+		return fmt.Errorf("could not check for a user with the same email: %v", err)
+	} else if len(users) > 0 {
+		emailUser = existingUser{users[0].UserName, users[0].Id}
+	}
+	if nameID != "" {
+		return fmt.Errorf("a user named \"%s\" already exists with id %s", name, nameID)
+	} else if emailUser.id == "" {
+		return nil
+	} else if dc.allowEmails {
+		ctx.Log.Warn("email %s of user \"%s\" is already used by user \"%s\" with id %s\n", email,
+			Named("Users", name), Named("Users", emailUser.name), emailUser.id)
+		return nil
+	}
+	return fmt.Errorf("email %s is already used by user \"%s\" with id %s", email,
+		Named("Users", emailUser.name), emailUser.id)
+}
+
+// addedUser adds a user that was just created to the index of a load
+func addedUser(ctx *HttpContext, id, name, email string) {
+	if dc := duplicateCheckOf(ctx); dc != nil && dc.names != nil {
+		dc.add(id, name, dispValue{Value: email})
+	}
+}
+
+// findUsers returns the ids, userNames and emails of the users matching a filter
+func findUsers(ctx *HttpContext, filter ScimFilter) (users []*typedUser, err error) {
+	err = scimForEach(ctx, "Users", filter.String(), []string{"id", "userName", "emails"},
+		func(resource scimResource) error {
+			users = append(users, resource.(*typedUser))
+			return nil
+		})
+	return users, err
+}
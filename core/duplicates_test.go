@@ -0,0 +1,122 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"os"
+	"testing"
+)
+
+const noUsers = `{"totalResults": 0, "Resources": []}`
+
+// findUsersURL is the path of the search of the users matching a filter
+func findUsersURL(filter string) string {
+	vals := url.Values{"attributes": {"id,userName,emails"}, "count": {"500"}, "startIndex": {"1"}}
+	if filter != "" {
+		vals.Set("filter", filter)
+	}
+	return "GET/scim/Users?" + vals.Encode()
+}
+
+// addUserChecked adds user sue with sue@acme.com, checking for duplicates
+// with the given results of the searches by userName and email, and returns
+// whether the user was created.
+func addUserChecked(t *testing.T, allowEmails bool, byName, byEmail string) (*HttpContext, bool) {
+	added := false
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		findUsersURL(`userName eq "sue"`):        GoodPathHandler(byName),
+		findUsersURL(`emails eq "sue@acme.com"`): GoodPathHandler(byEmail),
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			added = true
+			return &TstReply{Output: `{"id": "1"}`}
+		}})
+	CheckDuplicates(ctx, allowEmails)
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "sue", Email: "sue@acme.com"})
+	return ctx, added
+}
+
+func TestAddUserChecksForDuplicates(t *testing.T) {
+	ctx, added := addUserChecked(t, false, noUsers, noUsers)
+	assert.True(t, added)
+	AssertOnlyInfoContains(t, ctx, "User 'sue' successfully added")
+}
+
+func TestAddUserFailsIfUserNameExists(t *testing.T) {
+	ctx, added := addUserChecked(t, true, ScimUsersPage(1, 1, "Sue"), noUsers)
+	assert.False(t, added)
+	AssertOnlyErrorContains(t, ctx, `Error creating user 'sue': a user named "sue" already exists with id Sue-id`)
+}
+
+func TestAddUserFailsIfEmailExists(t *testing.T) {
+	ctx, added := addUserChecked(t, false, noUsers, ScimUsersPage(1, 1, "susan"))
+	assert.False(t, added)
+	AssertOnlyErrorContains(t, ctx, `Error creating user 'sue': email sue@acme.com is already used by user "susan" `+
+		"with id susan-id")
+}
+
+func TestAddUserWarnsIfEmailExistsWhenAllowed(t *testing.T) {
+	ctx, added := addUserChecked(t, true, noUsers, ScimUsersPage(1, 1, "susan"))
+	assert.True(t, added)
+	assert.Equal(t, "WARNING: email sue@acme.com of user \"sue\" is already used by user \"susan\" with id susan-id\n",
+		ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "User 'sue' successfully added")
+}
+
+func TestAddUserWithoutDuplicateCheckDoesNotSearchUsers(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": GoodPathHandler(`{"id": "1"}`)})
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "sue", Email: "sue@acme.com"})
+	AssertOnlyInfoContains(t, ctx, "User 'sue' successfully added")
+}
+
+func TestLoadUsersChecksDuplicatesWithOneSearch(t *testing.T) {
+	searches, added := 0, []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		findUsersURL(""): func(t *testing.T, req *TstReq) *TstReply {
+			searches++
+			return &TstReply{Output: `{"totalResults": 2, "Resources": [
+				{"id": "1a", "userName": "Ann", "emails": [{"value": "ann@acme.com"}]},
+				{"id": "2b", "userName": "bob", "emails": [{"value": "bob@acme.com"}, {"value": "B@home.com"}]}]}`}
+		},
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			added = append(added, req.Input)
+			return &TstReply{Output: `{"id": "new1"}`}
+		}})
+	CheckDuplicates(ctx, false)
+	usersFile := WriteTempFile(t, "---\n- {name: ann, email: anna@acme.com}\n- {name: cy, email: b@HOME.com}\n"+
+		"- {name: dee, email: dee@acme.com}\n- {name: DEE, email: dee2@acme.com}\n- {name: eve, email: dee@acme.com}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Equal(t, 1, searches)
+	assert.Len(t, added, 1)
+	assert.Equal(t, `Error creating user 'ann': a user named "ann" already exists with id 1a
+Error creating user 'cy': email b@HOME.com is already used by user "bob" with id 2b
+Error creating user 'DEE': a user named "DEE" already exists with id new1
+Error creating user 'eve': email dee@acme.com is already used by user "dee" with id new1
+`, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 1, failed: 4, not attempted: 0")
+}
+
+func TestLoadUsersFailsIfUsersCannotBeSearched(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{findUsersURL(""): ErrorHandler(403, "forbidden")})
+	CheckDuplicates(ctx, false)
+	new(SCIMUsersService).LoadEntities(ctx, YAML_USERS_FILE, nil)
+	AssertOnlyErrorContains(t, ctx, "could not get the users of the tenant to check for duplicates: 403 Forbidden")
+}
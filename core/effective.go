@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/vmware/priam/util"
+	"sort"
+	"sync"
+)
+
+// effectiveEntitlement is an app that a user is entitled to, with every way
+// the user is entitled: "direct" or "via group <name>".
+type effectiveEntitlement struct {
+	App           string   `json:"app" yaml:"app"`
+	CatalogItemID string   `json:"catalogItemId" yaml:"catalogItemId"`
+	Sources       []string `json:"sources" yaml:"sources,flow"`
+}
+
+// entitlementSource is the user or one of the groups of the user, whose
+// entitlements are got
+type entitlementSource struct {
+	resType, id, name string
+	group             dispValue
+	defs              []entitlementDef
+	err               error
+}
+
+// GetEffectiveEntitlements prints the apps that a user is entitled to,
+// directly or through their groups, each once with all the ways the user is
+// entitled. The entitlements of the groups are got with at most parallel
+// requests at the same time. If byID is set, name is the SCIM ID of the user.
+func GetEffectiveEntitlements(ctx *HttpContext, name string, byID bool, parallel int) {
+	user, err := getEntitledUser(ctx, name, byID)
+	if err != nil {
+		ctx.Log.Err("Error getting user %s: %v\n", Named("Users", name), err)
+		reportAmbiguous(ctx, err)
+		return
+	}
+	sources := []*entitlementSource{{resType: "users", id: user.Id, name: user.UserName}}
+	for _, g := range user.Groups {
+		sources = append(sources, &entitlementSource{resType: "groups", id: g.Value, group: g})
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots, wg := make(chan struct{}, parallel), sync.WaitGroup{}
+	for _, s := range sources {
+		wg.Add(1)
+		go func(s *entitlementSource, srcCtx *HttpContext) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if s.resType == "groups" {
+				groupName, err := displayName(srcCtx, "Groups", s.group)
+				if s.name = StringOrDefault(groupName, s.id); err != nil {
+					srcCtx.Log.Warn("%v, the group is named by its id\n", err)
+				}
+			}
+			s.defs, s.err = subjectEntitlements(srcCtx, s.resType, s.id)
+		}(s, ctx.Clone())
+	}
+	wg.Wait()
+	// the groups are listed by name after the direct entitlements
+	sort.SliceStable(sources[1:], func(i, j int) bool { return sources[i+1].name < sources[j+1].name })
+	entitlements, incomplete := mergeEntitlements(ctx, sources)
+	ctx.Log.PP("Effective entitlements of "+user.UserName, entitlements, "app", "sources")
+	if incomplete {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
+
+func getEntitledUser(ctx *HttpContext, name string, byID bool) (*typedUser, error) {
+	if !byID {
+		item, err := scimGetByName(ctx, "Users", "userName", name)
+		if err != nil {
+			return nil, err
+		}
+		return item.(*typedUser), nil
+	}
+	user := &typedUser{}
+	return user, ctx.Accept("json").Request("GET", "scim/Users/"+name, nil, user)
+}
+
+// mergeEntitlements returns the entitlements of the sources by app, sorted
+// by the names of the apps, and whether some could not be got.
+func mergeEntitlements(ctx *HttpContext, sources []*entitlementSource) ([]*effectiveEntitlement, bool) {
+	incomplete, appNames := false, make(map[string]string)
+	if items, err := catalogItems(ctx); err != nil {
+		ctx.Log.Err("Could not get names of apps: %v\n", err)
+		incomplete = true
+	} else {
+		for _, item := range items {
+			appNames[InterfaceToString(item["uuid"])] = InterfaceToString(item["name"])
+		}
+	}
+	byItem, entitlements := make(map[string]*effectiveEntitlement), []*effectiveEntitlement{}
+	for _, s := range sources {
+		source := "direct"
+		if s.resType == "groups" {
+			source = "via group " + s.name
+		}
+		if s.err != nil {
+			ctx.Log.Err("Could not get entitlements of %s \"%s\": %v\n", s.resType[:len(s.resType)-1], s.name, s.err)
+			incomplete = true
+			continue
+		}
+		for _, def := range s.defs {
+			e := byItem[def.CatalogItemID]
+			if e == nil {
+				e = &effectiveEntitlement{App: StringOrDefault(appNames[def.CatalogItemID], def.CatalogItemID),
+					CatalogItemID: def.CatalogItemID}
+				byItem[def.CatalogItemID], entitlements = e, append(entitlements, e)
+			}
+			if !HasString(source, e.Sources) {
+				e.Sources = append(e.Sources, source)
+			}
+		}
+	}
+	sort.SliceStable(entitlements, func(i, j int) bool { return entitlements[i].App < entitlements[j].App })
+	return entitlements, incomplete
+}
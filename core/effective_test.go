@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+// effectivePaths are the describePaths where trolls are also entitled to
+// sledge, which john is entitled to directly.
+func effectivePaths() map[string]TstHandler {
+	paths := describePaths()
+	paths["GET/entitlements/definitions/groups/11"] = GoodPathHandler(`{"items": [{"catalogItemId": "app-1",
+		"subjectType": "GROUPS", "subjectId": "11", "activationPolicy": "AUTOMATIC"}]}`)
+	return paths
+}
+
+func effectiveJSON(t *testing.T, ctx *HttpContext, parallel int) []effectiveEntitlement {
+	ctx.Log.Format = FJson
+	GetEffectiveEntitlements(ctx, "john", false, parallel)
+	var entitlements []effectiveEntitlement
+	require.Nil(t, json.Unmarshal([]byte(ctx.Log.InfoString()), &entitlements))
+	return entitlements
+}
+
+func TestEffectiveEntitlementsMergeSources(t *testing.T) {
+	for _, parallel := range []int{1, 8} {
+		ctx := NewReplayContext(t, effectivePaths())
+		assert.Equal(t, []effectiveEntitlement{
+			{App: "castle", CatalogItemID: "app-2", Sources: []string{"via group friends"}},
+			{App: "sledge", CatalogItemID: "app-1", Sources: []string{"direct", "via group trolls"}},
+		}, effectiveJSON(t, ctx, parallel))
+		assert.Empty(t, ctx.Log.ErrString())
+		assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+	}
+}
+
+func TestEffectiveEntitlementsOfGroupThatFails(t *testing.T) {
+	paths := effectivePaths()
+	paths["GET/entitlements/definitions/groups/10"] = ErrorHandler(503, "down")
+	paths["GET/scim/Groups/11?attributes=displayName"] = ErrorHandler(404, "gone")
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	assert.Equal(t, []effectiveEntitlement{
+		{App: "sledge", CatalogItemID: "app-1", Sources: []string{"direct", "via group 11"}},
+	}, effectiveJSON(t, ctx, 4))
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: could not get name of Groups 11")
+	assert.Contains(t, ctx.Log.ErrString(), `Could not get entitlements of group "friends": 503`)
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestEffectiveEntitlementsPrintsSources(t *testing.T) {
+	ctx := NewReplayContext(t, effectivePaths())
+	GetEffectiveEntitlements(ctx, "john", false, 4)
+	AssertOnlyInfoContains(t, ctx, "---- Effective entitlements of john ----")
+	AssertOnlyInfoContains(t, ctx, "sources: [direct, via group trolls]")
+}
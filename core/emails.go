@@ -0,0 +1,169 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+const defaultEmailDomainKey = "defaultEmailDomain"
+
+// SetDefaultEmailDomain sets the domain of the email of users added without
+// one, whose email is then <userName>@<domain>.
+func SetDefaultEmailDomain(ctx *HttpContext, domain string) {
+	ctx.SetValue(defaultEmailDomainKey, strings.TrimPrefix(domain, "@"))
+}
+
+const lowercaseNamesKey = "lowercaseNames"
+
+// SetLowercaseNames makes the users added with the context get their userName
+// and email in lower case, for tenants where names that only differ in case
+// are different accounts.
+func SetLowercaseNames(ctx *HttpContext, lowercase bool) {
+	ctx.SetValue(lowercaseNamesKey, lowercase)
+}
+
+// lowercaseUser changes the userName and email of a user to add to lower
+// case if the context says so, and returns whether they changed.
+func lowercaseUser(ctx *HttpContext, u *BasicUser) bool {
+	if lowercase, _ := ctx.Value(lowercaseNamesKey, nil); lowercase != true {
+		return false
+	}
+	name, email := strings.ToLower(u.Name), strings.ToLower(u.Email)
+	changed := name != u.Name || email != u.Email
+	u.Name, u.Email = name, email
+	return changed
+}
+
+// newUserEmail returns the email of a user to add, with the default email
+// domain if the user has none, and whether the default domain was used.
+func newUserEmail(ctx *HttpContext, u *BasicUser) (string, bool, error) {
+	if u.Email != "" {
+		return u.Email, false, nil
+	}
+	if domain, _ := ctx.Value(defaultEmailDomainKey, nil); domain != nil && domain != "" {
+		return u.Name + "@" + domain.(string), true, nil
+	}
+	return "", false, errors.New("the user has no email and no default email domain is set for the target, " +
+		"set one with \"priam target --default-email-domain <domain>\"")
+}
+
+func (u *UserUpdate) changesEmails() bool {
+	return u.Email != "" || u.PrimaryEmail != "" || len(u.AddEmails) > 0 || len(u.RemoveEmails) > 0
+}
+
+// userEmails gets the current emails of a user with all their attributes
+func userEmails(ctx *HttpContext, id string) ([]map[string]interface{}, error) {
+	outp := &struct{ Emails []map[string]interface{} }{}
+	err := ctx.Accept("json").Request("GET", "scim/Users/"+id+"?attributes=emails", nil, outp)
+	return outp.Emails, err
+}
+
+// mergeEmails returns the emails of a user changed by the update, keeping
+// the other emails and their attributes, with exactly one primary email if
+// there are any. Emails are compared ignoring case so that no value is sent
+// twice, which tenants reject. It also returns the emails to remove that the
+// user does not have.
+func mergeEmails(current []map[string]interface{}, u *UserUpdate) (emails []map[string]interface{}, missing []string) {
+	for _, email := range current {
+		copied := make(map[string]interface{}, len(email))
+		for k, v := range email {
+			copied[k] = v
+		}
+		emails = append(emails, copied)
+	}
+	find := func(value string) int {
+		for i, email := range emails {
+			if strings.EqualFold(InterfaceToString(email["value"]), value) {
+				return i
+			}
+		}
+		return -1
+	}
+	primary := func() int {
+		for i, email := range emails {
+			if isPrimary, _ := email["primary"].(bool); isPrimary {
+				return i
+			}
+		}
+		return -1
+	}
+	setPrimary := func(index int) {
+		for i, email := range emails {
+			if i == index {
+				email["primary"] = true
+			} else if _, ok := email["primary"]; ok {
+				email["primary"] = false
+			}
+		}
+	}
+	remove := func(index int) {
+		emails = append(emails[:index], emails[index+1:]...)
+	}
+	if u.Email != "" {
+		if p, i := primary(), find(u.Email); p >= 0 && i >= 0 && i != p {
+			remove(p)
+			setPrimary(find(u.Email))
+		} else if p >= 0 {
+			emails[p]["value"] = u.Email
+		} else if i >= 0 {
+			setPrimary(i)
+		} else {
+			emails = append(emails, map[string]interface{}{"value": u.Email})
+			setPrimary(len(emails) - 1)
+		}
+	}
+	for _, value := range u.AddEmails {
+		if find(value) < 0 {
+			emails = append(emails, map[string]interface{}{"value": value})
+		}
+	}
+	for _, value := range u.RemoveEmails {
+		if i := find(value); i < 0 {
+			missing = append(missing, value)
+		} else {
+			remove(i)
+		}
+	}
+	if u.PrimaryEmail != "" {
+		if find(u.PrimaryEmail) < 0 {
+			emails = append(emails, map[string]interface{}{"value": u.PrimaryEmail})
+		}
+		setPrimary(find(u.PrimaryEmail))
+	}
+	if p := primary(); p >= 0 {
+		setPrimary(p)
+	} else if len(emails) > 0 {
+		setPrimary(0)
+	}
+	if emails == nil {
+		emails = []map[string]interface{}{}
+	}
+	return
+}
+
+// emailsError explains an error of a tenant that rejects an email, which may
+// be used by another user.
+func emailsError(err error) error {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == 409 {
+		return fmt.Errorf("the tenant rejected an email as a duplicate value, it may be used by another user: %v", err)
+	}
+	return err
+}
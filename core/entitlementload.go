@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"strings"
+)
+
+// EntitlementLoadOptions are the options of LoadEntitlements
+type EntitlementLoadOptions struct {
+	// Ensure skips the rows whose subject is already entitled to the app
+	Ensure bool
+	// PolicyUpdate also updates the entitlements whose activation policy is
+	// not the one of their row, it implies Ensure
+	PolicyUpdate bool
+	// DryRun only prints the operations that would be sent
+	DryRun bool
+}
+
+// entitlementLoader resolves the rows of a file of entitlements to bulk
+// operations, with the IDs of apps and the entitlements of each app got once.
+type entitlementLoader struct {
+	ctx      *HttpContext
+	opts     EntitlementLoadOptions
+	appIDs   map[string]string
+	existing map[string][]entitlementDef
+}
+
+// LoadEntitlements entitles the subjects of the rows of a YAML file to their
+// apps with bulk requests. The rows have the format of the entitlements of a
+// backup: app, subjectType, subject and optionally policy. If the command is
+// interrupted, the rows that are left are not attempted. Rows that failed or
+// were not attempted are saved in a file with the same format so that they
+// can be loaded again. A dry run resolves the rows and prints the operations
+// without sending them.
+func LoadEntitlements(ctx *HttpContext, fileName string, opts EntitlementLoadOptions) {
+	var rows, pending, failedRows []backupEntitlement
+	err := readRows(ctx, fileName, func(content []byte) (int, error) {
+		rows = nil
+		err := yaml.Unmarshal(content, &rows)
+		return len(rows), err
+	})
+	if err != nil {
+		ctx.Log.Err("could not read file of entitlements: %v\n", err)
+		return
+	}
+	l := &entitlementLoader{ctx: ctx, opts: opts, appIDs: make(map[string]string),
+		existing: make(map[string][]entitlementDef)}
+	var ops []entitlementOp
+	var pendingRows []int
+	// a dry run does not change the tenant, so it has no rows to summarize
+	summary := ctx.Log.Summary
+	if opts.DryRun {
+		summary = nil
+	}
+	present, failed, skipped := 0, 0, 0
+	for i, e := range rows {
+		if ctx.Canceled() {
+			skipped, failedRows = len(rows)-i, append(failedRows, rows[i:]...)
+			for j := i; j < len(rows); j++ {
+				summary.Row(j+1, rows[j].rowName(), OutcomeSkipped, errNotAttempted)
+			}
+			break
+		}
+		if op, needed, err := l.operation(e); err != nil {
+			ctx.Log.Err("Could not entitle %s \"%s\" to app \"%s\": %v\n", e.SubjectType, e.Subject, e.App, err)
+			failed, failedRows = failed+1, append(failedRows, e)
+			summary.Row(i+1, e.rowName(), OutcomeFailed, err)
+		} else if !needed {
+			present++
+			summary.Row(i+1, e.rowName(), OutcomeSkipped, nil)
+		} else {
+			ops, pending, pendingRows = append(ops, op), append(pending, e), append(pendingRows, i+1)
+		}
+	}
+	if opts.DryRun {
+		planEntitlements(ctx, ops, pending, present, failed, skipped)
+		return
+	}
+	created, updated := 0, 0
+	for i, err := range entitlementBulkRequest(ctx, ops...) {
+		e, row := pending[i], pendingRows[i]
+		if err == errNotAttempted {
+			skipped, failedRows = skipped+1, append(failedRows, e)
+			summary.Row(row, e.rowName(), OutcomeSkipped, err)
+		} else if err != nil {
+			ctx.Log.Err("Could not entitle %s \"%s\" to app \"%s\": %v\n", e.SubjectType, e.Subject, e.App, err)
+			failed, failedRows = failed+1, append(failedRows, e)
+			summary.Row(row, e.rowName(), OutcomeFailed, err)
+		} else if ops[i].Method == "PUT" {
+			ctx.Log.Info("Updated activation policy of %s \"%s\" to app \"%s\" to %s\n", e.SubjectType, e.Subject,
+				e.App, ops[i].Data.ActivationPolicy)
+			summary.Row(row, e.rowName(), OutcomeUpdated, nil)
+			updated++
+		} else {
+			ctx.Log.Info("Entitled %s \"%s\" to app \"%s\"\n", e.SubjectType, e.Subject, e.App)
+			summary.Row(row, e.rowName(), OutcomeCreated, nil)
+			created++
+		}
+	}
+	ctx.Log.Info("Entitlements created: %d, updated: %d, already present: %d, failed: %d, not attempted: %d\n",
+		created, updated, present, failed, skipped)
+	if len(failedRows) > 0 {
+		ctx.Log.Fail(ExitPartial)
+		failFile := failureFileName(fileName)
+		if err := PutYamlFile(failFile, failedRows); err != nil {
+			ctx.Log.Err("could not save entitlements that were not created: %v\n", err)
+		} else {
+			ctx.Log.Info("Entitlements that were not created are saved in %s\n", failFile)
+		}
+	}
+}
+
+// rowName names a row of a file of entitlements in summaries
+func (e backupEntitlement) rowName() string {
+	return fmt.Sprintf("%s %s to app %s", e.SubjectType, e.Subject, e.App)
+}
+
+// operation returns the bulk operation of a row, or false if it is not
+// needed because the subject is already entitled to the app. The existing
+// entitlements are only got in ensure mode.
+func (l *entitlementLoader) operation(e backupEntitlement) (op entitlementOp, needed bool, err error) {
+	st, err := getSubjectType(e.SubjectType)
+	if err != nil {
+		return op, false, err
+	}
+	itemID, ok := l.appIDs[e.App]
+	if !ok {
+		if itemID, err = appID(l.ctx, e.App); err != nil {
+			return op, false, err
+		}
+		l.appIDs[e.App] = itemID
+	}
+	subjID, err := scimGetID(l.ctx, st.ScimType, st.NameAttr, e.Subject)
+	if err != nil {
+		return op, false, err
+	}
+	op = entitlementOp{Method: "POST", Data: entitlementDef{CatalogItemID: itemID, SubjectType: st.EntitlementType,
+		SubjectID: subjID, ActivationPolicy: StringOrDefault(e.Policy, "AUTOMATIC")}}
+	if !l.opts.Ensure && !l.opts.PolicyUpdate {
+		return op, true, nil
+	}
+	defs, ok := l.existing[itemID]
+	if !ok {
+		if defs, err = getAppEntitlements(l.ctx, itemID); err != nil {
+			return op, false, err
+		}
+		l.existing[itemID] = defs
+	}
+	for _, def := range defs {
+		if def.SubjectType == op.Data.SubjectType && def.SubjectID == subjID {
+			if l.opts.PolicyUpdate && e.Policy != "" && !strings.EqualFold(def.ActivationPolicy, e.Policy) {
+				op.Method = "PUT"
+				return op, true, nil
+			}
+			return op, false, nil
+		}
+	}
+	// a later row of the same subject and app is already present
+	l.existing[itemID] = append(defs, op.Data)
+	return op, true, nil
+}
+
+// planEntitlements prints the operations of a dry run of a load and how many
+// entitlements would be created or updated. The command fails if a row
+// could not be resolved.
+func planEntitlements(ctx *HttpContext, ops []entitlementOp, rows []backupEntitlement, present, failed, skipped int) {
+	created, updated := 0, 0
+	for i, op := range ops {
+		e := rows[i]
+		if err := planEntitlement(ctx, op, e.SubjectType, e.Subject, e.App); err != nil {
+			ctx.Log.Err("Could not entitle %s \"%s\" to app \"%s\": %v\n", e.SubjectType, e.Subject, e.App, err)
+			failed++
+		} else if op.Method == "PUT" {
+			updated++
+		} else {
+			created++
+		}
+	}
+	ctx.Log.Info("Entitlements that would be created: %d, updated: %d, already present: %d, failed: %d, "+
+		"not attempted: %d\n", created, updated, present, failed, skipped)
+	if failed+skipped > 0 {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const olafID = "6c48beb6-afb1-44bc-ad7f-980214ee346c"
+
+const entitlementRows = `- {app: olaf, subjectType: user, subject: anna}
+- {app: olaf, subjectType: user, subject: sven, policy: USER_MANUAL}
+- {app: olaf, subjectType: group, subject: friends}
+- {app: olaf, subjectType: group, subject: friends}
+`
+
+// loadEntitlements loads the rows with the given handler of bulk requests,
+// for app olaf entitled to sven on a first page and to friends on a second.
+// Group friends has two members.
+func loadEntitlements(t *testing.T, opts EntitlementLoadOptions, bulkH TstHandler) (*HttpContext, map[string]int) {
+	return loadEntitlementsWith(t, opts, bulkH, func(*HttpContext) {})
+}
+
+// loadEntitlementsWith loads the rows as loadEntitlements with a context
+// that setup changes first
+func loadEntitlementsWith(t *testing.T, opts EntitlementLoadOptions, bulkH TstHandler,
+	setup func(*HttpContext)) (*HttpContext, map[string]int) {
+	calls := make(map[string]int)
+	counted := func(key string, h TstHandler) TstHandler {
+		return func(t *testing.T, req *TstReq) *TstReply {
+			calls[key]++
+			return h(t, req)
+		}
+	}
+	paths := map[string]TstHandler{
+		appSearchPath: counted("search", appSearchH(appSearchFilter, appSearchResult, 0)),
+		"GET/entitlements/definitions/catalogitems/" + olafID: counted("page1", GoodPathHandler(`{"items": [
+			{"catalogItemId": "`+olafID+`", "subjectType": "USERS", "subjectId": "2", "activationPolicy": "AUTOMATIC"}],
+			"_links": {"next": {"href": "/entitlements/definitions/catalogitems/`+olafID+`?startIndex=1"}}}`)),
+		"GET/entitlements/definitions/catalogitems/" + olafID + "?startIndex=1": counted("page2", GoodPathHandler(
+			`{"items": [{"catalogItemId": "`+olafID+`", "subjectType": "GROUPS", "subjectId": "10",
+			"activationPolicy": "AUTOMATIC"}], "_links": {}}`)),
+		"POST/entitlements/definitions": counted("bulk", bulkH),
+		"GET/scim/Groups/10?attributes=members": counted("members", GoodPathHandler(
+			`{"members": [{"value": "1"}, {"value": "2"}]}`)),
+	}
+	ctx := NewReplayContext(t, paths)
+	ctx.CacheID("Users", "userName", "anna", "1")
+	ctx.CacheID("Users", "userName", "sven", "2")
+	ctx.CacheID("Groups", "displayName", "friends", "10")
+	setup(ctx)
+	rowsFile := WriteTempFile(t, entitlementRows)
+	defer CleanupTempFile(rowsFile)
+	defer os.Remove(failureFileName(rowsFile.Name()))
+	LoadEntitlements(ctx, rowsFile.Name(), opts)
+	return ctx, calls
+}
+
+func TestLoadEntitlementsSendsAllRows(t *testing.T) {
+	ctx, calls := loadEntitlements(t, EntitlementLoadOptions{}, func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, 4, strings.Count(req.Input, `"method":"POST"`))
+		return &TstReply{Output: `{"operations": [{"status": "201"}, {"status": "409", "errors": [{"message": "exists"}]},
+			{"status": "409", "errors": [{"message": "exists"}]}, {"status": "409", "errors": [{"message": "exists"}]}]}`}
+	})
+	assert.Equal(t, map[string]int{"search": 1, "bulk": 1}, calls)
+	assert.Contains(t, ctx.Log.ErrString(), `Could not entitle user "sven" to app "olaf": 409 Conflict: exists`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements created: 1, updated: 0, already present: 0, failed: 3, not attempted: 0\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestLoadEntitlementsEnsureSkipsEntitledSubjects(t *testing.T) {
+	ctx, calls := loadEntitlements(t, EntitlementLoadOptions{Ensure: true}, func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"returnPayloadOnError":true,"operations":[{"method":"POST","data":{"catalogItemId":"`+
+			olafID+`","subjectType":"USERS","subjectId":"1","activationPolicy":"AUTOMATIC"}}]}`, req.Input)
+		return &TstReply{Output: EntitlementBulkResponse(201)}
+	})
+	assert.Equal(t, map[string]int{"search": 1, "page1": 1, "page2": 1, "bulk": 1}, calls)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), `Entitled user "anna" to app "olaf"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements created: 1, updated: 0, already present: 3, failed: 0, not attempted: 0\n")
+}
+
+func TestLoadEntitlementsSummarizesEachRow(t *testing.T) {
+	rowsFile := WriteTempFile(t, entitlementRows)
+	defer CleanupTempFile(rowsFile)
+	summaryFile := rowsFile.Name() + ".summary.json"
+	defer os.Remove(summaryFile)
+	ctx, _ := loadEntitlementsWith(t, EntitlementLoadOptions{Ensure: true}, func(t *testing.T, req *TstReq) *TstReply {
+		return &TstReply{Output: `{"operations": [{"status": "409", "errors": [{"message": "exists"}]}]}`}
+	}, func(ctx *HttpContext) {
+		summary, err := StartRunSummary(summaryFile, "entitlement load", rowsFile.Name(), Destination{})
+		require.Nil(t, err)
+		ctx.Log.Summary = summary
+	})
+	require.Nil(t, ctx.Log.Summary.Finish(ctx.Log.ExitCode()))
+	content, err := ioutil.ReadFile(summaryFile)
+	require.Nil(t, err)
+	assert.Contains(t, string(content), `{"row":2,"name":"user sven to app olaf","outcome":"skipped"}`)
+	assert.Contains(t, string(content), `{"row":1,"name":"user anna to app olaf","outcome":"failed",`+
+		`"error":"409 Conflict: exists"}`)
+	assert.Contains(t, string(content), `"counts":{"failed":1,"skipped":3,"total":4}`)
+}
+
+func TestLoadEntitlementsUpdatesPolicies(t *testing.T) {
+	ctx, _ := loadEntitlements(t, EntitlementLoadOptions{PolicyUpdate: true}, func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `{"method":"PUT","data":{"catalogItemId":"`+olafID+
+			`","subjectType":"USERS","subjectId":"2","activationPolicy":"USER_MANUAL"}}`)
+		return &TstReply{Output: EntitlementBulkResponse(201, 200)}
+	})
+	assert.Contains(t, ctx.Log.InfoString(), `Updated activation policy of user "sven" to app "olaf" to USER_MANUAL`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements created: 1, updated: 1, already present: 2, failed: 0, not attempted: 0\n")
+}
+
+func TestLoadEntitlementsDryRunOnlyPrintsOperations(t *testing.T) {
+	ctx, calls := loadEntitlements(t, EntitlementLoadOptions{DryRun: true}, nil)
+	assert.Equal(t, map[string]int{"search": 1, "members": 2}, calls)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), `Would entitle user "sven" (USERS 2) to app "olaf" (catalog item `+
+		olafID+`) with activation policy USER_MANUAL`)
+	assert.Contains(t, ctx.Log.InfoString(), `Would entitle group "friends" (GROUPS 10, 2 members) to app "olaf"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements that would be created: 4, updated: 0, already present: 0, "+
+		"failed: 0, not attempted: 0\n")
+	assert.Equal(t, 0, ctx.Log.ExitCode())
+}
+
+func TestLoadEntitlementsDryRunPlansPolicyUpdates(t *testing.T) {
+	ctx, calls := loadEntitlements(t, EntitlementLoadOptions{PolicyUpdate: true, DryRun: true}, nil)
+	assert.Zero(t, calls["bulk"])
+	assert.Contains(t, ctx.Log.InfoString(), `Would update the activation policy of user "sven" (USERS 2) to app "olaf"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements that would be created: 1, updated: 1, already present: 2")
+}
+
+func TestLoadEntitlementsStopsWhenInterrupted(t *testing.T) {
+	stopContext, stop := context.WithCancel(context.Background())
+	defer stop()
+	ctx, calls := loadEntitlementsWith(t, EntitlementLoadOptions{}, func(t *testing.T, req *TstReq) *TstReply {
+		stop()
+		return &TstReply{Output: EntitlementBulkResponse(201)}
+	}, func(ctx *HttpContext) {
+		ctx.WithStop(stopContext)
+		SetEntitlementChunkSize(ctx, 1)
+	})
+	assert.Equal(t, 1, calls["bulk"])
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements created: 1, updated: 0, already present: 0, failed: 0, "+
+		"not attempted: 3\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements that were not created are saved in ")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
@@ -16,67 +16,396 @@ limitations under the License.
 package core
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	. "github.com/vmware/priam/util"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-const fmtEntitlement = `
-{
-  "returnPayloadOnError" : true,
-  "operations" : [ {
-    "method" : "POST",
-    "data" : {
-      "catalogItemId" : "%s",
-      "subjectType" : "%s",
-      "subjectId" : "%s",
-      "activationPolicy" : "AUTOMATIC"
-    }
-  } ]
-}`
-
-// Create entitlement for the given user or group
-func maybeEntitle(ctx *HttpContext, itemID, subjName, subjType, nameAttr, appName string) {
+// entitlement definition as used by the bulk entitlement requests
+type entitlementDef struct {
+	CatalogItemID    string `json:"catalogItemId"`
+	SubjectType      string `json:"subjectType"`
+	SubjectID        string `json:"subjectId"`
+	ActivationPolicy string `json:"activationPolicy,omitempty"`
+}
+
+type entitlementOp struct {
+	Method string         `json:"method"`
+	Data   entitlementDef `json:"data"`
+}
+
+// DefaultEntitlementChunkSize is the most operations sent in one bulk
+// entitlement request unless set with SetEntitlementChunkSize, tenants
+// refuse requests with many more.
+const DefaultEntitlementChunkSize = 100
+
+const entitlementChunkSizeKey = "entitlementChunkSize"
+
+// SetEntitlementChunkSize sets the most operations sent in one bulk
+// entitlement request, the default if size is not positive.
+func SetEntitlementChunkSize(ctx *HttpContext, size int) {
+	ctx.SetValue(entitlementChunkSizeKey, size)
+}
+
+func entitlementChunkSize(ctx *HttpContext) int {
+	if size, _ := ctx.Value(entitlementChunkSizeKey, nil); size != nil && size.(int) > 0 {
+		return size.(int)
+	}
+	return DefaultEntitlementChunkSize
+}
+
+type entitlementBulk struct {
+	ReturnPayloadOnError bool            `json:"returnPayloadOnError"`
+	Operations           []entitlementOp `json:"operations"`
+}
+
+// outcome of an operation in the bulk sync response, in the order of the
+// operations of the request
+type entitlementOpResult struct {
+	Method string      `json:"method"`
+	Status interface{} `json:"status"` // a number or a string of digits
+	Errors []struct{ Message, Description string }
+}
+
+type entitlementBulkResponse struct {
+	Operations []entitlementOpResult `json:"operations"`
+}
+
+// err returns the error of an operation that failed, with the messages of
+// the server, or nil if it succeeded.
+func (r *entitlementOpResult) err() error {
+	status, _ := strconv.Atoi(strings.TrimSpace(fmt.Sprint(r.Status)))
+	var msgs []string
+	for _, e := range r.Errors {
+		if msg := strings.TrimSpace(StringOrDefault(e.Message, e.Description)); msg != "" && !HasString(msg, msgs) {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 && (status == 0 || status/100 == 2) {
+		return nil
+	}
+	text := "failed"
+	if status != 0 {
+		text = strings.TrimSpace(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+	}
+	if len(msgs) > 0 {
+		text += ": " + strings.Join(msgs, "; ")
+	}
+	return errors.New(text)
+}
+
+// exists returns true if the operation failed because the entitlement it
+// creates already exists.
+func (r *entitlementOpResult) exists() bool {
+	if status, _ := strconv.Atoi(strings.TrimSpace(fmt.Sprint(r.Status))); status == http.StatusConflict {
+		return true
+	}
+	for _, e := range r.Errors {
+		if strings.Contains(strings.ToLower(e.Message+" "+e.Description), "already exist") {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectType describes how an entitlement subject is looked up in SCIM and
+// how it is named in entitlement definitions.
+type subjectType struct {
+	ScimType, NameAttr, EntitlementType string
+}
+
+// supported entitlement subject types, keyed by the name used on the command
+// line. New subject types can be supported by adding them to this map.
+var subjectTypes = map[string]subjectType{
+	"user":  {ScimType: "Users", NameAttr: "userName", EntitlementType: "USERS"},
+	"group": {ScimType: "Groups", NameAttr: "displayName", EntitlementType: "GROUPS"},
+	"role":  {ScimType: "Roles", NameAttr: "displayName", EntitlementType: "ROLES"},
+}
+
+// SubjectTypeNames returns the sorted names of the supported subject types
+func SubjectTypeNames() []string {
+	names := make([]string, 0, len(subjectTypes))
+	for k := range subjectTypes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getSubjectType(name string) (subjectType, error) {
+	if st, ok := subjectTypes[name]; ok {
+		return st, nil
+	}
+	return subjectType{}, fmt.Errorf("unsupported subject type \"%s\", supported types are: %s",
+		name, strings.Join(SubjectTypeNames(), ", "))
+}
+
+// Create entitlement for the given user, group or role. The subject type is
+// checked before anything is looked up. If itemID is empty the catalog item
+// is looked up by appName. With dryRun, the entitlement is only planned.
+func maybeEntitle(ctx *HttpContext, itemID, subjName, subjType, appName string, dryRun bool) {
 	if subjName != "" {
-		subjID, err := scimGetID(ctx, strings.Title(subjType+"s"), nameAttr, subjName)
+		var subjID string
+		st, err := getSubjectType(subjType)
+		if err == nil && itemID == "" {
+			itemID, err = appID(ctx, appName)
+		}
 		if err == nil {
-			err = entitleSubject(ctx, subjID, strings.ToUpper(subjType+"s"), itemID)
+			subjID, err = scimGetID(ctx, st.ScimType, st.NameAttr, subjName)
+		}
+		if err == nil && dryRun {
+			err = planEntitlement(ctx, entitlementOp{Method: "POST", Data: entitlementDef{CatalogItemID: itemID,
+				SubjectType: st.EntitlementType, SubjectID: subjID, ActivationPolicy: "AUTOMATIC"}},
+				subjType, subjName, appName)
+		} else if err == nil {
+			err = entitleSubject(ctx, subjID, st.EntitlementType, itemID)
 		}
 		if err != nil {
 			ctx.Log.Err("Could not entitle %s \"%s\" to app \"%s\", error: %v\n", subjType, subjName, appName, err)
-		} else {
+		} else if !dryRun {
 			ctx.Log.Info("Entitled %s \"%s\" to app \"%s\".\n", subjType, subjName, appName)
 		}
 	}
 }
 
+// planEntitlement prints the operation that a dry run would send for an
+// entitlement, with the number of members of a group so that it is clear
+// how many users would be given access to the app.
+func planEntitlement(ctx *HttpContext, op entitlementOp, subjType, subjName, appName string) error {
+	def, members := op.Data, ""
+	if def.SubjectType == subjectTypes["group"].EntitlementType {
+		group := &typedGroup{}
+		path := fmt.Sprintf("scim/Groups/%s?attributes=members", def.SubjectID)
+		if err := ctx.Accept("json").Request("GET", path, nil, group); err != nil {
+			return fmt.Errorf("could not get members of the group: %v", err)
+		}
+		members = fmt.Sprintf(", %d members", len(group.Members))
+	}
+	action := "entitle"
+	if op.Method == "PUT" {
+		action = "update the activation policy of"
+	}
+	ctx.Log.Plan("Would %s %s \"%s\" (%s %s%s) to app \"%s\" (catalog item %s) with activation policy %s\n",
+		action, subjType, subjName, def.SubjectType, def.SubjectID, members, appName, def.CatalogItemID,
+		def.ActivationPolicy)
+	return nil
+}
+
 func entitleSubject(ctx *HttpContext, subjectId, subjectType, itemID string) error {
-	inp := fmt.Sprintf(fmtEntitlement, itemID, subjectType, subjectId)
-	ctx.Accept("bulk.sync.response").ContentType("entitlements.definition.bulk")
-	return ctx.Request("POST", "entitlements/definitions", inp, nil)
+	return entitlementRequest(ctx, entitlementOp{Method: "POST", Data: entitlementDef{CatalogItemID: itemID,
+		SubjectType: subjectType, SubjectID: subjectId, ActivationPolicy: "AUTOMATIC"}})
+}
+
+// errNotAttempted is the error of the operations that were not sent because
+// the command was interrupted
+var errNotAttempted = errors.New("not attempted, the command was interrupted")
+
+// entitlementRequest sends a single operation in a bulk request and returns
+// its error.
+func entitlementRequest(ctx *HttpContext, op entitlementOp) error {
+	return entitlementBulkRequest(ctx, op)[0]
+}
+
+// entitlementBulkRequest sends the operations in bulk requests of at most
+// the chunk size of the context, one after the other, and returns the error
+// of each operation, nil for those that succeeded. The errors are the same
+// whatever the chunk size. Once the command is interrupted, the chunks that
+// are left are not sent and their operations fail with errNotAttempted.
+func entitlementBulkRequest(ctx *HttpContext, ops ...entitlementOp) []error {
+	errs, size := make([]error, 0, len(ops)), entitlementChunkSize(ctx)
+	for start := 0; start < len(ops); start += size {
+		end := start + size
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if ctx.Canceled() {
+			for range ops[start:end] {
+				errs = append(errs, errNotAttempted)
+			}
+			continue
+		}
+		errs = append(errs, entitlementChunkRequest(ctx, ops[start:end])...)
+	}
+	return errs
 }
 
-// Get entitlement for the given user whose username is 'name'
-// rtypeName has been validated before and is one of 'user', 'group' or 'app'
-func GetEntitlement(ctx *HttpContext, rtypeName, name string) {
+// entitlementChunkRequest sends the operations in one bulk request and
+// returns the error of each operation from the bulk sync response. If the
+// response has no operations, such as when the request is refused, its
+// error is that of each operation. The request is sent again after a
+// timeout or a transport error, when the first attempt may have been
+// applied, so creations of the request sent again that fail because the
+// entitlement exists succeeded.
+func entitlementChunkRequest(ctx *HttpContext, ops []entitlementOp) []error {
+	inp, outp, resent := entitlementBulk{ReturnPayloadOnError: true, Operations: ops}, entitlementBulkResponse{}, false
+	ctx.Accept("bulk.sync.response").ContentType("entitlements.definition.bulk").RetryChecked(func() (bool, error) {
+		resent = true
+		return false, nil
+	})
+	err := ctx.Request("POST", "entitlements/definitions", &inp, &outp)
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if len(outp.Operations) == 0 {
+			errs[i] = err
+		} else if i < len(outp.Operations) {
+			if errs[i] = outp.Operations[i].err(); errs[i] != nil && resent && op.Method == "POST" &&
+				outp.Operations[i].exists() {
+				ctx.Log.Debug("Entitlement of %s to catalog item %s was created before the request was sent "+
+					"again\n", subjectOf(op.Data), op.Data.CatalogItemID)
+				errs[i] = nil
+			}
+		} else {
+			errs[i] = fmt.Errorf("the bulk response has no outcome of this operation")
+		}
+	}
+	return errs
+}
+
+// subjectOf names the subject of an entitlement definition in messages,
+// such as user 1234.
+func subjectOf(def entitlementDef) string {
+	for name, st := range subjectTypes {
+		if st.EntitlementType == def.SubjectType {
+			return name + " " + def.SubjectID
+		}
+	}
+	return def.SubjectType + " " + def.SubjectID
+}
+
+// getAppEntitlements returns the entitlement definitions of a catalog item
+func getAppEntitlements(ctx *HttpContext, itemID string) ([]entitlementDef, error) {
+	return subjectEntitlements(ctx, "catalogitems", itemID)
+}
+
+// removeAppEntitlements deletes all entitlement definitions of a catalog item,
+// says which were deleted or not, and returns how many were deleted and how
+// many failed.
+func removeAppEntitlements(ctx *HttpContext, appName, itemID string) (removed, failed int, err error) {
+	defs, err := getAppEntitlements(ctx, itemID)
+	if err != nil || len(defs) == 0 {
+		return 0, 0, err
+	}
+	ops := make([]entitlementOp, len(defs))
+	for i, def := range defs {
+		ops[i] = entitlementOp{Method: "DELETE", Data: entitlementDef{CatalogItemID: itemID,
+			SubjectType: def.SubjectType, SubjectID: def.SubjectID}}
+	}
+	for i, opErr := range entitlementBulkRequest(ctx, ops...) {
+		if opErr != nil {
+			ctx.Log.Err("Could not remove entitlement of %s to app %s: %v\n", subjectOf(defs[i]), appName, opErr)
+			failed++
+		} else {
+			ctx.Log.Info("Removed entitlement of %s to app %s\n", subjectOf(defs[i]), appName)
+			removed++
+		}
+	}
+	return removed, failed, nil
+}
+
+// EntitleOptions are the options of Entitle
+type EntitleOptions struct {
+	AppByID bool // the app is given by its catalog item id
+	DryRun  bool // only print the entitlement that would be created
+}
+
+// Entitle the user, group or role named subjName to an app. The app is looked
+// up by name unless AppByID is set or the app name looks like a catalog item
+// id.
+func Entitle(ctx *HttpContext, subjType, subjName, app string, opts EntitleOptions) {
+	itemID := ""
+	if opts.AppByID {
+		itemID = app
+	}
+	maybeEntitle(ctx, itemID, subjName, subjType, app, opts.DryRun)
+}
+
+// Get entitlement for the given user, group, role or app named 'name'. If byID
+// is set, 'name' is taken to be the SCIM id or catalog item id. rtypeName has
+// been validated before and is one of 'user', 'group', 'role' or 'app'
+func GetEntitlement(ctx *HttpContext, rtypeName, name string, byID bool) {
 	var resType, id string
-	body := make(map[string]interface{})
 	switch rtypeName {
 	case "user":
-		resType, id = "users", scimNameToID(ctx, "Users", "userName", name)
+		resType, id = "users", name
+		if !byID {
+			id = scimNameToID(ctx, "Users", "userName", name)
+		}
 	case "group":
-		resType, id = "groups", scimNameToID(ctx, "Groups", "displayName", name)
+		resType, id = "groups", name
+		if !byID {
+			id = scimNameToID(ctx, "Groups", "displayName", name)
+		}
+	case "role":
+		resType, id = "roles", name
+		if !byID {
+			id = scimNameToID(ctx, "Roles", "displayName", name)
+		}
 	case "app":
 		resType, id = "catalogitems", name
+		if !byID {
+			id = appNameToID(ctx, name)
+		}
 	}
 	if id == "" {
 		return
 	}
-	path := fmt.Sprintf("entitlements/definitions/%s/%s", resType, id)
-	if err := ctx.Request("GET", path, nil, &body); err != nil {
+	items := []interface{}{}
+	err := entitlementPages(ctx, resType, id, func(page json.RawMessage) error {
+		var pageItems []interface{}
+		err := json.Unmarshal(page, &pageItems)
+		items = append(items, pageItems...)
+		return err
+	})
+	if err != nil {
 		ctx.Log.Err("Error: %v\n", err)
 	} else {
-		ctx.Log.PP("Entitlements", body["items"],
-			"catalogItemId", "subjectType", "subjectId", "activationPolicy")
+		ctx.Log.PP("Entitlements", items, "catalogItemId", "subjectType", "subjectId", "activationPolicy")
+		ctx.Log.Info("Entitlements: %d\n", len(items))
+	}
+}
+
+// subjectEntitlements returns the entitlement definitions of a user, group,
+// role or catalog item by its id, resType is "users", "groups", "roles" or
+// "catalogitems", from all pages of the definitions.
+func subjectEntitlements(ctx *HttpContext, resType, id string) (defs []entitlementDef, err error) {
+	err = entitlementPages(ctx, resType, id, func(page json.RawMessage) error {
+		var pageDefs []entitlementDef
+		err := json.Unmarshal(page, &pageDefs)
+		defs = append(defs, pageDefs...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// entitlementPages gets the entitlement definitions of a subject and calls
+// page with the items of each page, in order.
+// The definitions are paginated with a next link, which is followed until a
+// page has none or links to a page that was already got.
+func entitlementPages(ctx *HttpContext, resType, id string, page func(items json.RawMessage) error) error {
+	path, seen := fmt.Sprintf("entitlements/definitions/%s/%s", resType, id), make(map[string]bool)
+	for path != "" && !seen[path] {
+		seen[path] = true
+		body := struct {
+			Items json.RawMessage
+			Links map[string]struct{ Href string } `json:"_links"`
+		}{}
+		if err := ctx.Request("GET", path, nil, &body); err != nil {
+			return err
+		}
+		if len(body.Items) > 0 && string(body.Items) != "null" {
+			if err := page(body.Items); err != nil {
+				return fmt.Errorf("unexpected entitlements in the response: %v", err)
+			}
+		}
+		path = strings.TrimPrefix(body.Links["next"].Href, ctx.HostURL)
 	}
+	return nil
 }
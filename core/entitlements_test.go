@@ -16,10 +16,16 @@ limitations under the License.
 package core
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetEntitlementForUser(t *testing.T) {
@@ -30,8 +36,55 @@ func TestGetEntitlementForGroup(t *testing.T) {
 	checkGetEntitlementReturns(t, "group", "Groups", "testid67")
 }
 
+func TestGetEntitlementForRole(t *testing.T) {
+	checkGetEntitlementReturns(t, "role", "Roles", "testid67")
+}
+
 func TestGetEntitlementForApp(t *testing.T) {
-	checkGetEntitlementReturns(t, "app", "catalogitems", "foo")
+	checkGetEntitlementReturns(t, "app", "catalogitems", "testid67")
+}
+
+func TestGetEntitlementForAppByUuid(t *testing.T) {
+	const appID = "6c48beb6-afb1-44bc-ad7f-980214ee346c"
+	paths := map[string]TstHandler{
+		"GET/entitlements/definitions/catalogitems/" + appID: GoodPathHandler(`{"items": [{ "activationPolicy" : "bar"}]}`)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	GetEntitlement(ctx, "app", appID, false)
+	AssertOnlyInfoContains(t, ctx, "activationPolicy: bar")
+}
+
+func TestGetEntitlementGetsAllPages(t *testing.T) {
+	const appID = "6c48beb6-afb1-44bc-ad7f-980214ee346c"
+	paths := map[string]TstHandler{
+		"GET/entitlements/definitions/catalogitems/" + appID: GoodPathHandler(`{"items": [
+			{"subjectType": "USERS", "subjectId": "1"}, {"subjectType": "USERS", "subjectId": "2"}],
+			"_links": {"next": {"href": "/entitlements/definitions/catalogitems/` + appID + `?startIndex=2"}}}`),
+		"GET/entitlements/definitions/catalogitems/" + appID + "?startIndex=2": GoodPathHandler(`{"items": [
+			{"subjectType": "GROUPS", "subjectId": "3"}], "_links": {}}`)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.Format = FCsv
+	GetEntitlement(ctx, "app", appID, true)
+	assert.Equal(t, "subjectType,subjectId\nUSERS,1\nUSERS,2\nGROUPS,3\n", ctx.Log.InfoString())
+	assert.Contains(t, ctx.Log.ErrString(), "Entitlements: 3")
+}
+
+func TestGetEntitlementByID(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET/entitlements/definitions/users/foo": GoodPathHandler(`{"items": [{ "activationPolicy" : "bar"}]}`)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	GetEntitlement(ctx, "user", "foo", true)
+	AssertOnlyInfoContains(t, ctx, "activationPolicy: bar")
+}
+
+func TestGetEntitlementForUnknownApp(t *testing.T) {
+	paths := map[string]TstHandler{appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	GetEntitlement(ctx, "app", "sven", false)
+	AssertErrorContains(t, ctx, `Error getting catalog item ID of sven: No app found with name "sven"`)
 }
 
 func TestGetEntitlementForUnknownScimUser(t *testing.T) {
@@ -39,10 +92,10 @@ func TestGetEntitlementForUnknownScimUser(t *testing.T) {
 		return &TstReply{Status: 404, ContentType: "application/json"}
 	}
 	paths := map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22foo%22": errorReply}
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22foo%22": errorReply}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	GetEntitlement(ctx, "user", "foo")
+	GetEntitlement(ctx, "user", "foo", false)
 	AssertErrorContains(t, ctx, "Error getting SCIM Users ID of foo: 404 Not Found")
 }
 
@@ -55,11 +108,11 @@ func TestGetEntitlementForUnknownUserEntitlement(t *testing.T) {
 		return &TstReply{Output: output, ContentType: "application/json"}
 	}
 	paths := map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22foo%22": idH,
-		"GET/entitlements/definitions/users/test-fail":            entErrorReply}
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22foo%22": idH,
+		"GET/entitlements/definitions/users/test-fail":                                   entErrorReply}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	GetEntitlement(ctx, "user", "foo")
+	GetEntitlement(ctx, "user", "foo", false)
 	AssertErrorContains(t, ctx, "Error: 404 Not Found")
 	AssertErrorContains(t, ctx, "test: foo does not exist")
 }
@@ -73,14 +126,171 @@ func TestCreateEntitlementForUser(t *testing.T) {
 		return &TstReply{Output: output, ContentType: "application/json"}
 	}
 	paths := map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22patrick%22": idH,
-		"POST/entitlements/definitions":                               entReply}
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22patrick%22": idH,
+		"POST/entitlements/definitions": entReply}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	maybeEntitle(ctx, "baby", "patrick", "user", "userName", "dance")
+	maybeEntitle(ctx, "baby", "patrick", "user", "dance", false)
 	AssertOnlyInfoContains(t, ctx, `Entitled user "patrick" to app "dance"`)
 }
 
+func TestEntitleUserToAppByName(t *testing.T) {
+	entH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"returnPayloadOnError":true,"operations":[{"method":"POST","data":{"catalogItemId":`+
+			`"6c48beb6-afb1-44bc-ad7f-980214ee346c","subjectType":"USERS","subjectId":"12345","activationPolicy":"AUTOMATIC"}}]}`,
+			req.Input)
+		return &TstReply{Output: `{}`, ContentType: "application/json"}
+	}
+	paths := map[string]TstHandler{
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0),
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22patrick%22": GoodPathHandler(`{"resources": [{ "userName" : "patrick", "id": "12345"}]}`),
+		"POST/entitlements/definitions": entH}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	Entitle(ctx, "user", "patrick", "olaf", EntitleOptions{})
+	AssertOnlyInfoContains(t, ctx, `Entitled user "patrick" to app "olaf"`)
+}
+
+func TestEntitleRoleToAppByName(t *testing.T) {
+	entH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"subjectType":"ROLES","subjectId":"777"`)
+		return &TstReply{Output: `{}`, ContentType: "application/json"}
+	}
+	paths := map[string]TstHandler{
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0),
+		"GET/scim/Roles?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22auditors%22": GoodPathHandler(
+			`{"resources": [{"displayName": "auditors", "id": "777"}]}`),
+		"POST/entitlements/definitions": entH}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	Entitle(ctx, "role", "auditors", "olaf", EntitleOptions{})
+	AssertOnlyInfoContains(t, ctx, `Entitled role "auditors" to app "olaf"`)
+}
+
+func TestEntitleGroupDryRunPrintsMembersWithoutEntitling(t *testing.T) {
+	paths := map[string]TstHandler{
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0),
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22friends%22": GoodPathHandler(
+			`{"resources": [{"displayName": "friends", "id": "10"}]}`),
+		"GET/scim/Groups/10?attributes=members": GoodPathHandler(`{"members": [{"value": "1"}, {"value": "2"}, {"value": "3"}]}`)}
+	ctx := NewReplayContext(t, paths)
+	Entitle(ctx, "group", "friends", "olaf", EntitleOptions{DryRun: true})
+	AssertOnlyInfoContains(t, ctx, `Would entitle group "friends" (GROUPS 10, 3 members) to app "olaf" (catalog item `+
+		`6c48beb6-afb1-44bc-ad7f-980214ee346c) with activation policy AUTOMATIC`)
+	assert.NotContains(t, ctx.Log.InfoString(), "Entitled")
+}
+
+func TestEntitleDryRunFailsWhenSubjectIsNotFound(t *testing.T) {
+	paths := map[string]TstHandler{
+		appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0),
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22patrick%22": GoodPathHandler(
+			`{"totalResults": 0, "Resources": []}`)}
+	ctx := NewReplayContext(t, paths)
+	Entitle(ctx, "user", "patrick", "olaf", EntitleOptions{DryRun: true})
+	AssertErrorContains(t, ctx, `Could not entitle user "patrick" to app "olaf"`)
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
+
+func TestEntitleUserToAppByID(t *testing.T) {
+	paths := map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22patrick%22": GoodPathHandler(`{"resources": [{ "userName" : "patrick", "id": "12345"}]}`),
+		"POST/entitlements/definitions": GoodPathHandler(`{}`)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	Entitle(ctx, "user", "patrick", "baby", EntitleOptions{AppByID: true})
+	AssertOnlyInfoContains(t, ctx, `Entitled user "patrick" to app "baby"`)
+}
+
+func TestEntitleToUnknownAppFails(t *testing.T) {
+	paths := map[string]TstHandler{appSearchPath: appSearchH(appSearchFilter, appSearchResult, 0)}
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	Entitle(ctx, "group", "ALL USERS", "sven", EntitleOptions{})
+	AssertErrorContains(t, ctx, `Could not entitle group "ALL USERS" to app "sven", error: No app found with name "sven"`)
+}
+
+func TestEntitleSubjectBodyShape(t *testing.T) {
+	entH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "bulk.sync.response+json", req.Accept)
+		assert.Equal(t, "entitlements.definition.bulk+json", req.ContentType)
+		assert.Equal(t, `{"returnPayloadOnError":true,"operations":[{"method":"POST","data":{"catalogItemId":"baby",`+
+			`"subjectType":"GROUPS","subjectId":"`+ScimID("dancers")+`","activationPolicy":"AUTOMATIC"}}]}`, req.Input)
+		return &TstReply{Output: EntitlementBulkResponse(201)}
+	}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/entitlements/definitions": entH})
+	assert.Nil(t, entitleSubject(ctx, ScimID("dancers"), "GROUPS", "baby"))
+}
+
+func TestEntitleSubjectReportsScimError(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"POST/entitlements/definitions": ScimErrorHandler(400, "catalog item baby does not exist")})
+	err := entitleSubject(ctx, ScimID("patrick"), "USERS", "baby")
+	if assert.Error(t, err) {
+		assert.Regexp(t, `^400 Bad Request: catalog item baby does not exist \(request id [-0-9a-f]{36}\)$`, err.Error())
+	}
+}
+
+func TestEntitleSubjectReportsFailedOperation(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/entitlements/definitions": GoodPathHandler(
+		`{"operations": [{"method": "POST", "status": "409", "errors": [{"message": "Entitlement exists"}]}]}`)})
+	assert.EqualError(t, entitleSubject(ctx, ScimID("patrick"), "USERS", "baby"), "409 Conflict: Entitlement exists")
+}
+
+func TestEntitlementBulkRequestReportsEachOperation(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/entitlements/definitions": func(t *testing.T,
+		req *TstReq) *TstReply {
+		return &TstReply{Status: 400, Output: `{"operations": [{"status": 200}, {"status": "404",
+			"errors": [{"code": "not.found", "description": "Subject not found"}]}, {"status": "204"}]}`}
+	}})
+	ops := []entitlementOp{{Method: "DELETE"}, {Method: "DELETE"}, {Method: "DELETE"}, {Method: "DELETE"}}
+	errs := entitlementBulkRequest(ctx, ops...)
+	if assert.Len(t, errs, 4) {
+		assert.Nil(t, errs[0])
+		assert.EqualError(t, errs[1], "404 Not Found: Subject not found")
+		assert.Nil(t, errs[2])
+		assert.EqualError(t, errs[3], "the bulk response has no outcome of this operation")
+	}
+}
+
+func TestEntitlementBulkRequestSendsChunks(t *testing.T) {
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var bulk entitlementBulk
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&bulk))
+		// the second request gets no response and is sent again
+		if sizes = append(sizes, len(bulk.Operations)); len(sizes) == 2 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		var results []string
+		for _, op := range bulk.Operations {
+			if op.Data.SubjectID == "3" {
+				results = append(results, `{"status": "404", "errors": [{"message": "no subject 3"}]}`)
+			} else {
+				results = append(results, `{"status": "200"}`)
+			}
+		}
+		fmt.Fprintf(w, `{"operations": [%s]}`, strings.Join(results, ", "))
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	var ops []entitlementOp
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		ops = append(ops, entitlementOp{Method: "DELETE", Data: entitlementDef{SubjectType: "USERS", SubjectID: id}})
+	}
+	SetEntitlementChunkSize(ctx, 2)
+	errs := entitlementBulkRequest(ctx, ops...)
+	assert.Equal(t, []int{2, 2, 2, 1}, sizes)
+	if assert.Len(t, errs, 5) {
+		assert.EqualError(t, errs[2], "404 Not Found: no subject 3")
+		assert.Equal(t, []error{nil, nil, errs[2], nil, nil}, errs)
+	}
+	SetEntitlementChunkSize(ctx, 0)
+	assert.Equal(t, errs, entitlementBulkRequest(ctx, ops...))
+	assert.Equal(t, []int{2, 2, 2, 1, 5}, sizes)
+}
+
 // Test user.
 // @todo test group as well.
 func TestCreateEntitlementFailedForUnknownUser(t *testing.T) {
@@ -88,13 +298,45 @@ func TestCreateEntitlementFailedForUnknownUser(t *testing.T) {
 		return &TstReply{Status: 404, ContentType: "application/json"}
 	}
 	paths := map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22patrick%22": errorReply}
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22patrick%22": errorReply}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	maybeEntitle(ctx, "baby", "patrick", "user", "userName", "dance")
+	maybeEntitle(ctx, "baby", "patrick", "user", "dance", false)
 	AssertErrorContains(t, ctx, `Could not entitle user "patrick" to app "dance", error: 404 Not Found`)
 }
 
+func TestSubjectTypeForUser(t *testing.T) {
+	st, err := getSubjectType("user")
+	assert.Nil(t, err)
+	assert.Equal(t, subjectType{ScimType: "Users", NameAttr: "userName", EntitlementType: "USERS"}, st)
+}
+
+func TestSubjectTypeForGroup(t *testing.T) {
+	st, err := getSubjectType("group")
+	assert.Nil(t, err)
+	assert.Equal(t, subjectType{ScimType: "Groups", NameAttr: "displayName", EntitlementType: "GROUPS"}, st)
+}
+
+func TestSubjectTypeForRole(t *testing.T) {
+	st, err := getSubjectType("role")
+	assert.Nil(t, err)
+	assert.Equal(t, subjectType{ScimType: "Roles", NameAttr: "displayName", EntitlementType: "ROLES"}, st)
+}
+
+func TestSubjectTypeInvalid(t *testing.T) {
+	_, err := getSubjectType("actor")
+	if assert.Error(t, err) {
+		assert.Equal(t, `unsupported subject type "actor", supported types are: group, role, user`, err.Error())
+	}
+}
+
+func TestCreateEntitlementForInvalidSubjectTypeMakesNoRequests(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	maybeEntitle(ctx, "baby", "patrick", "actor", "dance", false)
+	AssertErrorContains(t, ctx, `Could not entitle actor "patrick" to app "dance", error: unsupported subject type "actor"`)
+}
+
 // common method to test getting basic entitlements
 func checkGetEntitlementReturns(t *testing.T, entity, rType, rID string) {
 	entH := func(t *testing.T, req *TstReq) *TstReply {
@@ -106,11 +348,34 @@ func checkGetEntitlementReturns(t *testing.T, entity, rType, rID string) {
 		return &TstReply{Output: output, ContentType: "application/json"}
 	}
 	paths := map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22foo%22":                 idH,
-		"GET/scim/Groups?count=10000&filter=displayName+eq+%22foo%22":             idH,
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22foo%22":        idH,
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22foo%22": idH,
+		"GET/scim/Roles?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22foo%22":  idH,
+		appSearchPath: appSearchH(`{"nameFilter":"foo"}`,
+			fmt.Sprintf(`{"items": [{ "name" : "foo", "uuid": "%s"}]}`, rID), 0),
 		"GET/" + "entitlements/definitions/" + strings.ToLower(rType) + "/" + rID: entH}
 	srv, ctx := NewTestContext(t, paths)
 	defer srv.Close()
-	GetEntitlement(ctx, entity, "foo")
+	GetEntitlement(ctx, entity, "foo", false)
 	AssertOnlyInfoContains(t, ctx, "activationPolicy: bar")
 }
+
+func TestEntitlementsCreatedByRequestThatTimedOutSucceed(t *testing.T) {
+	posts := 0
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/entitlements/definitions": func(t *testing.T,
+		req *TstReq) *TstReply {
+		// the first attempt creates both entitlements, but its response comes too late
+		if posts++; posts == 1 {
+			time.Sleep(300 * time.Millisecond)
+			return &TstReply{Output: `{"operations": [{"status": "201"}, {"status": "201"}]}`}
+		}
+		return &TstReply{Output: `{"operations": [{"status": "409", "errors": [{"message": "Entitlement exists"}]},
+			{"status": "400", "errors": [{"message": "Entitlement already exists"}]}]}`}
+	}})
+	defer srv.Close()
+	ctx.Timeout = 100 * time.Millisecond
+	ops := []entitlementOp{{Method: "POST", Data: entitlementDef{SubjectType: "USERS", SubjectID: "1"}},
+		{Method: "POST", Data: entitlementDef{SubjectType: "GROUPS", SubjectID: "2"}}}
+	assert.Equal(t, []error{nil, nil}, entitlementBulkRequest(ctx, ops...))
+	assert.Equal(t, 2, posts)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+// Exists checks that the user or group with a name exists for scripts. Only
+// its id is printed if printID is set. A resource that is not found only
+// makes the command fail with ExitNotFound, other errors are reported.
+// Several resources with the name exist, unless their id is printed, which
+// needs one to be chosen.
+func Exists(ctx *HttpContext, resType, nameAttr, name string, printID bool) {
+	item, err := scimGetByName(ctx, resType, nameAttr, name, "id", nameAttr)
+	reportExists(ctx, resType, name, item, err, printID)
+}
+
+// UserWithEmailExists checks that a user with an email exists as Exists,
+// with emails compared as names are, without case unless names are case
+// sensitive.
+func UserWithEmailExists(ctx *HttpContext, email string, printID bool) {
+	users, err := findUsers(ctx, Eq("emails", email))
+	var item scimResource
+	if err == nil {
+		var matches []scimResource
+		for _, u := range users {
+			for _, e := range u.Emails {
+				if strings.EqualFold(e.Value, email) && (!ctx.CaseSensitiveNames() || e.Value == email) {
+					matches = append(matches, u)
+					break
+				}
+			}
+		}
+		switch len(matches) {
+		case 0:
+			err = NotFound("no Users found with email \"%s\"", email)
+		case 1:
+			item = matches[0]
+		default:
+			item, err = chooseResource(ctx, "Users", "emails", email, matches, nil)
+		}
+	}
+	reportExists(ctx, "Users", email, item, err, printID)
+}
+
+// reportExists prints the id of a resource that was found if printID is set,
+// or fails the command
+func reportExists(ctx *HttpContext, resType, name string, item scimResource, err error, printID bool) {
+	var ambiguous *ambiguousNameError
+	switch {
+	case err == nil:
+		if printID {
+			fmt.Fprintln(ctx.Log.OutW, item.id())
+		}
+	case IsNotFound(err):
+		ctx.Log.Debug("%v\n", err)
+		ctx.Log.Fail(ExitNotFound)
+	case errors.As(err, &ambiguous) && !printID:
+	default:
+		ctx.Log.Err("Could not check if %s \"%s\" exists: %v\n", resType, name, err)
+		reportAmbiguous(ctx, err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const existsUserURL = "GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22bob%22"
+
+func TestExistsPrintsNothingIfFound(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{existsUserURL: GoodPathHandler(
+		`{"Resources": [{"id": "12", "userName": "bob"}]}`)})
+	Exists(ctx, "Users", "userName", "bob", false)
+	assert.Empty(t, ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestExistsPrintsIDOfGroup(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22eng-team%22": GoodPathHandler(
+			`{"Resources": [{"id": "g1", "displayName": "Eng-Team"}]}`)})
+	Exists(ctx, "Groups", "displayName", "eng-team", true)
+	assert.Equal(t, "g1\n", ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestExistsFailsQuietlyIfNotFound(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{existsUserURL: GoodPathHandler(
+		`{"Resources": [{"id": "12", "userName": "Bob"}]}`)})
+	ctx.SetCaseSensitiveNames(true)
+	Exists(ctx, "Users", "userName", "bob", true)
+	assert.Empty(t, ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
+
+func TestExistsReportsErrors(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{existsUserURL: ErrorHandler(401, "unauthorized")})
+	Exists(ctx, "Users", "userName", "bob", false)
+	assert.Contains(t, ctx.Log.ErrString(), "Could not check if Users \"bob\" exists: 401")
+	assert.Equal(t, ExitError, ctx.Log.ExitCode())
+}
+
+func TestExistsOfSeveralUsersNeedsOneChosenToPrintID(t *testing.T) {
+	paths := map[string]TstHandler{existsUserURL: GoodPathHandler(
+		`{"Resources": [{"id": "12", "userName": "bob"}, {"id": "13", "userName": "BOB"}]}`),
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta&count=500&filter=userName+eq+%22bob%22": GoodPathHandler(
+			`{"Resources": [{"id": "12", "userName": "bob"}, {"id": "13", "userName": "BOB"}]}`)}
+	ctx := NewReplayContext(t, paths)
+	Exists(ctx, "Users", "userName", "bob", false)
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+	Exists(ctx, "Users", "userName", "bob", true)
+	assert.Contains(t, ctx.Log.ErrString(), "multiple Users found named \"bob\", choose one with --choose-id")
+	assert.Equal(t, ExitError, ctx.Log.ExitCode())
+}
+
+func TestUserWithEmailExists(t *testing.T) {
+	byEmail := findUsersURL(`emails eq "bob@example.com"`)
+	ctx := NewReplayContext(t, map[string]TstHandler{byEmail: GoodPathHandler(`{"totalResults": 1, "Resources": [
+		{"id": "12", "userName": "bob", "emails": [{"value": "robert@example.com"}, {"value": "Bob@Example.com"}]}]}`)})
+	UserWithEmailExists(ctx, "bob@example.com", true)
+	assert.Equal(t, "12\n", ctx.Log.InfoString())
+	ctx.Log.ClearBuffers()
+	ctx.SetCaseSensitiveNames(true)
+	UserWithEmailExists(ctx, "bob@example.com", true)
+	assert.Empty(t, ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
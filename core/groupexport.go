@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// GroupExportOptions are the options of ExportGroupMembers
+type GroupExportOptions struct {
+	Parallel int  // maximum number of groups whose members are got at the same time
+	Count    bool // add a memberCount column, which is 0 for the groups without members
+}
+
+// groupMembersHeader is the header of the CSV file of group members
+var groupMembersHeader = []string{"groupName", "memberType", "memberName", "memberId"}
+
+// groupMembersRows returns a row for each member of a group, or one row with
+// empty member columns if the group has no members. Users are named by their
+// user name, other members by their display name.
+func groupMembersRows(groupName string, members []groupMember, userNames map[string]string, count bool) [][]string {
+	rows := [][]string{}
+	for _, m := range members {
+		memberType, memberName := m.Type, m.Display
+		if name, ok := userNames[m.Value]; ok {
+			memberType, memberName = StringOrDefault(memberType, "User"), name
+		}
+		rows = append(rows, []string{groupName, memberType, memberName, m.Value})
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{groupName, "", "", ""})
+	}
+	if count {
+		for i := range rows {
+			rows[i] = append(rows[i], strconv.Itoa(len(members)))
+		}
+	}
+	return rows
+}
+
+// ExportGroupMembers writes a CSV row for each member of each group to a
+// file. Groups are listed page by page and the members of at most
+// opts.Parallel groups are got at the same time, each from its own copy of
+// the context. The rows of a group are written as soon as its members are
+// got, so that only the groups being exported are held in memory.
+func ExportGroupMembers(ctx *HttpContext, fileName string, opts GroupExportOptions) {
+	userNames, err := scimNames(ctx, "Users", "userName")
+	if err != nil {
+		ctx.Log.Err("Could not get user names: %v\n", err)
+		return
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		ctx.Log.Err("Could not create group members file: %v\n", err)
+		return
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	header := groupMembersHeader
+	if opts.Count {
+		header = append(header[:len(header):len(header)], "memberCount")
+	}
+	w.Write(header)
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+	groups, wg, mutex := make(chan *typedGroup), sync.WaitGroup{}, sync.Mutex{}
+	groupCount, memberCount, failed := 0, 0, 0
+	for i := 0; i < opts.Parallel; i++ {
+		wg.Add(1)
+		go func(ctx *HttpContext) {
+			defer wg.Done()
+			for g := range groups {
+				members := &typedGroup{}
+				err := ctx.Accept("json").Request("GET", fmt.Sprintf("scim/Groups/%s?attributes=members", g.Id), nil, members)
+				mutex.Lock()
+				if err != nil {
+					ctx.Log.Err("Could not get members of group %s: %v\n", g.DisplayName, err)
+					failed++
+				} else {
+					w.WriteAll(groupMembersRows(g.DisplayName, members.Members, userNames, opts.Count))
+					groupCount, memberCount = groupCount+1, memberCount+len(members.Members)
+				}
+				mutex.Unlock()
+			}
+		}(ctx.Clone())
+	}
+	err = scimForEach(ctx, "Groups", "", []string{"id", "displayName"}, func(resource scimResource) error {
+		if ctx.Canceled() {
+			return fmt.Errorf("canceled")
+		}
+		groups <- resource.(*typedGroup)
+		return nil
+	})
+	close(groups)
+	wg.Wait()
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		ctx.Log.Err("Could not export groups to %s: %v\n", fileName, err)
+	} else if failed > 0 {
+		ctx.Log.Err("Export to %s is incomplete, members of %d groups could not be got\n", fileName, failed)
+	}
+	ctx.Log.Info("Exported %d members of %d groups to %s\n", memberCount, groupCount, fileName)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// groupExportPaths are the paths of a tenant with the users of backupPaths,
+// group friends with two users and group trolls, and group loners without
+// members, listed two by two.
+func groupExportPaths() map[string]TstHandler {
+	paths := backupPaths()
+	paths["GET/scim/Groups?attributes=id%2CdisplayName&count=2&startIndex=1"] = GoodPathHandler(`{"totalResults": 3,
+		"Resources": [{"id": "10", "displayName": "friends"}, {"id": "11", "displayName": "loners"}]}`)
+	paths["GET/scim/Groups?attributes=id%2CdisplayName&count=2&startIndex=3"] = GoodPathHandler(`{"totalResults": 3,
+		"Resources": [{"id": "12", "displayName": "trolls"}]}`)
+	paths["GET/scim/Groups/10?attributes=members"] = GoodPathHandler(`{"members": [{"value": "3"},
+		{"value": "1", "type": "User"}, {"value": "12", "display": "trolls", "type": "Group"}]}`)
+	paths["GET/scim/Groups/11?attributes=members"] = GoodPathHandler(`{}`)
+	paths["GET/scim/Groups/12?attributes=members"] = GoodPathHandler(`{"members": [{"value": "2"}]}`)
+	return paths
+}
+
+func exportGroupsTo(t *testing.T, paths map[string]TstHandler, opts GroupExportOptions) (*HttpContext, string) {
+	defer func(pageSize int) { scimPageSize = pageSize }(scimPageSize)
+	scimPageSize = 2
+	f := WriteTempFile(t, "")
+	defer CleanupTempFile(f)
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	ExportGroupMembers(ctx, f.Name(), opts)
+	content, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+	return ctx, string(content)
+}
+
+func TestExportGroupMembers(t *testing.T) {
+	ctx, content := exportGroupsTo(t, groupExportPaths(), GroupExportOptions{Parallel: 1})
+	assert.Equal(t, "groupName,memberType,memberName,memberId\nfriends,User,sven,3\nfriends,User,anna,1\n"+
+		"friends,Group,trolls,12\nloners,,,\ntrolls,User,olaf,2\n", content)
+	AssertOnlyInfoContains(t, ctx, "Exported 4 members of 3 groups to ")
+}
+
+func TestExportGroupMembersWithCount(t *testing.T) {
+	ctx, content := exportGroupsTo(t, groupExportPaths(), GroupExportOptions{Parallel: 1, Count: true})
+	assert.Equal(t, "groupName,memberType,memberName,memberId,memberCount\nfriends,User,sven,3,3\n"+
+		"friends,User,anna,1,3\nfriends,Group,trolls,12,3\nloners,,,,0\ntrolls,User,olaf,2,1\n", content)
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestExportGroupMembersInParallel(t *testing.T) {
+	ctx, content := exportGroupsTo(t, groupExportPaths(), GroupExportOptions{Parallel: 3})
+	rows := strings.Split(strings.TrimSpace(content), "\n")
+	assert.Equal(t, "groupName,memberType,memberName,memberId", rows[0])
+	sort.Strings(rows[1:])
+	assert.Equal(t, []string{"friends,Group,trolls,12", "friends,User,anna,1", "friends,User,sven,3", "loners,,,",
+		"trolls,User,olaf,2"}, rows[1:])
+	AssertOnlyInfoContains(t, ctx, "Exported 4 members of 3 groups to ")
+}
+
+func TestExportGroupMembersReportsGroupsNotExported(t *testing.T) {
+	paths := groupExportPaths()
+	paths["GET/scim/Groups/11?attributes=members"] = ErrorHandler(503, "down")
+	ctx, content := exportGroupsTo(t, paths, GroupExportOptions{Parallel: 1})
+	assert.NotContains(t, content, "loners")
+	assert.Contains(t, ctx.Log.ErrString(), "Could not get members of group loners: 503")
+	assert.Contains(t, ctx.Log.ErrString(), "is incomplete, members of 1 groups could not be got\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Exported 4 members of 2 groups to ")
+}
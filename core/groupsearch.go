@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"sort"
+	"strings"
+)
+
+// groupMatch is a group found by a search of part of its name
+type groupMatch struct {
+	Id          string `json:"id" yaml:"id"`
+	DisplayName string `json:"displayName" yaml:"displayName"`
+	MemberCount int    `json:"memberCount" yaml:"memberCount"`
+}
+
+// SearchGroups prints the id, name and number of members of the groups
+// whose name contains text, or starts with it if match is MatchPrefix,
+// sorted by name. Names are matched without case unless they are case
+// sensitive. If the server rejects the filter, all groups are got and
+// matched here. At most a page of groups is printed, with a note of how
+// many more match.
+func SearchGroups(ctx *HttpContext, text, match string) {
+	if match == "" {
+		match = MatchContains
+	}
+	filter, verb := Co("displayName", text), nameMatchVerbs[match]
+	if match == MatchPrefix {
+		filter = Sw("displayName", text)
+	}
+	var matches []groupMatch
+	collect := func(resource scimResource) error {
+		found := resource.name("displayName")
+		if ctx.CaseSensitiveNames() && matchesName(match, found, text) ||
+			!ctx.CaseSensitiveNames() && matchesName(match, strings.ToLower(found), strings.ToLower(text)) {
+			matches = append(matches, groupMatch{Id: resource.id(), DisplayName: found,
+				MemberCount: len(resource.(*typedGroup).Members)})
+		}
+		return nil
+	}
+	attrs := []string{"id", "displayName", "members"}
+	err := scimForEach(ctx, "Groups", filter.String(), attrs, collect)
+	if isFilterRejected(err) {
+		ctx.Log.Debug("Groups cannot be filtered with %s, matching their names here: %v\n", filter, err)
+		matches = nil
+		err = scimForEach(ctx, "Groups", "", attrs, collect)
+	}
+	if err != nil {
+		ctx.Log.Err("Error searching groups with names that %s \"%s\": %v\n", verb, text, err)
+		return
+	}
+	if len(matches) == 0 {
+		ctx.Log.Err("Error searching groups: %v\n", NotFound("no groups found with names that %s \"%s\"", verb, text))
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].DisplayName < matches[j].DisplayName })
+	total, limit := len(matches), pageSize(ctx)
+	if total > limit {
+		matches = matches[:limit]
+	}
+	ctx.Log.PP(fmt.Sprintf("Groups with names that %s %s", verb, text), matches)
+	if total > limit {
+		ctx.Log.Info("Only the first %d of %d groups are listed, give more of the name to find the others\n",
+			limit, total)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const groupSearchAttrs = "GET/scim/Groups?attributes=id%2CdisplayName%2Cmembers&count="
+
+func TestSearchGroupsSortsMatchesWithMemberCounts(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		groupSearchAttrs + "500&filter=displayName+co+%22eng%22&startIndex=1": GoodPathHandler(`{"totalResults": 2,
+			"Resources": [{"id": "2", "displayName": "org-eng-web", "members": [{"value": "7"}]},
+			{"id": "1", "displayName": "org-Eng-api", "members": [{"value": "7"}, {"value": "8"}]}]}`)})
+	SearchGroups(ctx, "eng", MatchContains)
+	AssertOnlyInfoContains(t, ctx, "---- Groups with names that contain eng ----\n"+
+		"- id: \"1\"\n  displayName: org-Eng-api\n  memberCount: 2\n"+
+		"- id: \"2\"\n  displayName: org-eng-web\n  memberCount: 1\n")
+}
+
+func TestSearchGroupsByPrefixMatchesCaseWithCaseSensitiveNames(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		groupSearchAttrs + "500&filter=displayName+sw+%22org-eng%22&startIndex=1": GoodPathHandler(`{"totalResults": 2,
+			"Resources": [{"id": "1", "displayName": "org-Eng-api"}, {"id": "2", "displayName": "org-eng-web"}]}`)})
+	ctx.SetCaseSensitiveNames(true)
+	SearchGroups(ctx, "org-eng", MatchPrefix)
+	AssertOnlyInfoContains(t, ctx, "org-eng-web")
+	assert.NotContains(t, ctx.Log.InfoString(), "org-Eng-api")
+}
+
+func TestSearchGroupsMatchesNamesHereIfFilterIsRejected(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		groupSearchAttrs + "500&filter=displayName+co+%22eng%22&startIndex=1": ErrorHandler(400, "invalid filter"),
+		groupSearchAttrs + "500&startIndex=1": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"id": "1", "displayName": "org-eng-api"}, {"id": "2", "displayName": "org-ops"},
+			{"id": "3", "displayName": "ENG"}]}`)})
+	SearchGroups(ctx, "eng", MatchContains)
+	AssertOnlyInfoContains(t, ctx, "displayName: ENG")
+	assert.Contains(t, ctx.Log.InfoString(), "displayName: org-eng-api")
+	assert.NotContains(t, ctx.Log.InfoString(), "org-ops")
+}
+
+func TestSearchGroupsListsAPageAtMost(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		groupSearchAttrs + "2&filter=displayName+co+%22eng%22&startIndex=1": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"id": "3", "displayName": "eng-c"}, {"id": "1", "displayName": "eng-a"}]}`),
+		groupSearchAttrs + "2&filter=displayName+co+%22eng%22&startIndex=3": GoodPathHandler(`{"totalResults": 3,
+			"Resources": [{"id": "2", "displayName": "eng-b"}]}`)})
+	SetPageSize(ctx, 2)
+	SearchGroups(ctx, "eng", MatchContains)
+	AssertOnlyInfoContains(t, ctx, "displayName: eng-a")
+	assert.Contains(t, ctx.Log.InfoString(), "displayName: eng-b")
+	assert.NotContains(t, ctx.Log.InfoString(), "eng-c")
+	assert.Contains(t, ctx.Log.InfoString(), "Only the first 2 of 3 groups are listed, give more of the name")
+}
+
+func TestSearchGroupsWithoutMatchesIsNotFound(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		groupSearchAttrs + "500&filter=displayName+co+%22eng%22&startIndex=1": GoodPathHandler(`{"totalResults": 0}`)})
+	SearchGroups(ctx, "eng", MatchContains)
+	AssertErrorContains(t, ctx, `no groups found with names that contain "eng"`)
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
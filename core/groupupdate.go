@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// GroupUpdate is a change of the name or the description of a group
+type GroupUpdate struct {
+	DisplayName    string // new name of the group, empty to keep its name
+	Description    string // new description of the group
+	SetDescription bool   // set the description, removing it if it is empty
+	ByID           bool   // the group is given by its id rather than its name
+}
+
+// groupPatch is the body of the request that updates a group
+type groupPatch struct {
+	Schemas     []string `json:"schemas"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// updateGroup renames a group or sets its description. A group is not
+// renamed onto the name of another group. Since files such as those of
+// membership syncs refer to groups by name, the old and new names are
+// printed when a group is renamed.
+func updateGroup(ctx *HttpContext, name string, update *GroupUpdate) {
+	id, oldName, err := groupToUpdate(ctx, name, update.ByID)
+	if err == nil && update.DisplayName != "" && update.DisplayName != oldName {
+		var other string
+		if other, err = otherGroupNamed(ctx, update.DisplayName, id); err == nil && other != "" {
+			err = fmt.Errorf("a group named \"%s\" already exists with id %s", update.DisplayName, other)
+		}
+	}
+	if err != nil {
+		ctx.Log.Err("Error updating group \"%s\": %v\n", Named("Groups", name), err)
+		return
+	}
+	patch, clear := groupPatch{Schemas: []string{coreSchemaURN}, DisplayName: update.DisplayName}, []string{}
+	if update.SetDescription && update.Description == "" {
+		clear = append(clear, "description")
+	} else if update.SetDescription {
+		patch.Description = update.Description
+	}
+	if err = scimPatchClear(ctx, "Groups", id, &patch, clear); err != nil {
+		ctx.Log.Err("Error updating group \"%s\": %v\n", Named("Groups", oldName), err)
+	} else if update.DisplayName != "" && update.DisplayName != oldName {
+		ctx.ForgetID("Groups", "displayName", oldName)
+		ctx.CacheID("Groups", "displayName", update.DisplayName, id)
+		ctx.Log.Info("Group \"%s\" renamed to \"%s\", files that refer to the group as \"%s\" should now use \"%s\"\n",
+			Named("Groups", oldName), update.DisplayName, oldName, update.DisplayName)
+	} else {
+		ctx.Log.Info("Group \"%s\" updated\n", Named("Groups", oldName))
+	}
+}
+
+// groupToUpdate returns the id and the current name of a group given by its
+// name, or by its id if byID is set.
+func groupToUpdate(ctx *HttpContext, name string, byID bool) (id, displayName string, err error) {
+	if !byID {
+		item, err := scimGetByName(ctx, "Groups", "displayName", name, "id", "displayName")
+		if err != nil {
+			return "", "", err
+		}
+		return item.id(), item.name("displayName"), nil
+	}
+	group := scimGroup{}
+	path := fmt.Sprintf("scim/Groups/%s?attributes=id%%2CdisplayName", url.PathEscape(name))
+	if err = ctx.Accept("json").Request("GET", path, nil, &group); err != nil {
+		return "", "", err
+	}
+	return name, group.DisplayName, nil
+}
+
+// otherGroupNamed returns the id of a group other than the one with the
+// given id whose name is name whatever its case, or "" if there is none.
+func otherGroupNamed(ctx *HttpContext, name, id string) (other string, err error) {
+	vals := url.Values{"attributes": {"id,displayName"}, "count": {strconv.Itoa(pageSize(ctx))},
+		"filter": {Eq("displayName", name).String()}}
+	err = scimPages(ctx, "Groups", vals, 0, func(page []scimResource) error {
+		for _, group := range page {
+			if other == "" && group.id() != id && strings.EqualFold(group.name("displayName"), name) {
+				other = group.id()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not check for a group named \"%s\": %v", name, err)
+	}
+	return other, nil
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const engLookupPath = "GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22eng%22"
+const engineeringLookupPath = "GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22engineering%22"
+
+// groupPatchHandler checks the body of the update of group 10
+func groupPatchHandler(expected string) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "PATCH", req.Header.Get("X-HTTP-Method-Override"))
+		assert.JSONEq(t, expected, req.Input)
+		return &TstReply{Status: 204}
+	}
+}
+
+func TestRenameGroup(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		engLookupPath:         GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "eng"}]}`),
+		engineeringLookupPath: GoodPathHandler(`{"totalResults": 0, "Resources": []}`),
+		"POST/scim/Groups/10": groupPatchHandler(`{"schemas": ["` + coreSchemaURN + `"], "displayName": "engineering"}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "eng", &GroupUpdate{DisplayName: "engineering"})
+	AssertOnlyInfoContains(t, ctx, `Group "eng" renamed to "engineering", files that refer to the group as "eng" `+
+		`should now use "engineering"`)
+	id, _ := ctx.CachedID("Groups", "displayName", "engineering")
+	assert.Equal(t, "10", id)
+}
+
+func TestRenameGroupOntoExistingNameIsRefused(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		engLookupPath:         GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "eng"}]}`),
+		engineeringLookupPath: GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "11", "displayName": "Engineering"}]}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "eng", &GroupUpdate{DisplayName: "engineering"})
+	AssertErrorContains(t, ctx, `Error updating group "eng": a group named "engineering" already exists with id 11`)
+}
+
+func TestRenameGroupChangingOnlyTheCase(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		engLookupPath: GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "eng"}]}`),
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22ENG%22": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "eng"}]}`),
+		"POST/scim/Groups/10": groupPatchHandler(`{"schemas": ["` + coreSchemaURN + `"], "displayName": "ENG"}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "eng", &GroupUpdate{DisplayName: "ENG"})
+	AssertOnlyInfoContains(t, ctx, `Group "eng" renamed to "ENG"`)
+}
+
+func TestSetDescriptionOfGroupByID(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Groups/10?attributes=id%2CdisplayName": GoodPathHandler(`{"id": "10", "displayName": "eng"}`),
+		"POST/scim/Groups/10":                            groupPatchHandler(`{"schemas": ["` + coreSchemaURN + `"], "description": "builders"}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "10", &GroupUpdate{Description: "builders", SetDescription: true, ByID: true})
+	AssertOnlyInfoContains(t, ctx, `Group "eng" updated`)
+}
+
+func TestClearDescriptionOfGroup(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		engLookupPath: GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "eng"}]}`),
+		"POST/scim/Groups/10": groupPatchHandler(`{"schemas": ["` + coreSchemaURN + `"],
+			"meta": {"attributes": ["description"]}}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "eng", &GroupUpdate{SetDescription: true})
+	AssertOnlyInfoContains(t, ctx, `Group "eng" updated`)
+}
+
+func TestUpdateUnknownGroupFails(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		engLookupPath: GoodPathHandler(`{"totalResults": 0, "Resources": []}`)})
+	new(SCIMGroupsService).UpdateEntity(ctx, "eng", &GroupUpdate{DisplayName: "engineering"})
+	AssertErrorContains(t, ctx, `Error updating group "eng": no Groups found named "eng"`)
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"errors"
+	. "github.com/vmware/priam/util"
+	"net/http"
+)
+
+// DefaultMemberBatchSize is the most member changes sent in one patch of a
+// group unless set with SetMemberBatchSize, tenants refuse or time out on
+// patches with many more.
+const DefaultMemberBatchSize = 100
+
+const memberBatchSizeKey = "memberBatchSize"
+
+// SetMemberBatchSize sets the most member changes sent in one patch of a
+// group, the default if size is not positive.
+func SetMemberBatchSize(ctx *HttpContext, size int) {
+	ctx.SetValue(memberBatchSizeKey, size)
+}
+
+func memberBatchSize(ctx *HttpContext) int {
+	if size, _ := ctx.Value(memberBatchSizeKey, nil); size != nil && size.(int) > 0 {
+		return size.(int)
+	}
+	return DefaultMemberBatchSize
+}
+
+// memberPatches counts the patches of member changes that were sent, and the
+// batches that were split because the tenant refused them as too large or
+// did not answer them in time.
+type memberPatches struct {
+	sent, split int
+}
+
+// send changes the members of a SCIM resource with patches of at most the
+// member batch size of the context. A batch refused with 413 or that timed
+// out is sent again in two halves, down to single members, since the limit
+// differs between tenants. Sending a change again is safe, adding a member
+// twice or removing one that is not there changes nothing. It returns the
+// error of each change that failed, by index in members.
+func (p *memberPatches) send(ctx *HttpContext, resType, id string, members []memberValue) map[int]error {
+	failed, size := make(map[int]error), memberBatchSize(ctx)
+	for start := 0; start < len(members); start += size {
+		end := start + size
+		if end > len(members) {
+			end = len(members)
+		}
+		p.sendBatch(ctx, resType, id, members, start, end, failed)
+	}
+	return failed
+}
+
+func (p *memberPatches) sendBatch(ctx *HttpContext, resType, id string, members []memberValue, start, end int,
+	failed map[int]error) {
+	var err error
+	if ctx.Canceled() {
+		err = ErrCanceled
+	} else {
+		p.sent++
+		patch := memberPatch{Schemas: []string{coreSchemaURN}, Members: members[start:end]}
+		if err = scimPatch(ctx, resType, id, &patch); err == nil {
+			return
+		} else if end-start > 1 && patchTooLarge(err) {
+			p.split++
+			ctx.Log.Debug("Patch of %d members of %s %s failed, sending it again in halves: %v\n", end-start,
+				resType, id, err)
+			middle := start + (end-start)/2
+			p.sendBatch(ctx, resType, id, members, start, middle, failed)
+			p.sendBatch(ctx, resType, id, members, middle, end, failed)
+			return
+		}
+	}
+	for i := start; i < end; i++ {
+		failed[i] = err
+	}
+}
+
+// patchTooLarge returns true if a patch failed because the tenant refused it
+// as too large or did not answer it in time.
+func patchTooLarge(err error) bool {
+	var status *StatusError
+	var timeout *TimeoutError
+	return errors.As(err, &status) && status.Code == http.StatusRequestEntityTooLarge || errors.As(err, &timeout)
+}
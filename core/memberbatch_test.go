@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"strings"
+	"testing"
+)
+
+func batchMembers(ids ...string) []memberValue {
+	members := make([]memberValue, len(ids))
+	for i, id := range ids {
+		members[i] = memberValue{Value: id, Type: "User"}
+	}
+	return members
+}
+
+func TestMemberPatchesAreSentInBatches(t *testing.T) {
+	var bodies []string
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Groups/10": func(t *testing.T, req *TstReq) *TstReply {
+		bodies = append(bodies, req.Input)
+		return &TstReply{Status: 204}
+	}})
+	defer srv.Close()
+	SetMemberBatchSize(ctx, 2)
+	var patches memberPatches
+	assert.Empty(t, patches.send(ctx, "Groups", "10", batchMembers("1", "2", "3")))
+	assert.Equal(t, []string{
+		`{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[{"Value":"1","Type":"User"},{"Value":"2","Type":"User"}]}`,
+		`{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[{"Value":"3","Type":"User"}]}`}, bodies)
+	assert.Equal(t, memberPatches{sent: 2}, patches)
+}
+
+func TestMemberBatchSizeDefaultsIfNotPositive(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	assert.Equal(t, DefaultMemberBatchSize, memberBatchSize(ctx))
+	SetMemberBatchSize(ctx, 0)
+	assert.Equal(t, DefaultMemberBatchSize, memberBatchSize(ctx))
+}
+
+func TestMemberPatchesAreSplitWhenTooLarge(t *testing.T) {
+	var sizes []int
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Groups/10": func(t *testing.T, req *TstReq) *TstReply {
+		size := strings.Count(req.Input, `"Value"`)
+		sizes = append(sizes, size)
+		if size > 1 {
+			return &TstReply{Status: 413, Output: "too large"}
+		}
+		return &TstReply{Status: 204}
+	}})
+	defer srv.Close()
+	var patches memberPatches
+	assert.Empty(t, patches.send(ctx, "Groups", "10", batchMembers("1", "2", "3")))
+	assert.Equal(t, []int{3, 1, 2, 1, 1}, sizes)
+	assert.Equal(t, memberPatches{sent: 5, split: 2}, patches)
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestMemberPatchesReportFailedMembers(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Groups/10": func(t *testing.T, req *TstReq) *TstReply {
+		if strings.Count(req.Input, `"Value"`) > 1 {
+			return &TstReply{Status: 413, Output: "too large"}
+		} else if strings.Contains(req.Input, `"Value":"2"`) {
+			return &TstReply{Status: 404, Output: "no such user"}
+		}
+		return &TstReply{Status: 204}
+	}})
+	defer srv.Close()
+	var patches memberPatches
+	failed := patches.send(ctx, "Groups", "10", batchMembers("1", "2"))
+	assert.Len(t, failed, 1)
+	assert.Contains(t, failed[1].Error(), "404")
+	assert.Equal(t, memberPatches{sent: 3, split: 1}, patches)
+}
+
+func TestMemberPatchesAreNotSplitForOtherErrors(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Groups/10": ErrorHandler(500, "broken")})
+	defer srv.Close()
+	var patches memberPatches
+	failed := patches.send(ctx, "Groups", "10", batchMembers("1", "2"))
+	assert.Len(t, failed, 2)
+	assert.Equal(t, memberPatches{sent: 1}, patches)
+}
@@ -16,10 +16,15 @@ limitations under the License.
 package core
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	. "github.com/vmware/priam/util"
+	"net"
 	"net/url"
 	"strings"
+	"time"
 )
 
 func CmdLocalUserStore(ctx *HttpContext, args []string) {
@@ -72,7 +77,7 @@ func CmdTenantConfig(ctx *HttpContext, name string, nvpairs []string) {
 
 func CmdSchema(ctx *HttpContext, name string) {
 	vals := make(url.Values)
-	vals.Set("filter", fmt.Sprintf("name eq \"%s\"", name))
+	vals.Set("filter", Eq("name", name).String())
 	path := fmt.Sprintf("scim/Schemas?%v", vals.Encode())
 	ctx.GetPrintJson("Schema for "+name, path, "")
 }
@@ -85,3 +90,58 @@ func HealthCheck(ctx *HttpContext) {
 		ctx.Log.PP("Health info", outp)
 	}
 }
+
+// CmdCheck checks with an inexpensive request that the target can be reached
+// and accepts the access token, and prints who the token was issued to. If
+// the check fails, the error says which layer is broken.
+func CmdCheck(ctx *HttpContext) {
+	start := time.Now()
+	err := ctx.Accept("json").Request("GET", "scim/Users?count=1", nil, nil)
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		ctx.Log.Err("Check of %s failed, %s: %v\n", ctx.HostURL, failedLayer(err), err)
+		return
+	}
+	info := tokenClaims(ctx.Headers("Authorization"))
+	info["target"], info["url"], info["latency"] = ctx.TargetName, ctx.HostURL, latency.String()
+	granted, requested := grantedScopes(ctx), requestedScopes(ctx)
+	if granted != "" {
+		info["scopes"] = granted
+	}
+	if requested != "" {
+		info["requestedScopes"] = requested
+	}
+	ctx.Log.PP("Check", info)
+	if missing := MissingScopes(requested, granted); granted != "" && len(missing) > 0 {
+		ctx.Log.Warn("the access token was not granted the requested scopes: %s\n", strings.Join(missing, " "))
+	}
+}
+
+// failedLayer describes which layer a request failed in
+func failedLayer(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	var timeout *TimeoutError
+	var status *StatusError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "the host name could not be resolved"
+	case errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) ||
+		errors.As(err, &recordHeader) || strings.Contains(err.Error(), "tls: "):
+		return "TLS error, check the --cacert, --cert and --key options"
+	case errors.As(err, &timeout):
+		return "the server did not respond in time"
+	case !errors.As(err, &status):
+		return "the server could not be reached"
+	case status.Code == 401:
+		return "the access token was refused, please log in"
+	case status.Code == 403:
+		return "the access token is not allowed to read users"
+	case status.Code >= 500:
+		return "server error"
+	}
+	return "unexpected response"
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package core
 
 import (
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	. "github.com/vmware/priam/testaid"
 	. "github.com/vmware/priam/util"
@@ -38,11 +39,81 @@ func TestGetSchemaWithNoMediaType(t *testing.T) {
 	assert.Contains(t, ctx.Log.InfoString(), "name: userName")
 }
 
+const checkPath = "GET/scim/Users?count=1"
+
+func TestCheckShowsTokenPrincipalAndExpiry(t *testing.T) {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"prn": "alice@example", "cid": "cli-client", "exp": 1893456000}).SignedString([]byte("test key"))
+	h := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "Bearer "+token, req.Authorization)
+		return &TstReply{Output: `{"totalResults": 3, "Resources": []}`}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{checkPath: h})
+	defer srv.Close()
+	ctx.TargetName = "staging"
+	CmdCheck(ctx.Authorization("Bearer " + token))
+	AssertOnlyInfoContains(t, ctx, "principal: alice@example")
+	for _, s := range []string{"client: cli-client", "tokenExpiry: \"2030-01-01T00:00:00Z\"",
+		"target: staging", "url: " + srv.URL, "latency: "} {
+		assert.Contains(t, ctx.Log.InfoString(), s)
+	}
+}
+
+func TestCheckWithOpaqueToken(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{checkPath: GoodPathHandler(`{}`)})
+	defer srv.Close()
+	CmdCheck(ctx.Authorization("Bearer opaque"))
+	AssertOnlyInfoContains(t, ctx, "the access token is not a JWT")
+}
+
+func TestCheckReportsWhichLayerFailed(t *testing.T) {
+	for code, layer := range map[int]string{401: "the access token was refused, please log in",
+		403: "the access token is not allowed to read users", 500: "server error", 404: "unexpected response"} {
+		srv, ctx := NewTestContext(t, map[string]TstHandler{checkPath: ErrorHandler(code, "test check")})
+		ctx.MaxAttempts = 1
+		CmdCheck(ctx)
+		AssertOnlyErrorContains(t, ctx, "Check of "+srv.URL+" failed, "+layer)
+		AssertErrorContains(t, ctx, "test check")
+		srv.Close()
+	}
+}
+
+func TestCheckReportsTLSError(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	CmdCheck(ctx)
+	AssertOnlyErrorContains(t, ctx, "failed, TLS error")
+}
+
+func TestCheckReportsUnreachableServer(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.MaxAttempts = 1
+	CmdCheck(ctx)
+	AssertOnlyErrorContains(t, ctx, "failed, the server could not be reached")
+}
+
+func TestCheckReportsUnknownHost(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "http://no-such-host.invalid", "/", "")
+	ctx.MaxAttempts = 1
+	CmdCheck(ctx)
+	AssertOnlyErrorContains(t, ctx, "failed, the host name could not be resolved")
+}
+
 func NewTestContext(t *testing.T, paths map[string]TstHandler) (*httptest.Server, *HttpContext) {
 	srv := StartTstServer(t, paths)
 	return srv, NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 }
 
+// NewReplayContext returns a context whose requests are answered by the
+// handlers of paths without a server
+func NewReplayContext(t *testing.T, paths map[string]TstHandler) *HttpContext {
+	return NewHttpContext(NewBufferedLogr(), "https://tenant.example", "/", "").
+		SetRoundTripper(ReplayTransport(t, paths))
+}
+
 // Assert context info contains the given string
 func AssertOnlyInfoContains(t *testing.T, ctx *HttpContext, expected string) {
 	assert.Empty(t, ctx.Log.ErrString(), "Error message should be empty")
@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+// context value keys of whether passwords must be changed at next login and
+// of the attribute that requires it
+const (
+	mustChangeKey     = "mustChangePassword"
+	mustChangeAttrKey = "mustChangePasswordAttr"
+)
+
+// mustChangeAttrs are the names that tenants may give to the attribute of the
+// workspace extension that requires users to change their password at next
+// login
+var mustChangeAttrs = []string{"mustChangePassword", "forcePasswordChange", "passwordChangeRequired"}
+
+// RequirePasswordChange makes the passwords set with the context temporary:
+// users must change them at next login. Setting a password then fails if the
+// tenant does not support it.
+func RequirePasswordChange(ctx *HttpContext) {
+	ctx.SetValue(mustChangeKey, true)
+}
+
+// mustChangePatch returns the attributes to send with a password so that it
+// must be changed at next login, or nil if it need not be.
+func mustChangePatch(ctx *HttpContext) (*rawAttributes, error) {
+	if required, _ := ctx.Value(mustChangeKey, nil); required != true {
+		return nil, nil
+	}
+	attr, err := ctx.Value(mustChangeAttrKey, func() (interface{}, error) { return findMustChangeAttr(ctx) })
+	if err != nil {
+		return nil, err
+	}
+	return &rawAttributes{map[string]interface{}{
+		workspaceSchemaURN: map[string]interface{}{attr.(string): true},
+	}}, nil
+}
+
+// findMustChangeAttr finds in the SCIM schemas of the tenant the writable
+// attribute of the workspace extension that requires a password change.
+func findMustChangeAttr(ctx *HttpContext) (string, error) {
+	schemas, err := scimDiscover(ctx, "scim/Schemas")
+	if err != nil {
+		if schemas = scimSchemasByName(ctx); len(schemas) == 0 {
+			return "", fmt.Errorf("could not get the SCIM schemas of the tenant to find how to require "+
+				"a password change at next login: %v", err)
+		}
+	}
+	for _, row := range schemaAttributes(schemas) {
+		name := strings.TrimPrefix(row["attribute"].(string), workspaceSchemaURN+".")
+		if row["schema"] != workspaceSchemaURN && name == row["attribute"] || row["mutability"] == "readOnly" {
+			continue
+		}
+		for _, attr := range mustChangeAttrs {
+			if strings.EqualFold(name, attr) {
+				ctx.Log.Debug("Password change at next login is required with %s.%s\n", workspaceSchemaURN, name)
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("the tenant does not support requiring a password change at next login, "+
+		"the %s extension has none of the writable attributes %s", workspaceSchemaURN, strings.Join(mustChangeAttrs, ", "))
+}
+
+// checkNewPassword checks a password that is about to be set and returns the
+// attributes to send with it, if any.
+func checkNewPassword(ctx *HttpContext, pwd string) (*rawAttributes, error) {
+	if pwd == "" {
+		return nil, nil
+	}
+	if err := checkPassword(ctx, pwd); err != nil {
+		return nil, err
+	}
+	return mustChangePatch(ctx)
+}
+
+// withAttributes returns the account to send with the extra attributes, if
+// any. Those of the workspace extension are merged with the account's.
+func withAttributes(acct *userAccount, extra *rawAttributes) interface{} {
+	if extra == nil {
+		return acct
+	}
+	if ext, ok := extra.raw[workspaceSchemaURN].(map[string]interface{}); ok {
+		if !HasString(workspaceSchemaURN, acct.Schemas) {
+			acct.Schemas = append(acct.Schemas, workspaceSchemaURN)
+		}
+		if data, err := json.Marshal(acct.WksExt); err == nil && acct.WksExt != nil {
+			json.Unmarshal(data, &ext)
+			acct.WksExt = nil
+		}
+	}
+	return &typedUser{*acct, *extra}
+}
+
+// mustChangeNote says that the password must be changed if extra requires it.
+func mustChangeNote(extra *rawAttributes) string {
+	if extra == nil {
+		return ""
+	}
+	return ", password must be changed at next login"
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"os"
+	"testing"
+)
+
+func workspaceSchemaHandler(calls *int, attr, mutability string) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		*calls++
+		return &TstReply{ContentType: "application/json", Output: `{"Resources": [
+			{"id": "urn:scim:schemas:core:1.0", "attributes": [{"name": "userName", "type": "string"}]},
+			{"id": "` + workspaceSchemaURN + `", "attributes": [
+				{"name": "userStatus", "type": "string"},
+				{"name": "` + attr + `", "type": "boolean", "mutability": "` + mutability + `"}]}]}`}
+	}
+}
+
+func TestSetPasswordThatMustBeChanged(t *testing.T) {
+	calls := 0
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Schemas":   workspaceSchemaHandler(&calls, "mustChangePassword", "readWrite"),
+		DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+		DEFAULT_POST_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+			assert.JSONEq(t, `{"Schemas": ["`+coreSchemaURN+`", "`+workspaceSchemaURN+`"], "Password": "travolta", "`+
+				workspaceSchemaURN+`": {"mustChangePassword": true}}`, req.Input)
+			return &TstReply{Status: 204}
+		}})
+	RequirePasswordChange(ctx)
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "travolta"})
+	AssertOnlyInfoContains(t, ctx, `User "john" updated, password must be changed at next login`)
+}
+
+func TestPasswordIsNotSetIfTenantCannotRequireChange(t *testing.T) {
+	for attr, mutability := range map[string]string{"otherAttribute": "readWrite", "mustChangePassword": "readOnly"} {
+		calls := 0
+		ctx := NewReplayContext(t, map[string]TstHandler{
+			"GET/scim/Schemas": workspaceSchemaHandler(&calls, attr, mutability)})
+		RequirePasswordChange(ctx)
+		new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "travolta"})
+		AssertOnlyErrorContains(t, ctx, `Error updating user "john": the tenant does not support requiring `+
+			"a password change at next login")
+	}
+}
+
+func TestMustChangeIsOnlySentWithPasswords(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+		DEFAULT_POST_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+			assert.NotContains(t, req.Input, workspaceSchemaURN)
+			return &TstReply{Status: 204}
+		}})
+	RequirePasswordChange(ctx)
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Given: "johnny"})
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+}
+
+func TestLoadUsersThatMustChangePasswordGetsSchemasOnce(t *testing.T) {
+	calls, added := 0, 0
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Schemas": workspaceSchemaHandler(&calls, "forcePasswordChange", ""),
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			added++
+			assert.Contains(t, req.Input, `{"forcePasswordChange":true}`)
+			return &TstReply{Output: `{"id": "1"}`}
+		}})
+	RequirePasswordChange(ctx)
+	usersFile := WriteTempFile(t, "---\n- {name: joe, pwd: changeme}\n- {name: sue, pwd: changeme}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2, added)
+	AssertOnlyInfoContains(t, ctx, "User 'sue' successfully added, password must be changed at next login")
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"sort"
+	"strings"
+)
+
+const nameMatchKey = "nameMatch"
+
+// how the names given to get commands can be matched besides exactly
+const (
+	MatchPrefix   = "prefix"
+	MatchContains = "contains"
+)
+
+// SetNameMatch makes the get commands of users, groups and roles list the
+// id and name of all the resources whose name starts with, or contains, the
+// name given rather than get the one with that name. Commands that change
+// resources still need their exact name or --choose-id.
+func SetNameMatch(ctx *HttpContext, match string) error {
+	switch match {
+	case MatchPrefix, MatchContains, "":
+		ctx.SetValue(nameMatchKey, match)
+		return nil
+	}
+	return fmt.Errorf("unknown name match \"%s\", supported matches are: %s, %s", match, MatchContains, MatchPrefix)
+}
+
+// verbs of the name matches in messages
+var nameMatchVerbs = map[string]string{MatchPrefix: "start with", MatchContains: "contain"}
+
+// nameMatchOf returns how the names given to get commands are matched, or
+// an empty string if they are matched exactly.
+func nameMatchOf(ctx *HttpContext) string {
+	match, _ := ctx.Value(nameMatchKey, nil)
+	if match, ok := match.(string); ok {
+		return match
+	}
+	return ""
+}
+
+// matchesName returns true if found matches name, with case
+func matchesName(match, found, name string) bool {
+	if match == MatchPrefix {
+		return strings.HasPrefix(found, name)
+	}
+	return strings.Contains(found, name)
+}
+
+// scimListMatches prints the id and name of the resources whose name
+// matches, sorted by name. With case sensitive names, those that only match
+// without case are left out.
+func scimListMatches(ctx *HttpContext, resType, nameAttr, name, match string) {
+	filter, verb := Sw(nameAttr, name), nameMatchVerbs[match]
+	if match == MatchContains {
+		filter = Co(nameAttr, name)
+	}
+	var matches []interface{}
+	err := scimForEach(ctx, resType, filter.String(), []string{"id", nameAttr}, func(resource scimResource) error {
+		if found := resource.name(nameAttr); !ctx.CaseSensitiveNames() || matchesName(match, found, name) {
+			matches = append(matches, map[string]interface{}{"id": resource.id(), nameAttr: found})
+		}
+		return nil
+	})
+	if err != nil {
+		ctx.Log.Err("Error getting %s with names that %s \"%s\": %v\n", resType, verb, name, err)
+		return
+	}
+	if len(matches) == 0 {
+		ctx.Log.Err("Error getting %s: %v\n", resType, NotFound("no %v found with names that %s \"%s\"",
+			resType, verb, name))
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return InterfaceToString(matches[i].(map[string]interface{})[nameAttr]) <
+			InterfaceToString(matches[j].(map[string]interface{})[nameAttr])
+	})
+	ctx.Log.PP(fmt.Sprintf("%s with names that %s %s", resType, verb, name), matches, "id", nameAttr)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"testing"
+)
+
+func matchURL(resType, nameAttr, filter string) string {
+	vals := url.Values{"attributes": {"id," + nameAttr}, "count": {"500"}, "startIndex": {"1"}, "filter": {filter}}
+	return "GET/scim/" + resType + "?" + vals.Encode()
+}
+
+func TestGetGroupsWithNamePrefixListsMatches(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		matchURL("Groups", "displayName", `displayName sw "eng platform "`): GoodPathHandler(`{"totalResults": 2,
+			"Resources": [{"id": "g2", "displayName": "eng platform web"}, {"id": "g1", "displayName": "eng platform api"}]}`)})
+	assert.Nil(t, SetNameMatch(ctx, MatchPrefix))
+	new(SCIMGroupsService).DisplayEntity(ctx, "eng platform ")
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Equal(t, "---- Groups with names that start with eng platform  ----\n"+
+		"- displayName: eng platform api\n  id: g1\n- displayName: eng platform web\n  id: g2\n", ctx.Log.InfoString())
+}
+
+func TestGetUsersWithNameContainingQuotes(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		matchURL("Users", "userName", `userName co "o\"brien jr"`): GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"id": "u1", "userName": "Pat O\"Brien Jr"}]}`)})
+	assert.Nil(t, SetNameMatch(ctx, MatchContains))
+	new(SCIMUsersService).DisplayEntity(ctx, `o"brien jr`)
+	assert.Contains(t, ctx.Log.InfoString(), "id: u1")
+
+	ctx.Log.ClearBuffers()
+	ctx.SetCaseSensitiveNames(true)
+	new(SCIMUsersService).DisplayEntity(ctx, `o"brien jr`)
+	assert.Equal(t, `Error getting Users: no Users found with names that contain "o"brien jr"`+"\n", ctx.Log.ErrString())
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+}
+
+func TestSetNameMatchRejectsUnknownMatches(t *testing.T) {
+	ctx := NewReplayContext(t, nil)
+	assert.Contains(t, SetNameMatch(ctx, "suffix").Error(), `unknown name match "suffix"`)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+)
+
+// OrphanOptions are the options of OrphanedEntitlements
+type OrphanOptions struct {
+	Clean  bool // delete the orphaned entitlements
+	DryRun bool // only print the entitlements that would be deleted
+	Force  bool // do not ask for confirmation before deleting
+}
+
+// statuses of the entitlements whose subject was not found
+const (
+	orphanedStatus     = "orphaned"
+	lookupFailedStatus = "unknown (lookup failed)"
+)
+
+// orphanedEntitlement is an entitlement whose subject was not found
+type orphanedEntitlement struct {
+	App         string `json:"app" yaml:"app"`
+	SubjectType string `json:"subjectType" yaml:"subjectType"`
+	SubjectID   string `json:"subjectId" yaml:"subjectId"`
+	Status      string `json:"status" yaml:"status"`
+	def         entitlementDef
+}
+
+// subjectStatus returns "" if the subject of an entitlement exists,
+// orphanedStatus if it does not, or lookupFailedStatus if it could not be
+// found out. The status of each subject is looked up once.
+func subjectStatus(ctx *HttpContext, def entitlementDef, statuses map[string]string) string {
+	key := def.SubjectType + "/" + def.SubjectID
+	if status, ok := statuses[key]; ok {
+		return status
+	}
+	status := ""
+	for _, st := range subjectTypes {
+		if st.EntitlementType != def.SubjectType {
+			continue
+		}
+		path := fmt.Sprintf("scim/%s/%s?attributes=id", st.ScimType, def.SubjectID)
+		if err := ctx.Accept("json").Request("GET", path, nil, nil); IsNotFound(err) {
+			status = orphanedStatus
+		} else if err != nil {
+			ctx.Log.Debug("Could not look up %s %s: %v\n", st.ScimType, def.SubjectID, err)
+			status = lookupFailedStatus
+		}
+	}
+	statuses[key] = status
+	return status
+}
+
+// OrphanedEntitlements prints the entitlements of all apps of the catalog whose
+// user, group or role no longer exists. Subjects that could not be looked up
+// are reported as unknown rather than orphaned, and never deleted. With Clean,
+// the orphaned entitlements are deleted after confirmation.
+func OrphanedEntitlements(ctx *HttpContext, opts OrphanOptions) {
+	items, err := catalogItems(ctx)
+	if err != nil {
+		ctx.Log.Err("Could not get apps of the catalog: %v\n", err)
+		return
+	}
+	statuses, orphans, total, orphaned := make(map[string]string), []orphanedEntitlement{}, 0, 0
+	for _, item := range items {
+		if ctx.Canceled() {
+			return
+		}
+		appName, itemID := InterfaceToString(item["name"]), InterfaceToString(item["uuid"])
+		defs, err := getAppEntitlements(ctx, itemID)
+		if err != nil {
+			ctx.Log.Err("Could not get entitlements of app %s: %v\n", appName, err)
+			continue
+		}
+		for _, def := range defs {
+			total++
+			def.CatalogItemID = StringOrDefault(def.CatalogItemID, itemID)
+			if status := subjectStatus(ctx, def, statuses); status != "" {
+				orphans = append(orphans, orphanedEntitlement{App: appName, SubjectType: def.SubjectType,
+					SubjectID: def.SubjectID, Status: status, def: def})
+				if status == orphanedStatus {
+					orphaned++
+				}
+			}
+		}
+	}
+	ctx.Log.PP("Orphaned entitlements", orphans, "app", "subjectType", "subjectId", "status")
+	ctx.Log.Info("Entitlements: %d, orphaned: %d, unknown (lookup failed): %d\n", total, orphaned, len(orphans)-orphaned)
+	if len(orphans) > orphaned {
+		ctx.Log.Fail(ExitPartial)
+	}
+	if opts.Clean && orphaned > 0 {
+		cleanOrphans(ctx, orphans, orphaned, opts)
+	}
+}
+
+// cleanOrphans deletes the entitlements that are orphaned, not those whose
+// subject could not be looked up.
+func cleanOrphans(ctx *HttpContext, orphans []orphanedEntitlement, orphaned int, opts OrphanOptions) {
+	if !opts.DryRun && !opts.Force &&
+		!ctx.Log.Confirm("Delete %d orphaned entitlements of %s?", orphaned, ctx.HostURL) {
+		ctx.Log.Info("No entitlements deleted\n")
+		return
+	}
+	var ops []entitlementOp
+	var deleted []orphanedEntitlement
+	for _, o := range orphans {
+		if o.Status != orphanedStatus {
+			continue
+		}
+		if opts.DryRun {
+			ctx.Log.Plan("Would delete entitlement of %s to app %s\n", subjectOf(o.def), o.App)
+			continue
+		}
+		ops = append(ops, entitlementOp{Method: "DELETE", Data: entitlementDef{CatalogItemID: o.def.CatalogItemID,
+			SubjectType: o.def.SubjectType, SubjectID: o.def.SubjectID}})
+		deleted = append(deleted, o)
+	}
+	failed := 0
+	for i, err := range entitlementBulkRequest(ctx, ops...) {
+		if err != nil {
+			ctx.Log.Err("Could not delete entitlement of %s to app %s: %v\n", subjectOf(deleted[i].def), deleted[i].App, err)
+			failed++
+		} else {
+			ctx.Log.Info("Deleted entitlement of %s to app %s\n", subjectOf(deleted[i].def), deleted[i].App)
+		}
+	}
+	if !opts.DryRun {
+		ctx.Log.Info("Orphaned entitlements deleted: %d, failed: %d\n", len(ops)-failed, failed)
+	}
+	if failed > 0 {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
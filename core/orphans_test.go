@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"strings"
+	"testing"
+)
+
+// orphanPaths are the paths of a tenant with apps sledge and castle both
+// entitled to user 1, deleted user 2 and group 10 whose lookup fails.
+func orphanPaths(lookups *int) map[string]TstHandler {
+	counted := func(h TstHandler) TstHandler {
+		return func(t *testing.T, req *TstReq) *TstReply {
+			*lookups++
+			return h(t, req)
+		}
+	}
+	return map[string]TstHandler{
+		"POST/catalogitems/search?startIndex=0&pageSize=100": GoodPathHandler(`{"items": [
+			{"name": "sledge", "uuid": "app-1"}, {"name": "castle", "uuid": "app-2"}]}`),
+		"GET/entitlements/definitions/catalogitems/app-1": GoodPathHandler(`{"items": [
+			{"subjectType": "USERS", "subjectId": "1"}, {"subjectType": "USERS", "subjectId": "2"}]}`),
+		"GET/entitlements/definitions/catalogitems/app-2": GoodPathHandler(`{"items": [
+			{"subjectType": "USERS", "subjectId": "2"}, {"subjectType": "GROUPS", "subjectId": "10"}]}`),
+		"GET/scim/Users/1?attributes=id":   counted(GoodPathHandler(`{"id": "1"}`)),
+		"GET/scim/Users/2?attributes=id":   counted(ErrorHandler(404, "no such user")),
+		"GET/scim/Groups/10?attributes=id": counted(ErrorHandler(503, "down")),
+	}
+}
+
+func TestOrphanedEntitlementsAreReported(t *testing.T) {
+	lookups := 0
+	ctx := NewReplayContext(t, orphanPaths(&lookups))
+	ctx.MaxAttempts = 1
+	OrphanedEntitlements(ctx, OrphanOptions{})
+	assert.Equal(t, 3, lookups, "each subject is looked up once")
+	assert.Contains(t, ctx.Log.InfoString(), "- app: sledge\n  subjectType: USERS\n  subjectId: \"2\"\n  status: orphaned\n")
+	assert.Contains(t, ctx.Log.InfoString(), "- app: castle\n  subjectType: USERS\n  subjectId: \"2\"\n  status: orphaned\n")
+	assert.Contains(t, ctx.Log.InfoString(), "- app: castle\n  subjectType: GROUPS\n  subjectId: \"10\"\n"+
+		"  status: unknown (lookup failed)\n")
+	assert.NotContains(t, ctx.Log.InfoString(), `subjectId: "1"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Entitlements: 4, orphaned: 2, unknown (lookup failed): 1\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestCleanDeletesOnlyOrphanedEntitlements(t *testing.T) {
+	paths := orphanPaths(new(int))
+	paths["POST/entitlements/definitions"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"returnPayloadOnError":true,"operations":[`+
+			`{"method":"DELETE","data":{"catalogItemId":"app-1","subjectType":"USERS","subjectId":"2"}},`+
+			`{"method":"DELETE","data":{"catalogItemId":"app-2","subjectType":"USERS","subjectId":"2"}}]}`, req.Input)
+		return &TstReply{Output: EntitlementBulkResponse(200, 200)}
+	}
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	OrphanedEntitlements(ctx, OrphanOptions{Clean: true, Force: true})
+	assert.Contains(t, ctx.Log.InfoString(), "Deleted entitlement of user 2 to app sledge\n"+
+		"Deleted entitlement of user 2 to app castle\nOrphaned entitlements deleted: 2, failed: 0\n")
+}
+
+func TestCleanAsksForConfirmation(t *testing.T) {
+	ctx := NewReplayContext(t, orphanPaths(new(int)))
+	ctx.MaxAttempts, ctx.Log.InR = 1, strings.NewReader("n\n")
+	OrphanedEntitlements(ctx, OrphanOptions{Clean: true})
+	assert.Contains(t, ctx.Log.InfoString(), "Delete 2 orphaned entitlements of "+ctx.HostURL+"? [y/N]: "+
+		"No entitlements deleted\n")
+}
+
+func TestCleanDryRunDeletesNothing(t *testing.T) {
+	ctx := NewReplayContext(t, orphanPaths(new(int)))
+	ctx.MaxAttempts = 1
+	OrphanedEntitlements(ctx, OrphanOptions{Clean: true, DryRun: true})
+	assert.Contains(t, ctx.Log.InfoString(), "Would delete entitlement of user 2 to app sledge\n"+
+		"Would delete entitlement of user 2 to app castle\n")
+	assert.NotContains(t, ctx.Log.InfoString(), "Orphaned entitlements deleted")
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	pageSizeKey    = "pageSize"
+	pageClampedKey = "pageClamped"
+)
+
+// SetPageSize sets how many SCIM resources are requested per page, the
+// default if size is not positive.
+func SetPageSize(ctx *HttpContext, size int) {
+	ctx.SetValue(pageSizeKey, size)
+}
+
+func pageSize(ctx *HttpContext) int {
+	if size, _ := ctx.Value(pageSizeKey, nil); size != nil && size.(int) > 0 {
+		return size.(int)
+	}
+	return scimPageSize
+}
+
+// scimPage is a page of a SCIM search
+type scimPage struct {
+	Resources                  []json.RawMessage
+	TotalResults, ItemsPerPage int
+	hasTotal                   bool // the tenant gave totalResults
+}
+
+// UnmarshalJSON decodes a page, which must be a SCIM list response with
+// Resources or totalResults, so that a response of another kind is not taken
+// for an empty page.
+func (p *scimPage) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("not a SCIM list response: %v", err)
+	}
+	listed := false
+	for k := range fields {
+		p.hasTotal = p.hasTotal || strings.EqualFold(k, "totalResults")
+		listed = listed || strings.EqualFold(k, "Resources") || p.hasTotal
+	}
+	if !listed {
+		return errors.New("not a SCIM list response, it has no Resources or totalResults")
+	}
+	type page scimPage // without this method
+	return json.Unmarshal(data, (*page)(p))
+}
+
+// scimPages calls fn with each page of the resources of a type got with the
+// query, until limit resources are got if limit is positive. The first page
+// is requested with the startIndex of the query, if any, and the count of
+// the query, which the next pages are requested with too. Tenants may return
+// fewer resources than requested, so the totalResults of the server is
+// trusted to request more pages, but not alone: pages are requested until
+// one is empty, or is short and starts after the total. Without a total, a
+// short page is the last unless the tenant says with itemsPerPage that it
+// returns fewer per page than requested, then pages are requested until one
+// is empty.
+func scimPages(ctx *HttpContext, resType string, vals url.Values, limit int,
+	fn func(resources []scimResource) error) error {
+	requested, _ := strconv.Atoi(vals.Get("count"))
+	for start, got := 1, 0; ; {
+		if start > 1 {
+			vals.Set("startIndex", strconv.Itoa(start))
+		}
+		page := &scimPage{}
+		if err := ctx.Accept("json").Request("GET", fmt.Sprintf("scim/%s?%s", resType, vals.Encode()), nil,
+			page); err != nil {
+			return err
+		}
+		resources, err := decodeResources(resType, page.Resources)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && got+len(resources) > limit {
+			resources = resources[:limit-got]
+		}
+		if err := fn(resources); err != nil {
+			return err
+		}
+		start, got = start+len(page.Resources), got+len(resources)
+		short := requested == 0 || len(page.Resources) < requested
+		clamped := !page.hasTotal && page.ItemsPerPage > 0 && page.ItemsPerPage < requested
+		if len(page.Resources) == 0 || limit > 0 && got >= limit || short && start > page.TotalResults && !clamped {
+			return nil
+		}
+		if requested > 0 && len(page.Resources) < requested {
+			reportClamped(ctx, resType, requested, page)
+		}
+	}
+}
+
+// reportClamped says once that the tenant returns fewer resources per page
+// than requested, which costs more requests.
+func reportClamped(ctx *HttpContext, resType string, requested int, page *scimPage) {
+	if reported, _ := ctx.Value(pageClampedKey, nil); reported != nil {
+		return
+	}
+	ctx.SetValue(pageClampedKey, true)
+	perPage := page.ItemsPerPage
+	if perPage <= 0 || perPage >= requested {
+		perPage = len(page.Resources)
+	}
+	ctx.Log.Debug("The tenant returns at most %d %s per page rather than the %d requested, "+
+		"getting the others with more requests\n", perPage, resType, requested)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"strings"
+	"testing"
+)
+
+func TestGetByNameGetsAllPagesWhenTenantClampsThem(t *testing.T) {
+	const search = "GET/scim/Users?attributes=id%2CuserName%2Cmeta&count=3&filter=userName+eq+%22bob%22"
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		search:                   GoodPathHandler(ScimUsersPage(1, 3, "bob", "Bob")),
+		search + "&startIndex=3": GoodPathHandler(ScimUsersPage(3, 3, "BOB")),
+	})
+	ctx.Log.Level = LDebug
+	SetPageSize(ctx, 3)
+	_, err := scimGetByName(ctx, "Users", "userName", "bob", "id", "userName", "meta")
+	assert.Contains(t, err.Error(), `multiple Users found named "bob"`)
+	assert.Equal(t, 1, strings.Count(ctx.Log.InfoString(),
+		"The tenant returns at most 2 Users per page rather than the 3 requested"))
+}
+
+func TestListStopsAtCountWhenTenantClampsPages(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Groups?count=3":              GoodPathHandler(ScimUsersPage(1, 9, "a", "b")),
+		"GET/scim/Groups?count=3&startIndex=3": GoodPathHandler(ScimUsersPage(3, 9, "c", "d")),
+	})
+	scimList(ctx, ListOptions{Count: 3}, "Groups")
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "userName: c")
+	assert.NotContains(t, ctx.Log.InfoString(), "userName: d")
+}
+
+func TestForEachUsesPageSizeOfContext(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Users?count=2&startIndex=1": GoodPathHandler(ScimUsersPage(1, 3, "a", "b")),
+		"GET/scim/Users?count=2&startIndex=3": GoodPathHandler(ScimUsersPage(3, 3, "c")),
+	})
+	SetPageSize(ctx, 2)
+	var names []string
+	assert.Nil(t, scimForEach(ctx, "Users", "", nil, func(resource scimResource) error {
+		names = append(names, resource.name("userName"))
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+func TestMalformedSearchResponsesAreErrors(t *testing.T) {
+	const search = "GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22bob%22"
+	for _, tc := range []struct {
+		reply    *TstReply
+		expected string
+	}{
+		{&TstReply{Output: "<html><body>Sign in</body></html>", ContentType: "text/html"},
+			"expected JSON but got text/html: <html><body>Sign in</body></html>"},
+		{&TstReply{Output: `{}`}, "not a SCIM list response, it has no Resources or totalResults: {}"},
+		{&TstReply{Output: `{"id": "1", "userName": "bob"}`}, "not a SCIM list response, it has no Resources"},
+		{&TstReply{Output: `[{"id": "1", "userName": "bob"}]`}, "not a SCIM list response: json: cannot unmarshal array"},
+		{&TstReply{Output: `"bob"`}, "not a SCIM list response: json: cannot unmarshal string"},
+		{&TstReply{Output: `{"totalResults": "many"}`}, "cannot unmarshal string"},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": "bob"}`}, "cannot unmarshal string"},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": [1]}`},
+			"unexpected Users resource in the response: json: cannot unmarshal number"},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": [{"id": 1, "userName": "bob"}]}`},
+			`unexpected Users resource in the response: json: cannot unmarshal number into Go struct field ` +
+				`userAccount.id of type string: {"id": 1, "userName": "bob"}`},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": [{"userName": "bob"}]}`},
+			`no id returned for "bob": {"userName":"bob"}`},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": [null]}`}, `no Users found named "bob"`},
+		{&TstReply{Output: `{"totalResults": 1, "Resources": [{"id": "1", "userName": "bob"}`},
+			"unexpected end of JSON input"},
+	} {
+		reply := tc.reply
+		ctx := NewReplayContext(t, map[string]TstHandler{search: func(t *testing.T, req *TstReq) *TstReply {
+			return reply
+		}})
+		assert.NotPanics(t, func() {
+			_, err := scimGetID(ctx, "Users", "userName", "bob")
+			if assert.NotNil(t, err, reply.Output) {
+				assert.Contains(t, err.Error(), tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"unicode"
+)
+
+// context value keys of the password policy and of whether it is enforced
+const (
+	passwordPolicyKey  = "passwordPolicy"
+	policyEnforcedKey  = "passwordPolicyEnforced"
+	passwordPolicyPath = "tenants/tenant/passwordpolicy"
+)
+
+// passwordPolicy is the password policy of the tenant. Zero values mean that
+// there is no such rule. The number of previous passwords that cannot be
+// reused (History) can only be checked by the server.
+type passwordPolicy struct {
+	MinLen                            int `json:"minLen"`
+	MaxLen                            int `json:"maxLen"`
+	MinLower                          int `json:"minLower"`
+	MinUpper                          int `json:"minUpper"`
+	MinDigit                          int `json:"minDigit"`
+	MinSpecial                        int `json:"minSpecial"`
+	History                           int `json:"history"`
+	MaxConsecutiveIdenticalCharacters int `json:"maxConsecutiveIdenticalCharacters"`
+}
+
+// EnforcePasswordPolicy makes the commands run with the context check that
+// passwords follow the password policy of the tenant before sending them.
+// The policy is only requested if a password is set.
+func EnforcePasswordPolicy(ctx *HttpContext) {
+	ctx.SetValue(policyEnforcedKey, true)
+}
+
+// getPasswordPolicy gets the password policy of the tenant once per command.
+// It returns nil without error if the tenant has none.
+func getPasswordPolicy(ctx *HttpContext) (*passwordPolicy, error) {
+	policy, err := ctx.Value(passwordPolicyKey, func() (interface{}, error) {
+		policy := &passwordPolicy{}
+		err := ctx.Accept("tenants.tenant.passwordpolicy").Request("GET", passwordPolicyPath, nil, policy)
+		if IsNotFound(err) {
+			ctx.Log.Debug("Tenant has no password policy\n")
+			return (*passwordPolicy)(nil), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get the password policy of the tenant, "+
+				"use --skip-policy-check to let the server check the password: %v", err)
+		}
+		return policy, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policy.(*passwordPolicy), nil
+}
+
+// checkPassword returns an error naming the first rule of the password policy
+// of the tenant that the password does not follow, if the policy is enforced.
+func checkPassword(ctx *HttpContext, pwd string) error {
+	if enforced, _ := ctx.Value(policyEnforcedKey, nil); enforced != true {
+		return nil
+	}
+	policy, err := getPasswordPolicy(ctx)
+	if err != nil || policy == nil {
+		return err
+	}
+	return policy.check(pwd)
+}
+
+// check returns an error naming the first rule that the password does not follow.
+func (p *passwordPolicy) check(pwd string) error {
+	var length, lower, upper, digit, special, run, maxRun int
+	var prev rune
+	for i, c := range pwd {
+		length++
+		switch {
+		case unicode.IsLower(c):
+			lower++
+		case unicode.IsUpper(c):
+			upper++
+		case unicode.IsDigit(c):
+			digit++
+		default:
+			special++
+		}
+		if i > 0 && c == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > maxRun {
+			maxRun = run
+		}
+		prev = c
+	}
+	rules := []struct {
+		ok    bool
+		rule  string
+		limit int
+	}{
+		{length >= p.MinLen, "at least %d characters", p.MinLen},
+		{p.MaxLen <= 0 || length <= p.MaxLen, "at most %d characters", p.MaxLen},
+		{lower >= p.MinLower, "at least %d lowercase letters", p.MinLower},
+		{upper >= p.MinUpper, "at least %d uppercase letters", p.MinUpper},
+		{digit >= p.MinDigit, "at least %d digits", p.MinDigit},
+		{special >= p.MinSpecial, "at least %d special characters", p.MinSpecial},
+		{p.MaxConsecutiveIdenticalCharacters <= 0 || maxRun <= p.MaxConsecutiveIdenticalCharacters,
+			"at most %d consecutive identical characters", p.MaxConsecutiveIdenticalCharacters},
+	}
+	for _, r := range rules {
+		if !r.ok {
+			return fmt.Errorf("password does not follow the password policy of the tenant: it must have "+r.rule, r.limit)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const policyURL = "GET/" + passwordPolicyPath
+
+func policyHandler(calls *int, policy string) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		*calls++
+		assert.Contains(t, req.Accept, "tenants.tenant.passwordpolicy+json")
+		return &TstReply{Output: policy, ContentType: "application/json"}
+	}
+}
+
+func TestPasswordPolicyNamesTheViolatedRule(t *testing.T) {
+	policy := &passwordPolicy{MinLen: 8, MaxLen: 12, MinLower: 1, MinUpper: 1, MinDigit: 2, MinSpecial: 1,
+		MaxConsecutiveIdenticalCharacters: 2}
+	for pwd, rule := range map[string]string{
+		"Ab1!":           "at least 8 characters",
+		"Abcdefgh12!xyz": "at most 12 characters",
+		"ABCDEFG12!":     "at least 1 lowercase letters",
+		"abcdefg12!":     "at least 1 uppercase letters",
+		"Abcdefgh1!":     "at least 2 digits",
+		"Abcdefgh12":     "at least 1 special characters",
+		"Abcdddef12!":    "at most 2 consecutive identical characters",
+	} {
+		err := policy.check(pwd)
+		if assert.Error(t, err, pwd) {
+			assert.Contains(t, err.Error(), "must have "+rule, pwd)
+		}
+	}
+	assert.NoError(t, policy.check("Abcddef12!"))
+	assert.NoError(t, (&passwordPolicy{}).check(""))
+}
+
+func TestSetPasswordIsNotSentIfItViolatesPolicy(t *testing.T) {
+	calls := 0
+	ctx := NewReplayContext(t, map[string]TstHandler{policyURL: policyHandler(&calls, `{"minLen": 10}`)})
+	EnforcePasswordPolicy(ctx)
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "travolta"})
+	AssertOnlyErrorContains(t, ctx, `Error updating user "john": password does not follow the password `+
+		"policy of the tenant: it must have at least 10 characters")
+}
+
+func TestSetPasswordThatFollowsPolicy(t *testing.T) {
+	calls := 0
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		policyURL:               policyHandler(&calls, `{"minLen": 6, "minDigit": 1, "history": 5}`),
+		DEFAULT_GET_USER_URL:    scimDefaultUserHandler(),
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply { return &TstReply{Status: 204} }})
+	EnforcePasswordPolicy(ctx)
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "travolta1"})
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+}
+
+func TestPasswordPolicyIsNotCheckedUnlessEnforced(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:    scimDefaultUserHandler(),
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply { return &TstReply{Status: 204} }})
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "x"})
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+}
+
+func TestTenantWithoutPasswordPolicy(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		policyURL:               ErrorHandler(404, "no policy"),
+		DEFAULT_GET_USER_URL:    scimDefaultUserHandler(),
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply { return &TstReply{Status: 204} }})
+	EnforcePasswordPolicy(ctx)
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &BasicUser{Pwd: "x"})
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+}
+
+func TestPasswordPolicyErrorSuggestsSkippingCheck(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{policyURL: ErrorHandler(403, "forbidden")})
+	EnforcePasswordPolicy(ctx)
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "john", Pwd: "travolta"})
+	AssertOnlyErrorContains(t, ctx, "Error creating user 'john': could not get the password policy of the "+
+		"tenant, use --skip-policy-check")
+}
+
+func TestForbiddenPasswordPolicyWithScopeHint(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{policyURL: ErrorHandler(403, "forbidden")})
+	SetTokenScopes(ctx.Authorization("Bearer opaque"), "", "openid")
+	EnforcePasswordPolicy(ctx)
+	done := make(chan error)
+	go func() { done <- checkPassword(ctx, "travolta") }()
+	select {
+	case err := <-done:
+		assert.Contains(t, err.Error(), "could not get the password policy of the tenant")
+		assert.Contains(t, err.Error(), "access token only has openid")
+	case <-time.After(5 * time.Second):
+		t.Fatal("password check did not return after the password policy was refused")
+	}
+}
+
+func TestLoadUsersGetsPasswordPolicyOnceAndSkipsViolations(t *testing.T) {
+	calls, added := 0, []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		policyURL: policyHandler(&calls, `{"minLen": 8, "minUpper": 1}`),
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			added = append(added, req.Input)
+			return &TstReply{Output: `{"id": "1"}`}
+		}})
+	EnforcePasswordPolicy(ctx)
+	usersFile := WriteTempFile(t, "---\n- {name: joe, pwd: Changeme}\n- {name: sue, pwd: changeme}\n"+
+		"- {name: bob}\n- {name: ann, pwd: Changeme2}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Equal(t, 1, calls)
+	assert.Len(t, added, 3)
+	assert.False(t, strings.Contains(strings.Join(added, ""), `"sue"`))
+	assert.Contains(t, ctx.Log.ErrString(), "Error creating user 'sue': password does not follow the password "+
+		"policy of the tenant: it must have at least 1 uppercase letters")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 3, failed: 1, not attempted: 0")
+}
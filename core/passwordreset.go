@@ -0,0 +1,344 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ResetOptions are the options of a bulk password reset
+type ResetOptions struct {
+	Generate   bool   // generate random passwords for a file of user names
+	Output     string // file where generated passwords are written, <fileName>.passwords.csv if empty
+	Parallel   int    // maximum number of users reset at the same time
+	BestEffort bool   // reset the users that pass the pre-flight checks even if others do not
+	Force      bool   // do not ask for confirmation
+}
+
+// passwordReset is the reset of the password of a user
+type passwordReset struct {
+	name, pwd, id string
+	err           error
+}
+
+// characters of generated passwords, by class
+var passwordClasses = []string{"abcdefghijkmnopqrstuvwxyz", "ABCDEFGHJKLMNPQRSTUVWXYZ", "23456789", "!#%+-=?@^_"}
+
+// generatedPasswordLen is the length of generated passwords unless the policy requires more
+const generatedPasswordLen = 16
+
+// ResetPasswords sets the passwords of the users of a CSV file of user names
+// and passwords, or with opts.Generate of a file of user names as read by
+// DeleteUsers, in which case random passwords are written to opts.Output.
+// Pre-flight checks look up all users and check their passwords before any
+// is reset, and stop the command if one fails unless opts.BestEffort is set.
+// The users whose password could not be reset are saved in a file of the
+// same format so that they can be reset again. Passwords are never logged.
+func ResetPasswords(ctx *HttpContext, fileName string, opts ResetOptions) {
+	resets, err := readPasswordResets(fileName, opts.Generate)
+	if err != nil {
+		ctx.Log.Err("could not read file of passwords to reset: %v\n", err)
+		return
+	}
+	if opts.Generate {
+		if opts.Output == "" {
+			opts.Output = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".passwords.csv"
+		}
+		if _, err := os.Stat(opts.Output); err == nil || !os.IsNotExist(err) {
+			ctx.Log.Err("Output file %s for generated passwords already exists or cannot be created\n", opts.Output)
+			return
+		}
+	}
+	if _, err := mustChangePatch(ctx); err != nil {
+		ctx.Log.Err("No passwords reset: %v\n", err)
+		return
+	}
+	failed := preflightResets(ctx, resets, opts)
+	if failed > 0 && !opts.BestEffort {
+		ctx.Log.Err("No passwords reset, %d of %d users failed the pre-flight checks, "+
+			"use --best-effort to reset the others\n", failed, len(resets))
+		return
+	}
+	ready := len(resets) - failed
+	if ready > 0 && !opts.Force && !ctx.Log.Confirm("Reset passwords of %d users of %s?", ready, ctx.HostURL) {
+		ctx.Log.Info("No passwords reset\n")
+		return
+	}
+	var output *csv.Writer
+	if opts.Generate && ready > 0 {
+		f, err := os.OpenFile(opts.Output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			ctx.Log.Err("Could not create output file for generated passwords: %v\n", err)
+			return
+		}
+		defer f.Close()
+		output = csv.NewWriter(f)
+		output.Write([]string{"userName", "password"})
+		output.Flush()
+	}
+	reset, skipped, mutex := 0, 0, sync.Mutex{}
+	progress := ctx.Log.StartProgress("Passwords reset", ready)
+	forEachParallel(ctx, len(resets), opts.Parallel, func(ctx *HttpContext, i int) {
+		r := &resets[i]
+		if r.err != nil {
+			return
+		}
+		if ctx.Canceled() {
+			r.err = errNotAttempted
+		} else {
+			r.err = resetPassword(ctx, r)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.err == nil && output != nil {
+			output.Write([]string{r.name, r.pwd})
+			if output.Flush(); output.Error() != nil {
+				// the password is lost, so the user is reset again by the next run
+				r.err = fmt.Errorf("password reset but not saved to %s: %v", opts.Output, output.Error())
+				ctx.Log.Err("Could not write generated password of user \"%s\" to %s: %v\n", r.name, opts.Output,
+					output.Error())
+			}
+		}
+		switch {
+		case r.err == nil:
+			reset++
+		case r.err == errNotAttempted:
+			skipped++
+			return
+		default:
+			failed++
+		}
+		progress.Add(1)
+	})
+	progress.Finish()
+	ctx.Log.Info("Passwords reset: %d, failed: %d, not attempted: %d\n", reset, failed, skipped)
+	if output != nil && reset > 0 {
+		ctx.Log.Info("Generated passwords are saved in %s\n", opts.Output)
+	}
+	if failed > 0 || skipped > 0 {
+		ctx.Log.Fail(ExitPartial)
+		saveFailedResets(ctx, fileName, resets, opts.Generate)
+	}
+}
+
+// readPasswordResets reads the user names and passwords of a CSV file, or
+// only the user names of a file if the passwords are generated.
+func readPasswordResets(fileName string, generate bool) (resets []passwordReset, err error) {
+	if generate {
+		names, err := readUserNames(fileName)
+		for _, name := range names {
+			resets = append(resets, passwordReset{name: name})
+		}
+		return resets, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord, r.Comment, r.TrimLeadingSpace = -1, '#', true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for i, record := range records {
+		name := strings.TrimSpace(record[0])
+		if i == 0 && (CaselessEqual(name, "userName") || CaselessEqual(name, "name")) || name == "" {
+			continue
+		}
+		// the error must not include the record, which may have a password
+		if len(record) < 2 || record[1] == "" {
+			return nil, fmt.Errorf("no password for user \"%s\" on line %d of %s, use --generate "+
+				"for a file of user names", name, i+1, fileName)
+		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("user \"%s\" is repeated on line %d of %s", name, i+1, fileName)
+		}
+		seen[strings.ToLower(name)] = true
+		resets = append(resets, passwordReset{name: name, pwd: record[1]})
+	}
+	if len(resets) == 0 {
+		return nil, fmt.Errorf("no user names and passwords in %s", fileName)
+	}
+	return resets, nil
+}
+
+// preflightResets looks up the ID of each user, generates or checks its
+// password, and returns how many users failed.
+func preflightResets(ctx *HttpContext, resets []passwordReset, opts ResetOptions) (failed int) {
+	mutex := sync.Mutex{}
+	forEachParallel(ctx, len(resets), opts.Parallel, func(ctx *HttpContext, i int) {
+		r := &resets[i]
+		if r.id, r.err = scimGetID(ctx, "Users", "userName", r.name); r.err == nil {
+			if opts.Generate {
+				r.pwd, r.err = generatePassword(ctx)
+			} else {
+				r.err = checkPassword(ctx, r.pwd)
+			}
+		}
+		if r.err != nil {
+			ctx.Log.Err("Pre-flight check of user \"%s\" failed: %v\n", Named("Users", r.name), r.err)
+			mutex.Lock()
+			failed++
+			mutex.Unlock()
+		}
+	})
+	return
+}
+
+// resetPassword sets the password of a user that passed the pre-flight checks
+func resetPassword(ctx *HttpContext, r *passwordReset) error {
+	extra, err := mustChangePatch(ctx)
+	if err == nil {
+		acct := userAccount{Schemas: []string{coreSchemaURN}, Password: r.pwd}
+		err = scimPatch(ctx, "Users", r.id, withAttributes(&acct, extra))
+	}
+	if err != nil {
+		ctx.Log.Err("Error resetting password of user \"%s\": %v\n", Named("Users", r.name), err)
+	} else {
+		ctx.Log.Info("Password of user \"%s\" reset%s\n", Named("Users", r.name), mustChangeNote(extra))
+	}
+	return err
+}
+
+// saveFailedResets saves the users whose password was not reset in a file
+// of the same format as the file read, with their passwords unless they
+// were generated.
+func saveFailedResets(ctx *HttpContext, fileName string, resets []passwordReset, generated bool) {
+	failFile, records := failureFileName(fileName), [][]string{}
+	for _, r := range resets {
+		if r.err != nil && generated {
+			records = append(records, []string{r.name})
+		} else if r.err != nil {
+			records = append(records, []string{r.name, r.pwd})
+		}
+	}
+	var err error
+	if ext := strings.ToLower(filepath.Ext(fileName)); generated && (ext == ".yaml" || ext == ".yml") {
+		names := make([]string, len(records))
+		for i, record := range records {
+			names[i] = record[0]
+		}
+		err = PutYamlFile(failFile, names)
+	} else {
+		err = writeCSVFile(failFile, records)
+	}
+	if err != nil {
+		ctx.Log.Err("could not save users whose password was not reset: %v\n", err)
+	} else {
+		ctx.Log.Info("Users whose password was not reset are saved in %s\n", failFile)
+	}
+}
+
+// writeCSVFile writes records to a file that only its owner can read
+func writeCSVFile(fileName string, records [][]string) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(records)
+	if err = w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// generatePassword returns a random password with characters of each class,
+// that follows the password policy of the tenant if it is enforced.
+func generatePassword(ctx *HttpContext) (string, error) {
+	policy := &passwordPolicy{}
+	if enforced, _ := ctx.Value(policyEnforcedKey, nil); enforced == true {
+		if p, err := getPasswordPolicy(ctx); err != nil {
+			return "", err
+		} else if p != nil {
+			policy = p
+		}
+	}
+	counts := []int{policy.MinLower, policy.MinUpper, policy.MinDigit, policy.MinSpecial}
+	for i := range counts {
+		if counts[i] < 1 {
+			counts[i] = 1
+		}
+	}
+	pwd := []byte{}
+	for i, class := range passwordClasses {
+		for j := 0; j < counts[i]; j++ {
+			c, err := randomChar(class)
+			if err != nil {
+				return "", err
+			}
+			pwd = append(pwd, c)
+		}
+	}
+	for len(pwd) < generatedPasswordLen || len(pwd) < policy.MinLen {
+		c, err := randomChar(strings.Join(passwordClasses, ""))
+		if err != nil {
+			return "", err
+		}
+		pwd = append(pwd, c)
+	}
+	for i := len(pwd) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		pwd[i], pwd[j.Int64()] = pwd[j.Int64()], pwd[i]
+	}
+	return string(pwd), policy.check(string(pwd))
+}
+
+func randomChar(chars string) (byte, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i.Int64()], nil
+}
+
+// forEachParallel calls fn with the index of each of n items, from at most
+// parallel goroutines that each have their own copy of the context.
+func forEachParallel(ctx *HttpContext, n, parallel int, fn func(ctx *HttpContext, i int)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	indexes, wg := make(chan int), sync.WaitGroup{}
+	for w := 0; w < parallel && w < n; w++ {
+		wg.Add(1)
+		go func(ctx *HttpContext) {
+			defer wg.Done()
+			for i := range indexes {
+				fn(ctx, i)
+			}
+		}(ctx.Clone())
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func getUserIDURL(name string) string {
+	return "GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22" + name + "%22"
+}
+
+// resetPaths answers the lookups of the named users and records the
+// passwords set by user name, requests may be concurrent
+func resetPaths(passwords map[string]string, names ...string) map[string]TstHandler {
+	mutex, paths := &sync.Mutex{}, map[string]TstHandler{}
+	for _, name := range names {
+		name := name
+		paths[getUserIDURL(name)] = GoodPathHandler(ScimUsersPage(1, 1, name))
+		paths["POST/scim/Users/"+ScimID(name)] = func(t *testing.T, req *TstReq) *TstReply {
+			acct := userAccount{}
+			assert.NoError(t, json.Unmarshal([]byte(req.Input), &acct))
+			mutex.Lock()
+			defer mutex.Unlock()
+			passwords[name] = acct.Password
+			return &TstReply{Status: 204}
+		}
+	}
+	return paths
+}
+
+func resetFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "priam-reset")
+	assert.NoError(t, err)
+	fileName := dir + "/" + name
+	assert.NoError(t, ioutil.WriteFile(fileName, []byte(content), 0600))
+	return fileName, func() { os.RemoveAll(dir) }
+}
+
+func TestResetPasswordsFromCSV(t *testing.T) {
+	passwords := map[string]string{}
+	ctx := NewReplayContext(t, resetPaths(passwords, "joe", "sue", "bob"))
+	fileName, cleanup := resetFile(t, "users.csv", "userName,password\njoe,secret1\nsue, secret2\n# bob\nbob,secret3\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{Parallel: 3, Force: true})
+	assert.Equal(t, map[string]string{"joe": "secret1", "sue": "secret2",
+		"bob": "secret3"}, passwords)
+	AssertOnlyInfoContains(t, ctx, "Passwords reset: 3, failed: 0, not attempted: 0")
+	assert.Contains(t, ctx.Log.InfoString(), `Password of user "sue" reset`)
+	assert.NotContains(t, ctx.Log.InfoString(), "secret")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+	_, err := os.Stat(failureFileName(fileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResetPasswordsStopsIfPreflightFails(t *testing.T) {
+	paths := resetPaths(map[string]string{})
+	paths[getUserIDURL("joe")] = GoodPathHandler(ScimUsersPage(1, 1, "joe"))
+	paths[getUserIDURL("ann")] = GoodPathHandler(`{"Resources": []}`)
+	ctx := NewReplayContext(t, paths)
+	fileName, cleanup := resetFile(t, "users.csv", "joe,secret1\nann,secret2\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{Force: true})
+	assert.Contains(t, ctx.Log.ErrString(), `Pre-flight check of user "ann" failed: no Users found named "ann"`)
+	assert.Contains(t, ctx.Log.ErrString(), "No passwords reset, 1 of 2 users failed the pre-flight checks")
+	assert.NotContains(t, ctx.Log.ErrString(), "secret")
+}
+
+func TestResetPasswordsBestEffortSavesFailuresToRetry(t *testing.T) {
+	passwords := map[string]string{}
+	paths := resetPaths(passwords, "joe", "sue")
+	paths[getUserIDURL("ann")] = GoodPathHandler(`{"Resources": []}`)
+	paths["POST/scim/Users/sue-id"] = ErrorHandler(400, "bad password")
+	ctx := NewReplayContext(t, paths)
+	fileName, cleanup := resetFile(t, "users.csv", "joe,secret1\nann,secret2\nsue,secret3\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{BestEffort: true, Force: true})
+	assert.Equal(t, map[string]string{"joe": "secret1"}, passwords)
+	assert.Contains(t, ctx.Log.InfoString(), "Passwords reset: 1, failed: 2, not attempted: 0")
+	assert.Contains(t, ctx.Log.ErrString(), `Error resetting password of user "sue": 400`)
+	retry, err := ioutil.ReadFile(failureFileName(fileName))
+	assert.NoError(t, err)
+	assert.Equal(t, "ann,secret2\nsue,secret3\n", string(retry))
+}
+
+func TestResetPasswordsThatFailsWhileInterruptedIsFailed(t *testing.T) {
+	stopContext, stop := context.WithCancel(context.Background())
+	defer stop()
+	paths := resetPaths(map[string]string{}, "joe", "sue")
+	paths["POST/scim/Users/"+ScimID("joe")] = func(t *testing.T, req *TstReq) *TstReply {
+		stop()
+		return &TstReply{Status: 400}
+	}
+	ctx := NewReplayContext(t, paths)
+	ctx.WithStop(stopContext)
+	fileName, cleanup := resetFile(t, "users.csv", "joe,secret1\nsue,secret2\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{Parallel: 1, Force: true})
+	assert.Contains(t, ctx.Log.InfoString(), "Passwords reset: 0, failed: 1, not attempted: 1")
+	retry, err := ioutil.ReadFile(failureFileName(fileName))
+	assert.NoError(t, err)
+	assert.Equal(t, "joe,secret1\nsue,secret2\n", string(retry))
+}
+
+func TestResetPasswordsAsksForConfirmation(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{getUserIDURL("joe"): GoodPathHandler(ScimUsersPage(1, 1, "joe"))})
+	ctx.Log.InR = strings.NewReader("n\n")
+	fileName, cleanup := resetFile(t, "users.csv", "joe,secret1\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{})
+	assert.Contains(t, ctx.Log.InfoString(), "No passwords reset")
+}
+
+func TestResetPasswordsWithGeneratedPasswords(t *testing.T) {
+	passwords, calls := map[string]string{}, 0
+	paths := resetPaths(passwords, "joe", "sue")
+	paths[policyURL] = policyHandler(&calls, `{"minLen": 20, "minDigit": 3}`)
+	ctx := NewReplayContext(t, paths)
+	EnforcePasswordPolicy(ctx)
+	fileName, cleanup := resetFile(t, "users.txt", "joe\nsue\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{Generate: true, Parallel: 2, Force: true})
+	AssertOnlyInfoContains(t, ctx, "Passwords reset: 2, failed: 0, not attempted: 0")
+	output := strings.TrimSuffix(fileName, ".txt") + ".passwords.csv"
+	assert.Contains(t, ctx.Log.InfoString(), "Generated passwords are saved in "+output)
+	content, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, "userName,password", lines[0])
+	assert.ElementsMatch(t, []string{"joe," + passwords["joe"], "sue," + passwords["sue"]}, lines[1:])
+	assert.Len(t, passwords["joe"], 20)
+	assert.NotEqual(t, passwords["joe"], passwords["sue"])
+	assert.NotContains(t, ctx.Log.InfoString(), passwords["joe"])
+	info, err := os.Stat(output)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, 1, calls)
+}
+
+func TestResetPasswordsDoesNotOverwriteGeneratedPasswords(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	fileName, cleanup := resetFile(t, "users.txt", "joe\n")
+	defer cleanup()
+	output := fileName + ".out"
+	assert.NoError(t, ioutil.WriteFile(output, []byte("joe,old\n"), 0600))
+	ResetPasswords(ctx, fileName, ResetOptions{Generate: true, Output: output, Force: true})
+	AssertOnlyErrorContains(t, ctx, "Output file "+output+" for generated passwords already exists")
+}
+
+func TestResetPasswordsFailsIfPasswordIsMissing(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	fileName, cleanup := resetFile(t, "users.csv", "joe,secret1\nsue\n")
+	defer cleanup()
+	ResetPasswords(ctx, fileName, ResetOptions{Force: true})
+	AssertOnlyErrorContains(t, ctx, `no password for user "sue" on line 2`)
+	assert.NotContains(t, ctx.Log.ErrString(), "secret1")
+}
+
+func TestGeneratedPasswordHasEachCharacterClass(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	pwd, err := generatePassword(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, pwd, generatedPasswordLen)
+	for _, class := range passwordClasses {
+		assert.True(t, strings.ContainsAny(pwd, class), class)
+	}
+}
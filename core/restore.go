@@ -0,0 +1,446 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/vmware/priam/util"
+	"path/filepath"
+	"strings"
+)
+
+// restoreCounts are the numbers of changes of one kind of resource
+type restoreCounts struct {
+	created, removed, skipped, failed int
+}
+
+// actions to prune the users of the tenant that are not in a backup
+const (
+	PruneDeactivate = "deactivate"
+	PruneDelete     = "delete"
+)
+
+// Options of Restore
+type RestoreOptions struct {
+	DryRun      bool   // only print the changes that would be made
+	PruneAction string // deactivate or delete the users that are not in the backup, none if empty
+	PruneFilter string // filter of the users that may be pruned, such as 'userName sw "x"'
+	// internal user type of the users that may be pruned, such as LOCAL, which
+	// must be set unless PruneAnyUserType is
+	PruneUserType    string
+	PruneAnyUserType bool
+	Force            bool // prune without asking for confirmation
+}
+
+// restorer applies a backup to the tenant. It knows the ids of the users and
+// groups of the tenant by lower case name, an empty id is a user or group
+// that is created by a dry run, or whose id was not returned when created.
+type restorer struct {
+	ctx                                      *HttpContext
+	dryRun                                   bool
+	ids                                      map[string]map[string]string
+	userNames                                map[string]string          // user names by id
+	members                                  map[string]map[string]bool // ids of members by group id
+	users, groups, memberships, entitlements restoreCounts
+	pruned                                   restoreCounts
+	patches                                  memberPatches
+}
+
+// Restore applies the files of a backup directory to the tenant. It creates
+// the users and groups that are missing, adds and removes the users of each
+// group so that they are the members listed in the backup, and creates the
+// entitlements that are missing, in that order. Anything that exists is
+// skipped, so that a second run changes nothing. Files that are not in the
+// directory are skipped. If a prune action is given, the users of the tenant
+// that are not in the backup are then deactivated or deleted, which is
+// refused if the backup has no users at all, or if the users that may be
+// pruned are not restricted to a user type unless any type is allowed, or if
+// a file of the backup could only be read in part. The users are pruned
+// after confirmation unless Force is set.
+func Restore(ctx *HttpContext, dir string, opts RestoreOptions) {
+	if opts.PruneAction != "" && opts.PruneAction != PruneDeactivate && opts.PruneAction != PruneDelete {
+		ctx.Log.Err("Invalid prune action \"%s\", it must be %s or %s\n", opts.PruneAction, PruneDeactivate, PruneDelete)
+		return
+	}
+	if opts.PruneAction != "" && opts.PruneUserType == "" && !opts.PruneAnyUserType {
+		ctx.Log.Err("Refusing to prune users of any type, such as users synced from a directory, restrict them " +
+			"with --user-type or give --i-know-what-im-doing\n")
+		return
+	}
+	state, err := readBackup(ctx, dir)
+	if err != nil {
+		ctx.Log.Err("Could not read %v\n", err)
+		return
+	}
+	if expected := rowCheckOf(ctx).ExpectAtLeast; len(state.Users) < expected {
+		ctx.Log.Err("Refusing to apply the backup, only %d users in %s, fewer than the %d expected\n",
+			len(state.Users), filepath.Join(dir, backupUsersFile), expected)
+		return
+	}
+	if opts.PruneAction != "" && len(state.Users) == 0 {
+		ctx.Log.Err("Refusing to prune users, there are no users in %s\n", filepath.Join(dir, backupUsersFile))
+		return
+	}
+	if opts.PruneAction != "" && len(state.partial) > 0 {
+		ctx.Log.Err("Refusing to prune users, only part of %s could be read\n", strings.Join(state.partial, ", "))
+		return
+	}
+	r := &restorer{ctx: ctx, dryRun: opts.DryRun, ids: make(map[string]map[string]string),
+		userNames: make(map[string]string), members: make(map[string]map[string]bool)}
+	if err := r.loadTenant(); err != nil {
+		ctx.Log.Err("Could not get users and groups of %s: %v\n", ctx.HostURL, err)
+		return
+	}
+	if opts.DryRun {
+		ctx.Log.Info("Dry run, no changes are made to %s\n", ctx.HostURL)
+	}
+	r.restoreUsers(state.Users)
+	r.restoreGroups(state.Groups)
+	r.restoreMembers(state.Groups)
+	r.restoreEntitlements(state.Entitlements)
+	if opts.PruneAction != "" {
+		r.pruneUsers(state.Users, opts.PruneAction, opts.PruneFilter, opts.PruneUserType, opts.Force)
+	}
+	ctx.Log.Info("Users created: %d, skipped: %d, failed: %d\n", r.users.created, r.users.skipped, r.users.failed)
+	ctx.Log.Info("Groups created: %d, skipped: %d, failed: %d\n", r.groups.created, r.groups.skipped, r.groups.failed)
+	ctx.Log.Info("Group members added: %d, removed: %d, skipped: %d, failed: %d\n", r.memberships.created,
+		r.memberships.removed, r.memberships.skipped, r.memberships.failed)
+	ctx.Log.Info("Entitlements created: %d, skipped: %d, failed: %d\n", r.entitlements.created,
+		r.entitlements.skipped, r.entitlements.failed)
+	if opts.PruneAction != "" {
+		ctx.Log.Info("Users pruned: %d, skipped: %d, failed: %d\n", r.pruned.removed, r.pruned.skipped, r.pruned.failed)
+	}
+	if r.patches.sent > 0 {
+		ctx.Log.Info("Group member patches sent: %d, split after 413 or timeout: %d\n", r.patches.sent, r.patches.split)
+	}
+	if r.users.failed+r.groups.failed+r.memberships.failed+r.entitlements.failed+r.pruned.failed > 0 || ctx.Canceled() {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
+
+// loadTenant gets the ids of all users and groups, and the members of groups
+func (r *restorer) loadTenant() error {
+	userIDs := make(map[string]string)
+	attrs := []string{"id", "userName"}
+	err := scimForEach(r.ctx, "Users", "", attrs, func(resource scimResource) error {
+		id, name := resource.id(), resource.name("userName")
+		userIDs[strings.ToLower(name)], r.userNames[id] = id, name
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	groupIDs := make(map[string]string)
+	attrs = []string{"id", "displayName", "members"}
+	err = scimForEach(r.ctx, "Groups", "", attrs, func(resource scimResource) error {
+		group, members := resource.(*typedGroup), make(map[string]bool)
+		groupIDs[strings.ToLower(group.DisplayName)] = group.Id
+		for _, member := range group.Members {
+			members[member.Value] = true
+		}
+		r.members[group.Id] = members
+		return nil
+	})
+	r.ids["Users"], r.ids["Groups"] = userIDs, groupIDs
+	return err
+}
+
+// id returns the id of a user or group, and whether it exists. The id of a
+// user or group that was created without returning its id is looked up.
+func (r *restorer) id(scimType, nameAttr, name string) (id string, exists bool, err error) {
+	if id, exists = r.ids[scimType][strings.ToLower(name)]; !exists || id != "" || r.dryRun {
+		return id, exists, nil
+	}
+	if id, err = scimGetID(r.ctx, scimType, nameAttr, name); err == nil {
+		r.ids[scimType][strings.ToLower(name)] = id
+	}
+	return id, true, err
+}
+
+func (r *restorer) restoreUsers(users []BasicUser) {
+	progress := r.ctx.Log.StartProgress("Users", len(users))
+	defer progress.Finish()
+	for i := range users {
+		if r.ctx.Canceled() {
+			return
+		}
+		if _, exists := r.ids["Users"][strings.ToLower(users[i].Name)]; exists {
+			r.users.skipped++
+		} else if r.dryRun {
+			r.ctx.Log.Plan("Would create user \"%s\"\n", Named("Users", users[i].Name))
+			r.ids["Users"][strings.ToLower(users[i].Name)] = ""
+			r.users.created++
+		} else if scimAddUser(r.ctx, &users[i]) {
+			r.ids["Users"][strings.ToLower(users[i].Name)] = ""
+			r.users.created++
+		} else {
+			r.users.failed++
+		}
+		progress.Add(1)
+	}
+}
+
+func (r *restorer) restoreGroups(groups []backupGroup) {
+	for _, group := range groups {
+		if r.ctx.Canceled() {
+			return
+		}
+		if _, exists := r.ids["Groups"][strings.ToLower(group.Name)]; exists {
+			r.groups.skipped++
+			continue
+		}
+		id := ""
+		if r.dryRun {
+			r.ctx.Log.Plan("Would create group \"%s\"\n", Named("Groups", group.Name))
+		} else {
+			var err error
+			if id, err = scimAddGroup(r.ctx, group.Name); err != nil {
+				r.ctx.Log.Err("Error creating group \"%s\": %v\n", Named("Groups", group.Name), err)
+				r.groups.failed++
+				continue
+			}
+			r.ctx.Log.Info("Created group \"%s\"\n", Named("Groups", group.Name))
+		}
+		r.ids["Groups"][strings.ToLower(group.Name)] = id
+		r.members[id] = make(map[string]bool)
+		r.groups.created++
+	}
+}
+
+// restoreMembers adds and removes the users of each group so that they are
+// the members of the backup. Members that are not users are not removed.
+func (r *restorer) restoreMembers(groups []backupGroup) {
+	progress := r.ctx.Log.StartProgress("Group members", len(groups))
+	defer progress.Finish()
+	for _, group := range groups {
+		if r.ctx.Canceled() {
+			return
+		}
+		r.restoreGroupMembers(group)
+		progress.Add(1)
+	}
+}
+
+func (r *restorer) restoreGroupMembers(group backupGroup) {
+	gid, exists, err := r.id("Groups", "displayName", group.Name)
+	if !exists || err != nil {
+		r.ctx.Log.Err("Could not update members of group \"%s\", the group was not created\n",
+			Named("Groups", group.Name))
+		r.memberships.failed += len(group.Members)
+		return
+	}
+	current, wanted := r.members[gid], make(map[string]bool)
+	var members []memberValue
+	var names []string // of the users of members, in the same order
+	added, removed := []string{}, []string{}
+	for _, name := range group.Members {
+		uid, exists, err := r.id("Users", "userName", name)
+		if !exists || err != nil {
+			r.ctx.Log.Err("Could not add \"%s\" to group \"%s\", no user found with that name\n", name, group.Name)
+			r.memberships.failed++
+		} else if uid != "" && current[uid] {
+			r.memberships.skipped++
+		} else {
+			members, names = append(members, memberValue{Value: uid, Type: "User"}), append(names, name)
+			added = append(added, name)
+		}
+		wanted[uid] = true
+	}
+	for uid := range current {
+		if name, ok := r.userNames[uid]; ok && !wanted[uid] {
+			members = append(members, memberValue{Value: uid, Type: "User", Operation: "delete"})
+			names, removed = append(names, name), append(removed, name)
+		}
+	}
+	if len(members) == 0 {
+		return
+	}
+	if r.dryRun {
+		r.ctx.Log.Plan("Would update members of group \"%s\", add: %s, remove: %s\n", group.Name,
+			restoreNames(added), restoreNames(removed))
+		r.memberships.created += len(added)
+		r.memberships.removed += len(removed)
+		return
+	}
+	failed := r.patches.send(r.ctx, "Groups", gid, members)
+	reported := make(map[string]bool)
+	added, removed = []string{}, []string{}
+	for i, member := range members {
+		if err, ok := failed[i]; ok {
+			if !reported[err.Error()] {
+				reported[err.Error()] = true
+				r.ctx.Log.Err("Error updating members of group \"%s\": %v\n", Named("Groups", group.Name), err)
+			}
+			r.memberships.failed++
+		} else if member.Operation == "delete" {
+			removed = append(removed, names[i])
+		} else {
+			added = append(added, names[i])
+		}
+	}
+	if len(added)+len(removed) > 0 {
+		r.ctx.Log.Info("Updated members of group \"%s\", added: %s, removed: %s\n", group.Name,
+			restoreNames(added), restoreNames(removed))
+	}
+	r.memberships.created += len(added)
+	r.memberships.removed += len(removed)
+}
+
+func restoreNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// restoreEntitlements creates the entitlements that the apps do not have
+func (r *restorer) restoreEntitlements(entitlements []backupEntitlement) {
+	var appIDs map[string]string
+	existing := make(map[string][]entitlementDef)
+	progress := r.ctx.Log.StartProgress("Entitlements", len(entitlements))
+	defer progress.Finish()
+	for _, e := range entitlements {
+		if r.ctx.Canceled() {
+			return
+		}
+		if appIDs == nil {
+			items, err := catalogItems(r.ctx)
+			if err != nil {
+				r.ctx.Log.Err("Could not get apps of the catalog: %v\n", err)
+				r.entitlements.failed += len(entitlements)
+				return
+			}
+			appIDs = make(map[string]string)
+			for _, item := range items {
+				appIDs[InterfaceToString(item["name"])] = InterfaceToString(item["uuid"])
+			}
+		}
+		if err := r.restoreEntitlement(e, appIDs, existing); err != nil {
+			r.ctx.Log.Err("Could not entitle %s \"%s\" to app \"%s\": %v\n", e.SubjectType, e.Subject, e.App, err)
+			r.entitlements.failed++
+		}
+		progress.Add(1)
+	}
+}
+
+func (r *restorer) restoreEntitlement(e backupEntitlement, appIDs map[string]string,
+	existing map[string][]entitlementDef) error {
+	st, err := getSubjectType(e.SubjectType)
+	if err != nil {
+		return err
+	}
+	itemID, ok := appIDs[e.App]
+	if !ok {
+		return NotFound("no app found named \"%s\"", e.App)
+	}
+	subjID, exists, err := r.id(st.ScimType, st.NameAttr, e.Subject)
+	if err != nil {
+		return err
+	} else if !exists {
+		return NotFound("no %s found named \"%s\"", e.SubjectType, e.Subject)
+	}
+	defs, ok := existing[itemID]
+	if !ok {
+		if defs, err = getAppEntitlements(r.ctx, itemID); err != nil {
+			return err
+		}
+		existing[itemID] = defs
+	}
+	for _, def := range defs {
+		if subjID != "" && def.SubjectType == st.EntitlementType && def.SubjectID == subjID {
+			r.entitlements.skipped++
+			return nil
+		}
+	}
+	if r.dryRun {
+		r.ctx.Log.Plan("Would entitle %s \"%s\" to app \"%s\"\n", e.SubjectType, e.Subject, e.App)
+	} else if err = entitlementRequest(r.ctx, entitlementOp{Method: "POST", Data: entitlementDef{
+		CatalogItemID: itemID, SubjectType: st.EntitlementType, SubjectID: subjID,
+		ActivationPolicy: StringOrDefault(e.Policy, "AUTOMATIC")}}); err != nil {
+		return err
+	} else {
+		r.ctx.Log.Info("Entitled %s \"%s\" to app \"%s\"\n", e.SubjectType, e.Subject, e.App)
+	}
+	r.entitlements.created++
+	return nil
+}
+
+// pruneUsers deactivates or deletes the users of the tenant that match the
+// filter and user type and are not in the backup. Users that are already
+// inactive are skipped when they are deactivated. The names of the users are
+// always printed before they are changed, which is confirmed first unless
+// force is true.
+func (r *restorer) pruneUsers(users []BasicUser, action, filter, userType string, force bool) {
+	if r.ctx.Canceled() {
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, u := range users {
+		wanted[strings.ToLower(u.Name)] = true
+	}
+	var names, ids []string
+	attrs := []string{"id", "userName", "active"}
+	err := scimForEachUser(r.ctx, filter, userType, attrs, func(resource scimResource) error {
+		user := resource.(*typedUser)
+		if wanted[strings.ToLower(user.UserName)] {
+			return nil
+		}
+		if user.Active != nil && !*user.Active && action == PruneDeactivate {
+			r.pruned.skipped++
+			return nil
+		}
+		names, ids = append(names, user.UserName), append(ids, user.Id)
+		return nil
+	})
+	if err != nil {
+		r.ctx.Log.Err("Could not get users to prune: %v\n", err)
+		r.pruned.failed++
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+	if r.dryRun {
+		r.ctx.Log.Warn("Would %s %d users that are not in the backup: %s\n", action, len(names), strings.Join(names, ", "))
+		r.pruned.removed += len(names)
+		return
+	}
+	r.ctx.Log.Warn("Pruning %d users that are not in the backup, %s: %s\n", len(names), action, strings.Join(names, ", "))
+	if !force && !r.ctx.Log.Confirm("%s %d users of %s?", strings.Title(action), len(ids), r.ctx.HostURL) {
+		r.ctx.Log.Info("No users pruned\n")
+		r.pruned.skipped += len(ids)
+		return
+	}
+	progress := r.ctx.Log.StartProgress("Users pruned", len(ids))
+	defer progress.Finish()
+	for i, id := range ids {
+		if r.ctx.Canceled() {
+			return
+		}
+		if action == PruneDeactivate {
+			err = scimSetActive(r.ctx, id, false, "")
+		} else {
+			r.ctx.ForgetID("Users", "userName", names[i])
+			err = r.ctx.Request("DELETE", "scim/Users/"+id, nil, nil)
+		}
+		if err != nil {
+			r.ctx.Log.Err("Error pruning user \"%s\": %v\n", Named("Users", names[i]), err)
+			r.pruned.failed++
+		} else {
+			r.pruned.removed++
+		}
+		progress.Add(1)
+	}
+}
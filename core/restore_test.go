@@ -0,0 +1,297 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	restoreUsersPath  = "GET/scim/Users?attributes=id%2CuserName&count=500&startIndex=1"
+	restoreGroupsPath = "GET/scim/Groups?attributes=id%2CdisplayName%2Cmembers&count=500&startIndex=1"
+	restoreAppPath    = "GET/entitlements/definitions/catalogitems/" + backupAppID
+)
+
+// writeBackup writes a backup of users anna, olaf and sven, groups friends
+// and trolls, and entitlements of friends and sven to app sledge.
+func writeBackup(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "priam-restore")
+	require.Nil(t, err)
+	for fileName, content := range map[string]string{
+		"users.yaml":        "- {name: anna}\n- {name: olaf}\n- {name: sven, email: sven@example.com}\n",
+		"groups.yaml":       "- {name: friends, members: [anna, olaf, sven]}\n- {name: trolls, members: [olaf]}\n",
+		"entitlements.yaml": "- {app: sledge, subjectType: group, subject: friends}\n- {app: sledge, subjectType: user, subject: sven}\n",
+	} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, fileName), []byte(content), 0644))
+	}
+	return dir
+}
+
+// restorePaths are the paths to get the state of a tenant with users anna,
+// olaf and kristoff, group friends with members anna, kristoff and a nested
+// group, and app sledge entitled to friends.
+func restorePaths() map[string]TstHandler {
+	return map[string]TstHandler{
+		restoreUsersPath: GoodPathHandler(`{"totalResults": 3, "Resources": [{"id": "1", "userName": "anna"},
+			{"id": "2", "userName": "Olaf"}, {"id": "4", "userName": "kristoff"}]}`),
+		restoreGroupsPath: GoodPathHandler(`{"totalResults": 1, "Resources": [{"id": "10", "displayName": "friends",
+			"members": [{"value": "1"}, {"value": "4"}, {"value": "99"}]}]}`),
+		"POST/catalogitems/search?startIndex=0&pageSize=100": GoodPathHandler(`{"items": [{"name": "sledge", "uuid": "` + backupAppID + `"}]}`),
+		restoreAppPath: GoodPathHandler(`{"items": [{"subjectType": "GROUPS", "subjectId": "10"}]}`),
+	}
+}
+
+func restoreFrom(t *testing.T, paths map[string]TstHandler, opts RestoreOptions) *HttpContext {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	Restore(ctx, dir, opts)
+	return ctx
+}
+
+func TestRestore(t *testing.T) {
+	paths := restorePaths()
+	paths["POST/scim/Users"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"UserName":"sven"`)
+		return &TstReply{Output: `{"id": "3", "userName": "sven"}`}
+	}
+	paths["POST/scim/Groups"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"DisplayName":"trolls"}`, req.Input)
+		return &TstReply{Output: `{"id": "11", "displayName": "trolls"}`}
+	}
+	paths["GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22sven%22"] = GoodPathHandler(
+		`{"Resources": [{"userName": "sven", "id": "3"}]}`)
+	paths["POST/scim/Groups/10"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[{"Value":"2","Type":"User"},`+
+			`{"Value":"3","Type":"User"},{"Value":"4","Type":"User","Operation":"delete"}]}`, req.Input)
+		return &TstReply{Status: 204}
+	}
+	paths["POST/scim/Groups/11"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[{"Value":"2","Type":"User"}]}`, req.Input)
+		return &TstReply{Status: 204}
+	}
+	paths["POST/entitlements/definitions"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"subjectType":"USERS","subjectId":"3","activationPolicy":"AUTOMATIC"`)
+		return &TstReply{Output: "{}"}
+	}
+	ctx := restoreFrom(t, paths, RestoreOptions{})
+	AssertOnlyInfoContains(t, ctx, `Created group "trolls"`)
+	assert.Contains(t, ctx.Log.InfoString(), `Updated members of group "friends", added: olaf, sven, removed: kristoff`)
+	assert.Contains(t, ctx.Log.InfoString(), `Entitled user "sven" to app "sledge"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 1, skipped: 2, failed: 0\n"+
+		"Groups created: 1, skipped: 1, failed: 0\n"+
+		"Group members added: 3, removed: 1, skipped: 1, failed: 0\n"+
+		"Entitlements created: 1, skipped: 1, failed: 0\n"+
+		"Group member patches sent: 2, split after 413 or timeout: 0\n")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestRestoreReportsMembersOfFailedPatches(t *testing.T) {
+	paths := restoredPaths()
+	paths[restoreGroupsPath] = GoodPathHandler(`{"totalResults": 2, "Resources": [{"id": "10", "displayName": "friends",
+		"members": [{"value": "1"}, {"value": "4"}]}, {"id": "11", "displayName": "trolls", "members": [{"value": "2"}]}]}`)
+	paths["POST/scim/Groups/10"] = func(t *testing.T, req *TstReq) *TstReply {
+		if strings.Count(req.Input, `"Value"`) > 1 {
+			return &TstReply{Status: 413, Output: "too large"}
+		} else if strings.Contains(req.Input, `"delete"`) {
+			return &TstReply{Status: 500, Output: "broken"}
+		}
+		return &TstReply{Status: 204}
+	}
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	SetMemberBatchSize(ctx, 2)
+	Restore(ctx, dir, RestoreOptions{})
+	assert.Equal(t, 1, strings.Count(ctx.Log.ErrString(), `Error updating members of group "friends": 500`))
+	assert.Contains(t, ctx.Log.InfoString(), `Updated members of group "friends", added: olaf, sven, removed: none`)
+	assert.Contains(t, ctx.Log.InfoString(), "Group members added: 2, removed: 0, skipped: 2, failed: 1\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Group member patches sent: 4, split after 413 or timeout: 1\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestRestoreDryRunMakesNoChanges(t *testing.T) {
+	ctx := restoreFrom(t, restorePaths(), RestoreOptions{DryRun: true})
+	AssertOnlyInfoContains(t, ctx, "Dry run, no changes are made to "+ctx.HostURL)
+	assert.Contains(t, ctx.Log.InfoString(), `Would create user "sven"`)
+	assert.Contains(t, ctx.Log.InfoString(), `Would create group "trolls"`)
+	assert.Contains(t, ctx.Log.InfoString(), `Would update members of group "friends", add: olaf, sven, remove: kristoff`)
+	assert.Contains(t, ctx.Log.InfoString(), `Would update members of group "trolls", add: olaf, remove: none`)
+	assert.Contains(t, ctx.Log.InfoString(), `Would entitle user "sven" to app "sledge"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Group members added: 3, removed: 1, skipped: 1, failed: 0\n")
+}
+
+// restoredPaths are the paths of the tenant of restorePaths once the backup
+// of writeBackup is restored.
+func restoredPaths() map[string]TstHandler {
+	paths := restorePaths()
+	paths[restoreUsersPath] = GoodPathHandler(`{"totalResults": 4, "Resources": [{"id": "1", "userName": "anna"},
+		{"id": "2", "userName": "olaf"}, {"id": "3", "userName": "sven"}, {"id": "4", "userName": "kristoff"}]}`)
+	paths[restoreGroupsPath] = GoodPathHandler(`{"totalResults": 2, "Resources": [{"id": "10", "displayName": "friends",
+		"members": [{"value": "1"}, {"value": "2"}, {"value": "3"}, {"value": "99"}]},
+		{"id": "11", "displayName": "trolls", "members": [{"value": "2"}]}]}`)
+	paths[restoreAppPath] = GoodPathHandler(`{"items": [{"subjectType": "GROUPS", "subjectId": "10"},
+		{"subjectType": "USERS", "subjectId": "3"}]}`)
+	return paths
+}
+
+func TestRestoreTwiceChangesNothing(t *testing.T) {
+	ctx := restoreFrom(t, restoredPaths(), RestoreOptions{})
+	AssertOnlyInfoContains(t, ctx, "Users created: 0, skipped: 3, failed: 0\n"+
+		"Groups created: 0, skipped: 2, failed: 0\n"+
+		"Group members added: 0, removed: 0, skipped: 4, failed: 0\n"+
+		"Entitlements created: 0, skipped: 2, failed: 0\n")
+}
+
+func TestRestoreReportsAllPhasesWhenOneFails(t *testing.T) {
+	paths := restorePaths()
+	paths["POST/scim/Users"] = ErrorHandler(409, "conflict")
+	paths["POST/scim/Groups"] = ErrorHandler(500, "broken")
+	paths["POST/scim/Groups/10"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[{"Value":"2","Type":"User"},`+
+			`{"Value":"4","Type":"User","Operation":"delete"}]}`, req.Input)
+		return &TstReply{Status: 204}
+	}
+	ctx := restoreFrom(t, paths, RestoreOptions{})
+	assert.Contains(t, ctx.Log.ErrString(), `Error creating group "trolls": 500 Internal Server Error`)
+	assert.Contains(t, ctx.Log.ErrString(), `Could not add "sven" to group "friends", no user found with that name`)
+	assert.Contains(t, ctx.Log.ErrString(), `Could not update members of group "trolls", the group was not created`)
+	assert.Contains(t, ctx.Log.ErrString(), `Could not entitle user "sven" to app "sledge": no user found named "sven"`)
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 0, skipped: 2, failed: 1\n"+
+		"Groups created: 0, skipped: 1, failed: 1\n"+
+		"Group members added: 1, removed: 1, skipped: 1, failed: 2\n"+
+		"Entitlements created: 0, skipped: 1, failed: 1\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+const (
+	pruneUsersPath = "GET/scim/Users?attributes=id%2CuserName%2Cactive&count=500" +
+		"&filter=internalUserType+eq+%22LOCAL%22&startIndex=1"
+	pruneLocalUsersPath = "GET/scim/Users?attributes=id%2CuserName%2Cactive%2Curn%3Ascim%3Aschemas%3Aextension%3A" +
+		"workspace%3A1.0&count=500&filter=internalUserType+eq+%22LOCAL%22&startIndex=1"
+	pruneAllUsersPath = "GET/scim/Users?attributes=id%2CuserName%2Cactive%2Curn%3Ascim%3Aschemas%3Aextension%3A" +
+		"workspace%3A1.0&count=500&startIndex=1"
+	localUser = `"urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "LOCAL"}`
+)
+
+func TestRestorePrunesUsersByDeactivatingThem(t *testing.T) {
+	paths := restoredPaths()
+	paths[pruneLocalUsersPath] = GoodPathHandler(`{"totalResults": 3, "Resources": [
+		{"id": "1", "userName": "Anna", "active": true, ` + localUser + `},
+		{"id": "4", "userName": "kristoff", "active": true, ` + localUser + `},
+		{"id": "5", "userName": "hans", "active": false, ` + localUser + `}]}`)
+	paths["POST/scim/Users/4"] = func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Active":false}`, req.Input)
+		return &TstReply{Status: 204}
+	}
+	ctx := restoreFrom(t, paths, RestoreOptions{PruneAction: PruneDeactivate, PruneUserType: "LOCAL", Force: true})
+	assert.Equal(t, "WARNING: Pruning 1 users that are not in the backup, deactivate: kristoff\n", ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users pruned: 1, skipped: 1, failed: 0\n")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestRestorePrunesUsersOnlyAfterConfirmation(t *testing.T) {
+	paths := restoredPaths()
+	paths[pruneLocalUsersPath] = GoodPathHandler(`{"totalResults": 2, "Resources": [
+		{"id": "1", "userName": "Anna", "active": true, ` + localUser + `},
+		{"id": "4", "userName": "kristoff", "active": true, ` + localUser + `}]}`)
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	srv, ctx := NewTestContext(t, paths)
+	defer srv.Close()
+	ctx.Log.InR = strings.NewReader("n\n")
+	Restore(ctx, dir, RestoreOptions{PruneAction: PruneDelete, PruneUserType: "LOCAL"})
+	assert.Contains(t, ctx.Log.InfoString(), "Delete 1 users of "+ctx.HostURL+"? [y/N]: ")
+	assert.Contains(t, ctx.Log.InfoString(), "No users pruned\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users pruned: 0, skipped: 1, failed: 0\n")
+}
+
+func TestRestoreRefusesToPruneWithPartialFile(t *testing.T) {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte("- {name: anna}\n- {name: ol"), 0644))
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	SetRowCheck(ctx, RowCheck{AllowPartial: true})
+	Restore(ctx, dir, RestoreOptions{PruneAction: PruneDelete, PruneUserType: "LOCAL", Force: true})
+	AssertErrorContains(t, ctx, "Refusing to prune users, only part of "+filepath.Join(dir, "users.yaml")+
+		" could be read")
+}
+
+func TestRestorePruneDryRun(t *testing.T) {
+	paths := restoredPaths()
+	paths[pruneUsersPath] = GoodPathHandler(`{"totalResults": 2, "Resources": [{"id": "4", "userName": "kristoff"},
+		{"id": "5", "userName": "hans", "active": false}]}`)
+	ctx := restoreFrom(t, paths, RestoreOptions{DryRun: true, PruneAction: PruneDelete,
+		PruneFilter: `internalUserType eq "LOCAL"`, PruneAnyUserType: true})
+	assert.Equal(t, "WARNING: Would delete 2 users that are not in the backup: kristoff, hans\n", ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users pruned: 2, skipped: 0, failed: 0\n")
+}
+
+func TestRestoreRefusesToPruneWithoutUsers(t *testing.T) {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte("# truncated\n"), 0644))
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	Restore(ctx, dir, RestoreOptions{PruneAction: PruneDelete, PruneUserType: "LOCAL"})
+	AssertErrorContains(t, ctx, "Refusing to prune users, there are no users in "+filepath.Join(dir, "users.yaml"))
+}
+
+func TestRestoreRefusesToPruneUsersOfAnyType(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	Restore(ctx, "backup", RestoreOptions{PruneAction: PruneDelete, PruneFilter: `userName sw "test"`})
+	AssertErrorContains(t, ctx, "Refusing to prune users of any type")
+}
+
+func TestRestorePrunesUsersOfTypeWhenTenantRejectsFilter(t *testing.T) {
+	paths := restoredPaths()
+	paths[pruneLocalUsersPath] = ErrorHandler(400, "unknown filter attribute")
+	paths[pruneAllUsersPath] = GoodPathHandler(`{"totalResults": 3, "Resources": [
+		{"id": "4", "userName": "kristoff", ` + localUser + `},
+		{"id": "6", "userName": "synced", "urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "PROVISIONED"}},
+		{"id": "7", "userName": "unknown"}]}`)
+	ctx := restoreFrom(t, paths, RestoreOptions{DryRun: true, PruneAction: PruneDelete, PruneUserType: "LOCAL"})
+	assert.Equal(t, "WARNING: Would delete 1 users that are not in the backup: kristoff\n", ctx.Log.ErrString())
+}
+
+func TestRestoreRejectsInvalidPruneAction(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	Restore(ctx, "backup", RestoreOptions{PruneAction: "purge"})
+	AssertErrorContains(t, ctx, `Invalid prune action "purge", it must be deactivate or delete`)
+}
+
+func TestRestoreFailsBeforeChangesIfFileIsInvalid(t *testing.T) {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "groups.yaml"), []byte("friends: [anna"), 0644))
+	srv, ctx := NewTestContext(t, map[string]TstHandler{})
+	defer srv.Close()
+	Restore(ctx, dir, RestoreOptions{})
+	AssertErrorContains(t, ctx, "Could not read groups.yaml of backup")
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"regexp"
+)
+
+const rowCheckKey = "rowCheck"
+
+// RowCheck are the checks of the rows of a file loaded in bulk, made before
+// any request so that a file that was cut short, such as by a failed copy,
+// is not loaded as if it were complete.
+type RowCheck struct {
+	// ExpectAtLeast fails the load if the file has fewer rows
+	ExpectAtLeast int
+	// AllowPartial loads the rows before a row that does not decode rather
+	// than fail
+	AllowPartial bool
+}
+
+// SetRowCheck sets the checks of the rows of the files loaded in bulk
+func SetRowCheck(ctx *HttpContext, check RowCheck) {
+	ctx.SetValue(rowCheckKey, check)
+}
+
+func rowCheckOf(ctx *HttpContext) RowCheck {
+	check, _ := ctx.Value(rowCheckKey, nil)
+	if check, ok := check.(RowCheck); ok {
+		return check
+	}
+	return RowCheck{}
+}
+
+// readRows reads the rows of a YAML file with read as readPartialRows, and
+// fails as expectRows.
+func readRows(ctx *HttpContext, fileName string, read func(content []byte) (int, error)) error {
+	rows, _, err := readPartialRows(ctx, fileName, read)
+	if err != nil {
+		return err
+	}
+	return expectRows(ctx, fileName, rows)
+}
+
+// expectRows fails if a file has no rows, or fewer than expected
+func expectRows(ctx *HttpContext, fileName string, rows int) error {
+	if rows == 0 {
+		return fmt.Errorf("no rows in %s", fileName)
+	} else if expected := rowCheckOf(ctx).ExpectAtLeast; rows < expected {
+		return fmt.Errorf("only %d rows in %s, fewer than the %d expected", rows, fileName, expected)
+	}
+	return nil
+}
+
+// readPartialRows reads the rows of a YAML file with read, which decodes the
+// content of the file into the rows and returns how many there are, and
+// returns how many rows were read, or can be read as partialRows when the
+// file does not decode, and true if only the rows before an error are read.
+func readPartialRows(ctx *HttpContext, fileName string, read func(content []byte) (int, error)) (int, bool, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, false, err
+	}
+	rows, err := read(content)
+	if err == nil {
+		return rows, false, nil
+	}
+	rows, err = partialRows(ctx, fileName, decodedRows(content, read), err)
+	return rows, err == nil, err
+}
+
+// partialRows returns how many rows of a file are read when reading it
+// failed with err after the given rows. It fails, with how many rows can be
+// read, unless partial files are allowed: then the rows before the error
+// are read.
+func partialRows(ctx *HttpContext, fileName string, rows int, err error) (int, error) {
+	if rows == 0 {
+		return 0, err
+	} else if !rowCheckOf(ctx).AllowPartial {
+		return 0, fmt.Errorf("only the first %d rows of %s can be read, the file may be incomplete, "+
+			"use --allow-partial to load them: %v", rows, fileName, err)
+	}
+	ctx.Log.Warn("only the first %d rows of %s are loaded, the file may be incomplete: %v\n", rows, fileName, err)
+	return rows, nil
+}
+
+// rowStart matches the lines that start an item of a YAML list
+var rowStart = regexp.MustCompile(`(?m)^ *- `)
+
+// decodedRows returns how many rows of content decode before the first that
+// does not, 0 if none do, with the rows decoded by read. The content is cut
+// before each item of the list of rows, from the last, until it decodes.
+func decodedRows(content []byte, read func(content []byte) (int, error)) int {
+	starts := rowStart.FindAllIndex(content, -1)
+	if len(starts) == 0 {
+		return 0
+	}
+	indent := starts[0][1] - starts[0][0]
+	for i := len(starts) - 1; i > 0; i-- {
+		if starts[i][1]-starts[i][0] != indent {
+			continue
+		}
+		if rows, err := read(bytes.TrimRight(content[:starts[i][0]], " ")); err == nil && rows > 0 {
+			return rows
+		}
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// truncatedRows is a file of entitlements cut short in its third row
+const truncatedRows = "- {app: olaf, subjectType: user, subject: anna}\n- {app: olaf, subjectType: user, subject: sven}\n" +
+	"- {app: olaf, subjectType: gro"
+
+func readEntitlementRows(t *testing.T, ctx *HttpContext, content string) ([]backupEntitlement, error) {
+	file := WriteTempFile(t, content)
+	defer CleanupTempFile(file)
+	var rows []backupEntitlement
+	err := readRows(ctx, file.Name(), func(content []byte) (int, error) {
+		rows = nil
+		err := yaml.Unmarshal(content, &rows)
+		return len(rows), err
+	})
+	return rows, err
+}
+
+func TestReadRowsOfTruncatedFileSaysHowManyRowsCanBeRead(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	_, err := readEntitlementRows(t, ctx, truncatedRows)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "only the first 2 rows of ")
+		assert.Contains(t, err.Error(), "use --allow-partial to load them")
+	}
+}
+
+func TestReadRowsOfTruncatedFileWithPartialAllowed(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	SetRowCheck(ctx, RowCheck{AllowPartial: true})
+	rows, err := readEntitlementRows(t, ctx, truncatedRows)
+	assert.Nil(t, err)
+	assert.Equal(t, []backupEntitlement{{App: "olaf", SubjectType: "user", Subject: "anna"},
+		{App: "olaf", SubjectType: "user", Subject: "sven"}}, rows)
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: only the first 2 rows of ")
+}
+
+func TestReadRowsOfInvalidFirstRowFails(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	SetRowCheck(ctx, RowCheck{AllowPartial: true})
+	_, err := readEntitlementRows(t, ctx, "- {app: olaf, subjectType: gro")
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "only the first")
+	}
+}
+
+func TestReadRowsWithFewerRowsThanExpectedFails(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	SetRowCheck(ctx, RowCheck{ExpectAtLeast: 3})
+	_, err := readEntitlementRows(t, ctx, "- {app: olaf, subjectType: user, subject: anna}\n")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "only 1 rows in ")
+		assert.Contains(t, err.Error(), "fewer than the 3 expected")
+	}
+}
+
+func TestLoadUsersWithoutRowsFailsWithoutRequests(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	file := WriteTempFile(t, "# nothing\n")
+	defer CleanupTempFile(file)
+	new(SCIMUsersService).LoadEntities(ctx, file.Name(), nil)
+	AssertErrorContains(t, ctx, "could not read file of bulk users: no rows in "+file.Name())
+}
+
+func TestLoadEntitlementsOfTruncatedFileFailsWithoutRequests(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	file := WriteTempFile(t, truncatedRows)
+	defer CleanupTempFile(file)
+	LoadEntitlements(ctx, file.Name(), EntitlementLoadOptions{})
+	AssertErrorContains(t, ctx, "could not read file of entitlements: only the first 2 rows of "+file.Name())
+}
+
+func TestRestoreWithFewerUsersThanExpectedFailsWithoutRequests(t *testing.T) {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	SetRowCheck(ctx, RowCheck{ExpectAtLeast: 4})
+	Restore(ctx, dir, RestoreOptions{})
+	AssertErrorContains(t, ctx, "Refusing to apply the backup, only 3 users in "+filepath.Join(dir, "users.yaml")+
+		", fewer than the 4 expected")
+}
+
+func TestRestoreOfTruncatedBackupFailsWithoutRequests(t *testing.T) {
+	dir := writeBackup(t)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "users.yaml"), []byte("- {name: anna}\n- {name: ol"), 0644))
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	Restore(ctx, dir, RestoreOptions{PruneAction: PruneDelete, PruneUserType: "LOCAL"})
+	AssertErrorContains(t, ctx, "only the first 1 rows of "+filepath.Join(dir, "users.yaml"))
+}
@@ -0,0 +1,370 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"net/mail"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// scaffoldFormat is a format of the YAML files that priam loads, with an
+// example generated from the structs that its loader parses.
+type scaffoldFormat struct {
+	title    string             // what the file is for and which command loads it, may have several lines
+	example  interface{}        // content of the example file
+	fields   []scaffoldFields   // the documented fields of the entries
+	validate func(string) check // parses a file with the loader and checks its entries
+}
+
+// scaffoldFields are the fields of a struct in a file, named with a prefix
+// such as workspace. for nested structs.
+type scaffoldFields struct {
+	prefix string
+	value  interface{}
+}
+
+// check is the outcome of the validation of a file: its number of entries,
+// the problems of its entries, or the error that stopped it from being read.
+type check struct {
+	entries  int
+	problems []string
+	err      error
+}
+
+// fieldDocs describe the fields of the scaffolds by format and field. Each
+// field that a loader parses must be described, which is tested, so that the
+// scaffolds follow the loaders.
+var fieldDocs = map[string]map[string]string{
+	"users": {
+		"name":             "user name, required and unique",
+		"given":            "given name, the user name if not set",
+		"family":           "family name, the user name if not set",
+		"middle":           "middle name, none if not set",
+		"honorific":        "honorific prefix such as Dr., none if not set",
+		"display":          "display name, composed with the display-name-template of the target if not set",
+		"email":            "email, <name>@<default email domain of the target> if not set",
+		"pwd":              "password, none if not set",
+		"internalUserType": "internal user type, one of " + strings.Join(InternalUserTypes, ", "),
+		"attrs":            "other SCIM attributes by path, such as title",
+	},
+	"groups": {
+		"name":    "display name of the group, required and unique",
+		"members": "user names of the members of the group",
+	},
+	"entitlements": {
+		"app":         "name of the app, required",
+		"subjectType": "type of the subject entitled, user, group or role",
+		"subject":     "user name or group name of the subject, required",
+		"policy":      "activation policy, AUTOMATIC if not set, or USER_ACTIVATION",
+	},
+	"apps": {
+		"name":                            "name of the Cloud Foundry app, required and unique",
+		"memory":                          "memory of the Cloud Foundry app",
+		"path":                            "path of the Cloud Foundry app to push",
+		"buildpack":                       "build pack of the Cloud Foundry app",
+		"instances":                       "number of instances of the Cloud Foundry app",
+		"env":                             "environment of the Cloud Foundry app",
+		"workspace":                       "catalog item of the app",
+		"workspace.name":                  "name of the catalog item, the name of the app if not set",
+		"workspace.uuid":                  "uuid of the catalog item, generated if not set",
+		"workspace.packageVersion":        "version of the catalog item",
+		"workspace.description":           "description of the catalog item",
+		"workspace.iconFile":              "file of the icon of the catalog item",
+		"workspace.entitleGroup":          "group to entitle to the app",
+		"workspace.entitleUser":           "user to entitle to the app",
+		"workspace.resourceConfiguration": "resource configuration of the catalog item",
+		"workspace.accessPolicy":          "name of the access policy set of the catalog item",
+		"workspace.accessPolicySetUuid":   "uuid of the access policy set of the catalog item",
+		"workspace.catalogItemType":       "type of the catalog item, such as Saml20 or WebAppLink, required",
+		"workspace.labels":                "labels of the catalog item",
+		"workspace.authInfo":              "authentication information of the catalog item, with its type",
+	},
+}
+
+// scaffoldHidden are the fields that loaders parse but that are not meant to
+// be set in files
+var scaffoldHidden = []string{"workspace.jsonTester"}
+
+// scaffoldFormats are the formats of files that scaffolds are written for
+var scaffoldFormats = map[string]scaffoldFormat{
+	"users": {
+		title: "users to add with 'priam user load', a list of users, or as here the users under\n" +
+			"users with defaults of their fields under defaults",
+		example: usersFile{
+			Defaults: &BasicUser{Family: "Example", Email: "{{.Given}}.{{.Family}}@corp.example.org"},
+			Users: []interface{}{
+				BasicUser{Name: "jdoe", Given: "John", Family: "Doe", Pwd: "Changeme1!"},
+				BasicUser{Name: "asmith", Given: "Ann", Email: "ann@example.org",
+					Attrs: map[string]interface{}{"name.middleName": "Lee"}},
+				BasicUser{Name: "backup-svc", Given: "Backup", InternalUserType: "SERVICE"},
+			},
+		},
+		fields:   []scaffoldFields{{"", BasicUser{}}},
+		validate: validateUsers,
+	},
+	"groups": {
+		title: "groups and their members, as in the groups.yaml file read by 'priam restore'",
+		example: []backupGroup{{Name: "sales", Members: []string{"jdoe", "asmith"}},
+			{Name: "support"}},
+		fields:   []scaffoldFields{{"", backupGroup{}}},
+		validate: validateGroups,
+	},
+	"entitlements": {
+		title: "entitlements to create with 'priam entitlement load'",
+		example: []backupEntitlement{{App: "expenses", SubjectType: "group", Subject: "sales"},
+			{App: "expenses", SubjectType: "user", Subject: "jdoe", Policy: "USER_ACTIVATION"}},
+		fields:   []scaffoldFields{{"", backupEntitlement{}}},
+		validate: validateEntitlements,
+	},
+	"apps": {
+		title: "apps to add to the catalog with 'priam app add', the applications of a Cloud Foundry manifest",
+		example: struct {
+			Applications []manifestApp
+		}{[]manifestApp{{Name: "expenses", Memory: "512M", Path: "build/expenses.war", Instances: 1,
+			BuildPack: "java_buildpack", Env: map[string]string{"STAGE": "prod"},
+			Workspace: priamApp{PackageVersion: "1.0", Description: "Expense reports", EntitleGroup: "sales",
+				CatalogItemType: "WebAppLink", AuthInfo: map[string]interface{}{"type": "WebAppLink",
+					"targetUrl": "https://expenses.example.org"}}}}},
+		fields:   []scaffoldFields{{"", manifestApp{}}, {"workspace.", priamApp{}}},
+		validate: validateApps,
+	},
+}
+
+// ScaffoldFormats returns the sorted names of the formats of scaffolds
+func ScaffoldFormats() []string {
+	names := make([]string, 0, len(scaffoldFormats))
+	for name := range scaffoldFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scaffoldFormatOf returns the format of a name, or logs the supported ones
+func scaffoldFormatOf(log *Logr, name string) (scaffoldFormat, bool) {
+	format, ok := scaffoldFormats[name]
+	if !ok {
+		log.Err("Unknown format \"%s\", supported formats are: %s\n", name, strings.Join(ScaffoldFormats(), ", "))
+	}
+	return format, ok
+}
+
+// Scaffold writes an example file of a format, with comments that describe
+// its fields, to a new file or to the output if fileName is empty.
+func Scaffold(log *Logr, name, fileName string) {
+	format, ok := scaffoldFormatOf(log, name)
+	if !ok {
+		return
+	}
+	content, err := scaffoldContent(name, format)
+	if err != nil {
+		log.Err("Could not generate example of %s: %v\n", name, err)
+	} else if fileName == "" {
+		fmt.Fprint(log.OutW, content)
+	} else if err = writeNewFile(fileName, []byte(content)); err != nil {
+		log.Err("Could not write example of %s: %v\n", name, err)
+	} else {
+		log.Info("Example of %s written to %s\n", name, fileName)
+	}
+}
+
+// scaffoldContent returns the example of a format with its comments
+func scaffoldContent(name string, format scaffoldFormat) (string, error) {
+	example, err := yaml.Marshal(format.example)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{"# Example file of " + strings.Replace(format.title, "\n", "\n# ", -1), "#", "# Fields:"}
+	for _, field := range scaffoldFieldNames(format) {
+		lines = append(lines, fmt.Sprintf("#   %s: %s", field, fieldDocs[name][field]))
+	}
+	return strings.Join(lines, "\n") + "\n---\n" + string(example), nil
+}
+
+// scaffoldFieldNames returns the YAML names of the fields of a format
+func scaffoldFieldNames(format scaffoldFormat) (names []string) {
+	for _, fields := range format.fields {
+		t := reflect.TypeOf(fields.value)
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(t.Field(i).Name)
+			}
+			if name != "-" && !HasString(fields.prefix+name, scaffoldHidden) {
+				names = append(names, fields.prefix+name)
+			}
+		}
+	}
+	return names
+}
+
+// writeNewFile writes a file that must not exist
+func writeNewFile(fileName string, content []byte) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ValidateFile reads a file of a format with its loader and reports the
+// problems of its entries, without any request to the target.
+func ValidateFile(log *Logr, name, fileName string) {
+	format, ok := scaffoldFormatOf(log, name)
+	if !ok {
+		return
+	}
+	result := format.validate(fileName)
+	if result.err != nil {
+		log.Err("Could not read %s as a file of %s: %v\n", fileName, name, result.err)
+		return
+	}
+	for _, problem := range result.problems {
+		log.Err("%s: %s\n", fileName, problem)
+	}
+	if len(result.problems) > 0 {
+		log.Err("Found %d problems in the %d entries of %s\n", len(result.problems), result.entries, fileName)
+	} else {
+		log.Info("%s is a valid file of %s with %d entries\n", fileName, name, result.entries)
+	}
+}
+
+// duplicates finds the keys that are repeated, ignoring case, and says where
+// they were first seen
+type duplicates map[string]int
+
+func (d duplicates) seen(key string, entry int) (int, bool) {
+	key = strings.ToLower(key)
+	if first, ok := d[key]; ok {
+		return first, true
+	}
+	d[key] = entry
+	return 0, false
+}
+
+func validateUsers(fileName string) (result check) {
+	var users []BasicUser
+	defaults, err := getUsersFile(fileName, &users)
+	if err != nil {
+		return check{err: err}
+	}
+	names, problem := duplicates{}, func(i int, format string, args ...interface{}) {
+		result.problems = append(result.problems, fmt.Sprintf("user %d: %s", i+1, fmt.Sprintf(format, args...)))
+	}
+	for i, row := range users {
+		u, err := defaults.apply(row)
+		if u.Name == "" {
+			problem(i, "missing name")
+		} else if first, ok := names.seen(u.Name, i+1); ok {
+			problem(i, "duplicate userName %s of user %d", u.Name, first)
+		}
+		if err != nil {
+			problem(i, "%v", err)
+		}
+		if address, err := mail.ParseAddress(u.Email); u.Email != "" && (err != nil || address.Address != u.Email) {
+			problem(i, "malformed email \"%s\"", u.Email)
+		}
+		if u.InternalUserType != "" && !HasString(strings.ToUpper(u.InternalUserType), InternalUserTypes) {
+			problem(i, "invalid internal user type \"%s\", must be one of %s", u.InternalUserType,
+				strings.Join(InternalUserTypes, ", "))
+		}
+	}
+	result.entries = len(users)
+	return result
+}
+
+func validateGroups(fileName string) (result check) {
+	var groups []backupGroup
+	if result.err = GetYamlFile(fileName, &groups); result.err != nil {
+		return result
+	}
+	names := duplicates{}
+	for i, g := range groups {
+		if g.Name == "" {
+			result.problems = append(result.problems, fmt.Sprintf("group %d: missing name", i+1))
+		} else if first, ok := names.seen(g.Name, i+1); ok {
+			result.problems = append(result.problems, fmt.Sprintf("group %d: duplicate name %s of group %d",
+				i+1, g.Name, first))
+		}
+		members := duplicates{}
+		for _, m := range g.Members {
+			if m == "" {
+				result.problems = append(result.problems, fmt.Sprintf("group %d: empty member name", i+1))
+			} else if _, ok := members.seen(m, i+1); ok {
+				result.problems = append(result.problems, fmt.Sprintf("group %d: duplicate member %s", i+1, m))
+			}
+		}
+	}
+	result.entries = len(groups)
+	return result
+}
+
+func validateEntitlements(fileName string) (result check) {
+	var rows []backupEntitlement
+	if result.err = GetYamlFile(fileName, &rows); result.err != nil {
+		return result
+	}
+	seen, problem := duplicates{}, func(i int, format string, args ...interface{}) {
+		result.problems = append(result.problems, fmt.Sprintf("entitlement %d: %s", i+1, fmt.Sprintf(format, args...)))
+	}
+	for i, e := range rows {
+		if e.App == "" {
+			problem(i, "missing app")
+		}
+		if e.Subject == "" {
+			problem(i, "missing subject")
+		}
+		if _, err := getSubjectType(e.SubjectType); err != nil {
+			problem(i, "%v", err)
+		} else if first, ok := seen.seen(strings.Join([]string{e.App, e.SubjectType, e.Subject}, "\x00"), i+1); ok &&
+			e.App != "" && e.Subject != "" {
+			problem(i, "duplicate of entitlement %d", first)
+		}
+	}
+	result.entries = len(rows)
+	return result
+}
+
+func validateApps(fileName string) (result check) {
+	apps, err := getManifestApps(fileName)
+	if err != nil {
+		return check{err: err}
+	}
+	names := duplicates{}
+	for i, app := range apps {
+		if app.Name == "" {
+			result.problems = append(result.problems, fmt.Sprintf("app %d: missing name", i+1))
+		} else if first, ok := names.seen(app.Name, i+1); ok {
+			result.problems = append(result.problems, fmt.Sprintf("app %d: duplicate name %s of app %d",
+				i+1, app.Name, first))
+		}
+		if app.Workspace.CatalogItemType == "" {
+			result.problems = append(result.problems, fmt.Sprintf("app %d: missing workspace.catalogItemType", i+1))
+		}
+	}
+	result.entries = len(apps)
+	return result
+}
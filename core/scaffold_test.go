@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaffoldFieldsAreAllDocumented(t *testing.T) {
+	for name, format := range scaffoldFormats {
+		fields := scaffoldFieldNames(format)
+		for _, field := range fields {
+			assert.NotEmpty(t, fieldDocs[name][field], "field %s of %s is not documented", field, name)
+		}
+		for field := range fieldDocs[name] {
+			assert.Contains(t, fields, field, "documented field %s of %s is not parsed", field, name)
+		}
+	}
+}
+
+func TestScaffoldsAreValidFilesOfTheirFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-scaffold")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range ScaffoldFormats() {
+		log := NewBufferedLogr()
+		fileName := filepath.Join(dir, name+".yaml")
+		Scaffold(log, name, fileName)
+		assert.Equal(t, "Example of "+name+" written to "+fileName+"\n", log.InfoString())
+		log.ClearBuffers()
+		ValidateFile(log, name, fileName)
+		assert.Empty(t, log.ErrString())
+		assert.Contains(t, log.InfoString(), fileName+" is a valid file of "+name+" with ")
+	}
+}
+
+func TestScaffoldToOutputHasDocumentedFields(t *testing.T) {
+	log := NewBufferedLogr()
+	Scaffold(log, "users", "")
+	assert.Contains(t, log.InfoString(), "# Example file of users to add with 'priam user load'")
+	assert.Contains(t, log.InfoString(), "#   internalUserType: internal user type, one of LOCAL, PROVISIONED, SERVICE\n")
+	assert.Contains(t, log.InfoString(), "\n---\ndefaults:\n")
+	assert.Empty(t, log.ErrString())
+}
+
+func TestScaffoldDoesNotOverwriteFiles(t *testing.T) {
+	f := WriteTempFile(t, "keep")
+	defer CleanupTempFile(f)
+	log := NewBufferedLogr()
+	Scaffold(log, "groups", f.Name())
+	assert.Contains(t, log.ErrString(), "Could not write example of groups: ")
+	assert.Equal(t, "keep", GetTempFile(t, f.Name()))
+}
+
+func TestScaffoldOfUnknownFormat(t *testing.T) {
+	log := NewBufferedLogr()
+	Scaffold(log, "roles", "")
+	assert.Equal(t, "Unknown format \"roles\", supported formats are: apps, entitlements, groups, users\n",
+		log.ErrString())
+}
+
+// validate validates the content of a file of a format and returns the log
+func validate(t *testing.T, name, content string) *Logr {
+	f := WriteTempFile(t, content)
+	defer CleanupTempFile(f)
+	log := NewBufferedLogr()
+	ValidateFile(log, name, f.Name())
+	return log
+}
+
+func TestValidateUsersReportsProblemsOfEachRow(t *testing.T) {
+	log := validate(t, "users", "defaults: {email: \"{{.Given}}@example.org\"}\nusers:\n"+
+		"- {name: joe, given: Joe}\n- {given: Nobody}\n- {name: JOE, given: Joseph}\n- {name: ann, email: ann@}\n"+
+		"- {name: bob}\n- {name: svc, given: Svc, internalUserType: robot}\n")
+	assert.Contains(t, log.ErrString(), ": user 2: missing name\n")
+	assert.Contains(t, log.ErrString(), ": user 3: duplicate userName JOE of user 1\n")
+	assert.Contains(t, log.ErrString(), ": user 4: malformed email \"ann@\"\n")
+	assert.Contains(t, log.ErrString(), ": user 5: default email: ")
+	assert.Contains(t, log.ErrString(), ": user 6: invalid internal user type \"robot\"")
+	assert.Contains(t, log.ErrString(), "Found 5 problems in the 6 entries of ")
+	assert.Empty(t, log.InfoString())
+}
+
+func TestValidateGroupsReportsProblemsOfEachRow(t *testing.T) {
+	log := validate(t, "groups", "- {name: sales, members: [joe, Joe, '']}\n- {members: [ann]}\n- {name: Sales}\n")
+	assert.Contains(t, log.ErrString(), ": group 1: duplicate member Joe\n")
+	assert.Contains(t, log.ErrString(), ": group 1: empty member name\n")
+	assert.Contains(t, log.ErrString(), ": group 2: missing name\n")
+	assert.Contains(t, log.ErrString(), ": group 3: duplicate name Sales of group 1\n")
+	assert.Contains(t, log.ErrString(), "Found 4 problems in the 3 entries of ")
+}
+
+func TestValidateEntitlementsReportsProblemsOfEachRow(t *testing.T) {
+	log := validate(t, "entitlements", "- {app: mail, subjectType: user, subject: joe}\n"+
+		"- {subjectType: robot, subject: r2}\n- {app: mail, subjectType: user, subject: joe}\n")
+	assert.Contains(t, log.ErrString(), ": entitlement 2: missing app\n")
+	assert.Contains(t, log.ErrString(), ": entitlement 2: unsupported subject type \"robot\"")
+	assert.Contains(t, log.ErrString(), ": entitlement 3: duplicate of entitlement 1\n")
+}
+
+func TestValidateAppsOfManifest(t *testing.T) {
+	log := NewBufferedLogr()
+	ValidateFile(log, "apps", "../resources/manifest.yaml")
+	assert.Equal(t, "../resources/manifest.yaml is a valid file of apps with 1 entries\n", log.InfoString())
+	log = validate(t, "apps", "applications:\n- {workspace: {catalogItemType: Saml20}}\n- {name: a}\n")
+	assert.Contains(t, log.ErrString(), ": app 1: missing name\n")
+	assert.Contains(t, log.ErrString(), ": app 2: missing workspace.catalogItemType\n")
+}
+
+func TestValidateFileThatCannotBeRead(t *testing.T) {
+	log := validate(t, "groups", "name: sales\n")
+	assert.Contains(t, log.ErrString(), "as a file of groups: yaml: unmarshal errors")
+}
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// schemaColumns are the fields printed for each attribute of a schema
+var schemaColumns = []string{"schema", "attribute", "type", "mutability", "required", "multiValued"}
+
+// schemaNames are the schemas looked up one by one when the server does not list them all
+var schemaNames = []string{"User", "Group", "Role"}
+
+// CmdSchemas prints the resource types and schemas that the server describes,
+// with the name, type, mutability and required flag of each attribute.
+func CmdSchemas(ctx *HttpContext) {
+	types, err := scimDiscover(ctx, "scim/ResourceTypes")
+	if err != nil {
+		ctx.Log.Warn("the server does not list SCIM resource types: %v\n", err)
+	}
+	schemas, err := scimDiscover(ctx, "scim/Schemas")
+	if err != nil {
+		if schemas = scimSchemasByName(ctx); len(schemas) == 0 {
+			ctx.Log.Err("Error getting SCIM schemas: %v\n", err)
+			return
+		}
+		ctx.Log.Debug("Schemas are not listed, got them by name: %v\n", err)
+	}
+	switch {
+	case ctx.Log.Format == FCsv:
+		ctx.Log.PP("Schemas", schemaAttributes(schemas), schemaColumns...)
+	case ctx.Log.MachineFormat():
+		ctx.Log.PP("Schemas", map[string]interface{}{"resourceTypes": types, "schemas": schemas})
+	default:
+		printSchemas(ctx, types, schemas)
+	}
+}
+
+// scimDiscover gets the resources of a discovery endpoint, which may be a list
+// response, a plain list or a single resource.
+func scimDiscover(ctx *HttpContext, path string) ([]map[string]interface{}, error) {
+	var outp interface{}
+	if err := ctx.Accept("json").Request("GET", path, nil, &outp); err != nil {
+		return nil, err
+	}
+	if list, ok := outp.(map[string]interface{}); ok {
+		if _, isSchema := list["attributes"]; !isSchema {
+			outp = list["Resources"]
+		} else {
+			outp = []interface{}{list}
+		}
+	}
+	items, _ := outp.([]interface{})
+	resources := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if res, ok := item.(map[string]interface{}); ok {
+			resources = append(resources, res)
+		}
+	}
+	if len(resources) == 0 {
+		return nil, errors.New("no resources in the response")
+	}
+	return resources, nil
+}
+
+// scimSchemasByName gets the known schemas one by one with a filter, the way
+// that servers which do not list all their schemas support.
+func scimSchemasByName(ctx *HttpContext) (schemas []map[string]interface{}) {
+	for _, name := range schemaNames {
+		vals := url.Values{"filter": {Eq("name", name).String()}}
+		if found, err := scimDiscover(ctx, "scim/Schemas?"+vals.Encode()); err != nil {
+			ctx.Log.Debug("Schema %s not found: %v\n", name, err)
+		} else {
+			schemas = append(schemas, found...)
+		}
+	}
+	return
+}
+
+// schemaAttributes returns a row for each attribute of the schemas, with
+// sub-attributes named after their parent such as name.givenName
+func schemaAttributes(schemas []map[string]interface{}) []map[string]interface{} {
+	rows := []map[string]interface{}{}
+	var add func(schema, prefix string, attrs interface{})
+	add = func(schema, prefix string, attrs interface{}) {
+		list, _ := attrs.([]interface{})
+		for _, item := range list {
+			attr, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name := prefix + fmt.Sprint(attr["name"])
+			mutability, _ := attr["mutability"].(string)
+			if readOnly, _ := attr["readOnly"].(bool); mutability == "" && readOnly {
+				mutability = "readOnly"
+			}
+			required, _ := attr["required"].(bool)
+			multiValued, _ := attr["multiValued"].(bool)
+			rows = append(rows, map[string]interface{}{"schema": schema, "attribute": name,
+				"type": attr["type"], "mutability": mutability, "required": required, "multiValued": multiValued})
+			add(schema, name+".", attr["subAttributes"])
+		}
+	}
+	for _, schema := range schemas {
+		add(schemaName(schema), "", schema["attributes"])
+	}
+	return rows
+}
+
+// schemaName returns the ID of a schema, or its name if it has no ID
+func schemaName(schema map[string]interface{}) string {
+	if id, ok := schema["id"].(string); ok && id != "" {
+		return id
+	}
+	return fmt.Sprint(schema["name"])
+}
+
+// printSchemas prints the resource types and the attributes of each schema as aligned columns
+func printSchemas(ctx *HttpContext, types, schemas []map[string]interface{}) {
+	w := tabwriter.NewWriter(ctx.Log.OutW, 0, 8, 2, ' ', 0)
+	if len(types) > 0 {
+		fmt.Fprintf(w, "---- Resource types ----\nNAME\tENDPOINT\tSCHEMA\tEXTENSIONS\n")
+		for _, t := range types {
+			extensions := []string{}
+			list, _ := t["schemaExtensions"].([]interface{})
+			for _, item := range list {
+				if ext, ok := item.(map[string]interface{}); ok {
+					extensions = append(extensions, fmt.Sprint(ext["schema"]))
+				}
+			}
+			sort.Strings(extensions)
+			fmt.Fprintf(w, "%v\t%v\t%v\t%s\n", t["name"], t["endpoint"], t["schema"], strings.Join(extensions, ", "))
+		}
+	}
+	rows, schema := schemaAttributes(schemas), ""
+	for _, row := range rows {
+		if row["schema"] != schema {
+			schema = row["schema"].(string)
+			fmt.Fprintf(w, "---- Schema %s ----\nATTRIBUTE\tTYPE\tMUTABILITY\tREQUIRED\tMULTIVALUED\n", schema)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", row["attribute"], row["type"], row["mutability"], row["required"], row["multiValued"])
+	}
+	w.Flush()
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const (
+	resourceTypesPath = "GET/scim/ResourceTypes"
+	schemasPath       = "GET/scim/Schemas"
+	userSchemaPath    = "GET/scim/Schemas?filter=name+eq+%22User%22"
+	groupSchemaPath   = "GET/scim/Schemas?filter=name+eq+%22Group%22"
+	roleSchemaPath    = "GET/scim/Schemas?filter=name+eq+%22Role%22"
+	userSchema        = `{"id": "urn:ietf:params:scim:schemas:core:2.0:User", "name": "User", "attributes": [
+		{"name": "userName", "type": "string", "mutability": "readWrite", "required": true},
+		{"name": "id", "type": "string", "readOnly": true},
+		{"name": "name", "type": "complex", "subAttributes": [{"name": "givenName", "type": "string"}]},
+		{"name": "emails", "type": "complex", "multiValued": true}]}`
+)
+
+func TestSchemasPrintsResourceTypesAndAttributes(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		resourceTypesPath: GoodPathHandler(`{"Resources": [{"name": "User", "endpoint": "/Users",
+			"schema": "urn:ietf:params:scim:schemas:core:2.0:User",
+			"schemaExtensions": [{"schema": "urn:vmware:ext", "required": false}]}]}`),
+		schemasPath: GoodPathHandler(`{"Resources": [` + userSchema + `]}`)})
+	defer srv.Close()
+	CmdSchemas(ctx)
+	AssertOnlyInfoContains(t, ctx, "---- Resource types ----")
+	for _, s := range []string{"User  /Users    urn:ietf:params:scim:schemas:core:2.0:User  urn:vmware:ext",
+		"---- Schema urn:ietf:params:scim:schemas:core:2.0:User ----",
+		"userName        string   readWrite   true      false",
+		"id              string   readOnly    false     false",
+		"name.givenName  string",
+		"emails          complex              false     true"} {
+		assert.Contains(t, ctx.Log.InfoString(), s)
+	}
+}
+
+func TestSchemasInJson(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		resourceTypesPath: GoodPathHandler(`[{"name": "Group", "endpoint": "/Groups"}]`),
+		schemasPath:       GoodPathHandler(`[` + userSchema + `]`)})
+	defer srv.Close()
+	ctx.Log.Format = FJson
+	CmdSchemas(ctx)
+	AssertOnlyInfoContains(t, ctx, `"resourceTypes": [`)
+	assert.Contains(t, ctx.Log.InfoString(), `"endpoint": "/Groups"`)
+	assert.Contains(t, ctx.Log.InfoString(), `"subAttributes": [`)
+}
+
+func TestSchemasInCsv(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		resourceTypesPath: ErrorHandler(404, "no resource types"), schemasPath: GoodPathHandler(userSchema)})
+	defer srv.Close()
+	ctx.Log.Format = FCsv
+	CmdSchemas(ctx)
+	assert.Contains(t, ctx.Log.InfoString(), "schema,attribute,type,mutability,required,multiValued\n")
+	assert.Contains(t, ctx.Log.InfoString(), "urn:ietf:params:scim:schemas:core:2.0:User,name.givenName,string,,false,false\n")
+}
+
+func TestSchemasAreFoundByNameIfNotListed(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		resourceTypesPath: ErrorHandler(404, "no resource types"),
+		schemasPath:       ErrorHandler(400, "filter required"),
+		userSchemaPath:    GoodPathHandler(userSchema),
+		groupSchemaPath:   ErrorHandler(404, "no group schema"),
+		roleSchemaPath:    ErrorHandler(404, "no role schema")})
+	defer srv.Close()
+	CmdSchemas(ctx)
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: the server does not list SCIM resource types")
+	assert.Contains(t, ctx.Log.ErrString(), "no resource types")
+	assert.NotContains(t, ctx.Log.InfoString(), "Resource types")
+	assert.Contains(t, ctx.Log.InfoString(), "name.givenName")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestSchemasFailIfNoneFound(t *testing.T) {
+	notImplemented := ErrorHandler(501, "not implemented")
+	srv, ctx := NewTestContext(t, map[string]TstHandler{resourceTypesPath: notImplemented, schemasPath: notImplemented,
+		userSchemaPath: notImplemented, groupSchemaPath: notImplemented, roleSchemaPath: notImplemented})
+	defer srv.Close()
+	ctx.MaxAttempts = 1
+	CmdSchemas(ctx)
+	AssertErrorContains(t, ctx, "Error getting SCIM schemas")
+	AssertErrorContains(t, ctx, "not implemented")
+	assert.Equal(t, ExitError, ctx.Log.ExitCode())
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+// ScimFilter is a SCIM filter expression, built with Eq, Sw, Co, And and Or
+// so that values are always quoted and escaped, and operators spelled right.
+type ScimFilter struct {
+	expr     string
+	compound bool // whether the expression must be in parentheses in another one
+}
+
+// RawFilter returns a filter from an expression written by hand, it is put
+// in parentheses when combined with other filters.
+func RawFilter(expr string) ScimFilter {
+	return ScimFilter{expr: strings.TrimSpace(expr), compound: true}
+}
+
+func compare(attr, op string, value interface{}) ScimFilter {
+	switch v := value.(type) {
+	case string:
+		return ScimFilter{expr: fmt.Sprintf(`%s %s "%s"`, attr, op, EscapeQuotes(v))}
+	default:
+		return ScimFilter{expr: fmt.Sprintf("%s %s %v", attr, op, v)}
+	}
+}
+
+// Eq returns a filter of the resources whose attribute equals the value.
+// Strings are quoted, other values such as booleans and numbers are not.
+func Eq(attr string, value interface{}) ScimFilter {
+	return compare(attr, "eq", value)
+}
+
+// Sw returns a filter of the resources whose attribute starts with the value
+func Sw(attr, value string) ScimFilter {
+	return compare(attr, "sw", value)
+}
+
+// Co returns a filter of the resources whose attribute contains the value
+func Co(attr, value string) ScimFilter {
+	return compare(attr, "co", value)
+}
+
+func combine(op string, filters []ScimFilter) ScimFilter {
+	nonEmpty := []ScimFilter{}
+	for _, f := range filters {
+		if f.expr != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+	switch len(nonEmpty) {
+	case 0:
+		return ScimFilter{}
+	case 1:
+		return nonEmpty[0]
+	}
+	exprs := make([]string, len(nonEmpty))
+	for i, f := range nonEmpty {
+		if exprs[i] = f.expr; f.compound {
+			exprs[i] = "(" + f.expr + ")"
+		}
+	}
+	return ScimFilter{expr: strings.Join(exprs, " "+op+" "), compound: true}
+}
+
+// And returns a filter of the resources that match all the filters, empty
+// filters are ignored.
+func And(filters ...ScimFilter) ScimFilter {
+	return combine("and", filters)
+}
+
+// Or returns a filter of the resources that match any of the filters, empty
+// filters are ignored.
+func Or(filters ...ScimFilter) ScimFilter {
+	return combine("or", filters)
+}
+
+func (f ScimFilter) String() string {
+	return f.expr
+}
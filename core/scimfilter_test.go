@@ -0,0 +1,44 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilterValuesAreQuotedAndEscaped(t *testing.T) {
+	assert.Equal(t, `userName eq "joe"`, Eq("userName", "joe").String())
+	assert.Equal(t, `displayName eq "the \"best\" \\ friends"`, Eq("displayName", `the "best" \ friends`).String())
+	assert.Equal(t, `active eq false`, Eq("active", false).String())
+	assert.Equal(t, `userName sw "jo"`, Sw("userName", "jo").String())
+	assert.Equal(t, `emails.value co "@acme.com"`, Co("emails.value", "@acme.com").String())
+}
+
+func TestFiltersAreCombined(t *testing.T) {
+	assert.Equal(t, `userName sw "a" and active eq true`, And(Sw("userName", "a"), Eq("active", true)).String())
+	assert.Equal(t, `(userName eq "a" or userName eq "b") and active eq true`,
+		And(Or(Eq("userName", "a"), Eq("userName", "b")), Eq("active", true)).String())
+	assert.Equal(t, `(title pr) or userName eq "a"`, Or(RawFilter(" title pr "), Eq("userName", "a")).String())
+}
+
+func TestEmptyFiltersAreIgnored(t *testing.T) {
+	assert.Equal(t, "", And().String())
+	assert.Equal(t, "", And(RawFilter(""), ScimFilter{}).String())
+	assert.Equal(t, "title pr", And(RawFilter("title pr"), RawFilter("")).String())
+	assert.Equal(t, `(title pr) and userName eq "a"`,
+		And(RawFilter(""), And(RawFilter("title pr"), Eq("userName", "a"))).String())
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+const (
+	patchOpSchemaURN = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scim2PatchKey    = "scim2Patch"
+)
+
+// patchOp is an operation of a SCIM 2.0 PATCH request
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type patchRequest struct {
+	Schemas    []string  `json:"schemas"`
+	Operations []patchOp `json:"Operations"`
+}
+
+// UseScim2Patch makes the updates of users sent with the context SCIM 2.0
+// PATCH requests, with remove operations for the attributes to clear, rather
+// than SCIM 1.x patches.
+func UseScim2Patch(ctx *HttpContext) {
+	ctx.SetValue(scim2PatchKey, true)
+}
+
+// scimPatchClear patches a resource with the attributes of input and removes
+// the attributes at the given paths. SCIM 1.x removes the attributes listed
+// in meta.attributes, SCIM 2.0 has a remove operation for each.
+func scimPatchClear(ctx *HttpContext, resType, id string, input interface{}, clear []string) error {
+	scim2, _ := ctx.Value(scim2PatchKey, nil)
+	if len(clear) == 0 && scim2 != true {
+		return scimPatch(ctx, resType, id, input)
+	}
+	attrs := map[string]interface{}{}
+	if data, err := json.Marshal(input); err != nil {
+		return err
+	} else if err = json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+	if scim2 != true {
+		attrs["meta"] = map[string]interface{}{"attributes": clear}
+		return scimPatch(ctx, resType, id, attrs)
+	}
+	patch := patchRequest{Schemas: []string{patchOpSchemaURN}}
+	for name := range attrs {
+		if strings.EqualFold(name, "schemas") {
+			delete(attrs, name)
+		}
+	}
+	if len(attrs) > 0 {
+		patch.Operations = append(patch.Operations, patchOp{Op: "replace", Value: attrs})
+	}
+	for _, path := range clear {
+		patch.Operations = append(patch.Operations, patchOp{Op: "remove", Path: path})
+	}
+	return ctx.Accept("json").Request("PATCH", fmt.Sprintf("scim/%s/%s", resType, id), &patch, nil)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+type scimMeta struct {
+	Created, LastModified, Location, Version string `json:",omitempty"`
+}
+
+type groupMember struct {
+	Value, Display, Type string `json:",omitempty"`
+}
+
+// groupResource is the typed content of a SCIM group
+type groupResource struct {
+	Schemas         []string      `json:",omitempty"`
+	Id, DisplayName string        `json:",omitempty"`
+	Members         []groupMember `json:",omitempty"`
+	Meta            *scimMeta     `json:",omitempty"`
+}
+
+// scimResource is a SCIM resource as returned by the server, decoded into
+// the typed attributes that priam uses. All the attributes returned are also
+// kept as they are, so that none is dropped when the resource is printed or
+// sent back.
+type scimResource interface {
+	id() string
+	name(nameAttr string) string
+	meta() *scimMeta
+	attributes() map[string]interface{}
+}
+
+// rawAttributes are all the attributes of a resource, by name
+type rawAttributes struct {
+	raw map[string]interface{}
+}
+
+func (r *rawAttributes) attributes() map[string]interface{} {
+	return r.raw
+}
+
+func (r *rawAttributes) name(nameAttr string) string {
+	return InterfaceToString(r.raw[nameAttr])
+}
+
+// decodeResource decodes a resource both into its typed attributes and into
+// the map of all its attributes.
+func decodeResource(data []byte, typed interface{}, raw *rawAttributes) error {
+	if err := json.Unmarshal(data, typed); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &raw.raw)
+}
+
+// encodeResource encodes all the attributes of a resource, with the typed
+// attributes that are set replacing the ones that were decoded. Attribute
+// names are compared without case, as SCIM does.
+func encodeResource(typed interface{}, raw rawAttributes) ([]byte, error) {
+	data, err := json.Marshal(typed)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]interface{})
+	if err = json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]interface{}, len(raw.raw))
+	for name, value := range raw.raw {
+		if !hasFoldedKey(set, name) {
+			attrs[name] = value
+		}
+	}
+	for name, value := range set {
+		attrs[name] = value
+	}
+	return json.Marshal(attrs)
+}
+
+func hasFoldedKey(attrs map[string]interface{}, name string) bool {
+	for key := range attrs {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// typedUser is a SCIM user
+type typedUser struct {
+	userAccount
+	rawAttributes
+}
+
+func (u *typedUser) UnmarshalJSON(data []byte) error {
+	return decodeResource(data, &u.userAccount, &u.rawAttributes)
+}
+
+func (u *typedUser) MarshalJSON() ([]byte, error) {
+	return encodeResource(&u.userAccount, u.rawAttributes)
+}
+
+func (u *typedUser) id() string { return u.Id }
+
+func (u *typedUser) meta() *scimMeta { return u.Meta }
+
+func (u *typedUser) name(nameAttr string) string {
+	if nameAttr == "userName" {
+		return u.UserName
+	}
+	return u.rawAttributes.name(nameAttr)
+}
+
+// basicUser returns the attributes of the user that are loaded and backed up
+func (u *typedUser) basicUser() BasicUser {
+	user := BasicUser{Name: u.UserName, Display: u.DisplayName}
+	if u.Name != nil {
+		user.Given, user.Family = u.Name.GivenName, u.Name.FamilyName
+		user.Middle, user.Honorific = u.Name.MiddleName, u.Name.HonorificPrefix
+	}
+	if len(u.Emails) > 0 {
+		user.Email = u.Emails[0].Value
+	}
+	return user
+}
+
+// typedGroup is a SCIM group
+type typedGroup struct {
+	groupResource
+	rawAttributes
+}
+
+func (g *typedGroup) UnmarshalJSON(data []byte) error {
+	return decodeResource(data, &g.groupResource, &g.rawAttributes)
+}
+
+func (g *typedGroup) MarshalJSON() ([]byte, error) {
+	return encodeResource(&g.groupResource, g.rawAttributes)
+}
+
+func (g *typedGroup) id() string { return g.Id }
+
+func (g *typedGroup) meta() *scimMeta { return g.Meta }
+
+func (g *typedGroup) name(nameAttr string) string {
+	if nameAttr == "displayName" {
+		return g.DisplayName
+	}
+	return g.rawAttributes.name(nameAttr)
+}
+
+// genericResource is a SCIM resource of a type with no typed attributes
+// other than the common ones, such as roles.
+type genericResource struct {
+	common struct {
+		Id   string
+		Meta *scimMeta
+	}
+	rawAttributes
+}
+
+func (r *genericResource) UnmarshalJSON(data []byte) error {
+	return decodeResource(data, &r.common, &r.rawAttributes)
+}
+
+func (r *genericResource) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.raw)
+}
+
+func (r *genericResource) id() string { return r.common.Id }
+
+func (r *genericResource) meta() *scimMeta { return r.common.Meta }
+
+// newScimResource returns an empty resource of the given type to decode
+func newScimResource(resType string) scimResource {
+	switch resType {
+	case "Users":
+		return &typedUser{}
+	case "Groups":
+		return &typedGroup{}
+	}
+	return &genericResource{}
+}
+
+// decodeResources decodes the resources of a SCIM search
+func decodeResources(resType string, resources []json.RawMessage) ([]scimResource, error) {
+	decoded := make([]scimResource, len(resources))
+	for i, data := range resources {
+		decoded[i] = newScimResource(resType)
+		if err := json.Unmarshal(data, decoded[i]); err != nil {
+			return nil, fmt.Errorf("unexpected %s resource in the response: %v: %s", resType, err, BodySnippet(data))
+		}
+	}
+	return decoded, nil
+}
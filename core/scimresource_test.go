@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const userWithExtraAttributes = `{"id": "1", "userName": "anna", "name": {"givenName": "Anna"},
+	"emails": [{"value": "anna@example.com"}], "meta": {"lastModified": "2020-01-02T03:04:05Z"},
+	"title": "princess", "urn:test:ext": {"castle": "arendelle"}}`
+
+func TestUserIsDecodedWithAllAttributes(t *testing.T) {
+	resources, err := decodeResources("Users", []json.RawMessage{json.RawMessage(userWithExtraAttributes)})
+	require.Nil(t, err)
+	user := resources[0].(*typedUser)
+	assert.Equal(t, "1", user.id())
+	assert.Equal(t, "anna", user.name("userName"))
+	assert.Equal(t, "princess", user.name("title"))
+	assert.Equal(t, "2020-01-02T03:04:05Z", user.meta().LastModified)
+	assert.Equal(t, BasicUser{Name: "anna", Given: "Anna", Email: "anna@example.com"}, user.basicUser())
+	assert.Equal(t, map[string]interface{}{"castle": "arendelle"}, user.attributes()["urn:test:ext"])
+}
+
+func TestEncodedUserKeepsUnknownAttributes(t *testing.T) {
+	user := &typedUser{}
+	require.Nil(t, json.Unmarshal([]byte(userWithExtraAttributes), user))
+	user.Name.FamilyName = "Arendelle"
+	data, err := json.Marshal(user)
+	require.Nil(t, err)
+	var encoded map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &encoded))
+	assert.Equal(t, "princess", encoded["title"])
+	assert.Equal(t, map[string]interface{}{"castle": "arendelle"}, encoded["urn:test:ext"])
+	assert.Equal(t, map[string]interface{}{"GivenName": "Anna", "FamilyName": "Arendelle"}, encoded["Name"])
+	assert.Nil(t, encoded["name"])
+}
+
+func TestGroupIsDecodedWithMembers(t *testing.T) {
+	resources, err := decodeResources("Groups", []json.RawMessage{json.RawMessage(`{"id": "10",
+		"displayName": "friends", "members": [{"value": "1", "display": "anna", "type": "User"}], "extra": true}`)})
+	require.Nil(t, err)
+	group := resources[0].(*typedGroup)
+	assert.Equal(t, "friends", group.name("displayName"))
+	assert.Equal(t, []groupMember{{Value: "1", Display: "anna", Type: "User"}}, group.Members)
+	assert.Nil(t, group.meta())
+	assert.Equal(t, true, group.attributes()["extra"])
+}
+
+func TestUnknownTypeIsDecodedAsGeneric(t *testing.T) {
+	resources, err := decodeResources("Roles", []json.RawMessage{json.RawMessage(`{"id": "20",
+		"displayName": "admins", "meta": {"created": "2020-01-01T00:00:00Z"}}`)})
+	require.Nil(t, err)
+	assert.IsType(t, &genericResource{}, resources[0])
+	assert.Equal(t, "20", resources[0].id())
+	assert.Equal(t, "admins", resources[0].name("displayName"))
+	assert.Equal(t, "2020-01-01T00:00:00Z", resources[0].meta().Created)
+}
+
+func TestDecodeResourcesFailsOnWrongType(t *testing.T) {
+	_, err := decodeResources("Users", []json.RawMessage{json.RawMessage(`{"userName": 3}`)})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,48 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	. "github.com/vmware/priam/util"
+)
+
+// ScimList prints the resources of any SCIM resource type with their id and
+// the given name attribute, or all their attributes if verbose. The type is
+// sent as is, so the server says whether it has such resources.
+func ScimList(ctx *HttpContext, resType, nameAttr string, opts ListOptions) {
+	scimList(ctx, opts, resType, "id", nameAttr)
+}
+
+// ScimGet prints the resource of any SCIM resource type whose name attribute
+// is name, or the resources whose name matches with a name match.
+func ScimGet(ctx *HttpContext, resType, nameAttr, name string) {
+	scimGet(ctx, resType, nameAttr, name)
+}
+
+// ScimResourceTypes prints the name, endpoint and schema of the resource
+// types that the server advertises.
+func ScimResourceTypes(ctx *HttpContext) {
+	types, err := scimDiscover(ctx, "scim/ResourceTypes")
+	if err != nil {
+		ctx.Log.Err("Error getting SCIM resource types: %v\n", err)
+		return
+	}
+	list := make([]interface{}, len(types))
+	for i, t := range types {
+		list[i] = t
+	}
+	ctx.Log.PP("Resource types", list, "name", "endpoint", "schema")
+}
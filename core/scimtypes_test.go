@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"testing"
+)
+
+func TestScimListPrintsIdAndNameOfAnyType(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Devices?attributes=id%2CdeviceName": GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"id": "d1", "deviceName": "pixel", "owner": "anna"}]}`)})
+	ScimList(ctx, "Devices", "deviceName", ListOptions{})
+	AssertOnlyInfoContains(t, ctx, "---- Devices ----\n- deviceName: pixel\n  id: d1\n")
+	assert.NotContains(t, ctx.Log.InfoString(), "owner")
+}
+
+func TestScimListOfUnknownTypeFailsWithServerError(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Widgets?attributes=id%2CdisplayName": ErrorHandler(404, "no such endpoint")})
+	ScimList(ctx, "Widgets", "displayName", ListOptions{})
+	AssertErrorContains(t, ctx, "Error getting SCIM resources of type Widgets: 404 Not Found")
+	assert.Contains(t, ctx.Log.ErrString(), "no such endpoint")
+}
+
+func TestScimGetOfAnyTypeByName(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Devices?count=500&filter=deviceName+eq+%22pixel%22": GoodPathHandler(`{"totalResults": 1,
+			"Resources": [{"id": "d1", "deviceName": "pixel", "owner": "anna"}]}`)})
+	ScimGet(ctx, "Devices", "deviceName", "pixel")
+	AssertOnlyInfoContains(t, ctx, "owner: anna")
+}
+
+func TestScimResourceTypesPrintsAdvertisedTypes(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		resourceTypesPath: GoodPathHandler(`{"Resources": [
+			{"name": "User", "endpoint": "/Users", "schema": "urn:ietf:params:scim:schemas:core:2.0:User"},
+			{"name": "Device", "endpoint": "/Devices", "schema": "urn:example:Device", "description": "devices"}]}`)})
+	ScimResourceTypes(ctx)
+	AssertOnlyInfoContains(t, ctx, "- endpoint: /Devices\n  name: Device\n  schema: urn:example:Device\n")
+	assert.NotContains(t, ctx.Log.InfoString(), "description")
+}
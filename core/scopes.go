@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"net/http"
+	"strings"
+)
+
+const (
+	requestedScopesKey = "requestedScopes"
+	grantedScopesKey   = "grantedScopes"
+)
+
+// scopeFamilies are the scopes needed by the families of endpoints, found
+// by a part of their paths, besides admin which allows them all
+var scopeFamilies = []struct{ part, family, scope string }{
+	{"scim/", "SCIM users, groups and roles", "scim"},
+	{"entitlements/", "entitlements", "entitlements"},
+	{"catalogitems", "the catalog of applications", "catalog"},
+}
+
+// ParseScopes returns the scopes of a list separated by spaces or commas,
+// as OAuth2 requests them
+func ParseScopes(list string) string {
+	return strings.Join(strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }), " ")
+}
+
+// SetTokenScopes sets the scopes requested for the access tokens of the
+// context, which are then requested when they are renewed, and the scopes
+// the access token was granted, if known. Requests refused with 401 or 403
+// then give a hint, see authorizationHint.
+func SetTokenScopes(ctx *HttpContext, requested, granted string) {
+	ctx.SetValue(requestedScopesKey, ParseScopes(requested))
+	ctx.SetValue(grantedScopesKey, ParseScopes(granted))
+	ctx.SetAuthorizationHint(authorizationHint)
+}
+
+func requestedScopes(ctx *HttpContext) string {
+	scopes, _ := ctx.Value(requestedScopesKey, nil)
+	return InterfaceToString(scopes)
+}
+
+// grantedScopes returns the scopes that the access token was granted, from
+// the token response or else from the claims of the token.
+func grantedScopes(ctx *HttpContext) string {
+	if scopes, _ := ctx.Value(grantedScopesKey, nil); InterfaceToString(scopes) != "" {
+		return InterfaceToString(scopes)
+	}
+	return InterfaceToString(tokenClaims(ctx.Headers("Authorization"))["scopes"])
+}
+
+// MissingScopes returns the requested scopes that were not granted
+func MissingScopes(requested, granted string) []string {
+	var missing []string
+	for _, scope := range strings.Fields(ParseScopes(requested)) {
+		if !HasString(scope, strings.Fields(ParseScopes(granted))) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// authorizationHint says why a request was refused. A request refused with
+// 401 has an access token that expired or was revoked, and could not be
+// renewed, so the hint says how to log in to the target again. Other
+// requests get the hint of scopeHint. There is no hint for requests sent
+// without an access token, such as those of logins.
+func authorizationHint(ctx *HttpContext, path string, code int) string {
+	if scheme := strings.SplitN(ctx.Headers("Authorization"), " ", 2)[0]; scheme != "Bearer" && scheme != "HZN" {
+		return ""
+	} else if code != http.StatusUnauthorized {
+		return scopeHint(ctx, path)
+	} else if ctx.TargetName == "" {
+		return `the access token expired or was revoked, log in again with "priam login"`
+	}
+	return fmt.Sprintf(`the access token of target %s expired or was revoked, log in again with `+
+		`"priam --target %s login"`, ctx.TargetName, ctx.TargetName)
+}
+
+// scopeHint says which scope a request that was refused likely needs, and
+// whether the access token has it.
+func scopeHint(ctx *HttpContext, path string) string {
+	family, needed := "this endpoint", []string{"admin"}
+	for _, f := range scopeFamilies {
+		if strings.Contains(path, f.part) {
+			family, needed = f.family, []string{f.scope, "admin"}
+			break
+		}
+	}
+	granted := grantedScopes(ctx)
+	if granted == "" {
+		return fmt.Sprintf("requests for %s need the %s scope, check the scopes of the access token with \"priam check\"",
+			family, strings.Join(needed, " or "))
+	}
+	for _, scope := range needed {
+		if HasString(scope, strings.Fields(granted)) {
+			return fmt.Sprintf("the access token has the %s scope, the user or client it was issued to may lack "+
+				"the rights needed for %s", scope, family)
+		}
+	}
+	return fmt.Sprintf("requests for %s need the %s scope but the access token only has %s, log in again with "+
+		"\"priam login --scope\"", family, strings.Join(needed, " or "), granted)
+}
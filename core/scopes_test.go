@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+func TestParseAndCompareScopes(t *testing.T) {
+	assert.Equal(t, "openid admin scim", ParseScopes(" openid, admin scim,"))
+	assert.Equal(t, []string{"admin", "catalog"}, MissingScopes("openid,admin catalog", "openid scim"))
+	assert.Empty(t, MissingScopes("", "openid"))
+}
+
+func TestScopeHints(t *testing.T) {
+	ctx := NewReplayContext(t, nil).Authorization("Bearer opaque")
+	SetTokenScopes(ctx, "", "")
+	assert.Equal(t, `requests for SCIM users, groups and roles need the scim or admin scope, check the scopes of the access `+
+		`token with "priam check"`, scopeHint(ctx, "scim/Users?count=1"))
+	SetTokenScopes(ctx, "", "openid user")
+	assert.Equal(t, `requests for entitlements need the entitlements or admin scope but the access token only has openid user, `+
+		`log in again with "priam login --scope"`, scopeHint(ctx, "entitlements/definitions"))
+	assert.Equal(t, `requests for this endpoint need the admin scope but the access token only has openid user, `+
+		`log in again with "priam login --scope"`, scopeHint(ctx, "localuserstore"))
+	SetTokenScopes(ctx, "", "catalog")
+	assert.Equal(t, "the access token has the catalog scope, the user or client it was issued to may lack the "+
+		"rights needed for the catalog of applications", scopeHint(ctx, "catalogitems/search"))
+	assert.Empty(t, authorizationHint(ctx.BasicAuth("john", "travolta"), "scim/Users", 403), "no hint without access token")
+}
+
+func TestForbiddenRequestHasScopeHint(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"GET/scim/Groups/g1": ErrorHandler(403, "forbidden")})
+	SetTokenScopes(ctx.Authorization("Bearer opaque"), "", "openid")
+	err := ctx.Request("GET", "scim/Groups/g1", nil, nil)
+	assert.Contains(t, err.Error(), "\nhint: requests for SCIM users, groups and roles need the scim or admin scope but the "+
+		"access token only has openid")
+	assert.IsType(t, &StatusError{}, err)
+}
+
+func TestUnauthorizedRequestHintSuggestsLoginToTarget(t *testing.T) {
+	ctx := NewReplayContext(t, nil).Authorization("Bearer opaque")
+	assert.Equal(t, `the access token expired or was revoked, log in again with "priam login"`,
+		authorizationHint(ctx, "scim/Users", 401))
+	ctx.TargetName = "prod"
+	assert.Equal(t, `the access token of target prod expired or was revoked, log in again with "priam --target prod login"`,
+		authorizationHint(ctx, "scim/Users", 401))
+}
+
+func TestCheckShowsScopesOfToken(t *testing.T) {
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"prn": "alice@example", "scp": []string{"openid", "user"}}).SignedString([]byte("test key"))
+	srv, ctx := NewTestContext(t, map[string]TstHandler{checkPath: GoodPathHandler(`{"totalResults": 0}`)})
+	defer srv.Close()
+	SetTokenScopes(ctx, "openid admin", "")
+	CmdCheck(ctx.Authorization("Bearer " + token))
+	assert.Contains(t, ctx.Log.InfoString(), "scopes: openid user\n")
+	assert.Contains(t, ctx.Log.InfoString(), "requestedScopes: openid admin\n")
+	assert.Equal(t, "WARNING: the access token was not granted the requested scopes: admin\n", ctx.Log.ErrString())
+}
@@ -30,6 +30,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 /* TokenInfo encapsulates various tokens and information returned by OAuth2 token grants.
@@ -48,6 +50,7 @@ type TokenInfo struct {
 // Interface to get tokens via OAuth2 grants, system user login API, and validate them.
 type TokenGrants interface {
 	ClientCredentialsGrant(ctx *HttpContext, clientID, clientSecret string) (TokenInfo, error)
+	RefreshTokenGrant(ctx *HttpContext, refreshToken string) (TokenInfo, error)
 	LoginSystemUser(ctx *HttpContext, user, password string) (TokenInfo, error)
 	AuthCodeGrant(ctx *HttpContext, userHint string) (TokenInfo, error)
 	ValidateIDToken(ctx *HttpContext, idToken string)
@@ -61,7 +64,29 @@ type TokenService struct{ BasePath, AuthorizePath, TokenPath, LoginPath, CliClie
 */
 func (ts TokenService) ClientCredentialsGrant(ctx *HttpContext, clientID, clientSecret string) (ti TokenInfo, err error) {
 	ctx.BasicAuth(clientID, clientSecret).ContentType("application/x-www-form-urlencoded")
-	err = ctx.Request("POST", ts.BasePath+ts.TokenPath, url.Values{"grant_type": {"client_credentials"}}.Encode(), &ti)
+	inp := withScopes(ctx, url.Values{"grant_type": {"client_credentials"}}).Encode()
+	err = ctx.Request("POST", ts.BasePath+ts.TokenPath, inp, &ti)
+	return
+}
+
+// withScopes adds the scopes requested for the tokens of the context, if
+// any, to the parameters of a grant
+func withScopes(ctx *HttpContext, vals url.Values) url.Values {
+	if scopes := requestedScopes(ctx); scopes != "" {
+		vals.Set("scope", scopes)
+	}
+	return vals
+}
+
+/*
+RefreshTokenGrant takes a refresh token and makes a request for a new access token.
+
+	Returns common TokenInfo.
+*/
+func (ts TokenService) RefreshTokenGrant(ctx *HttpContext, refreshToken string) (ti TokenInfo, err error) {
+	ctx.BasicAuth(ts.CliClientID, ts.CliClientSecret).ContentType("application/x-www-form-urlencoded")
+	inp := withScopes(ctx, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}).Encode()
+	err = ctx.Request("POST", ts.BasePath+ts.TokenPath, inp, &ti)
 	return
 }
 
@@ -143,8 +168,8 @@ func (ts TokenService) AuthCodeGrant(ctx *HttpContext, userHint string) (ti Toke
 	}
 
 	authStateDelivery <- state
-	vals := url.Values{"response_type": {"code"}, "client_id": {ts.CliClientID},
-		"state": {state}, "redirect_uri": {TokenCatcherURI}}
+	vals := withScopes(ctx, url.Values{"response_type": {"code"}, "client_id": {ts.CliClientID},
+		"state": {state}, "redirect_uri": {TokenCatcherURI}})
 	if userHint != "" {
 		vals.Set("login_hint", userHint)
 	}
@@ -225,6 +250,63 @@ func (ts TokenService) ValidateIDToken(ctx *HttpContext, idToken string) {
 	}
 }
 
+// tokenClaims returns who the access token of an Authorization header was
+// issued to, its scopes and when it expires, read from its claims without
+// verifying it.
+func tokenClaims(authorization string) map[string]interface{} {
+	info, claims := map[string]interface{}{}, jwt.MapClaims{}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 {
+		info["principal"] = "none, no access token"
+		return info
+	}
+	if _, _, err := new(jwt.Parser).ParseUnverified(parts[1], claims); err != nil {
+		info["principal"] = "unknown, the access token is not a JWT"
+		return info
+	}
+	for _, k := range []string{"prn", "sub", "user_name"} {
+		if v, ok := claims[k].(string); ok && v != "" {
+			info["principal"] = v
+			break
+		}
+	}
+	for _, k := range []string{"cid", "client_id", "azp"} {
+		if v, ok := claims[k].(string); ok && v != "" {
+			info["client"] = v
+			break
+		}
+	}
+	switch scopes := claims["scp"].(type) {
+	case string:
+		info["scopes"] = ParseScopes(scopes)
+	case []interface{}:
+		list := make([]string, len(scopes))
+		for i, scope := range scopes {
+			list[i] = InterfaceToString(scope)
+		}
+		info["scopes"] = strings.Join(list, " ")
+	}
+	if scopes, ok := claims["scope"].(string); ok && info["scopes"] == nil {
+		info["scopes"] = ParseScopes(scopes)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		info["tokenExpiry"] = time.Unix(int64(exp), 0).UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// TokenPrincipal returns who the access token of an Authorization header was
+// issued to, or why it is not known.
+func TokenPrincipal(authorization string) string {
+	return InterfaceToString(tokenClaims(authorization)["principal"])
+}
+
+// TokenClient returns the OAuth2 client that the access token of an
+// Authorization header was issued by, "" if it is not known.
+func TokenClient(authorization string) string {
+	return InterfaceToString(tokenClaims(authorization)["client"])
+}
+
 // define cred file handlers so that they can be stubbed for testing
 var saveCredFile = func(f *ini.File, fileName string) error { return f.SaveTo(fileName) }
 var updateKeyInCredFile = func(f *ini.File, section, key, value string) error {
@@ -65,6 +65,33 @@ func TestCanLoginWithClientCreds(t *testing.T) {
 	assert.Equal(t, ti.AccessToken, goodAccessToken)
 }
 
+func TestClientCredsGrantRequestsScopes(t *testing.T) {
+	handler := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "grant_type=client_credentials&scope=admin+scim", req.Input)
+		return &TstReply{Output: `{"token_type": "Bearer", "access_token": "` + goodAccessToken + `", "scope": "scim"}`}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST" + testTS.BasePath + testTS.TokenPath: handler})
+	defer srv.Close()
+	SetTokenScopes(ctx, "admin,scim", "")
+	ti, err := testTS.ClientCredentialsGrant(ctx, "john", "travolta")
+	assert.Nil(t, err)
+	assert.Equal(t, "scim", ti.Scope)
+}
+
+func TestCanRefreshToken(t *testing.T) {
+	handler := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, "Basic c2Fsbzp0cmFsZmFtYWRvcmU=", req.Authorization)
+		assert.Equal(t, "grant_type=refresh_token&refresh_token=so-it-goes", req.Input)
+		return &TstReply{Output: `{"token_type": "Bearer", "access_token": "` + goodAccessToken + `", "expires_in": 3600}`}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST" + testTS.BasePath + testTS.TokenPath: handler})
+	defer srv.Close()
+	ti, err := testTS.RefreshTokenGrant(ctx, "so-it-goes")
+	assert.Nil(t, err)
+	assert.Equal(t, goodAccessToken, ti.AccessToken)
+	assert.Equal(t, 3600, ti.ExpiresIn)
+}
+
 func TestCanHandleBadUserLoginReply(t *testing.T) {
 	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST" + testTS.BasePath + testTS.LoginPath: ErrorHandler(0, "crap")})
 	defer srv.Close()
@@ -154,7 +181,7 @@ func TestAuthCodeGrant(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "Bearer", ti.AccessTokenType)
 	assert.Equal(t, goodAccessToken, ti.AccessToken)
-	assert.Contains(t, ctx.Log.InfoString(), "caught authcode: "+authcode)
+	assert.Contains(t, ctx.Log.ErrString(), "caught authcode: "+authcode)
 }
 
 func TestHandleBadAuthCode(t *testing.T) {
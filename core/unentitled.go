@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnentitledOptions are the options of UnentitledUsers
+type UnentitledOptions struct {
+	Effective bool   // also check the entitlements of the groups of each user
+	Parallel  int    // maximum number of users checked at the same time
+	MinAge    int    // only report users created at least this number of days ago, if set
+	Output    string // CSV file to write the users to rather than print them, if set
+	// only report users created or last modified within these times
+	DateWindow
+}
+
+// unentitledUser is an active user entitled to no app
+type unentitledUser struct {
+	UserName string `json:"userName" yaml:"userName"`
+	Email    string `json:"email" yaml:"email"`
+	Created  string `json:"created" yaml:"created"`
+	id       string
+	groups   []dispValue
+	err      error
+	entitled bool
+}
+
+// UnentitledUsers prints the active users that are entitled to no app,
+// directly or with opts.Effective through their groups. Each user is checked
+// with its own request, from at most opts.Parallel goroutines, and the
+// entitlements of each group are got once. Users that could not be checked
+// are reported and make the command fail with ExitPartial.
+func UnentitledUsers(ctx *HttpContext, opts UnentitledOptions) {
+	attrs := []string{"id", "userName", "emails", "meta"}
+	if opts.Effective {
+		attrs = append(attrs, "groups")
+	}
+	var cutoff time.Time
+	if opts.MinAge > 0 {
+		cutoff = time.Now().AddDate(0, 0, -opts.MinAge)
+	}
+	users, tooNew, outside, undated := []*unentitledUser{}, 0, 0, 0
+	err := scimForEach(ctx, "Users", Eq("active", true).String(), attrs, func(resource scimResource) error {
+		u := resource.(*typedUser)
+		user := &unentitledUser{UserName: u.UserName, Email: u.basicUser().Email, id: u.Id, groups: u.Groups}
+		if u.Meta != nil {
+			user.Created = u.Meta.Created
+		}
+		if !timeBefore(user.Created, cutoff) {
+			tooNew++
+			return nil
+		}
+		within, invalid := opts.within(u.Meta)
+		if !within {
+			outside++
+			return nil
+		} else if invalid {
+			undated++
+		}
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		ctx.Log.Err("Could not get active users: %v\n", err)
+		return
+	}
+	groupsEntitled, mutex := make(map[string]bool), sync.Mutex{}
+	progress := ctx.Log.StartProgress("Users checked", len(users))
+	forEachParallel(ctx, len(users), opts.Parallel, func(ctx *HttpContext, i int) {
+		defer progress.Add(1)
+		user := users[i]
+		if ctx.Canceled() {
+			user.err = fmt.Errorf("not checked")
+			return
+		}
+		defs, err := subjectEntitlements(ctx, "users", user.id)
+		if user.entitled, user.err = len(defs) > 0, err; user.entitled || err != nil || !opts.Effective {
+			return
+		}
+		user.entitled, user.err = groupsHaveEntitlements(ctx, user, groupsEntitled, &mutex)
+	})
+	progress.Finish()
+	unentitled, failed := []*unentitledUser{}, 0
+	for _, user := range users {
+		if user.err != nil {
+			ctx.Log.Err("Could not get entitlements of user %s: %v\n", user.UserName, user.err)
+			failed++
+		} else if !user.entitled {
+			unentitled = append(unentitled, user)
+		}
+	}
+	sort.Slice(unentitled, func(i, j int) bool { return unentitled[i].UserName < unentitled[j].UserName })
+	if opts.Output == "" {
+		ctx.Log.PP("Users without entitlements", unentitled, "userName", "email", "created")
+	} else if err := writeUnentitledUsers(opts.Output, unentitled); err != nil {
+		ctx.Log.Err("Could not write users without entitlements to %s: %v\n", opts.Output, err)
+	} else {
+		ctx.Log.Info("Users without entitlements written to %s\n", opts.Output)
+	}
+	ctx.Log.Info("Active users: %d, without entitlements: %d, too new: %d, not checked: %d\n",
+		len(users)+tooNew+outside, len(unentitled), tooNew, failed)
+	if opts.DateWindow.IsSet() {
+		ctx.Log.Info("Users not created or modified within the dates: %d\n", outside)
+	}
+	if undated > 0 {
+		ctx.Log.Warn("%d users without a valid creation or modification time are checked whatever their dates\n",
+			undated)
+	}
+	if failed > 0 {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
+
+// groupsHaveEntitlements returns true if any group of a user is entitled to
+// an app. The groups are those of the user, or else those found by
+// userGroups. Whether a group is entitled is kept in entitled.
+func groupsHaveEntitlements(ctx *HttpContext, user *unentitledUser, entitled map[string]bool,
+	mutex *sync.Mutex) (bool, error) {
+	ids := []string{}
+	for _, g := range user.groups {
+		ids = append(ids, g.Value)
+	}
+	if len(ids) == 0 {
+		groups, _, err := userGroups(ctx, &typedUser{userAccount: userAccount{Id: user.id, UserName: user.UserName}})
+		if err != nil {
+			return false, fmt.Errorf("could not get groups: %v", err)
+		}
+		for _, g := range groups {
+			ids = append(ids, g.ID)
+		}
+	}
+	for _, id := range ids {
+		mutex.Lock()
+		groupEntitled, known := entitled[id]
+		mutex.Unlock()
+		if !known {
+			defs, err := subjectEntitlements(ctx, "groups", id)
+			if err != nil {
+				return false, fmt.Errorf("could not get entitlements of group %s: %v", id, err)
+			}
+			groupEntitled = len(defs) > 0
+			mutex.Lock()
+			entitled[id] = groupEntitled
+			mutex.Unlock()
+		}
+		if groupEntitled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// writeUnentitledUsers writes users to a CSV file with a header
+func writeUnentitledUsers(fileName string, users []*unentitledUser) error {
+	records := [][]string{{"userName", "email", "created"}}
+	for _, u := range users {
+		records = append(records, []string{u.UserName, u.Email, u.Created})
+	}
+	return writeCSVFile(fileName, records)
+}
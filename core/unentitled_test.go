@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// unentitledPaths are the paths of active users anna entitled directly,
+// olaf entitled to nothing, sven created today, kristoff and elsa entitled
+// through group friends, and hans whose entitlements cannot be got. The
+// number of requests for the entitlements of friends is counted.
+func unentitledPaths(groupRequests *int) map[string]TstHandler {
+	none := GoodPathHandler(`{"items": []}`)
+	return map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta%2Cgroups&count=500&filter=active+eq+true&startIndex=1": GoodPathHandler(`{
+			"totalResults": 6, "Resources": [
+			{"id": "1", "userName": "anna", "meta": {"created": "2019-01-01T00:00:00Z"}},
+			{"id": "2", "userName": "olaf", "emails": [{"value": "olaf@example.com"}], "meta": {"created": "2019-01-01T00:00:00Z"}},
+			{"id": "3", "userName": "sven", "meta": {"created": "` + time.Now().UTC().Format(time.RFC3339) + `"}},
+			{"id": "4", "userName": "kristoff", "groups": [{"value": "10"}]},
+			{"id": "5", "userName": "elsa", "groups": [{"value": "10"}]},
+			{"id": "6", "userName": "hans", "groups": [{"value": "10"}]}]}`),
+		"GET/entitlements/definitions/users/1": GoodPathHandler(`{"items": [{"catalogItemId": "app-1"}]}`),
+		"GET/entitlements/definitions/users/2": none,
+		"GET/entitlements/definitions/users/3": none,
+		"GET/entitlements/definitions/users/4": none,
+		"GET/entitlements/definitions/users/5": none,
+		"GET/entitlements/definitions/users/6": ErrorHandler(503, "down"),
+		"GET/entitlements/definitions/groups/10": func(t *testing.T, req *TstReq) *TstReply {
+			*groupRequests++
+			return &TstReply{Output: `{"items": [{"catalogItemId": "app-2"}]}`}
+		},
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=members.value+eq+%222%22&startIndex=1": GoodPathHandler(`{"totalResults": 0}`),
+		"GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=members.value+eq+%223%22&startIndex=1": GoodPathHandler(`{"totalResults": 0}`),
+	}
+}
+
+func TestUnentitledUsers(t *testing.T) {
+	groupRequests := 0
+	ctx := NewReplayContext(t, unentitledPaths(&groupRequests))
+	ctx.MaxAttempts = 1
+	ctx.Log.Format = FCsv
+	UnentitledUsers(ctx, UnentitledOptions{Parallel: 1, Effective: true})
+	assert.Contains(t, ctx.Log.InfoString(), "userName,email,created\nolaf,olaf@example.com,2019-01-01T00:00:00Z\nsven,,")
+	assert.NotContains(t, ctx.Log.InfoString(), "kristoff")
+	assert.Equal(t, 1, groupRequests)
+	assert.Contains(t, ctx.Log.ErrString(), "Could not get entitlements of user hans: 503")
+	assert.Contains(t, ctx.Log.ErrString(), "Active users: 6, without entitlements: 2, too new: 0, not checked: 1\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestUnentitledUsersDirectOnlyToCSVFile(t *testing.T) {
+	paths := unentitledPaths(new(int))
+	paths["GET/scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta&count=500&filter=active+eq+true&startIndex=1"] =
+		paths["GET/scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta%2Cgroups&count=500&filter=active+eq+true&startIndex=1"]
+	paths["GET/entitlements/definitions/users/6"] = GoodPathHandler(`{"items": []}`)
+	f := WriteTempFile(t, "")
+	defer CleanupTempFile(f)
+	ctx := NewReplayContext(t, paths)
+	UnentitledUsers(ctx, UnentitledOptions{Parallel: 4, MinAge: 30, Output: f.Name()})
+	content, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+	assert.Equal(t, "userName,email,created\nelsa,,\nhans,,\nkristoff,,\nolaf,olaf@example.com,2019-01-01T00:00:00Z\n",
+		string(content))
+	AssertOnlyInfoContains(t, ctx, "Users without entitlements written to "+f.Name()+"\n"+
+		"Active users: 6, without entitlements: 4, too new: 1, not checked: 0\n")
+}
+
+func TestUnentitledUsersCreatedWithinDates(t *testing.T) {
+	paths := unentitledPaths(new(int))
+	paths["GET/scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta&count=500&filter=active+eq+true&startIndex=1"] =
+		paths["GET/scim/Users?attributes=id%2CuserName%2Cemails%2Cmeta%2Cgroups&count=500&filter=active+eq+true&startIndex=1"]
+	paths["GET/entitlements/definitions/users/6"] = GoodPathHandler(`{"items": []}`)
+	ctx := NewReplayContext(t, paths)
+	ctx.Log.Format = FCsv
+	after, _ := time.Parse(time.RFC3339, "2020-01-01T00:00:00Z")
+	UnentitledUsers(ctx, UnentitledOptions{Parallel: 1, DateWindow: DateWindow{CreatedAfter: after}})
+	assert.Contains(t, ctx.Log.InfoString(), "userName,email,created\nelsa,,\nhans,,\nkristoff,,\nsven,,")
+	assert.NotContains(t, ctx.Log.InfoString(), "olaf")
+	assert.Contains(t, ctx.Log.ErrString(), "Active users: 6, without entitlements: 4, too new: 0, not checked: 0\n"+
+		"Users not created or modified within the dates: 2\n")
+	assert.Contains(t, ctx.Log.ErrString(),
+		"WARNING: 3 users without a valid creation or modification time are checked whatever their dates\n")
+}
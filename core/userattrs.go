@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	. "github.com/vmware/priam/util"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const keepUnknownFieldsKey = "keepUnknownFields"
+
+// basicUserFields are the fields of users in the YAML files of a load
+var basicUserFields = []string{"name", "given", "family", "middle", "honorific", "display", "email", "pwd",
+	"internalUserType", "attrs"}
+
+// extensionAttrPattern splits the key of an attribute of a schema extension,
+// such as urn:scim:schemas:extension:workspace:1.0.department, into the URN
+// of the extension and the path of the attribute.
+var extensionAttrPattern = regexp.MustCompile(`^(urn:.*:[^.:]*(?:\.\d[^.:]*)*)\.([^:]+)$`)
+
+// KeepUnknownFields makes the fields of the users of a load that priam does
+// not know added to the SCIM attributes of the users, as those of attrs.
+func KeepUnknownFields(ctx *HttpContext) {
+	ctx.SetValue(keepUnknownFieldsKey, true)
+}
+
+// unknownFields returns the fields of a row of a file of users that are not
+// fields of BasicUser, and moves them into the attributes of the user if
+// keep is true.
+func unknownFields(row map[string]interface{}, user *BasicUser, keep bool) (unknown []string) {
+	for key, value := range row {
+		if HasString(key, basicUserFields) {
+			continue
+		}
+		unknown = append(unknown, key)
+		if _, ok := user.Attrs[key]; keep && !ok {
+			if user.Attrs == nil {
+				user.Attrs = map[string]interface{}{}
+			}
+			user.Attrs[key] = value
+		}
+	}
+	return unknown
+}
+
+// keepUnknownFields returns whether the context keeps the unknown fields of
+// users as attributes
+func keepUnknownFields(ctx *HttpContext) bool {
+	keep, _ := ctx.Value(keepUnknownFieldsKey, nil)
+	return keep == true
+}
+
+// warnUnknownFields warns that the unknown fields of the users of a load are
+// ignored, unless the context keeps them.
+func warnUnknownFields(ctx *HttpContext, unknown map[string]bool) {
+	if len(unknown) == 0 || keepUnknownFields(ctx) {
+		return
+	}
+	ignored := make([]string, 0, len(unknown))
+	for key := range unknown {
+		ignored = append(ignored, key)
+	}
+	sort.Strings(ignored)
+	ctx.Log.Warn("unknown fields of users are ignored: %s, use --keep-unknown-fields to add them as "+
+		"attributes\n", strings.Join(ignored, ", "))
+}
+
+// mergeAttributes merges the attributes of a user into the body of the
+// request that adds it. Keys are paths such as name.middleName and may start
+// with the URN of a schema extension, which is then added to the schemas of
+// the user. Attributes set by the fields of the user are kept and a warning
+// says which are ignored.
+func mergeAttributes(ctx *HttpContext, name string, body interface{}, attrs map[string]interface{}) (interface{}, error) {
+	if len(attrs) == 0 {
+		return body, nil
+	}
+	merged := map[string]interface{}{}
+	if data, err := json.Marshal(body); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := attributePath(key)
+		if setAttribute(merged, path, ChangeKeysToString(attrs[key])) {
+			ctx.Log.Warn("attribute %s of user \"%s\" is ignored where it is set by a field of the user\n",
+				key, Named("Users", name))
+		}
+		if len(path) > 1 && strings.HasPrefix(path[0], "urn:") {
+			addSchema(merged, path[0])
+		}
+	}
+	return merged, nil
+}
+
+// attributePath returns the names of the path of an attribute key
+func attributePath(key string) []string {
+	if m := extensionAttrPattern.FindStringSubmatch(key); m != nil {
+		return append([]string{m[1]}, strings.Split(m[2], ".")...)
+	} else if strings.HasPrefix(key, "urn:") {
+		return []string{key}
+	}
+	return strings.Split(key, ".")
+}
+
+// setAttribute sets the value at a path of attributes where none is set,
+// merging maps, and returns true if a value was already set. Names are
+// compared without case.
+func setAttribute(attrs map[string]interface{}, path []string, value interface{}) bool {
+	key := foldedKey(attrs, path[0])
+	current, found := attrs[key]
+	if !found {
+		for i := len(path) - 1; i > 0; i-- {
+			value = map[string]interface{}{path[i]: value}
+		}
+		attrs[key] = value
+		return false
+	}
+	currentMap, ok := current.(map[string]interface{})
+	if !ok {
+		return true
+	} else if len(path) > 1 {
+		return setAttribute(currentMap, path[1:], value)
+	}
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	conflict := false
+	for name, v := range valueMap {
+		conflict = setAttribute(currentMap, []string{name}, v) || conflict
+	}
+	return conflict
+}
+
+// foldedKey returns the key of attrs equal to name without case, or name
+func foldedKey(attrs map[string]interface{}, name string) string {
+	for key := range attrs {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// addSchema adds a schema URN to the schemas of a resource
+func addSchema(attrs map[string]interface{}, urn string) {
+	key := foldedKey(attrs, "schemas")
+	schemas, _ := attrs[key].([]interface{})
+	for _, schema := range schemas {
+		if schema == urn {
+			return
+		}
+	}
+	attrs[key] = append(schemas, urn)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"os"
+	"testing"
+)
+
+func TestAttributePath(t *testing.T) {
+	for key, path := range map[string][]string{
+		"costCenter":      {"costCenter"},
+		"name.middleName": {"name", "middleName"},
+		"urn:scim:schemas:extension:workspace:1.0.department":        {workspaceSchemaURN, "department"},
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"},
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User.manager.value": {
+			"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User", "manager", "value"},
+	} {
+		assert.Equal(t, path, attributePath(key), key)
+	}
+}
+
+func TestAddUserMergesAttributes(t *testing.T) {
+	body := ""
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		body = req.Input
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "ann", Given: "Ann", Email: "ann@hr.com",
+		Attrs: map[string]interface{}{"name.middleName": "Lee", "NAME.givenName": "Annie", "costCenter": "cc42",
+			"urn:scim:schemas:extension:workspace:1.0.department": "hr",
+			"x-badge":                 map[interface{}]interface{}{"color": "blue", "floor": 3},
+			"employeeNumber":          7,
+			workspaceSchemaURN + ".x": map[interface{}]interface{}{"y": true}}})
+	assert.JSONEq(t, `{"Schemas": ["urn:scim:schemas:core:1.0", "urn:scim:schemas:extension:workspace:1.0"],
+		"UserName": "ann", "Name": {"GivenName": "Ann", "FamilyName": "ann", "middleName": "Lee"},
+		"Emails": [{"Value": "ann@hr.com"}], "costCenter": "cc42", "employeeNumber": 7,
+		"x-badge": {"color": "blue", "floor": 3},
+		"urn:scim:schemas:extension:workspace:1.0": {"department": "hr", "x": {"y": true}}}`, body)
+	assert.Equal(t, "WARNING: attribute NAME.givenName of user \"ann\" is ignored where it is set by a field "+
+		"of the user\n", ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "User 'ann' successfully added")
+}
+
+func TestAddUserWithoutAttributesSendsTypedFields(t *testing.T) {
+	body := ""
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		body = req.Input
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "ann", Email: "ann@hr.com"})
+	assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"UserName":"ann","Emails":[{"Value":"ann@hr.com"}],`+
+		`"Name":{"GivenName":"ann","FamilyName":"ann"}}`, body)
+}
+
+func loadUsersWithUnknownFields(t *testing.T, keep bool) (*HttpContext, []string) {
+	bodies := []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		bodies = append(bodies, req.Input)
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	if keep {
+		KeepUnknownFields(ctx)
+	}
+	usersFile := WriteTempFile(t, "---\n- {name: ann, email: ann@hr.com, department: hr, costCenter: cc1, "+
+		"attrs: {costCenter: cc2, name.middleName: Lee}}\n- {name: bob, email: bob@hr.com, mood: {today: sunny}}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	return ctx, bodies
+}
+
+func TestLoadUsersKeepsUnknownFields(t *testing.T) {
+	ctx, bodies := loadUsersWithUnknownFields(t, true)
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Len(t, bodies, 2)
+	assert.JSONEq(t, `{"Schemas": ["urn:scim:schemas:core:1.0"], "UserName": "ann", "Emails": [{"Value": "ann@hr.com"}],
+		"Name": {"GivenName": "ann", "FamilyName": "ann", "middleName": "Lee"}, "costCenter": "cc2", "department": "hr"}`,
+		bodies[0])
+	assert.JSONEq(t, `{"Schemas": ["urn:scim:schemas:core:1.0"], "UserName": "bob", "Emails": [{"Value": "bob@hr.com"}],
+		"Name": {"GivenName": "bob", "FamilyName": "bob"}, "mood": {"today": "sunny"}}`, bodies[1])
+}
+
+func TestLoadUsersWarnsOfIgnoredUnknownFields(t *testing.T) {
+	ctx, bodies := loadUsersWithUnknownFields(t, false)
+	assert.Equal(t, "WARNING: unknown fields of users are ignored: costCenter, department, mood, use "+
+		"--keep-unknown-fields to add them as attributes\n", ctx.Log.ErrString())
+	assert.JSONEq(t, `{"Schemas": ["urn:scim:schemas:core:1.0"], "UserName": "ann", "Emails": [{"Value": "ann@hr.com"}],
+		"Name": {"GivenName": "ann", "FamilyName": "ann", "middleName": "Lee"}, "costCenter": "cc2"}`, bodies[0])
+	assert.NotContains(t, bodies[1], "mood")
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"text/template"
+)
+
+// usersFile is the form of a YAML file of users with defaults, a map with
+// the defaults and the list of users rather than only the list.
+type usersFile struct {
+	Defaults *BasicUser    `yaml:"defaults,omitempty"`
+	Users    []interface{} `yaml:"users"`
+}
+
+// userDefaults are the defaults of a file of users, each field a template
+// that is expanded with the fields of a user that does not have the field.
+type userDefaults struct {
+	user      *BasicUser
+	templates []defaultTemplate
+}
+
+type defaultTemplate struct {
+	field string
+	tmpl  *template.Template
+	get   func(u *BasicUser) *string
+}
+
+// defaultFields are the fields of users that can have a default, in the
+// order they are expanded so that a default can use the fields defaulted
+// before it.
+var defaultFields = []struct {
+	field string
+	get   func(u *BasicUser) *string
+}{
+	{"given", func(u *BasicUser) *string { return &u.Given }},
+	{"family", func(u *BasicUser) *string { return &u.Family }},
+	{"middle", func(u *BasicUser) *string { return &u.Middle }},
+	{"honorific", func(u *BasicUser) *string { return &u.Honorific }},
+	{"display", func(u *BasicUser) *string { return &u.Display }},
+	{"email", func(u *BasicUser) *string { return &u.Email }},
+	{"pwd", func(u *BasicUser) *string { return &u.Pwd }},
+	{"internalUserType", func(u *BasicUser) *string { return &u.InternalUserType }},
+}
+
+// getUsersFile reads the users of a YAML file, either a list of users or a
+// map with the list under users and their defaults under defaults, and
+// returns the defaults, nil if there are none.
+func getUsersFile(fileName string, users interface{}) (*userDefaults, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUsersFile(content, users)
+}
+
+// decodeUsersFile decodes the content of a file of users as getUsersFile
+func decodeUsersFile(content []byte, users interface{}) (*userDefaults, error) {
+	var probe interface{}
+	if err := yaml.Unmarshal(content, &probe); err != nil {
+		return nil, err
+	} else if _, ok := probe.(map[interface{}]interface{}); !ok {
+		return nil, yaml.Unmarshal(content, users)
+	}
+	var file usersFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, err
+	}
+	if rows, err := yaml.Marshal(file.Users); err != nil {
+		return nil, err
+	} else if err = yaml.Unmarshal(rows, users); err != nil {
+		return nil, err
+	}
+	if file.Defaults == nil {
+		return nil, nil
+	}
+	return newUserDefaults(file.Defaults)
+}
+
+// putUsersFile writes users to a YAML file in the form of getUsersFile, with
+// the defaults if there are any so that the users can be loaded again.
+func putUsersFile(fileName string, users []BasicUser, defaults *userDefaults) error {
+	if defaults == nil {
+		return PutYamlFile(fileName, users)
+	}
+	file := usersFile{Defaults: defaults.user}
+	for _, u := range users {
+		file.Users = append(file.Users, u)
+	}
+	return PutYamlFile(fileName, file)
+}
+
+// newUserDefaults parses the templates of the defaults of a file of users
+func newUserDefaults(user *BasicUser) (*userDefaults, error) {
+	if user.Name != "" {
+		return nil, fmt.Errorf("defaults cannot set the name of users")
+	}
+	defaults := &userDefaults{user: user}
+	for _, f := range defaultFields {
+		if text := *f.get(user); text != "" {
+			tmpl, err := template.New(f.field).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default %s: %v", f.field, err)
+			}
+			defaults.templates = append(defaults.templates, defaultTemplate{f.field, tmpl, f.get})
+		}
+	}
+	return defaults, nil
+}
+
+// apply returns the user with the defaults of the fields it does not have.
+// The variables of the templates are the fields that the user has, Name,
+// Given, Family, Middle, Honorific, Display, Email and InternalUserType, and
+// a template that uses a field the user does not have fails. Attributes of
+// the defaults are added to those the user does not have as they are.
+func (defaults *userDefaults) apply(u BasicUser) (BasicUser, error) {
+	if defaults == nil {
+		return u, nil
+	}
+	for _, d := range defaults.templates {
+		value := d.get(&u)
+		if *value != "" {
+			continue
+		}
+		var out bytes.Buffer
+		if err := d.tmpl.Execute(&out, templateVars(&u)); err != nil {
+			return u, fmt.Errorf("default %s: %v", d.field, err)
+		}
+		*value = out.String()
+	}
+	if len(defaults.user.Attrs) > 0 {
+		attrs := map[string]interface{}{}
+		for key, value := range defaults.user.Attrs {
+			attrs[key] = value
+		}
+		for key, value := range u.Attrs {
+			attrs[key] = value
+		}
+		u.Attrs = attrs
+	}
+	return u, nil
+}
+
+// templateVars returns the fields of a user that templates can use, only
+// those that are set so that using another one fails.
+func templateVars(u *BasicUser) map[string]string {
+	vars := map[string]string{}
+	for name, value := range map[string]string{"Name": u.Name, "Given": u.Given, "Family": u.Family,
+		"Middle": u.Middle, "Honorific": u.Honorific, "Display": u.Display, "Email": u.Email,
+		"InternalUserType": u.InternalUserType} {
+		if value != "" {
+			vars[name] = value
+		}
+	}
+	return vars
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"os"
+	"testing"
+)
+
+const defaultsUsersFile = `---
+defaults:
+  family: "{{.Name}}-family"
+  email: "{{.Given}}.{{.Family}}@corp.example.org"
+  pwd: Changeme1!
+  attrs: {department: sales, title: rep}
+users:
+- {name: joe, given: Joseph}
+- {name: ann, given: Ann, family: Lee, email: ann@hr.example.org, pwd: Secret1!, attrs: {department: hr}}
+- {name: bob}
+`
+
+// loadUsersWithDefaults loads the users of a file and returns the bodies of
+// the users that were added by user name
+func loadUsersWithDefaults(t *testing.T, content string) (*HttpContext, map[string]userAccount, string) {
+	added := map[string]userAccount{}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		acct := userAccount{}
+		assert.NoError(t, json.Unmarshal([]byte(req.Input), &acct))
+		added[acct.UserName] = acct
+		assert.Contains(t, req.Input, `"department":`)
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	usersFile := WriteTempFile(t, content)
+	defer CleanupTempFile(usersFile)
+	failFile := usersFile.Name() + ".failed"
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	return ctx, added, failFile
+}
+
+func TestLoadUsersAppliesDefaultsThatRowsDoNotOverride(t *testing.T) {
+	ctx, added, failFile := loadUsersWithDefaults(t, defaultsUsersFile)
+	defer os.Remove(failFile)
+	require.Contains(t, added, "joe")
+	assert.Equal(t, "joe-family", added["joe"].Name.FamilyName)
+	assert.Equal(t, "Joseph.joe-family@corp.example.org", added["joe"].Emails[0].Value)
+	assert.Equal(t, "Changeme1!", added["joe"].Password)
+	require.Contains(t, added, "ann")
+	assert.Equal(t, "Lee", added["ann"].Name.FamilyName)
+	assert.Equal(t, "ann@hr.example.org", added["ann"].Emails[0].Value)
+	assert.Equal(t, "Secret1!", added["ann"].Password)
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 2, failed: 1, not attempted: 0\n")
+}
+
+func TestLoadUsersAddsDefaultAttributesTheRowDoesNotHave(t *testing.T) {
+	u, err := (&userDefaults{user: &BasicUser{Attrs: map[string]interface{}{"department": "sales", "title": "rep"}}}).
+		apply(BasicUser{Name: "ann", Attrs: map[string]interface{}{"department": "hr"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"department": "hr", "title": "rep"}, u.Attrs)
+}
+
+func TestLoadUsersFailsRowWhoseDefaultUsesMissingField(t *testing.T) {
+	ctx, added, failFile := loadUsersWithDefaults(t, defaultsUsersFile)
+	defer os.Remove(failFile)
+	assert.NotContains(t, added, "bob")
+	assert.Contains(t, ctx.Log.ErrString(), "Error creating user 'bob': default email: ")
+	assert.Contains(t, ctx.Log.ErrString(), `map has no entry for key "Given"`)
+	assertFailedUsers(t, failFile, "bob")
+	var failed []BasicUser
+	defaults, err := getUsersFile(failFile, &failed)
+	require.Nil(t, err)
+	require.NotNil(t, defaults)
+	assert.Equal(t, "{{.Given}}.{{.Family}}@corp.example.org", defaults.user.Email)
+	assert.Equal(t, []BasicUser{{Name: "bob"}}, failed)
+}
+
+func TestLoadUsersRejectsInvalidDefaults(t *testing.T) {
+	for content, msg := range map[string]string{
+		"defaults: {email: \"{{.Name\"}\nusers:\n- {name: joe}\n": "invalid default email: ",
+		"defaults: {name: joe}\nusers:\n- {name: joe}\n":          "defaults cannot set the name of users",
+		"defaults: {mail: x}\nusers:\n- {name: joe}\n":            "field mail not found in type core.BasicUser",
+	} {
+		ctx, added, _ := loadUsersWithDefaults(t, content)
+		assert.Empty(t, added)
+		assert.Contains(t, ctx.Log.ErrString(), "could not read file of bulk users: ")
+		assert.Contains(t, ctx.Log.ErrString(), msg)
+	}
+}
+
+func TestReadUserNamesOfFileWithDefaults(t *testing.T) {
+	usersFile := WriteTempFile(t, defaultsUsersFile)
+	defer CleanupTempFile(usersFile)
+	require.Nil(t, os.Rename(usersFile.Name(), usersFile.Name()+".yaml"))
+	defer os.Remove(usersFile.Name() + ".yaml")
+	names, err := readUserNames(usersFile.Name() + ".yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"joe", "ann", "bob"}, names)
+}
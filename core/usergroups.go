@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"errors"
+	. "github.com/vmware/priam/util"
+	"net/http"
+	"sort"
+)
+
+// how the groups of a user were found, from the fastest to the slowest
+const (
+	groupsFromUser   = "the groups attribute of the user"
+	groupsFromFilter = "a members filter on groups"
+	groupsFromWalk   = "the members of every group"
+)
+
+// userGroup is a group that a user is a member of
+type userGroup struct {
+	DisplayName string `json:"displayName" yaml:"displayName"`
+	ID          string `json:"id" yaml:"id"`
+}
+
+// ListUserGroups prints the groups of a user with their ids, and how they
+// were found. The groups attribute of the user is used if the tenant sets
+// it, otherwise groups are searched with a filter on their members, or if
+// the filter is rejected, all groups are walked to find the user in their
+// members. If byID is set, name is the SCIM ID of the user.
+func ListUserGroups(ctx *HttpContext, name string, byID bool) {
+	user, err := getEntitledUser(ctx, name, byID)
+	if err != nil {
+		ctx.Log.Err("Error getting user %s: %v\n", Named("Users", name), err)
+		reportAmbiguous(ctx, err)
+		return
+	}
+	groups, method, err := userGroups(ctx, user)
+	if err != nil {
+		ctx.Log.Err("Could not get groups of user %s: %v\n", user.UserName, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].DisplayName < groups[j].DisplayName })
+	ctx.Log.PP("Groups of "+user.UserName, groups, "displayName", "id")
+	ctx.Log.Info("Found %d groups of %s from %s\n", len(groups), user.UserName, method)
+}
+
+// userGroups returns the groups of a user and how they were found
+func userGroups(ctx *HttpContext, user *typedUser) ([]userGroup, string, error) {
+	groups := []userGroup{}
+	if len(user.Groups) > 0 {
+		for _, g := range user.Groups {
+			groupName, err := displayName(ctx, "Groups", g)
+			if err != nil {
+				ctx.Log.Warn("%v, the group is named by its id\n", err)
+			}
+			groups = append(groups, userGroup{DisplayName: StringOrDefault(groupName, g.Value), ID: g.Value})
+		}
+		return groups, groupsFromUser, nil
+	}
+	attrs := []string{"id", "displayName"}
+	err := scimForEach(ctx, "Groups", Eq("members.value", user.Id).String(), attrs, func(resource scimResource) error {
+		groups = append(groups, userGroup{DisplayName: resource.name("displayName"), ID: resource.id()})
+		return nil
+	})
+	if !isFilterRejected(err) {
+		return groups, groupsFromFilter, err
+	}
+	ctx.Log.Debug("Groups cannot be filtered by member, looking for %s in the members of every group: %v\n",
+		user.UserName, err)
+	groups = []userGroup{}
+	err = scimForEach(ctx, "Groups", "", append(attrs, "members"), func(resource scimResource) error {
+		for _, m := range resource.(*typedGroup).Members {
+			if m.Value == user.Id {
+				groups = append(groups, userGroup{DisplayName: resource.name("displayName"), ID: resource.id()})
+				break
+			}
+		}
+		return nil
+	})
+	return groups, groupsFromWalk, err
+}
+
+// isFilterRejected returns true if a search failed because the server does
+// not support its filter.
+func isFilterRejected(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) &&
+		(status.Code == http.StatusBadRequest || status.Code == http.StatusNotImplemented)
+}
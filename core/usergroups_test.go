@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"testing"
+)
+
+const userGroupsFilterPath = "GET/scim/Groups?attributes=id%2CdisplayName&count=500&" +
+	"filter=members.value+eq+%221%22&startIndex=1"
+
+// userGroupsPaths are the paths of user john without groups attribute, who
+// is a member of groups friends and trolls.
+func userGroupsPaths() map[string]TstHandler {
+	return map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(`{"Resources": [{"id": "1", "userName": "john"}]}`),
+		userGroupsFilterPath: GoodPathHandler(`{"totalResults": 2, "Resources": [
+			{"id": "11", "displayName": "trolls"}, {"id": "10", "displayName": "friends"}]}`),
+		"GET/scim/Groups?attributes=id%2CdisplayName%2Cmembers&count=500&startIndex=1": GoodPathHandler(`{
+			"totalResults": 3, "Resources": [{"id": "10", "displayName": "friends", "members": [{"value": "1"}]},
+			{"id": "12", "displayName": "reindeer", "members": [{"value": "2"}]},
+			{"id": "11", "displayName": "trolls", "members": [{"value": "2"}, {"value": "1"}]}]}`),
+	}
+}
+
+func TestUserGroupsFromUser(t *testing.T) {
+	ctx := NewReplayContext(t, describePaths())
+	ctx.Log.Format = FCsv
+	ListUserGroups(ctx, "john", false)
+	assert.Equal(t, "displayName,id\nfriends,10\ntrolls,11\n", ctx.Log.InfoString())
+	assert.Contains(t, ctx.Log.ErrString(), "Found 2 groups of john from the groups attribute of the user\n")
+}
+
+func TestUserGroupsFromMembersFilter(t *testing.T) {
+	ctx := NewReplayContext(t, userGroupsPaths())
+	ListUserGroups(ctx, "john", false)
+	AssertOnlyInfoContains(t, ctx, "friends")
+	assert.Regexp(t, "(?s)friends.*10.*trolls.*11", ctx.Log.InfoString())
+	assert.Contains(t, ctx.Log.InfoString(), "Found 2 groups of john from a members filter on groups\n")
+}
+
+func TestUserGroupsFromWalkWhenFilterIsRejected(t *testing.T) {
+	paths := userGroupsPaths()
+	paths[userGroupsFilterPath] = ErrorHandler(400, "invalid filter")
+	ctx := NewReplayContext(t, paths)
+	ctx.Log.Format = FCsv
+	ListUserGroups(ctx, "john", false)
+	assert.Equal(t, "displayName,id\nfriends,10\ntrolls,11\n", ctx.Log.InfoString())
+	assert.Contains(t, ctx.Log.ErrString(), "Found 2 groups of john from the members of every group\n")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestUserGroupsFailsIfGroupsCannotBeSearched(t *testing.T) {
+	paths := userGroupsPaths()
+	paths[userGroupsFilterPath] = ErrorHandler(503, "down")
+	ctx := NewReplayContext(t, paths)
+	ctx.MaxAttempts = 1
+	ListUserGroups(ctx, "john", false)
+	AssertOnlyErrorContains(t, ctx, "Could not get groups of user john: 503")
+}
@@ -16,10 +16,19 @@ limitations under the License.
 package core
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	. "github.com/vmware/priam/util"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // SCIM implementation of the users service
@@ -31,31 +40,71 @@ type SCIMGroupsService struct{}
 // SCIM implementation of the roles service
 type SCIMRolesService struct{}
 
-const coreSchemaURN = "urn:scim:schemas:core:1.0"
+const (
+	coreSchemaURN      = "urn:scim:schemas:core:1.0"
+	workspaceSchemaURN = "urn:scim:schemas:extension:workspace:1.0"
+	userStatusLabel    = workspaceSchemaURN + ".userStatus"
+)
+
+// workspace status of locked and unlocked users unless another is given
+const (
+	LockedStatus   = "LOCKED"
+	UnlockedStatus = "ACTIVE"
+)
 
 // Define user information
 type BasicUser struct {
 	Name, Given, Family, Email, Pwd string `yaml:",omitempty,flow"`
+	// middle name, honorific prefix such as Dr. and display name of the user
+	Middle, Honorific, Display string `yaml:",omitempty,flow"`
+	// internal user type of the workspace extension set when the user is created
+	InternalUserType string `yaml:"internalUserType,omitempty"`
+	// SCIM attributes added to the user by paths such as name.middleName or
+	// urn:scim:schemas:extension:workspace:1.0.department
+	Attrs map[string]interface{} `yaml:"attrs,omitempty,flow"`
+}
+
+// UserUpdate is a change of the attributes of a user with finer control of
+// the emails than BasicUser, whose Email replaces the primary email, and
+// attributes to remove.
+type UserUpdate struct {
+	BasicUser
+	AddEmails, RemoveEmails []string
+	PrimaryEmail            string   // email to mark as primary, added if the user does not have it
+	Clear                   []string // paths of the attributes to remove, such as name.givenName
 }
 
+// InternalUserTypes are the internal user types that users can be created with
+var InternalUserTypes = []string{"LOCAL", "PROVISIONED", "SERVICE"}
+
 type dispValue struct {
 	Display, Value string `json:",omitempty"`
 }
 
 type nameAttr struct {
-	GivenName, FamilyName string `json:",omitempty"`
+	GivenName, FamilyName, MiddleName, HonorificPrefix string `json:",omitempty"`
+}
+
+type workspaceExt struct {
+	InternalUserType, UserStatus string `json:",omitempty"`
 }
 
 type userAccount struct {
-	Schemas               []string                                                   `json:",omitempty"`
-	UserName              string                                                     `json:",omitempty"`
-	Id                    string                                                     `json:",omitempty"`
-	Active                bool                                                       `json:",omitempty"`
-	Emails, Groups, Roles []dispValue                                                `json:",omitempty"`
-	Meta                  *struct{ Created, LastModified, Location, Version string } `json:",omitempty"`
-	Name                  *nameAttr                                                  `json:",omitempty"`
-	WksExt                *struct{ InternalUserType, UserStatus string }             `json:"urn:scim:schemas:extension:workspace:1.0,omitempty"`
-	Password              string                                                     `json:",omitempty"`
+	Schemas               []string      `json:",omitempty"`
+	UserName              string        `json:",omitempty"`
+	DisplayName           string        `json:",omitempty"`
+	Id                    string        `json:",omitempty"`
+	Active                *bool         `json:",omitempty"`
+	Emails, Groups, Roles []dispValue   `json:",omitempty"`
+	Meta                  *scimMeta     `json:",omitempty"`
+	Name                  *nameAttr     `json:",omitempty"`
+	WksExt                *workspaceExt `json:"urn:scim:schemas:extension:workspace:1.0,omitempty"`
+	Password              string        `json:",omitempty"`
+}
+
+type scimGroup struct {
+	Schemas         []string `json:",omitempty"`
+	DisplayName, Id string   `json:",omitempty"`
 }
 
 type memberValue struct {
@@ -74,30 +123,421 @@ func (userService SCIMUsersService) DisplayEntity(ctx *HttpContext, username str
 	scimGet(ctx, "Users", "userName", username)
 }
 
-func (userService SCIMUsersService) LoadEntities(ctx *HttpContext, fileName string) {
-	var newUsers []BasicUser
-	if err := GetYamlFile(fileName, &newUsers); err != nil {
+// LoadEntities adds the users of the given YAML or CSV file, after those that
+// the checkpoint records as processed if it is resumed. The file is read once
+// to check its rows, then again row by row as the users are added, so that a
+// file of any size is never in memory as a whole. The defaults of the file are
+// applied to each user, and a user whose defaults cannot be expanded is not
+// added. Users are added one request each, or with bulk requests if the context
+// loads users in bulk. It stops early if the requests are canceled. Users that
+// were not added are saved in a file with the same format so that they can be
+// loaded again.
+func (userService SCIMUsersService) LoadEntities(ctx *HttpContext, fileName string, cp *Checkpoint) {
+	var failed []BasicUser
+	total, defaults, err := checkUserRows(ctx, fileName)
+	if err != nil {
+		ctx.Log.Err("could not read file of bulk users: %v\n", err)
+		return
+	}
+	if err := indexUsers(ctx); err != nil {
+		ctx.Log.Err("could not get the users of the tenant to check for duplicates: %v\n", err)
+		return
+	}
+	file, err := openUserRows(fileName)
+	if err != nil {
 		ctx.Log.Err("could not read file of bulk users: %v\n", err)
+		return
+	}
+	defer file.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	rows, keep, start := file.stream(total, stop), keepUnknownFields(ctx), cp.Next()
+	if start > 0 {
+		failed = previousFailures(ctx, fileName, rows, start)
+	}
+	created, defaulted, normalized, skipped, previous := 0, 0, 0, 0, len(failed)
+	progress := ctx.Log.StartProgress("Users", total-start)
+	for {
+		if ctx.Canceled() {
+			for row := range rows {
+				unknownFields(row.fields, &row.user, keep)
+				skipped, failed = skipped+1, append(failed, row.user)
+				ctx.Log.Summary.Row(row.row, row.user.Name, OutcomeSkipped, errNotAttempted)
+			}
+			break
+		}
+		size := bulkUsersSize(ctx)
+		if size == 0 {
+			size = 1
+		}
+		chunk := nextUserRows(rows, size)
+		if len(chunk) == 0 {
+			break
+		}
+		users := make([]*BasicUser, len(chunk))
+		for j := range chunk {
+			unknownFields(chunk[j].fields, &chunk[j].user, keep)
+			if user, err := defaults.apply(chunk[j].user); err != nil {
+				ctx.Log.Err("Error creating user '%s': %v\n", Named("Users", user.Name), err)
+			} else {
+				if lowercaseUser(ctx, &user) {
+					normalized++
+				}
+				users[j] = &user
+			}
+		}
+		allAdded := true
+		for j, added := range addUsers(ctx, users) {
+			name := chunk[j].user.Name
+			if users[j] != nil {
+				name = users[j].Name
+			}
+			if added {
+				created++
+				if users[j].Email == "" {
+					defaulted++
+				}
+				ctx.Log.Summary.Row(chunk[j].row, name, OutcomeCreated, nil)
+			} else {
+				failed, allAdded = append(failed, chunk[j].user), false
+				ctx.Log.Summary.Row(chunk[j].row, name, OutcomeFailed, nil)
+			}
+		}
+		// users whose request was canceled are tried again when the load is resumed
+		if last := chunk[len(chunk)-1]; allAdded || !ctx.Canceled() {
+			recordCheckpoint(ctx, cp, last.row, last.user.Name)
+		}
+		progress.Add(len(chunk))
+	}
+	if file.err != nil {
+		ctx.Log.Err("could not read file of bulk users: %v\n", file.err)
+	}
+	progress.Finish()
+	finishCheckpoint(ctx, cp, skipped == 0 && !ctx.Canceled())
+	ctx.Log.Info("Users created: %d, failed: %d, not attempted: %d\n", created, len(failed)-skipped-previous, skipped)
+	if defaulted > 0 {
+		domain, _ := ctx.Value(defaultEmailDomainKey, nil)
+		ctx.Log.Info("Users created with an email of the default domain %s: %d\n", domain, defaulted)
+	}
+	if normalized > 0 {
+		ctx.Log.Info("Users whose userName or email was changed to lower case: %d\n", normalized)
+	}
+	if len(failed) > 0 {
+		ctx.Log.Fail(ExitPartial)
+		failFile := failureFileName(fileName)
+		if err := putUsersFile(failFile, failed, defaults); err != nil {
+			ctx.Log.Err("could not save users that were not created: %v\n", err)
+		} else {
+			ctx.Log.Info("Users that were not created are saved in %s\n", failFile)
+		}
+	}
+}
+
+// previousFailures reads the rows of a load that is resumed that were
+// processed before the checkpoint, says after which user the load is
+// resumed, and returns the users of the failure file among them.
+func previousFailures(ctx *HttpContext, fileName string, rows <-chan userRow, processed int) (failed []BasicUser) {
+	names, last := map[string]bool{}, ""
+	for i := 0; i < processed; i++ {
+		if row, ok := <-rows; ok {
+			names[row.user.Name], last = true, row.user.Name
+		}
+	}
+	ctx.Log.Info("Resuming after user %d of %s, %s\n", processed, fileName, last)
+	var previous []BasicUser
+	if _, err := getUsersFile(failureFileName(fileName), &previous); err != nil {
+		return nil
+	}
+	for _, u := range previous {
+		if names[u.Name] {
+			failed = append(failed, u)
+		}
+	}
+	return failed
+}
+
+// recordCheckpoint records that the entries before index done are processed
+func recordCheckpoint(ctx *HttpContext, cp *Checkpoint, done int, key string) {
+	if err := cp.Record(done, key); err != nil {
+		ctx.Log.Warn("Could not save checkpoint %s: %v\n", cp.FileName(), err)
+	}
+}
+
+// finishCheckpoint removes the checkpoint once all entries are processed, or
+// saves it so that the command can be resumed.
+func finishCheckpoint(ctx *HttpContext, cp *Checkpoint, complete bool) {
+	if cp == nil {
+		return
+	}
+	if complete {
+		if err := cp.Remove(); err != nil {
+			ctx.Log.Warn("Could not remove checkpoint %s: %v\n", cp.FileName(), err)
+		}
+	} else if err := cp.Save(); err != nil {
+		ctx.Log.Warn("Could not save checkpoint %s: %v\n", cp.FileName(), err)
+	} else {
+		ctx.Log.Info("Progress is saved in %s, run the command again with --resume to continue\n", cp.FileName())
+	}
+}
+
+// failureFileName returns the name of the file for the entries of the
+// given file that could not be loaded, e.g. users.failed.yaml for users.yaml
+func failureFileName(fileName string) string {
+	ext := filepath.Ext(fileName)
+	return strings.TrimSuffix(fileName, ext) + ".failed" + ext
+}
+
+// DeleteUsers deletes, or deactivates with the given workspace status, the
+// users named in a YAML, CSV or text file, after those that the checkpoint
+// records as processed if it is resumed. All names are looked up first so
+// that users that are not found are reported before the confirmation, which
+// is not asked if force is true. If userType is set, users of other types
+// are reported and left alone.
+func DeleteUsers(ctx *HttpContext, fileName string, deactivate bool, status, userType string, force bool,
+	cp *Checkpoint) {
+	names, err := readUserNames(fileName)
+	if err != nil {
+		ctx.Log.Err("could not read file of users to delete: %v\n", err)
+		return
+	}
+	start := cp.Next()
+	if start > 0 && start <= len(names) {
+		ctx.Log.Info("Resuming after user %d of %s, %s\n", start, fileName, names[start-1])
+	}
+	var ids, found, notFound, otherType []string
+	var indexes []int
+	failed := 0
+	for i := start; i < len(names); i++ {
+		name := names[i]
+		if id, err := userIDOfType(ctx, name, userType); err == nil && id == "" {
+			otherType = append(otherType, name)
+			ctx.Log.Summary.Row(i+1, name, OutcomeSkipped, fmt.Errorf("not of type %s", userType))
+		} else if err == nil {
+			ids, found, indexes = append(ids, id), append(found, name), append(indexes, i)
+		} else if IsNotFound(err) {
+			notFound = append(notFound, name)
+			ctx.Log.Summary.Row(i+1, name, OutcomeSkipped, err)
+		} else {
+			ctx.Log.Err("Error getting SCIM Users ID of %s: %v\n", Named("Users", name), err)
+			ctx.Log.Summary.Row(i+1, name, OutcomeFailed, nil)
+			failed++
+		}
+	}
+	if len(notFound) > 0 {
+		ctx.Log.Info("Users not found: %s\n", strings.Join(notFound, ", "))
+		ctx.Log.Fail(ExitNotFound)
+	}
+	if len(otherType) > 0 {
+		ctx.Log.Info("Users not of type %s, left alone: %s\n", userType, strings.Join(otherType, ", "))
+	}
+	action, doing, done := "Delete", "deleting", "deleted"
+	if deactivate {
+		action, doing, done = "Deactivate", "deactivating", "deactivated"
+	}
+	if len(ids) > 0 && !force && !ctx.Log.Confirm("%s %d users of %s?", action, len(ids), ctx.HostURL) {
+		ctx.Log.Info("No users %s\n", done)
+		for i, name := range found {
+			ctx.Log.Summary.Row(indexes[i]+1, name, OutcomeSkipped, fmt.Errorf("not confirmed"))
+		}
+		return
+	}
+	outcome := OutcomeDeleted
+	if deactivate {
+		outcome = OutcomeUpdated
+	}
+	changed, skipped := 0, 0
+	progress := ctx.Log.StartProgress("Users "+done, len(ids))
+	for i, id := range ids {
+		if ctx.Canceled() {
+			skipped = len(ids) - i
+			for j := i; j < len(ids); j++ {
+				ctx.Log.Summary.Row(indexes[j]+1, found[j], OutcomeSkipped, errNotAttempted)
+			}
+			break
+		}
+		if deactivate {
+			err = scimSetActive(ctx, id, false, status)
+		} else {
+			err = ctx.Request("DELETE", "scim/Users/"+id, nil, nil)
+		}
+		if err != nil && ctx.Canceled() {
+			ctx.Log.Err("Error %s user %s: %v\n", doing, Named("Users", found[i]), err)
+			skipped = len(ids) - i
+			for j := i; j < len(ids); j++ {
+				ctx.Log.Summary.Row(indexes[j]+1, found[j], OutcomeSkipped, errNotAttempted)
+			}
+			break
+		}
+		recordCheckpoint(ctx, cp, indexes[i]+1, found[i])
+		progress.Add(1)
+		if err != nil {
+			ctx.Log.Err("Error %s user %s: %v\n", doing, Named("Users", found[i]), err)
+			ctx.Log.Summary.Row(indexes[i]+1, found[i], OutcomeFailed, err)
+			failed++
+			continue
+		}
+		if !deactivate {
+			ctx.ForgetID("Users", "userName", found[i])
+		}
+		ctx.Log.Info("User \"%s\" %s\n", Named("Users", found[i]), done)
+		ctx.Log.Summary.Row(indexes[i]+1, found[i], outcome, nil)
+		changed++
+	}
+	progress.Finish()
+	finishCheckpoint(ctx, cp, skipped == 0)
+	ctx.Log.Info("Users %s: %d, not found: %d, failed: %d, not attempted: %d\n", done, changed, len(notFound), failed, skipped)
+	if failed > 0 || skipped > 0 {
+		ctx.Log.Fail(ExitPartial)
+	}
+}
+
+// SetUserActive activates or deactivates a user, and sets the workspace
+// status of the user if status is not empty.
+func SetUserActive(ctx *HttpContext, name string, active bool, status string) {
+	doing, done := "deactivating", "deactivated"
+	if active {
+		doing, done = "reactivating", "reactivated"
+	}
+	if id := scimNameToID(ctx, "Users", "userName", name); id == "" {
+		return
+	} else if err := scimSetActive(ctx, id, active, status); err != nil {
+		ctx.Log.Err("Error %s user \"%s\": %v\n", doing, Named("Users", name), err)
+	} else {
+		ctx.Log.Info("User \"%s\" %s\n", Named("Users", name), done)
+	}
+}
+
+// SetUserLocked locks or unlocks a user account, which unlike deactivation
+// keeps it active, by setting the workspace status of the user to the given
+// status, or LockedStatus or UnlockedStatus if it is empty. The status is read
+// back to confirm that the server applied it.
+func SetUserLocked(ctx *HttpContext, name string, locked bool, status string) {
+	doing, done := "unlocking", "unlocked"
+	if locked {
+		doing, done = "locking", "locked"
+	}
+	if status == "" && locked {
+		status = LockedStatus
+	} else if status == "" {
+		status = UnlockedStatus
+	}
+	id := scimNameToID(ctx, "Users", "userName", name)
+	if id == "" {
+		return
+	}
+	acct := userAccount{Schemas: []string{coreSchemaURN, workspaceSchemaURN}, WksExt: &workspaceExt{UserStatus: status}}
+	var statusErr *StatusError
+	if err := scimPatch(ctx, "Users", id, &acct); errors.As(err, &statusErr) && statusErr.Code < 500 {
+		ctx.Log.Err("Error %s user \"%s\", the tenant refused to set %s, which may be read-only for these "+
+			"credentials: %v\n", doing, Named("Users", name), userStatusLabel, err)
+		return
+	} else if err != nil {
+		ctx.Log.Err("Error %s user \"%s\": %v\n", doing, Named("Users", name), err)
+		return
+	}
+	acct = userAccount{}
+	if err := ctx.Accept("json").Request("GET", "scim/Users/"+id, nil, &acct); err != nil {
+		ctx.Log.Err("User \"%s\" may not be %s, could not read back its status: %v\n", Named("Users", name), done, err)
+	} else if acct.WksExt == nil || acct.WksExt.UserStatus != status {
+		current := ""
+		if acct.WksExt != nil {
+			current = acct.WksExt.UserStatus
+		}
+		ctx.Log.Err("User \"%s\" was not %s, its status is \"%s\" rather than \"%s\"\n",
+			Named("Users", name), done, current, status)
 	} else {
-		for _, v := range newUsers {
-			userService.AddEntity(ctx, &v)
+		ctx.Log.Info("User \"%s\" %s, status is %s\n", Named("Users", name), done, status)
+	}
+}
+
+func scimSetActive(ctx *HttpContext, id string, active bool, status string) error {
+	acct := userAccount{Schemas: []string{coreSchemaURN}, Active: &active}
+	if status != "" {
+		acct.Schemas = append(acct.Schemas, workspaceSchemaURN)
+		acct.WksExt = &workspaceExt{UserStatus: status}
+	}
+	return scimPatch(ctx, "Users", id, &acct)
+}
+
+// readUserNames reads the user names of a YAML file, either a list of names or
+// users as for LoadEntities, with or without defaults, of the first column of a
+// CSV file, or of the lines of a text file. Empty lines and lines that start
+// with # are skipped, as is a CSV header of userName or name, and names that
+// are repeated.
+func readUserNames(fileName string) (names []string, err error) {
+	var lines []string
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		var users []BasicUser
+		if err = GetYamlFile(fileName, &lines); err != nil {
+			if _, err = getUsersFile(fileName, &users); err != nil {
+				return nil, err
+			}
+		}
+		for _, u := range users {
+			lines = append(lines, u.Name)
+		}
+	case ".csv":
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := csv.NewReader(f)
+		r.FieldsPerRecord, r.Comment = -1, '#'
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			if i > 0 || !CaselessEqual(record[0], "userName") && !CaselessEqual(record[0], "name") {
+				lines = append(lines, record[0])
+			}
 		}
+	default:
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		lines = strings.Split(string(content), "\n")
+	}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") && !seen[strings.ToLower(line)] {
+			seen[strings.ToLower(line)] = true
+			names = append(names, line)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no user names in %s", fileName)
 	}
+	return names, nil
 }
 
 func (userService SCIMUsersService) AddEntity(ctx *HttpContext, entity interface{}) {
-	scimAddUser(ctx, entity.(*BasicUser))
+	u := entity.(*BasicUser)
+	lowercaseUser(ctx, u)
+	scimAddUser(ctx, u)
 }
 
+// UpdateEntity updates a user with a *BasicUser or a *UserUpdate
 func (userService SCIMUsersService) UpdateEntity(ctx *HttpContext, name string, entity interface{}) {
-	scimUpdateUser(ctx, name, entity.(*BasicUser))
+	if u, ok := entity.(*BasicUser); ok {
+		entity = &UserUpdate{BasicUser: *u}
+	}
+	scimUpdateUser(ctx, name, entity.(*UserUpdate))
 }
 
-func (userService SCIMUsersService) ListEntities(ctx *HttpContext, count int, filter string) {
-	scimList(ctx, count, filter,
-		"Users", "Users", "userName", "id", "emails",
-		"display", "roles", "groups", "name",
-		"givenName", "familyName", "value")
+func (userService SCIMUsersService) ListEntities(ctx *HttpContext, opts ListOptions) {
+	labels := []string{"userName", "id", "name.givenName", "name.familyName", "emails.value",
+		"active", "roles", "groups", "display"}
+	if opts.UserStatus {
+		labels = append(labels, userStatusLabel)
+	}
+	if opts.ShowUserType {
+		labels = append(labels, userTypeLabel)
+	}
+	scimList(ctx, opts, "Users", labels...)
 }
 
 func (userService SCIMUsersService) UpdateMember(ctx *HttpContext, name, member string, remove bool) {
@@ -115,7 +555,7 @@ func (groupService SCIMGroupsService) DisplayEntity(ctx *HttpContext, name strin
 	scimGet(ctx, "Groups", "displayName", name)
 }
 
-func (groupService SCIMGroupsService) LoadEntities(ctx *HttpContext, fileName string) {
+func (groupService SCIMGroupsService) LoadEntities(ctx *HttpContext, fileName string, cp *Checkpoint) {
 	// not implemented
 	ctx.Log.Err("Not implemented.")
 }
@@ -125,8 +565,16 @@ func (groupService SCIMGroupsService) AddEntity(ctx *HttpContext, entity interfa
 	ctx.Log.Err("Not implemented.")
 }
 
-func (groupService SCIMGroupsService) ListEntities(ctx *HttpContext, count int, filter string) {
-	scimList(ctx, count, filter, "Groups", "displayName", "id", "members", "display")
+// scimAddGroup creates a group and returns its id
+func scimAddGroup(ctx *HttpContext, name string) (string, error) {
+	group := scimGroup{Schemas: []string{coreSchemaURN}, DisplayName: name}
+	ctx.ForgetID("Groups", "displayName", name)
+	err := ctx.Accept("json").Request("POST", "scim/Groups", &group, &group)
+	return group.Id, err
+}
+
+func (groupService SCIMGroupsService) ListEntities(ctx *HttpContext, opts ListOptions) {
+	scimList(ctx, opts, "Groups", "displayName", "id", "meta.created", "members", "display")
 }
 
 func (groupService SCIMGroupsService) DeleteEntity(ctx *HttpContext, username string) {
@@ -134,9 +582,9 @@ func (groupService SCIMGroupsService) DeleteEntity(ctx *HttpContext, username st
 	ctx.Log.Err("Not implemented.")
 }
 
+// UpdateEntity renames a group or sets its description, entity is a *GroupUpdate
 func (groupService SCIMGroupsService) UpdateEntity(ctx *HttpContext, name string, entity interface{}) {
-	// not implemented
-	ctx.Log.Err("Not implemented.")
+	updateGroup(ctx, name, entity.(*GroupUpdate))
 }
 
 func (groupService SCIMGroupsService) UpdateMember(ctx *HttpContext, name, member string, remove bool) {
@@ -150,7 +598,7 @@ func (roleService SCIMRolesService) DisplayEntity(ctx *HttpContext, name string)
 	scimGet(ctx, "Roles", "displayName", name)
 }
 
-func (roleService SCIMRolesService) LoadEntities(ctx *HttpContext, fileName string) {
+func (roleService SCIMRolesService) LoadEntities(ctx *HttpContext, fileName string, cp *Checkpoint) {
 	// not implemented
 	ctx.Log.Err("Not implemented.")
 }
@@ -160,8 +608,8 @@ func (roleService SCIMRolesService) AddEntity(ctx *HttpContext, entity interface
 	ctx.Log.Err("Not implemented.")
 }
 
-func (roleService SCIMRolesService) ListEntities(ctx *HttpContext, count int, filter string) {
-	scimList(ctx, count, filter, "Roles", "displayName", "id")
+func (roleService SCIMRolesService) ListEntities(ctx *HttpContext, opts ListOptions) {
+	scimList(ctx, opts, "Roles", "displayName", "id")
 }
 
 func (roleService SCIMRolesService) DeleteEntity(ctx *HttpContext, username string) {
@@ -180,105 +628,476 @@ func (roleService SCIMRolesService) UpdateMember(ctx *HttpContext, name, member
 
 // -- SCIM common code
 
-func scimAddUser(ctx *HttpContext, u *BasicUser) {
+func scimAddUser(ctx *HttpContext, u *BasicUser) bool {
+	req, err := newUserRequest(ctx, u)
+	if err != nil {
+		ctx.Log.Err("Error creating user '%s': %v\n", Named("Users", u.Name), err)
+		return false
+	}
+	return req.post(ctx)
+}
+
+// userRequest is the request that adds a user
+type userRequest struct {
+	name, email string
+	acct        *userAccount
+	body        interface{}    // the account with the attributes of the user
+	extra       *rawAttributes // attributes added for the password, if any
+}
+
+// newUserRequest checks a user to add and returns the request that adds it
+func newUserRequest(ctx *HttpContext, u *BasicUser) (*userRequest, error) {
+	extra, err := checkNewPassword(ctx, u.Pwd)
+	if err != nil {
+		return nil, err
+	}
+	email, _, err := newUserEmail(ctx, u)
+	if err == nil {
+		err = checkDuplicate(ctx, u.Name, email)
+	}
+	if err != nil {
+		return nil, err
+	}
 	acct := &userAccount{UserName: u.Name, Schemas: []string{coreSchemaURN}, Password: u.Pwd}
-	acct.Name = &nameAttr{FamilyName: StringOrDefault(u.Family, u.Name), GivenName: StringOrDefault(u.Given, u.Name)}
-	acct.Emails = []dispValue{{Value: StringOrDefault(u.Email, u.Name+"@example.com")}}
-	ctx.Log.PP("add user: ", acct)
-	if err := ctx.Accept("json").Request("POST", "scim/Users", acct, acct); err != nil {
-		ctx.Log.Err("Error creating user '%s': %v\n", u.Name, err)
-	} else {
-		ctx.Log.Info(fmt.Sprintf("User '%s' successfully added\n", u.Name))
+	acct.Name = &nameAttr{FamilyName: StringOrDefault(u.Family, u.Name), GivenName: StringOrDefault(u.Given, u.Name),
+		MiddleName: u.Middle, HonorificPrefix: u.Honorific}
+	if acct.DisplayName, err = composedDisplayName(ctx, u); err != nil {
+		return nil, err
+	}
+	acct.DisplayName = StringOrDefault(u.Display, acct.DisplayName)
+	acct.Emails = []dispValue{{Value: email}}
+	if u.InternalUserType != "" {
+		userType := strings.ToUpper(u.InternalUserType)
+		if !HasString(userType, InternalUserTypes) {
+			return nil, fmt.Errorf("invalid internal user type \"%s\", must be one of %s", u.InternalUserType,
+				strings.Join(InternalUserTypes, ", "))
+		}
+		acct.Schemas = append(acct.Schemas, workspaceSchemaURN)
+		acct.WksExt = &workspaceExt{InternalUserType: userType}
 	}
+	body, err := mergeAttributes(ctx, u.Name, withAttributes(acct, extra), u.Attrs)
+	if err != nil {
+		return nil, err
+	}
+	return &userRequest{name: u.Name, email: email, acct: acct, body: body, extra: extra}, nil
+}
+
+// post sends the request that adds the user and says if it was added
+func (req *userRequest) post(ctx *HttpContext) bool {
+	ctx.Log.PP("add user: ", req.acct)
+	ctx.ForgetID("Users", "userName", req.name)
+	var id string
+	err := ctx.Accept("json").RetryChecked(func() (applied bool, err error) {
+		id, err = req.existingID(ctx)
+		return id != "", err
+	}).Request("POST", "scim/Users", req.body, req.acct)
+	if err == ErrApplied {
+		req.acct.Id, err = id, nil
+	}
+	if err != nil {
+		ctx.Log.Err("Error creating user '%s': %v\n", Named("Users", req.name), err)
+		return false
+	}
+	req.added(ctx, req.acct.Id)
+	return true
+}
+
+// existingID returns the id of the user of a request whose creation failed
+// but may have been applied, or "" if there is no such user
+func (req *userRequest) existingID(ctx *HttpContext) (string, error) {
+	item, err := scimGetByName(ctx, "Users", "userName", req.name, "id", "userName")
+	if IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return item.id(), nil
+}
+
+// added records that the user of the request was added with an id
+func (req *userRequest) added(ctx *HttpContext, id string) {
+	addedUser(ctx, id, req.name, req.email)
+	ctx.Log.Info(fmt.Sprintf("User '%s' successfully added%s\n", req.name, mustChangeNote(req.extra)))
 }
 
-func scimUpdateUser(ctx *HttpContext, name string, u *BasicUser) {
+func scimUpdateUser(ctx *HttpContext, name string, u *UserUpdate) {
+	extra, err := checkNewPassword(ctx, u.Pwd)
+	if err != nil {
+		ctx.Log.Err("Error updating user \"%s\": %v\n", Named("Users", name), err)
+		return
+	}
+	note := mustChangeNote(extra)
 	if id := scimNameToID(ctx, "Users", "userName", name); id != "" {
 		acct := userAccount{UserName: u.Name, Schemas: []string{coreSchemaURN}}
 		if u.Pwd != "" {
 			acct.Password = u.Pwd
 		}
-		if u.Given != "" || u.Family != "" {
-			acct.Name = &nameAttr{FamilyName: u.Family, GivenName: u.Given}
+		if u.Given != "" || u.Family != "" || u.Middle != "" || u.Honorific != "" {
+			acct.Name = &nameAttr{FamilyName: u.Family, GivenName: u.Given, MiddleName: u.Middle,
+				HonorificPrefix: u.Honorific}
+		}
+		if acct.DisplayName = u.Display; u.Given != "" && u.Family != "" {
+			if acct.DisplayName, err = composedDisplayName(ctx, &u.BasicUser); err != nil {
+				ctx.Log.Err("Error updating user \"%s\": %v\n", Named("Users", name), err)
+				return
+			}
+			acct.DisplayName = StringOrDefault(u.Display, acct.DisplayName)
 		}
-		if u.Email != "" {
-			acct.Emails = []dispValue{{Value: u.Email}}
+		if u.changesEmails() {
+			current, err := userEmails(ctx, id)
+			if err != nil {
+				ctx.Log.Err("Error getting emails of user \"%s\": %v\n", Named("Users", name), err)
+				return
+			}
+			emails, missing := mergeEmails(current, u)
+			for _, value := range missing {
+				ctx.Log.Warn("user \"%s\" has no email %s to remove\n", Named("Users", name), value)
+			}
+			if extra == nil {
+				extra = &rawAttributes{map[string]interface{}{}}
+			}
+			extra.raw["emails"] = emails
 		}
 
-		if err := scimPatch(ctx, "Users", id, &acct); err != nil {
-			ctx.Log.Err("Error updating user \"%s\": %v\n", name, err)
+		if err := scimPatchClear(ctx, "Users", id, withAttributes(&acct, extra), u.Clear); err != nil {
+			ctx.Log.Err("Error updating user \"%s\": %v\n", Named("Users", name), emailsError(err))
 		} else {
-			ctx.Log.Info("User \"%s\" updated\n", name)
+			if u.Name != "" && !CaselessEqual(name, u.Name) {
+				ctx.ForgetID("Users", "userName", name)
+			}
+			ctx.Log.Info("User \"%s\" updated%s\n", Named("Users", name), note)
 		}
 	}
 }
 
-func scimGetByName(ctx *HttpContext, resType, nameAttr, name string) (item map[string]interface{}, err error) {
-	output := &struct {
-		Resources                              []map[string]interface{}
-		ItemsPerPage, TotalResults, StartIndex uint
-		Schemas                                []string
-	}{}
-	vals := url.Values{"count": {"10000"}, "filter": {fmt.Sprintf("%s eq \"%s\"", nameAttr, name)}}
-	path := fmt.Sprintf("scim/%v?%v", resType, vals.Encode())
-	if err = ctx.Accept("json").Request("GET", path, nil, &output); err != nil {
-		return
+// scimGetByName gets the resource with the given name, with only the given
+// attributes if any
+func scimGetByName(ctx *HttpContext, resType, nameAttr, name string, attributes ...string) (item scimResource, err error) {
+	vals := url.Values{"count": {strconv.Itoa(pageSize(ctx))}, "filter": {Eq(nameAttr, name).String()}}
+	if len(attributes) > 0 {
+		vals.Set("attributes", strings.Join(attributes, ","))
 	}
-	for _, v := range output.Resources {
-		if CaselessEqual(name, v[nameAttr]) {
-			if item != nil {
-				return nil, fmt.Errorf("multiple %v found named \"%s\"", resType, name)
-			} else {
-				item = v
-			}
+	var resources []scimResource
+	if err = scimPages(ctx, resType, vals, 0, func(page []scimResource) error {
+		resources = append(resources, page...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var matches, caseless []scimResource
+	for _, v := range resources {
+		if !strings.EqualFold(name, v.name(nameAttr)) {
+			continue
+		} else if ctx.CaseSensitiveNames() && name != v.name(nameAttr) {
+			caseless = append(caseless, v)
+		} else {
+			matches = append(matches, v)
 		}
 	}
-	if item == nil {
-		err = fmt.Errorf("no %v found named \"%s\"", resType, name)
+	switch len(matches) {
+	case 0:
+		if len(caseless) > 0 {
+			return nil, NotFound("no %v found named \"%s\" with this case, names are case sensitive "+
+				"but \"%s\" matches without case", resType, name, caseless[0].name(nameAttr))
+		}
+		return nil, NotFound("no %v found named \"%s\"", resType, name)
+	case 1:
+		return matches[0], nil
 	}
-	return
+	return chooseResource(ctx, resType, nameAttr, name, matches, attributes)
 }
 
 func scimGetID(ctx *HttpContext, resType, nameAttr, name string) (string, error) {
-	if item, err := scimGetByName(ctx, resType, nameAttr, name); err != nil {
+	if id, ok := ctx.CachedID(resType, nameAttr, name); ok {
+		return id, nil
+	}
+	if item, err := scimGetByName(ctx, resType, nameAttr, name, "id", nameAttr); err != nil {
 		return "", err
-	} else if id, ok := item["id"].(string); !ok {
-		return "", fmt.Errorf("no id returned for \"%s\"", name)
+	} else if id := item.id(); id == "" {
+		data, _ := json.Marshal(item.attributes())
+		return "", fmt.Errorf("no id returned for \"%s\": %s", name, BodySnippet(data))
 	} else {
+		ctx.CacheID(resType, nameAttr, name, id)
 		return id, nil
 	}
 }
 
-// @param count the number of records to return
+// scimList prints the resources of a type, sorted by the server or here if
+// it does not sort them.
 // @param summaryLabels keys to filter the results of what to display
-func scimList(ctx *HttpContext, count int, filter string, resType string, summaryLabels ...string) {
+func scimList(ctx *HttpContext, opts ListOptions, resType string, summaryLabels ...string) {
+	if opts.CountOnly && !clientFiltered(opts) {
+		scimCount(ctx, resType, opts.Filter)
+		return
+	}
+	if opts.Dates {
+		summaryLabels = withLabels(summaryLabels, "meta.created", "meta.lastModified")
+	}
 	vals := url.Values{}
-	if count > 0 {
-		vals.Set("count", strconv.Itoa(count))
+	if opts.Count > 0 {
+		vals.Set("count", strconv.Itoa(opts.Count))
 	}
-	if filter != "" {
+	if filter := withUserType(opts.Filter, opts.UserType); filter != "" {
 		vals.Set("filter", filter)
 	}
-	path := fmt.Sprintf("scim/%s?%v", resType, vals.Encode())
-	outp := make(map[string]interface{})
-	if err := ctx.Accept("json").Request("GET", path, nil, &outp); err != nil {
+	if attributes := listAttributes(ctx.Log, opts, summaryLabels); len(attributes) > 0 {
+		vals.Set("attributes", strings.Join(attributes, ","))
+	}
+	if opts.SortBy != "" {
+		order := "ascending"
+		if opts.Descending {
+			order = "descending"
+		}
+		vals.Set("sortBy", opts.SortBy)
+		vals.Set("sortOrder", order)
+	}
+	// the resources are filtered as each page is got, so that only those
+	// listed are kept
+	filtered, list, total, undated := clientFiltered(opts), []interface{}{}, 0, 0
+	getAll := func() error {
+		list, total, undated = []interface{}{}, 0, 0
+		return scimPages(ctx, resType, vals, opts.Count, func(page []scimResource) error {
+			for _, resource := range page {
+				summary := interface{}(resource.attributes())
+				if filtered && len(summaryLabels) > 0 {
+					summary = ctx.Log.Filter(summary, summaryLabels)
+				}
+				within, invalid := opts.within(resource.meta())
+				if (opts.Grep == nil || grepMatch(opts.Grep, summary)) && within &&
+					userTypeMatch(resource, opts.UserType) {
+					list = append(list, resource.attributes())
+					if invalid {
+						undated++
+					}
+				}
+			}
+			total += len(page)
+			return nil
+		})
+	}
+	err := getAll()
+	if isFilterRejected(err) && opts.UserType != "" {
+		ctx.Log.Debug("%s cannot be filtered by %s, filtering them here: %v\n", resType, userTypeAttr, err)
+		if vals.Del("filter"); opts.Filter != "" {
+			vals.Set("filter", opts.Filter)
+		}
+		err = getAll()
+	}
+	if err != nil {
 		ctx.Log.Err("Error getting SCIM resources of type %s: %v\n", resType, err)
+		return
+	}
+	if undated > 0 {
+		ctx.Log.Warn("%d %s without a valid creation or modification time are listed whatever their dates\n",
+			undated, resType)
+	}
+	if opts.SortBy != "" && SortByPath(list, opts.SortBy, opts.Descending) {
+		ctx.Log.Debug("%s were not sorted by the server, sorted by %s here\n", resType, opts.SortBy)
+	}
+	if !filtered {
+		ctx.Log.PP(resType, list, summaryLabels...)
+		return
+	}
+	if opts.CountOnly {
+		printCount(ctx, resType, opts.Filter, len(list))
+		return
+	}
+	ctx.Log.PP(resType, list, summaryLabels...)
+	ctx.Log.Info("%d of %d %s matched\n", len(list), total, resType)
+}
+
+// scimCount prints the number of resources that match the filter, as
+// counted by the server or by getting their IDs if it does not count them.
+func scimCount(ctx *HttpContext, resType, filter string) {
+	vals := url.Values{"attributes": {"id"}}
+	if filter != "" {
+		vals.Set("filter", filter)
+	}
+	outp := &struct {
+		TotalResults *int
+		Resources    []interface{}
+	}{}
+	err := ctx.Accept("json").Request("GET", fmt.Sprintf("scim/%s?count=0&%v", resType, vals.Encode()), nil, outp)
+	if err == nil && outp.TotalResults == nil {
+		ctx.Log.Debug("No total of %s returned, counting them\n", resType)
+		total := 0
+		vals.Set("count", strconv.Itoa(pageSize(ctx)))
+		vals.Set("startIndex", "1")
+		err = scimPages(ctx, resType, vals, 0, func(resources []scimResource) error {
+			total += len(resources)
+			return nil
+		})
+		outp.TotalResults = &total
+	}
+	if err != nil {
+		ctx.Log.Err("Error counting SCIM resources of type %s: %v\n", resType, err)
 	} else {
-		ctx.Log.PP(resType, outp["Resources"], summaryLabels...)
+		printCount(ctx, resType, filter, *outp.TotalResults)
 	}
 }
 
+// printCount prints a number of resources alone on OutW so that scripts can
+// read it, and what was counted on ErrW.
+func printCount(ctx *HttpContext, resType, filter string, count int) {
+	if ctx.Log.Enabled(LInfo) && filter != "" {
+		fmt.Fprintf(ctx.Log.ErrW, "%s with filter '%s':\n", resType, filter)
+	} else if ctx.Log.Enabled(LInfo) {
+		fmt.Fprintf(ctx.Log.ErrW, "%s:\n", resType)
+	}
+	fmt.Fprintf(ctx.Log.OutW, "%d\n", count)
+}
+
+// DateWindow keeps the entities created or last modified on or after the
+// After times and before the Before times, each of which is only checked if
+// it is set. Entities without a valid time to check are kept.
+type DateWindow struct {
+	CreatedAfter, CreatedBefore           time.Time
+	LastModifiedAfter, LastModifiedBefore time.Time
+}
+
+// IsSet returns true if any time of the window is set.
+func (w DateWindow) IsSet() bool {
+	return !w.CreatedAfter.IsZero() || !w.CreatedBefore.IsZero() || !w.LastModifiedAfter.IsZero() ||
+		!w.LastModifiedBefore.IsZero()
+}
+
+// within returns false if the meta of a resource shows it was created or
+// last modified outside the window, and true as second value if a time that
+// had to be checked is missing or not valid.
+func (w DateWindow) within(meta *scimMeta) (bool, bool) {
+	if meta == nil {
+		meta = &scimMeta{}
+	}
+	created, createdInvalid := timeWithin(meta.Created, w.CreatedAfter, w.CreatedBefore)
+	modified, modifiedInvalid := timeWithin(meta.LastModified, w.LastModifiedAfter, w.LastModifiedBefore)
+	return created && modified, createdInvalid || modifiedInvalid
+}
+
+// timeWithin returns true if the SCIM timestamp is not before after nor
+// after before, the times that are set, and true as second value if it had
+// to be checked and is not valid, in which case it is also within.
+func timeWithin(timestamp string, after, before time.Time) (bool, bool) {
+	if after.IsZero() && before.IsZero() {
+		return true, false
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return true, true
+	}
+	return !t.Before(after) && (before.IsZero() || t.Before(before)), false
+}
+
+// timeBefore returns true if the time is not set, or the SCIM timestamp is
+// before it or is not valid.
+func timeBefore(timestamp string, before time.Time) bool {
+	if before.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	return err != nil || t.Before(before)
+}
+
+// clientFiltered returns true if the resources listed are filtered here
+// rather than only by the server.
+func clientFiltered(opts ListOptions) bool {
+	return opts.Grep != nil || dateFiltered(opts) || opts.UserType != ""
+}
+
+func dateFiltered(opts ListOptions) bool {
+	return opts.DateWindow.IsSet()
+}
+
+// withLabels returns the summary labels with the given ones added, unless
+// they are already there.
+func withLabels(summaryLabels []string, labels ...string) []string {
+	result := append([]string{}, summaryLabels...)
+	for _, label := range labels {
+		if !HasString(label, result) {
+			result = append(result, label)
+		}
+	}
+	return result
+}
+
+// grepMatch returns true if the pattern matches any value of the given info
+func grepMatch(pattern *regexp.Regexp, info interface{}) bool {
+	switch v := info.(type) {
+	case map[string]interface{}:
+		for _, value := range v {
+			if grepMatch(pattern, value) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if grepMatch(pattern, value) {
+				return true
+			}
+		}
+	case nil:
+	default:
+		return pattern.MatchString(fmt.Sprint(v))
+	}
+	return false
+}
+
+// subAttributeLabels are summary labels that select fields of complex
+// attributes such as groups, they are not requested as attributes
+var subAttributeLabels = []string{"display", "value"}
+
+// listAttributes returns the attributes to request for a list that only
+// prints the summary labels, none if all attributes are printed.
+func listAttributes(log *Logr, opts ListOptions, summaryLabels []string) []string {
+	if log.VerboseOn || log.Query != nil || log.Format == FJson || log.Format == FYaml || len(summaryLabels) == 0 {
+		return nil
+	}
+	attributes := []string{"id"}
+	for _, label := range summaryLabels {
+		if strings.HasPrefix(label, workspaceSchemaURN+".") {
+			label = workspaceSchemaURN
+		} else if i := strings.IndexAny(label, ".["); i > 0 {
+			label = label[:i]
+		}
+		if !HasString(label, attributes) && !HasString(label, subAttributeLabels) {
+			attributes = append(attributes, label)
+		}
+	}
+	if opts.SortBy != "" && !HasString(opts.SortBy, attributes) {
+		attributes = append(attributes, opts.SortBy)
+	}
+	if dateFiltered(opts) && !HasString("meta", attributes) {
+		attributes = append(attributes, "meta")
+	}
+	if opts.UserType != "" && !HasString(workspaceSchemaURN, attributes) {
+		attributes = append(attributes, workspaceSchemaURN)
+	}
+	return attributes
+}
+
 func scimPatch(ctx *HttpContext, resType, id string, input interface{}) error {
-	ctx.Header("X-HTTP-Method-Override", "PATCH")
+	ctx.Accept("json").Header("X-HTTP-Method-Override", "PATCH")
 	path := fmt.Sprintf("scim/%s/%s", resType, id)
 	return ctx.Request("POST", path, input, nil)
 }
 
 func scimNameToID(ctx *HttpContext, resType, nameAttr, name string) string {
+	return scimLookupID(ctx, resType, nameAttr, name, false)
+}
+
+// scimProbeID is scimNameToID for callers that check whether a resource
+// exists, a resource that is not found is only reported at debug level.
+func scimProbeID(ctx *HttpContext, resType, nameAttr, name string) string {
+	return scimLookupID(ctx, resType, nameAttr, name, true)
+}
+
+func scimLookupID(ctx *HttpContext, resType, nameAttr, name string, probe bool) string {
 	if id, err := scimGetID(ctx, resType, nameAttr, name); err == nil {
 		return id
+	} else if probe && IsNotFound(err) {
+		ctx.Log.Debug("%v\n", err)
 	} else {
-		ctx.Log.Err("Error getting SCIM %s ID of %s: %v\n", resType, name, err)
+		ctx.Log.Err("Error getting SCIM %s ID of %s: %v\n", resType, Named(resType, name), err)
+		reportAmbiguous(ctx, err)
 	}
 	return ""
 }
@@ -293,27 +1112,33 @@ func scimMember(ctx *HttpContext, resType, nameAttr, rname, uname string, remove
 		patch.Members[0].Operation = "delete"
 	}
 	if err := scimPatch(ctx, resType, rid, &patch); err != nil {
-		ctx.Log.Err("Error updating SCIM resource %s of type %s: %v\n", rname, resType, err)
+		ctx.Log.Err("Error updating SCIM resource %s of type %s: %v\n", Named(resType, rname), resType, err)
 	} else {
 		ctx.Log.Info("Updated SCIM resource %s of type %s\n", rname, resType)
 	}
 }
 
+// scimGet prints the resource with the given name, or the id and name of
+// those whose name matches if the context matches names otherwise.
 func scimGet(ctx *HttpContext, resType, nameAttr, rname string) {
-	if item, err := scimGetByName(ctx, resType, nameAttr, rname); err != nil {
-		ctx.Log.Err("Error getting SCIM resource named %s of type %s: %v\n", rname, resType, err)
+	if match := nameMatchOf(ctx); match != "" {
+		scimListMatches(ctx, resType, nameAttr, rname, match)
+	} else if item, err := scimGetByName(ctx, resType, nameAttr, rname); err != nil {
+		ctx.Log.Err("Error getting SCIM resource named %s of type %s: %v\n", Named(resType, rname), resType, err)
+		reportAmbiguous(ctx, err)
 	} else {
-		ctx.Log.PP("", item)
+		ctx.Log.PP("", item.attributes())
 	}
 }
 
 func scimDelete(ctx *HttpContext, resType, nameAttr, rname string) {
 	if id := scimNameToID(ctx, resType, nameAttr, rname); id != "" {
 		path := fmt.Sprintf("scim/%s/%s", resType, id)
-		if err := ctx.Request("DELETE", path, nil, nil); err != nil {
-			ctx.Log.Err("Error deleting %s %s: %v\n", resType, rname, err)
+		if err := ctx.Accept("json").Request("DELETE", path, nil, nil); err != nil {
+			ctx.Log.Err("Error deleting %s %s: %v\n", resType, Named(resType, rname), err)
 		} else {
-			ctx.Log.Info("%s \"%s\" deleted\n", resType, rname)
+			ctx.ForgetID(resType, nameAttr, rname)
+			ctx.Log.Info("%s \"%s\" deleted\n", resType, Named(resType, rname))
 		}
 	}
 }
@@ -16,24 +16,35 @@ limitations under the License.
 package core
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	. "github.com/vmware/priam/testaid"
 	. "github.com/vmware/priam/util"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
 	DEFAULT_USERNAME      = "john"
 	DEFAULT_GROUP_NAME    = "saturday-night-fever"
 	DEFAULT_ROLE_NAME     = "dancer"
-	DEFAULT_GET_USER_URL  = "GET/scim/Users?count=10000&filter=userName+eq+%22" + DEFAULT_USERNAME + "%22"
+	DEFAULT_GET_USER_URL  = "GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22" + DEFAULT_USERNAME + "%22"
+	DEFAULT_SHOW_USER_URL = "GET/scim/Users?count=500&filter=userName+eq+%22" + DEFAULT_USERNAME + "%22"
 	DEFAULT_POST_USER_URL = "POST/scim/Users/12345"
-	DEFAULT_GET_GROUP_URL = "GET/scim/Groups?count=10000&filter=displayName+eq+%22" + DEFAULT_GROUP_NAME + "%22"
-	YAML_USERS_FILE       = "../resources/newusers.yaml"
+	DEFAULT_GET_GROUP_URL = "GET/scim/Groups?attributes=id%2CdisplayName&count=500&filter=displayName+eq+%22" +
+		DEFAULT_GROUP_NAME + "%22"
+	DEFAULT_SHOW_GROUP_URL = "GET/scim/Groups?count=500&filter=displayName+eq+%22" + DEFAULT_GROUP_NAME + "%22"
+	YAML_USERS_FILE        = "../resources/newusers.yaml"
 )
 
-var aBasicUser = func() *BasicUser { return &BasicUser{Name: "john", Given: "travolta"} }
+var aBasicUser = func() *BasicUser { return &BasicUser{Name: "john", Given: "travolta", Email: "john@fever.com"} }
 
 // Helpers to get useful handlers used in the tests
 func scimDefaultUserHandler() func(t *testing.T, req *TstReq) *TstReply {
@@ -84,7 +95,7 @@ func TestSetPasswordFailsIfScimPatchFails(t *testing.T) {
 func TestScimGetByNameWhenUserDoesNotExistReturnsError(t *testing.T) {
 	errMessage := "test: john does not exist"
 	srv := StartTstServer(t, map[string]TstHandler{
-		DEFAULT_GET_USER_URL: ErrorHandler(404, errMessage)})
+		DEFAULT_SHOW_USER_URL: ErrorHandler(404, errMessage)})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	_, err := scimGetByName(ctx, "Users", "userName", "john")
 	if assert.Error(t, err, "Should have returned an error") {
@@ -99,7 +110,7 @@ func TestScimGetByNameWhenMultipleUsersReturnsError(t *testing.T) {
 	}
 
 	srv := StartTstServer(t, map[string]TstHandler{
-		DEFAULT_GET_USER_URL: multipleUsersHandler})
+		DEFAULT_SHOW_USER_URL: multipleUsersHandler})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	_, err := scimGetByName(ctx, "Users", "userName", "john")
 	if assert.Error(t, err, "Should have returned an error") {
@@ -107,9 +118,54 @@ func TestScimGetByNameWhenMultipleUsersReturnsError(t *testing.T) {
 	}
 }
 
+func TestScimGetByNameFindsDuplicatesWithoutCase(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(ScimUsersPage(1, 3, "john", "johnny", "John"))})
+	_, err := scimGetByName(ctx, "Users", "userName", "john")
+	if assert.Error(t, err) {
+		assert.Equal(t, `multiple Users found named "john", choose one with --choose-id`, err.Error())
+	}
+}
+
+func TestScimGetByNameComparesCaseIfCaseSensitive(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(ScimUsersPage(1, 2, "John", "john"))})
+	ctx.SetCaseSensitiveNames(true)
+	item, err := scimGetByName(ctx, "Users", "userName", "john")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "john-id", item.id())
+	}
+}
+
+func TestScimGetByNameSaysWhenOnlyCaseDiffersIfCaseSensitive(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(ScimUsersPage(1, 1, "JOHN"))})
+	ctx.SetCaseSensitiveNames(true)
+	_, err := scimGetByName(ctx, "Users", "userName", "john")
+	assert.True(t, IsNotFound(err))
+	assert.EqualError(t, err, `no Users found named "john" with this case, names are case sensitive but "JOHN" `+
+		"matches without case")
+}
+
+func TestScimGetByNameIgnoresPartialMatches(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_SHOW_USER_URL: GoodPathHandler(ScimUsersPage(1, 2, "johnny", "John"))})
+	item, err := scimGetByName(ctx, "Users", "userName", "john")
+	assert.Nil(t, err)
+	assert.Equal(t, ScimID("John"), item.id())
+}
+
+func TestScimGetByNameEscapesQuotesOfName(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Users?count=500&filter=userName+eq+%22jo%5C%22e%22": GoodPathHandler(ScimUsersPage(1, 1, `jo"e`))})
+	item, err := scimGetByName(ctx, "Users", "userName", `jo"e`)
+	assert.Nil(t, err)
+	assert.Equal(t, ScimID(`jo"e`), item.id())
+}
+
 func TestScimGetByNameWhenNoMatchReturnsError(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Users?count=10000&filter=userName+eq+%22patrick%22": scimDefaultUserHandler()})
+		"GET/scim/Users?count=500&filter=userName+eq+%22patrick%22": scimDefaultUserHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	_, err := scimGetByName(ctx, "Users", "userName", "patrick")
 	if assert.Error(t, err, "Should have returned an error") {
@@ -133,46 +189,286 @@ func TestScimGetIdWithNoIdReturnsError(t *testing.T) {
 
 func TestScimListWithCountAndFilter(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Users?count=3&filter=myfilter": scimDefaultUserHandler()})
+		"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups&count=3&filter=myfilter": scimDefaultUserHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	new(SCIMUsersService).ListEntities(ctx, 3, "myfilter")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Count: 3, Filter: "myfilter"})
 	AssertOnlyInfoContains(t, ctx, `id: "12345"`)
 }
 
+func TestScimListEmptyInJson(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?count=3": GoodPathHandler(`{"totalResults": 0}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Format = FJson
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Count: 3})
+	assert.Equal(t, "[]\n", ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestScimListInCsv(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups&count=3": scimDefaultUserHandler()})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Format = FCsv
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Count: 3})
+	assert.Equal(t, "userName,id,name.givenName,name.familyName,emails.value\njohn,12345,,,\n", ctx.Log.InfoString())
+}
+
 func TestScimListFilteredByLabel(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Users?filter=myfilter": scimDefaultUserHandler()})
+		"GET/scim/Users?attributes=id%2CuserName&filter=myfilter": scimDefaultUserHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	scimList(ctx, 0, "myfilter", "Users", "userName")
+	scimList(ctx, ListOptions{Filter: "myfilter"}, "Users", "userName")
 	AssertOnlyInfoContains(t, ctx, "userName: john")
 	assert.NotContains(t, ctx.Log.InfoString(), "id")
 }
 
 func TestScimListWithNonExistingSummaryLabelsPrintsEmpty(t *testing.T) {
-	// we're adding both URLs as older versions of go would normalize it and remove the trailing "?"
-	// go 1.7.3 and + keep it
-	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Users?": scimDefaultUserHandler(),
-		"GET/scim/Users":  scimDefaultUserHandler(),
-	})
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?attributes=id%2CIDontExist": scimDefaultUserHandler()})
 	defer srv.Close()
 
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	scimList(ctx, 0, "", "Users", "IDontExist")
+	scimList(ctx, ListOptions{}, "Users", "IDontExist")
 	AssertOnlyInfoContains(t, ctx, "")
 }
 
+func TestScimListSortedByServer(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups&filter=myfilter&sortBy=userName&sortOrder=descending": GoodPathHandler(
+			`{"Resources": [{"userName": "sven"}, {"userName": "anna"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Level = LDebug
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Filter: "myfilter", SortBy: "userName", Descending: true})
+	assert.Contains(t, ctx.Log.InfoString(), "- userName: sven\n- userName: anna\n")
+	assert.NotContains(t, ctx.Log.InfoString(), "sorted by userName here")
+}
+
+func TestScimListSortedHereIfServerIgnoresSort(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?count=4&sortBy=name.FamilyName&sortOrder=ascending": GoodPathHandler(`{"Resources": [
+			{"userName": "c", "name": {"familyName": "Snow"}}, {"userName": "n"},
+			{"userName": "b", "name": {"familyName": "arendelle"}}, {"userName": "a", "name": {"familyName": "Troll"}}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Level = LDebug
+	ctx.Log.Query, _ = ParseQuery("userName")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Count: 4, SortBy: "name.FamilyName"})
+	assert.Contains(t, ctx.Log.ErrString(), "Users were not sorted by the server, sorted by name.FamilyName here\n")
+	assert.Equal(t, "b\nc\na\nn\n", ctx.Log.InfoString())
+}
+
+// a response of the tenant to a list of users with only the summary attributes
+const trimmedUsersResponse = `{"totalResults": 2, "itemsPerPage": 2, "startIndex": 1,
+	"schemas": ["urn:scim:schemas:core:1.0"], "Resources": [
+	{"id": "0a1b", "userName": "anna", "name": {"givenName": "Anna", "familyName": "Arendelle"},
+	 "emails": [{"value": "anna@example.com"}], "groups": [{"display": "ALL USERS", "value": "9f3e"}],
+	 "roles": [{"display": "User", "value": "77c2"}]},
+	{"id": "0a1c", "userName": "olaf", "name": {"givenName": "Olaf", "familyName": "Snowman"},
+	 "emails": [{"value": "olaf@example.com"}]}]}`
+
+func TestScimListRequestsOnlySummaryAttributes(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups": GoodPathHandler(trimmedUsersResponse)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{})
+	AssertOnlyInfoContains(t, ctx, "---- Users ----\n")
+	for _, s := range []string{"- emails.value: anna@example.com\n  groups:\n  - display: ALL USERS\n  id: 0a1b\n",
+		"  name.familyName: Snowman\n  name.givenName: Olaf\n", "  roles:\n  - display: User\n  userName: anna\n"} {
+		assert.Contains(t, ctx.Log.InfoString(), s)
+	}
+}
+
+func TestScimListRequestsAllAttributesIfAllArePrinted(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?count=3": scimDefaultUserHandler()})
+	defer srv.Close()
+	for _, setup := range []func(*Logr){func(l *Logr) { l.VerboseOn = true }, func(l *Logr) { l.Format = FJson },
+		func(l *Logr) { l.Format = FYaml }, func(l *Logr) { l.Query, _ = ParseQuery("id") }} {
+		ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+		setup(ctx.Log)
+		new(SCIMUsersService).ListEntities(ctx, ListOptions{Count: 3})
+		AssertOnlyInfoContains(t, ctx, "12345")
+	}
+}
+
+func TestScimListRequestsSortAttribute(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Roles?attributes=id%2CdisplayName%2Cmeta.created&sortBy=meta.created&sortOrder=ascending": scimDefaultRoleHandler()})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMRolesService).ListEntities(ctx, ListOptions{SortBy: "meta.created"})
+	AssertOnlyInfoContains(t, ctx, "displayName: "+DEFAULT_ROLE_NAME)
+}
+
+func TestScimListWithGrep(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups&filter=active+eq+true": GoodPathHandler(
+			`{"Resources": [{"userName": "anna", "name": {"familyName": "Arendelle"}, "title": "queen"},
+			{"userName": "olaf", "name": {"familyName": "Snowman"}}, {"userName": "elsa", "title": "Snow queen"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Filter: "active eq true", Grep: regexp.MustCompile("(?i)snow")})
+	AssertOnlyInfoContains(t, ctx, "userName: olaf")
+	assert.NotContains(t, ctx.Log.InfoString(), "anna")
+	assert.NotContains(t, ctx.Log.InfoString(), "elsa", "fields that are not in the summary are not matched")
+	assert.Contains(t, ctx.Log.InfoString(), "1 of 3 Users matched\n")
+}
+
+func TestScimListWithGrepInJson(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Roles?": GoodPathHandler(
+		`{"Resources": [{"displayName": "Administrator", "id": "1"}, {"displayName": "User", "id": "2"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Format = FJson
+	new(SCIMRolesService).ListEntities(ctx, ListOptions{Grep: regexp.MustCompile("(?i)^admin")})
+	assert.Contains(t, ctx.Log.InfoString(), `"displayName": "Administrator"`)
+	assert.NotContains(t, ctx.Log.InfoString(), `"User"`)
+	assert.Equal(t, "1 of 2 Roles matched\n", ctx.Log.ErrString())
+}
+
+func TestScimListModifiedBeforeKeepsUndatedEntries(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta&count=1000&filter=active+eq+false": GoodPathHandler(
+			`{"Resources": [{"userName": "anna", "meta": {"lastModified": "2020-01-02T03:04:05Z"}},
+			{"userName": "olaf", "meta": {"lastModified": "2020-03-02T03:04:05Z"}}, {"userName": "sven"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	before, _ := time.Parse(time.RFC3339, "2020-02-01T00:00:00Z")
+	scimList(ctx, ListOptions{Count: 1000, Filter: "active eq false", DateWindow: DateWindow{LastModifiedBefore: before}},
+		"Users", "userName")
+	assert.Contains(t, ctx.Log.InfoString(), "userName: anna")
+	assert.NotContains(t, ctx.Log.InfoString(), "olaf")
+	assert.Contains(t, ctx.Log.InfoString(), "userName: sven")
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: 1 Users without a valid creation or modification time are listed "+
+		"whatever their dates\n")
+}
+
+// datedUsersHandler returns users anna and olaf with dates, and sven without
+// them or with dates that are not valid
+func datedUsersHandler(svenMeta string) TstHandler {
+	return GoodPathHandler(`{"Resources": [
+		{"userName": "anna", "meta": {"created": "2019-01-02T03:04:05Z", "lastModified": "2020-01-02T03:04:05Z"}},
+		{"userName": "olaf", "meta": {"created": "2020-02-02T03:04:05Z", "lastModified": "2020-03-02T03:04:05Z"}},
+		{"userName": "sven"` + svenMeta + `}]}`)
+}
+
+func TestScimListWarnsOnceOfUndatedEntriesOfAllPages(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta": GoodPathHandler(`{"totalResults": 3, "Resources": [
+			{"userName": "anna", "meta": {"lastModified": "2020-01-02T03:04:05Z"}}, {"userName": "sven"}]}`),
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta&startIndex=3": GoodPathHandler(
+			`{"totalResults": 3, "startIndex": 3, "Resources": [{"userName": "olaf"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	before, _ := time.Parse(time.RFC3339, "2020-02-01T00:00:00Z")
+	scimList(ctx, ListOptions{DateWindow: DateWindow{LastModifiedBefore: before}}, "Users", "userName")
+	assert.Contains(t, ctx.Log.InfoString(), "olaf")
+	assert.Equal(t, "WARNING: 2 Users without a valid creation or modification time are listed whatever "+
+		"their dates\n", ctx.Log.ErrString())
+}
+
+func TestScimListShowsDates(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta": datedUsersHandler("")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Format = FCsv
+	scimList(ctx, ListOptions{Dates: true}, "Users", "userName")
+	assert.Equal(t, "userName,meta.created,meta.lastModified\n"+
+		"anna,2019-01-02T03:04:05Z,2020-01-02T03:04:05Z\nolaf,2020-02-02T03:04:05Z,2020-03-02T03:04:05Z\nsven,,\n",
+		ctx.Log.InfoString())
+}
+
+func TestScimListCreatedAndModifiedBeforeKeepInvalidDates(t *testing.T) {
+	for _, svenMeta := range []string{"", `, "meta": {"created": "long ago", "lastModified": "yesterday"}`} {
+		srv := StartTstServer(t, map[string]TstHandler{
+			"GET/scim/Users?attributes=id%2CuserName%2Cmeta": datedUsersHandler(svenMeta)})
+		ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+		created, _ := time.Parse(time.RFC3339, "2020-01-01T00:00:00Z")
+		modified, _ := time.Parse(time.RFC3339, "2020-02-01T00:00:00Z")
+		scimList(ctx, ListOptions{DateWindow: DateWindow{CreatedBefore: created, LastModifiedBefore: modified}}, "Users", "userName")
+		srv.Close()
+		assert.Contains(t, ctx.Log.InfoString(), "anna")
+		assert.NotContains(t, ctx.Log.InfoString(), "olaf")
+		assert.Contains(t, ctx.Log.InfoString(), "sven")
+		assert.Contains(t, ctx.Log.InfoString(), "2 of 3 Users matched\n")
+	}
+}
+
+func TestScimListCreatedAndModifiedAfterCountInvalidDates(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cmeta": datedUsersHandler(`, "meta": {"created": "long ago"}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	created, _ := time.Parse(time.RFC3339, "2019-06-01T00:00:00Z")
+	modified, _ := time.Parse(time.RFC3339, "2020-03-02T03:04:05Z")
+	scimList(ctx, ListOptions{DateWindow: DateWindow{CreatedAfter: created, LastModifiedAfter: modified}},
+		"Users", "userName")
+	assert.NotContains(t, ctx.Log.InfoString(), "anna")
+	assert.Contains(t, ctx.Log.InfoString(), "olaf")
+	assert.Contains(t, ctx.Log.InfoString(), "sven")
+	assert.Contains(t, ctx.Log.InfoString(), "2 of 3 Users matched\n")
+	assert.Equal(t, "WARNING: 1 Users without a valid creation or modification time are listed whatever their "+
+		"dates\n", ctx.Log.ErrString())
+}
+
+func TestScimListCountOnly(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?count=0&attributes=id&filter=active+eq+true": GoodPathHandler(
+		`{"totalResults": 40123, "Resources": []}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Filter: "active eq true", CountOnly: true})
+	assert.Equal(t, "40123\n", ctx.Log.InfoString())
+	assert.Equal(t, "Users with filter 'active eq true':\n", ctx.Log.ErrString())
+}
+
+func TestScimListCountOnlyCountsResourcesWithoutTotal(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Groups?count=0&attributes=id": GoodPathHandler(`{"Resources": [{"id": "1"}]}`),
+		"GET/scim/Groups?attributes=id&count=500&startIndex=1": GoodPathHandler(
+			`{"itemsPerPage": 2, "Resources": [{"id": "1"}, {"id": "2"}]}`),
+		"GET/scim/Groups?attributes=id&count=500&startIndex=3": GoodPathHandler(
+			`{"itemsPerPage": 1, "Resources": [{"id": "3"}]}`),
+		"GET/scim/Groups?attributes=id&count=500&startIndex=4": GoodPathHandler(`{"itemsPerPage": 0, "Resources": []}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.Level = LError
+	new(SCIMGroupsService).ListEntities(ctx, ListOptions{CountOnly: true})
+	assert.Equal(t, "3\n", ctx.Log.InfoString())
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestScimListCountOnlyWithGrep(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Roles?attributes=id%2CdisplayName": GoodPathHandler(
+		`{"totalResults": 3, "Resources": [{"displayName": "Administrator"}, {"displayName": "User"}, {"displayName": "ReadOnlyAdmin"}]}`)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMRolesService).ListEntities(ctx, ListOptions{Grep: regexp.MustCompile("Admin"), CountOnly: true})
+	assert.Equal(t, "2\n", ctx.Log.InfoString())
+	assert.Equal(t, "Roles:\n", ctx.Log.ErrString())
+}
+
+func TestScimListCountOnlyFails(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users?count=0&attributes=id&filter=bad": ErrorHandler(400, "invalid filter")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Filter: "bad", CountOnly: true})
+	AssertOnlyErrorContains(t, ctx, "Error counting SCIM resources of type Users: 400 Bad Request")
+	AssertErrorContains(t, ctx, "invalid filter")
+}
+
 func TestScimListReturnsErrorOnInvalidRequest(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Users?filter=myfilter": ErrorHandler(404, "error scim list")})
+		"GET/scim/Users?attributes=id%2CuserName%2Cname%2Cemails%2Cactive%2Croles%2Cgroups&filter=myfilter": ErrorHandler(404, "error scim list")})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	new(SCIMUsersService).ListEntities(ctx, 0, "myfilter")
+	new(SCIMUsersService).ListEntities(ctx, ListOptions{Filter: "myfilter"})
 	AssertErrorContains(t, ctx, "Error getting SCIM resources of type Users: 404 Not Found\nerror scim list\n")
 }
 
 func TestScimGetNameExists(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		DEFAULT_GET_USER_URL: scimDefaultUserHandler()})
+		DEFAULT_SHOW_USER_URL: scimDefaultUserHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	new(SCIMUsersService).DisplayEntity(ctx, "john")
 	AssertOnlyInfoContains(t, ctx, "userName: john")
@@ -180,7 +476,7 @@ func TestScimGetNameExists(t *testing.T) {
 
 func TestScimGetWhenNameDoesNotExist(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		DEFAULT_GET_USER_URL: ErrorHandler(404, "error scim get")})
+		DEFAULT_SHOW_USER_URL: ErrorHandler(404, "error scim get")})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	new(SCIMUsersService).DisplayEntity(ctx, "john")
 	AssertErrorContains(t, ctx, "Error getting SCIM resource named john of type Users: 404 Not Found\nerror scim get\n")
@@ -242,8 +538,65 @@ func TestScimUpdateUserFamilyName(t *testing.T) {
 	scimUpdateDefaultUserWith(t, "john", &BasicUser{Name: "john", Family: "wayne"})
 }
 
+// updateEmails updates the emails of a user who has the given emails and
+// returns the emails sent.
+func updateEmails(t *testing.T, current string, update *UserUpdate) (*HttpContext, string) {
+	sent := ""
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:                     scimDefaultUserHandler(),
+		"GET/scim/Users/12345?attributes=emails": GoodPathHandler(`{"id": "12345", "emails": ` + current + `}`),
+		DEFAULT_POST_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+			patch := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal([]byte(req.Input), &patch))
+			emails, _ := json.Marshal(patch["emails"])
+			sent = string(emails)
+			return &TstReply{Status: 204}
+		}})
+	new(SCIMUsersService).UpdateEntity(ctx, "john", update)
+	return ctx, sent
+}
+
+const johnEmails = `[{"value": "john@work.com", "type": "work", "primary": true}, {"value": "john@home.com", "type": "home"}]`
+
 func TestScimUpdateUserEmail(t *testing.T) {
-	scimUpdateDefaultUserWith(t, "john", &BasicUser{Name: "john", Email: "j@travolta.com"})
+	ctx, sent := updateEmails(t, johnEmails, &UserUpdate{BasicUser: BasicUser{Email: "j@travolta.com"}})
+	assert.Equal(t, "User \"john\" updated\n", ctx.Log.InfoString())
+	assert.JSONEq(t, `[{"value": "j@travolta.com", "type": "work", "primary": true}, {"value": "john@home.com", "type": "home"}]`, sent)
+}
+
+func TestScimUpdateEmailOfUserWithoutEmails(t *testing.T) {
+	_, sent := updateEmails(t, `[]`, &UserUpdate{BasicUser: BasicUser{Email: "j@travolta.com"}})
+	assert.JSONEq(t, `[{"value": "j@travolta.com", "primary": true}]`, sent)
+	_, sent = updateEmails(t, `null`, &UserUpdate{AddEmails: []string{"j@travolta.com"}})
+	assert.JSONEq(t, `[{"value": "j@travolta.com", "primary": true}]`, sent)
+}
+
+func TestScimUpdateEmailThatIsAlreadySecondary(t *testing.T) {
+	_, sent := updateEmails(t, johnEmails, &UserUpdate{BasicUser: BasicUser{Email: "JOHN@home.com"}})
+	assert.JSONEq(t, `[{"value": "john@home.com", "type": "home", "primary": true}]`, sent)
+}
+
+func TestScimAddRemoveAndSetPrimaryEmails(t *testing.T) {
+	ctx, sent := updateEmails(t, johnEmails, &UserUpdate{AddEmails: []string{"john@home.com", "jt@fever.com"},
+		RemoveEmails: []string{"john@work.com", "john@gone.com"}, PrimaryEmail: "jt@fever.com"})
+	assert.JSONEq(t, `[{"value": "john@home.com", "type": "home"}, {"value": "jt@fever.com", "primary": true}]`, sent)
+	assert.Contains(t, ctx.Log.ErrString(), `WARNING: user "john" has no email john@gone.com to remove`)
+	assert.Contains(t, ctx.Log.InfoString(), `User "john" updated`)
+}
+
+func TestScimRemovePrimaryEmailMakesAnotherPrimary(t *testing.T) {
+	_, sent := updateEmails(t, johnEmails, &UserUpdate{RemoveEmails: []string{"john@work.com"}})
+	assert.JSONEq(t, `[{"value": "john@home.com", "type": "home", "primary": true}]`, sent)
+}
+
+func TestScimUpdateEmailRejectedAsDuplicate(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:                     scimDefaultUserHandler(),
+		"GET/scim/Users/12345?attributes=emails": GoodPathHandler(`{"emails": []}`),
+		DEFAULT_POST_USER_URL:                    ScimErrorHandler(409, "email already exists")})
+	new(SCIMUsersService).UpdateEntity(ctx, "john", &UserUpdate{AddEmails: []string{"sandy@grease.com"}})
+	AssertErrorContains(t, ctx, `Error updating user "john": the tenant rejected an email as a duplicate value, `+
+		"it may be used by another user: 409 Conflict: email already exists")
 }
 
 func TestScimDeleteFailsIfUserDoesNotExist(t *testing.T) {
@@ -273,6 +626,245 @@ func TestScimDelete(t *testing.T) {
 	AssertOnlyInfoContains(t, ctx, `Users "john" deleted`)
 }
 
+// writeUsersFile writes a file with the given extension, the caller removes it
+func writeUsersFile(t *testing.T, ext, content string) string {
+	f, err := ioutil.TempFile("", "priam-users*"+ext)
+	require.Nil(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.Nil(t, err)
+	return f.Name()
+}
+
+func TestReadUserNames(t *testing.T) {
+	for ext, content := range map[string]string{
+		".yaml": "- anna\n- olaf\n- Anna\n",
+		".yml":  "- {name: anna, given: Anna}\n- {name: olaf}\n",
+		".csv":  "userName,email\nanna,anna@example.com\n# gone already\nolaf\n",
+		".txt":  "anna\n\n  olaf  \n# comment\n"} {
+		fileName := writeUsersFile(t, ext, content)
+		names, err := readUserNames(fileName)
+		os.Remove(fileName)
+		assert.Nil(t, err, ext)
+		assert.Equal(t, []string{"anna", "olaf"}, names, ext)
+	}
+}
+
+func TestReadUserNamesOfEmptyFile(t *testing.T) {
+	fileName := writeUsersFile(t, "", "# nobody\n")
+	defer os.Remove(fileName)
+	_, err := readUserNames(fileName)
+	assert.EqualError(t, err, "no user names in "+fileName)
+}
+
+// deleteUsersPaths are the paths of users john, olaf and sven, who does not
+// exist, where changes of john and olaf are replied by the given function.
+func deleteUsersPaths(reply func(change string, req *TstReq) *TstReply) map[string]TstHandler {
+	change := func(change string) TstHandler {
+		return func(t *testing.T, req *TstReq) *TstReply { return reply(change, req) }
+	}
+	return map[string]TstHandler{
+		DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22olaf%22": GoodPathHandler(
+			`{"Resources": [{"userName": "olaf", "id": "678"}]}`),
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22sven%22": GoodPathHandler(`{"Resources": []}`),
+		"DELETE/scim/Users/12345": change("delete john"),
+		"DELETE/scim/Users/678":   change("delete olaf"),
+		"POST/scim/Users/12345":   change("patch john"),
+		"POST/scim/Users/678":     change("patch olaf"),
+	}
+}
+
+func TestDeleteUsersReportsNotFoundBeforeConfirmation(t *testing.T) {
+	changes := []string{}
+	srv := StartTstServer(t, deleteUsersPaths(func(change string, req *TstReq) *TstReply {
+		changes = append(changes, change)
+		return &TstReply{Status: 204}
+	}))
+	defer srv.Close()
+	fileName := writeUsersFile(t, ".txt", "john\nsven\nolaf\n")
+	defer os.Remove(fileName)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.InR = strings.NewReader("y\n")
+	DeleteUsers(ctx, fileName, false, "", "", false, nil)
+	assert.Contains(t, ctx.Log.InfoString(), "Users not found: sven\nDelete 2 users of "+srv.URL+"? [y/N]: ")
+	assert.Contains(t, ctx.Log.InfoString(), "Users deleted: 2, not found: 1, failed: 0, not attempted: 0\n")
+	assert.Equal(t, []string{"delete john", "delete olaf"}, changes)
+	assert.Equal(t, ExitNotFound, ctx.Log.ExitCode())
+	_, cached := ctx.CachedID("Users", "userName", "olaf")
+	assert.False(t, cached)
+}
+
+func TestDeleteUsersNotConfirmed(t *testing.T) {
+	srv := StartTstServer(t, deleteUsersPaths(nil))
+	defer srv.Close()
+	fileName := writeUsersFile(t, ".yaml", "- john\n")
+	defer os.Remove(fileName)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.Log.InR = strings.NewReader("n\n")
+	DeleteUsers(ctx, fileName, false, "", "", false, nil)
+	assert.Contains(t, ctx.Log.InfoString(), "No users deleted\n")
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestDeactivateUsersWithForce(t *testing.T) {
+	srv := StartTstServer(t, deleteUsersPaths(func(change string, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Active":false}`, req.Input)
+		if change == "patch olaf" {
+			return &TstReply{Status: 500, StatusMsg: "broken"}
+		}
+		return &TstReply{Status: 204}
+	}))
+	defer srv.Close()
+	fileName := writeUsersFile(t, ".csv", "john\nolaf\n")
+	defer os.Remove(fileName)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.MaxAttempts = 1
+	DeleteUsers(ctx, fileName, true, "", "", true, nil)
+	assert.NotContains(t, ctx.Log.InfoString(), "[y/N]")
+	assert.Contains(t, ctx.Log.InfoString(), `User "john" deactivated`)
+	assert.Contains(t, ctx.Log.ErrString(), "Error deactivating user olaf: 500 Internal Server Error")
+	assert.Contains(t, ctx.Log.InfoString(), "Users deactivated: 1, not found: 0, failed: 1, not attempted: 0\n")
+	assert.Equal(t, ExitPartial, ctx.Log.ExitCode())
+}
+
+func TestDeleteUsersOfType(t *testing.T) {
+	changes := []string{}
+	paths := deleteUsersPaths(func(change string, req *TstReq) *TstReply {
+		changes = append(changes, change)
+		return &TstReply{Status: 204}
+	})
+	typedPath := "GET/scim/Users?attributes=id%2CuserName%2Curn%3Ascim%3Aschemas%3Aextension%3Aworkspace%3A1.0" +
+		"&count=500&filter=userName+eq+%22"
+	paths[typedPath+"john%22"] = GoodPathHandler(`{"Resources": [{"userName": "john", "id": "12345",
+		"urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "LOCAL"}}]}`)
+	paths[typedPath+"olaf%22"] = GoodPathHandler(`{"Resources": [{"userName": "olaf", "id": "678",
+		"urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "PROVISIONED"}}]}`)
+	srv := StartTstServer(t, paths)
+	defer srv.Close()
+	fileName := writeUsersFile(t, ".txt", "john\nolaf\n")
+	defer os.Remove(fileName)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	DeleteUsers(ctx, fileName, false, "", "LOCAL", true, nil)
+	assert.Contains(t, ctx.Log.InfoString(), "Users not of type LOCAL, left alone: olaf\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users deleted: 1, not found: 0, failed: 0, not attempted: 0\n")
+	assert.Equal(t, []string{"delete john"}, changes)
+}
+
+func TestDeactivateUserWithStatus(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0","urn:scim:schemas:extension:workspace:1.0"],`+
+				`"Active":false,"urn:scim:schemas:extension:workspace:1.0":{"UserStatus":"offboarded"}}`, req.Input)
+			return &TstReply{Status: 204}
+		}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	SetUserActive(ctx, "john", false, "offboarded")
+	AssertOnlyInfoContains(t, ctx, `User "john" deactivated`)
+}
+
+func TestReactivateUser(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL: scimDefaultUserHandler(),
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Active":true}`, req.Input)
+			return &TstReply{Status: 204}
+		}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	SetUserActive(ctx, "john", true, "")
+	AssertOnlyInfoContains(t, ctx, `User "john" reactivated`)
+}
+
+func lockPaths(patch TstHandler, status string) map[string]TstHandler {
+	return map[string]TstHandler{
+		DEFAULT_GET_USER_URL:    scimDefaultUserHandler(),
+		"POST/scim/Users/12345": patch,
+		"GET/scim/Users/12345": GoodPathHandler(`{"userName": "john", "id": "12345", ` +
+			`"urn:scim:schemas:extension:workspace:1.0": {"userStatus": "` + status + `"}}`)}
+}
+
+func TestLockUser(t *testing.T) {
+	ctx := NewReplayContext(t, lockPaths(func(t *testing.T, req *TstReq) *TstReply {
+		assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0","urn:scim:schemas:extension:workspace:1.0"],`+
+			`"urn:scim:schemas:extension:workspace:1.0":{"UserStatus":"LOCKED"}}`, req.Input)
+		return &TstReply{Status: 204}
+	}, "LOCKED"))
+	SetUserLocked(ctx, "john", true, "")
+	AssertOnlyInfoContains(t, ctx, `User "john" locked, status is LOCKED`)
+}
+
+func TestUnlockUserWithStatus(t *testing.T) {
+	ctx := NewReplayContext(t, lockPaths(func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `{"UserStatus":"enabled"}`)
+		return &TstReply{Status: 204}
+	}, "enabled"))
+	SetUserLocked(ctx, "john", false, "enabled")
+	AssertOnlyInfoContains(t, ctx, `User "john" unlocked, status is enabled`)
+}
+
+func TestLockUserReportsStatusThatWasNotApplied(t *testing.T) {
+	ctx := NewReplayContext(t, lockPaths(GoodPathHandler(""), "ACTIVE"))
+	SetUserLocked(ctx, "john", true, "")
+	AssertErrorContains(t, ctx, `User "john" was not locked, its status is "ACTIVE" rather than "LOCKED"`)
+}
+
+func TestLockUserWhenStatusIsReadOnly(t *testing.T) {
+	ctx := NewReplayContext(t, lockPaths(ScimErrorHandler(400, "userStatus is readOnly"), ""))
+	SetUserLocked(ctx, "john", true, "")
+	AssertErrorContains(t, ctx, `Error locking user "john", the tenant refused to set `+
+		"urn:scim:schemas:extension:workspace:1.0.userStatus, which may be read-only for these credentials: "+
+		"400 Bad Request: userStatus is readOnly")
+}
+
+func TestScimListShowsUserStatus(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Users?attributes=id%2CuserName%2Cactive%2Curn%3Ascim%3Aschemas%3Aextension%3Aworkspace%3A1.0": GoodPathHandler(
+			`{"Resources": [{"userName": "anna", "active": true, "urn:scim:schemas:extension:workspace:1.0": ` +
+				`{"userStatus": "LOCKED"}}, {"userName": "olaf", "active": true}]}`)})
+	ctx.Log.Format = FCsv
+	scimList(ctx, ListOptions{}, "Users", "userName", "active", userStatusLabel)
+	assert.Equal(t, "userName,active,urn:scim:schemas:extension:workspace:1.0.userStatus\n"+
+		"anna,true,LOCKED\nolaf,true,\n", ctx.Log.InfoString())
+}
+
+const userTypeListPath = "GET/scim/Users?attributes=id%2CuserName%2Curn%3Ascim%3Aschemas%3Aextension%3Aworkspace%3A1.0"
+
+func TestScimListFiltersByUserType(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		userTypeListPath + "&filter=internalUserType+eq+%22LOCAL%22": GoodPathHandler(`{"Resources": [
+			{"userName": "anna", "urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "LOCAL"}},
+			{"userName": "hans", "urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "PROVISIONED"}}]}`)})
+	ctx.Log.Format = FCsv
+	scimList(ctx, ListOptions{UserType: "LOCAL"}, "Users", "userName", userTypeLabel)
+	assert.Equal(t, "userName,urn:scim:schemas:extension:workspace:1.0.internalUserType\nanna,LOCAL\n",
+		ctx.Log.InfoString())
+	assert.Contains(t, ctx.Log.ErrString(), "1 of 2 Users matched\n")
+}
+
+func TestScimListFiltersByUserTypeWhenTenantRejectsFilter(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		userTypeListPath + "&filter=%28active+eq+true%29+and+internalUserType+eq+%22LOCAL%22": ScimErrorHandler(400,
+			"invalid filter"),
+		userTypeListPath + "&filter=active+eq+true": GoodPathHandler(`{"Resources": [{"userName": "anna",
+			"urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "LOCAL"}}, {"userName": "olaf"}]}`)})
+	ctx.Log.Format = FCsv
+	scimList(ctx, ListOptions{Filter: "active eq true", UserType: "LOCAL"}, "Users", "userName")
+	assert.Equal(t, "userName\nanna\n", ctx.Log.InfoString())
+}
+
+func TestReactivateUserFails(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:    scimDefaultUserHandler(),
+		"POST/scim/Users/12345": ErrorHandler(403, "not allowed")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	SetUserActive(ctx, "john", true, "")
+	AssertErrorContains(t, ctx, `Error reactivating user "john": 403 Forbidden`)
+}
+
 func TestScimMemberReturnsWhenNoResourceId(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
 		DEFAULT_GET_USER_URL: ErrorHandler(404, "error scim members")})
@@ -281,6 +873,23 @@ func TestScimMemberReturnsWhenNoResourceId(t *testing.T) {
 	AssertErrorContains(t, ctx, "Error getting SCIM Users ID of john")
 }
 
+func TestScimProbeIDOfMissingUserIsNotAnError(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{DEFAULT_GET_USER_URL: GoodPathHandler(`{"Resources": []}`)})
+	defer srv.Close()
+	ctx.Log.Level = LDebug
+	assert.Empty(t, scimProbeID(ctx, "Users", "userName", DEFAULT_USERNAME))
+	assert.Empty(t, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), `no Users found named "john"`)
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+func TestScimProbeIDReportsOtherErrors(t *testing.T) {
+	srv, ctx := NewTestContext(t, map[string]TstHandler{DEFAULT_GET_USER_URL: ErrorHandler(500, "broken")})
+	defer srv.Close()
+	assert.Empty(t, scimProbeID(ctx, "Users", "userName", DEFAULT_USERNAME))
+	AssertErrorContains(t, ctx, "Error getting SCIM Users ID of john")
+}
+
 func TestAddScimMember(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
 		DEFAULT_GET_USER_URL:  scimDefaultUserHandler(),
@@ -299,6 +908,54 @@ func TestRemoveScimMember(t *testing.T) {
 	AssertOnlyInfoContains(t, ctx, "Updated SCIM resource john of type Users\n")
 }
 
+func TestScimMemberPatchBody(t *testing.T) {
+	for remove, member := range map[bool]string{false: `{"Value":"john-id","Type":"User"}`,
+		true: `{"Value":"john-id","Type":"User","Operation":"delete"}`} {
+		patched := false
+		ctx := NewReplayContext(t, map[string]TstHandler{
+			DEFAULT_GET_GROUP_URL: GoodPathHandler(ScimGroupWithMembers(DEFAULT_GROUP_NAME)),
+			DEFAULT_GET_USER_URL:  GoodPathHandler(ScimUsersPage(1, 1, "john")),
+			"POST/scim/Groups/" + ScimID(DEFAULT_GROUP_NAME): func(t *testing.T, req *TstReq) *TstReply {
+				patched = true
+				assert.Equal(t, `{"Schemas":["urn:scim:schemas:core:1.0"],"Members":[`+member+`]}`, req.Input)
+				return &TstReply{Status: 204}
+			}})
+		scimMember(ctx, "Groups", "displayName", DEFAULT_GROUP_NAME, "john", remove)
+		AssertOnlyInfoContains(t, ctx, "Updated SCIM resource "+DEFAULT_GROUP_NAME+" of type Groups\n")
+		assert.True(t, patched)
+	}
+}
+
+func TestScimPatchHeadersAreNotSentWithNextRequest(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"POST/scim/Users/12345": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Equal(t, "PATCH", req.Header.Get("X-HTTP-Method-Override"))
+			return &TstReply{Status: 204}
+		},
+		DEFAULT_SHOW_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+			assert.Empty(t, req.Header.Get("X-HTTP-Method-Override"))
+			assert.Empty(t, req.Accept)
+			return &TstReply{Output: ScimUsersPage(1, 1, "john")}
+		}})
+	assert.Nil(t, scimPatch(ctx, "Users", "12345", &userAccount{}))
+	assert.Nil(t, ctx.Request("GET", "scim/Users?count=500&filter=userName+eq+%22john%22", nil, nil))
+}
+
+func TestEntitlementHeadersAreNotSentWithNextRequest(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"POST/entitlements/definitions": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Equal(t, "bulk.sync.response+json", req.Accept)
+			return &TstReply{Output: EntitlementBulkResponse(201)}
+		},
+		DEFAULT_SHOW_USER_URL: func(t *testing.T, req *TstReq) *TstReply {
+			assert.Empty(t, req.Accept)
+			assert.Empty(t, req.ContentType)
+			return &TstReply{Output: ScimUsersPage(1, 1, "john")}
+		}})
+	assert.Nil(t, entitleSubject(ctx, "12345", "USERS", "baby"))
+	assert.Nil(t, ctx.Request("GET", "scim/Users?count=500&filter=userName+eq+%22john%22", nil, nil))
+}
+
 func TestRemoveScimMemberReturnsErrorIfScimPatchFailed(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
 		DEFAULT_GET_USER_URL:  scimDefaultUserHandler(),
@@ -311,21 +968,343 @@ func TestRemoveScimMemberReturnsErrorIfScimPatchFailed(t *testing.T) {
 func TestLoadUsersFromYaml(t *testing.T) {
 	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Users": scimDefaultUserHandler()})
 	defer srv.Close()
-	new(SCIMUsersService).LoadEntities(ctx, YAML_USERS_FILE)
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, YAML_USERS_FILE, nil)
 	AssertOnlyInfoContains(t, ctx, "User 'joe1' successfully added")
+	AssertOnlyInfoContains(t, ctx, "Users created: 2, failed: 0, not attempted: 0\n")
+	AssertOnlyInfoContains(t, ctx, "Users created with an email of the default domain example.com: 1\n")
+}
+
+func TestAddUserWithDefaultEmailDomain(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"Emails":[{"Value":"joe@corp.example.org"}]`)
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	SetDefaultEmailDomain(ctx, "@corp.example.org")
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "joe"})
+	AssertOnlyInfoContains(t, ctx, "User 'joe' successfully added")
+}
+
+func TestAddUserWithLowercaseNames(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"UserName":"åsa.öberg"`)
+		assert.Contains(t, req.Input, `"Emails":[{"Value":"åsa.öberg@corp.example.org"}]`)
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	SetLowercaseNames(ctx, true)
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "ÅSA.Öberg", Email: "Åsa.Öberg@Corp.Example.org"})
+	AssertOnlyInfoContains(t, ctx, "User 'åsa.öberg' successfully added")
+}
+
+func TestAddUserThatTimedOutAfterBeingCreated(t *testing.T) {
+	posts := 0
+	srv, ctx := NewTestContext(t, map[string]TstHandler{
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			posts++
+			time.Sleep(300 * time.Millisecond)
+			return &TstReply{Output: `{"id": "1"}`}
+		},
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22joe%22": GoodPathHandler(
+			`{"totalResults": 1, "Resources": [{"id": "1", "userName": "joe"}]}`)})
+	defer srv.Close()
+	ctx.Timeout = 100 * time.Millisecond
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "joe"})
+	AssertOnlyInfoContains(t, ctx, "User 'joe' successfully added")
+	assert.Equal(t, 1, posts, "the user is not created twice")
+}
+
+func TestAddUserRetriedWhenNotCreated(t *testing.T) {
+	posts := 0
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			if posts++; posts == 1 {
+				return &TstReply{Status: 503, Output: "try later"}
+			}
+			return &TstReply{Output: `{"id": "1"}`}
+		},
+		"GET/scim/Users?attributes=id%2CuserName&count=500&filter=userName+eq+%22joe%22": GoodPathHandler(
+			`{"totalResults": 0, "Resources": []}`)})
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "joe"})
+	AssertOnlyInfoContains(t, ctx, "User 'joe' successfully added")
+	assert.Equal(t, 2, posts)
+}
+
+func TestLoadUsersWithLowercaseNamesChecksDuplicatesInLowerCase(t *testing.T) {
+	added := []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		findUsersURL(""): GoodPathHandler(`{"totalResults": 1, "Resources": [
+			{"id": "1a", "userName": "bob@corp.com", "emails": [{"value": "bob@corp.com"}]}]}`),
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			added = append(added, req.Input)
+			return &TstReply{Output: `{"id": "new1"}`}
+		}})
+	CheckDuplicates(ctx, false)
+	ctx.SetCaseSensitiveNames(true)
+	SetLowercaseNames(ctx, true)
+	usersFile := WriteTempFile(t, "---\n- {name: Bob@Corp.com, email: Bob@Corp.com}\n"+
+		"- {name: ann@corp.com, email: Ann@corp.com}\n- {name: cy@corp.com, email: cy@corp.com}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Len(t, added, 2)
+	assert.Contains(t, added[0], `"Emails":[{"Value":"ann@corp.com"}]`)
+	assert.Equal(t, "Error creating user 'bob@corp.com': a user named \"bob@corp.com\" already exists with id 1a\n",
+		ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 2, failed: 1, not attempted: 0\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users whose userName or email was changed to lower case: 2\n")
+}
+
+func TestLoadUsersWithoutEmailFailsWithoutDefaultEmailDomain(t *testing.T) {
+	added := []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		added = append(added, req.Input)
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Len(t, added, 1)
+	assert.NotContains(t, added[0], "example.com")
+	assert.Equal(t, "Error creating user 'joe': the user has no email and no default email domain is set for the "+
+		"target, set one with \"priam target --default-email-domain <domain>\"\n", ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 1, failed: 1, not attempted: 0\n")
+	assert.NotContains(t, ctx.Log.InfoString(), "default domain")
+	assertFailedUsers(t, usersFile.Name()+".failed", "joe")
+}
+
+func TestLoadUsersWithAndWithoutInternalUserType(t *testing.T) {
+	added := map[string]string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		acct := userAccount{}
+		assert.NoError(t, json.Unmarshal([]byte(req.Input), &acct))
+		added[acct.UserName] = req.Input
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	usersFile := WriteTempFile(t, "---\n- {name: joe}\n- {name: backup-svc, internalUserType: service}\n"+
+		"- {name: bad-svc, internalUserType: robot}\n")
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.NotContains(t, added["joe"], workspaceSchemaURN)
+	assert.Contains(t, added["backup-svc"], `"Schemas":["urn:scim:schemas:core:1.0","urn:scim:schemas:extension:workspace:1.0"]`)
+	assert.Contains(t, added["backup-svc"], `"urn:scim:schemas:extension:workspace:1.0":{"InternalUserType":"SERVICE"}`)
+	assert.NotContains(t, added, "bad-svc")
+	assert.Contains(t, ctx.Log.ErrString(), `Error creating user 'bad-svc': invalid internal user type "robot", `+
+		"must be one of LOCAL, PROVISIONED, SERVICE")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 2, failed: 1, not attempted: 0")
+}
+
+func TestAddUserWithInternalUserTypeThatMustChangePassword(t *testing.T) {
+	calls := 0
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		"GET/scim/Schemas": workspaceSchemaHandler(&calls, "mustChangePassword", ""),
+		"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Contains(t, req.Input, `"Schemas":["urn:scim:schemas:core:1.0","urn:scim:schemas:extension:workspace:1.0"]`)
+			assert.Contains(t, req.Input, `"urn:scim:schemas:extension:workspace:1.0":{"InternalUserType":"LOCAL",`+
+				`"mustChangePassword":true}`)
+			return &TstReply{Output: `{"id": "1"}`}
+		}})
+	RequirePasswordChange(ctx)
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).AddEntity(ctx, &BasicUser{Name: "joe", Pwd: "changeme", InternalUserType: "LOCAL"})
+	AssertOnlyInfoContains(t, ctx, "User 'joe' successfully added, password must be changed at next login")
+}
+
+func TestGetUserShowsInternalUserType(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{DEFAULT_SHOW_USER_URL: GoodPathHandler(`{"Resources": [` +
+		`{"userName": "john", "id": "1", "urn:scim:schemas:extension:workspace:1.0": {"internalUserType": "SERVICE"}}]}`)})
+	new(SCIMUsersService).DisplayEntity(ctx, "john")
+	AssertOnlyInfoContains(t, ctx, "internalUserType: SERVICE")
 }
 
 func TestLoadUsersFromYamlFailedIfAddUserFailed(t *testing.T) {
 	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Users": ErrorHandler(404, "error scim add user")})
 	defer srv.Close()
-	new(SCIMUsersService).LoadEntities(ctx, YAML_USERS_FILE)
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
 	AssertErrorContains(t, ctx, "Error creating user 'joe1': 404 Not Found")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 0, failed: 2, not attempted: 0\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users that were not created are saved in "+usersFile.Name()+".failed\n")
+	assertFailedUsers(t, usersFile.Name()+".failed", "joe", "joe1")
+}
+
+func TestLoadUsersAttributesErrorsToUsers(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		if strings.Contains(req.Input, "joe1") {
+			return ScimErrorHandler(409, "userName joe1 is already taken")(t, req)
+		}
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	assert.Regexp(t, `^Error creating user 'joe1': 409 Conflict: userName joe1 is already taken `+
+		`\(request id [-0-9a-f]{36}\)\n$`, ctx.Log.ErrString())
+	assert.Contains(t, ctx.Log.InfoString(), "User 'joe' successfully added")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 1, failed: 1, not attempted: 0\n")
+	assertFailedUsers(t, usersFile.Name()+".failed", "joe1")
+}
+
+func TestLoadUsersSummarizesEachRow(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		if strings.Contains(req.Input, "joe1") {
+			return ScimErrorHandler(409, "userName joe1 is already taken")(t, req)
+		}
+		return &TstReply{Output: `{"id": "1"}`}
+	}})
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	summaryFile := usersFile.Name() + ".summary.json"
+	defer os.Remove(summaryFile)
+	summary, err := StartRunSummary(summaryFile, "user load", usersFile.Name(), Destination{})
+	require.Nil(t, err)
+	ctx.Log.Summary = summary
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	require.Nil(t, summary.Finish(ctx.Log.ExitCode()))
+	content, err := ioutil.ReadFile(summaryFile)
+	require.Nil(t, err)
+	assert.Contains(t, string(content), `{"row":1,"name":"joe","outcome":"created"}`)
+	assert.Contains(t, string(content), `{"row":2,"name":"joe1","outcome":"failed","error":"409 Conflict: `+
+		`userName joe1 is already taken (request id `)
+	assert.Contains(t, string(content), `"counts":{"created":1,"failed":1,"total":2}`)
+	assert.Contains(t, string(content), `"exitCode":3`)
+}
+
+func assertFailedUsers(t *testing.T, fileName string, names ...string) {
+	var users []BasicUser
+	_, err := getUsersFile(fileName, &users)
+	assert.Nil(t, err)
+	failedNames := []string{}
+	for _, u := range users {
+		failedNames = append(failedNames, u.Name)
+	}
+	assert.Equal(t, names, failedNames)
+}
+
+func TestLoadUsersStopsWhenCanceled(t *testing.T) {
+	cmdContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addUserH := func(t *testing.T, req *TstReq) *TstReply {
+		cancel()
+		return &TstReply{Output: "{}"}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Users": addUserH})
+	defer srv.Close()
+	ctx.WithContext(cmdContext)
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), nil)
+	AssertErrorContains(t, ctx, "Error creating user 'joe': request canceled")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 0, failed: 1, not attempted: 1\n")
+	assertFailedUsers(t, usersFile.Name()+".failed", "joe", "joe1")
+}
+
+// usersCheckpoint returns the checkpoint of a users file where the given
+// number of users were processed, and the users file. The caller removes both.
+func usersCheckpoint(t *testing.T, done int) (*Checkpoint, *os.File) {
+	usersFile := WriteTempFile(t, GetTempFile(t, YAML_USERS_FILE))
+	cp, err := OpenCheckpoint(NewBufferedLogr(), usersFile.Name()+".checkpoint", usersFile.Name(), false)
+	require.Nil(t, err)
+	if done > 0 {
+		cp.Record(done, "joe")
+		require.Nil(t, cp.Save())
+		cp, err = OpenCheckpoint(NewBufferedLogr(), usersFile.Name()+".checkpoint", usersFile.Name(), true)
+		require.Nil(t, err)
+	}
+	return cp, usersFile
+}
+
+func TestLoadUsersResumesAfterCheckpoint(t *testing.T) {
+	addUserH := func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"UserName":"joe1"`)
+		return &TstReply{Output: "{}"}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Users": addUserH})
+	defer srv.Close()
+	cp, usersFile := usersCheckpoint(t, 1)
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(cp.FileName())
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), cp)
+	AssertOnlyInfoContains(t, ctx, "Resuming after user 1 of "+usersFile.Name()+", joe\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users created: 1, failed: 0, not attempted: 0\n")
+	_, err := os.Stat(cp.FileName())
+	assert.True(t, os.IsNotExist(err), "checkpoint is removed once all users are processed")
+}
+
+func TestLoadUsersSavesCheckpointWhenCanceled(t *testing.T) {
+	cmdContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	adds := 0
+	addUserH := func(t *testing.T, req *TstReq) *TstReply {
+		if adds++; adds == 2 {
+			cancel()
+			return &TstReply{Status: 503}
+		}
+		return &TstReply{Output: "{}"}
+	}
+	srv, ctx := NewTestContext(t, map[string]TstHandler{"POST/scim/Users": addUserH})
+	defer srv.Close()
+	ctx.WithContext(cmdContext)
+	cp, usersFile := usersCheckpoint(t, 0)
+	defer CleanupTempFile(usersFile)
+	defer os.Remove(cp.FileName())
+	defer os.Remove(usersFile.Name() + ".failed")
+	SetDefaultEmailDomain(ctx, "example.com")
+	new(SCIMUsersService).LoadEntities(ctx, usersFile.Name(), cp)
+	assert.Contains(t, ctx.Log.InfoString(), "Progress is saved in "+cp.FileName()+
+		", run the command again with --resume to continue\n")
+	cp, err := OpenCheckpoint(ctx.Log, cp.FileName(), usersFile.Name(), true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, cp.Next())
+	assert.Equal(t, "joe", cp.LastKey)
+}
+
+func TestDeleteUsersResumesAfterCheckpoint(t *testing.T) {
+	changes := []string{}
+	srv := StartTstServer(t, deleteUsersPaths(func(change string, req *TstReq) *TstReply {
+		changes = append(changes, change)
+		return &TstReply{Status: 204}
+	}))
+	defer srv.Close()
+	fileName := writeUsersFile(t, ".txt", "john\nolaf\n")
+	defer os.Remove(fileName)
+	cp, err := OpenCheckpoint(NewBufferedLogr(), fileName+".checkpoint", fileName, false)
+	require.Nil(t, err)
+	cp.Record(1, "john")
+	require.Nil(t, cp.Save())
+	defer os.Remove(cp.FileName())
+	cp, err = OpenCheckpoint(NewBufferedLogr(), fileName+".checkpoint", fileName, true)
+	require.Nil(t, err)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	DeleteUsers(ctx, fileName, false, "", "", true, cp)
+	AssertOnlyInfoContains(t, ctx, "Resuming after user 1 of "+fileName+", john\n")
+	assert.Contains(t, ctx.Log.InfoString(), "Users deleted: 1, not found: 0, failed: 0, not attempted: 0\n")
+	assert.Equal(t, []string{"delete olaf"}, changes)
+}
+
+func TestFailureFileName(t *testing.T) {
+	assert.Equal(t, "dir/users.failed.yaml", failureFileName("dir/users.yaml"))
+	assert.Equal(t, "users.failed", failureFileName("users"))
 }
 
 func TestLoadUsersFromYamlFailedIfYamlFileDoesNotExist(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	new(SCIMUsersService).LoadEntities(ctx, "newusers-does-not-exist.yaml")
+	new(SCIMUsersService).LoadEntities(ctx, "newusers-does-not-exist.yaml", nil)
 	AssertErrorContains(t, ctx, "could not read file of bulk users")
 }
 
@@ -334,7 +1313,7 @@ func TestLoadUsersFromYamlFailedIfYamlFileDoesNotExist(t *testing.T) {
 
 func TestGetGroup(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		DEFAULT_GET_GROUP_URL: scimDefaultGroupHandler()})
+		DEFAULT_SHOW_GROUP_URL: scimDefaultGroupHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
 	new(SCIMGroupsService).DisplayEntity(ctx, DEFAULT_GROUP_NAME)
 	AssertOnlyInfoContains(t, ctx, "displayName: "+DEFAULT_GROUP_NAME)
@@ -342,9 +1321,9 @@ func TestGetGroup(t *testing.T) {
 
 func TestListGroups(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Groups?count=3&filter=myfilter": scimDefaultGroupHandler()})
+		"GET/scim/Groups?attributes=id%2CdisplayName%2Cmeta%2Cmembers&count=3&filter=myfilter": scimDefaultGroupHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	new(SCIMGroupsService).ListEntities(ctx, 3, "myfilter")
+	new(SCIMGroupsService).ListEntities(ctx, ListOptions{Count: 3, Filter: "myfilter"})
 	AssertOnlyInfoContains(t, ctx, `id: "6789"`)
 	AssertOnlyInfoContains(t, ctx, "displayName: "+DEFAULT_GROUP_NAME)
 }
@@ -354,9 +1333,97 @@ func TestListGroups(t *testing.T) {
 
 func TestListRoles(t *testing.T) {
 	srv := StartTstServer(t, map[string]TstHandler{
-		"GET/scim/Roles?count=3&filter=myfilter": scimDefaultRoleHandler()})
+		"GET/scim/Roles?attributes=id%2CdisplayName&count=3&filter=myfilter": scimDefaultRoleHandler()})
 	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
-	new(SCIMRolesService).ListEntities(ctx, 3, "myfilter")
+	new(SCIMRolesService).ListEntities(ctx, ListOptions{Count: 3, Filter: "myfilter"})
 	AssertOnlyInfoContains(t, ctx, `id: "123"`)
 	AssertOnlyInfoContains(t, ctx, "displayName: "+DEFAULT_ROLE_NAME)
 }
+
+func countingHandler(count *int, handler TstHandler) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		*count++
+		return handler(t, req)
+	}
+}
+
+func TestScimMemberLooksUpNamesOnce(t *testing.T) {
+	userGets, groupGets := 0, 0
+	srv := StartTstServer(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:    countingHandler(&userGets, scimDefaultUserHandler()),
+		DEFAULT_GET_GROUP_URL:   countingHandler(&groupGets, scimDefaultGroupHandler()),
+		"POST/scim/Groups/6789": GoodPathHandler("")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	for _, name := range []string{"john", "John", "JOHN", "john", "jOhN"} {
+		scimMember(ctx, "Groups", "displayName", DEFAULT_GROUP_NAME, name, false)
+	}
+	assert.Equal(t, 1, userGets, "user ID should be looked up once")
+	assert.Equal(t, 1, groupGets, "group ID should be looked up once")
+	assert.Equal(t, 5, strings.Count(ctx.Log.InfoString(), "Updated SCIM resource"))
+}
+
+func TestScimDeleteForgetsCachedID(t *testing.T) {
+	userGets := 0
+	srv := StartTstServer(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:      countingHandler(&userGets, scimDefaultUserHandler()),
+		"DELETE/scim/Users/12345": GoodPathHandler("")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	scimDelete(ctx, "Users", "userName", "john")
+	scimDelete(ctx, "Users", "userName", "john")
+	assert.Equal(t, 2, userGets, "user ID should be looked up again after delete")
+	_, ok := ctx.CachedID("Users", "userName", "john")
+	assert.False(t, ok)
+}
+
+func TestScimAddUserForgetsCachedID(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"POST/scim/Users": GoodPathHandler("{}")})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	ctx.CacheID("Users", "userName", "john", "stale")
+	scimAddUser(ctx, aBasicUser())
+	_, ok := ctx.CachedID("Users", "userName", "john")
+	assert.False(t, ok)
+}
+
+// updateUserBody updates user john and returns the body of the patch request.
+func updateUserBody(t *testing.T, update *UserUpdate, scim2 bool) (*HttpContext, string) {
+	body := ""
+	patchHandler := func(t *testing.T, req *TstReq) *TstReply {
+		body = req.Input
+		return &TstReply{Status: 204}
+	}
+	ctx := NewReplayContext(t, map[string]TstHandler{
+		DEFAULT_GET_USER_URL:     scimDefaultUserHandler(),
+		DEFAULT_POST_USER_URL:    patchHandler,
+		"PATCH/scim/Users/12345": patchHandler})
+	if scim2 {
+		UseScim2Patch(ctx)
+	}
+	new(SCIMUsersService).UpdateEntity(ctx, "john", update)
+	return ctx, body
+}
+
+func TestScimUpdateUserClearsAttributes(t *testing.T) {
+	ctx, body := updateUserBody(t, &UserUpdate{BasicUser: BasicUser{Name: "john", Family: "wayne"},
+		Clear: []string{"name.givenName", "title"}}, false)
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+	assert.Equal(t, `{"Name":{"FamilyName":"wayne"},"Schemas":["urn:scim:schemas:core:1.0"],"UserName":"john",`+
+		`"meta":{"attributes":["name.givenName","title"]}}`, body)
+}
+
+func TestScim2UpdateUserRemovesAttributes(t *testing.T) {
+	ctx, body := updateUserBody(t, &UserUpdate{BasicUser: BasicUser{Name: "john", Family: "wayne"},
+		Clear: []string{"name.givenName", "title"}}, true)
+	AssertOnlyInfoContains(t, ctx, `User "john" updated`)
+	assert.Equal(t, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[`+
+		`{"op":"replace","value":{"Name":{"FamilyName":"wayne"},"UserName":"john"}},`+
+		`{"op":"remove","path":"name.givenName"},{"op":"remove","path":"title"}]}`, body)
+}
+
+func TestScim2UpdateUserOnlyRemovingAttributes(t *testing.T) {
+	_, body := updateUserBody(t, &UserUpdate{Clear: []string{"name.familyName"}}, true)
+	assert.Equal(t, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[`+
+		`{"op":"remove","path":"name.familyName"}]}`, body)
+}
@@ -0,0 +1,354 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// userRow is a row of a file of bulk users, numbered from 1, with all the
+// fields of the row, including those that are not fields of BasicUser.
+type userRow struct {
+	user   BasicUser
+	fields map[string]interface{}
+	row    int
+}
+
+// userRows reads the users of a file of bulk users one row at a time, so
+// that a CSV file is loaded without being read as a whole, and a YAML file
+// one document at a time. YAML files are a list of users, or a map with the
+// list under users and their defaults under defaults, and may have several
+// documents. CSV files have a header with the fields of the users, name or
+// userName first.
+type userRows struct {
+	file     *os.File
+	rows     int // number of rows read
+	next     func() (BasicUser, map[string]interface{}, error)
+	defaults *BasicUser // defaults of a YAML file, once read
+	err      error      // error that stopped the rows sent by stream
+}
+
+// openUserRows opens a file of bulk users to read its rows
+func openUserRows(fileName string) (*userRows, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	r := &userRows{file: file}
+	if strings.ToLower(filepath.Ext(fileName)) == ".csv" {
+		in := csv.NewReader(bufio.NewReader(file))
+		in.FieldsPerRecord, in.Comment = -1, '#'
+		r.next = (&csvUserRows{in: in}).next
+	} else {
+		y := &yamlUserRows{fileName: fileName, dec: yaml.NewDecoder(bufio.NewReader(file))}
+		r.next = func() (BasicUser, map[string]interface{}, error) {
+			u, fields, err := y.next()
+			r.defaults = y.defaults
+			return u, fields, err
+		}
+	}
+	return r, nil
+}
+
+// read returns the next row, or io.EOF once all rows are read. An error
+// says the number of the row that could not be read.
+func (r *userRows) read() (userRow, error) {
+	u, fields, err := r.next()
+	if err == io.EOF {
+		return userRow{}, err
+	} else if err != nil {
+		return userRow{}, fmt.Errorf("row %d: %v", r.rows+1, err)
+	}
+	r.rows++
+	return userRow{u, fields, r.rows}, nil
+}
+
+func (r *userRows) Close() error {
+	return r.file.Close()
+}
+
+// stream sends the rows of the file to the returned channel, up to limit,
+// from a goroutine so that the rows are decoded while the users before them
+// are added. The channel is closed after the last row, after a row that
+// cannot be read, whose error is then in err, or once stop is closed.
+func (r *userRows) stream(limit int, stop <-chan struct{}) <-chan userRow {
+	rows := make(chan userRow, 100)
+	go func() {
+		defer close(rows)
+		for r.rows < limit {
+			row, err := r.read()
+			if err == io.EOF {
+				r.err = fmt.Errorf("only %d rows, the file changed since it was checked", r.rows)
+				return
+			} else if err != nil {
+				r.err = err
+				return
+			}
+			select {
+			case rows <- row:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return rows
+}
+
+// checkUserRows reads all the rows of a file of bulk users before any is
+// loaded, so that a file whose rows cannot all be read, or with fewer rows
+// than expected, fails before any request as readRows. It returns how many
+// rows are loaded and the defaults of the file, and warns of the unknown
+// fields of its users.
+func checkUserRows(ctx *HttpContext, fileName string) (int, *userDefaults, error) {
+	r, err := openUserRows(fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Close()
+	unknown := map[string]bool{}
+	for {
+		row, err := r.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, err = partialRows(ctx, fileName, r.rows, err); err != nil {
+				return 0, nil, err
+			}
+			break
+		}
+		for _, key := range unknownFields(row.fields, &row.user, false) {
+			unknown[key] = true
+		}
+	}
+	if err = expectRows(ctx, fileName, r.rows); err != nil {
+		return 0, nil, err
+	}
+	warnUnknownFields(ctx, unknown)
+	if r.defaults == nil {
+		return r.rows, nil, nil
+	}
+	defaults, err := newUserDefaults(r.defaults)
+	return r.rows, defaults, err
+}
+
+// nextUserRows returns the next rows of a channel, at most n
+func nextUserRows(rows <-chan userRow, n int) (next []userRow) {
+	for row := range rows {
+		if next = append(next, row); len(next) == n {
+			break
+		}
+	}
+	return next
+}
+
+// yamlUserRows reads the users of a YAML file with the decoder of the yaml
+// package, one document at a time, and decodes each user of a document only
+// when it is read.
+type yamlUserRows struct {
+	fileName string
+	dec      *yaml.Decoder
+	items    []yamlItem // items of the current document not read yet
+	read     int        // number of items read
+	defaults *BasicUser
+	err      error // error of the document of the items, once they are read
+}
+
+// yamlItem is an item of a list of users, kept to be decoded when read
+type yamlItem struct {
+	unmarshal func(interface{}) error
+}
+
+func (item *yamlItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	item.unmarshal = unmarshal
+	return nil
+}
+
+// yamlUsersDoc is a document of a YAML file of users, a list of users or a
+// map of defaults and users.
+type yamlUsersDoc struct {
+	items    []yamlItem
+	defaults *BasicUser
+}
+
+func (doc *yamlUsersDoc) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&doc.items); err == nil {
+		return nil
+	}
+	var keys yaml.MapSlice
+	if err := unmarshal(&keys); err != nil {
+		return fmt.Errorf("expected a list of users, or a map of defaults and users")
+	}
+	for _, key := range keys {
+		if key.Key != "users" && key.Key != "defaults" {
+			return fmt.Errorf("unknown key %v, expected a list of users, or a map of defaults and users", key.Key)
+		}
+	}
+	var file struct {
+		Defaults *yamlItem  `yaml:"defaults"`
+		Users    []yamlItem `yaml:"users"`
+	}
+	if err := unmarshal(&file); err != nil {
+		return err
+	}
+	doc.items = file.Users
+	if file.Defaults == nil {
+		return nil
+	}
+	var fields map[string]interface{}
+	doc.defaults = &BasicUser{}
+	if err := file.Defaults.unmarshal(&fields); err != nil {
+		return err
+	} else if err = file.Defaults.unmarshal(doc.defaults); err != nil {
+		return err
+	}
+	for key := range fields {
+		if !HasString(key, basicUserFields) {
+			return fmt.Errorf("defaults: field %s not found in type %T", key, BasicUser{})
+		}
+	}
+	return nil
+}
+
+// next returns the user of the next item, with its fields
+func (y *yamlUserRows) next() (BasicUser, map[string]interface{}, error) {
+	for len(y.items) == 0 {
+		if y.err != nil {
+			return BasicUser{}, nil, y.err
+		}
+		var doc yamlUsersDoc
+		if err := y.dec.Decode(&doc); err == io.EOF {
+			return BasicUser{}, nil, err
+		} else if err != nil {
+			y.items, y.err = y.readableItems(), err
+			continue
+		}
+		y.items = doc.items
+		if doc.defaults != nil {
+			y.defaults = doc.defaults
+		}
+	}
+	item := y.items[0]
+	y.items, y.read = y.items[1:], y.read+1
+	var u BasicUser
+	var fields map[string]interface{}
+	if err := item.unmarshal(&fields); err != nil {
+		return BasicUser{}, nil, fmt.Errorf("expected a user: %v", err)
+	} else if err = item.unmarshal(&u); err != nil {
+		return BasicUser{}, nil, err
+	}
+	return u, fields, nil
+}
+
+// readableItems returns the items not read yet of a file whose document did
+// not decode, those of the file cut before the first item that does not
+// decode as decodedRows, so that the rows before the error are read.
+func (y *yamlUserRows) readableItems() []yamlItem {
+	content, err := ioutil.ReadFile(y.fileName)
+	if err != nil {
+		return nil
+	}
+	var items []yamlItem
+	decodedRows(content, func(content []byte) (int, error) {
+		items = nil
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			var doc yamlUsersDoc
+			if err := dec.Decode(&doc); err == io.EOF {
+				return len(items), nil
+			} else if err != nil {
+				items = nil
+				return 0, err
+			}
+			items = append(items, doc.items...)
+			if doc.defaults != nil {
+				y.defaults = doc.defaults
+			}
+		}
+	})
+	if len(items) <= y.read {
+		return nil
+	}
+	return items[y.read:]
+}
+
+// csvUserRows reads the users of a CSV file, whose header names the field of
+// each column. Columns that are not fields of users are unknown fields, and
+// empty cells are ignored.
+type csvUserRows struct {
+	in     *csv.Reader
+	header []string
+}
+
+// next returns the user of the next record, with its fields
+func (c *csvUserRows) next() (BasicUser, map[string]interface{}, error) {
+	record, err := c.in.Read()
+	if err == nil && c.header == nil {
+		if c.header, err = csvUserHeader(record); err == nil {
+			record, err = c.in.Read()
+		}
+	}
+	if err != nil {
+		return BasicUser{}, nil, err
+	}
+	var u BasicUser
+	fields := map[string]interface{}{}
+	for i, value := range record {
+		if i >= len(c.header) || value == "" {
+			continue
+		}
+		fields[c.header[i]] = value
+		if c.header[i] == "name" {
+			u.Name = value
+		}
+		for _, f := range defaultFields {
+			if c.header[i] == f.field {
+				*f.get(&u) = value
+			}
+		}
+	}
+	return u, fields, nil
+}
+
+// csvUserHeader returns the fields of the columns of a CSV file of users,
+// with the names of the fields of users in the case of YAML files
+func csvUserHeader(record []string) ([]string, error) {
+	header := make([]string, len(record))
+	for i, column := range record {
+		header[i] = strings.TrimSpace(column)
+		if CaselessEqual(header[i], "userName") {
+			header[i] = "name"
+		}
+		for _, field := range basicUserFields {
+			if CaselessEqual(header[i], field) {
+				header[i] = field
+			}
+		}
+	}
+	if len(header) == 0 || header[0] != "name" {
+		return nil, fmt.Errorf("the first column must be the name or userName of the users")
+	}
+	return header, nil
+}
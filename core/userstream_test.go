@@ -0,0 +1,169 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	. "github.com/vmware/priam/util"
+	"io"
+	"os"
+	"testing"
+)
+
+// readUserRows returns all the rows of a file of users and the error that
+// stopped reading them, nil at the end of the file.
+func readUserRows(t *testing.T, ext, content string) (rows []userRow, defaults *BasicUser, err error) {
+	fileName := writeUsersFile(t, ext, content)
+	defer os.Remove(fileName)
+	r, err := openUserRows(fileName)
+	require.Nil(t, err)
+	defer r.Close()
+	for {
+		row, err := r.read()
+		if err == io.EOF {
+			return rows, r.defaults, nil
+		} else if err != nil {
+			return rows, r.defaults, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestUserRowsReadsItemsOfYamlLists(t *testing.T) {
+	rows, defaults, err := readUserRows(t, ".yaml", "---\n- {name: joe}\n# a comment\n- name: sue\n  given: |\n"+
+		"    Susan\n\n    Anne\n  dept: hr\n---\nusers:\n  - name: ann\n\n  # last row\n  - name: bob\ndefaults:\n"+
+		"  family: Sales\n")
+	require.Nil(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, userRow{BasicUser{Name: "joe"}, map[string]interface{}{"name": "joe"}, 1}, rows[0])
+	assert.Equal(t, "Susan\n\nAnne\n", rows[1].user.Given)
+	assert.Equal(t, "hr", rows[1].fields["dept"])
+	assert.Equal(t, userRow{BasicUser{Name: "bob"}, map[string]interface{}{"name": "bob"}, 4}, rows[3])
+	assert.Equal(t, &BasicUser{Family: "Sales"}, defaults)
+}
+
+func TestUserRowsReadsListUnderUsers(t *testing.T) {
+	rows, defaults, err := readUserRows(t, ".yml", "defaults: {family: Sales}\nusers:\n  - name: joe\n"+
+		"    given: Joseph\n  - {name: sue}\n")
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, BasicUser{Name: "joe", Given: "Joseph"}, rows[0].user)
+	assert.Equal(t, 2, rows[1].row)
+	assert.Equal(t, &BasicUser{Family: "Sales"}, defaults)
+}
+
+func TestUserRowsErrorSaysRowAndLineOfFile(t *testing.T) {
+	rows, _, err := readUserRows(t, ".yaml", "- {name: joe}\n- name: sue\n  given: Susan\n- {name: ann, given: An")
+	assert.Len(t, rows, 2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "row 3: yaml: line 4: ")
+	}
+}
+
+func TestUserRowsRejectsUnknownKeys(t *testing.T) {
+	_, _, err := readUserRows(t, ".yaml", "defaults: {family: Sales}\npeople:\n- {name: joe}\n")
+	assert.EqualError(t, err, "row 1: unknown key people, expected a list of users, or a map of defaults and users")
+}
+
+func TestUserRowsReadsFlowStyleLists(t *testing.T) {
+	rows, defaults, err := readUserRows(t, ".yaml", "[{name: joe}, {name: sue, given: Susan}]\n---\n"+
+		"users: [{name: ann}]\ndefaults: {family: Sales}\n---\n{users: [{name: bob}]}\n")
+	require.Nil(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, BasicUser{Name: "sue", Given: "Susan"}, rows[1].user)
+	assert.Equal(t, userRow{BasicUser{Name: "ann"}, map[string]interface{}{"name": "ann"}, 3}, rows[2])
+	assert.Equal(t, "bob", rows[3].user.Name)
+	assert.Equal(t, &BasicUser{Family: "Sales"}, defaults)
+}
+
+func TestUserRowsErrorOfLaterDocumentSaysRowAndLineOfFile(t *testing.T) {
+	rows, _, err := readUserRows(t, ".yaml", "- {name: joe}\n---\nusers:\n- {name: sue}\n- {name: ann, given: [An")
+	assert.Len(t, rows, 2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "row 3: yaml: line 5: ")
+	}
+}
+
+func TestUserRowsRejectsItemsThatAreNotUsers(t *testing.T) {
+	rows, _, err := readUserRows(t, ".yaml", "- {name: joe}\n- sue\n")
+	assert.Len(t, rows, 1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "row 2: expected a user: ")
+	}
+}
+
+func TestUserRowsReadsCsvRecords(t *testing.T) {
+	rows, _, err := readUserRows(t, ".csv", "UserName,Given,email,dept\n# a comment\njoe,Joseph,,hr\n"+
+		"\"sue, jr\",Susan,sue@example.com\n")
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, userRow{BasicUser{Name: "joe", Given: "Joseph"},
+		map[string]interface{}{"name": "joe", "given": "Joseph", "dept": "hr"}, 1}, rows[0])
+	assert.Equal(t, BasicUser{Name: "sue, jr", Given: "Susan", Email: "sue@example.com"}, rows[1].user)
+}
+
+func TestUserRowsOfCsvWithoutNameColumnFails(t *testing.T) {
+	_, _, err := readUserRows(t, ".csv", "given,family\nJoseph,Smith\n")
+	assert.EqualError(t, err, "row 1: the first column must be the name or userName of the users")
+}
+
+func TestLoadUsersFromCsv(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		assert.Contains(t, req.Input, `"Emails":[{"Value":"joe@example.com"}]`)
+		assert.Contains(t, req.Input, `"department":"hr"`)
+		return &TstReply{Output: "{}"}
+	}})
+	KeepUnknownFields(ctx)
+	fileName := writeUsersFile(t, ".csv", "name,email,urn:scim:schemas:extension:workspace:1.0.department\n"+
+		"joe,joe@example.com,hr\n")
+	defer os.Remove(fileName)
+	new(SCIMUsersService).LoadEntities(ctx, fileName, nil)
+	AssertOnlyInfoContains(t, ctx, "Users created: 1, failed: 0, not attempted: 0\n")
+}
+
+func TestLoadUsersOfTruncatedFileSaysRowAndLine(t *testing.T) {
+	ctx := NewReplayContext(t, map[string]TstHandler{})
+	fileName := writeUsersFile(t, ".yaml", "- {name: joe}\n- {name: sue}\n- {name: ann, giv")
+	defer os.Remove(fileName)
+	new(SCIMUsersService).LoadEntities(ctx, fileName, nil)
+	AssertErrorContains(t, ctx, "could not read file of bulk users: only the first 2 rows of "+fileName+
+		" can be read, the file may be incomplete, use --allow-partial to load them: row 3: yaml: line 3: ")
+}
+
+func TestLoadUsersResumesAfterRowsOfStream(t *testing.T) {
+	added := []string{}
+	ctx := NewReplayContext(t, map[string]TstHandler{"POST/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		added = append(added, req.Input)
+		return &TstReply{Output: "{}"}
+	}})
+	SetDefaultEmailDomain(ctx, "example.com")
+	fileName := writeUsersFile(t, ".csv", "name\njoe\nsue\nann\n")
+	defer os.Remove(fileName)
+	cp, err := OpenCheckpoint(NewBufferedLogr(), fileName+".checkpoint", fileName, false)
+	require.Nil(t, err)
+	defer os.Remove(cp.FileName())
+	cp.Record(2, "sue")
+	require.Nil(t, cp.Save())
+	cp, err = OpenCheckpoint(NewBufferedLogr(), cp.FileName(), fileName, true)
+	require.Nil(t, err)
+	new(SCIMUsersService).LoadEntities(ctx, fileName, cp)
+	AssertOnlyInfoContains(t, ctx, "Resuming after user 2 of "+fileName+", sue\n")
+	if assert.Len(t, added, 1) {
+		assert.Contains(t, added[0], `"UserName":"ann"`)
+	}
+}
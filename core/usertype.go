@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package core
+
+import (
+	"fmt"
+	. "github.com/vmware/priam/util"
+	"strings"
+)
+
+const (
+	userTypeAttr  = "internalUserType" // filter attribute of the internal user type
+	userTypeLabel = workspaceSchemaURN + "." + userTypeAttr
+)
+
+// CheckUserType returns an internal user type in upper case, or an error if
+// it is not one of InternalUserTypes.
+func CheckUserType(userType string) (string, error) {
+	upper := strings.ToUpper(userType)
+	if !HasString(upper, InternalUserTypes) {
+		return "", fmt.Errorf("invalid user type \"%s\", it must be one of: %s", userType,
+			strings.Join(InternalUserTypes, ", "))
+	}
+	return upper, nil
+}
+
+// withUserType returns a filter that also restricts users to a type, or
+// the filter unchanged if the type is empty.
+func withUserType(filter, userType string) string {
+	if userType == "" {
+		return filter
+	}
+	return And(RawFilter(filter), Eq(userTypeAttr, userType)).String()
+}
+
+// userTypeOf returns the internal user type of a user, empty if it is not
+// known, for instance when the tenant does not return it.
+func userTypeOf(resource scimResource) string {
+	if u, ok := resource.(*typedUser); ok && u.WksExt != nil {
+		return u.WksExt.InternalUserType
+	}
+	return ""
+}
+
+// userTypeMatch returns true if the type is empty or is the type of the
+// user. A user of unknown type does not match any type, so that it is never
+// changed by a command restricted to a type.
+func userTypeMatch(resource scimResource, userType string) bool {
+	return userType == "" || strings.EqualFold(userTypeOf(resource), userType)
+}
+
+// userIDOfType returns the id of a named user, or "" if the user is not of
+// the given type. Users of any type match an empty type.
+func userIDOfType(ctx *HttpContext, name, userType string) (string, error) {
+	if userType == "" {
+		return scimGetID(ctx, "Users", "userName", name)
+	}
+	item, err := scimGetByName(ctx, "Users", "userName", name, "id", "userName", workspaceSchemaURN)
+	if err != nil || !userTypeMatch(item, userType) {
+		return "", err
+	}
+	return item.id(), nil
+}
+
+// scimForEachUser is scimForEach for users that also restricts them to a
+// type, by filter if the tenant accepts it or else here. The workspace
+// attributes are requested with the others so that the type is checked in
+// any case.
+func scimForEachUser(ctx *HttpContext, filter, userType string, attrs []string,
+	fn func(resource scimResource) error) error {
+	if userType == "" {
+		return scimForEach(ctx, "Users", filter, attrs, fn)
+	}
+	attrs = withLabels(attrs, workspaceSchemaURN)
+	matching := func(resource scimResource) error {
+		if userTypeMatch(resource, userType) {
+			return fn(resource)
+		}
+		return nil
+	}
+	err := scimForEach(ctx, "Users", withUserType(filter, userType), attrs, matching)
+	if isFilterRejected(err) {
+		ctx.Log.Debug("Users cannot be filtered by %s, filtering them here: %v\n", userTypeAttr, err)
+		err = scimForEach(ctx, "Users", filter, attrs, matching)
+	}
+	return err
+}
@@ -27,11 +27,13 @@ import (
 
 type TstReq struct {
 	Accept, ContentType, Authorization, Input string
+	Header                                    http.Header // all headers of the request
 }
 
 type TstReply struct {
 	Output, ContentType, StatusMsg string
 	Status                         int
+	Header                         http.Header // additional headers of the reply
 }
 
 type TstHandler func(t *testing.T, req *TstReq) *TstReply
@@ -44,7 +46,13 @@ func stringOrDefault(v, dfault string) string {
 }
 
 func StartTstServer(t *testing.T, paths map[string]TstHandler) *httptest.Server {
-	handler := func(w http.ResponseWriter, r *http.Request) {
+	return httptest.NewServer(tstHandler(t, paths))
+}
+
+// tstHandler answers requests with the handlers of paths, keyed by the method
+// and the path with its query, and fails the test for any other request.
+func tstHandler(t *testing.T, paths map[string]TstHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		t.Logf("Request URL: '%s'\n", r.Method+r.URL.String())
 		if rbody, err := ioutil.ReadAll(r.Body); err != nil {
 			http.Error(w, fmt.Sprintf("error reading request body: %v", err), 404)
@@ -52,18 +60,22 @@ func StartTstServer(t *testing.T, paths map[string]TstHandler) *httptest.Server
 			http.Error(w, fmt.Sprintf("unknown path: %v", r.Method+r.URL.String()), 404)
 			t.Errorf("unknown path: %v\nregistered paths are: %v", r.Method+r.URL.String(), paths)
 		} else {
-			reply := handler(t, &TstReq{r.Header.Get("Accept"),
-				r.Header.Get("Content-Type"), r.Header.Get("Authorization"),
-				string(rbody)})
+			reply := handler(t, &TstReq{Accept: r.Header.Get("Accept"),
+				ContentType: r.Header.Get("Content-Type"), Authorization: r.Header.Get("Authorization"),
+				Input: string(rbody), Header: r.Header})
+			for name, values := range reply.Header {
+				w.Header()[name] = values
+			}
 			if reply.Status != 0 && reply.Status != 200 {
 				http.Error(w, reply.StatusMsg, reply.Status)
 			}
 			w.Header().Set("Content-Type", stringOrDefault(reply.ContentType, "application/json"))
-			_, err = io.WriteString(w, reply.Output)
-			assert.Nil(t, err)
+			if reply.Output != "" {
+				_, err = io.WriteString(w, reply.Output)
+				assert.Nil(t, err)
+			}
 		}
 	}
-	return httptest.NewServer(http.HandlerFunc(handler))
 }
 
 // Returns an error with the given message
@@ -0,0 +1,48 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testaid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ReplayTransport returns a transport that answers requests with the
+// handlers of paths, keyed by method and path as for StartTstServer, without
+// starting a server. Use it with HttpContext.SetRoundTripper.
+func ReplayTransport(t *testing.T, paths map[string]TstHandler) http.RoundTripper {
+	handler := tstHandler(t, paths)
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		local := req.Clone(req.Context())
+		local.URL = &url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+		if local.Body == nil {
+			local.Body = http.NoBody
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, local)
+		resp := rec.Result()
+		resp.Request = req
+		return resp, nil
+	})
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testaid
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+// Fixtures of the common responses of the tenant. Users and groups are
+// given the ID of their name followed by "-id".
+
+func toJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// ScimID returns the ID that fixtures give to the user or group of the given name
+func ScimID(name string) string {
+	return name + "-id"
+}
+
+// ScimUsersPage returns a page of a SCIM search of users, starting at
+// startIndex, of a search that found total users.
+func ScimUsersPage(startIndex, total int, userNames ...string) string {
+	resources := []map[string]interface{}{}
+	for _, name := range userNames {
+		resources = append(resources, map[string]interface{}{"id": ScimID(name), "userName": name, "active": true})
+	}
+	return toJSON(map[string]interface{}{"schemas": []string{"urn:scim:schemas:core:1.0"},
+		"totalResults": total, "itemsPerPage": len(resources), "startIndex": startIndex, "Resources": resources})
+}
+
+// ScimGroupWithMembers returns the result of a SCIM search that found the
+// named group with the named users as members.
+func ScimGroupWithMembers(groupName string, userNames ...string) string {
+	members := []map[string]string{}
+	for _, name := range userNames {
+		members = append(members, map[string]string{"value": ScimID(name), "type": "User", "display": name})
+	}
+	group := map[string]interface{}{"id": ScimID(groupName), "displayName": groupName, "members": members}
+	return toJSON(map[string]interface{}{"schemas": []string{"urn:scim:schemas:core:1.0"},
+		"totalResults": 1, "itemsPerPage": 1, "startIndex": 1, "Resources": []interface{}{group}})
+}
+
+// EntitlementBulkResponse returns the response of a bulk entitlement request
+// with an operation of each given status.
+func EntitlementBulkResponse(statuses ...int) string {
+	ops := []map[string]interface{}{}
+	for _, status := range statuses {
+		ops = append(ops, map[string]interface{}{"status": strconv.Itoa(status)})
+	}
+	return toJSON(map[string]interface{}{"operations": ops})
+}
+
+// ScimError returns a SCIM error body with the given status and detail.
+func ScimError(status int, detail string) string {
+	return toJSON(map[string]interface{}{"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:Error"},
+		"status": strconv.Itoa(status), "detail": detail})
+}
+
+// ScimErrorHandler answers with the given status and a SCIM error body.
+func ScimErrorHandler(status int, detail string) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		return &TstReply{Status: status, Output: ScimError(status, detail)}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog appends a record of each request that may change the tenant to
+// a file. It is shared by the copies of a context.
+type auditLog struct {
+	mutex    sync.Mutex
+	fileName string
+	warned   bool
+}
+
+// Destination is where the requests of a context go and who sends them, as
+// printed when commands that change the tenant start and as recorded in
+// audit files and summaries.
+type Destination struct {
+	Target    string `json:"target,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	Client    string `json:"client,omitempty"`
+}
+
+// Destination returns the target, tenant, principal and client of the context
+func (ctx *HttpContext) Destination() Destination {
+	return Destination{ctx.TargetName, ctx.HostURL, ctx.Principal, ctx.Client}
+}
+
+func (d Destination) String() string {
+	text := fmt.Sprintf("target %s, %s", d.Target, d.Tenant)
+	if d.Principal != "" {
+		text += ", principal " + d.Principal
+	}
+	if d.Client != "" {
+		text += ", client " + d.Client
+	}
+	return text
+}
+
+// AuditRecord is a line of the audit file, as a JSON object. Bodies are not
+// recorded, only the name of the resource if it is known.
+type AuditRecord struct {
+	Time      string `json:"time"`
+	Target    string `json:"target,omitempty" yaml:"target,omitempty"`
+	Tenant    string `json:"tenant"`
+	Principal string `json:"principal,omitempty" yaml:"principal,omitempty"`
+	Client    string `json:"client,omitempty" yaml:"client,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Resource  string `json:"resource,omitempty" yaml:"resource,omitempty"`
+	Status    int    `json:"status,omitempty" yaml:"status,omitempty"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+	RequestID string `json:"requestId,omitempty" yaml:"requestId,omitempty"`
+	TraceID   string `json:"traceId,omitempty" yaml:"traceId,omitempty"`
+}
+
+// SetAudit appends a record of the POST, PUT, PATCH and DELETE requests sent
+// with this context and its copies to the named file, with the principal and
+// client of the context. Nothing is recorded if fileName is empty.
+func (ctx *HttpContext) SetAudit(fileName string) *HttpContext {
+	ctx.audit = nil
+	if fileName != "" {
+		ctx.audit = &auditLog{fileName: fileName}
+	}
+	return ctx
+}
+
+func auditedMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// auditRequest records the outcome of a request, the status of the response
+// or the error, with the ID of the request and the trace ID of the server. A
+// record that cannot be written does not fail the request, a warning is
+// printed the first time.
+func (ctx *HttpContext) auditRequest(method, path string, body []byte, status int, requestID, traceID string,
+	err error) {
+	a := ctx.audit
+	if a == nil || !auditedMethod(method) {
+		return
+	}
+	rec := AuditRecord{Time: now().UTC().Format(time.RFC3339), Target: ctx.TargetName, Tenant: ctx.HostURL,
+		Principal: ctx.Principal, Client: ctx.Client, Method: method, Path: redactURL(path), Resource: ctx.auditResource(path, body),
+		Status: status, RequestID: requestID, TraceID: traceID}
+	if err != nil {
+		rec.Error = redactText(strings.TrimSpace(strings.SplitN(err.Error(), "\n", 2)[0]))
+	}
+	line, _ := json.Marshal(rec)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	f, err := os.OpenFile(a.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil && !a.warned {
+		a.warned = true
+		ctx.Log.Warn("Could not write audit file %s: %v\n", a.fileName, err)
+	}
+}
+
+// auditResource returns the name of the resource of a request: the name in
+// its body, or the cached name of the ID at the end of its path.
+func (ctx *HttpContext) auditResource(path string, body []byte) string {
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, k := range []string{"userName", "displayName", "name"} {
+			if name, ok := fields[k].(string); ok && name != "" {
+				return name
+			}
+		}
+	}
+	segments := strings.Split(strings.SplitN(path, "?", 2)[0], "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if name, ok := ctx.cachedName(segments[i]); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// PrintAudit prints the records of an audit file from since and before
+// until, either of which may be zero, and about the given resource if it is
+// not empty. The resource is matched without case with the name of the
+// resource and with the segments of the path of the request.
+func PrintAudit(log *Logr, fileName string, since, until time.Time, resource string) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		log.Err("Could not read audit file: %v\n", err)
+		return
+	}
+	defer f.Close()
+	records, scanner := []AuditRecord{}, bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var rec AuditRecord
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		} else if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Warn("Line %d of %s is not an audit record: %v\n", n, fileName, err)
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, rec.Time); err == nil &&
+			(!since.IsZero() && t.Before(since) || !until.IsZero() && !t.Before(until)) {
+			continue
+		}
+		if resource == "" || auditAbout(rec, resource) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Err("Could not read audit file: %v\n", err)
+		return
+	}
+	log.PP(fmt.Sprintf("%d audit records", len(records)), records)
+}
+
+func auditAbout(rec AuditRecord, resource string) bool {
+	if strings.EqualFold(rec.Resource, resource) {
+		return true
+	}
+	for _, s := range strings.Split(strings.SplitN(rec.Path, "?", 2)[0], "/") {
+		if strings.EqualFold(s, resource) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func auditedContext(t *testing.T, fileName string) (*HttpContext, func()) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/scim/Users":      GoodPathHandler(`{"Resources": []}`),
+		"POST/scim/Users":     GoodPathHandler(`{"id": "1"}`),
+		"DELETE/scim/Users/2": ErrorHandler(404, "no such user"),
+	})
+	now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	newRequestID = func() string { return "req-1" }
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetAudit(fileName)
+	ctx.TargetName, ctx.Principal, ctx.Client = "staging", "admin@acme", "priam-cli"
+	return ctx, func() { srv.Close(); now, newRequestID = time.Now, uuid.New }
+}
+
+func TestAuditRecordsChangesWithResourceAndOutcome(t *testing.T) {
+	auditFile := WriteTempFile(t, "")
+	defer CleanupTempFile(auditFile)
+	ctx, undo := auditedContext(t, auditFile.Name())
+	defer undo()
+	ctx.CacheID("Users", "userName", "Anna", "2")
+	assert.Nil(t, ctx.Request("GET", "scim/Users", nil, nil))
+	assert.Nil(t, ctx.Request("POST", "scim/Users", map[string]string{"userName": "sven", "password": "x"}, nil))
+	assert.NotNil(t, ctx.Request("DELETE", "scim/Users/2", nil, nil))
+	tenant := ctx.HostURL
+	assert.Equal(t, `{"time":"2020-01-02T03:04:05Z","target":"staging","tenant":"`+tenant+`","principal":"admin@acme",`+
+		`"client":"priam-cli",`+
+		`"method":"POST","path":"scim/Users","resource":"sven","status":200,"requestId":"req-1"}`+"\n"+
+		`{"time":"2020-01-02T03:04:05Z","target":"staging","tenant":"`+tenant+`","principal":"admin@acme",`+
+		`"client":"priam-cli",`+
+		`"method":"DELETE","path":"scim/Users/2","resource":"anna","status":404,"error":"404 Not Found",`+
+		`"requestId":"req-1"}`+"\n",
+		GetTempFile(t, auditFile.Name()))
+}
+
+func TestAuditFailureOnlyWarns(t *testing.T) {
+	ctx, undo := auditedContext(t, filepath.Join(os.TempDir(), "no-such-dir", "audit.log"))
+	defer undo()
+	assert.Nil(t, ctx.Request("POST", "scim/Users", nil, nil))
+	assert.Nil(t, ctx.Request("POST", "scim/Users", nil, nil))
+	assert.Equal(t, 1, strings.Count(ctx.Log.ErrString(), "WARNING: Could not write audit file"))
+	assert.Equal(t, ExitOK, ctx.Log.ExitCode())
+}
+
+const auditRecords = `{"time":"2020-01-01T10:00:00Z","tenant":"https://t","method":"POST","path":"scim/Users","resource":"sven","status":201}
+not a record
+{"time":"2020-01-02T10:00:00Z","tenant":"https://t","method":"DELETE","path":"scim/Users/2","resource":"anna","status":204}
+{"time":"2020-01-03T10:00:00Z","tenant":"https://t","method":"PATCH","path":"scim/Groups/3","status":204}
+`
+
+func TestPrintAuditFiltersByTimeAndResource(t *testing.T) {
+	auditFile := WriteTempFile(t, auditRecords)
+	defer CleanupTempFile(auditFile)
+	log := NewBufferedLogr()
+	PrintAudit(log, auditFile.Name(), time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), time.Time{}, "")
+	assert.Contains(t, log.InfoString(), "---- 2 audit records ----")
+	assert.NotContains(t, log.InfoString(), "sven")
+	assert.Contains(t, log.ErrString(), "WARNING: Line 2 of ")
+
+	log = NewBufferedLogr()
+	PrintAudit(log, auditFile.Name(), time.Time{}, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), "3")
+	assert.Contains(t, log.InfoString(), "---- 0 audit records ----")
+
+	log = NewBufferedLogr()
+	PrintAudit(log, auditFile.Name(), time.Time{}, time.Time{}, "ANNA")
+	assert.Equal(t, "---- 1 audit records ----\n- time: \"2020-01-02T10:00:00Z\"\n  tenant: https://t\n"+
+		"  method: DELETE\n  path: scim/Users/2\n  resource: anna\n  status: 204\n", log.InfoString())
+}
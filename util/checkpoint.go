@@ -0,0 +1,145 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CheckpointInterval is how many entries are processed between two saves of
+// a checkpoint.
+var CheckpointInterval = 100
+
+// Checkpoint records how many entries of an input file a bulk command has
+// processed, so that the command can resume after them when it is run again.
+// A nil checkpoint records nothing.
+type Checkpoint struct {
+	InputHash string `yaml:"inputHash"`
+	Done      int    `yaml:"done"`    // number of entries processed
+	LastKey   string `yaml:"lastKey"` // key of the last entry processed
+	fileName  string
+	saved     int
+}
+
+// OpenCheckpoint returns the checkpoint of the given file for the input file.
+// If resume is set, it continues the checkpoint saved in the file unless the
+// input file changed since, otherwise it starts from the first entry.
+func OpenCheckpoint(log *Logr, fileName, inputFile string, resume bool) (*Checkpoint, error) {
+	hash, err := fileHash(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{InputHash: hash, fileName: fileName}
+	if !resume {
+		return cp, nil
+	}
+	saved := Checkpoint{}
+	if err = GetYamlFile(fileName, &saved); os.IsNotExist(err) {
+		log.Warn("No checkpoint in %s, starting from the first entry\n", fileName)
+	} else if err != nil {
+		return nil, err
+	} else if saved.InputHash != hash {
+		log.Warn("%s changed since checkpoint %s was saved, starting from the first entry\n", inputFile, fileName)
+	} else {
+		cp.Done, cp.LastKey, cp.saved = saved.Done, saved.LastKey, saved.Done
+	}
+	return cp, nil
+}
+
+func fileHash(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Next returns the index of the first entry that was not processed
+func (cp *Checkpoint) Next() int {
+	if cp == nil {
+		return 0
+	}
+	return cp.Done
+}
+
+// Record records that the entries before index done are processed, the last
+// one named key, and saves the checkpoint every CheckpointInterval entries.
+func (cp *Checkpoint) Record(done int, key string) error {
+	if cp == nil {
+		return nil
+	}
+	cp.Done, cp.LastKey = done, key
+	if cp.Done-cp.saved < CheckpointInterval {
+		return nil
+	}
+	return cp.Save()
+}
+
+// Save writes the checkpoint to a temporary file that then replaces the
+// checkpoint file, so that the file is never partly written.
+func (cp *Checkpoint) Save() error {
+	if cp == nil {
+		return nil
+	}
+	out, err := yaml.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cp.fileName), filepath.Base(cp.fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(out)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cp.fileName)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	cp.saved = cp.Done
+	return nil
+}
+
+// Remove deletes the checkpoint file once all entries are processed
+func (cp *Checkpoint) Remove() error {
+	if cp == nil {
+		return nil
+	}
+	if err := os.Remove(cp.fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// FileName returns the name of the checkpoint file
+func (cp *Checkpoint) FileName() string {
+	return cp.fileName
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempCheckpoint returns a directory with an input file and the name of a
+// checkpoint file in it, the caller removes the directory.
+func tempCheckpoint(t *testing.T) (dir, inputFile, cpFile string) {
+	dir, err := ioutil.TempDir("", "priam-checkpoint")
+	require.Nil(t, err)
+	inputFile, cpFile = filepath.Join(dir, "users.yaml"), filepath.Join(dir, "users.yaml.checkpoint")
+	require.Nil(t, ioutil.WriteFile(inputFile, []byte("- {name: anna}\n- {name: olaf}\n- {name: sven}\n"), 0644))
+	return
+}
+
+func TestCheckpointIsSavedEveryInterval(t *testing.T) {
+	defer func(interval int) { CheckpointInterval = interval }(CheckpointInterval)
+	CheckpointInterval = 2
+	dir, inputFile, cpFile := tempCheckpoint(t)
+	defer os.RemoveAll(dir)
+	cp, err := OpenCheckpoint(NewBufferedLogr(), cpFile, inputFile, false)
+	require.Nil(t, err)
+	assert.Nil(t, cp.Record(1, "anna"))
+	_, err = os.Stat(cpFile)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, cp.Record(2, "olaf"))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 2, "the temporary file is renamed")
+
+	log := NewBufferedLogr()
+	cp, err = OpenCheckpoint(log, cpFile, inputFile, true)
+	require.Nil(t, err)
+	assert.Equal(t, 2, cp.Next())
+	assert.Equal(t, "olaf", cp.LastKey)
+	assert.Empty(t, log.ErrString())
+	assert.Nil(t, cp.Remove())
+	_, err = os.Stat(cpFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckpointIsNotResumedIfInputChanged(t *testing.T) {
+	dir, inputFile, cpFile := tempCheckpoint(t)
+	defer os.RemoveAll(dir)
+	cp, err := OpenCheckpoint(NewBufferedLogr(), cpFile, inputFile, false)
+	require.Nil(t, err)
+	cp.Record(1, "anna")
+	require.Nil(t, cp.Save())
+	require.Nil(t, ioutil.WriteFile(inputFile, []byte("- {name: olaf}\n"), 0644))
+	log := NewBufferedLogr()
+	cp, err = OpenCheckpoint(log, cpFile, inputFile, true)
+	require.Nil(t, err)
+	assert.Equal(t, 0, cp.Next())
+	assert.Equal(t, "WARNING: "+inputFile+" changed since checkpoint "+cpFile+" was saved, starting from the first entry\n",
+		log.ErrString())
+}
+
+func TestResumeWithoutCheckpointStartsFromFirstEntry(t *testing.T) {
+	dir, inputFile, cpFile := tempCheckpoint(t)
+	defer os.RemoveAll(dir)
+	log := NewBufferedLogr()
+	cp, err := OpenCheckpoint(log, cpFile, inputFile, true)
+	require.Nil(t, err)
+	assert.Equal(t, 0, cp.Next())
+	assert.Contains(t, log.ErrString(), "No checkpoint in "+cpFile)
+}
+
+func TestOpenCheckpointFailsWithoutInput(t *testing.T) {
+	_, err := OpenCheckpoint(NewBufferedLogr(), "missing.checkpoint", "missing.yaml", false)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNilCheckpointRecordsNothing(t *testing.T) {
+	var cp *Checkpoint
+	assert.Equal(t, 0, cp.Next())
+	assert.Nil(t, cp.Record(1, "anna"))
+	assert.Nil(t, cp.Save())
+	assert.Nil(t, cp.Remove())
+}
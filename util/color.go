@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ColorMode selects whether messages and results are printed with ANSI colors
+type ColorMode int
+
+const (
+	ColorAuto   ColorMode = iota // on terminals, unless NO_COLOR is set
+	ColorAlways                  // even when not printed to a terminal
+	ColorNever
+)
+
+var colorModes = map[string]ColorMode{"auto": ColorAuto, "always": ColorAlways, "never": ColorNever}
+
+// ParseColorMode returns the color mode of the given name.
+func ParseColorMode(name string) (ColorMode, error) {
+	if m, ok := colorModes[strings.ToLower(name)]; ok {
+		return m, nil
+	}
+	return ColorAuto, fmt.Errorf("unknown color mode \"%s\", supported modes are: always, auto, never", name)
+}
+
+// ANSI escape sequences of the colors used
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+	colorReset  = "\x1b[0m"
+)
+
+// colors of the kinds of messages that have one
+var kindColors = map[string]string{recordError: colorRed, recordWarning: colorYellow}
+
+// colors of the lines of a diff by their first character
+var diffColors = map[byte]string{'+': colorGreen, '-': colorRed, '~': colorYellow, '<': colorRed, '>': colorGreen}
+
+// SetColor sets whether messages and results are colored when printed to
+// ErrW and OutW, which must be set first.
+func (l *Logr) SetColor(mode ColorMode) *Logr {
+	useColor := func(w io.Writer) bool {
+		switch mode {
+		case ColorAlways:
+			return true
+		case ColorNever:
+			return false
+		}
+		return os.Getenv("NO_COLOR") == "" && isTerminal(w)
+	}
+	l.colorErr, l.colorOut = useColor(l.ErrW), useColor(l.OutW)
+	return l
+}
+
+// colorize returns text in the given color if w is colored, with the final
+// newline after the end of the color.
+func (l *Logr) colorize(w io.Writer, color, text string) string {
+	if color == "" || !(w == l.ErrW && l.colorErr || w == l.OutW && l.colorOut) {
+		return text
+	}
+	if strings.HasSuffix(text, "\n") {
+		return color + strings.TrimSuffix(text, "\n") + colorReset + "\n"
+	}
+	return color + text + colorReset
+}
+
+// Plan prints a message about a change that is planned, for example by a
+// dry run, at the level of Info, in cyan if colored.
+func (l *Logr) Plan(format string, args ...interface{}) {
+	l.print(LInfo, recordInfo, l.msgW(), colorCyan, format, args...)
+}
+
+// DiffLine prints a line of a diff to OutW, colored by its first character:
+// + and > in green, - and < in red, ~ in yellow.
+func (l *Logr) DiffLine(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	if text != "" {
+		text = l.colorize(l.OutW, diffColors[text[0]], text)
+	}
+	fmt.Fprint(l.OutW, text)
+}
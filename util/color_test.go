@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+// stubTerminal makes all writers terminals or not, undone by the returned function
+func stubTerminal(terminal bool) (undo func()) {
+	saved := isTerminal
+	isTerminal = func(io.Writer) bool { return terminal }
+	return func() { isTerminal = saved }
+}
+
+func TestParseColorMode(t *testing.T) {
+	mode, err := ParseColorMode("Always")
+	assert.Nil(t, err)
+	assert.Equal(t, ColorAlways, mode)
+	_, err = ParseColorMode("sometimes")
+	assert.Contains(t, err.Error(), `unknown color mode "sometimes"`)
+}
+
+func TestNoColorWhenNotTerminal(t *testing.T) {
+	log := NewBufferedLogr().SetColor(ColorAuto)
+	log.Err("failed\n")
+	log.Warn("careful\n")
+	log.Plan("Would create\n")
+	log.DiffLine("+ user %s\n", "anna")
+	assert.NotContains(t, log.ErrString(), "\x1b")
+	assert.NotContains(t, log.InfoString(), "\x1b")
+}
+
+func TestColorOnTerminal(t *testing.T) {
+	defer stubTerminal(true)()
+	log := NewBufferedLogr().SetColor(ColorAuto)
+	log.Err("failed\n")
+	log.Warn("careful\n")
+	log.Info("done\n")
+	log.Plan("Would create\n")
+	log.DiffLine("+ user %s\n", "anna")
+	log.DiffLine("- member %s\n", "olaf")
+	assert.Equal(t, "\x1b[31mfailed\x1b[0m\n\x1b[33mWARNING: careful\x1b[0m\n", log.ErrString())
+	assert.Equal(t, "done\n\x1b[36mWould create\x1b[0m\n\x1b[32m+ user anna\x1b[0m\n\x1b[31m- member olaf\x1b[0m\n",
+		log.InfoString())
+}
+
+func TestColorModes(t *testing.T) {
+	defer stubTerminal(true)()
+	defer os.Unsetenv("NO_COLOR")
+	os.Setenv("NO_COLOR", "1")
+	log := NewBufferedLogr().SetColor(ColorAuto)
+	log.Err("failed\n")
+	assert.Equal(t, "failed\n", log.ErrString())
+
+	log = NewBufferedLogr().SetColor(ColorAlways)
+	log.Err("failed\n")
+	assert.Equal(t, "\x1b[31mfailed\x1b[0m\n", log.ErrString())
+
+	os.Unsetenv("NO_COLOR")
+	log = NewBufferedLogr().SetColor(ColorNever)
+	log.Err("failed\n")
+	assert.Equal(t, "failed\n", log.ErrString())
+}
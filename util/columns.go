@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dateLayouts are the forms of the dates that results are sorted by as times.
+var dateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z0700", "2006-01-02T15:04:05", "2006-01-02"}
+
+// sortDate returns the time of a value that is a date, false if it is not.
+func sortDate(value interface{}) (time.Time, bool) {
+	if s, ok := value.(string); ok {
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// sortNumber returns the number of a value that is a number or a string of
+// one, false if it is not.
+func sortNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// lessValue orders values as results are sorted: numbers by value, dates by
+// time and anything else as strings that ignore case.
+func lessValue(a, b interface{}) bool {
+	if fa, ok := sortNumber(a); ok {
+		if fb, ok := sortNumber(b); ok {
+			return fa < fb
+		}
+	}
+	if ta, ok := sortDate(a); ok {
+		if tb, ok := sortDate(b); ok {
+			return ta.Before(tb)
+		}
+	}
+	return strings.ToLower(queryValueString(a)) < strings.ToLower(queryValueString(b))
+}
+
+// arrange returns results as they are printed with the --sort-by, --reverse
+// and --columns options: a list sorted by SortBy, reversed if Reverse, and if
+// columns is true each result as a map of the Columns to their values, nil
+// for a column the result does not have. Results are converted as for JSON
+// output so that paths select values by their JSON names.
+func (l *Logr) arrange(info interface{}, columns bool) interface{} {
+	if l.SortBy == "" && !l.Reverse && (!columns || len(l.Columns) == 0) {
+		return info
+	}
+	var generic interface{}
+	if content, err := json.Marshal(info); err != nil || json.Unmarshal(content, &generic) != nil {
+		generic = info
+	}
+	items, isList := generic.([]interface{})
+	if isList && l.SortBy != "" {
+		SortByPath(items, l.SortBy, l.Reverse)
+	} else if isList && l.Reverse {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if !columns || len(l.Columns) == 0 || generic == nil {
+		return generic
+	}
+	if !isList {
+		items = []interface{}{generic}
+	}
+	rows := make([]interface{}, len(items))
+	for i, item := range items {
+		row := make(map[string]interface{}, len(l.Columns))
+		for _, column := range l.Columns {
+			row[column], _ = lookupLabel(item, column)
+		}
+		rows[i] = row
+	}
+	if !isList {
+		return rows[0]
+	}
+	return rows
+}
+
+// printColumns prints results arranged in Columns as a table with a line
+// of column names and a line of values for each result.
+func (l *Logr) printColumns(title string, info interface{}) {
+	rows := csvRows(info)
+	fmt.Fprintf(l.OutW, "---- %s ----\n", title)
+	w := tabwriter.NewWriter(l.OutW, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(l.Columns, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(l.Columns))
+		for i, column := range l.Columns {
+			cells[i] = l.csvCell(row[column], nil)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+}
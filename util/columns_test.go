@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const columnUsers = `[{"userName": "sven", "meta": {"created": "2016-02-01T10:00:00Z"}, "loginCount": "9"},
+	{"userName": "Anna", "meta": {"created": "2015-12-31T23:00:00-05:00"}, "loginCount": "10",
+	"emails": [{"value": "anna@example.com"}]},
+	{"userName": "olaf", "meta": {"created": "2016-01-01T00:00:00Z"}, "loginCount": 2}]`
+
+func TestPPWithColumns(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Columns = []string{"userName", "emails.0.value", "title"}
+	log.PP("Users", queryData(t, columnUsers), "id")
+	assert.Equal(t, "---- Users ----\n"+
+		"userName  emails.0.value    title\n"+
+		"sven                        \n"+
+		"Anna      anna@example.com  \n"+
+		"olaf                        \n", log.InfoString())
+}
+
+func TestCsvFormatUsesColumnsAsHeaders(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format, log.VerboseOn = FCsv, true
+	log.Columns = []string{"emails", "userName", "title"}
+	log.PP("Users", queryData(t, columnUsers), "id")
+	assert.Equal(t, "emails,userName,title\n,sven,\n\"[{\"\"value\"\":\"\"anna@example.com\"\"}]\",Anna,\n,olaf,\n",
+		log.InfoString())
+}
+
+func TestJsonFormatWithColumns(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format, log.Columns = FJson, []string{"userName", "title"}
+	log.PP("User", queryData(t, `{"userName": "olaf", "id": "1"}`))
+	assert.JSONEq(t, `{"userName": "olaf", "title": null}`, log.InfoString())
+}
+
+func TestPPSortedByStringNumberAndDate(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Query, _ = ParseQuery("userName")
+	for path, expected := range map[string]string{"userName": "Anna\nolaf\nsven\n",
+		"loginCount": "olaf\nsven\nAnna\n", "meta.created": "olaf\nAnna\nsven\n"} {
+		log.ClearBuffers().SortBy, log.Reverse = path, false
+		log.PP("Users", queryData(t, columnUsers))
+		assert.Equal(t, expected, log.InfoString(), path)
+		log.ClearBuffers().Reverse = true
+		log.PP("Users", queryData(t, columnUsers))
+		assert.Equal(t, reverseLines(expected), log.InfoString(), path)
+	}
+}
+
+func TestPPReversedWithoutSortBy(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Query, log.Reverse = &Query{path: []string{"userName"}}, true
+	log.PP("Users", queryData(t, columnUsers))
+	assert.Equal(t, "olaf\nAnna\nsven\n", log.InfoString())
+}
+
+func reverseLines(text string) (reversed string) {
+	for _, line := range strings.SplitAfter(text, "\n") {
+		reversed = line + reversed
+	}
+	return
+}
@@ -43,6 +43,14 @@ type Config struct {
 	Targets       map[string]map[string]string
 	fileName      string
 	Log           *Logr `yaml:"-"`
+
+	// savedTarget is the current target in the file while another target is used for one command
+	savedTarget string
+	overridden  bool
+
+	// credentials keeps the secretOptions of targets, they are in the file if nil
+	credentials   CredentialStore
+	secretOptions []string
 }
 
 func GetYamlFile(filename string, output interface{}) error {
@@ -109,7 +117,11 @@ func (cfg *Config) Init(log *Logr, fileName string) bool {
 }
 
 func (cfg *Config) Save() bool {
-	if err := PutYamlFile(cfg.fileName, cfg); err != nil {
+	saved := *cfg
+	if cfg.overridden {
+		saved.CurrentTarget = cfg.savedTarget
+	}
+	if err := PutYamlFile(cfg.fileName, &saved); err != nil {
 		cfg.Log.Err("could not write config file %s, error: %v\n", cfg.fileName, err)
 		return false
 	}
@@ -117,7 +129,10 @@ func (cfg *Config) Save() bool {
 }
 
 func (cfg *Config) Clear() {
-	cfg.CurrentTarget = NoTarget
+	for name := range cfg.Targets {
+		cfg.deleteSecrets(name)
+	}
+	cfg.CurrentTarget, cfg.overridden = NoTarget, false
 	cfg.Targets = nil
 	if cfg.Save() {
 		cfg.Log.Info("all targets deleted.\n")
@@ -137,23 +152,82 @@ func (cfg *Config) ClearTarget(name string) {
 	if cfg.CurrentTarget == name {
 		cfg.CurrentTarget = NoTarget
 	}
+	if cfg.savedTarget == name {
+		cfg.savedTarget = NoTarget
+	}
+	cfg.deleteSecrets(name)
 	delete(cfg.Targets, name)
 	if cfg.Save() {
 		cfg.Log.Info("deleted target %s.\n", name)
 	}
 }
 
+// UseTarget makes the named target current for this run only, the current
+// target saved in the config file does not change.
+func (cfg *Config) UseTarget(name string) error {
+	if !cfg.hasTarget(name) {
+		if len(cfg.Targets) == 0 {
+			return fmt.Errorf("unknown target \"%s\", no targets are configured yet", name)
+		}
+		return fmt.Errorf("unknown target \"%s\", targets are: %s", name, strings.Join(cfg.TargetNames(), ", "))
+	}
+	if !cfg.overridden {
+		cfg.savedTarget, cfg.overridden = cfg.CurrentTarget, true
+	}
+	cfg.CurrentTarget = name
+	return nil
+}
+
+// TargetNames returns the names of the configured targets in order.
+func (cfg *Config) TargetNames() []string {
+	var names []string
+	for k := range cfg.Targets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (cfg *Config) hasTarget(name string) bool {
 	_, ok := cfg.Targets[name]
 	return ok
 }
 
+// KeepSecrets keeps the given options of all targets in the credential
+// store rather than in the config file, or in the file if store is nil.
+func (cfg *Config) KeepSecrets(store CredentialStore, options ...string) {
+	cfg.credentials, cfg.secretOptions = store, options
+}
+
+func (cfg *Config) inStore(name string) bool {
+	return cfg.credentials != nil && HasString(name, cfg.secretOptions)
+}
+
+// Option returns an option of the current target. Secret options are read
+// from the credential store, or from the file if they were saved there before.
 func (cfg *Config) Option(name string) string {
+	if cfg.inStore(name) {
+		if value, err := cfg.credentials.Get(cfg.CurrentTarget, name); err != nil {
+			cfg.Log.Warn("could not read %s of target %s from the keyring: %v\n", name, cfg.CurrentTarget, err)
+		} else if value != "" {
+			return value
+		}
+	}
 	return cfg.Targets[cfg.CurrentTarget][name]
 }
 
+// WithOptions sets options of the current target. Secret options that
+// cannot be saved in the credential store are kept in the file.
 func (cfg *Config) WithOptions(options map[string]string) *Config {
 	for k, v := range options {
+		if cfg.inStore(k) {
+			if err := cfg.credentials.Set(cfg.CurrentTarget, k, v); err == nil {
+				delete(cfg.Targets[cfg.CurrentTarget], k)
+				continue
+			} else {
+				cfg.Log.Warn("could not save %s in the keyring, it is saved in the config file: %v\n", k, err)
+			}
+		}
 		cfg.Targets[cfg.CurrentTarget][k] = v
 	}
 	return cfg
@@ -161,11 +235,46 @@ func (cfg *Config) WithOptions(options map[string]string) *Config {
 
 func (cfg *Config) WithoutOptions(optionKeys ...string) *Config {
 	for _, k := range optionKeys {
+		if cfg.inStore(k) {
+			if err := cfg.credentials.Delete(cfg.CurrentTarget, k); err != nil {
+				cfg.Log.Warn("could not delete %s of target %s from the keyring: %v\n", k, cfg.CurrentTarget, err)
+			}
+		}
 		delete(cfg.Targets[cfg.CurrentTarget], k)
 	}
 	return cfg
 }
 
+// deleteSecrets deletes the secret options of the named target from the
+// credential store and from the targets to save in the file. It returns
+// false if some could not be deleted from the credential store.
+func (cfg *Config) deleteSecrets(target string) bool {
+	ok := true
+	for _, k := range cfg.secretOptions {
+		if cfg.credentials != nil {
+			if err := cfg.credentials.Delete(target, k); err != nil {
+				cfg.Log.Err("could not delete %s of target %s from the keyring: %v\n", k, target, err)
+				ok = false
+			}
+		}
+		delete(cfg.Targets[target], k)
+	}
+	return ok
+}
+
+// ClearCredentials deletes the secret options of the named target, or of
+// the current target if name is empty.
+func (cfg *Config) ClearCredentials(name string) {
+	name = StringOrDefault(name, cfg.CurrentTarget)
+	if name == NoTarget {
+		cfg.Log.Err("no target set\n")
+	} else if !cfg.hasTarget(name) {
+		cfg.Log.Err("unknown target \"%s\"\n", name)
+	} else if cfg.deleteSecrets(name) && cfg.Save() {
+		cfg.Log.Info("credentials of target %s deleted.\n", name)
+	}
+}
+
 func ensureFullURL(url string) string {
 	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
 		return url
@@ -226,6 +335,7 @@ func (cfg *Config) SetTarget(url, name string, checkURL func(*Config) bool) {
 		return
 	}
 
+	cfg.overridden = false
 	if tgt := cfg.findTarget(url, name); tgt != NoTarget {
 		// found existing target
 		cfg.CurrentTarget = tgt
@@ -261,12 +371,7 @@ func (cfg *Config) SetTarget(url, name string, checkURL func(*Config) bool) {
 }
 
 func (cfg *Config) ListTargets() {
-	var keys []string
-	for k := range cfg.Targets {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	for _, k := range keys {
+	for _, k := range cfg.TargetNames() {
 		cfg.Log.Info("name: %s\nhost: %s\n\n", k, cfg.Targets[k][HostOption])
 	}
 	cfg.PrintTarget("current")
@@ -210,3 +210,113 @@ func TestCanDetectTenantInPathMode(t *testing.T) {
 	assert.Contains(t, cfg.Log.InfoString(), "Mode detected: tenant-in-path")
 	assert.False(t, cfg.IsTenantInHost(), "host mode should be tenant in path")
 }
+
+func TestUseTargetDoesNotChangeSavedTarget(t *testing.T) {
+	cfg := cfgTestSetup(t)
+	defer os.Remove(cfg.fileName)
+	require.Nil(t, cfg.UseTarget("staging"))
+	assert.Equal(t, "https://earth.example.com", cfg.Option(HostOption))
+	require.True(t, cfg.WithOptions(map[string]string{"access_token": "tok"}).Save())
+	saved := &Config{}
+	require.True(t, saved.Init(NewBufferedLogr(), cfg.fileName))
+	assert.Equal(t, "familyCountDown", saved.CurrentTarget)
+	assert.Equal(t, "tok", saved.Targets["staging"]["access_token"])
+}
+
+func TestUseUnknownTarget(t *testing.T) {
+	cfg := cfgTestSetup(t)
+	defer os.Remove(cfg.fileName)
+	assert.EqualError(t, cfg.UseTarget("prod"),
+		`unknown target "prod", targets are: 1, beautyOnTheBeach, familyCountDown, staging`)
+	assert.Equal(t, "familyCountDown", cfg.CurrentTarget)
+}
+
+func TestUseTargetWithNoTargets(t *testing.T) {
+	cfg := &Config{}
+	require.True(t, cfg.Init(NewBufferedLogr(), filepath.Join(os.TempDir(), "priam-no-such-config")))
+	assert.EqualError(t, cfg.UseTarget("prod"), `unknown target "prod", no targets are configured yet`)
+}
+
+// memStore is a credential store in memory, that fails if err is set
+type memStore struct {
+	secrets map[string]string
+	err     error
+}
+
+func (m *memStore) Get(target, key string) (string, error) {
+	return m.secrets[keyringAccount(target, key)], m.err
+}
+
+func (m *memStore) Set(target, key, value string) error {
+	if m.err == nil {
+		m.secrets[keyringAccount(target, key)] = value
+	}
+	return m.err
+}
+
+func (m *memStore) Delete(target, key string) error {
+	if m.err == nil {
+		delete(m.secrets, keyringAccount(target, key))
+	}
+	return m.err
+}
+
+func TestSecretOptionsAreKeptInCredentialStore(t *testing.T) {
+	cfg, store := cfgTestSetup(t), &memStore{secrets: map[string]string{}}
+	defer os.Remove(cfg.fileName)
+	cfg.KeepSecrets(store, "accesstoken")
+	require.True(t, cfg.WithOptions(map[string]string{"accesstoken": "sesame", "accesstokentype": "Bearer"}).Save())
+	assert.Equal(t, "sesame", store.secrets["familyCountDown/accesstoken"])
+	assert.Equal(t, "sesame", cfg.Option("accesstoken"))
+	assert.NotContains(t, GetTempFile(t, cfg.fileName), "sesame")
+	assert.Contains(t, GetTempFile(t, cfg.fileName), "accesstokentype: Bearer")
+
+	cfg.WithoutOptions("accesstoken")
+	assert.Empty(t, store.secrets)
+	assert.Empty(t, cfg.Option("accesstoken"))
+}
+
+func TestSecretOptionsAreReadFromFileIfNotInCredentialStore(t *testing.T) {
+	cfg := cfgTestSetup(t)
+	defer os.Remove(cfg.fileName)
+	cfg.WithOptions(map[string]string{"accesstoken": "sesame"})
+	cfg.KeepSecrets(&memStore{secrets: map[string]string{}}, "accesstoken")
+	assert.Equal(t, "sesame", cfg.Option("accesstoken"))
+}
+
+func TestSecretOptionsAreKeptInFileIfCredentialStoreFails(t *testing.T) {
+	cfg := cfgTestSetup(t)
+	defer os.Remove(cfg.fileName)
+	cfg.KeepSecrets(&memStore{err: errors.New("locked")}, "accesstoken")
+	require.True(t, cfg.WithOptions(map[string]string{"accesstoken": "sesame"}).Save())
+	assert.Contains(t, GetTempFile(t, cfg.fileName), "accesstoken: sesame")
+	assert.Contains(t, cfg.Log.ErrString(), "WARNING: could not save accesstoken in the keyring")
+	assert.Equal(t, "sesame", cfg.Option("accesstoken"))
+	assert.Equal(t, ExitOK, cfg.Log.ExitCode())
+}
+
+func TestClearCredentials(t *testing.T) {
+	cfg, store := cfgTestSetup(t), &memStore{secrets: map[string]string{"staging/accesstoken": "sesame"}}
+	defer os.Remove(cfg.fileName)
+	cfg.KeepSecrets(store, "accesstoken", "refreshtoken")
+	cfg.Targets["staging"]["refreshtoken"] = "open"
+	cfg.ClearCredentials("staging")
+	assert.Contains(t, cfg.Log.InfoString(), "credentials of target staging deleted.")
+	assert.Empty(t, store.secrets)
+	assert.NotContains(t, GetTempFile(t, cfg.fileName), "open")
+}
+
+func TestClearCredentialsOfUnknownTarget(t *testing.T) {
+	cfg := cfgTestSetup(t)
+	defer os.Remove(cfg.fileName)
+	cfg.ClearCredentials("prod")
+	assert.Contains(t, cfg.Log.ErrString(), `unknown target "prod"`)
+}
+
+func TestDeleteTargetDeletesItsCredentials(t *testing.T) {
+	cfg, store := cfgTestSetup(t), &memStore{secrets: map[string]string{"1/accesstoken": "sesame"}}
+	defer os.Remove(cfg.fileName)
+	cfg.KeepSecrets(store, "accesstoken")
+	cfg.DeleteTarget("1", "")
+	assert.Empty(t, store.secrets)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Exit codes of commands
+const (
+	ExitOK       = 0 // success
+	ExitError    = 1 // generic error
+	ExitNotFound = 2 // a resource was not found
+	ExitPartial  = 3 // some operations of a bulk command failed
+	// the command was interrupted, the code of the shell for SIGINT
+	ExitInterrupted = 130
+)
+
+// NotFoundError is returned when a resource does not exist.
+type NotFoundError struct {
+	msg string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.msg
+}
+
+// NotFound returns a NotFoundError with the formatted message.
+func NotFound(format string, args ...interface{}) error {
+	return &NotFoundError{fmt.Sprintf(format, args...)}
+}
+
+// StatusError is returned by requests that get a response with an error
+// status, with the method and path of the request, the ID it was sent with
+// and the trace ID of the server if the response has one. Hint may say why
+// a request was not authorized, see SetAuthorizationHint, and Cause why the
+// access token of a request refused with 401 could not be renewed.
+type StatusError struct {
+	Code               int
+	Method, Path       string
+	RequestID, TraceID string
+	Hint               string
+	Cause              error
+	msg                string
+}
+
+func (e *StatusError) Error() string {
+	msg := withRequestIDs(e.msg, requestIDs(e.RequestID, e.TraceID))
+	var lines []string
+	if e.Cause != nil {
+		lines = append(lines, e.Cause.Error())
+	}
+	if e.Hint != "" {
+		lines = append(lines, "hint: "+e.Hint)
+	}
+	if len(lines) > 0 && !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	return msg + strings.Join(lines, "\n")
+}
+
+// UncertainError is returned when a request that is not safe to send again
+// was sent but got no response, so it may or may not have been applied.
+type UncertainError struct {
+	Method, URL string
+	Err         error
+	RequestID   string
+}
+
+func (e *UncertainError) Error() string {
+	return fmt.Sprintf("%v\nthe %s request may or may not have been applied, check before sending it again",
+		withRequestIDs(e.Err.Error(), requestIDs(e.RequestID, "")), e.Method)
+}
+
+func (e *UncertainError) Unwrap() error {
+	return e.Err
+}
+
+// errorBody has the fields of the error responses of the tenant: SCIM 1.1
+// and 2.0 errors, vIDM errors, OAuth2 errors, and the failed operations of bulk
+// responses. Keys are matched without case so "Errors" and "errors" are alike.
+type errorBody struct {
+	Detail, Message, Description string
+	OAuthError                   string `json:"error"`
+	OAuthDescription             string `json:"error_description"`
+	Errors, Operations           []errorBody
+}
+
+func (b *errorBody) messages() (msgs []string) {
+	oauthMsg := b.OAuthError
+	if b.OAuthError != "" && b.OAuthDescription != "" {
+		oauthMsg = b.OAuthError + ": " + b.OAuthDescription
+	}
+	for _, msg := range []string{b.Detail, b.Message, b.Description, oauthMsg} {
+		if msg = strings.TrimSpace(msg); msg != "" {
+			msgs = append(msgs, msg)
+			break
+		}
+	}
+	for _, nested := range append(b.Errors, b.Operations...) {
+		for _, msg := range nested.messages() {
+			if !HasString(msg, msgs) {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	return
+}
+
+// errorDetail returns the messages of a JSON error body, or "" if the body
+// is not an error body that we know.
+func errorDetail(body []byte) string {
+	parsed := errorBody{}
+	if json.Unmarshal(body, &parsed) != nil {
+		return ""
+	}
+	return strings.Join(parsed.messages(), "; ")
+}
+
+// statusError returns a StatusError with the status and the messages of the
+// error body, or the formatted body if it has no messages.
+func statusError(resp *http.Response, body []byte, ls LogStyle) *StatusError {
+	if detail := errorDetail(body); detail != "" {
+		return &StatusError{Code: resp.StatusCode, msg: fmt.Sprintf("%s: %s", resp.Status, detail)}
+	}
+	return &StatusError{Code: resp.StatusCode, msg: fmt.Sprintf("%s\n%s\n", resp.Status,
+		formatReply(ls, resp.Header.Get("Content-Type"), body))}
+}
+
+// snippetLength is how many bytes of an unexpected body are quoted in errors
+const snippetLength = 200
+
+// BodySnippet returns the start of a body on one line, without secrets, to
+// quote in errors about responses that are not what was expected.
+func BodySnippet(body []byte) string {
+	s := strings.Join(strings.Fields(redactText(string(body))), " ")
+	if len(s) > snippetLength {
+		return s[:snippetLength] + "..."
+	}
+	return s
+}
+
+// jsonContent returns true if a response with the given Content-Type may be
+// JSON: JSON media types, and plain text or none from servers that do not say
+func jsonContent(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/plain" || mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeJSON decodes the body of a response, with an error that quotes the
+// body if it is not the expected JSON, such as the HTML error page of a proxy
+// returned with a 200 status.
+func decodeJSON(resp *http.Response, body []byte, output interface{}) error {
+	if contentType := resp.Header.Get("Content-Type"); !jsonContent(contentType) {
+		return fmt.Errorf("unexpected response: expected JSON but got %s: %s", contentType, BodySnippet(body))
+	}
+	if err := json.Unmarshal(body, output); err != nil {
+		return fmt.Errorf("unexpected response: %v: %s", err, BodySnippet(body))
+	}
+	return nil
+}
+
+// IsNotFound returns true if err means that a resource does not exist,
+// either from a NotFoundError or a 404 response.
+func IsNotFound(err error) bool {
+	var notFound *NotFoundError
+	var status *StatusError
+	return errors.As(err, &notFound) || errors.As(err, &status) && status.Code == http.StatusNotFound
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func errorOfRequest(t *testing.T, status int, contentType, body string) error {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	newRequestID = func() string { return "req-1" }
+	defer func() { newRequestID = uuid.New }()
+	return NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Request("GET", "/fail", nil, nil)
+}
+
+func TestErrorMessagesOfErrorBodies(t *testing.T) {
+	for _, tc := range []struct {
+		status         int
+		body, expected string
+	}{
+		{400, `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:Error"], "scimType": "invalidValue",
+			"detail": "attribute userName is required", "status": "400"}`,
+			"400 Bad Request: attribute userName is required"},
+		{409, `{"Errors": [{"code": "409", "description": "User name is already taken"}]}`,
+			"409 Conflict: User name is already taken"},
+		{404, `{"errors": [{"code": "user.not.found", "message": "User not found"},
+			{"code": "user.not.found", "message": "User not found"}]}`, "404 Not Found: User not found"},
+		{400, `{"operations": [{"method": "POST", "status": "400", "errors": [{"message": "Invalid subject"}]},
+			{"method": "POST", "status": "409", "errors": [{"message": "Entitlement exists"}]}]}`,
+			"400 Bad Request: Invalid subject; Entitlement exists"},
+		{401, `{"error": "invalid_token", "error_description": "token expired"}`,
+			"401 Unauthorized: invalid_token: token expired"},
+		{500, `{"message": "Internal error", "errors": [{"message": "database unavailable"}]}`,
+			"500 Internal Server Error: Internal error; database unavailable"},
+	} {
+		err := errorOfRequest(t, tc.status, "application/json", tc.body)
+		assert.EqualError(t, err, tc.expected+" (request id req-1)")
+		assert.Equal(t, tc.status, err.(*StatusError).Code)
+	}
+}
+
+func TestErrorMessageFallsBackToBody(t *testing.T) {
+	assert.EqualError(t, errorOfRequest(t, 404, "text/html", "<html>no such page</html>"),
+		"404 Not Found\n<html>no such page</html>\n(request id req-1)\n")
+	assert.EqualError(t, errorOfRequest(t, 500, "application/json", `{"id": 3}`),
+		"500 Internal Server Error\nid: 3\n\n(request id req-1)\n")
+}
+
+func TestUnexpectedResponsesAreErrors(t *testing.T) {
+	for _, tc := range []struct {
+		contentType, body, expected string
+	}{
+		{"text/html", "<html>\n  <body>Please sign in to the proxy</body>\n</html>",
+			"unexpected response: expected JSON but got text/html: <html> <body>Please sign in to the proxy</body> </html>"},
+		{"application/json", "<html>sign in</html>",
+			"unexpected response: invalid character '<' looking for beginning of value: <html>sign in</html>"},
+		{"application/json", `{"id": 5}`, "unexpected response: json: cannot unmarshal number into Go struct field " +
+			".id of type string: {\"id\": 5}"},
+		{"application/json", `{"id": "1", "password": "changeme"`, "unexpected response: unexpected end of JSON " +
+			`input: {"id": "1", "password": "[REDACTED]"`},
+		{"", `["a", "b"]`, "unexpected response: json: cannot unmarshal array into Go value of type " +
+			`struct { Id string }: ["a", "b"]`},
+		{"text/plain", `{"id": "1"}`, ""},
+		{"application/vnd.vmware.horizon.manager.user+json", `{"id": "1"}`, ""},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header()["Content-Type"] = []string{tc.contentType}
+			io.WriteString(w, tc.body)
+		}))
+		var output struct{ Id string }
+		err := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Request("GET", "/", nil, &output)
+		srv.Close()
+		if tc.expected == "" {
+			assert.Nil(t, err)
+			assert.Equal(t, "1", output.Id)
+		} else {
+			assert.EqualError(t, err, tc.expected)
+		}
+	}
+}
+
+func TestBodySnippetIsShortWithoutSecrets(t *testing.T) {
+	assert.Equal(t, `{"userName": "joe", "password": "[REDACTED]"}`,
+		BodySnippet([]byte("{\"userName\": \"joe\",\n  \"password\": \"changeme\"}")))
+	long := BodySnippet([]byte("<html>" + strings.Repeat("x", 300) + "</html>"))
+	assert.Len(t, long, snippetLength+3)
+	assert.True(t, strings.HasSuffix(long, "..."))
+}
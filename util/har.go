@@ -0,0 +1,300 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HarLog records the requests of a context and its copies with their
+// responses, in the HAR 1.2 format read by browsers and support tools.
+// Secrets are redacted as in traces, and bodies are cut at a limit.
+type HarLog struct {
+	mutex     sync.Mutex
+	creator   harCreator
+	bodyLimit int
+	entries   []*harEntry
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harEntry is a request and its response, with the times of the steps of
+// the exchange that are set by the hooks of the transport
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Error           string      `json:"_error,omitempty"`
+
+	started, gotConn, dnsStart, dnsDone, connectStart, connectDone time.Time
+	tlsStart, tlsDone, wrote, firstByte, done                      time.Time
+}
+
+type harEntryKey struct{}
+
+// NewHarLog returns a log of requests and responses that names the given
+// program as creator. At most bodyLimit bytes of each body are recorded, no
+// limit if 0.
+func NewHarLog(name, version string, bodyLimit int) *HarLog {
+	return &HarLog{creator: harCreator{name, version}, bodyLimit: bodyLimit}
+}
+
+// SetHar records the requests sent with this context and its copies, and
+// their responses, in the given log, or nothing if it is nil.
+func (ctx *HttpContext) SetHar(har *HarLog) *HttpContext {
+	ctx.har = har
+	return ctx
+}
+
+// start adds an entry for a request about to be sent and returns a context
+// with hooks that set the times of the exchange.
+func (h *HarLog) start(reqCtx context.Context) context.Context {
+	if h == nil {
+		return reqCtx
+	}
+	e := &harEntry{started: now()}
+	h.mutex.Lock()
+	h.entries = append(h.entries, e)
+	h.mutex.Unlock()
+	mark := func(t *time.Time) {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		*t = now()
+	}
+	reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { mark(&e.gotConn) },
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&e.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&e.dnsDone) },
+		ConnectStart:         func(string, string) { mark(&e.connectStart) },
+		ConnectDone:          func(string, string, error) { mark(&e.connectDone) },
+		TLSHandshakeStart:    func() { mark(&e.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&e.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&e.wrote) },
+		GotFirstResponseByte: func() { mark(&e.firstByte) },
+	})
+	return context.WithValue(reqCtx, harEntryKey{}, e)
+}
+
+func harEntryOf(req *http.Request) *harEntry {
+	e, _ := req.Context().Value(harEntryKey{}).(*harEntry)
+	return e
+}
+
+func harHeaders(hdrs http.Header) []harNameValue {
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := []harNameValue{}
+	for _, k := range names {
+		for _, v := range hdrs[k] {
+			list = append(list, harNameValue{k, redactHeader(k, v)})
+		}
+	}
+	return list
+}
+
+// harBody returns a body with secrets redacted and cut at the limit of the
+// log, with a comment that says how much was cut
+func (h *HarLog) harBody(contentType string, body []byte) (text, comment string) {
+	text = redactBody(contentType, body)
+	if h.bodyLimit > 0 && len(text) > h.bodyLimit {
+		comment = fmt.Sprintf("truncated, %d more bytes not recorded", len(text)-h.bodyLimit)
+		text = text[:h.bodyLimit]
+	}
+	return
+}
+
+// sent records a request and the status and headers of its response, or
+// the error if there is no response.
+func (h *HarLog) sent(req *http.Request, body []byte, resp *http.Response, err error) {
+	if h == nil {
+		return
+	}
+	e := harEntryOf(req)
+	if e == nil {
+		return
+	}
+	u := redactURL(req.URL.String())
+	query := []harNameValue{}
+	if parsed, perr := url.Parse(u); perr == nil {
+		for k, vals := range parsed.Query() {
+			for _, v := range vals {
+				query = append(query, harNameValue{k, v})
+			}
+		}
+		sort.Slice(query, func(i, j int) bool { return query[i].Name < query[j].Name })
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e.Request = harRequest{Method: req.Method, URL: u, HTTPVersion: req.Proto, Cookies: []harNameValue{},
+		Headers: harHeaders(req.Header), QueryString: query, HeadersSize: -1, BodySize: len(body)}
+	if len(body) > 0 {
+		contentType := req.Header.Get("Content-Type")
+		text, comment := h.harBody(contentType, body)
+		e.Request.PostData = &harPostData{MimeType: contentType, Text: text, Comment: comment}
+	}
+	e.Response = harResponse{Cookies: []harNameValue{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+	if err != nil {
+		e.Error, e.done = err.Error(), now()
+		return
+	}
+	e.Response.Status, e.Response.StatusText = resp.StatusCode, http.StatusText(resp.StatusCode)
+	e.Response.HTTPVersion, e.Response.Headers = resp.Proto, harHeaders(resp.Header)
+	e.Response.Content.MimeType = resp.Header.Get("Content-Type")
+	e.done = now()
+}
+
+// received records the body of a response once it is read
+func (h *HarLog) received(resp *http.Response, body []byte) {
+	if h == nil || resp.Request == nil {
+		return
+	}
+	e := harEntryOf(resp.Request)
+	if e == nil {
+		return
+	}
+	text, comment := h.harBody(resp.Header.Get("Content-Type"), body)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e.Response.Content.Size, e.Response.Content.Text, e.Response.Content.Comment = len(body), text, comment
+	e.Response.BodySize, e.done = len(body), now()
+}
+
+// millis returns the time from start to end in milliseconds, or -1 if
+// either did not happen
+func millis(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return -1
+	}
+	return float64(end.Sub(start)) / float64(time.Millisecond)
+}
+
+// timings sets the timings of an entry from the times of its steps. Steps
+// that did not happen, such as DNS for a connection that was reused, are -1
+// for those that are optional in HAR and 0 otherwise.
+func (e *harEntry) timings() {
+	t := harTimings{DNS: millis(e.dnsStart, e.dnsDone), Connect: millis(e.connectStart, e.connectDone),
+		SSL: millis(e.tlsStart, e.tlsDone), Blocked: millis(e.started, e.gotConn)}
+	if t.Blocked >= 0 {
+		// time blocked is the time to get a connection without opening it
+		for _, d := range []float64{t.DNS, t.Connect, t.SSL} {
+			if d > 0 {
+				t.Blocked -= d
+			}
+		}
+		if t.Blocked < 0 {
+			t.Blocked = 0
+		}
+	}
+	nonNegative := func(d float64) float64 {
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+	t.Send, t.Wait = nonNegative(millis(e.gotConn, e.wrote)), nonNegative(millis(e.wrote, e.firstByte))
+	t.Receive = nonNegative(millis(e.firstByte, e.done))
+	e.Timings, e.Time = t, nonNegative(millis(e.started, e.done))
+	e.StartedDateTime = e.started.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// WriteFile writes the requests recorded so far to the named file
+func (h *HarLog) WriteFile(fileName string) error {
+	h.mutex.Lock()
+	for _, e := range h.entries {
+		e.timings()
+	}
+	content, err := json.MarshalIndent(map[string]interface{}{"log": map[string]interface{}{
+		"version": "1.2", "creator": h.creator, "entries": h.entries}}, "", "  ")
+	h.mutex.Unlock()
+	if err == nil {
+		err = ioutil.WriteFile(fileName, append(content, '\n'), 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write HAR file %s: %v", fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type harFile struct {
+	Log struct {
+		Version string
+		Creator harCreator
+		Entries []harEntry
+	}
+}
+
+func readHarFile(t *testing.T, fileName string) harFile {
+	var har harFile
+	require.Nil(t, json.Unmarshal([]byte(GetTempFile(t, fileName)), &har))
+	return har
+}
+
+func TestHarRecordsRequestsWithoutSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"id": "1", "userName": "joe", "description": "a long description of the user"}`))
+	}))
+	defer srv.Close()
+	harFile := WriteTempFile(t, "")
+	defer CleanupTempFile(harFile)
+	har := NewHarLog("priam", "1.0.0", 40)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetHar(har)
+	ctx.headers["Authorization"] = "Bearer secret-token"
+	assert.Nil(t, ctx.ContentType("json").Request("POST", "scim/Users?access_token=abc&count=2",
+		map[string]string{"password": "changeme"}, nil))
+	require.Nil(t, har.WriteFile(harFile.Name()))
+
+	log := readHarFile(t, harFile.Name()).Log
+	assert.Equal(t, "1.2", log.Version)
+	assert.Equal(t, harCreator{"priam", "1.0.0"}, log.Creator)
+	require.Len(t, log.Entries, 1)
+	e := log.Entries[0]
+	assert.Equal(t, "POST", e.Request.Method)
+	assert.Equal(t, srv.URL+"/scim/Users?access_token=%5BREDACTED%5D&count=2", e.Request.URL)
+	assert.Equal(t, []harNameValue{{"access_token", redacted}, {"count", "2"}}, e.Request.QueryString)
+	assert.Contains(t, e.Request.Headers, harNameValue{"Authorization", "Bearer " + redacted})
+	assert.Contains(t, e.Request.PostData.Text, `"password": "[REDACTED]"`)
+	assert.NotContains(t, GetTempFile(t, harFile.Name()), "secret-token")
+	assert.NotContains(t, GetTempFile(t, harFile.Name()), "changeme")
+	assert.Equal(t, 201, e.Response.Status)
+	assert.Equal(t, "Created", e.Response.StatusText)
+	assert.Equal(t, "application/json", e.Response.Content.MimeType)
+	assert.Len(t, e.Response.Content.Text, 40)
+	assert.Regexp(t, `^truncated, \d+ more bytes not recorded$`, e.Response.Content.Comment)
+	assert.True(t, e.Time >= 0)
+	assert.True(t, e.Timings.Wait >= 0)
+	assert.NotEmpty(t, e.StartedDateTime)
+}
+
+func TestHarRecordsFailedRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+	harFile := WriteTempFile(t, "")
+	defer CleanupTempFile(harFile)
+	har := NewHarLog("priam", "1.0.0", 0)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetHar(har)
+	ctx.MaxAttempts = 1
+	assert.NotNil(t, ctx.Request("GET", "health", nil, nil))
+	require.Nil(t, har.WriteFile(harFile.Name()))
+	entries := readHarFile(t, harFile.Name()).Log.Entries
+	require.Len(t, entries, 1)
+	assert.Equal(t, 0, entries[0].Response.Status)
+	assert.Contains(t, entries[0].Error, "connection refused")
+}
@@ -17,7 +17,7 @@ package util
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -25,12 +25,22 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptrace"
 	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// HttpContext sends requests to a tenant. A context is not safe for
+// concurrent use, since fluent calls such as Accept, ContentType and Header
+// set the headers of its next request: goroutines that send requests at the
+// same time must each use their own copy made with Clone. The copies share
+// what is safe to share, such as the log, the caches of IDs, values and
+// responses, the rate limit, the statistics and the renewal of the access
+// token.
 type HttpContext struct {
 	Log     *Logr
 	HostURL string
@@ -47,16 +57,72 @@ type HttpContext struct {
 	 * For example: "application/vnd.vmware.horizon.manager." + shortType + "+json"
 	 */
 	baseMediaType string
-	headers       map[string]string
+	headers       map[string]string // sent with every request, such as Authorization
+	reqHeaders    map[string]string // sent with the next request only, see Header
 	client        http.Client
+	ids           *idCache
+
+	// MaxAttempts is how many times a request that fails with a transient
+	// error is tried, see canRetry for which requests are retried.
+	MaxAttempts int
+	idempotent  bool
+	check       func() (bool, error) // see RetryChecked
+
+	// Timeout is how long each request may take, no limit if 0.
+	Timeout     time.Duration
+	cmdContext  context.Context
+	stopContext context.Context
+
+	// TraceBodyLimit is how many bytes of each body are traced, no limit if 0.
+	TraceBodyLimit int
+
+	// limiter spaces the requests of the context and its copies, see SetRate
+	limiter *rateLimiter
+
+	// cache remembers the responses of GET requests, see SetCache
+	cache *ResponseCache
+
+	// har records the requests and responses, see SetHar
+	har *HarLog
+
+	// stats counts the requests of the context and its copies, see SetStats
+	stats *RequestStats
+
+	// audit records the requests that may change the tenant, see SetAudit
+	audit *auditLog
+
+	// TargetName is printed before the first request that may change
+	// something, so that it is clear which tenant is changed, or when a
+	// command that changes the tenant starts, see AnnounceTarget.
+	TargetName string
+	announced  bool
+
+	// Principal and Client are who the access token was issued to and the
+	// OAuth2 client it was issued by, if known, as printed and audited.
+	Principal, Client string
+
+	tokenExpiry time.Time
+	renewal     *tokenRenewal
+	authHint    func(ctx *HttpContext, path string, code int) string // see SetAuthorizationHint
 }
 
 func NewHttpContext(log *Logr, hostURL, basePath, baseMediaType string) *HttpContext {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false}, // @todo Add a flag to trust self-signed cert
-	}
+	tr, _ := newTransport(TransportOptions{})
 	return &HttpContext{Log: log, HostURL: hostURL, basePath: basePath,
-		baseMediaType: baseMediaType, headers: make(map[string]string), client: http.Client{Transport: tr}}
+		baseMediaType: baseMediaType, headers: make(map[string]string), client: http.Client{Transport: tr},
+		ids: newIDCache(), MaxAttempts: DefaultMaxAttempts, Timeout: DefaultTimeout, cmdContext: context.Background(),
+		stopContext:    context.Background(),
+		TraceBodyLimit: DefaultTraceBodyLimit}
+}
+
+// Clone returns a copy of the context with its own headers, so that each
+// goroutine that sends requests can use its own copy. Clone the context
+// before starting the goroutines, not in them, since the context that is
+// cloned must not be in use.
+func (ctx *HttpContext) Clone() *HttpContext {
+	clone := *ctx
+	clone.headers, clone.reqHeaders = copyHeaders(ctx.headers), copyHeaders(ctx.reqHeaders)
+	return &clone
 }
 
 func (ctx *HttpContext) fullMediaType(shortType string) string {
@@ -68,12 +134,25 @@ func (ctx *HttpContext) fullMediaType(shortType string) string {
 	return ctx.baseMediaType + shortType + "+json"
 }
 
+func copyHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(headers))
+	for k, v := range headers {
+		cp[k] = v
+	}
+	return cp
+}
+
+// Header sets a header of the next request only, like Accept and
+// ContentType, so that the headers of a request are never sent with the
+// requests that follow it on the same context.
 func (ctx *HttpContext) Header(name, value string) *HttpContext {
-	if value == "" {
-		delete(ctx.headers, name)
-	} else {
-		ctx.headers[name] = value
+	if ctx.reqHeaders == nil {
+		ctx.reqHeaders = make(map[string]string)
 	}
+	ctx.reqHeaders[name] = value
 	return ctx
 }
 
@@ -85,27 +164,24 @@ func (ctx *HttpContext) ContentType(s string) *HttpContext {
 	return ctx.Header("Content-Type", ctx.fullMediaType(s))
 }
 
+// Authorization sets the Authorization header of all the requests that
+// follow, or removes it if s is empty.
 func (ctx *HttpContext) Authorization(s string) *HttpContext {
-	return ctx.Header("Authorization", s)
-}
-
-func (ctx *HttpContext) traceHeaders(prefix string, hdrs *http.Header) {
-	if ctx.Log.TraceOn {
-		ctx.Log.Trace("%s:\n", prefix)
-		for k, av := range *hdrs {
-			for _, v := range av {
-				ctx.Log.Trace("  %v: %v\n", k, v)
-			}
-		}
+	if s == "" {
+		delete(ctx.headers, "Authorization")
+	} else {
+		ctx.headers["Authorization"] = s
 	}
+	return ctx
 }
 
-// Return the HTTP header of the given name, or empty string if name is not in the headers
+// Return the HTTP header of the given name that the next request would be
+// sent with, or empty string if there is none
 func (ctx *HttpContext) Headers(name string) string {
-	if value, exists := ctx.headers[name]; exists {
+	if value, exists := ctx.reqHeaders[name]; exists {
 		return value
 	}
-	return ""
+	return ctx.headers[name]
 }
 
 func ToJson(input interface{}) (output []byte, err error) {
@@ -140,7 +216,10 @@ func formatReply(ls LogStyle, contentType string, body []byte) string {
 	return ToStringWithStyle(ls, parsedBody)
 }
 
-func (ctx *HttpContext) Request(method, path string, input, output interface{}) error {
+func (ctx *HttpContext) Request(method, path string, input, output interface{}) (err error) {
+	reqHeaders := ctx.reqHeaders
+	retry, reauthorized, check := ctx.canRetry(method, reqHeaders), false, ctx.check
+	ctx.reqHeaders, ctx.idempotent, ctx.check = nil, false, nil
 	body, err := ToJson(input)
 	if err != nil {
 		return err
@@ -149,32 +228,148 @@ func (ctx *HttpContext) Request(method, path string, input, output interface{})
 	if !strings.HasPrefix(path, "/") {
 		url = ctx.HostURL + ctx.basePath + path
 	}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
-	if err != nil {
+	status, requestID, traceID := 0, newRequestID(), ""
+	defer func() {
+		ctx.cache.invalidate(method, url)
+		ctx.auditRequest(method, path, body, status, requestID, traceID, err)
+	}()
+	cached, reqHeaders := ctx.cache.conditional(method, url, reqHeaders)
+	ctx.announceTarget(method)
+	// a token that could not be renewed before the request is not renewed again if it is refused
+	renewErr := ctx.refreshIfExpiring()
+	reauthorized = renewErr != nil
+	for attempt := 1; ; attempt++ {
+		if ctx.limiter.wait(ctx.cmdContext) != nil {
+			return ErrCanceled
+		}
+		reqCtx, cancel := ctx.requestContext()
+		started := now()
+		resp, sent, err := ctx.send(reqCtx, method, url, body, requestID, reqHeaders)
+		ctx.stats.record(method, strings.TrimPrefix(path, ctx.basePath), resp, now().Sub(started))
+		if retry && attempt < ctx.MaxAttempts {
+			if wait, ok := ctx.transientWait(method, url, attempt, resp, err); ok {
+				ctx.stats.retried()
+				cancel()
+				if sleep(ctx.cmdContext, wait) != nil {
+					return ErrCanceled
+				}
+				continue
+			}
+		}
+		if !retry && check != nil && attempt < ctx.MaxAttempts {
+			if wait, ok := ctx.checkWait(reqCtx, method, url, attempt, resp, err); ok {
+				cancel()
+				if sleep(ctx.cmdContext, wait) != nil {
+					return ErrCanceled
+				}
+				if applied, cerr := check(); cerr != nil {
+					return &UncertainError{method, url, cerr, requestID}
+				} else if applied {
+					ctx.Log.Debug("%s request to %s was applied before it failed\n", method, url)
+					return ErrApplied
+				}
+				ctx.stats.retried()
+				continue
+			}
+		}
+		// a request refused with 401 was not applied, so it can be sent again
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && ctx.renewal != nil && !reauthorized {
+			reauthorized = true
+			ctx.Log.Debug("%s request to %s was not authorized, renewing the access token\n", method, url)
+			if renewErr = ctx.renewToken(); renewErr == nil {
+				resp.Body.Close()
+				cancel()
+				continue
+			}
+			ctx.Log.Debug("%v\n", renewErr)
+		}
+		if err == nil {
+			status, traceID = resp.StatusCode, serverTraceID(resp.Header, requestID)
+			if err = ctx.cache.update(ctx.Log, method, url, reqHeaders, cached, resp); err == nil {
+				err = ctx.reply(resp, output)
+			}
+			resp.Body.Close()
+			if status, ok := err.(*StatusError); ok {
+				status.Method, status.Path, status.RequestID, status.TraceID = method, path, requestID, traceID
+				if ctx.authHint != nil && (status.Code == http.StatusUnauthorized || status.Code == http.StatusForbidden) {
+					status.Hint = ctx.authHint(ctx, path, status.Code)
+				}
+				if status.Code == http.StatusUnauthorized {
+					status.Cause = renewErr
+				}
+			}
+		}
+		err = ctx.requestError(reqCtx, method, url, err)
+		cancel()
+		if err != nil && resp == nil && sent && !retry && err != ErrCanceled {
+			err = &UncertainError{method, url, err, requestID}
+		}
 		return err
 	}
+}
+
+func (ctx *HttpContext) announceTarget(method string) {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	if ctx.TargetName != "" && !ctx.announced {
+		ctx.announced = true
+		ctx.Log.Info("Using %s\n", ctx.Destination())
+	}
+}
+
+// AnnounceTarget prints where the requests of the context go and who sends
+// them when a command that changes the tenant starts, at any level so that
+// it is seen even with --quiet, unless show is false. Either way, it is not
+// printed again before the first request that may change something.
+func (ctx *HttpContext) AnnounceTarget(show bool) {
+	if ctx.TargetName != "" && !ctx.announced {
+		ctx.announced = true
+		if show {
+			ctx.Log.Notice("Using %s\n", ctx.Destination())
+		}
+	}
+}
+
+// send sends a request, and returns whether it was written entirely so
+// that the server may have applied it even if there is no response.
+func (ctx *HttpContext) send(reqCtx context.Context, method, url string, body []byte, requestID string,
+	reqHeaders map[string]string) (*http.Response, bool, error) {
+	var wrote int32 // set by the transport goroutine that writes the request
+	reqCtx = httptrace.WithClientTrace(reqCtx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				atomic.StoreInt32(&wrote, 1)
+			}
+		}})
+	reqCtx = ctx.har.start(reqCtx)
+	req, err := http.NewRequestWithContext(reqCtx, method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, false, err
+	}
 	for k, v := range ctx.headers {
 		req.Header.Set(k, v)
 	}
-	ctx.Log.Trace("%s request to : %v\n", method, url)
-	ctx.traceHeaders("request headers", &req.Header)
-	if input != nil {
-		ctx.Log.Trace("request body: %s\n", body)
+	for k, v := range reqHeaders {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
 	}
+	req.Header.Set(RequestIDHeader, requestID)
+	ctx.Log.Debug("%s %s\n", method, redactURL(url))
+	ctx.traceRequest(req, body)
 	resp, err := ctx.client.Do(req)
+	ctx.har.sent(req, body, resp, err)
+	return resp, atomic.LoadInt32(&wrote) == 1, err
+}
+
+func (ctx *HttpContext) reply(resp *http.Response, output interface{}) (err error) {
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	ctx.Log.Trace("response status: %v\n", resp.Status)
-	ctx.traceHeaders("response headers", &resp.Header)
-	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		return err
-	}
-	contentType := resp.Header.Get("Content-Type")
-	if ctx.Log.TraceOn && len(body) > 0 {
-		ctx.Log.Trace("response body:\n%s\n", formatReply(LJson, contentType, body))
-	}
+	ctx.traceResponse(resp, body)
 	if output != nil {
 		switch outp := output.(type) {
 		case *string:
@@ -183,13 +378,13 @@ func (ctx *HttpContext) Request(method, path string, input, output interface{})
 			outp = body
 		default:
 			if len(body) > 0 {
-				err = json.Unmarshal(body, outp)
+				err = decodeJSON(resp, body, outp)
 			}
 		}
 	}
 	good := map[int]bool{200: true, 201: true, 204: true}
 	if !good[resp.StatusCode] {
-		err = fmt.Errorf("%s\n%s\n", resp.Status, formatReply(ctx.Log.Style, contentType, body))
+		err = statusError(resp, body, ctx.Log.Style)
 	}
 	return err
 }
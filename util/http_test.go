@@ -33,3 +33,35 @@ func TestHttpGet(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, output)
 }
+
+func TestRequestHeadersAreOnlySentOnce(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{
+		"POST/items": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Equal(t, "application/vnd.test.item+json", req.Accept)
+			assert.Equal(t, "abc", req.Header.Get("If-Match"))
+			assert.Equal(t, "Bearer token", req.Authorization)
+			return &TstReply{}
+		},
+		"GET/items": func(t *testing.T, req *TstReq) *TstReply {
+			assert.Empty(t, req.Accept)
+			assert.Empty(t, req.Header.Get("If-Match"))
+			assert.Equal(t, "Bearer token", req.Authorization)
+			return &TstReply{}
+		}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "application/vnd.test.").Authorization("Bearer token")
+	assert.Nil(t, ctx.Accept("item").Header("If-Match", "abc").Request("POST", "items", nil, nil))
+	assert.Empty(t, ctx.Headers("Accept"))
+	assert.Nil(t, ctx.Request("GET", "items", nil, nil))
+}
+
+func TestFailedRequestDoesNotKeepHeaders(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/items": func(t *testing.T, req *TstReq) *TstReply {
+		assert.Empty(t, req.ContentType)
+		return &TstReply{}
+	}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	assert.NotNil(t, ctx.ContentType("json").Request("POST", "items", make(chan int), nil))
+	assert.Nil(t, ctx.Request("GET", "items", nil, nil))
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"sync"
+)
+
+type idKey struct {
+	resType, nameAttr, name string
+}
+
+// idCache remembers the IDs of resources looked up by name during a command
+// so that bulk operations do not ask the server again for the same names,
+// and other values of the tenant that do not change during a command, see
+// Value. It is safe to use from concurrent requests.
+type idCache struct {
+	mutex  sync.Mutex
+	ids    map[idKey]string
+	exact  bool       // names are compared with case
+	vmutex sync.Mutex // of values, apart from mutex so that ID lookups are not blocked
+	values map[string]*cachedValue
+}
+
+// cachedValue is a value of the context, got once with get
+type cachedValue struct {
+	once  sync.Once
+	get   func() (interface{}, error)
+	value interface{}
+	err   error
+}
+
+func newIDCache() *idCache {
+	return &idCache{ids: make(map[idKey]string), values: make(map[string]*cachedValue)}
+}
+
+func (c *idCache) key(resType, nameAttr, name string) idKey {
+	if c.exact {
+		return idKey{resType, nameAttr, name}
+	}
+	return idKey{resType, nameAttr, strings.ToLower(name)}
+}
+
+// SetCaseSensitiveNames makes the names of resources compared with case by
+// the context and its copies, for tenants where names that only differ in
+// case are different resources.
+func (ctx *HttpContext) SetCaseSensitiveNames(exact bool) {
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	ctx.ids.exact = exact
+}
+
+// CaseSensitiveNames returns true if names of resources are compared with case
+func (ctx *HttpContext) CaseSensitiveNames() bool {
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	return ctx.ids.exact
+}
+
+// CachedID returns the ID of the resource of the given type whose name
+// attribute matches name case-insensitively, or exactly if names are case
+// sensitive, if it has been cached.
+func (ctx *HttpContext) CachedID(resType, nameAttr, name string) (id string, ok bool) {
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	id, ok = ctx.ids.ids[ctx.ids.key(resType, nameAttr, name)]
+	return
+}
+
+// CacheID remembers the ID of the named resource of the given type.
+func (ctx *HttpContext) CacheID(resType, nameAttr, name, id string) {
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	ctx.ids.ids[ctx.ids.key(resType, nameAttr, name)] = id
+}
+
+// ForgetID removes the named resource from the cache, it must be called
+// when a resource of that type and name is created or deleted.
+func (ctx *HttpContext) ForgetID(resType, nameAttr, name string) {
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	delete(ctx.ids.ids, ctx.ids.key(resType, nameAttr, name))
+}
+
+// cachedName returns the name of the cached resource with the given ID, in
+// lower case unless names are case sensitive, since names are cached without
+// case.
+func (ctx *HttpContext) cachedName(id string) (name string, ok bool) {
+	if id == "" {
+		return "", false
+	}
+	ctx.ids.mutex.Lock()
+	defer ctx.ids.mutex.Unlock()
+	for k, v := range ctx.ids.ids {
+		if v == id {
+			return k.name, true
+		}
+	}
+	return "", false
+}
+
+// SetValue stores a value under the key for the context and its copies.
+func (ctx *HttpContext) SetValue(key string, value interface{}) {
+	cached := &cachedValue{value: value}
+	cached.once.Do(func() {})
+	ctx.ids.vmutex.Lock()
+	defer ctx.ids.vmutex.Unlock()
+	ctx.ids.values[key] = cached
+}
+
+// Value returns the value stored under the key, or if there is none and get
+// is not nil, the value and error that get returns, which are stored so that
+// get is only called once even if it fails. Concurrent callers of the same
+// key wait for get, which must not get the value of its own key. Other values
+// can be got meanwhile, such as by the hint of a request that get sends.
+func (ctx *HttpContext) Value(key string, get func() (interface{}, error)) (interface{}, error) {
+	ctx.ids.vmutex.Lock()
+	cached, ok := ctx.ids.values[key]
+	if !ok && get != nil {
+		cached = &cachedValue{get: get}
+		ctx.ids.values[key] = cached
+	}
+	ctx.ids.vmutex.Unlock()
+	if cached == nil {
+		return nil, nil
+	}
+	cached.once.Do(func() { cached.value, cached.err = cached.get() })
+	return cached.value, cached.err
+}
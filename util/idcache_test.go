@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestCachedIDIgnoresCaseOfName(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	ctx.CacheID("Users", "userName", "Olaf", "123")
+	id, ok := ctx.CachedID("Users", "userName", "oLAF")
+	assert.True(t, ok)
+	assert.Equal(t, "123", id)
+	_, ok = ctx.CachedID("Groups", "userName", "olaf")
+	assert.False(t, ok, "resource type is part of the key")
+	_, ok = ctx.CachedID("Users", "displayName", "olaf")
+	assert.False(t, ok, "name attribute is part of the key")
+}
+
+func TestCachedIDComparesCaseOfNameIfCaseSensitive(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	ctx.SetCaseSensitiveNames(true)
+	assert.True(t, ctx.Clone().CaseSensitiveNames(), "copies of the context share the setting")
+	ctx.CacheID("Users", "userName", "Olaf", "123")
+	_, ok := ctx.CachedID("Users", "userName", "olaf")
+	assert.False(t, ok)
+	id, ok := ctx.CachedID("Users", "userName", "Olaf")
+	assert.True(t, ok)
+	assert.Equal(t, "123", id)
+}
+
+func TestForgetID(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	ctx.CacheID("Users", "userName", "olaf", "123")
+	ctx.ForgetID("Users", "userName", "OLAF")
+	_, ok := ctx.CachedID("Users", "userName", "olaf")
+	assert.False(t, ok)
+}
+
+func TestIDCacheIsSafeForConcurrentUse(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i%5)
+			ctx.CacheID("Users", "userName", name, name)
+			ctx.CachedID("Users", "userName", name)
+			ctx.ForgetID("Users", "userName", name)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestValueIsGotOnceEvenIfItFails(t *testing.T) {
+	ctx, calls := NewHttpContext(NewBufferedLogr(), "", "", ""), 0
+	get := func() (interface{}, error) {
+		calls++
+		return nil, errors.New("forbidden")
+	}
+	_, err := ctx.Value("policy", get)
+	assert.EqualError(t, err, "forbidden")
+	_, err = ctx.Clone().Value("policy", get)
+	assert.EqualError(t, err, "forbidden", "copies of the context share values")
+	assert.Equal(t, 1, calls)
+}
+
+func TestSetValue(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	value, err := ctx.Value("enforced", nil)
+	assert.Nil(t, value)
+	assert.NoError(t, err)
+	ctx.SetValue("enforced", true)
+	value, _ = ctx.Value("enforced", func() (interface{}, error) { return false, nil })
+	assert.Equal(t, true, value)
+}
+
+func TestValueCanGetOtherValues(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "")
+	ctx.SetValue("scopes", "admin")
+	value, _ := ctx.Value("policy", func() (interface{}, error) {
+		scopes, _ := ctx.Value("scopes", nil)
+		return scopes.(string) + " policy", nil
+	})
+	assert.Equal(t, "admin policy", value)
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CredentialStore keeps the secret options of targets, such as tokens, out
+// of the config file.
+type CredentialStore interface {
+	// Get returns the value of the option of the target, "" if none is stored.
+	Get(target, key string) (string, error)
+	Set(target, key, value string) error
+	Delete(target, key string) error
+}
+
+// Names of the credential stores for NewCredentialStore
+const (
+	CredentialsAuto    = "auto"
+	CredentialsKeyring = "keyring"
+	CredentialsFile    = "file"
+)
+
+const keyringService = "priam"
+
+// NewCredentialStore returns the OS keyring for CredentialsKeyring, or nil
+// for CredentialsFile which means that secrets are kept in the config file.
+// CredentialsAuto selects the keyring if it is available.
+func NewCredentialStore(name string) (CredentialStore, error) {
+	switch strings.ToLower(name) {
+	case CredentialsFile:
+		return nil, nil
+	case CredentialsKeyring:
+		if err := keyringAvailable(); err != nil {
+			return nil, fmt.Errorf("OS keyring is not available: %v", err)
+		}
+		return osKeyring{}, nil
+	case CredentialsAuto, "":
+		if keyringAvailable() == nil {
+			return osKeyring{}, nil
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown credential store \"%s\", supported stores are: auto, file, keyring", name)
+}
+
+func keyringAccount(target, key string) string {
+	return target + "/" + key
+}
+
+// runCommand runs a helper command of the OS keyring with input on stdin and
+// returns its output without the final newline. Tests replace it to check
+// the commands without touching the real keyring.
+var runCommand = func(input, name string, args ...string) (string, error) {
+	cmd, stderr := exec.Command(name, args...), &bytes.Buffer{}
+	cmd.Stdin, cmd.Stderr = strings.NewReader(input), stderr
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), err
+}
+
+// exitCode returns the exit code of a command that failed, 0 if err is not
+// the failure of a command.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// errSecItemNotFound is the exit code of the security command when there is no such item
+const errSecItemNotFound = 44
+
+// osKeyring keeps secrets in the macOS Keychain with the security command.
+type osKeyring struct{}
+
+func keyringAvailable() error {
+	_, err := exec.LookPath("security")
+	return err
+}
+
+func (osKeyring) Get(target, key string) (string, error) {
+	out, err := runCommand("", "security", "find-generic-password", "-s", keyringService,
+		"-a", keyringAccount(target, key), "-w")
+	if exitCode(err) == errSecItemNotFound {
+		return "", nil
+	}
+	return out, err
+}
+
+// Set sends the command that stores the secret on the stdin of an
+// interactive security command, so that it is not on a command line that
+// other users can see. The secret is in hex so that it needs no quotes, and
+// is read back since an interactive security command does not fail when one
+// of its commands does.
+func (k osKeyring) Set(target, key, value string) error {
+	account := keyringAccount(target, key)
+	command := fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n", securityQuote(keyringService),
+		securityQuote(account), hex.EncodeToString([]byte(value)))
+	if _, err := runCommand(command, "security", "-i"); err != nil {
+		return err
+	} else if stored, err := k.Get(target, key); err != nil {
+		return err
+	} else if stored != value {
+		return errors.New("could not add " + account + " to the Keychain, the secret read back differs")
+	}
+	return nil
+}
+
+// securityQuote quotes an argument of a command of an interactive security
+// command like a shell does.
+func securityQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+func (osKeyring) Delete(target, key string) error {
+	_, err := runCommand("", "security", "delete-generic-password", "-s", keyringService,
+		"-a", keyringAccount(target, key))
+	if exitCode(err) == errSecItemNotFound {
+		return nil
+	}
+	return err
+}
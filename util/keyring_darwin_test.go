@@ -0,0 +1,45 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestKeychainSecretIsNotOnCommandLine(t *testing.T) {
+	defer func(saved func(string, string, ...string) (string, error)) { runCommand = saved }(runCommand)
+	var calls []string
+	runCommand = func(input, name string, args ...string) (string, error) {
+		calls = append(calls, input+"|"+name+" "+strings.Join(args, " "))
+		return "sesame", nil
+	}
+	assert.Nil(t, osKeyring{}.Set("o'prod", "accesstoken", "sesame"))
+	assert.Equal(t, []string{
+		`add-generic-password -U -s 'priam' -a 'o'"'"'prod/accesstoken' -X 736573616d65` + "\n|security -i",
+		"|security find-generic-password -s priam -a o'prod/accesstoken -w",
+	}, calls)
+}
+
+func TestKeychainSetFailsIfSecretIsNotStored(t *testing.T) {
+	defer func(saved func(string, string, ...string) (string, error)) { runCommand = saved }(runCommand)
+	runCommand = func(input, name string, args ...string) (string, error) {
+		return "", nil
+	}
+	assert.EqualError(t, osKeyring{}.Set("prod", "accesstoken", "sesame"), "could not add prod/accesstoken to the "+
+		"Keychain, the secret read back differs")
+}
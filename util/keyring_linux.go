@@ -0,0 +1,62 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// osKeyring keeps secrets with the Secret Service, such as GNOME Keyring or
+// KWallet, by way of the secret-tool command.
+type osKeyring struct{}
+
+func keyringAvailable() error {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return err
+	}
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return errors.New("no D-Bus session to reach the Secret Service")
+	}
+	return nil
+}
+
+// secret-tool exits with 1 and prints nothing when there is no such secret
+func (osKeyring) Get(target, key string) (string, error) {
+	out, err := runCommand("", "secret-tool", "lookup", "service", keyringService,
+		"account", keyringAccount(target, key))
+	if exitCode(err) == 1 && out == "" {
+		return "", nil
+	}
+	return out, err
+}
+
+func (osKeyring) Set(target, key, value string) error {
+	account := keyringAccount(target, key)
+	_, err := runCommand(value, "secret-tool", "store", "--label", keyringService+" "+account,
+		"service", keyringService, "account", account)
+	return err
+}
+
+func (osKeyring) Delete(target, key string) error {
+	_, err := runCommand("", "secret-tool", "clear", "service", keyringService,
+		"account", keyringAccount(target, key))
+	if exitCode(err) == 1 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+type secretToolCall struct {
+	input, args string
+}
+
+// stubSecretTool records the calls of secret-tool, which exits with the given code
+func stubSecretTool(output string, code int) *[]secretToolCall {
+	calls := &[]secretToolCall{}
+	runCommand = func(input, name string, args ...string) (string, error) {
+		*calls = append(*calls, secretToolCall{input, name + " " + strings.Join(args, " ")})
+		if code != 0 {
+			return output, exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+		}
+		return output, nil
+	}
+	return calls
+}
+
+func TestSecretToolCommands(t *testing.T) {
+	defer func(saved func(string, string, ...string) (string, error)) { runCommand = saved }(runCommand)
+	calls := stubSecretTool("sesame", 0)
+	value, err := osKeyring{}.Get("prod", "accesstoken")
+	assert.Nil(t, err)
+	assert.Equal(t, "sesame", value)
+	assert.Nil(t, osKeyring{}.Set("prod", "accesstoken", "sesame"))
+	assert.Nil(t, osKeyring{}.Delete("prod", "accesstoken"))
+	assert.Equal(t, []secretToolCall{
+		{"", "secret-tool lookup service priam account prod/accesstoken"},
+		{"sesame", "secret-tool store --label priam prod/accesstoken service priam account prod/accesstoken"},
+		{"", "secret-tool clear service priam account prod/accesstoken"},
+	}, *calls)
+}
+
+func TestSecretToolMissingSecret(t *testing.T) {
+	defer func(saved func(string, string, ...string) (string, error)) { runCommand = saved }(runCommand)
+	stubSecretTool("", 1)
+	value, err := osKeyring{}.Get("prod", "accesstoken")
+	assert.Nil(t, err)
+	assert.Empty(t, value)
+	assert.Nil(t, osKeyring{}.Delete("prod", "accesstoken"))
+}
+
+func TestSecretToolFailure(t *testing.T) {
+	defer func(saved func(string, string, ...string) (string, error)) { runCommand = saved }(runCommand)
+	runCommand = func(input, name string, args ...string) (string, error) {
+		return "", errors.New("no such secret collection")
+	}
+	_, err := osKeyring{}.Get("prod", "accesstoken")
+	assert.EqualError(t, err, "no such secret collection")
+}
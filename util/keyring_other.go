@@ -0,0 +1,41 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "errors"
+
+var errNoKeyring = errors.New("no keyring support on this platform")
+
+type osKeyring struct{}
+
+func keyringAvailable() error {
+	return errNoKeyring
+}
+
+func (osKeyring) Get(target, key string) (string, error) {
+	return "", errNoKeyring
+}
+
+func (osKeyring) Set(target, key, value string) error {
+	return errNoKeyring
+}
+
+func (osKeyring) Delete(target, key string) error {
+	return errNoKeyring
+}
@@ -0,0 +1,32 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	store, err := NewCredentialStore(CredentialsFile)
+	assert.Nil(t, err)
+	assert.Nil(t, store)
+}
+
+func TestUnknownCredentialStore(t *testing.T) {
+	_, err := NewCredentialStore("vault")
+	assert.EqualError(t, err, `unknown credential store "vault", supported stores are: auto, file, keyring`)
+}
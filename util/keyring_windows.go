@@ -0,0 +1,120 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead   = advapi32.NewProc("CredReadW")
+	procCredWrite  = advapi32.NewProc("CredWriteW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+	credMaxBlobSize         = 5 * 512
+	errorNotFound           = syscall.Errno(1168)
+)
+
+// credential is the CREDENTIALW structure of the Credential Manager API
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// osKeyring keeps secrets in the Windows Credential Manager.
+type osKeyring struct{}
+
+func keyringAvailable() error {
+	return advapi32.Load()
+}
+
+func credentialName(target, key string) (*uint16, error) {
+	return syscall.UTF16PtrFromString(keyringService + ":" + keyringAccount(target, key))
+}
+
+func (osKeyring) Get(target, key string) (string, error) {
+	name, err := credentialName(target, key)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	if r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0,
+		uintptr(unsafe.Pointer(&cred))); r == 0 {
+		if err == errorNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	if cred.CredentialBlobSize == 0 {
+		return "", nil
+	}
+	blob := (*[credMaxBlobSize]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	return string(blob), nil
+}
+
+func (osKeyring) Set(target, key, value string) error {
+	if len(value) > credMaxBlobSize {
+		return fmt.Errorf("%s is longer than the %d bytes the Credential Manager can keep", key, credMaxBlobSize)
+	}
+	name, err := credentialName(target, key)
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(keyringService)
+	if err != nil {
+		return err
+	}
+	blob := []byte(value)
+	cred := credential{Type: credTypeGeneric, TargetName: name, Persist: credPersistLocalMachine,
+		CredentialBlobSize: uint32(len(blob)), UserName: user}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	if r, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (osKeyring) Delete(target, key string) error {
+	name, err := credentialName(target, key)
+	if err != nil {
+		return err
+	}
+	if r, _, err := procCredDelete.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0); r == 0 && err != errorNotFound {
+		return err
+	}
+	return nil
+}
@@ -16,12 +16,17 @@ limitations under the License.
 package util
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type LogStyle int
@@ -31,14 +36,62 @@ const (
 	LYaml
 )
 
+// LogLevel selects which messages are printed, errors and results are always printed
+type LogLevel int
+
+const (
+	LError LogLevel = iota - 1 // only errors, for scripts
+	LInfo                      // default, also progress and status messages
+	LDebug                     // also debug messages such as the requests sent
+)
+
+// OutputFormat selects how results are printed by PP
+type OutputFormat int
+
+const (
+	FTable OutputFormat = iota // titled summary in the log style
+	FJson
+	FYaml
+	FCsv
+)
+
+var outputFormats = map[string]OutputFormat{"table": FTable, "json": FJson, "yaml": FYaml, "csv": FCsv}
+
+// ParseOutputFormat returns the output format of the given name.
+func ParseOutputFormat(name string) (OutputFormat, error) {
+	if f, ok := outputFormats[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return FTable, fmt.Errorf("unknown output format \"%s\", supported formats are: csv, json, table, yaml", name)
+}
+
 type Logr struct {
-	DebugOn, TraceOn, VerboseOn bool
-	Style                       LogStyle
-	ErrW, OutW                  io.Writer
+	TraceOn, VerboseOn bool
+	Level              LogLevel
+	Style              LogStyle
+	Format             OutputFormat
+	ErrW, OutW         io.Writer
+	InR                io.Reader // answers to confirmation prompts, none if nil
+	TraceW             io.Writer // trace output, ErrW if nil
+	LogW               io.Writer // also gets a record of each message and result, if not nil
+	LogJSON            bool      // records are JSON objects rather than lines of text
+	ConsoleOff         bool      // messages only go to LogW, results are still printed
+	Query              *Query    // selects the values to print from results, all if nil
+	Columns            []string  // path labels of the only values printed of each result, if any
+	SortBy             string    // path label of the value that lists of results are sorted by, if any
+	Reverse            bool      // lists of results are printed in reverse order
+	ResultsOnly        bool      // OutW only gets results, messages go to ErrW
+	colorErr, colorOut bool      // whether to color what is printed to ErrW and OutW
+	exitCode           int
+	in                 *bufio.Reader // reads InR, kept so that what it reads ahead is not lost
+	inOf               io.Reader     // the InR that in reads
+	mutex              sync.Mutex    // so that messages of concurrent requests do not mix
+	progress           *Progress     // displayed in place on ErrW, if any
+	Summary            *RunSummary   // gets the errors of resources for their rows, if not nil
 }
 
 func NewLogr() *Logr {
-	return &Logr{false, false, false, LYaml, os.Stderr, os.Stdout}
+	return &Logr{Style: LYaml, ErrW: os.Stderr, OutW: os.Stdout, InR: os.Stdin}
 }
 
 func (l *Logr) ClearBuffers() *Logr {
@@ -47,7 +100,7 @@ func (l *Logr) ClearBuffers() *Logr {
 }
 
 func NewBufferedLogr() *Logr {
-	return (&Logr{false, false, false, LYaml, nil, nil}).ClearBuffers()
+	return (&Logr{Style: LYaml}).ClearBuffers()
 }
 
 func (l *Logr) InfoString() string {
@@ -58,26 +111,110 @@ func (l *Logr) ErrString() string {
 	return l.ErrW.(*bytes.Buffer).String()
 }
 
+// MachineFormat returns true if results are printed for other tools to parse,
+// in which case messages go to ErrW so that they do not mix with results.
+func (l *Logr) MachineFormat() bool {
+	return l.Format != FTable || l.Query != nil
+}
+
+func (l *Logr) msgW() io.Writer {
+	if l.MachineFormat() || l.ResultsOnly {
+		return l.ErrW
+	}
+	return l.OutW
+}
+
+// Enabled returns true if messages of the given level are printed.
+func (l *Logr) Enabled(level LogLevel) bool {
+	return l.Level >= level
+}
+
 func (l *Logr) Info(format string, args ...interface{}) {
-	fmt.Fprintf(l.OutW, format, args...)
+	l.print(LInfo, recordInfo, l.msgW(), "", format, args...)
 }
 
+// Err prints an error message and records that the command failed, with
+// ExitNotFound if one of the args is an error that a resource was not found.
 func (l *Logr) Err(format string, args ...interface{}) {
-	fmt.Fprintf(l.ErrW, format, args...)
+	l.print(LError, recordError, l.ErrW, "", format, args...)
+	l.Summary.noteError(args)
+	code := ExitError
+	for _, arg := range args {
+		if err, ok := arg.(error); ok && IsNotFound(err) {
+			code = ExitNotFound
+		}
+	}
+	l.Fail(code)
+}
+
+// Warn prints a warning to ErrW at any level, without failing the command.
+func (l *Logr) Warn(format string, args ...interface{}) {
+	l.print(LError, recordWarning, l.ErrW, "", format, args...)
+}
+
+// Notice prints a message with the other messages at any level, for what
+// must be seen even with --quiet.
+func (l *Logr) Notice(format string, args ...interface{}) {
+	l.print(LError, recordInfo, l.msgW(), "", format, args...)
 }
 
 func (l *Logr) Debug(format string, args ...interface{}) {
-	if l.DebugOn {
-		fmt.Fprintf(l.OutW, format, args...)
+	l.print(LDebug, recordDebug, l.msgW(), "", format, args...)
+}
+
+// print writes a message of the given level to w if the level is enabled,
+// clearing the progress line displayed in place first and drawing it again
+// after, so that they do not mix on the terminal. Messages are also written
+// to LogW whatever the level, except debug messages. Messages are colored
+// with color if given, or the color of their kind.
+func (l *Logr) print(level LogLevel, kind string, w io.Writer, color, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.LogW != nil && (level <= LInfo || l.Enabled(level)) {
+		l.writeRecord(kind, fmt.Sprintf(format, args...), args, nil)
+	}
+	if !l.Enabled(level) || l.ConsoleOff {
+		return
+	}
+	if kind == recordWarning {
+		format = "WARNING: " + format
+	}
+	if color == "" {
+		color = kindColors[kind]
+	}
+	shown := l.progress.clear()
+	fmt.Fprint(w, l.colorize(w, color, fmt.Sprintf(format, args...)))
+	if shown {
+		l.progress.draw(now())
 	}
 }
 
+// Trace prints to TraceW, or to ErrW so that it does not mix with the output
+// of commands.
 func (l *Logr) Trace(format string, args ...interface{}) {
-	if l.TraceOn {
-		fmt.Fprintf(l.OutW, format, args...)
+	if l.TraceOn && l.TraceW != nil {
+		fmt.Fprintf(l.TraceW, format, args...)
+	} else if l.TraceOn {
+		fmt.Fprintf(l.ErrW, format, args...)
 	}
 }
 
+// Confirm prints the prompt and returns true only if the answer read from InR
+// is yes. If there is no input to read from, the answer is no. The prompt is
+// printed at any level.
+func (l *Logr) Confirm(format string, args ...interface{}) bool {
+	fmt.Fprintf(l.msgW(), format+" [y/N]: ", args...)
+	if l.InR == nil {
+		return false
+	}
+	if l.in == nil || l.inOf != l.InR {
+		l.in, l.inOf = bufio.NewReader(l.InR), l.InR
+	}
+	answer, _ := l.in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func ToStringWithStyle(ls LogStyle, input interface{}) string {
 	var err error
 	var outp []byte
@@ -97,8 +234,15 @@ func ToStringWithStyle(ls LogStyle, input interface{}) string {
 // map[string]interface{} -- arrays and maps of various types of data.
 // This method takes such an object and removes any map keys that are
 // not in the filter. returns a new filtered interface{}
-//
+// Filters that are paths such as name.givenName add the value at the path
+// to the first maps found, with the path as key.
 func (l *Logr) Filter(info interface{}, filter []string) interface{} {
+	keys := make([]string, 0, len(filter))
+	for _, k := range filter {
+		if !IsPathLabel(k) {
+			keys = append(keys, k)
+		}
+	}
 	switch inf := info.(type) {
 	case []interface{}:
 		filteredArray := make([]interface{}, 0)
@@ -114,10 +258,14 @@ func (l *Logr) Filter(info interface{}, filter []string) interface{} {
 	case map[string]interface{}:
 		filteredMap := make(map[string]interface{}, len(inf))
 		for _, k := range filter {
-			if v, ok := inf[k]; ok {
-				if fv := l.Filter(v, filter); fv != nil {
-					filteredMap[k] = fv
+			if !IsPathLabel(k) {
+				if v, ok := inf[k]; ok {
+					if fv := l.Filter(v, keys); fv != nil {
+						filteredMap[k] = fv
+					}
 				}
+			} else if v, ok := lookupLabel(inf, k); ok && v != nil {
+				filteredMap[k] = l.Filter(v, keys)
 			}
 		}
 		if len(filteredMap) == 0 {
@@ -130,10 +278,170 @@ func (l *Logr) Filter(info interface{}, filter []string) interface{} {
 
 // pp will pretty print in json or yaml format (based on logr.style) to logr.info.
 // If filter is not empty and logr is not verbose, output will only include map
-// values with those keys.
+// values with those keys. The json and yaml output formats print the whole info
+// without title, the csv format prints a column for each key of the filter.
 func (l *Logr) PP(title string, info interface{}, filter ...string) {
-	if !l.VerboseOn && len(filter) > 0 {
-		info = l.Filter(info, filter)
+	if l.LogW != nil {
+		l.mutex.Lock()
+		l.writeRecord(recordResult, title, nil, info)
+		l.mutex.Unlock()
+	}
+	if l.Query != nil {
+		l.printQuery(l.arrange(info, false))
+		return
+	}
+	if info = l.arrange(info, true); len(l.Columns) > 0 {
+		filter = l.Columns
+	}
+	switch l.Format {
+	case FJson:
+		fmt.Fprintf(l.OutW, "%s\n", ToStringWithStyle(LJson, info))
+	case FYaml:
+		fmt.Fprint(l.OutW, ToStringWithStyle(LYaml, info))
+	case FCsv:
+		if l.VerboseOn && len(l.Columns) == 0 {
+			filter = nil
+		}
+		l.printCsv(info, filter)
+	default:
+		if len(l.Columns) > 0 {
+			l.printColumns(title, info)
+			return
+		}
+		if !l.VerboseOn && len(filter) > 0 {
+			info = l.Filter(info, filter)
+		}
+		fmt.Fprintf(l.OutW, "---- %s ----\n%s", title, ToStringWithStyle(l.Style, info))
+	}
+}
+
+// printQuery prints the values selected by the query one per line, an empty
+// line if the query selects nothing, which is an error if the query is strict.
+func (l *Logr) printQuery(info interface{}) {
+	values, misses := l.Query.Select(info)
+	for _, v := range values {
+		fmt.Fprintln(l.OutW, v)
+	}
+	if misses > 0 && l.Query.Strict {
+		l.Err("Query \"%s\" selected nothing in %d of %d results\n", l.Query.text, misses, len(values))
+	}
+}
+
+// Fail records that the command failed with the given exit code. The
+// exit codes are ordered by how specific they are, the highest is reported.
+func (l *Logr) Fail(code int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if code > l.exitCode {
+		l.exitCode = code
+	}
+}
+
+// ExitCode returns the exit code of the command, 0 if it did not fail.
+func (l *Logr) ExitCode() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.exitCode
+}
+
+// TakeExitCode returns the exit code of the command so far and clears it, so
+// that each run of a command repeated on several targets is checked alone.
+func (l *Logr) TakeExitCode() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	code := l.exitCode
+	l.exitCode = 0
+	return code
+}
+
+// csvRows converts info to a list of maps by way of JSON so that structs
+// and maps are handled alike. Values that are not maps are in a "value" column.
+func csvRows(info interface{}) []map[string]interface{} {
+	var generic interface{}
+	if content, err := json.Marshal(info); err != nil || json.Unmarshal(content, &generic) != nil {
+		generic = info
+	}
+	items, ok := generic.([]interface{})
+	if !ok && generic != nil {
+		items = []interface{}{generic}
+	}
+	rows := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if row, ok := item.(map[string]interface{}); ok {
+			rows = append(rows, row)
+		} else {
+			rows = append(rows, map[string]interface{}{"value": item})
+		}
+	}
+	return rows
+}
+
+// csvColumns returns the keys of the filter that are in any row, or all
+// keys of the rows sorted if there is no filter.
+func csvColumns(rows []map[string]interface{}, filter []string) []string {
+	columns, seen := []string{}, map[string]bool{}
+	for _, row := range rows {
+		for k := range row {
+			seen[k] = true
+		}
+	}
+	if len(filter) == 0 {
+		for k := range seen {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns)
+		return columns
+	}
+	for _, k := range filter {
+		if (seen[k] || IsPathLabel(k)) && !HasString(k, columns) {
+			columns = append(columns, k)
+		}
+	}
+	return columns
+}
+
+func (l *Logr) csvCell(value interface{}, filter []string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprintf("%v", v)
+	}
+	if len(filter) > 0 {
+		value = l.Filter(value, filter)
+	}
+	if content, err := json.Marshal(value); err == nil {
+		return string(content)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func (l *Logr) printCsv(info interface{}, filter []string) {
+	rows := csvRows(info)
+	if len(rows) == 0 {
+		return
+	}
+	for _, k := range filter {
+		for _, row := range rows {
+			if v, ok := lookupLabel(row, k); IsPathLabel(k) && ok {
+				row[k] = v
+			}
+		}
+	}
+	columns := csvColumns(rows, filter)
+	if len(l.Columns) > 0 {
+		filter = nil // the columns select values, not fields of them
+	}
+	w := csv.NewWriter(l.OutW)
+	w.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, k := range columns {
+			record[i] = l.csvCell(row[k], filter)
+		}
+		w.Write(record)
 	}
-	l.Info("---- %s ----\n%s", title, ToStringWithStyle(l.Style, info))
+	w.Flush()
 }
@@ -16,9 +16,11 @@ limitations under the License.
 package util
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -94,22 +96,75 @@ func TestVerboseFilteredJsonPrettyPrint(t *testing.T) {
 
 func TestLogDebug(t *testing.T) {
 	log := NewBufferedLogr()
-	log.DebugOn = true
+	log.Level = LDebug
 	log.Debug("test1")
 	assert.Contains(t, log.InfoString(), "test1")
-	log.DebugOn = false
+	log.Level = LInfo
 	log.Debug("test2")
 	assert.NotContains(t, log.InfoString(), "test2")
 }
 
+func TestQuietLevelPrintsOnlyResultsAndErrors(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Level = LError
+	log.Info("User successfully added\n")
+	log.Debug("GET /scim/Users\n")
+	log.PP("Users", []string{"olaf"})
+	log.Err("Error: %v\n", "boom")
+	assert.Equal(t, "---- Users ----\n- olaf\n", log.InfoString())
+	assert.Equal(t, "Error: boom\n", log.ErrString())
+}
+
+func TestQuietLevelStillPromptsForConfirmation(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Level, log.InR = LError, strings.NewReader("y\n")
+	assert.True(t, log.Confirm("Delete app %s?", "olaf"))
+	assert.Equal(t, "Delete app olaf? [y/N]: ", log.InfoString())
+}
+
 func TestLogTrace(t *testing.T) {
 	log := NewBufferedLogr()
 	log.TraceOn = true
 	log.Trace("test1")
-	assert.Contains(t, log.InfoString(), "test1")
+	assert.Contains(t, log.ErrString(), "test1")
+	assert.Empty(t, log.InfoString())
 	log.TraceOn = false
 	log.Trace("test2")
-	assert.NotContains(t, log.InfoString(), "test2")
+	assert.NotContains(t, log.ErrString(), "test2")
+}
+
+func TestLogTraceToWriter(t *testing.T) {
+	log, traceW := NewBufferedLogr(), &bytes.Buffer{}
+	log.TraceOn, log.TraceW = true, traceW
+	log.Trace("test1")
+	assert.Equal(t, "test1", traceW.String())
+	assert.Empty(t, log.ErrString())
+	assert.Empty(t, log.InfoString())
+}
+
+func TestConfirm(t *testing.T) {
+	for input, expected := range map[string]bool{"y\n": true, "YES\n": true, " y ": true,
+		"n\n": false, "\n": false, "": false, "yep\n": false} {
+		log := NewBufferedLogr()
+		log.InR = strings.NewReader(input)
+		assert.Equal(t, expected, log.Confirm("Delete %s?", "olaf"), "answer %q", input)
+		assert.Equal(t, "Delete olaf? [y/N]: ", log.InfoString())
+	}
+}
+
+func TestConfirmReadsEachAnswerOfInput(t *testing.T) {
+	log := NewBufferedLogr()
+	log.InR = strings.NewReader("y\nn\nyes\n")
+	assert.True(t, log.Confirm("Delete olaf?"))
+	assert.False(t, log.Confirm("Delete sven?"))
+	assert.True(t, log.Confirm("Delete anna?"))
+	log.InR = strings.NewReader("n\n")
+	assert.False(t, log.Confirm("Delete olaf?"))
+}
+
+func TestConfirmWithoutInputIsNo(t *testing.T) {
+	log := NewBufferedLogr()
+	assert.False(t, log.Confirm("Delete?"))
 }
 
 func TestToStringJsonStyle(t *testing.T) {
@@ -200,3 +255,149 @@ func TestUnfilteredOutputValidJson(t *testing.T) {
 	log.PP("sirens", ppData)
 	assert.Equal(t, expected, log.InfoString())
 }
+
+const csvData = `[{"name": "olaf", "uuid": "1", "size": 3, "visible": true,
+	"emails": [{"value": "olaf@example.com", "primary": true}]},
+	{"name": "sven, the reindeer", "uuid": "2", "description": "says \"hi\""}]`
+
+func TestParseOutputFormat(t *testing.T) {
+	for name, expected := range map[string]OutputFormat{"table": FTable, "json": FJson, "YAML": FYaml, "csv": FCsv} {
+		f, err := ParseOutputFormat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, f)
+	}
+	_, err := ParseOutputFormat("xml")
+	assert.EqualError(t, err, `unknown output format "xml", supported formats are: csv, json, table, yaml`)
+}
+
+func TestJsonFormatPrintsWholeInfoWithoutTitle(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FJson
+	log.PP("sirens", ppData, "integer")
+	assert.Equal(t, "{\n  \"array\": [\n    5,\n    4,\n    3\n  ],\n  \"integer\": 88888,\n"+
+		"  \"intstring\": \"111\",\n  \"string\": \"string\"\n}\n", log.InfoString())
+}
+
+func TestJsonFormatEmptyList(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FJson
+	log.PP("Users", []interface{}{}, "userName")
+	assert.Equal(t, "[]\n", log.InfoString())
+}
+
+func TestYamlFormatPrintsWholeInfoWithoutTitle(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FYaml
+	log.PP("sirens", ppData, "integer")
+	assert.Equal(t, "array:\n- 5\n- 4\n- 3\ninteger: 88888\nintstring: \"111\"\nstring: string\n", log.InfoString())
+}
+
+func TestCsvFormatUsesFilterAsColumns(t *testing.T) {
+	var jsonObj interface{}
+	assert.Nil(t, json.Unmarshal([]byte(csvData), &jsonObj))
+	log := NewBufferedLogr()
+	log.Format = FCsv
+	log.PP("apps", jsonObj, "name", "missing", "description", "emails", "value", "size", "visible")
+	assert.Equal(t, "name,description,emails,size,visible\n"+
+		`olaf,,"[{""value"":""olaf@example.com""}]",3,true`+"\n"+
+		`"sven, the reindeer","says ""hi""",,,`+"\n", log.InfoString())
+}
+
+const pathData = `[
+  {"userName": "anna", "name": {"givenName": "Anna"}, "meta": {"created": "2016-03-01"},
+   "emails": [{"value": "anna@example.com"}, {"value": "queen@example.com"}]},
+  {"userName": "olaf", "emails": []}]`
+
+func filterPaths(t *testing.T, paths ...string) interface{} {
+	var data interface{}
+	assert.Nil(t, json.Unmarshal([]byte(pathData), &data))
+	return NewBufferedLogr().Filter(data, append([]string{"userName"}, paths...))
+}
+
+func TestFilterWithDottedPathIntoMap(t *testing.T) {
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"userName": "anna", "name.givenName": "Anna", "meta.created": "2016-03-01"},
+		map[string]interface{}{"userName": "olaf"}}, filterPaths(t, "name.givenName", "meta.created"))
+}
+
+func TestFilterWithIndexPaths(t *testing.T) {
+	expected := []interface{}{map[string]interface{}{"userName": "anna", "emails[1].value": "queen@example.com"},
+		map[string]interface{}{"userName": "olaf"}}
+	assert.Equal(t, expected, filterPaths(t, "emails[1].value"))
+	expected[0] = map[string]interface{}{"userName": "anna", "emails.1.value": "queen@example.com"}
+	assert.Equal(t, expected, filterPaths(t, "emails.1.value"))
+}
+
+func TestFilterWithPathThroughListUsesFirstElement(t *testing.T) {
+	assert.Equal(t, []interface{}{map[string]interface{}{"userName": "anna", "emails.value": "anna@example.com"},
+		map[string]interface{}{"userName": "olaf"}}, filterPaths(t, "emails.value"))
+}
+
+func TestFilterWithPathIntoSchemaExtension(t *testing.T) {
+	var data interface{}
+	assert.Nil(t, json.Unmarshal([]byte(`[{"userName": "anna",
+		"urn:scim:schemas:extension:workspace:1.0": {"userStatus": "LOCKED"}}, {"userName": "olaf"}]`), &data))
+	label := "urn:scim:schemas:extension:workspace:1.0.userStatus"
+	assert.Equal(t, []interface{}{map[string]interface{}{"userName": "anna", label: "LOCKED"},
+		map[string]interface{}{"userName": "olaf"}}, NewBufferedLogr().Filter(data, []string{"userName", label}))
+}
+
+func TestFilterWithMissingPaths(t *testing.T) {
+	assert.Equal(t, []interface{}{map[string]interface{}{"userName": "anna"}, map[string]interface{}{"userName": "olaf"}},
+		filterPaths(t, "name.middleName", "emails[5].value", "userName.first", "meta.created.year"))
+}
+
+func TestPathFilterInTableAndCsvFormats(t *testing.T) {
+	var data interface{}
+	assert.Nil(t, json.Unmarshal([]byte(pathData), &data))
+	log := NewBufferedLogr()
+	log.PP("Users", data, "userName", "emails.value", "name.familyName")
+	assert.Equal(t, "---- Users ----\n- emails.value: anna@example.com\n  userName: anna\n- userName: olaf\n", log.InfoString())
+	log.ClearBuffers().Format = FCsv
+	log.PP("Users", data, "userName", "emails.value", "name.familyName")
+	assert.Equal(t, "userName,emails.value,name.familyName\nanna,anna@example.com,\nolaf,,\n", log.InfoString())
+}
+
+func TestCsvFormatWithoutFilter(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FCsv
+	log.PP("sirens", ppData)
+	assert.Equal(t, "array,integer,intstring,string\n\"[5,4,3]\",88888,111,string\n", log.InfoString())
+}
+
+func TestCsvFormatEmptyList(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Format = FCsv
+	log.PP("Users", []interface{}{}, "userName")
+	assert.Empty(t, log.InfoString())
+}
+
+func TestMachineFormatsPrintMessagesToErrW(t *testing.T) {
+	for _, format := range []OutputFormat{FJson, FYaml, FCsv} {
+		log := NewBufferedLogr()
+		log.Format, log.Level = format, LDebug
+		log.Info("info message\n")
+		log.Debug("debug message\n")
+		assert.Empty(t, log.InfoString())
+		assert.Equal(t, "info message\ndebug message\n", log.ErrString())
+	}
+}
+
+func TestErrRecordsExitCode(t *testing.T) {
+	log := NewBufferedLogr()
+	assert.Equal(t, ExitOK, log.ExitCode())
+	log.Err("failed: %v\n", errors.New("boom"))
+	assert.Equal(t, ExitError, log.ExitCode())
+	log.Err("failed: %v\n", NotFound("no user %s", "olaf"))
+	assert.Equal(t, ExitNotFound, log.ExitCode())
+	log.Fail(ExitPartial)
+	log.Err("failed again\n")
+	assert.Equal(t, ExitPartial, log.ExitCode(), "most specific exit code should be kept")
+}
+
+func TestIsNotFound(t *testing.T) {
+	assert.True(t, IsNotFound(NotFound("no user")))
+	assert.True(t, IsNotFound(&StatusError{Code: 404, msg: "404 Not Found"}))
+	assert.False(t, IsNotFound(&StatusError{Code: 500, msg: "500 Internal Server Error"}))
+	assert.False(t, IsNotFound(errors.New("no user")))
+}
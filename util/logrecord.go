@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// kinds of log records, the level of messages or a result
+const (
+	recordError   = "error"
+	recordWarning = "warning"
+	recordInfo    = "info"
+	recordDebug   = "debug"
+	recordResult  = "result"
+)
+
+// Resource is an argument of messages that names a resource. It is printed
+// as the name, and log records have its type and name in separate fields.
+type Resource struct {
+	Type, Name string
+}
+
+func (r Resource) String() string {
+	return r.Name
+}
+
+// Named returns the Resource of the given SCIM type, such as Users, and name.
+func Named(resType, name string) Resource {
+	return Resource{Type: resType, Name: name}
+}
+
+// logRecord is what is written to LogW for each message or result
+type logRecord struct {
+	Time         string      `json:"time"`
+	Level        string      `json:"level"`
+	Message      string      `json:"message"`
+	ResourceType string      `json:"resourceType,omitempty"`
+	ResourceName string      `json:"resourceName,omitempty"`
+	Method       string      `json:"method,omitempty"`
+	Path         string      `json:"path,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	RequestID    string      `json:"requestId,omitempty"`
+	TraceID      string      `json:"traceId,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	Result       interface{} `json:"result,omitempty"`
+}
+
+// secretText matches credentials in messages: those of authorization
+// schemes, whose scheme is kept, and the values of keys such as password or
+// refresh_token.
+var secretText = regexp.MustCompile(`\b(Bearer|Basic|HZN) +[^\s"',]+|` +
+	`(?i)\b([\w-]*(?:password|secret|token|pwd|authorization)"?\s*[:=]\s*"?)((?-i:Bearer|Basic|HZN) +)?[^\s"',&}]+`)
+
+// redactText hides the credentials of a message
+func redactText(s string) string {
+	return secretText.ReplaceAllStringFunc(s, func(m string) string {
+		sub := secretText.FindStringSubmatch(m)
+		if sub[1] != "" {
+			return sub[1] + " " + redacted
+		}
+		return sub[2] + sub[3] + redacted
+	})
+}
+
+// newRecord returns the record of a message, with the fields of the
+// resources and errors among its args, or of a result. Secrets are hidden.
+func newRecord(kind, msg string, args []interface{}, result interface{}) *logRecord {
+	rec := &logRecord{Time: now().UTC().Format(time.RFC3339), Level: kind,
+		Message: redactText(strings.TrimSpace(msg))}
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case Resource:
+			rec.ResourceType, rec.ResourceName = a.Type, a.Name
+		case error:
+			rec.Error = redactText(strings.TrimSpace(a.Error()))
+			var status *StatusError
+			if errors.As(a, &status) {
+				rec.Method, rec.Path, rec.Status = status.Method, redactURL(status.Path), status.Code
+				rec.RequestID, rec.TraceID = status.RequestID, status.TraceID
+			}
+		}
+	}
+	if result != nil {
+		var generic interface{}
+		if b, err := json.Marshal(result); err == nil && json.Unmarshal(b, &generic) == nil {
+			rec.Result = redactJSON(generic)
+		}
+	}
+	return rec
+}
+
+// writeRecord writes a record to LogW as a JSON object or a line of text,
+// the caller holds the mutex of the log
+func (l *Logr) writeRecord(kind, msg string, args []interface{}, result interface{}) {
+	rec := newRecord(kind, msg, args, result)
+	if l.LogJSON {
+		if b, err := json.Marshal(rec); err == nil {
+			fmt.Fprintf(l.LogW, "%s\n", b)
+		}
+		return
+	}
+	line := fmt.Sprintf("%s %s %s", rec.Time, strings.ToUpper(rec.Level), rec.Message)
+	if rec.Result != nil {
+		line += "\n" + ToStringWithStyle(LYaml, rec.Result)
+	}
+	// continuation lines are indented so that each record starts with its time
+	fmt.Fprintf(l.LogW, "%s\n", strings.Replace(strings.TrimRight(line, "\n"), "\n", "\n  ", -1))
+}
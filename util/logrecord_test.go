@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"testing"
+	"time"
+)
+
+// recordingLogr returns a log that writes records to the returned buffer at
+// a fixed time, undone by the returned function
+func recordingLogr(json bool) (*Logr, *bytes.Buffer, func()) {
+	now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	log, records := NewBufferedLogr(), &bytes.Buffer{}
+	log.LogW, log.LogJSON = records, json
+	return log, records, func() { now = time.Now }
+}
+
+func TestJsonRecordHasResourceAndRequestOfError(t *testing.T) {
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users/0": ErrorHandler(404, "no such user")})
+	defer srv.Close()
+	log, records, undo := recordingLogr(true)
+	defer undo()
+	ctx := NewHttpContext(log, srv.URL, "/", "")
+	err := ctx.Request("GET", "scim/Users/0", nil, nil)
+	log.Err("Error getting user %s: %v\n", Named("Users", "sven"), err)
+	assert.Contains(t, log.ErrString(), "Error getting user sven: 404 Not Found")
+	var rec map[string]interface{}
+	assert.Nil(t, json.Unmarshal(records.Bytes(), &rec))
+	assert.Equal(t, "2020-01-02T03:04:05Z", rec["time"])
+	assert.Equal(t, "error", rec["level"])
+	assert.Equal(t, "Users", rec["resourceType"])
+	assert.Equal(t, "sven", rec["resourceName"])
+	assert.Equal(t, "GET", rec["method"])
+	assert.Equal(t, "scim/Users/0", rec["path"])
+	assert.Equal(t, float64(404), rec["status"])
+	assert.Len(t, rec["requestId"], 36)
+	assert.Contains(t, rec["error"], "404 Not Found")
+	assert.Contains(t, rec["message"], "Error getting user sven: 404 Not Found")
+}
+
+func TestRecordsHideSecrets(t *testing.T) {
+	log, records, undo := recordingLogr(true)
+	defer undo()
+	log.Info("Authorization: Bearer abc.def, refresh_token=ghi\n")
+	log.PP("client", map[string]interface{}{"clientId": "priam", "secret": "jkl"})
+	assert.Contains(t, log.InfoString(), "Bearer abc.def")
+	assert.Contains(t, log.InfoString(), "jkl")
+	assert.Equal(t, `{"time":"2020-01-02T03:04:05Z","level":"info",`+
+		`"message":"Authorization: Bearer [REDACTED], refresh_token=[REDACTED]"}`+"\n"+
+		`{"time":"2020-01-02T03:04:05Z","level":"result","message":"client",`+
+		`"result":{"clientId":"priam","secret":"[REDACTED]"}}`+"\n", records.String())
+}
+
+func TestTextRecords(t *testing.T) {
+	log, records, undo := recordingLogr(false)
+	defer undo()
+	log.Warn("no users in %s\n", "hr.yaml")
+	log.PP("user", map[string]interface{}{"userName": "sven", "pwd": "secret"})
+	assert.Equal(t, "2020-01-02T03:04:05Z WARNING no users in hr.yaml\n"+
+		"2020-01-02T03:04:05Z RESULT user\n  pwd: '[REDACTED]'\n  userName: sven\n", records.String())
+	assert.Equal(t, "WARNING: no users in hr.yaml\n", log.ErrString())
+}
+
+func TestRecordsIgnoreQuietButNotDebug(t *testing.T) {
+	log, records, undo := recordingLogr(false)
+	defer undo()
+	log.Level = LError
+	log.Info("Users created: 1\n")
+	log.Debug("GET scim/Users\n")
+	assert.Empty(t, log.InfoString())
+	assert.Equal(t, "2020-01-02T03:04:05Z INFO Users created: 1\n", records.String())
+}
+
+func TestConsoleOffOnlyWritesRecords(t *testing.T) {
+	log, records, undo := recordingLogr(false)
+	defer undo()
+	log.ConsoleOff = true
+	log.Err("Error creating user %s\n", "sven")
+	log.PP("user", "sven")
+	assert.Empty(t, log.ErrString())
+	assert.Equal(t, "---- user ----\nsven\n", log.InfoString())
+	assert.Equal(t, 1, log.ExitCode())
+	assert.Contains(t, records.String(), "ERROR Error creating user sven\n")
+}
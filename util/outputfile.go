@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// OutputFile gets the results of a command in a temporary file next to the
+// file of its name, which the temporary file replaces only when committed so
+// that the file is never left half written.
+type OutputFile struct {
+	name string
+	tmp  *os.File
+	err  error // first error writing to the temporary file
+}
+
+// CreateOutputFile starts an output file of the given name, which must not
+// exist unless overwrite is set.
+func CreateOutputFile(name string, overwrite bool) (*OutputFile, error) {
+	if _, err := os.Stat(name); err == nil && !overwrite {
+		return nil, fmt.Errorf("output file %s exists, add --overwrite to replace it", name)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create output file: %v", err)
+	}
+	return &OutputFile{name: name, tmp: tmp}, nil
+}
+
+func (f *OutputFile) Write(p []byte) (int, error) {
+	n, err := f.tmp.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// Commit replaces the file of its name with what was written, or returns
+// why it could not.
+func (f *OutputFile) Commit() error {
+	err := f.tmp.Close()
+	if f.err != nil {
+		err = f.err
+	}
+	if err == nil {
+		err = os.Chmod(f.tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.tmp.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.tmp.Name())
+		return fmt.Errorf("could not write output file %s: %v", f.name, err)
+	}
+	return nil
+}
+
+// Discard removes what was written, the file of its name is left as it was.
+func (f *OutputFile) Discard() {
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+}
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputFileIsOnlyWrittenWhenCommitted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-output")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "report.csv")
+	f, err := CreateOutputFile(name, false)
+	require.Nil(t, err)
+	fmt.Fprint(f, "a,b\n")
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, f.Commit())
+	content, err := ioutil.ReadFile(name)
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b\n", string(content))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary file should be renamed")
+}
+
+func TestOutputFileExistsWithoutOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-output")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "report.csv")
+	require.Nil(t, ioutil.WriteFile(name, []byte("old"), 0644))
+	_, err = CreateOutputFile(name, false)
+	assert.Contains(t, err.Error(), "exists, add --overwrite to replace it")
+
+	f, err := CreateOutputFile(name, true)
+	require.Nil(t, err)
+	fmt.Fprint(f, "new")
+	f.Discard()
+	content, _ := ioutil.ReadFile(name)
+	assert.Equal(t, "old", string(content))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary file should be removed")
+}
+
+func TestOutputFileReportsWriteErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priam-output")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	f, err := CreateOutputFile(filepath.Join(dir, "report.csv"), false)
+	require.Nil(t, err)
+	f.tmp.Close()
+	fmt.Fprint(f, "lost")
+	assert.Contains(t, f.Commit().Error(), "could not write output file")
+}
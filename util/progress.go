@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ProgressEvery and ProgressInterval set how often a progress line is
+// printed when ErrW is not a terminal: after the given number of items or
+// time, whichever comes first.
+var (
+	ProgressEvery    = 100
+	ProgressInterval = 10 * time.Second
+)
+
+// progressRedraw is how often the line displayed in place on a terminal is updated
+const progressRedraw = 100 * time.Millisecond
+
+// isTerminal returns true if w is a terminal, replaced by tests
+var isTerminal = func(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress reports how many of the items of a bulk command are processed,
+// with the rate and the estimated time left. On a terminal the report is a
+// line on ErrW that is updated in place and that messages are printed over,
+// otherwise a line is printed from time to time. A nil Progress reports
+// nothing, so that callers need not check whether progress is shown.
+type Progress struct {
+	log         *Logr
+	label       string
+	total, done int
+	tty, shown  bool
+	start       time.Time
+	printed     time.Time // when the last line was printed or drawn
+	printedDone int       // items done when the last line was printed
+}
+
+// StartProgress returns the progress of a command that processes total
+// items, nil if messages are not printed on the console because of --quiet
+// or because results are printed for other tools to parse.
+func (l *Logr) StartProgress(label string, total int) *Progress {
+	if total <= 0 || !l.Enabled(LInfo) || l.MachineFormat() || l.ConsoleOff {
+		return nil
+	}
+	t := now()
+	p := &Progress{log: l, label: label, total: total, tty: isTerminal(l.ErrW), start: t, printed: t}
+	l.mutex.Lock()
+	l.progress = p
+	l.mutex.Unlock()
+	return p
+}
+
+// Add records that n more items are processed.
+func (p *Progress) Add(n int) {
+	if p == nil {
+		return
+	}
+	p.log.mutex.Lock()
+	defer p.log.mutex.Unlock()
+	p.done += n
+	t := now()
+	if p.tty {
+		if p.done >= p.total || t.Sub(p.printed) >= progressRedraw {
+			p.draw(t)
+		}
+	} else if p.done-p.printedDone >= ProgressEvery || t.Sub(p.printed) >= ProgressInterval {
+		fmt.Fprintln(p.log.ErrW, p.line(t))
+		p.printed, p.printedDone = t, p.done
+	}
+}
+
+// Finish removes the line displayed in place, the summary of the command
+// is printed after.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.log.mutex.Lock()
+	defer p.log.mutex.Unlock()
+	p.clear()
+	if p.log.progress == p {
+		p.log.progress = nil
+	}
+}
+
+// line returns e.g. "Users: 120/1000 (12%), 8.5/s, ETA 1m43s"
+func (p *Progress) line(t time.Time) string {
+	s := fmt.Sprintf("%s: %d/%d (%d%%)", p.label, p.done, p.total, p.done*100/p.total)
+	elapsed := t.Sub(p.start).Seconds()
+	if p.done == 0 || elapsed <= 0 {
+		return s
+	}
+	rate := float64(p.done) / elapsed
+	eta := time.Duration(float64(p.total-p.done) / rate * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("%s, %.1f/s, ETA %v", s, rate, eta)
+}
+
+// draw displays the line in place, the caller holds the mutex of the log
+func (p *Progress) draw(t time.Time) {
+	if p == nil || !p.tty {
+		return
+	}
+	fmt.Fprintf(p.log.ErrW, "\r%s\x1b[K", p.line(t))
+	p.printed, p.shown = t, true
+}
+
+// clear removes the line displayed in place and returns true if there was
+// one, the caller holds the mutex of the log
+func (p *Progress) clear() bool {
+	if p == nil || !p.shown {
+		return false
+	}
+	fmt.Fprint(p.log.ErrW, "\r\x1b[K")
+	p.shown = false
+	return true
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+// stubProgress makes the log a terminal or not and returns a clock that
+// tests advance, undone by the returned function
+func stubProgress(terminal bool) (clock *time.Time, undo func()) {
+	t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return t }
+	isTerminal = func(io.Writer) bool { return terminal }
+	return &t, func() {
+		now, isTerminal = time.Now, func(w io.Writer) bool { return false }
+	}
+}
+
+func TestProgressPrintsLinesWhenNotTerminal(t *testing.T) {
+	clock, undo := stubProgress(false)
+	defer undo()
+	defer func(every int) { ProgressEvery = every }(ProgressEvery)
+	ProgressEvery = 2
+	log := NewBufferedLogr()
+	p := log.StartProgress("Users", 5)
+	for i := 0; i < 4; i++ {
+		*clock = clock.Add(time.Second)
+		p.Add(1)
+	}
+	p.Finish()
+	assert.Equal(t, "Users: 2/5 (40%), 1.0/s, ETA 3s\nUsers: 4/5 (80%), 1.0/s, ETA 1s\n", log.ErrString())
+	assert.Empty(t, log.InfoString())
+}
+
+func TestProgressPrintsLineAfterInterval(t *testing.T) {
+	clock, undo := stubProgress(false)
+	defer undo()
+	log := NewBufferedLogr()
+	p := log.StartProgress("Users", 1000)
+	p.Add(1)
+	*clock = clock.Add(ProgressInterval)
+	p.Add(1)
+	assert.Equal(t, "Users: 2/1000 (0%), 0.2/s, ETA 1h23m10s\n", log.ErrString())
+}
+
+func TestProgressIsUpdatedInPlaceOnTerminal(t *testing.T) {
+	clock, undo := stubProgress(true)
+	defer undo()
+	log := NewBufferedLogr()
+	p := log.StartProgress("Users", 4)
+	*clock = clock.Add(time.Second)
+	p.Add(1)
+	p.Add(1) // not drawn, too soon after the last update
+	*clock = clock.Add(time.Second)
+	log.Err("Error creating user %s\n", "sven")
+	p.Add(2)
+	p.Finish()
+	assert.Equal(t, "\rUsers: 1/4 (25%), 1.0/s, ETA 3s\x1b[K"+
+		"\r\x1b[KError creating user sven\n\rUsers: 2/4 (50%), 1.0/s, ETA 2s\x1b[K"+
+		"\rUsers: 4/4 (100%), 2.0/s, ETA 0s\x1b[K\r\x1b[K", log.ErrString())
+}
+
+func TestMessagesAreNotClearedAfterProgressFinishes(t *testing.T) {
+	_, undo := stubProgress(true)
+	defer undo()
+	log := NewBufferedLogr()
+	p := log.StartProgress("Users", 1)
+	p.Add(1)
+	p.Finish()
+	log.Info("Users created: 1\n")
+	assert.Equal(t, "\rUsers: 1/1 (100%)\x1b[K\r\x1b[K", log.ErrString())
+	assert.Equal(t, "Users created: 1\n", log.InfoString())
+}
+
+func TestProgressIsNotShownWhenQuietOrMachineFormat(t *testing.T) {
+	_, undo := stubProgress(true)
+	defer undo()
+	for _, log := range []*Logr{{Level: LError}, {Format: FJson}} {
+		log.ClearBuffers()
+		p := log.StartProgress("Users", 1)
+		assert.Nil(t, p)
+		p.Add(1)
+		p.Finish()
+		assert.Empty(t, log.ErrString())
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Query selects values from results, either with a dotted path such as
+// emails.0.value or with a Go template such as "{{.id}} {{.userName}}".
+// Queries on a list of results are applied to each element, unless the
+// path starts with an index.
+type Query struct {
+	text     string
+	path     []string
+	template *template.Template
+	Strict   bool // a query that selects nothing is an error
+}
+
+// ParseQuery returns the query for the given text, which is a template if
+// it contains "{{".
+func ParseQuery(text string) (*Query, error) {
+	q := &Query{text: text}
+	if strings.Contains(text, "{{") {
+		tmpl, err := template.New("query").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query template: %v", err)
+		}
+		q.template = tmpl
+	} else if text = strings.Trim(strings.TrimSpace(text), "."); text != "" {
+		q.path = strings.Split(text, ".")
+	}
+	return q, nil
+}
+
+// lookup returns the value at the path in the given data, false if there is none
+func lookup(data interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			v, ok := d[key]
+			if !ok {
+				return nil, false
+			}
+			data = v
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, false
+			}
+			data = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// IsPathLabel returns true if a summary label is a path to a nested value
+// such as name.givenName or emails[0].value rather than a key.
+func IsPathLabel(label string) bool {
+	return strings.ContainsAny(label, ".[")
+}
+
+// lookupLabel returns the value at a path label in the given data. A list on
+// the path is indexed by a number, such as emails.0.value or emails[0].value,
+// or else its first element is used, such as emails.value. A path may start
+// with the URN of a schema extension, which may contain dots, such as
+// urn:scim:schemas:extension:workspace:1.0.userStatus.
+func lookupLabel(data interface{}, label string) (interface{}, bool) {
+	if m, ok := data.(map[string]interface{}); ok && strings.HasPrefix(label, "urn:") {
+		for key, value := range m {
+			if strings.HasPrefix(label, key+".") {
+				data, label = value, label[len(key)+1:]
+				break
+			}
+		}
+	}
+	label = strings.NewReplacer("[", ".", "]", "").Replace(label)
+	for _, key := range strings.Split(strings.Trim(label, "."), ".") {
+		if list, ok := data.([]interface{}); ok && !isIndex(key) {
+			if len(list) == 0 {
+				return nil, false
+			}
+			data = list[0]
+		}
+		var ok bool
+		if data, ok = lookupFold(data, []string{key}); !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func queryValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprintf("%v", v)
+	}
+	content, _ := json.Marshal(value)
+	return string(content)
+}
+
+// selectOne returns the selected value of one result, false if there is none
+func (q *Query) selectOne(data interface{}) (string, bool) {
+	if q.template == nil {
+		value, ok := lookup(data, q.path)
+		return queryValueString(value), ok
+	}
+	buf := &bytes.Buffer{}
+	if err := q.template.Execute(buf, data); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// Select returns the selected values, one per result, and the number of
+// results for which the query selected nothing. Results are converted as
+// for JSON output so that values are selected by their JSON names.
+func (q *Query) Select(info interface{}) (values []string, misses int) {
+	var data interface{}
+	if content, err := json.Marshal(info); err != nil || json.Unmarshal(content, &data) != nil {
+		data = info
+	}
+	items, isList := data.([]interface{})
+	if !isList || len(q.path) > 0 && isIndex(q.path[0]) {
+		items = []interface{}{data}
+	}
+	for _, item := range items {
+		value, ok := q.selectOne(item)
+		if !ok {
+			misses++
+		}
+		values = append(values, value)
+	}
+	return
+}
+
+func isIndex(key string) bool {
+	_, err := strconv.Atoi(key)
+	return err == nil
+}
+
+// SortByPath sorts items by the value at a path label of each, as SCIM
+// sorts by an attribute: names and strings ignore case, numbers are compared
+// by value, dates by time and items without the value are last, or first if
+// descending. It returns false if the items were already sorted.
+func SortByPath(items []interface{}, path string, descending bool) bool {
+	less := func(i, j int) bool {
+		a, aok := lookupLabel(items[i], path)
+		b, bok := lookupLabel(items[j], path)
+		aok, bok = aok && a != nil, bok && b != nil
+		if !aok || !bok {
+			return aok != descending && bok == descending
+		}
+		if descending {
+			a, b = b, a
+		}
+		return lessValue(a, b)
+	}
+	if sort.SliceIsSorted(items, less) {
+		return false
+	}
+	sort.SliceStable(items, less)
+	return true
+}
+
+// lookupFold is lookup with map keys that ignore case, like SCIM attribute
+// names, and where a null value is none.
+func lookupFold(data interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		if m, ok := data.(map[string]interface{}); ok {
+			for k := range m {
+				if _, exact := m[key]; !exact && strings.EqualFold(k, key) {
+					key = k
+				}
+			}
+		}
+		var ok bool
+		if data, ok = lookup(data, []string{key}); !ok {
+			return nil, false
+		}
+	}
+	return data, data != nil
+}
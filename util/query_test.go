@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const queryUsers = `[{"id": "1", "userName": "olaf", "active": true,
+	"meta": {"created": "2016-01-01"}, "emails": [{"value": "olaf@example.com"}]},
+	{"id": "2", "userName": "sven"}]`
+
+func queryData(t *testing.T, data string) (v interface{}) {
+	require.Nil(t, json.Unmarshal([]byte(data), &v))
+	return
+}
+
+func selectValues(t *testing.T, query string, data interface{}) ([]string, int) {
+	q, err := ParseQuery(query)
+	require.Nil(t, err)
+	return q.Select(data)
+}
+
+func TestQueryPathOnEachResult(t *testing.T) {
+	users := queryData(t, queryUsers)
+	for query, expected := range map[string][]string{
+		"id":             {"1", "2"},
+		"meta.created":   {"2016-01-01", ""},
+		"emails.0.value": {"olaf@example.com", ""},
+		"active":         {"true", ""},
+		"emails":         {`[{"value":"olaf@example.com"}]`, ""},
+		"1.userName":     {"sven"},
+	} {
+		values, _ := selectValues(t, query, users)
+		assert.Equal(t, expected, values, query)
+	}
+}
+
+func TestQueryCountsMisses(t *testing.T) {
+	values, misses := selectValues(t, "meta.created", queryData(t, queryUsers))
+	assert.Equal(t, []string{"2016-01-01", ""}, values)
+	assert.Equal(t, 1, misses)
+	_, misses = selectValues(t, "5.id", queryData(t, queryUsers))
+	assert.Equal(t, 1, misses)
+	_, misses = selectValues(t, "id", queryData(t, queryUsers))
+	assert.Equal(t, 0, misses)
+}
+
+func TestQueryTemplate(t *testing.T) {
+	values, misses := selectValues(t, "{{.id}} {{.userName}}", queryData(t, queryUsers))
+	assert.Equal(t, []string{"1 olaf", "2 sven"}, values)
+	assert.Equal(t, 0, misses)
+	values, misses = selectValues(t, "{{.meta.created}}", queryData(t, queryUsers))
+	assert.Equal(t, []string{"2016-01-01", ""}, values)
+	assert.Equal(t, 1, misses)
+}
+
+func TestQueryOnStructUsesJsonNames(t *testing.T) {
+	values, _ := selectValues(t, "name", struct {
+		Name string `json:"name"`
+	}{"olaf"})
+	assert.Equal(t, []string{"olaf"}, values)
+}
+
+func TestInvalidQueryTemplate(t *testing.T) {
+	_, err := ParseQuery("{{.id")
+	assert.Contains(t, err.Error(), "invalid query template")
+}
+
+func TestPPWithQuery(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Query, _ = ParseQuery("userName")
+	log.Info("message\n")
+	log.PP("Users", queryData(t, queryUsers), "id")
+	assert.Equal(t, "olaf\nsven\n", log.InfoString())
+	assert.Equal(t, "message\n", log.ErrString(), "messages should not mix with selected values")
+	assert.Equal(t, 0, log.ExitCode())
+}
+
+func TestPPWithStrictQuery(t *testing.T) {
+	log := NewBufferedLogr()
+	log.Query, _ = ParseQuery("meta.created")
+	log.Query.Strict = true
+	log.PP("Users", queryData(t, queryUsers))
+	assert.Equal(t, "2016-01-01\n\n", log.InfoString())
+	assert.Equal(t, "Query \"meta.created\" selected nothing in 1 of 2 results\n", log.ErrString())
+	assert.Equal(t, 1, log.ExitCode())
+}
+
+func TestSortByPath(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"name": "b", "meta": map[string]interface{}{"version": 10.0}},
+		map[string]interface{}{"name": "C", "meta": map[string]interface{}{"version": 9.0}},
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": nil, "meta": map[string]interface{}{"version": 2.0}}}
+	names := func() (names []interface{}) {
+		for _, item := range items {
+			names = append(names, item.(map[string]interface{})["name"])
+		}
+		return
+	}
+	assert.True(t, SortByPath(items, "Name", false))
+	assert.Equal(t, []interface{}{"a", "b", "C", nil}, names())
+	assert.False(t, SortByPath(items, "name", false))
+	assert.True(t, SortByPath(items, "name", true))
+	assert.Equal(t, []interface{}{nil, "C", "b", "a"}, names())
+	assert.False(t, SortByPath(items, "meta.version", false))
+	assert.True(t, SortByPath(items, "meta.version", true))
+	assert.Equal(t, []interface{}{"a", "b", "C", nil}, names())
+}
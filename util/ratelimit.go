@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces requests so that at most a given number are sent per
+// second. It is a token bucket that holds a single token, so requests are
+// never sent in bursts, and it is shared by the copies of a context so that
+// the rate applies to all the requests of a command.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time // when the next token is available
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait waits until a request may be sent, unless the context is done first
+func (l *rateLimiter) wait(c context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mutex.Unlock()
+	if at.Equal(now) {
+		return nil
+	}
+	// not the sleep of retries, which tests replace to avoid waiting
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-c.Done():
+		return c.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SetRate limits the requests sent with this context and its copies to the
+// given number per second, including the requests that are retried. There
+// is no limit if perSecond is 0 or less.
+func (ctx *HttpContext) SetRate(perSecond float64) *HttpContext {
+	ctx.limiter = nil
+	if perSecond > 0 {
+		ctx.limiter = newRateLimiter(perSecond)
+	}
+	return ctx
+}
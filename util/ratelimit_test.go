@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// timedServer records when it receives requests, and fails the first ones
+// with the given status.
+func timedServer(failures, status int) (*httptest.Server, func() []time.Time) {
+	var mutex sync.Mutex
+	times := []time.Time{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		times = append(times, time.Now())
+		calls := len(times)
+		mutex.Unlock()
+		if calls <= failures {
+			http.Error(w, "slow down", status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return srv, func() []time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		return times
+	}
+}
+
+// assertSpacing asserts that requests were received about interval apart,
+// with some slack since the first request also opens the connection.
+func assertSpacing(t *testing.T, times []time.Time, interval time.Duration) {
+	for i := 1; i < len(times); i++ {
+		assert.True(t, times[i].Sub(times[i-1]) >= interval*3/4,
+			"request %d was sent %v after the previous one", i, times[i].Sub(times[i-1]))
+	}
+}
+
+func TestRateLimitSpacesRequestsOfAllCopies(t *testing.T) {
+	srv, times := timedServer(0, 0)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").SetRate(20)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func(ctx *HttpContext) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				output := ""
+				assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+			}
+		}(ctx.Clone())
+	}
+	wg.Wait()
+	require.Len(t, times(), 9)
+	assertSpacing(t, times(), 50*time.Millisecond)
+}
+
+func TestRateLimitAppliesToRetries(t *testing.T) {
+	defer restoreSleep()
+	waits := stubSleep()
+	srv, times := timedServer(2, 429)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").SetRate(10)
+	output := ""
+	assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+	assert.Len(t, *waits, 2, "retries do not wait for the backoff when sleep is stubbed")
+	require.Len(t, times(), 3)
+	assertSpacing(t, times(), 100*time.Millisecond)
+}
+
+func TestRateLimitStopsWaitingWhenCanceled(t *testing.T) {
+	srv, times := timedServer(0, 0)
+	defer srv.Close()
+	cmdContext, cancel := context.WithCancel(context.Background())
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").SetRate(0.1).WithContext(cmdContext)
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	assert.Equal(t, ErrCanceled, ctx.Request("GET", "/", nil, nil))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Len(t, times(), 1)
+}
+
+func TestNoRateLimitByDefault(t *testing.T) {
+	ctx := NewHttpContext(NewBufferedLogr(), "", "", "").SetRate(0)
+	assert.Nil(t, ctx.limiter)
+	assert.Nil(t, ctx.limiter.wait(context.Background()))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reauthorizer gets a new access token. It returns the value of the
+// Authorization header to use with it, and when it expires, zero if unknown.
+type Reauthorizer func() (authorization string, expiry time.Time, err error)
+
+// RefreshMargin is how long before it expires an access token is renewed,
+// so that it does not expire while a request is sent.
+const RefreshMargin = 30 * time.Second
+
+// RenewalBackoff is how long after the access token could not be renewed it
+// is not tried again, so that the requests of a bulk command do not each
+// ask for a token that is refused.
+const RenewalBackoff = time.Minute
+
+// tokenRenewal is shared by the copies of a context so that they renew the
+// access token one at a time, and only once when it expires.
+type tokenRenewal struct {
+	mutex         sync.Mutex
+	reauthorize   Reauthorizer
+	authorization string // of the last access token got, "" if none yet
+	expiry        time.Time
+	failed        error     // why the access token could not be renewed last, nil if it was
+	retryAt       time.Time // when it is tried again after it failed
+}
+
+// SetReauthorizer makes requests renew the access token shortly before it
+// expires, and renew it once and send the request again if it is refused
+// with 401 Unauthorized, including the first request of a command whose
+// stored token already expired. If the token cannot be renewed, the error
+// of the request says why. Copies of the context made afterwards share the
+// renewed tokens.
+func (ctx *HttpContext) SetReauthorizer(expiry time.Time, reauthorize Reauthorizer) *HttpContext {
+	ctx.tokenExpiry, ctx.renewal = expiry, nil
+	if reauthorize != nil {
+		ctx.renewal = &tokenRenewal{reauthorize: reauthorize}
+	}
+	return ctx
+}
+
+// SetAuthorizationHint makes the errors of requests refused with 401 or 403
+// give the hint that the function returns for the path and status code of
+// the request, such as the scope that the access token likely lacks.
+func (ctx *HttpContext) SetAuthorizationHint(hint func(ctx *HttpContext, path string, code int) string) *HttpContext {
+	ctx.authHint = hint
+	return ctx
+}
+
+// refreshIfExpiring renews the access token if it expires soon, and returns
+// why it could not. The request is still sent, the token may be valid long
+// enough.
+func (ctx *HttpContext) refreshIfExpiring() error {
+	if ctx.renewal == nil || ctx.tokenExpiry.IsZero() || now().Add(RefreshMargin).Before(ctx.tokenExpiry) {
+		return nil
+	}
+	ctx.Log.Debug("access token expires at %s, getting a new one\n", ctx.tokenExpiry.Format(time.RFC3339))
+	err := ctx.renewToken()
+	if err != nil {
+		ctx.Log.Debug("%v\n", err)
+	}
+	return err
+}
+
+// renewToken gets a new access token, unless another copy of the context
+// got one since this copy got its own. If it failed less than RenewalBackoff
+// ago, it fails again with the same error without asking for one.
+func (ctx *HttpContext) renewToken() error {
+	r := ctx.renewal
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.authorization == "" || r.authorization == ctx.headers["Authorization"] {
+		if r.failed != nil && now().Before(r.retryAt) {
+			return r.failed
+		}
+		authorization, expiry, err := r.reauthorize()
+		if err != nil {
+			r.failed, r.retryAt = fmt.Errorf("could not renew the access token: %v", err), now().Add(RenewalBackoff)
+			return r.failed
+		}
+		r.authorization, r.expiry, r.failed = authorization, expiry, nil
+	}
+	ctx.Authorization(r.authorization)
+	ctx.tokenExpiry = r.expiry
+	return nil
+}
+
+// now is a variable so that tests can make tokens expire
+var now = time.Now
@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer accepts requests authorized with one of the valid tokens,
+// and counts the requests that were applied
+func tokenServer(valid map[string]bool, applied *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !valid[r.Header.Get("Authorization")] {
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		}
+		*applied++
+		io.WriteString(w, "ok")
+	}))
+}
+
+// renewer returns a Reauthorizer that counts its calls and returns tokens
+// numbered by the calls that expire after validity, or do not expire if 0.
+func renewer(validity time.Duration, err error) (Reauthorizer, *int) {
+	calls := 0
+	return func() (string, time.Time, error) {
+		calls++
+		expiry := time.Time{}
+		if validity > 0 {
+			expiry = now().Add(validity)
+		}
+		return fmt.Sprintf("Bearer token%d", calls), expiry, err
+	}, &calls
+}
+
+func TestRequestRenewsTokenRefusedWith401(t *testing.T) {
+	applied := 0
+	srv := tokenServer(map[string]bool{"Bearer token1": true}, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(time.Hour, nil)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale")
+	ctx.SetReauthorizer(time.Time{}, reauthorize)
+	output := ""
+	assert.Nil(t, ctx.Request("POST", "/", "{}", &output))
+	assert.Equal(t, "ok", output)
+	assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, 2, applied)
+}
+
+func TestRequestRenewsTokenOnlyOnce(t *testing.T) {
+	applied := 0
+	srv := tokenServer(map[string]bool{}, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(time.Hour, nil)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale")
+	ctx.SetReauthorizer(time.Time{}, reauthorize)
+	assert.Contains(t, ctx.Request("POST", "/", "{}", nil).Error(), "401 Unauthorized")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestClonesRenewTokenOnlyOnce(t *testing.T) {
+	var calls, applied int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&applied, 1)
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale").
+		SetReauthorizer(time.Time{}, func() (string, time.Time, error) {
+			atomic.AddInt32(&calls, 1)
+			return "Bearer fresh", time.Time{}, nil
+		})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(ctx *HttpContext) {
+			defer wg.Done()
+			assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+		}(ctx.Clone())
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(20), applied)
+}
+
+func TestRequestFailsIfTokenCannotBeRenewed(t *testing.T) {
+	applied := 0
+	srv := tokenServer(map[string]bool{}, &applied)
+	defer srv.Close()
+	reauthorize, _ := renewer(time.Hour, errors.New("invalid_client"))
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale")
+	ctx.SetReauthorizer(time.Time{}, reauthorize)
+	err := ctx.Request("GET", "/", nil, nil)
+	assert.IsType(t, &StatusError{}, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+	assert.Contains(t, err.Error(), "\ncould not renew the access token: invalid_client")
+}
+
+func TestExpiredTokenThatCannotBeRenewedIsRenewedOnlyOnce(t *testing.T) {
+	defer func() { now = time.Now }()
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	applied := 0
+	srv := tokenServer(map[string]bool{}, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(time.Hour, errors.New("invalid_grant"))
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale")
+	ctx.SetReauthorizer(clock.Add(-time.Hour), reauthorize)
+	ctx.SetAuthorizationHint(func(ctx *HttpContext, path string, code int) string {
+		return fmt.Sprintf("log in again, %s got %d", path, code)
+	})
+	err := ctx.Request("GET", "/", nil, nil)
+	assert.Equal(t, 1, *calls)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "\ncould not renew the access token: invalid_grant\nhint: log in again, / got 401")
+	}
+}
+
+func TestTokenThatCannotBeRenewedIsNotRenewedForEachRequest(t *testing.T) {
+	defer func() { now = time.Now }()
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	applied := 0
+	srv := tokenServer(map[string]bool{"Bearer stale": true}, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(time.Hour, errors.New("invalid_grant"))
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer stale")
+	ctx.SetReauthorizer(clock.Add(10*time.Second), reauthorize)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, ctx.Request("POST", "/", "{}", nil))
+	}
+	assert.Equal(t, 10, applied)
+	assert.Equal(t, 1, *calls)
+
+	clock = clock.Add(RenewalBackoff)
+	assert.Nil(t, ctx.Request("POST", "/", "{}", nil))
+	assert.Equal(t, 2, *calls, "the token is renewed again after the backoff")
+}
+
+func TestTokenIsRenewedBeforeItExpires(t *testing.T) {
+	defer func() { now = time.Now }()
+	clock := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	applied := 0
+	srv := tokenServer(map[string]bool{"Bearer token0": true, "Bearer token1": true, "Bearer token2": true}, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(10*time.Minute, nil)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer token0")
+	ctx.SetReauthorizer(clock.Add(10*time.Minute), reauthorize)
+
+	// a request every minute for 25 minutes, tokens are renewed 30s before they expire
+	for i := 0; i < 25; i++ {
+		assert.Nil(t, ctx.Request("POST", "/", "{}", nil))
+		clock = clock.Add(time.Minute)
+	}
+	assert.Equal(t, 25, applied)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestTokenRevokedMidwayIsRenewed(t *testing.T) {
+	applied := 0
+	valid := map[string]bool{"Bearer token0": true}
+	srv := tokenServer(valid, &applied)
+	defer srv.Close()
+	reauthorize, calls := renewer(0, nil)
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Authorization("Bearer token0")
+	ctx.SetReauthorizer(time.Time{}, reauthorize)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			valid["Bearer token0"], valid["Bearer token1"] = false, true
+		}
+		assert.Nil(t, ctx.Request("POST", "/", "{}", nil))
+	}
+	assert.Equal(t, 10, applied)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestRequestWithoutResponseMayHaveBeenApplied(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	err := ctx.Request("POST", "/", "{}", nil)
+	assert.IsType(t, &UncertainError{}, err)
+	assert.Contains(t, err.Error(), "the POST request may or may not have been applied, check before sending it again")
+}
+
+func TestRequestThatCouldNotBeSentWasNotApplied(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	err := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Request("POST", "/", "{}", nil)
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "may or may not have been applied")
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pborman/uuid"
+)
+
+// RequestIDHeader is sent with each request, with an ID that is unique to
+// the call so that the logs of the client and server can be lined up. The
+// retries of a call are sent with the same ID.
+const RequestIDHeader = "X-Request-Id"
+
+// headers of responses that may have the ID of the server trace of a request
+var traceIDHeaders = []string{"X-Trace-Id", "X-B3-TraceId", "X-Correlation-Id", "Traceparent"}
+
+var newRequestID = uuid.New // called via variable so that tests can provide stub
+
+// serverTraceID returns the trace or correlation ID of the server in the
+// headers of a response, or the request ID the server used if it is not the
+// one that was sent, or "" if there is none.
+func serverTraceID(hdrs http.Header, requestID string) string {
+	for _, name := range traceIDHeaders {
+		if id := strings.TrimSpace(hdrs.Get(name)); id != "" {
+			return id
+		}
+	}
+	if id := strings.TrimSpace(hdrs.Get(RequestIDHeader)); id != requestID {
+		return id
+	}
+	return ""
+}
+
+// requestIDs describes the request ID and server trace ID of a request,
+// which support can search their logs with.
+func requestIDs(requestID, traceID string) string {
+	if requestID == "" {
+		return ""
+	}
+	if traceID == "" {
+		return fmt.Sprintf("request id %s", requestID)
+	}
+	return fmt.Sprintf("request id %s, server trace id %s", requestID, traceID)
+}
+
+// withRequestIDs adds the IDs at the end of the message of an error, on a
+// line of their own if the message ends with a new line.
+func withRequestIDs(msg, ids string) string {
+	if ids == "" {
+		return msg
+	}
+	if strings.HasSuffix(msg, "\n") {
+		return msg + "(" + ids + ")\n"
+	}
+	return msg + " (" + ids + ")"
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestsAreSentWithUniqueIDs(t *testing.T) {
+	var ids []string
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		ids = append(ids, req.Header.Get(RequestIDHeader))
+		return &TstReply{Output: `{}`}
+	}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	assert.Nil(t, ctx.Request("GET", "scim/Users", nil, nil))
+	assert.Nil(t, ctx.Request("GET", "scim/Users", nil, nil))
+	if assert.Len(t, ids, 2) {
+		assert.Len(t, ids[0], 36)
+		assert.NotEqual(t, ids[0], ids[1])
+	}
+}
+
+func TestRetriesAreSentWithTheSameRequestID(t *testing.T) {
+	var ids []string
+	srv := StartTstServer(t, map[string]TstHandler{"GET/scim/Users": func(t *testing.T, req *TstReq) *TstReply {
+		if ids = append(ids, req.Header.Get(RequestIDHeader)); len(ids) == 1 {
+			return &TstReply{Status: 503, Header: http.Header{"Retry-After": {"0"}}}
+		}
+		return &TstReply{Output: `{}`}
+	}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	assert.Nil(t, ctx.Request("GET", "scim/Users", nil, nil))
+	if assert.Len(t, ids, 2) {
+		assert.Equal(t, ids[0], ids[1])
+	}
+}
+
+func TestErrorsHaveRequestAndServerTraceIDs(t *testing.T) {
+	newRequestID = func() string { return "req-1" }
+	defer func() { newRequestID = uuid.New }()
+	srv := StartTstServer(t, map[string]TstHandler{
+		"DELETE/scim/Users/1": func(t *testing.T, req *TstReq) *TstReply {
+			return &TstReply{Status: 409, Output: `{"detail": "user is locked"}`, ContentType: "application/json",
+				Header: http.Header{"X-Trace-Id": {"trace-7"}}}
+		},
+		"DELETE/scim/Users/2": func(t *testing.T, req *TstReq) *TstReply {
+			return &TstReply{Status: 500, Header: http.Header{RequestIDHeader: {"lb-42"}}}
+		},
+	})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	err := ctx.Request("DELETE", "scim/Users/1", nil, nil)
+	assert.EqualError(t, err, "409 Conflict: user is locked (request id req-1, server trace id trace-7)")
+	assert.Equal(t, "trace-7", err.(*StatusError).TraceID)
+	err = ctx.Request("DELETE", "scim/Users/2", nil, nil)
+	assert.Contains(t, err.Error(), "(request id req-1, server trace id lb-42)")
+}
+
+func TestUncertainErrorHasRequestID(t *testing.T) {
+	newRequestID = func() string { return "req-1" }
+	defer func() { newRequestID = uuid.New }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer srv.Close()
+	err := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").Request("POST", "/", "{}", nil)
+	assert.Contains(t, err.Error(), " (request id req-1)\nthe POST request may or may not have been applied")
+}
+
+func TestServerTraceIDOfResponseHeaders(t *testing.T) {
+	assert.Equal(t, "", serverTraceID(http.Header{}, "req-1"))
+	assert.Equal(t, "", serverTraceID(http.Header{RequestIDHeader: {"req-1"}}, "req-1"))
+	assert.Equal(t, "b3", serverTraceID(http.Header{"X-B3-Traceid": {"b3"}, RequestIDHeader: {"lb"}}, "req-1"))
+	assert.Equal(t, "corr", serverTraceID(http.Header{"X-Correlation-Id": {" corr "}}, "req-1"))
+}
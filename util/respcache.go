@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type cachedResponse struct {
+	path                            string // URL without its query, see invalidate
+	etag, lastModified, contentType string
+	body                            []byte
+}
+
+// ResponseCache remembers the responses of GET requests that have an ETag
+// or Last-Modified header, so that the same GET is sent again with
+// If-None-Match or If-Modified-Since and the server can answer 304 Not
+// Modified rather than send the whole response again. It is kept in memory
+// for one command, shared by the copies of a context, and safe to use from
+// concurrent requests.
+type ResponseCache struct {
+	mutex       sync.Mutex
+	responses   map[string]*cachedResponse
+	hits, sends int
+}
+
+func NewResponseCache() *ResponseCache {
+	return &ResponseCache{responses: make(map[string]*cachedResponse)}
+}
+
+// SetCache makes the GET requests of the context and its copies use the
+// given cache, or no cache if it is nil.
+func (ctx *HttpContext) SetCache(cache *ResponseCache) *HttpContext {
+	ctx.cache = cache
+	return ctx
+}
+
+// Stats returns how many GET requests were answered from the cache, and how
+// many were sent conditionally.
+func (c *ResponseCache) Stats() (hits, conditional int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.sends
+}
+
+// responseKey is the URL and media type of a response, since the same URL
+// may return different representations.
+func responseKey(url string, reqHeaders map[string]string) string {
+	return url + " " + reqHeaders["Accept"]
+}
+
+func urlPath(url string) string {
+	return strings.TrimSuffix(strings.SplitN(url, "?", 2)[0], "/")
+}
+
+// conditional returns the cached response of a GET request, if any, and the
+// headers to send the request with so that the server answers 304 if the
+// cached response is still current.
+func (c *ResponseCache) conditional(method, url string, reqHeaders map[string]string) (*cachedResponse,
+	map[string]string) {
+	if c == nil || method != "GET" {
+		return nil, reqHeaders
+	}
+	c.mutex.Lock()
+	cached := c.responses[responseKey(url, reqHeaders)]
+	if cached != nil {
+		c.sends++
+	}
+	c.mutex.Unlock()
+	if cached == nil {
+		return nil, reqHeaders
+	}
+	headers := copyHeaders(reqHeaders)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if cached.etag != "" {
+		headers["If-None-Match"] = cached.etag
+	} else {
+		headers["If-Modified-Since"] = cached.lastModified
+	}
+	return cached, headers
+}
+
+// update replaces a 304 response by the cached one, and remembers a
+// successful response to a GET if it can be validated later.
+func (c *ResponseCache) update(log *Logr, method, url string, reqHeaders map[string]string,
+	cached *cachedResponse, resp *http.Response) error {
+	if c == nil || method != "GET" {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		log.Debug("GET %s was not modified, using the cached response\n", redactURL(url))
+		resp.Body.Close()
+		resp.StatusCode, resp.Status = http.StatusOK, "200 OK (cached)"
+		resp.Header.Set("Content-Type", cached.contentType)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(cached.body))
+		c.mutex.Lock()
+		c.hits++
+		c.mutex.Unlock()
+		return nil
+	}
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || etag == "" && lastModified == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.responses[responseKey(url, reqHeaders)] = &cachedResponse{path: urlPath(url), etag: etag,
+		lastModified: lastModified, contentType: resp.Header.Get("Content-Type"), body: body}
+	return nil
+}
+
+// invalidate forgets the responses that a request to change the resource
+// at url may make stale: those of the resource, of the resources below it,
+// and of the collections above it such as the searches of its type.
+func (c *ResponseCache) invalidate(method, url string) {
+	if c == nil {
+		return
+	}
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	path := urlPath(url)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, cached := range c.responses {
+		if cached.path == path || strings.HasPrefix(cached.path, path+"/") ||
+			strings.HasPrefix(path, cached.path+"/") {
+			delete(c.responses, key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "github.com/vmware/priam/testaid"
+	"net/http"
+	"testing"
+)
+
+// etagHandler answers with the ETag of the current version, or 304 if the
+// request has it already
+func etagHandler(version *string, gets *int) TstHandler {
+	return func(t *testing.T, req *TstReq) *TstReply {
+		*gets++
+		etag := `"` + *version + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			return &TstReply{Status: 304}
+		}
+		return &TstReply{Output: `{"version": "` + *version + `"}`, Header: http.Header{"Etag": {etag}}}
+	}
+}
+
+func getVersion(t *testing.T, ctx *HttpContext, path string) string {
+	var outp struct{ Version string }
+	assert.Nil(t, ctx.Request("GET", path, nil, &outp))
+	return outp.Version
+}
+
+func TestRepeatedGetIsAnsweredFromCache(t *testing.T) {
+	version, gets := "1", 0
+	srv := StartTstServer(t, map[string]TstHandler{"GET/items/1": etagHandler(&version, &gets)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetCache(NewResponseCache())
+	assert.Equal(t, "1", getVersion(t, ctx, "items/1"))
+	assert.Equal(t, "1", getVersion(t, ctx.Clone(), "items/1"))
+	version = "2"
+	assert.Equal(t, "2", getVersion(t, ctx, "items/1"))
+	assert.Equal(t, "2", getVersion(t, ctx, "items/1"))
+	assert.Equal(t, 4, gets)
+	hits, conditional := ctx.cache.Stats()
+	assert.Equal(t, 2, hits)
+	assert.Equal(t, 3, conditional)
+}
+
+func TestLastModifiedIsSentIfNoETag(t *testing.T) {
+	const modified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	srv := StartTstServer(t, map[string]TstHandler{"GET/items": func(t *testing.T, req *TstReq) *TstReply {
+		if req.Header.Get("If-Modified-Since") == modified {
+			return &TstReply{Status: 304}
+		}
+		return &TstReply{Output: `{"version": "1"}`, Header: http.Header{"Last-Modified": {modified}}}
+	}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetCache(NewResponseCache())
+	assert.Equal(t, "1", getVersion(t, ctx, "items"))
+	assert.Equal(t, "1", getVersion(t, ctx, "items"))
+	hits, _ := ctx.cache.Stats()
+	assert.Equal(t, 1, hits)
+}
+
+func TestChangeInvalidatesCachedResponses(t *testing.T) {
+	version, gets := "1", 0
+	srv := StartTstServer(t, map[string]TstHandler{
+		"GET/items/1":        etagHandler(&version, &gets),
+		"GET/items?filter=x": etagHandler(&version, &gets),
+		"GET/others":         etagHandler(&version, &gets),
+		"DELETE/items/1":     func(t *testing.T, req *TstReq) *TstReply { return &TstReply{Status: 204} }})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetCache(NewResponseCache())
+	for _, path := range []string{"items/1", "items?filter=x", "others"} {
+		getVersion(t, ctx, path)
+	}
+	assert.Nil(t, ctx.Request("DELETE", "items/1", nil, nil))
+	for _, path := range []string{"items/1", "items?filter=x", "others"} {
+		getVersion(t, ctx, path)
+	}
+	_, conditional := ctx.cache.Stats()
+	assert.Equal(t, 1, conditional, "only the GET of others should be conditional")
+}
+
+func TestResponsesAreCachedByMediaType(t *testing.T) {
+	version, gets := "1", 0
+	srv := StartTstServer(t, map[string]TstHandler{"GET/items/1": etagHandler(&version, &gets)})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "").SetCache(NewResponseCache())
+	getVersion(t, ctx.Accept("json"), "items/1")
+	getVersion(t, ctx.Accept("text/plain"), "items/1")
+	_, conditional := ctx.cache.Stats()
+	assert.Equal(t, 0, conditional)
+}
+
+func TestNoCacheSendsFullRequests(t *testing.T) {
+	version, gets := "1", 0
+	srv := StartTstServer(t, map[string]TstHandler{"GET/items/1": func(t *testing.T, req *TstReq) *TstReply {
+		assert.Empty(t, req.Header.Get("If-None-Match"))
+		return etagHandler(&version, &gets)(t, req)
+	}})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/", "")
+	assert.Equal(t, "1", getVersion(t, ctx, "items/1"))
+	assert.Equal(t, "1", getVersion(t, ctx, "items/1"))
+	hits, conditional := ctx.cache.Stats()
+	assert.Equal(t, 0, hits+conditional)
+}
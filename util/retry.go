@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxAttempts is how many times a request is tried before giving up
+// on transient errors, unless the context is configured otherwise.
+const DefaultMaxAttempts = 4
+
+var (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// sleep waits for the given time unless the context is done first, it is
+// called via variable so that tests can avoid waiting
+var sleep = func(c context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.Done():
+		return c.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Idempotent marks the next request as safe to retry even if its method
+// is POST or PATCH, e.g. because the server ignores duplicate requests.
+func (ctx *HttpContext) Idempotent() *HttpContext {
+	ctx.idempotent = true
+	return ctx
+}
+
+// ErrApplied is returned by a request marked with RetryChecked when it failed
+// but its check found that the server had applied it anyway.
+var ErrApplied = errors.New("the request was applied although it failed")
+
+// RetryChecked marks the next request as safe to retry after a transient
+// error or a timeout, once check has found that it was not applied, e.g. by
+// looking up the resource that a POST creates. The request returns ErrApplied
+// if check finds that it was applied, or an UncertainError if check fails.
+func (ctx *HttpContext) RetryChecked(check func() (applied bool, err error)) *HttpContext {
+	ctx.check = check
+	return ctx
+}
+
+// canRetry returns true if a request with the given method and headers can
+// be sent again without risk of doing the same change twice.
+func (ctx *HttpContext) canRetry(method string, reqHeaders map[string]string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return ctx.idempotent || reqHeaders["If-Match"] != "" || reqHeaders["Idempotency-Key"] != ""
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func retryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter parses the value of a Retry-After header, which can either be
+// a number of seconds or an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryDelay returns how long to wait after the given failed attempt. The
+// server's Retry-After is honored for throttled requests, otherwise the delay
+// grows exponentially with random jitter so that parallel clients spread out.
+func retryDelay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+	d := retryMaxDelay
+	if attempt < 16 && retryBaseDelay<<uint(attempt-1) < retryMaxDelay {
+		d = retryBaseDelay << uint(attempt-1)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// transientWait returns how long to wait before trying a request again if
+// its response or error is transient. The response body is discarded then.
+func (ctx *HttpContext) transientWait(method, url string, attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		if !retryableError(err) {
+			return 0, false
+		}
+		wait := retryDelay(attempt, nil)
+		ctx.Log.Debug("%s request to %s failed: %v, retrying in %v\n", method, url, err, wait)
+		return wait, true
+	}
+	if !retryableStatus(resp.StatusCode) {
+		return 0, false
+	}
+	wait := retryDelay(attempt, resp)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	ctx.Log.Debug("%s request to %s returned %s, retrying in %v\n", method, url, resp.Status, wait)
+	return wait, true
+}
+
+// checkWait returns how long to wait before checking whether a request that
+// cannot be sent again blindly was applied, if it timed out or its response
+// or error is transient.
+func (ctx *HttpContext) checkWait(reqCtx context.Context, method, url string, attempt int, resp *http.Response,
+	err error) (time.Duration, bool) {
+	if err != nil && reqCtx.Err() == context.DeadlineExceeded && ctx.cmdContext.Err() == nil {
+		wait := retryDelay(attempt, nil)
+		ctx.Log.Debug("%s request to %s timed out, checking whether it was applied in %v\n", method, url, wait)
+		return wait, true
+	}
+	return ctx.transientWait(method, url, attempt, resp, err)
+}
@@ -0,0 +1,227 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first requests with the given status, then succeeds
+func flakyServer(t *testing.T, failures, status int, header map[string]string) (*httptest.Server, *int) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			for k, v := range header {
+				w.Header().Set(k, v)
+			}
+			http.Error(w, "try later", status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return srv, &calls
+}
+
+var realSleep = sleep
+
+// stubSleep records waits instead of sleeping until restoreSleep is called
+func stubSleep() *[]time.Duration {
+	waits := []time.Duration{}
+	sleep = func(c context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return &waits
+}
+
+func restoreSleep() {
+	sleep = realSleep
+}
+
+func TestRequestRetriesTransientErrors(t *testing.T) {
+	defer restoreSleep()
+	for _, status := range []int{429, 502, 503, 504} {
+		waits := stubSleep()
+		srv, calls := flakyServer(t, 2, status, nil)
+		ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+		ctx.Log.Level = LDebug
+		output := ""
+		assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+		assert.Equal(t, "ok", output)
+		assert.Equal(t, 3, *calls)
+		assert.Len(t, *waits, 2)
+		assert.Contains(t, ctx.Log.InfoString(), fmt.Sprintf("GET request to %s/ returned %d %s",
+			srv.URL, status, http.StatusText(status)))
+		assert.Contains(t, ctx.Log.InfoString(), "retrying in")
+		srv.Close()
+	}
+}
+
+func TestRequestGivesUpAfterMaxAttempts(t *testing.T) {
+	waits := stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 10, 502, nil)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.MaxAttempts = 3
+	err := ctx.Request("DELETE", "/", nil, nil)
+	assert.Contains(t, err.Error(), "502 Bad Gateway")
+	assert.Equal(t, 3, *calls)
+	assert.Len(t, *waits, 2)
+}
+
+func TestRequestHonorsRetryAfter(t *testing.T) {
+	waits := stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 1, 429, map[string]string{"Retry-After": "7"})
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, []time.Duration{7 * time.Second}, *waits)
+}
+
+func TestRequestDoesNotRetryPost(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 1, 503, nil)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.NotNil(t, ctx.Request("POST", "/", "{}", nil))
+	assert.Equal(t, 1, *calls)
+}
+
+func TestRequestRetriesIdempotentPost(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 2, 503, nil)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.Nil(t, ctx.Idempotent().Request("POST", "/", "{}", nil))
+	assert.Equal(t, 3, *calls)
+	*calls = 0
+	assert.NotNil(t, ctx.Request("POST", "/", "{}", nil), "opt in only applies to one request")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestRequestRetriesPatchWithIfMatch(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 1, 504, nil)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.Nil(t, ctx.Header("If-Match", `W/"3"`).Request("PATCH", "/", "{}", nil))
+	assert.Equal(t, 2, *calls)
+}
+
+// slowCreateServer applies each POST but replies only after the first one
+// has timed out, and counts the resources created
+func slowCreateServer(delay time.Duration) (*httptest.Server, *int32) {
+	created := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&created, 1) == 1 {
+			time.Sleep(delay)
+		}
+		w.WriteHeader(201)
+	}))
+	return srv, &created
+}
+
+func TestCheckedPostTimedOutAfterBeingApplied(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, created := slowCreateServer(200 * time.Millisecond)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Timeout = 50 * time.Millisecond
+	err := ctx.RetryChecked(func() (bool, error) { return atomic.LoadInt32(created) > 0, nil }).Request("POST", "/", "{}", nil)
+	assert.Equal(t, ErrApplied, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(created))
+}
+
+func TestCheckedPostRetriedWhenNotApplied(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, calls := flakyServer(t, 1, 503, nil)
+	defer srv.Close()
+	ctx, checks := NewHttpContext(NewBufferedLogr(), srv.URL, "", ""), 0
+	err := ctx.RetryChecked(func() (bool, error) { checks++; return false, nil }).Request("POST", "/", "{}", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, 1, checks)
+	*calls = 0
+	assert.NotNil(t, ctx.Request("POST", "/", "{}", nil), "check only applies to one request")
+	assert.Equal(t, 1, *calls)
+}
+
+func TestCheckedPostUncertainWhenCheckFails(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	srv, created := slowCreateServer(200 * time.Millisecond)
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Timeout = 50 * time.Millisecond
+	err := ctx.RetryChecked(func() (bool, error) { return false, errors.New("lookup failed") }).
+		Request("POST", "/", "{}", nil)
+	assert.IsType(t, &UncertainError{}, err)
+	assert.Contains(t, err.Error(), "lookup failed")
+	assert.Equal(t, int32(1), atomic.LoadInt32(created))
+}
+
+func TestRequestRetriesClosedConnection(t *testing.T) {
+	waits, calls := stubSleep(), 0
+	defer restoreSleep()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+	assert.Equal(t, 2, calls)
+	assert.Len(t, *waits, 1)
+}
+
+func TestRetryDelayGrowsWithJitter(t *testing.T) {
+	for attempt, max := 1, retryBaseDelay; attempt < 20; attempt, max = attempt+1, max*2 {
+		if max > retryMaxDelay {
+			max = retryMaxDelay
+		}
+		d := retryDelay(attempt, nil)
+		assert.True(t, d >= max/2 && d <= max, "delay %v of attempt %d should be within [%v, %v]", d, attempt, max/2, max)
+	}
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	d, ok := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.True(t, d > 50*time.Second && d <= time.Minute, "delay was %v", d)
+	_, ok = retryAfter("soon")
+	assert.False(t, ok)
+}
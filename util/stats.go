@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestStats counts the requests sent by a command and how long they
+// took, including each attempt of the requests that are retried. It is
+// shared by the copies of a context and safe to use from concurrent requests.
+type RequestStats struct {
+	mutex                      sync.Mutex
+	start                      time.Time
+	retries, failed            int // failed is the attempts without a response
+	clientErrors, serverErrors int
+	latencies                  []time.Duration
+	byPrefix                   map[string]int // requests by method and path prefix
+}
+
+func NewRequestStats() *RequestStats {
+	return &RequestStats{start: now(), byPrefix: make(map[string]int)}
+}
+
+// SetStats makes the context and its copies count their requests in the
+// given stats, or not count them if it is nil.
+func (ctx *HttpContext) SetStats(stats *RequestStats) *HttpContext {
+	ctx.stats = stats
+	return ctx
+}
+
+// pathPrefix returns the first segments of a path without its query and
+// the IDs of resources, such as scim/Users for scim/Users/<id>.
+func pathPrefix(path string) string {
+	segments := strings.Split(strings.Trim(strings.SplitN(path, "?", 2)[0], "/"), "/")
+	if len(segments) > 2 {
+		segments = segments[:2]
+	}
+	return strings.Join(segments, "/")
+}
+
+// record counts an attempt of a request and its latency, the response is
+// nil if the attempt failed without one.
+func (s *RequestStats) record(method, path string, resp *http.Response, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.byPrefix[method+" "+pathPrefix(path)]++
+	s.latencies = append(s.latencies, latency)
+	switch {
+	case resp == nil:
+		s.failed++
+	case resp.StatusCode >= 500:
+		s.serverErrors++
+	case resp.StatusCode >= 400:
+		s.clientErrors++
+	}
+}
+
+// retried counts an attempt that is tried again
+func (s *RequestStats) retried() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.retries++
+	s.mutex.Unlock()
+}
+
+// Requests returns how many requests were sent, each attempt counted.
+func (s *RequestStats) Requests() int {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.latencies)
+}
+
+// percentile returns the latency that p percent of the requests took at
+// most, the mutex must be held.
+func (s *RequestStats) percentile(p int) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*p+99)/100-1]
+}
+
+// Summary returns a line with the counts of requests, retries and errors,
+// the median and 95th percentile of latencies and the time since the
+// stats started.
+func (s *RequestStats) Summary() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	summary := fmt.Sprintf("Requests: %d, retries: %d, 4xx: %d, 5xx: %d", len(s.latencies), s.retries,
+		s.clientErrors, s.serverErrors)
+	if s.failed > 0 {
+		summary += fmt.Sprintf(", no response: %d", s.failed)
+	}
+	return fmt.Sprintf("%s, p50: %v, p95: %v, wall time: %v\n", summary, s.percentile(50).Round(time.Millisecond),
+		s.percentile(95).Round(time.Millisecond), now().Sub(s.start).Round(time.Millisecond))
+}
+
+// Breakdown returns a line for each method and path prefix with the number
+// of requests sent, the most first.
+func (s *RequestStats) Breakdown() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	keys := make([]string, 0, len(s.byPrefix))
+	for k := range s.byPrefix {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if s.byPrefix[keys[i]] != s.byPrefix[keys[j]] {
+			return s.byPrefix[keys[i]] > s.byPrefix[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%6d  %s\n", s.byPrefix[k], k)
+	}
+	return b.String()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPathPrefix(t *testing.T) {
+	assert.Equal(t, "scim/Users", pathPrefix("scim/Users/12?attributes=id"))
+	assert.Equal(t, "scim/Users", pathPrefix("scim/Users?filter=x"))
+	assert.Equal(t, "health", pathPrefix("/health"))
+}
+
+func TestStatsCountRetriesAndErrors(t *testing.T) {
+	defer restoreSleep()
+	stubSleep()
+	srv, _ := flakyServer(t, 2, 503, nil)
+	defer srv.Close()
+	stats := NewRequestStats()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "/api/", "").SetStats(stats)
+	assert.Nil(t, ctx.Request("GET", "scim/Users/1", nil, nil))
+	assert.Nil(t, ctx.Request("POST", "scim/Users", nil, nil))
+	assert.Equal(t, 4, stats.Requests())
+	assert.Contains(t, stats.Summary(), "Requests: 4, retries: 2, 4xx: 0, 5xx: 2, p50: ")
+	assert.Equal(t, "     3  GET scim/Users\n     1  POST scim/Users\n", stats.Breakdown())
+}
+
+func TestStatsOfConcurrentRequests(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	stats := NewRequestStats()
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := &http.Response{StatusCode: 200}
+			if i%10 == 0 {
+				resp.StatusCode = 404
+			}
+			stats.record("GET", "scim/Users", resp, time.Duration(i)*time.Millisecond)
+		}(i)
+	}
+	wg.Wait()
+	now = func() time.Time { return start.Add(3 * time.Second) }
+	assert.Equal(t, "Requests: 100, retries: 0, 4xx: 10, 5xx: 0, p50: 50ms, p95: 95ms, wall time: 3s\n",
+		stats.Summary())
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outcomes of the rows of a bulk command
+const (
+	OutcomeCreated = "created"
+	OutcomeUpdated = "updated"
+	OutcomeDeleted = "deleted"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// RunSummary writes what a bulk command did with each row of its input file
+// to a JSON document: the SHA-256 hash of the file, the target, when the
+// command started and ended, its exit code, the outcome of each row and how
+// many rows had each outcome. Rows are written as they are recorded to a
+// temporary file, so that memory does not grow with them, which replaces
+// the file of the summary once the command ends.
+type RunSummary struct {
+	mutex  sync.Mutex
+	file   *OutputFile
+	rows   int
+	counts map[string]int
+	errors map[string]string // last error logged about each resource, see noteError
+}
+
+// summaryHeader has the fields of a summary known when the command starts
+type summaryHeader struct {
+	Command     string `json:"command"`
+	InputFile   string `json:"inputFile"`
+	InputSHA256 string `json:"inputSha256"`
+	Destination
+	Started string `json:"started"`
+}
+
+// summaryRow is the outcome of a row, numbered from 1
+type summaryRow struct {
+	Row     int    `json:"row"`
+	Name    string `json:"name"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// StartRunSummary starts the summary of a command run on the rows of the
+// input file with the destination of its requests, to be written to fileName
+// once it is finished.
+func StartRunSummary(fileName, command, inputFile string, dest Destination) (*RunSummary, error) {
+	hash, err := fileSHA256(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash input file of summary: %v", err)
+	}
+	header, err := json.Marshal(summaryHeader{command, inputFile, hash, dest,
+		now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		return nil, err
+	}
+	file, err := CreateOutputFile(fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	s := &RunSummary{file: file, counts: map[string]int{}, errors: map[string]string{}}
+	fmt.Fprintf(file, "%s,\n\"rows\": [", bytes.TrimSuffix(header, []byte("}")))
+	return s, nil
+}
+
+// fileSHA256 returns the hex SHA-256 hash of a file
+func fileSHA256(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Row records the outcome of a row, named by the resource it is about. The
+// error of a row that failed or was skipped is err, or else the last error
+// logged about the resource. Rows are not recorded if the summary is nil.
+func (s *RunSummary) Row(row int, name, outcome string, err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := summaryRow{Row: row, Name: name, Outcome: outcome}
+	if err != nil {
+		r.Error = redactText(strings.TrimSpace(err.Error()))
+	} else if outcome == OutcomeFailed || outcome == OutcomeSkipped {
+		r.Error = s.errors[name]
+	}
+	delete(s.errors, name)
+	line, jerr := json.Marshal(r)
+	if jerr != nil {
+		return
+	}
+	sep := ","
+	if s.rows == 0 {
+		sep = ""
+	}
+	fmt.Fprintf(s.file, "%s\n  %s", sep, line)
+	s.rows++
+	s.counts[outcome]++
+}
+
+// noteError remembers the error of a message about a resource, so that the
+// row of the resource has it.
+func (s *RunSummary) noteError(args []interface{}) {
+	if s == nil {
+		return
+	}
+	var name, msg string
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case Resource:
+			name = a.Name
+		case error:
+			msg = redactText(strings.TrimSpace(a.Error()))
+		}
+	}
+	if name != "" && msg != "" {
+		s.mutex.Lock()
+		s.errors[name] = msg
+		s.mutex.Unlock()
+	}
+}
+
+// Finish ends the summary with when the command ended, its exit code and
+// how many rows had each outcome, and replaces the file of the summary.
+func (s *RunSummary) Finish(exitCode int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	counts := map[string]int{"total": s.rows}
+	for outcome, n := range s.counts {
+		counts[outcome] = n
+	}
+	end, err := json.Marshal(map[string]interface{}{"ended": now().UTC().Format(time.RFC3339),
+		"exitCode": exitCode, "counts": counts})
+	if err != nil {
+		s.file.Discard()
+		return err
+	}
+	fmt.Fprintf(s.file, "\n],\n%s\n", bytes.TrimPrefix(end, []byte("{")))
+	if err = s.file.Commit(); err != nil {
+		return fmt.Errorf("could not write summary: %v", err)
+	}
+	return nil
+}
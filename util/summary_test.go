@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunSummaryWritesRowsOnceFinished(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC) }
+	dir, err := ioutil.TempDir("", "priam-summary")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	input, summaryFile := filepath.Join(dir, "users.yaml"), filepath.Join(dir, "summary.json")
+	require.Nil(t, ioutil.WriteFile(input, []byte("- {name: joe}\n"), 0600))
+	s, err := StartRunSummary(summaryFile, "user load", input,
+		Destination{"prod", "https://prod.example.com", "admin@acme", "priam-cli"})
+	require.Nil(t, err)
+	log := NewBufferedLogr()
+	log.Summary = s
+	log.Err("Error creating user '%s': %v\n", Named("Users", "sue"), errors.New("409 Conflict: password=secret"))
+	s.Row(1, "joe", OutcomeCreated, nil)
+	s.Row(2, "sue", OutcomeFailed, nil)
+	s.Row(3, "ann", OutcomeSkipped, errors.New("not attempted"))
+	_, err = os.Stat(summaryFile)
+	assert.True(t, os.IsNotExist(err), "the summary is only written once finished")
+	require.Nil(t, s.Finish(ExitPartial))
+
+	var summary struct {
+		Command, InputFile, InputSHA256, Target, Tenant, Principal, Client, Started, Ended string
+		ExitCode                                                                           int
+		Rows                                                                               []summaryRow
+		Counts                                                                             map[string]int
+	}
+	content, err := ioutil.ReadFile(summaryFile)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(content, &summary), string(content))
+	assert.Equal(t, "user load", summary.Command)
+	assert.Equal(t, input, summary.InputFile)
+	assert.Equal(t, "8d02fb0681e60318c47d1acf04a76295b0923d014b3d18ed68e4eae919c697b0", summary.InputSHA256)
+	assert.Equal(t, "prod", summary.Target)
+	assert.Equal(t, "admin@acme", summary.Principal)
+	assert.Equal(t, "priam-cli", summary.Client)
+	assert.Equal(t, "2020-01-31T12:00:00Z", summary.Started)
+	assert.Equal(t, "2020-01-31T12:00:00Z", summary.Ended)
+	assert.Equal(t, ExitPartial, summary.ExitCode)
+	assert.Equal(t, []summaryRow{{1, "joe", OutcomeCreated, ""}, {2, "sue", OutcomeFailed, "409 Conflict: password=" +
+		redacted}, {3, "ann", OutcomeSkipped, "not attempted"}}, summary.Rows)
+	assert.Equal(t, map[string]int{"total": 3, "created": 1, "failed": 1, "skipped": 1}, summary.Counts)
+}
+
+func TestRunSummaryWithoutRows(t *testing.T) {
+	input, err := ioutil.TempFile("", "priam-summary")
+	require.Nil(t, err)
+	input.Close()
+	defer os.Remove(input.Name())
+	summaryFile := input.Name() + ".summary.json"
+	defer os.Remove(summaryFile)
+	s, err := StartRunSummary(summaryFile, "user delete-all", input.Name(), Destination{})
+	require.Nil(t, err)
+	require.Nil(t, s.Finish(ExitInterrupted))
+	var summary map[string]interface{}
+	content, err := ioutil.ReadFile(summaryFile)
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(content, &summary), string(content))
+	assert.Equal(t, []interface{}{}, summary["rows"])
+	assert.Equal(t, float64(ExitInterrupted), summary["exitCode"])
+}
+
+func TestRowsOfNilSummaryAreIgnored(t *testing.T) {
+	var s *RunSummary
+	s.Row(1, "joe", OutcomeCreated, nil)
+	NewBufferedLogr().Err("Error creating user '%s': %v\n", Named("Users", "joe"), errors.New("conflict"))
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultTimeout is how long a request may take, including reading the
+// response body, unless the context is configured otherwise.
+const DefaultTimeout = 60 * time.Second
+
+// ErrCanceled is returned by requests that were canceled before they
+// completed, for example because the user interrupted the command.
+var ErrCanceled = errors.New("request canceled")
+
+// TimeoutError is returned by requests that did not complete in time.
+type TimeoutError struct {
+	Method, URL string
+	Timeout     time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s request to %s timed out after %v", e.Method, e.URL, e.Timeout)
+}
+
+// WithContext sets the context that cancels all requests made with this
+// http context when it is done.
+func (ctx *HttpContext) WithContext(c context.Context) *HttpContext {
+	ctx.cmdContext = c
+	return ctx
+}
+
+// WithStop sets the context that is done when the command is interrupted.
+// Loops then stop starting requests, while the requests in flight go on
+// until the context of WithContext is done.
+func (ctx *HttpContext) WithStop(c context.Context) *HttpContext {
+	ctx.stopContext = c
+	return ctx
+}
+
+// Canceled returns true once the command is interrupted or the context of
+// the requests is done. Loops that make many requests check it to stop early.
+func (ctx *HttpContext) Canceled() bool {
+	return ctx.stopContext.Err() != nil || ctx.cmdContext.Err() != nil
+}
+
+func (ctx *HttpContext) requestContext() (context.Context, context.CancelFunc) {
+	if ctx.Timeout <= 0 {
+		return context.WithCancel(ctx.cmdContext)
+	}
+	return context.WithTimeout(ctx.cmdContext, ctx.Timeout)
+}
+
+// requestError replaces the error of a request that failed because it was
+// canceled or timed out with one that says so.
+func (ctx *HttpContext) requestError(reqCtx context.Context, method, url string, err error) error {
+	if err == nil || reqCtx.Err() == nil {
+		return err
+	}
+	if ctx.cmdContext.Err() != nil {
+		return ErrCanceled
+	}
+	if reqCtx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{method, url, ctx.Timeout}
+	}
+	return err
+}
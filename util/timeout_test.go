@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimesOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Timeout = 50 * time.Millisecond
+	err := ctx.Request("GET", "/slow", nil, nil)
+	assert.IsType(t, &TimeoutError{}, err)
+	assert.EqualError(t, err, "GET request to "+srv.URL+"/slow timed out after 50ms")
+}
+
+func TestRequestTimeoutIncludesReadingBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [`))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`]}`))
+	}))
+	defer srv.Close()
+	ctx, output := NewHttpContext(NewBufferedLogr(), srv.URL, "", ""), ""
+	ctx.Timeout = 50 * time.Millisecond
+	assert.IsType(t, &TimeoutError{}, ctx.Request("GET", "/", nil, &output))
+}
+
+func TestRequestCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	cmdContext, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").WithContext(cmdContext)
+	assert.True(t, ctx.Canceled())
+	assert.Equal(t, ErrCanceled, ctx.Request("GET", "/", nil, nil))
+}
+
+func TestStopLetsRequestsComplete(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	stopContext, stop := context.WithCancel(context.Background())
+	stop()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").WithStop(stopContext)
+	assert.True(t, ctx.Canceled())
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+}
+
+func TestCancelStopsRetryWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "try later", 503)
+	}))
+	defer srv.Close()
+	cmdContext, cancel := context.WithCancel(context.Background())
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "").WithContext(cmdContext)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	assert.Equal(t, ErrCanceled, ctx.Request("GET", "/", nil, nil))
+	assert.True(t, time.Since(start) < retryBaseDelay*2, "request should stop waiting when canceled")
+}
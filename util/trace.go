@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultTraceBodyLimit is how many bytes of a request or response body are
+// traced, unless the context is configured otherwise.
+const DefaultTraceBodyLimit = 4096
+
+const redacted = "[REDACTED]"
+
+// sensitiveKey returns true if values of the given header, parameter or
+// JSON key are secrets that must not be traced.
+func sensitiveKey(key string) bool {
+	k := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	return k == "pwd" || k == "authorization" || k == "proxyauthorization" || k == "cookie" || k == "setcookie" ||
+		strings.HasSuffix(k, "password") || strings.HasSuffix(k, "secret") || strings.HasSuffix(k, "token")
+}
+
+// redactHeader hides the credentials of authorization headers but keeps
+// their scheme, e.g. "Bearer [REDACTED]", since it helps debugging.
+func redactHeader(name, value string) string {
+	if !sensitiveKey(name) {
+		return value
+	}
+	if scheme := strings.SplitN(value, " ", 2); len(scheme) == 2 && strings.Contains(strings.ToLower(name), "authorization") {
+		return scheme[0] + " " + redacted
+	}
+	return redacted
+}
+
+func redactValues(vals url.Values, extraKeys ...string) url.Values {
+	for k := range vals {
+		if sensitiveKey(k) || HasString(strings.ToLower(k), extraKeys) {
+			vals[k] = []string{redacted}
+		}
+	}
+	return vals
+}
+
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	vals, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return rawURL
+	}
+	u.RawQuery = redactValues(vals).Encode()
+	return u.String()
+}
+
+func redactJSON(input interface{}) interface{} {
+	switch inp := input.(type) {
+	case []interface{}:
+		for i, v := range inp {
+			inp[i] = redactJSON(v)
+		}
+	case map[string]interface{}:
+		for k, v := range inp {
+			if sensitiveKey(k) {
+				inp[k] = redacted
+			} else {
+				inp[k] = redactJSON(v)
+			}
+		}
+	}
+	return input
+}
+
+// redactBody returns a printable body with secrets hidden. Form bodies also
+// hide authorization codes and assertions. Bodies that cannot be parsed are
+// printed as they are.
+func redactBody(contentType string, body []byte) string {
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		if vals, err := url.ParseQuery(string(body)); err == nil {
+			return redactValues(vals, "code", "assertion").Encode()
+		}
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		return ToStringWithStyle(LJson, redactJSON(parsed))
+	}
+	return string(body)
+}
+
+func truncateBody(body string, limit int) string {
+	if limit <= 0 || len(body) <= limit {
+		return body
+	}
+	return fmt.Sprintf("%s\n... (%d more bytes not traced)", body[:limit], len(body)-limit)
+}
+
+func (ctx *HttpContext) traceHeaders(prefix string, hdrs http.Header) {
+	ctx.Log.Trace("%s:\n", prefix)
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for _, v := range hdrs[k] {
+			ctx.Log.Trace("  %v: %v\n", k, redactHeader(k, v))
+		}
+	}
+}
+
+func (ctx *HttpContext) traceBody(prefix, contentType string, body []byte) {
+	if len(body) > 0 {
+		ctx.Log.Trace("%s:\n%s\n", prefix, truncateBody(redactBody(contentType, body), ctx.TraceBodyLimit))
+	}
+}
+
+func (ctx *HttpContext) traceRequest(req *http.Request, body []byte) {
+	if ctx.Log.TraceOn {
+		ctx.Log.Trace("%s request to : %v\n", req.Method, redactURL(req.URL.String()))
+		ctx.traceHeaders("request headers", req.Header)
+		ctx.traceBody("request body", req.Header.Get("Content-Type"), body)
+	}
+}
+
+func (ctx *HttpContext) traceResponse(resp *http.Response, body []byte) {
+	ctx.har.received(resp, body)
+	if ctx.Log.TraceOn {
+		ctx.Log.Trace("response status: %v\n", resp.Status)
+		ctx.traceHeaders("response headers", resp.Header)
+		ctx.traceBody("response body", resp.Header.Get("Content-Type"), body)
+	}
+}
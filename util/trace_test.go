@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var secrets = []string{"secret-token-123", "hunter2", "s3cr3t", "issued-token", "session-cookie", "the-auth-code",
+	"sts-token", "dXNlcjpwd2Q="}
+
+func assertNoSecrets(t *testing.T, trace string) {
+	for _, secret := range secrets {
+		assert.NotContains(t, trace, secret)
+	}
+}
+
+func traceServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "JSESSIONID=session-cookie")
+		w.Write([]byte(`{"access_token": "issued-token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+}
+
+func TestTraceRedactsJSONRequestAndResponse(t *testing.T) {
+	srv := traceServer()
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Log.TraceOn = true
+	ctx.Authorization("Bearer secret-token-123").ContentType("application/json")
+	input := `{"userName": "joe", "password": "hunter2", "meta": [{"client_secret": "s3cr3t"}]}`
+	assert.Nil(t, ctx.Request("POST", "/scim/Users?WebIdentityToken=sts-token&count=1", input, nil))
+	trace := ctx.Log.ErrString()
+	assertNoSecrets(t, trace)
+	assert.Empty(t, ctx.Log.InfoString(), "trace should not go to stdout")
+	assert.Contains(t, trace, "POST request to : "+srv.URL+"/scim/Users?WebIdentityToken=%5BREDACTED%5D&count=1")
+	assert.Contains(t, trace, "  Authorization: Bearer [REDACTED]\n")
+	assert.Contains(t, trace, `"userName": "joe"`)
+	assert.Contains(t, trace, `"password": "[REDACTED]"`)
+	assert.Contains(t, trace, `"client_secret": "[REDACTED]"`)
+	assert.Contains(t, trace, "response status: 200 OK\n")
+	assert.Contains(t, trace, "  Set-Cookie: [REDACTED]\n")
+	assert.Contains(t, trace, `"access_token": "[REDACTED]"`)
+	assert.Contains(t, trace, `"token_type": "Bearer"`)
+}
+
+func TestTraceRedactsFormRequest(t *testing.T) {
+	srv := traceServer()
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Log.TraceOn = true
+	ctx.BasicAuth("user", "pwd").ContentType("application/x-www-form-urlencoded")
+	assert.Nil(t, ctx.Request("POST", "/token", "grant_type=authorization_code&code=the-auth-code&client_secret=s3cr3t", nil))
+	trace := ctx.Log.ErrString()
+	assertNoSecrets(t, trace)
+	assert.Contains(t, trace, "  Authorization: Basic [REDACTED]\n")
+	assert.Contains(t, trace, "client_secret=%5BREDACTED%5D&code=%5BREDACTED%5D&grant_type=authorization_code")
+}
+
+func TestTraceTruncatesLargeBodies(t *testing.T) {
+	srv := traceServer()
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	ctx.Log.TraceOn, ctx.TraceBodyLimit = true, 20
+	assert.Nil(t, ctx.ContentType("text/plain").Request("PUT", "/", strings.Repeat("x", 100), nil))
+	assert.Contains(t, ctx.Log.ErrString(), "request body:\n"+strings.Repeat("x", 20)+"\n... (80 more bytes not traced)\n")
+}
+
+func TestNoTraceWhenOff(t *testing.T) {
+	srv := traceServer()
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestSensitiveKey(t *testing.T) {
+	for _, k := range []string{"password", "Password", "pwd", "client_secret", "clientSecret", "access_token",
+		"refresh_token", "id_token", "WebIdentityToken", "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"} {
+		assert.True(t, sensitiveKey(k), k)
+	}
+	for _, k := range []string{"userName", "token_type", "tokenType", "Content-Type", "code", "expires_in"} {
+		assert.False(t, sensitiveKey(k), k)
+	}
+}
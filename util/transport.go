@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// TransportOptions define how the connections of an http context are made.
+type TransportOptions struct {
+	CAFile            string // PEM file of the certificate authorities to trust in addition to the system ones
+	CertFile, KeyFile string // PEM files of the client certificate and its key, for mutual TLS
+	Insecure          bool   // do not verify the server certificate
+	ProxyURL          string // proxy for all requests, HTTPS_PROXY and NO_PROXY are used if empty
+}
+
+func newTransport(opts TransportOptions) (*http.Transport, error) {
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: opts.Insecure}}
+	if opts.ProxyURL != "" {
+		proxy, err := url.Parse(opts.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL \"%s\"", opts.ProxyURL)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("both a client certificate and its key must be given")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tr, nil
+}
+
+// SetTransport configures the connections of all requests made with this
+// context. It is meant to be called once, before the first request.
+func (ctx *HttpContext) SetTransport(opts TransportOptions) error {
+	tr, err := newTransport(opts)
+	if err != nil {
+		return err
+	}
+	if opts.Insecure {
+		ctx.Log.Warn("server certificates are not verified, connections to %s are NOT secure\n", ctx.HostURL)
+	}
+	ctx.client.Transport = tr
+	return nil
+}
+
+// SetRoundTripper sends the requests of the context with rt rather than
+// over the network, so that tests can answer them with canned responses.
+// Requests are still retried, traced and audited as usual.
+func (ctx *HttpContext) SetRoundTripper(rt http.RoundTripper) *HttpContext {
+	ctx.client.Transport = rt
+	return ctx
+}
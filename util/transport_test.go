@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2016 VMware, Inc. All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	. "github.com/vmware/priam/testaid"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func pemFile(t *testing.T, blockType string, der []byte) *os.File {
+	return WriteTempFile(t, string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})))
+}
+
+// selfSignedCert returns a new certificate for client authentication and its key as PEM files
+func selfSignedCert(t *testing.T) (cert *x509.Certificate, certFile, keyFile *os.File) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "priam test client"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	return cert, pemFile(t, "CERTIFICATE", der), pemFile(t, "EC PRIVATE KEY", keyDer)
+}
+
+func TestSelfSignedServerFailsByDefault(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	err := ctx.Request("GET", "/", nil, nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
+func TestTrustServerWithCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer srv.Close()
+	caFile := pemFile(t, "CERTIFICATE", srv.Certificate().Raw)
+	defer CleanupTempFile(caFile)
+	ctx, output := NewHttpContext(NewBufferedLogr(), srv.URL, "", ""), ""
+	require.Nil(t, ctx.SetTransport(TransportOptions{CAFile: caFile.Name()}))
+	assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+	assert.Equal(t, "ok", output)
+	assert.Empty(t, ctx.Log.ErrString())
+}
+
+func TestInsecureSkipsVerificationWithWarning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(okHandler))
+	defer srv.Close()
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	require.Nil(t, ctx.SetTransport(TransportOptions{Insecure: true}))
+	assert.Nil(t, ctx.Request("GET", "/", nil, nil))
+	assert.Contains(t, ctx.Log.ErrString(), "WARNING: server certificates are not verified")
+}
+
+func TestClientCertificate(t *testing.T) {
+	cert, certFile, keyFile := selfSignedCert(t)
+	defer CleanupTempFile(certFile)
+	defer CleanupTempFile(keyFile)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(okHandler))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := pemFile(t, "CERTIFICATE", srv.Certificate().Raw)
+	defer CleanupTempFile(caFile)
+
+	ctx := NewHttpContext(NewBufferedLogr(), srv.URL, "", "")
+	require.Nil(t, ctx.SetTransport(TransportOptions{CAFile: caFile.Name()}))
+	assert.NotNil(t, ctx.Request("GET", "/", nil, nil), "server should require a client certificate")
+
+	ctx, output := NewHttpContext(NewBufferedLogr(), srv.URL, "", ""), ""
+	require.Nil(t, ctx.SetTransport(TransportOptions{CAFile: caFile.Name(),
+		CertFile: certFile.Name(), KeyFile: keyFile.Name()}))
+	assert.Nil(t, ctx.Request("GET", "/", nil, &output))
+	assert.Equal(t, "ok", output)
+}
+
+func TestExplicitProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via proxy to " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	ctx, output := NewHttpContext(NewBufferedLogr(), "http://tenant.example.com", "", ""), ""
+	require.Nil(t, ctx.SetTransport(TransportOptions{ProxyURL: proxy.URL}))
+	assert.Nil(t, ctx.Request("GET", "/health", nil, &output))
+	assert.Equal(t, "via proxy to http://tenant.example.com/health", output)
+}
+
+func TestInvalidTransportOptions(t *testing.T) {
+	badPem := WriteTempFile(t, "not a certificate")
+	defer CleanupTempFile(badPem)
+	for opts, expected := range map[TransportOptions]string{
+		{ProxyURL: "::not a url"}:                         `invalid proxy URL "::not a url"`,
+		{CAFile: "does-not-exist.pem"}:                    "could not read CA file",
+		{CAFile: badPem.Name()}:                           "no certificates found in CA file",
+		{CertFile: badPem.Name()}:                         "both a client certificate and its key must be given",
+		{CertFile: badPem.Name(), KeyFile: badPem.Name()}: "could not load client certificate",
+	} {
+		ctx := NewHttpContext(NewBufferedLogr(), "https://tenant.example.com", "", "")
+		err := ctx.SetTransport(opts)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), expected)
+	}
+}